@@ -0,0 +1,403 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"toolkit"
+)
+
+const (
+	maxTitleLength       = 256
+	maxDescriptionLength = 16 * 1024
+	maxPayloadSize       = 256 * 1024
+	maxOptions           = 10
+	maxOptionLength      = 64
+	maxCommentLength     = 4096
+	defaultListLimit     = 50
+	maxListLimit         = 500
+	maxWait              = 5 * time.Minute
+	// maxUpdateAttempts bounds the compare-and-set retries of a change to an approval
+	maxUpdateAttempts = 5
+)
+
+// The statuses of an approval. Only a pending approval can be decided or cancelled.
+const (
+	statusPending   = "pending"
+	statusDecided   = "decided"
+	statusExpired   = "expired"
+	statusCancelled = "cancelled"
+)
+
+var (
+	defaultOptions = []string{"approve", "reject"}
+	// IDs are keys and part of links
+	idPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+// Approval is a request for a human to sign off on something an agent wants to do, by
+// choosing one of its options before it expires
+type Approval struct {
+	ID          string   `json:"id"`
+	Title       string   `json:"title"`
+	Description string   `json:"description,omitempty"`
+	Payload     string   `json:"payload,omitempty"`
+	Options     []string `json:"options"`
+	Status      string   `json:"status"`
+	// Decision is the option chosen, and Comment and DecidedBy what the human added to it
+	Decision  string     `json:"decision,omitempty"`
+	Comment   string     `json:"comment,omitempty"`
+	DecidedBy string     `json:"decided_by,omitempty"`
+	Created   time.Time  `json:"created"`
+	Expires   time.Time  `json:"expires"`
+	Decided   *time.Time `json:"decided,omitempty"`
+	// URL is the signed link to decide the approval with. It is not stored, as the public
+	// URL of the server can change.
+	URL string `json:"url,omitempty"`
+}
+
+type SubmitRequest struct {
+	Title       string             `json:"title"`
+	Description string             `json:"description,omitempty"`
+	Payload     payload            `json:"payload,omitempty"`
+	Options     toolkit.StringList `json:"options,omitempty"`
+	// ExpiresIn is how long the approval waits for a decision
+	ExpiresIn toolkit.Duration `json:"expires_in,omitempty"`
+	// ID makes submitting idempotent: submitting an ID again returns the approval it names
+	ID string `json:"id,omitempty"`
+}
+
+type GetRequest struct {
+	ID string `json:"id"`
+	// Wait is how long to wait for a decision while the approval is pending
+	Wait toolkit.Duration `json:"wait,omitempty"`
+}
+
+type ListRequest struct {
+	Status string      `json:"status,omitempty"`
+	Limit  toolkit.Int `json:"limit,omitempty"`
+}
+
+type CancelRequest struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// expire marks a pending approval past its expiry as expired. Expiry isn't stored, so it
+// applies as soon as it is due.
+func (a *Approval) expire(now time.Time) {
+	if a.Status == statusPending && !now.Before(a.Expires) {
+		a.Status = statusExpired
+	}
+}
+
+// withURL returns the approval with its link when it can still be decided
+func (s *Server) withURL(prefix string, approval *Approval) *Approval {
+	if approval.Status == statusPending {
+		approval.URL = s.publicURL + s.signer.sign(approvalPath(prefix, approval.ID))
+	}
+	return approval
+}
+
+func approvalPath(prefix, id string) string {
+	return "/approvals/" + prefix + "/" + id
+}
+
+func validateID(id string) error {
+	if !idPattern.MatchString(id) {
+		return fmt.Errorf("invalid id %q, ids are 1 to 64 letters, digits, - and _", id)
+	}
+	return nil
+}
+
+// getApproval loads an approval with its revision
+func getApproval(bucket nats.KeyValue, id string) (*Approval, uint64, error) {
+	entry, err := bucket.Get(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	var approval Approval
+	if err := json.Unmarshal(entry.Value(), &approval); err != nil {
+		return nil, 0, fmt.Errorf("invalid approval %s: %v", id, err)
+	}
+	approval.expire(time.Now())
+	return &approval, entry.Revision(), nil
+}
+
+// resolve moves a pending approval to its final status with change, which fails with a
+// conflict once it was resolved. Concurrent decisions are settled by the revision, so only
+// the first one counts.
+func resolve(bucket nats.KeyValue, id string, change func(*Approval) error) (*Approval, int, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		approval, revision, err := getApproval(bucket, id)
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			return nil, http.StatusNotFound, fmt.Errorf("approval %s does not exist", id)
+		}
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if approval.Status != statusPending {
+			return approval, http.StatusConflict, fmt.Errorf("approval %s is already %s", id, approval.Status)
+		}
+		if err := change(approval); err != nil {
+			return approval, http.StatusBadRequest, err
+		}
+		data, _ := json.Marshal(approval)
+		if _, err := bucket.Update(id, data, revision); errors.Is(err, nats.ErrKeyExists) {
+			continue
+		} else if err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("failed to update approval %s: %v", id, err)
+		}
+		return approval, http.StatusOK, nil
+	}
+	return nil, http.StatusConflict, fmt.Errorf("approval %s is changing concurrently, try again", id)
+}
+
+// waitForDecision watches a pending approval until it is resolved, it expires or wait
+// passes, and returns it as it is then
+func waitForDecision(ctx context.Context, bucket nats.KeyValue, approval *Approval, wait time.Duration) (*Approval, error) {
+	// The watch starts with the current value, so a decision made since the approval was
+	// loaded isn't missed
+	watcher, err := bucket.Watch(approval.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch approval %s: %v", approval.ID, err)
+	}
+	defer watcher.Stop()
+	timer := time.NewTimer(min(wait, time.Until(approval.Expires)))
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return approval, nil
+		case <-timer.C:
+			approval.expire(time.Now())
+			return approval, nil
+		case entry, ok := <-watcher.Updates():
+			if !ok {
+				return approval, nil
+			}
+			if entry == nil {
+				continue
+			}
+			if entry.Operation() != nats.KeyValuePut {
+				return nil, nats.ErrKeyNotFound
+			}
+			var updated Approval
+			if err := json.Unmarshal(entry.Value(), &updated); err != nil {
+				return nil, fmt.Errorf("invalid approval %s: %v", approval.ID, err)
+			}
+			approval = &updated
+			approval.expire(time.Now())
+			if approval.Status != statusPending {
+				return approval, nil
+			}
+		}
+	}
+}
+
+// handleSubmit submits an approval for a human to decide through its link
+func (s *Server) handleSubmit(w http.ResponseWriter, r *http.Request) {
+	var req SubmitRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if err := req.validate(s.maxExpiry); err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	prefix := getPrefixFromEnv(r.Header)
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	now := time.Now().UTC()
+	approval := Approval{
+		ID:          req.ID,
+		Title:       req.Title,
+		Description: req.Description,
+		Payload:     string(req.Payload),
+		Options:     req.Options,
+		Status:      statusPending,
+		Created:     now,
+		Expires:     now.Add(s.defaultExpiry),
+	}
+	if approval.ID == "" {
+		approval.ID = nuid.Next()
+	}
+	if len(approval.Options) == 0 {
+		approval.Options = defaultOptions
+	}
+	if req.ExpiresIn > 0 {
+		approval.Expires = now.Add(time.Duration(req.ExpiresIn))
+	}
+	data, _ := json.Marshal(approval)
+	if _, err := bucket.Create(approval.ID, data); errors.Is(err, nats.ErrKeyExists) {
+		existing, _, err := getApproval(bucket, approval.ID)
+		if err != nil {
+			toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: s.withURL(prefix, existing)})
+		return
+	} else if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to submit approval: %v", err))
+		return
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: s.withURL(prefix, &approval)})
+}
+
+func (req SubmitRequest) validate(maxExpiry time.Duration) error {
+	if req.ID != "" {
+		if err := validateID(req.ID); err != nil {
+			return err
+		}
+	}
+	switch {
+	case req.Title == "" || len(req.Title) > maxTitleLength:
+		return fmt.Errorf("title is required and can be at most %d characters", maxTitleLength)
+	case len(req.Description) > maxDescriptionLength:
+		return fmt.Errorf("description can be at most %d characters", maxDescriptionLength)
+	case len(req.Payload) > maxPayloadSize:
+		return fmt.Errorf("payload can be at most %d bytes", maxPayloadSize)
+	case len(req.Options) == 1 || len(req.Options) > maxOptions:
+		return fmt.Errorf("between 2 and %d options are required", maxOptions)
+	case req.ExpiresIn < 0 || time.Duration(req.ExpiresIn) > maxExpiry:
+		return fmt.Errorf("expires_in can be at most %s", maxExpiry)
+	}
+	for i, option := range req.Options {
+		if option == "" || len(option) > maxOptionLength {
+			return fmt.Errorf("options must be 1 to %d characters", maxOptionLength)
+		}
+		if slices.Contains(req.Options[:i], option) {
+			return fmt.Errorf("option %q is given twice", option)
+		}
+	}
+	return nil
+}
+
+// handleGet returns an approval, optionally waiting for it to be decided
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	var req GetRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if err := validateID(req.ID); err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Wait < 0 || time.Duration(req.Wait) > maxWait {
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("wait can be at most %s", maxWait))
+		return
+	}
+	prefix := getPrefixFromEnv(r.Header)
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	approval, _, err := getApproval(bucket, req.ID)
+	if err == nil && approval.Status == statusPending && req.Wait > 0 {
+		approval, err = waitForDecision(r.Context(), bucket, approval, time.Duration(req.Wait))
+	}
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		toolkit.WriteError(w, http.StatusNotFound, fmt.Sprintf("approval %s does not exist", req.ID))
+		return
+	}
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: s.withURL(prefix, approval)})
+}
+
+// handleList lists the approvals of the workspace, newest first
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	var req ListRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = defaultListLimit
+	}
+	switch {
+	case !slices.Contains([]string{"", statusPending, statusDecided, statusExpired, statusCancelled}, req.Status):
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid status %q, expected pending, decided, expired or cancelled", req.Status))
+		return
+	case req.Limit < 1 || req.Limit > maxListLimit:
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxListLimit))
+		return
+	}
+	prefix := getPrefixFromEnv(r.Header)
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	keys, err := bucket.Keys()
+	if err != nil && !errors.Is(err, nats.ErrNoKeysFound) {
+		toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to list approvals: %v", err))
+		return
+	}
+	approvals := []*Approval{}
+	for _, key := range keys {
+		approval, _, err := getApproval(bucket, key)
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if req.Status == "" || approval.Status == req.Status {
+			approvals = append(approvals, s.withURL(prefix, approval))
+		}
+	}
+	slices.SortFunc(approvals, func(a, b *Approval) int { return b.Created.Compare(a.Created) })
+	if len(approvals) > int(req.Limit) {
+		approvals = approvals[:req.Limit]
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: approvals})
+}
+
+// handleCancel withdraws a pending approval, so it can no longer be decided
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
+	var req CancelRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if err := validateID(req.ID); err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if len(req.Reason) > maxCommentLength {
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("reason can be at most %d characters", maxCommentLength))
+		return
+	}
+	bucket, err := s.getBucket(getPrefixFromEnv(r.Header))
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	approval, status, err := resolve(bucket, req.ID, func(approval *Approval) error {
+		now := time.Now().UTC()
+		approval.Status = statusCancelled
+		approval.Comment = req.Reason
+		approval.Decided = &now
+		return nil
+	})
+	if err != nil {
+		toolkit.WriteError(w, status, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: approval})
+}
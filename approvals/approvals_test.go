@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"toolkit"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	ns, err := server.NewServer(&server.Options{DontListen: true, NoSigs: true, JetStream: true, StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(4 * time.Second) {
+		t.Fatal("failed to start the NATS server")
+	}
+	nc, err := nats.Connect("", nats.InProcessServer(ns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(s)
+	// Links point at the test server
+	s.publicURL = httpServer.URL
+	t.Cleanup(func() {
+		httpServer.Close()
+		nc.Close()
+		ns.Shutdown()
+	})
+	return httpServer
+}
+
+// call posts a request as a workspace and decodes the approval it returns
+func call(t *testing.T, url, workspace, path string, body interface{}) (int, *Approval) {
+	t.Helper()
+	data, _ := json.Marshal(body)
+	req, _ := http.NewRequest(http.MethodPost, url+path, bytes.NewReader(data))
+	req.Header.Set("X-GPTScript-Env", "GPTSCRIPT_WORKSPACE_ID="+workspace)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var response struct {
+		Data *Approval `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&response)
+	return resp.StatusCode, response.Data
+}
+
+func TestValidateSubmit(t *testing.T) {
+	valid := SubmitRequest{Title: "Deploy", Options: toolkit.StringList{"ship", "hold", "rollback"}, ExpiresIn: toolkit.Duration(time.Hour)}
+	if err := valid.validate(24 * time.Hour); err != nil {
+		t.Errorf("validate failed: %v", err)
+	}
+	for name, req := range map[string]SubmitRequest{
+		"no title":         {},
+		"one option":       {Title: "a", Options: toolkit.StringList{"ok"}},
+		"duplicate option": {Title: "a", Options: toolkit.StringList{"ok", "ok"}},
+		"empty option":     {Title: "a", Options: toolkit.StringList{"ok", ""}},
+		"long expiry":      {Title: "a", ExpiresIn: toolkit.Duration(48 * time.Hour)},
+		"invalid id":       {Title: "a", ID: "a/b"},
+		"large payload":    {Title: "a", Payload: make(payload, maxPayloadSize+1)},
+	} {
+		if err := req.validate(24 * time.Hour); err == nil {
+			t.Errorf("validate with %s succeeded, want an error", name)
+		}
+	}
+}
+
+func TestSigner(t *testing.T) {
+	signer := &urlSigner{key: []byte("secret")}
+	link, _ := url.Parse(signer.sign("/approvals/abc/1"))
+	if !signer.verify(link.Path, link.Query().Get("signature")) {
+		t.Error("verify rejected a signed link")
+	}
+	if signer.verify("/approvals/abc/2", link.Query().Get("signature")) || signer.verify(link.Path, "") {
+		t.Error("verify accepted a link that wasn't signed")
+	}
+}
+
+func TestDecideWithForm(t *testing.T) {
+	srv := newTestServer(t)
+	status, approval := call(t, srv.URL, "ws1", "/api/v1/submit", map[string]interface{}{"title": "Delete <prod> database", "payload": map[string]string{"db": "prod"}, "id": "drop-1"})
+	if status != http.StatusOK || approval.Status != statusPending || len(approval.Options) != 2 || !strings.HasPrefix(approval.URL, srv.URL+"/approvals/") {
+		t.Fatalf("submit failed: %d %+v", status, approval)
+	}
+	if _, again := call(t, srv.URL, "ws1", "/api/v1/submit", map[string]string{"title": "Other", "id": "drop-1"}); again.Title != approval.Title {
+		t.Errorf("resubmitting an id returned %+v", again)
+	}
+
+	resp, err := http.Get(approval.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(page), "Delete &lt;prod&gt; database") || !strings.Contains(string(page), `value="approve"`) {
+		t.Fatalf("unexpected page %d %s", resp.StatusCode, page)
+	}
+	if resp, _ := http.Get(strings.Replace(approval.URL, "drop-1", "drop-2", 1)); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("a link with another id returned %d, want 403", resp.StatusCode)
+	}
+
+	// A long poll returns once the human decides
+	decided := make(chan *Approval, 1)
+	go func() {
+		_, approval := call(t, srv.URL, "ws1", "/api/v1/get", map[string]string{"id": "drop-1", "wait": "10s"})
+		decided <- approval
+	}()
+	time.Sleep(200 * time.Millisecond)
+	resp, err = http.PostForm(approval.URL, url.Values{"decision": {"reject"}, "comment": {"not today"}, "decided_by": {"sam"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("deciding returned %d", resp.StatusCode)
+	}
+	select {
+	case approval := <-decided:
+		if approval.Status != statusDecided || approval.Decision != "reject" || approval.Comment != "not today" || approval.DecidedBy != "sam" || approval.URL != "" {
+			t.Errorf("unexpected decision %+v", approval)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the long poll didn't return after the decision")
+	}
+
+	resp, _ = http.PostForm(approval.URL, url.Values{"decision": {"approve"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("deciding twice returned %d, want 409", resp.StatusCode)
+	}
+	if status, _ := call(t, srv.URL, "ws2", "/api/v1/get", map[string]string{"id": "drop-1"}); status != http.StatusNotFound {
+		t.Errorf("another workspace got the approval: %d", status)
+	}
+}
+
+func TestDecideWithJSONAndExpiry(t *testing.T) {
+	srv := newTestServer(t)
+	_, approval := call(t, srv.URL, "ws1", "/api/v1/submit", map[string]interface{}{"title": "Scale up", "options": "small, large"})
+	decide := func(decision string) int {
+		resp, err := http.Post(approval.URL, "application/json", strings.NewReader(`{"decision": "`+decision+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := decide("approve"); status != http.StatusBadRequest {
+		t.Errorf("an unknown option returned %d, want 400", status)
+	}
+	if status := decide("large"); status != http.StatusOK {
+		t.Errorf("deciding returned %d", status)
+	}
+
+	_, expiring := call(t, srv.URL, "ws1", "/api/v1/submit", map[string]string{"title": "Quick", "expires_in": "300ms"})
+	start := time.Now()
+	_, expired := call(t, srv.URL, "ws1", "/api/v1/get", map[string]string{"id": expiring.ID, "wait": "1m"})
+	if expired.Status != statusExpired || time.Since(start) > 5*time.Second {
+		t.Errorf("unexpected approval %+v after %s", expired, time.Since(start))
+	}
+	resp, _ := http.Post(expiring.URL, "application/json", strings.NewReader(`{"decision": "approve"}`))
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("deciding an expired approval returned %d, want 409", resp.StatusCode)
+	}
+
+	_, pending := call(t, srv.URL, "ws1", "/api/v1/submit", map[string]string{"title": "Later"})
+	if status, cancelled := call(t, srv.URL, "ws1", "/api/v1/cancel", map[string]string{"id": pending.ID, "reason": "done"}); status != http.StatusOK || cancelled.Status != statusCancelled {
+		t.Errorf("cancel failed: %d %+v", status, cancelled)
+	}
+
+	data, _ := json.Marshal(map[string]string{"status": "decided"})
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/api/v1/list", bytes.NewReader(data))
+	req.Header.Set("X-GPTScript-Env", "GPTSCRIPT_WORKSPACE_ID=ws1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Data []Approval `json:"data"`
+	}
+	json.NewDecoder(resp.Body).Decode(&list)
+	if len(list.Data) != 1 || list.Data[0].Decision != "large" {
+		t.Errorf("unexpected decided approvals %+v", list.Data)
+	}
+}
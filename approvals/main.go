@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"toolkit"
+)
+
+type Server struct {
+	nc *nats.Conn
+	js nats.JetStreamContext
+	// signer signs the links humans decide approvals with, and publicURL is where they reach
+	// this server
+	signer    *urlSigner
+	publicURL string
+	// defaultExpiry and maxExpiry bound how long an approval waits for a decision
+	defaultExpiry time.Duration
+	maxExpiry     time.Duration
+	// retention is how long approvals are kept after their last change
+	retention time.Duration
+}
+
+// getPrefixFromEnv generates a SHA1 prefix from the workspace of a request, which names the
+// bucket holding its approvals
+func getPrefixFromEnv(headers http.Header) string {
+	workspaceID := toolkit.GPTScriptEnv(headers, "GPTSCRIPT_WORKSPACE_ID")
+	if workspaceID == "" {
+		return "default"
+	}
+	hasher := sha1.New()
+	hasher.Write([]byte(workspaceID))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func NewServer(nc *nats.Conn) (*Server, error) {
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+	defaultExpiry, err := time.ParseDuration(getEnvOrDefault("APPROVALS_DEFAULT_EXPIRY", "24h"))
+	if err != nil || defaultExpiry <= 0 {
+		return nil, fmt.Errorf("invalid APPROVALS_DEFAULT_EXPIRY %q, expected a duration such as 24h", os.Getenv("APPROVALS_DEFAULT_EXPIRY"))
+	}
+	maxExpiry, err := time.ParseDuration(getEnvOrDefault("APPROVALS_MAX_EXPIRY", "168h"))
+	if err != nil || maxExpiry < defaultExpiry {
+		return nil, fmt.Errorf("invalid APPROVALS_MAX_EXPIRY %q, expected a duration of at least APPROVALS_DEFAULT_EXPIRY", os.Getenv("APPROVALS_MAX_EXPIRY"))
+	}
+	retention, err := time.ParseDuration(getEnvOrDefault("APPROVALS_RETENTION", "720h"))
+	if err != nil || retention < maxExpiry {
+		return nil, fmt.Errorf("invalid APPROVALS_RETENTION %q, expected a duration of at least APPROVALS_MAX_EXPIRY", os.Getenv("APPROVALS_RETENTION"))
+	}
+	signer, err := newURLSigner(js)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{
+		nc:            nc,
+		js:            js,
+		signer:        signer,
+		publicURL:     strings.TrimSuffix(getEnvOrDefault("APPROVALS_PUBLIC_URL", "http://localhost:"+getEnvOrDefault("PORT", "8080")), "/"),
+		defaultExpiry: defaultExpiry,
+		maxExpiry:     maxExpiry,
+		retention:     retention,
+	}, nil
+}
+
+// getBucket gets or creates the bucket of a workspace, which holds its approvals by ID
+func (s *Server) getBucket(prefix string) (nats.KeyValue, error) {
+	kv, err := s.js.CreateKeyValue(&nats.KeyValueConfig{
+		Bucket:  "approvals-" + prefix,
+		TTL:     s.retention,
+		Storage: nats.FileStorage,
+	})
+	if err != nil {
+		// If it already exists, try to get it
+		kv, err = s.js.KeyValue("approvals-" + prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create/get KV store: %v", err)
+		}
+	}
+	return kv, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rw := toolkit.NewResponseWriter(w)
+	w = rw
+	log.Printf("Request: %s %s", r.Method, r.URL.Path)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Handle health check endpoint
+	if r.URL.Path == "/api/ready" && r.Method == http.MethodGet {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// Humans decide through signed links, which authorize the page and its form
+	if strings.HasPrefix(r.URL.Path, "/approvals/") && (r.Method == http.MethodGet || r.Method == http.MethodPost) {
+		s.handleDecisionPage(w, r)
+		log.Printf("Response Status: %d", rw.Status)
+		return
+	}
+
+	// All other endpoints should be POST
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		log.Printf("Response: %d - Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/v1/submit":
+		s.handleSubmit(w, r)
+	case "/api/v1/get":
+		s.handleGet(w, r)
+	case "/api/v1/list":
+		s.handleList(w, r)
+	case "/api/v1/cancel":
+		s.handleCancel(w, r)
+	default:
+		http.NotFound(w, r)
+		log.Printf("Response: 404 - Not Found")
+		return
+	}
+
+	log.Printf("Response Status: %d", rw.Status)
+}
+
+func main() {
+	port := getEnvOrDefault("PORT", "8080")
+	storageDir := flag.String("s", getEnvOrDefault("NATS_STORAGE", "./data"), "Directory for storing data (env: NATS_STORAGE)")
+	flag.Parse()
+
+	// Ensure storage directory exists
+	if err := os.MkdirAll(*storageDir, 0755); err != nil {
+		log.Fatalf("Failed to create storage directory: %v", err)
+	}
+
+	// The embedded NATS server only serves this process, so it doesn't listen on a port
+	ns, err := server.NewServer(&server.Options{
+		JetStream:  true,
+		StoreDir:   filepath.Clean(*storageDir),
+		DontListen: true,
+		NoSigs:     true,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create server: %v", err)
+	}
+	ns.ConfigureLogger()
+	go ns.Start()
+	if !ns.ReadyForConnections(4 * time.Second) {
+		log.Fatal("Failed to start server")
+	}
+
+	nc, err := nats.Connect("", nats.InProcessServer(ns))
+	if err != nil {
+		log.Fatalf("Failed to connect to NATS: %v", err)
+	}
+	defer nc.Close()
+
+	httpServer, err := NewServer(nc)
+	if err != nil {
+		log.Fatalf("Failed to create HTTP server: %v", err)
+	}
+
+	go func() {
+		log.Printf("Starting HTTP server on port %s", port)
+		if err := http.ListenAndServe(":"+port, httpServer); err != nil {
+			log.Fatalf("HTTP server error: %v", err)
+		}
+	}()
+	log.Printf("Storage directory: %s", *storageDir)
+
+	// Handle graceful shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	<-sigChan
+	log.Print("Shutting down servers...")
+	ns.Shutdown()
+	ns.WaitForShutdown()
+}
+
+func getEnvOrDefault(key, defaultValue string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return defaultValue
+}
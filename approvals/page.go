@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"toolkit"
+)
+
+// DecideRequest is a decision posted as JSON to the link of an approval. The page posts the
+// same fields as a form.
+type DecideRequest struct {
+	Decision  string `json:"decision"`
+	Comment   string `json:"comment,omitempty"`
+	DecidedBy string `json:"decided_by,omitempty"`
+}
+
+// decide chooses an option of a pending approval
+func (req DecideRequest) decide(approval *Approval) error {
+	switch {
+	case !slices.Contains(approval.Options, req.Decision):
+		return fmt.Errorf("decision must be one of %s", strings.Join(approval.Options, ", "))
+	case len(req.Comment) > maxCommentLength:
+		return fmt.Errorf("comment can be at most %d characters", maxCommentLength)
+	case len(req.DecidedBy) > maxTitleLength:
+		return fmt.Errorf("decided_by can be at most %d characters", maxTitleLength)
+	}
+	now := time.Now().UTC()
+	approval.Status = statusDecided
+	approval.Decision = req.Decision
+	approval.Comment = req.Comment
+	approval.DecidedBy = req.DecidedBy
+	approval.Decided = &now
+	return nil
+}
+
+var pageTemplate = template.Must(template.New("approval").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Approval.Title}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 42rem; margin: 2rem auto; padding: 0 1rem; color: #222; }
+pre { background: #f4f4f4; padding: 1rem; overflow-x: auto; white-space: pre-wrap; }
+.status { font-weight: bold; text-transform: capitalize; }
+.error { color: #b00020; }
+label { display: block; margin-top: 1rem; }
+input, textarea { width: 100%; box-sizing: border-box; font: inherit; }
+button { margin: 1rem 0.5rem 0 0; padding: 0.5rem 1rem; font: inherit; }
+</style>
+</head>
+<body>
+<h1>{{.Approval.Title}}</h1>
+{{with .Approval.Description}}<p>{{.}}</p>{{end}}
+{{with .Approval.Payload}}<pre>{{.}}</pre>{{end}}
+{{with .Error}}<p class="error">{{.}}</p>{{end}}
+{{if eq .Approval.Status "pending"}}
+<form method="post" action="{{.Action}}">
+<p>Waiting for a decision until {{.Approval.Expires.Format "2006-01-02 15:04 MST"}}.</p>
+<label>Your name <input name="decided_by" maxlength="256"></label>
+<label>Comment <textarea name="comment" rows="3" maxlength="4096"></textarea></label>
+{{range .Approval.Options}}<button type="submit" name="decision" value="{{.}}">{{.}}</button>{{end}}
+</form>
+{{else}}
+<p>Status: <span class="status">{{.Approval.Status}}</span>{{with .Approval.Decision}}, {{.}}{{end}}{{with .Approval.DecidedBy}} by {{.}}{{end}}{{with .Approval.Decided}} at {{.Format "2006-01-02 15:04 MST"}}{{end}}</p>
+{{with .Approval.Comment}}<p>{{.}}</p>{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+type page struct {
+	Approval *Approval
+	Action   string
+	Error    string
+}
+
+// handleDecisionPage serves the link of an approval, /approvals/<prefix>/<id>, which is
+// authorized by its signature rather than a workspace. GET shows the approval with a form to
+// decide it, and POST decides it, from the form or as JSON.
+func (s *Server) handleDecisionPage(w http.ResponseWriter, r *http.Request) {
+	prefix, id, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/approvals/"), "/")
+	if !ok || validateID(id) != nil || !s.signer.verify(approvalPath(prefix, id), r.URL.Query().Get("signature")) {
+		toolkit.WriteError(w, http.StatusForbidden, "invalid or missing signature")
+		return
+	}
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	asJSON := strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+
+	var approval *Approval
+	status := http.StatusOK
+	if r.Method == http.MethodPost {
+		var req DecideRequest
+		if asJSON {
+			if !toolkit.DecodeRequest(w, r, &req) {
+				return
+			}
+		} else {
+			r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+			if err := r.ParseForm(); err != nil {
+				toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid form: %v", err))
+				return
+			}
+			req = DecideRequest{Decision: r.PostForm.Get("decision"), Comment: r.PostForm.Get("comment"), DecidedBy: r.PostForm.Get("decided_by")}
+		}
+		approval, status, err = resolve(bucket, id, req.decide)
+	} else {
+		approval, _, err = getApproval(bucket, id)
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			status, err = http.StatusNotFound, fmt.Errorf("approval %s does not exist", id)
+		} else if err != nil {
+			status = http.StatusInternalServerError
+		}
+	}
+
+	if asJSON || approval == nil {
+		if err != nil {
+			toolkit.WriteError(w, status, err.Error())
+			return
+		}
+		json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: approval})
+		return
+	}
+	// The signature is in the URL, so it mustn't leak through referrers or framing
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'; frame-ancestors 'none'")
+	data := page{Approval: approval, Action: r.URL.RequestURI()}
+	if err != nil {
+		data.Error = err.Error()
+	}
+	w.WriteHeader(status)
+	if err := pageTemplate.Execute(w, data); err != nil {
+		log.Printf("Failed to render approval %s: %v", id, err)
+	}
+}
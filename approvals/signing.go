@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// urlSigner creates and verifies HMAC signatures for the links humans decide approvals with
+type urlSigner struct {
+	key []byte
+}
+
+// newURLSigner uses APPROVALS_SIGNING_KEY, or else a key generated once and kept with the
+// approvals, so links keep working across restarts like the approvals they are for
+func newURLSigner(js nats.JetStreamContext) (*urlSigner, error) {
+	if key := getEnvOrDefault("APPROVALS_SIGNING_KEY", ""); key != "" {
+		return &urlSigner{key: []byte(key)}, nil
+	}
+	kv, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "approvals", Storage: nats.FileStorage})
+	if err != nil {
+		kv, err = js.KeyValue("approvals")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create/get KV store: %v", err)
+		}
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %v", err)
+	}
+	// Another process may have created the key first, in which case it is the one to use
+	if _, err := kv.Create("signing-key", key); err != nil && !errors.Is(err, nats.ErrKeyExists) {
+		return nil, fmt.Errorf("failed to store signing key: %v", err)
+	}
+	entry, err := kv.Get("signing-key")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signing key: %v", err)
+	}
+	return &urlSigner{key: entry.Value()}, nil
+}
+
+// mac returns the HMAC-SHA256 of data under the signing key
+func (u *urlSigner) mac(data []byte) []byte {
+	mac := hmac.New(sha256.New, u.key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// sign returns the path with a signature query parameter appended. Links don't expire by
+// themselves: an approval can't be decided once it expires, but its link still shows how
+// it ended.
+func (u *urlSigner) sign(path string) string {
+	return path + "?signature=" + hex.EncodeToString(u.mac([]byte(path)))
+}
+
+// verify checks that the signature matches the path
+func (u *urlSigner) verify(path, signature string) bool {
+	return hmac.Equal([]byte(hex.EncodeToString(u.mac([]byte(path)))), []byte(signature))
+}
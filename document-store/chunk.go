@@ -0,0 +1,54 @@
+package main
+
+import (
+	"strings"
+)
+
+// chunkText splits text into chunks of about size words, each repeating the last overlap
+// words of the one before so passages cut at a boundary are still found whole. Chunks end
+// at a paragraph break when there is one in their last quarter.
+func chunkText(text string, size, overlap int) []string {
+	type word struct {
+		text string
+		// paragraph is whether the word starts a paragraph
+		paragraph bool
+	}
+	var words []word
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		for i, field := range strings.Fields(paragraph) {
+			words = append(words, word{text: field, paragraph: i == 0})
+		}
+	}
+
+	var chunks []string
+	for start := 0; start < len(words); {
+		end := min(start+size, len(words))
+		if end < len(words) {
+			for i := end; i > end-size/4 && i > start+1; i-- {
+				if words[i].paragraph {
+					end = i
+					break
+				}
+			}
+		}
+
+		var chunk strings.Builder
+		for i := start; i < end; i++ {
+			switch {
+			case i == start:
+			case words[i].paragraph:
+				chunk.WriteString("\n\n")
+			default:
+				chunk.WriteByte(' ')
+			}
+			chunk.WriteString(words[i].text)
+		}
+		chunks = append(chunks, chunk.String())
+
+		if end == len(words) {
+			break
+		}
+		start = max(end-overlap, start+1)
+	}
+	return chunks
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"toolkit"
+)
+
+const (
+	maxDocumentSize  = 20 << 20
+	maxChunks        = 10000
+	maxChunkSize     = 2000
+	defaultChunkSize = 200
+	maxSearchResults = 100
+)
+
+// Search modes
+const (
+	modeKeyword   = "keyword"
+	modeEmbedding = "embedding"
+)
+
+// Documents are stored as doc.<id>, their chunks as chunk.<id>.<index>
+var documentID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+type Document struct {
+	ID          string             `json:"id"`
+	Name        string             `json:"name"`
+	ContentType string             `json:"content_type"`
+	Metadata    toolkit.JSONObject `json:"metadata,omitempty"`
+	Size        int                `json:"size"`
+	Chunks      int                `json:"chunks"`
+	Embedded    bool               `json:"embedded"`
+	Added       time.Time          `json:"added"`
+	// Version tells the chunks of the current content from those of a replaced one
+	Version string `json:"version"`
+}
+
+type Chunk struct {
+	Document  string    `json:"document"`
+	Index     int       `json:"index"`
+	Version   string    `json:"version"`
+	Text      string    `json:"text"`
+	Embedding []float32 `json:"embedding,omitempty"`
+}
+
+type AddDocumentRequest struct {
+	ID            string             `json:"id,omitempty"`
+	Name          string             `json:"name"`
+	Content       string             `json:"content,omitempty"`
+	ContentBase64 string             `json:"content_base64,omitempty"`
+	ContentType   string             `json:"content_type,omitempty"`
+	Metadata      toolkit.JSONObject `json:"metadata,omitempty"`
+	ChunkSize     toolkit.Int        `json:"chunk_size,omitempty"`
+	ChunkOverlap  toolkit.Int        `json:"chunk_overlap,omitempty"`
+}
+
+type DocumentRequest struct {
+	ID         string       `json:"id"`
+	WithChunks toolkit.Bool `json:"with_chunks,omitempty"`
+}
+
+type DocumentResult struct {
+	Document
+	Chunks []string `json:"chunk_texts,omitempty"`
+}
+
+type SearchRequest struct {
+	Query     string             `json:"query"`
+	K         toolkit.Int        `json:"k,omitempty"`
+	Mode      string             `json:"mode,omitempty"`
+	Documents toolkit.StringList `json:"documents,omitempty"`
+	Filter    toolkit.JSONObject `json:"filter,omitempty"`
+}
+
+type SearchResult struct {
+	Document string             `json:"document"`
+	Name     string             `json:"name"`
+	Chunk    int                `json:"chunk"`
+	Text     string             `json:"text"`
+	Score    float64            `json:"score"`
+	Metadata toolkit.JSONObject `json:"metadata,omitempty"`
+}
+
+func documentKey(id string) string {
+	return "doc." + id
+}
+
+func chunkKey(id string, index int) string {
+	return fmt.Sprintf("chunk.%s.%d", id, index)
+}
+
+// getDocument reads the record of a document, returning nil when it doesn't exist
+func getDocument(bucket nats.KeyValue, id string) (*Document, error) {
+	entry, err := bucket.Get(documentKey(id))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var doc Document
+	if err := json.Unmarshal(entry.Value(), &doc); err != nil {
+		return nil, fmt.Errorf("failed to read document %s: %v", id, err)
+	}
+	return &doc, nil
+}
+
+// handleAddDocument extracts the text of a document, splits it into chunks and stores them,
+// replacing the document if one with the same ID exists. The chunks are written before
+// the document record, so searches only find a document once all of it was stored.
+func (s *Server) handleAddDocument(w http.ResponseWriter, r *http.Request) {
+	var req AddDocumentRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if req.ID == "" {
+		req.ID = uuid.New().String()
+	}
+	if req.ChunkSize == 0 {
+		req.ChunkSize = defaultChunkSize
+	}
+	if req.ChunkOverlap == 0 && req.ChunkSize >= 5 {
+		req.ChunkOverlap = req.ChunkSize / 5
+	}
+	switch {
+	case !documentID.MatchString(req.ID):
+		toolkit.WriteError(w, http.StatusBadRequest, "id must be 1 to 128 letters, digits, - or _")
+		return
+	case req.Name == "":
+		toolkit.WriteError(w, http.StatusBadRequest, "name is required")
+		return
+	case (req.Content == "") == (req.ContentBase64 == ""):
+		toolkit.WriteError(w, http.StatusBadRequest, "either content or content_base64 is required")
+		return
+	case req.ChunkSize < 1 || req.ChunkSize > maxChunkSize:
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("chunk_size must be between 1 and %d words", maxChunkSize))
+		return
+	case req.ChunkOverlap < 0 || req.ChunkOverlap >= req.ChunkSize:
+		toolkit.WriteError(w, http.StatusBadRequest, "chunk_overlap must be at least 0 and less than chunk_size")
+		return
+	}
+
+	data := []byte(req.Content)
+	if req.ContentBase64 != "" {
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(req.ContentBase64); err != nil {
+			toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid content_base64: %v", err))
+			return
+		}
+	}
+	if len(data) > maxDocumentSize {
+		toolkit.WriteError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("documents can be at most %d bytes", maxDocumentSize))
+		return
+	}
+	if req.ContentType == "" {
+		req.ContentType = contentTypeOf(req.Name)
+	}
+	text, err := extractText(strings.ToLower(req.ContentType), data)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	texts := chunkText(text, int(req.ChunkSize), int(req.ChunkOverlap))
+	if len(texts) == 0 {
+		toolkit.WriteError(w, http.StatusBadRequest, "the document has no text")
+		return
+	}
+	if len(texts) > maxChunks {
+		toolkit.WriteError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("the document splits into %d chunks, at most %d are allowed, use a larger chunk_size", len(texts), maxChunks))
+		return
+	}
+
+	var embeddings [][]float32
+	if s.embeddings != nil {
+		if embeddings, err = s.embeddings.embed(texts); err != nil {
+			toolkit.WriteError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+	}
+
+	bucket, err := s.getBucket(getPrefixFromEnv(r.Header))
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	previous, err := getDocument(bucket, req.ID)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer s.indexes.drop(bucket)
+
+	doc := Document{
+		ID:          req.ID,
+		Name:        req.Name,
+		ContentType: strings.ToLower(req.ContentType),
+		Metadata:    req.Metadata,
+		Size:        len(data),
+		Chunks:      len(texts),
+		Embedded:    embeddings != nil,
+		Added:       time.Now().UTC(),
+		Version:     uuid.New().String(),
+	}
+	for i, text := range texts {
+		chunk := Chunk{Document: doc.ID, Index: i, Version: doc.Version, Text: text}
+		if embeddings != nil {
+			chunk.Embedding = embeddings[i]
+		}
+		value, _ := json.Marshal(chunk)
+		if _, err := bucket.Put(chunkKey(doc.ID, i), value); err != nil {
+			toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to store chunk %d: %v", i, err))
+			return
+		}
+	}
+	value, _ := json.Marshal(doc)
+	if _, err := bucket.Put(documentKey(doc.ID), value); err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	// Chunks beyond the end of the new content are left from the previous one
+	if previous != nil {
+		for i := doc.Chunks; i < previous.Chunks; i++ {
+			if err := bucket.Purge(chunkKey(doc.ID, i)); err != nil {
+				log.Printf("Failed to remove chunk %d of the previous content of %s: %v", i, doc.ID, err)
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: doc})
+}
+
+func (s *Server) handleListDocuments(w http.ResponseWriter, r *http.Request) {
+	bucket, err := s.getBucket(getPrefixFromEnv(r.Header))
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	index, err := s.indexes.get(bucket)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	documents := make([]Document, 0, len(index.documents))
+	for _, doc := range index.documents {
+		documents = append(documents, *doc)
+	}
+	slices.SortFunc(documents, func(a, b Document) int { return strings.Compare(a.Name, b.Name) })
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: documents})
+}
+
+func (s *Server) handleGetDocument(w http.ResponseWriter, r *http.Request) {
+	var req DocumentRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	bucket, err := s.getBucket(getPrefixFromEnv(r.Header))
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	index, err := s.indexes.get(bucket)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	doc, ok := index.documents[req.ID]
+	if !ok {
+		toolkit.WriteError(w, http.StatusNotFound, fmt.Sprintf("document %s does not exist", req.ID))
+		return
+	}
+	result := DocumentResult{Document: *doc}
+	if req.WithChunks {
+		result.Chunks = make([]string, 0, doc.Chunks)
+		for _, chunk := range index.chunks {
+			if chunk.Document == doc.ID {
+				result.Chunks = append(result.Chunks, chunk.Text)
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: result})
+}
+
+func (s *Server) handleDeleteDocument(w http.ResponseWriter, r *http.Request) {
+	var req DocumentRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	bucket, err := s.getBucket(getPrefixFromEnv(r.Header))
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	doc, err := getDocument(bucket, req.ID)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if doc == nil {
+		toolkit.WriteError(w, http.StatusNotFound, fmt.Sprintf("document %s does not exist", req.ID))
+		return
+	}
+	defer s.indexes.drop(bucket)
+
+	// The record goes first, so a failure part way leaves chunks no search returns
+	if err := bucket.Purge(documentKey(doc.ID)); err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for i := 0; i < doc.Chunks; i++ {
+		if err := bucket.Purge(chunkKey(doc.ID, i)); err != nil {
+			log.Printf("Failed to remove chunk %d of %s: %v", i, doc.ID, err)
+		}
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true})
+}
+
+// handleSearch returns the chunks best matching a query, by BM25 keyword relevance or by
+// the similarity of their embeddings to the query's
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	var req SearchRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if req.K == 0 {
+		req.K = 5
+	}
+	if req.Mode == "" {
+		req.Mode = modeKeyword
+	}
+	switch {
+	case strings.TrimSpace(req.Query) == "":
+		toolkit.WriteError(w, http.StatusBadRequest, "query is required")
+		return
+	case req.K < 1 || req.K > maxSearchResults:
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("k must be between 1 and %d", maxSearchResults))
+		return
+	case req.Mode != modeKeyword && req.Mode != modeEmbedding:
+		toolkit.WriteError(w, http.StatusBadRequest, "mode must be keyword or embedding")
+		return
+	case req.Mode == modeEmbedding && s.embeddings == nil:
+		toolkit.WriteError(w, http.StatusBadRequest, "embedding search is not configured, set EMBEDDINGS_API_KEY or EMBEDDINGS_API_URL")
+		return
+	}
+
+	bucket, err := s.getBucket(getPrefixFromEnv(r.Header))
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	index, err := s.indexes.get(bucket)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	candidates := index.candidates(req.Documents, req.Filter)
+
+	var scores map[*indexedChunk]float64
+	if req.Mode == modeEmbedding {
+		embeddings, err := s.embeddings.embed([]string{req.Query})
+		if err != nil {
+			toolkit.WriteError(w, http.StatusBadGateway, err.Error())
+			return
+		}
+		scores = embeddingScores(candidates, embeddings[0])
+	} else {
+		scores = index.keywordScores(candidates, req.Query)
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: index.topResults(scores, int(req.K))})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"toolkit"
+)
+
+func TestChunkText(t *testing.T) {
+	words := make([]string, 25)
+	for i := range words {
+		words[i] = string(rune('a' + i))
+	}
+	chunks := chunkText(strings.Join(words, " "), 10, 2)
+	if len(chunks) != 3 {
+		t.Fatalf("chunks = %q, want 3", chunks)
+	}
+	if !strings.HasPrefix(chunks[1], "i j ") || !strings.HasSuffix(chunks[2], " y") {
+		t.Errorf("chunks must overlap by 2 words and cover the text, got %q", chunks)
+	}
+
+	chunks = chunkText("one two three four five six seven\n\neight nine ten eleven", 8, 0)
+	if len(chunks) != 2 || chunks[0] != "one two three four five six seven" {
+		t.Errorf("chunks must end at a paragraph break near their end, got %q", chunks)
+	}
+	if chunks := chunkText("  \n\n ", 10, 2); len(chunks) != 0 {
+		t.Errorf("blank text gave chunks %q", chunks)
+	}
+}
+
+func TestExtractHTML(t *testing.T) {
+	text, err := extractHTML([]byte(`<html><head><title>T</title><style>p {}</style></head>
+<body><h1>Title</h1><p>First <b>bold</b> paragraph.</p><script>var x = 1;</script><p>Second</p></body></html>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Title\n\nFirst bold paragraph.\n\nSecond"; text != want {
+		t.Errorf("text = %q, want %q", text, want)
+	}
+}
+
+func TestExtractText(t *testing.T) {
+	if _, err := extractText(contentText, []byte{0xff, 0xfe}); err == nil {
+		t.Errorf("invalid UTF-8 accepted")
+	}
+	if _, err := extractText(contentPDF, []byte("not a pdf")); err == nil {
+		t.Errorf("invalid PDF accepted")
+	}
+	if _, err := extractText("docx", []byte("x")); err == nil {
+		t.Errorf("unsupported content type accepted")
+	}
+	if got := contentTypeOf("Guide.PDF"); got != contentPDF {
+		t.Errorf("contentTypeOf(Guide.PDF) = %s", got)
+	}
+}
+
+// testPDF builds a single page PDF showing a line of text
+func testPDF(text string) []byte {
+	content := fmt.Sprintf("BT /F1 12 Tf 72 720 Td (%s) Tj ET", text)
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents 4 0 R /Resources << /Font << /F1 5 0 R >> >> >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+	}
+	var pdf bytes.Buffer
+	pdf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = pdf.Len()
+		fmt.Fprintf(&pdf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := pdf.Len()
+	fmt.Fprintf(&pdf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&pdf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&pdf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return pdf.Bytes()
+}
+
+func TestExtractPDF(t *testing.T) {
+	text, err := extractText(contentPDF, testPDF("Quarterly report"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(text, "Quarterly report") {
+		t.Errorf("text = %q, want the text of the page", text)
+	}
+}
+
+func testIndex(chunks ...*Chunk) *workspaceIndex {
+	index := &workspaceIndex{documents: map[string]*Document{}, docFreq: map[string]int{}}
+	for _, chunk := range chunks {
+		if _, ok := index.documents[chunk.Document]; !ok {
+			index.documents[chunk.Document] = &Document{ID: chunk.Document, Name: chunk.Document + ".txt", Metadata: toolkit.JSONObject{"team": chunk.Document}}
+		}
+		indexed := &indexedChunk{Chunk: chunk, terms: map[string]int{}}
+		for _, term := range tokenize(chunk.Text) {
+			indexed.terms[term]++
+			indexed.length++
+		}
+		for term := range indexed.terms {
+			index.docFreq[term]++
+		}
+		index.totalLength += indexed.length
+		index.chunks = append(index.chunks, indexed)
+	}
+	return index
+}
+
+func TestKeywordSearch(t *testing.T) {
+	index := testIndex(
+		&Chunk{Document: "hr", Index: 0, Text: "Vacation requests are approved by your manager."},
+		&Chunk{Document: "hr", Index: 1, Text: "Expenses are reported monthly."},
+		&Chunk{Document: "it", Index: 0, Text: "Reset your password in the portal. The password must be long."},
+		&Chunk{Document: "it", Index: 1, Text: "Laptops are replaced every three years."},
+	)
+
+	results := index.topResults(index.keywordScores(index.candidates(nil, nil), "How do I reset my password?"), 5)
+	if len(results) != 1 || results[0].Document != "it" || results[0].Chunk != 0 || results[0].Name != "it.txt" {
+		t.Errorf("results = %+v, want the password chunk only", results)
+	}
+
+	results = index.topResults(index.keywordScores(index.candidates(nil, nil), "vacation password"), 1)
+	if len(results) != 1 {
+		t.Errorf("k must bound the results, got %+v", results)
+	}
+
+	candidates := index.candidates([]string{"hr"}, nil)
+	if results := index.topResults(index.keywordScores(candidates, "password"), 5); len(results) != 0 {
+		t.Errorf("documents must restrict the search, got %+v", results)
+	}
+	candidates = index.candidates(nil, map[string]interface{}{"team": "hr"})
+	if results := index.topResults(index.keywordScores(candidates, "vacation password"), 5); len(results) != 1 || results[0].Document != "hr" {
+		t.Errorf("filter must restrict the search, got %+v", results)
+	}
+}
+
+func TestEmbeddingSearch(t *testing.T) {
+	index := testIndex(
+		&Chunk{Document: "a", Index: 0, Text: "x", Embedding: []float32{1, 0}},
+		&Chunk{Document: "a", Index: 1, Text: "y", Embedding: []float32{0.6, 0.8}},
+		&Chunk{Document: "b", Index: 0, Text: "z"},
+	)
+	results := index.topResults(embeddingScores(index.candidates(nil, nil), []float32{0, 1}), 5)
+	if len(results) != 2 || results[0].Chunk != 1 {
+		t.Errorf("results = %+v, want the closest embedding first and chunks without one left out", results)
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	if got := strings.Join(tokenize("The API's rate-limit is 100/min."), " "); got != "api s rate limit 100 min" {
+		t.Errorf("tokenize = %q", got)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// embeddingsBatchSize bounds the chunks embedded with one request
+const embeddingsBatchSize = 64
+
+// embeddingsClient calls an OpenAI-compatible embeddings API. Documents are only embedded
+// when one is configured.
+type embeddingsClient struct {
+	url    string
+	apiKey string
+	model  string
+	client *http.Client
+}
+
+// newEmbeddingsClient reads EMBEDDINGS_API_URL, EMBEDDINGS_API_KEY or OPENAI_API_KEY and
+// EMBEDDINGS_MODEL. It returns nil when neither an API URL nor a key is set.
+func newEmbeddingsClient() *embeddingsClient {
+	apiKey := getEnvOrDefault("EMBEDDINGS_API_KEY", "")
+	if apiKey == "" {
+		apiKey = getEnvOrDefault("OPENAI_API_KEY", "")
+	}
+	url := getEnvOrDefault("EMBEDDINGS_API_URL", "")
+	if url == "" && apiKey == "" {
+		return nil
+	}
+	if url == "" {
+		url = "https://api.openai.com/v1/embeddings"
+	}
+	return &embeddingsClient{
+		url:    url,
+		apiKey: apiKey,
+		model:  getEnvOrDefault("EMBEDDINGS_MODEL", "text-embedding-3-small"),
+		client: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// embed returns the embeddings of texts, in their order
+func (c *embeddingsClient) embed(texts []string) ([][]float32, error) {
+	embeddings := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); start += embeddingsBatchSize {
+		batch, err := c.embedBatch(texts[start:min(start+embeddingsBatchSize, len(texts))])
+		if err != nil {
+			return nil, err
+		}
+		embeddings = append(embeddings, batch...)
+	}
+	return embeddings, nil
+}
+
+func (c *embeddingsClient) embedBatch(texts []string) ([][]float32, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"model": c.model,
+		"input": texts,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create embeddings request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("embeddings request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("embeddings API returned status %d: %s", resp.StatusCode, bytes.TrimSpace(message))
+	}
+
+	var result struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode embeddings response: %v", err)
+	}
+	if len(result.Data) != len(texts) {
+		return nil, fmt.Errorf("embeddings API returned %d embeddings for %d texts", len(result.Data), len(texts))
+	}
+	embeddings := make([][]float32, len(texts))
+	for _, item := range result.Data {
+		if item.Index < 0 || item.Index >= len(texts) {
+			return nil, fmt.Errorf("embeddings API returned an embedding for unknown input %d", item.Index)
+		}
+		embeddings[item.Index] = item.Embedding
+	}
+	return embeddings, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ledongthuc/pdf"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Content types documents can be added as
+const (
+	contentText     = "text"
+	contentMarkdown = "markdown"
+	contentHTML     = "html"
+	contentPDF      = "pdf"
+)
+
+// contentTypeOf guesses the content type of a document from its name, text by default
+func contentTypeOf(name string) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".html", ".htm", ".xhtml":
+		return contentHTML
+	case ".pdf":
+		return contentPDF
+	case ".md", ".markdown":
+		return contentMarkdown
+	}
+	return contentText
+}
+
+// extractText returns the plain text of a document
+func extractText(contentType string, data []byte) (string, error) {
+	switch contentType {
+	case contentText, contentMarkdown:
+		if !utf8.Valid(data) {
+			return "", fmt.Errorf("%s documents must be UTF-8", contentType)
+		}
+		return string(data), nil
+	case contentHTML:
+		return extractHTML(data)
+	case contentPDF:
+		return extractPDF(data)
+	}
+	return "", fmt.Errorf("unsupported content type %q, must be text, markdown, html or pdf", contentType)
+}
+
+// blockElements end a paragraph of the text extracted from HTML
+var blockElements = map[atom.Atom]bool{
+	atom.P: true, atom.Div: true, atom.Br: true, atom.Li: true, atom.Tr: true, atom.Table: true,
+	atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	atom.Pre: true, atom.Blockquote: true, atom.Section: true, atom.Article: true, atom.Header: true,
+	atom.Footer: true, atom.Ul: true, atom.Ol: true, atom.Dt: true, atom.Dd: true, atom.Hr: true,
+}
+
+// skippedElements hold no readable text
+var skippedElements = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Noscript: true, atom.Head: true, atom.Template: true, atom.Svg: true,
+}
+
+// extractHTML returns the readable text of an HTML document, with a blank line between
+// blocks so paragraphs survive
+func extractHTML(data []byte) (string, error) {
+	var text strings.Builder
+	tokenizer := html.NewTokenizer(bytes.NewReader(data))
+	skipping := 0
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if err := tokenizer.Err(); err != io.EOF {
+				return "", fmt.Errorf("failed to parse HTML: %v", err)
+			}
+			return normalizeText(text.String()), nil
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := tokenizer.TagName()
+			tag := atom.Lookup(name)
+			if skippedElements[tag] && tokenizer.Token().Type == html.StartTagToken {
+				skipping++
+			}
+			if blockElements[tag] {
+				text.WriteString("\n\n")
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			tag := atom.Lookup(name)
+			if skippedElements[tag] && skipping > 0 {
+				skipping--
+			}
+			if blockElements[tag] {
+				text.WriteString("\n\n")
+			}
+		case html.TextToken:
+			if skipping == 0 {
+				text.Write(tokenizer.Text())
+				text.WriteByte(' ')
+			}
+		}
+	}
+}
+
+// extractPDF returns the text of a PDF, page by page
+func extractPDF(data []byte) (text string, err error) {
+	// The PDF reader panics on some malformed documents
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			text, err = "", fmt.Errorf("failed to read the PDF: %v", recovered)
+		}
+	}()
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("failed to read the PDF: %v", err)
+	}
+	var pages strings.Builder
+	for i := 1; i <= reader.NumPage(); i++ {
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+		content, err := page.GetPlainText(nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to read page %d of the PDF: %v", i, err)
+		}
+		pages.WriteString(content)
+		pages.WriteString("\n\n")
+	}
+	text = normalizeText(pages.String())
+	if text == "" {
+		return "", fmt.Errorf("the PDF has no text, it may only hold scanned images")
+	}
+	return text, nil
+}
+
+var (
+	spaces     = regexp.MustCompile(`[ \t\r\f\v]+`)
+	blankLines = regexp.MustCompile(`\n\s*\n\s*`)
+)
+
+// normalizeText collapses runs of spaces and blank lines, keeping paragraph breaks
+func normalizeText(text string) string {
+	text = spaces.ReplaceAllString(text, " ")
+	text = blankLines.ReplaceAllString(text, "\n\n")
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSpace(line)
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/nats-io/nats.go"
+)
+
+// BM25 parameters: k1 is how quickly repeated terms stop adding to a score, b how much long
+// chunks are penalized
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// stopWords are too common to tell chunks apart
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "by": true,
+	"for": true, "from": true, "has": true, "in": true, "is": true, "it": true, "its": true, "of": true,
+	"on": true, "or": true, "that": true, "the": true, "this": true, "to": true, "was": true,
+	"were": true, "will": true, "with": true,
+}
+
+// tokenize splits text into lower case terms of letters and digits, without stop words
+func tokenize(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	terms := fields[:0]
+	for _, field := range fields {
+		if !stopWords[field] {
+			terms = append(terms, field)
+		}
+	}
+	return terms
+}
+
+// workspaceIndex holds the chunks of a workspace with their term statistics
+type workspaceIndex struct {
+	documents map[string]*Document
+	chunks    []*indexedChunk
+	// docFreq is the number of chunks each term appears in
+	docFreq     map[string]int
+	totalLength int
+}
+
+type indexedChunk struct {
+	*Chunk
+	terms  map[string]int
+	length int
+}
+
+// indexCache holds the index of each workspace searched. Writes drop the index of their
+// workspace, which is rebuilt from the bucket by the next search.
+type indexCache struct {
+	lock    sync.Mutex
+	indexes map[string]*workspaceIndex
+}
+
+func newIndexCache() *indexCache {
+	return &indexCache{indexes: map[string]*workspaceIndex{}}
+}
+
+func (c *indexCache) get(bucket nats.KeyValue) (*workspaceIndex, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if index, ok := c.indexes[bucket.Bucket()]; ok {
+		return index, nil
+	}
+	index, err := buildIndex(bucket)
+	if err != nil {
+		return nil, err
+	}
+	c.indexes[bucket.Bucket()] = index
+	return index, nil
+}
+
+func (c *indexCache) drop(bucket nats.KeyValue) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.indexes, bucket.Bucket())
+}
+
+// buildIndex reads every document and chunk of a bucket. Chunks of documents whose record
+// is missing, left behind by an add that failed, are skipped.
+func buildIndex(bucket nats.KeyValue) (*workspaceIndex, error) {
+	index := &workspaceIndex{documents: map[string]*Document{}, docFreq: map[string]int{}}
+	watcher, err := bucket.WatchAll(nats.IgnoreDeletes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the documents: %v", err)
+	}
+	defer watcher.Stop()
+
+	var chunks []*Chunk
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		switch {
+		case strings.HasPrefix(entry.Key(), "doc."):
+			var doc Document
+			if err := json.Unmarshal(entry.Value(), &doc); err != nil {
+				return nil, fmt.Errorf("failed to read %s: %v", entry.Key(), err)
+			}
+			index.documents[doc.ID] = &doc
+		case strings.HasPrefix(entry.Key(), "chunk."):
+			var chunk Chunk
+			if err := json.Unmarshal(entry.Value(), &chunk); err != nil {
+				return nil, fmt.Errorf("failed to read %s: %v", entry.Key(), err)
+			}
+			chunks = append(chunks, &chunk)
+		}
+	}
+
+	for _, chunk := range chunks {
+		doc, ok := index.documents[chunk.Document]
+		if !ok || chunk.Index >= doc.Chunks || chunk.Version != doc.Version {
+			continue
+		}
+		indexed := &indexedChunk{Chunk: chunk, terms: map[string]int{}}
+		for _, term := range tokenize(chunk.Text) {
+			indexed.terms[term]++
+			indexed.length++
+		}
+		for term := range indexed.terms {
+			index.docFreq[term]++
+		}
+		index.totalLength += indexed.length
+		index.chunks = append(index.chunks, indexed)
+	}
+	slices.SortFunc(index.chunks, func(a, b *indexedChunk) int {
+		return cmp.Or(cmp.Compare(a.Document, b.Document), cmp.Compare(a.Index, b.Index))
+	})
+	return index, nil
+}
+
+// candidates returns the chunks of the documents matching a search's document and metadata
+// filters
+func (idx *workspaceIndex) candidates(documents []string, filter map[string]interface{}) []*indexedChunk {
+	var matched []*indexedChunk
+	for _, chunk := range idx.chunks {
+		if len(documents) > 0 && !slices.Contains(documents, chunk.Document) {
+			continue
+		}
+		if !matchesFilter(idx.documents[chunk.Document].Metadata, filter) {
+			continue
+		}
+		matched = append(matched, chunk)
+	}
+	return matched
+}
+
+// keywordScores ranks chunks by BM25 against the terms of a query. Chunks without any of the
+// terms are left out.
+func (idx *workspaceIndex) keywordScores(chunks []*indexedChunk, query string) map[*indexedChunk]float64 {
+	terms := tokenize(query)
+	scores := map[*indexedChunk]float64{}
+	if len(idx.chunks) == 0 {
+		return scores
+	}
+	n := float64(len(idx.chunks))
+	avgLength := math.Max(float64(idx.totalLength)/n, 1)
+	for _, chunk := range chunks {
+		var score float64
+		for _, term := range terms {
+			tf := float64(chunk.terms[term])
+			if tf == 0 {
+				continue
+			}
+			df := float64(idx.docFreq[term])
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			score += idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*float64(chunk.length)/avgLength))
+		}
+		if score > 0 {
+			scores[chunk] = score
+		}
+	}
+	return scores
+}
+
+// embeddingScores ranks chunks by the cosine similarity of their embedding to the query's.
+// Chunks added without an embedding are left out.
+func embeddingScores(chunks []*indexedChunk, query []float32) map[*indexedChunk]float64 {
+	scores := map[*indexedChunk]float64{}
+	for _, chunk := range chunks {
+		if len(chunk.Embedding) != len(query) {
+			continue
+		}
+		scores[chunk] = cosine(query, chunk.Embedding)
+	}
+	return scores
+}
+
+func cosine(a, b []float32) float64 {
+	var dot, normA, normB float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// topResults returns the k best scored chunks, the highest first
+func (idx *workspaceIndex) topResults(scores map[*indexedChunk]float64, k int) []SearchResult {
+	results := make([]SearchResult, 0, len(scores))
+	for chunk, score := range scores {
+		doc := idx.documents[chunk.Document]
+		results = append(results, SearchResult{
+			Document: chunk.Document,
+			Name:     doc.Name,
+			Chunk:    chunk.Index,
+			Text:     chunk.Text,
+			Score:    score,
+			Metadata: doc.Metadata,
+		})
+	}
+	slices.SortFunc(results, func(a, b SearchResult) int {
+		return cmp.Or(cmp.Compare(b.Score, a.Score), cmp.Compare(a.Document, b.Document), cmp.Compare(a.Chunk, b.Chunk))
+	})
+	if len(results) > k {
+		results = results[:k]
+	}
+	return results
+}
+
+// matchesFilter reports whether metadata holds every field of the filter. Values are
+// compared as decoded from JSON, so 1 matches 1.0.
+func matchesFilter(metadata, filter map[string]interface{}) bool {
+	for field, want := range filter {
+		got, ok := metadata[field]
+		if !ok || !reflect.DeepEqual(normalizeJSON(got), normalizeJSON(want)) {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeJSON(value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var normalized interface{}
+	json.Unmarshal(data, &normalized)
+	return normalized
+}
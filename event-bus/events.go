@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nats-io/nats.go"
+	"toolkit"
+)
+
+const (
+	maxSubjectLength = 256
+	maxHeaders       = 20
+	defaultTimeout   = 5 * time.Second
+	maxRequestWait   = time.Minute
+	// replyToken starts the subjects replies to requests made through the bridge go to
+	replyToken = "_reply"
+)
+
+var (
+	// Subject tokens can't hold the separator or whitespace, and the wildcards stand alone
+	tokenPattern  = regexp.MustCompile(`^[^.\s*>]+$`)
+	headerPattern = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+^_`|~-]+$")
+)
+
+// Event is a message delivered to a subscriber. Data holds the payload when it is text,
+// and DataBase64 when it isn't.
+type Event struct {
+	Subject    string            `json:"subject,omitempty"`
+	Data       string            `json:"data,omitempty"`
+	DataBase64 string            `json:"data_base64,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	// Reply is the subject to publish a reply to, when the event is a request
+	Reply string    `json:"reply,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+type PublishRequest struct {
+	Subject string            `json:"subject"`
+	Data    payload           `json:"data,omitempty"`
+	Headers toolkit.StringMap `json:"headers,omitempty"`
+	// Reply is the subject subscribers should reply to
+	Reply string `json:"reply,omitempty"`
+}
+
+type RequestRequest struct {
+	Subject string            `json:"subject"`
+	Data    payload           `json:"data,omitempty"`
+	Headers toolkit.StringMap `json:"headers,omitempty"`
+	Timeout toolkit.Duration  `json:"timeout,omitempty"`
+}
+
+// subjectPrefix scopes the subjects of a workspace, so it only exchanges events with itself
+func subjectPrefix(prefix string) string {
+	return "ws." + prefix + "."
+}
+
+// validateSubject checks a subject of a workspace. Only subscriptions can use the *
+// wildcard for a token and > for the remaining tokens.
+func validateSubject(subject string, wildcards bool) error {
+	if subject == "" {
+		return fmt.Errorf("subject is required")
+	}
+	if len(subject) > maxSubjectLength {
+		return fmt.Errorf("subject can be at most %d characters", maxSubjectLength)
+	}
+	tokens := strings.Split(subject, ".")
+	for i, token := range tokens {
+		switch {
+		case wildcards && token == "*":
+		case wildcards && token == ">" && i == len(tokens)-1:
+		case token == "*" || token == ">":
+			return fmt.Errorf("invalid subject %q, wildcards can only be used to subscribe, and > only last", subject)
+		case !tokenPattern.MatchString(token):
+			return fmt.Errorf("invalid subject %q, subjects are tokens separated by dots without spaces", subject)
+		}
+	}
+	return nil
+}
+
+func validateHeaders(headers map[string]string) error {
+	if len(headers) > maxHeaders {
+		return fmt.Errorf("at most %d headers are allowed", maxHeaders)
+	}
+	for name := range headers {
+		if !headerPattern.MatchString(name) {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	return nil
+}
+
+// newMessage builds the message of a publish in a workspace
+func (s *Server) newMessage(prefix, subject string, data []byte, headers map[string]string) (*nats.Msg, error) {
+	if err := validateSubject(subject, false); err != nil {
+		return nil, err
+	}
+	if err := validateHeaders(headers); err != nil {
+		return nil, err
+	}
+	if max := s.nc.MaxPayload(); int64(len(data)) > max {
+		return nil, fmt.Errorf("data can be at most %d bytes", max)
+	}
+	msg := nats.NewMsg(subjectPrefix(prefix) + subject)
+	msg.Data = data
+	for name, value := range headers {
+		msg.Header.Set(name, value)
+	}
+	return msg, nil
+}
+
+// toEvent converts a message of a workspace to an event, removing the prefix of its
+// subjects
+func toEvent(prefix string, msg *nats.Msg) Event {
+	event := Event{
+		Subject: strings.TrimPrefix(msg.Subject, subjectPrefix(prefix)),
+		Reply:   strings.TrimPrefix(msg.Reply, subjectPrefix(prefix)),
+		Time:    time.Now().UTC(),
+	}
+	if utf8.Valid(msg.Data) {
+		event.Data = string(msg.Data)
+	} else {
+		event.DataBase64 = base64.StdEncoding.EncodeToString(msg.Data)
+	}
+	if len(msg.Header) > 0 {
+		event.Headers = make(map[string]string, len(msg.Header))
+		for name := range msg.Header {
+			event.Headers[name] = msg.Header.Get(name)
+		}
+	}
+	return event
+}
+
+// handlePublish publishes an event to the subscribers of a subject in the workspace
+func (s *Server) handlePublish(w http.ResponseWriter, r *http.Request) {
+	var req PublishRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	prefix := getPrefixFromEnv(r.Header)
+	msg, err := s.newMessage(prefix, req.Subject, req.Data, req.Headers)
+	if err == nil && req.Reply != "" {
+		if err = validateSubject(req.Reply, false); err == nil {
+			msg.Reply = subjectPrefix(prefix) + req.Reply
+		}
+	}
+	if err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := s.nc.PublishMsg(msg); err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to publish: %v", err))
+		return
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: map[string]string{"subject": req.Subject}})
+}
+
+// handleRequest publishes a request and returns the first reply. The reply subject is in
+// the workspace, so subscribers reply by publishing to it like to any other subject.
+func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
+	var req RequestRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if req.Timeout == 0 {
+		req.Timeout = toolkit.Duration(defaultTimeout)
+	}
+	if req.Timeout < 0 || time.Duration(req.Timeout) > maxRequestWait {
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("timeout can be at most %s", maxRequestWait))
+		return
+	}
+	prefix := getPrefixFromEnv(r.Header)
+	msg, err := s.newMessage(prefix, req.Subject, req.Data, req.Headers)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	msg.Reply = subjectPrefix(prefix) + replyToken + "." + strings.TrimPrefix(nats.NewInbox(), nats.InboxPrefix)
+
+	sub, err := s.nc.SubscribeSync(msg.Reply)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to subscribe to the reply: %v", err))
+		return
+	}
+	defer sub.Unsubscribe()
+	if err := s.nc.PublishMsg(msg); err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to publish: %v", err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(req.Timeout))
+	defer cancel()
+	reply, err := sub.NextMsgWithContext(ctx)
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		toolkit.WriteError(w, http.StatusGatewayTimeout, fmt.Sprintf("no reply to %s within %s", req.Subject, time.Duration(req.Timeout)))
+		return
+	case errors.Is(err, nats.ErrNoResponders):
+		// The broker answers for a subject without subscribers
+		toolkit.WriteError(w, http.StatusServiceUnavailable, fmt.Sprintf("nothing is subscribed to %s", req.Subject))
+		return
+	case err != nil:
+		toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to receive the reply: %v", err))
+		return
+	}
+	event := toEvent(prefix, reply)
+	event.Subject, event.Reply = "", ""
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: event})
+}
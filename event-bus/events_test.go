@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"toolkit"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	ns, err := server.NewServer(&server.Options{DontListen: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(4 * time.Second) {
+		t.Fatal("failed to start the NATS server")
+	}
+	nc, err := nats.Connect("", nats.InProcessServer(ns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := NewServer(nc)
+	httpServer := httptest.NewServer(s)
+	t.Cleanup(func() {
+		httpServer.Close()
+		nc.Close()
+		ns.Shutdown()
+	})
+	return httpServer
+}
+
+// call posts a request as a workspace and decodes the response
+func call(t *testing.T, url, workspace, path string, body interface{}) (int, toolkit.Response) {
+	t.Helper()
+	data, _ := json.Marshal(body)
+	req, _ := http.NewRequest(http.MethodPost, url+path, bytes.NewReader(data))
+	req.Header.Set("X-GPTScript-Env", "GPTSCRIPT_WORKSPACE_ID="+workspace)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var result toolkit.Response
+	json.NewDecoder(resp.Body).Decode(&result)
+	return resp.StatusCode, result
+}
+
+// waitAsync runs a wait in the background, returning its events once it is done
+func waitAsync(t *testing.T, url, workspace string, body map[string]interface{}) <-chan []Event {
+	done := make(chan []Event, 1)
+	go func() {
+		_, resp := call(t, url, workspace, "/api/v1/wait", body)
+		data, _ := json.Marshal(resp.Data)
+		var result WaitResult
+		json.Unmarshal(data, &result)
+		done <- result.Events
+	}()
+	// Give the wait time to subscribe
+	time.Sleep(200 * time.Millisecond)
+	return done
+}
+
+func TestValidateSubject(t *testing.T) {
+	for _, subject := range []string{"orders", "orders.created", "a-b.c_d.1", "_reply.x"} {
+		if err := validateSubject(subject, false); err != nil {
+			t.Errorf("validateSubject(%q) = %v", subject, err)
+		}
+	}
+	for _, subject := range []string{"orders.*", "orders.>", "*.created"} {
+		if err := validateSubject(subject, true); err != nil {
+			t.Errorf("validateSubject(%q) with wildcards = %v", subject, err)
+		}
+		if err := validateSubject(subject, false); err == nil {
+			t.Errorf("validateSubject(%q) without wildcards succeeded", subject)
+		}
+	}
+	for _, subject := range []string{"", "orders.", ".orders", "a..b", "orders created", "orders.>.x", "a*.b", strings.Repeat("a", 257)} {
+		if err := validateSubject(subject, true); err == nil {
+			t.Errorf("validateSubject(%q) succeeded, want an error", subject)
+		}
+	}
+}
+
+func TestToEvent(t *testing.T) {
+	prefix := subjectPrefix("abc")
+	msg := nats.NewMsg(prefix + "orders.created")
+	msg.Reply = prefix + "_reply.1"
+	msg.Data = []byte{0xff, 0x00}
+	msg.Header.Set("Trace", "1")
+	event := toEvent("abc", msg)
+	if event.Subject != "orders.created" || event.Reply != "_reply.1" || event.Data != "" || event.DataBase64 != "/wA=" || event.Headers["Trace"] != "1" {
+		t.Errorf("unexpected event %+v", event)
+	}
+}
+
+func TestParams(t *testing.T) {
+	var req struct {
+		Text    payload          `json:"text"`
+		Object  payload          `json:"object"`
+		Timeout toolkit.Duration `json:"timeout"`
+		Seconds toolkit.Duration `json:"seconds"`
+		Number  toolkit.Duration `json:"number"`
+	}
+	data := `{"text": "hello", "object": {"id": 1,  "ok": true}, "timeout": "1m", "seconds": "2.5", "number": 3}`
+	if err := json.Unmarshal([]byte(data), &req); err != nil {
+		t.Fatal(err)
+	}
+	if string(req.Text) != "hello" || string(req.Object) != `{"id":1,"ok":true}` {
+		t.Errorf("unexpected payloads %q and %q", req.Text, req.Object)
+	}
+	if time.Duration(req.Timeout) != time.Minute || time.Duration(req.Seconds) != 2500*time.Millisecond || time.Duration(req.Number) != 3*time.Second {
+		t.Errorf("unexpected durations %v %v %v", req.Timeout, req.Seconds, req.Number)
+	}
+	if err := json.Unmarshal([]byte(`{"timeout": "soon"}`), &req); err == nil {
+		t.Error("expected an error for an invalid duration")
+	}
+}
+
+func TestPublishAndWait(t *testing.T) {
+	srv := newTestServer(t)
+	waited := waitAsync(t, srv.URL, "ws1", map[string]interface{}{"subjects": "orders.*", "max": "2", "timeout": "5s"})
+	other := waitAsync(t, srv.URL, "ws2", map[string]interface{}{"subjects": []string{">"}, "timeout": "1s"})
+
+	for _, data := range []interface{}{"first", map[string]int{"id": 2}} {
+		status, resp := call(t, srv.URL, "ws1", "/api/v1/publish", map[string]interface{}{"subject": "orders.created", "data": data})
+		if status != http.StatusOK || !resp.Success {
+			t.Fatalf("publish failed: %d %+v", status, resp)
+		}
+	}
+	events := <-waited
+	if len(events) != 2 || events[0].Data != "first" || events[1].Data != `{"id":2}` || events[0].Subject != "orders.created" {
+		t.Errorf("unexpected events %+v", events)
+	}
+	if events := <-other; len(events) != 0 {
+		t.Errorf("another workspace got events %+v", events)
+	}
+
+	if status, _ := call(t, srv.URL, "ws1", "/api/v1/publish", map[string]string{"subject": "orders.*"}); status != http.StatusBadRequest {
+		t.Errorf("publishing to a wildcard returned %d, want 400", status)
+	}
+}
+
+func TestRequestReply(t *testing.T) {
+	srv := newTestServer(t)
+	if status, _ := call(t, srv.URL, "ws1", "/api/v1/request", map[string]string{"subject": "math.double", "data": "2"}); status != http.StatusServiceUnavailable {
+		t.Errorf("a request without subscribers returned %d, want 503", status)
+	}
+
+	// A responder waits for the request and publishes its reply like any event
+	go func() {
+		_, resp := call(t, srv.URL, "ws1", "/api/v1/wait", map[string]string{"subjects": "math.double"})
+		data, _ := json.Marshal(resp.Data)
+		var result WaitResult
+		json.Unmarshal(data, &result)
+		if len(result.Events) == 1 {
+			call(t, srv.URL, "ws1", "/api/v1/publish", map[string]string{"subject": result.Events[0].Reply, "data": "4"})
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	status, resp := call(t, srv.URL, "ws1", "/api/v1/request", map[string]string{"subject": "math.double", "data": "2", "timeout": "5s"})
+	if status != http.StatusOK || resp.Data.(map[string]interface{})["data"] != "4" {
+		t.Errorf("unexpected reply %d %+v", status, resp)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	srv := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodPost, srv.URL+"/api/v1/subscribe", strings.NewReader(`{"subjects": ["alerts.>"]}`))
+	req.Header.Set("X-GPTScript-Env", "GPTSCRIPT_WORKSPACE_ID=ws1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("unexpected content type %s", resp.Header.Get("Content-Type"))
+	}
+
+	call(t, srv.URL, "ws1", "/api/v1/publish", map[string]interface{}{"subject": "alerts.disk.full", "data": "90%", "headers": map[string]string{"Severity": "high"}})
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var event Event
+			json.Unmarshal([]byte(data), &event)
+			if event.Subject != "alerts.disk.full" || event.Data != "90%" || event.Headers["Severity"] != "high" {
+				t.Errorf("unexpected event %+v", event)
+			}
+			return
+		}
+	}
+	t.Fatal("the stream ended without an event")
+}
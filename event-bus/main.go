@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"toolkit"
+)
+
+type Server struct {
+	nc *nats.Conn
+}
+
+// getPrefixFromEnv generates a SHA1 prefix from the workspace of a request, which scopes the
+// subjects it can publish and subscribe to
+func getPrefixFromEnv(headers http.Header) string {
+	workspaceID := toolkit.GPTScriptEnv(headers, "GPTSCRIPT_WORKSPACE_ID")
+	if workspaceID == "" {
+		return "default"
+	}
+	hasher := sha1.New()
+	hasher.Write([]byte(workspaceID))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func NewServer(nc *nats.Conn) (*Server, error) {
+	return &Server{nc: nc}, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rw := toolkit.NewResponseWriter(w)
+	w = rw
+	log.Printf("Request: %s %s", r.Method, r.URL.Path)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Handle health check endpoint
+	if r.URL.Path == "/api/ready" && r.Method == http.MethodGet {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// All other endpoints should be POST
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		log.Printf("Response: %d - Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/v1/publish":
+		s.handlePublish(w, r)
+	case "/api/v1/request":
+		s.handleRequest(w, r)
+	case "/api/v1/subscribe":
+		s.handleSubscribe(w, r)
+	case "/api/v1/wait":
+		s.handleWait(w, r)
+	default:
+		http.NotFound(w, r)
+		log.Printf("Response: 404 - Not Found")
+		return
+	}
+
+	log.Printf("Response Status: %d", rw.Status)
+}
+
+func main() {
+	port := getEnvOrDefault("PORT", "8080")
+
+	// The embedded NATS server only serves this process, so it doesn't listen on a port.
+	// Events are not stored, only delivered to the subscribers at the time.
+	ns, err := server.NewServer(&server.Options{
+		DontListen: true,
+		NoSigs:     true,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create server: %v", err)
+	}
+	ns.ConfigureLogger()
+	go ns.Start()
+	if !ns.ReadyForConnections(4 * time.Second) {
+		log.Fatal("Failed to start server")
+	}
+
+	nc, err := nats.Connect("", nats.InProcessServer(ns))
+	if err != nil {
+		log.Fatalf("Failed to connect to NATS: %v", err)
+	}
+	defer nc.Close()
+
+	httpServer, err := NewServer(nc)
+	if err != nil {
+		log.Fatalf("Failed to create HTTP server: %v", err)
+	}
+
+	go func() {
+		log.Printf("Starting HTTP server on port %s", port)
+		if err := http.ListenAndServe(":"+port, httpServer); err != nil {
+			log.Fatalf("HTTP server error: %v", err)
+		}
+	}()
+
+	// Handle graceful shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	<-sigChan
+	log.Print("Shutting down servers...")
+	ns.Shutdown()
+	ns.WaitForShutdown()
+}
+
+func getEnvOrDefault(key, defaultValue string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return defaultValue
+}
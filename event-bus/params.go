@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// payload is the data of an event. A string is sent as it is and any other JSON value as
+// its JSON text.
+type payload []byte
+
+func (p *payload) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		*p = []byte(str)
+		return nil
+	}
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, data); err != nil {
+		return err
+	}
+	if compact.String() == "null" {
+		*p = nil
+		return nil
+	}
+	*p = compact.Bytes()
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"toolkit"
+)
+
+const (
+	maxSubscriptions = 20
+	// subscriptionBuffer is how many events a subscription holds for a slow client. Events
+	// beyond it are dropped, as the broker does for any slow subscriber.
+	subscriptionBuffer = 1024
+	// keepAlive is how often an idle event stream is sent a comment, so proxies don't close
+	// it
+	keepAlive       = 30 * time.Second
+	defaultWait     = 30 * time.Second
+	maxWait         = 5 * time.Minute
+	maxWaitedEvents = 100
+)
+
+var queuePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+type SubscribeRequest struct {
+	Subjects toolkit.StringList `json:"subjects"`
+	// Queue makes the subscription part of a queue group, whose subscribers each get a share
+	// of the events instead of all of them
+	Queue string `json:"queue,omitempty"`
+}
+
+type WaitRequest struct {
+	Subjects toolkit.StringList `json:"subjects"`
+	Queue    string             `json:"queue,omitempty"`
+	Max      toolkit.Int        `json:"max,omitempty"`
+	Timeout  toolkit.Duration   `json:"timeout,omitempty"`
+}
+
+type WaitResult struct {
+	Events   []Event `json:"events"`
+	TimedOut bool    `json:"timed_out,omitempty"`
+}
+
+func (req SubscribeRequest) validate() error {
+	if len(req.Subjects) == 0 || len(req.Subjects) > maxSubscriptions {
+		return fmt.Errorf("between 1 and %d subjects are required", maxSubscriptions)
+	}
+	for _, subject := range req.Subjects {
+		if err := validateSubject(subject, true); err != nil {
+			return err
+		}
+	}
+	if req.Queue != "" && !queuePattern.MatchString(req.Queue) {
+		return fmt.Errorf("queue must be 1 to 64 letters, digits, - and _")
+	}
+	return nil
+}
+
+// subscribe subscribes to subjects of a workspace, delivering their messages to a channel.
+// The returned function unsubscribes.
+func (s *Server) subscribe(prefix string, req SubscribeRequest) (chan *nats.Msg, func(), error) {
+	messages := make(chan *nats.Msg, subscriptionBuffer)
+	var subs []*nats.Subscription
+	unsubscribe := func() {
+		for _, sub := range subs {
+			sub.Unsubscribe()
+		}
+	}
+	for _, subject := range req.Subjects {
+		sub, err := s.nc.ChanQueueSubscribe(subjectPrefix(prefix)+subject, req.Queue, messages)
+		if err != nil {
+			unsubscribe()
+			return nil, nil, fmt.Errorf("failed to subscribe to %s: %v", subject, err)
+		}
+		subs = append(subs, sub)
+	}
+	// The subscriptions are in place once the broker has seen them, so events published
+	// right after a subscribe call returns are delivered
+	if err := s.nc.Flush(); err != nil {
+		unsubscribe()
+		return nil, nil, fmt.Errorf("failed to subscribe: %v", err)
+	}
+	return messages, unsubscribe, nil
+}
+
+// handleSubscribe streams the events published to subjects of the workspace as server-sent
+// events until the client disconnects
+func (s *Server) handleSubscribe(w http.ResponseWriter, r *http.Request) {
+	var req SubscribeRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if err := req.validate(); err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	prefix := getPrefixFromEnv(r.Header)
+	messages, unsubscribe, err := s.subscribe(prefix, req)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer unsubscribe()
+
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := controller.Flush(); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	var id uint64
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case msg := <-messages:
+			data, err := json.Marshal(toEvent(prefix, msg))
+			if err != nil {
+				continue
+			}
+			id++
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", id, data); err != nil {
+				return
+			}
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// handleWait subscribes to subjects of the workspace and returns the events published to
+// them until max events arrive or the timeout passes, for clients that can't hold a stream
+// open
+func (s *Server) handleWait(w http.ResponseWriter, r *http.Request) {
+	var req WaitRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if req.Max == 0 {
+		req.Max = 1
+	}
+	if req.Timeout == 0 {
+		req.Timeout = toolkit.Duration(defaultWait)
+	}
+	subscription := SubscribeRequest{Subjects: req.Subjects, Queue: req.Queue}
+	err := subscription.validate()
+	switch {
+	case err != nil:
+	case req.Max < 1 || req.Max > maxWaitedEvents:
+		err = fmt.Errorf("max must be between 1 and %d", maxWaitedEvents)
+	case req.Timeout < 0 || time.Duration(req.Timeout) > maxWait:
+		err = fmt.Errorf("timeout can be at most %s", maxWait)
+	}
+	if err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	prefix := getPrefixFromEnv(r.Header)
+	messages, unsubscribe, err := s.subscribe(prefix, subscription)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer unsubscribe()
+
+	ctx, cancel := context.WithTimeout(r.Context(), time.Duration(req.Timeout))
+	defer cancel()
+	result := WaitResult{Events: []Event{}}
+	for len(result.Events) < int(req.Max) && !result.TimedOut {
+		select {
+		case <-ctx.Done():
+			result.TimedOut = true
+		case msg := <-messages:
+			result.Events = append(result.Events, toEvent(prefix, msg))
+		}
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: result})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"toolkit"
+)
+
+type UpsertEdgesRequest struct {
+	Edges edgeList     `json:"edges"`
+	Merge toolkit.Bool `json:"merge,omitempty"`
+}
+
+type FindEdgesRequest struct {
+	From       string             `json:"from,omitempty"`
+	To         string             `json:"to,omitempty"`
+	Type       string             `json:"type,omitempty"`
+	Properties toolkit.JSONObject `json:"properties,omitempty"`
+	Limit      toolkit.Int        `json:"limit,omitempty"`
+}
+
+type DeleteEdgesRequest struct {
+	Edges edgeList `json:"edges"`
+}
+
+func validateEdge(edge Edge) error {
+	switch {
+	case edge.From == "" || edge.To == "":
+		return fmt.Errorf("from and to are required")
+	case edge.Type == "" || len(edge.Type) > maxLabelLength:
+		return fmt.Errorf("type must be 1 to %d characters", maxLabelLength)
+	}
+	return nil
+}
+
+// handleUpsertEdges adds edges between existing nodes, or replaces those with the same ends
+// and type. With merge, the properties of existing edges are added to.
+func (s *Server) handleUpsertEdges(w http.ResponseWriter, r *http.Request) {
+	var req UpsertEdgesRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if len(req.Edges) == 0 || len(req.Edges) > maxUpsert {
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("between 1 and %d edges are required", maxUpsert))
+		return
+	}
+	bucket, g, ok := s.loadGraph(w, r)
+	if !ok {
+		return
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	for i, edge := range req.Edges {
+		if err := validateEdge(edge); err != nil {
+			toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("edge %d: %v", i, err))
+			return
+		}
+		for _, id := range []string{edge.From, edge.To} {
+			if _, ok := g.nodes[id]; !ok {
+				toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("edge %d: node %s does not exist, add it first", i, id))
+				return
+			}
+		}
+	}
+
+	now := time.Now().UTC()
+	for _, edge := range req.Edges {
+		if existing, ok := g.edge(edge.key()); ok && bool(req.Merge) {
+			edge.Properties = mergeProperties(existing.Properties, edge.Properties)
+		}
+		edge.Updated = now
+		data, _ := json.Marshal(edge)
+		if _, err := bucket.Put(edgeStorageKey(edge.key()), data); err != nil {
+			toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to write edge %s -%s-> %s: %v", edge.From, edge.Type, edge.To, err))
+			return
+		}
+		g.addEdge(&edge)
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: map[string]int{"upserted": len(req.Edges)}})
+}
+
+// handleFindEdges returns the edges from a node, to a node, of a type and with properties,
+// any of which can be left out
+func (s *Server) handleFindEdges(w http.ResponseWriter, r *http.Request) {
+	var req FindEdgesRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = 100
+	}
+	if req.Limit < 1 || req.Limit > maxFindSize {
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxFindSize))
+		return
+	}
+	_, g, ok := s.loadGraph(w, r)
+	if !ok {
+		return
+	}
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+
+	var candidates []*Edge
+	switch {
+	case req.From != "":
+		candidates = g.edgesOf(req.From, directionOut)
+	case req.To != "":
+		candidates = g.edgesOf(req.To, directionIn)
+	default:
+		for _, edges := range g.out {
+			for _, edge := range edges {
+				candidates = append(candidates, edge)
+			}
+		}
+	}
+	edges := []*Edge{}
+	for _, edge := range candidates {
+		if (req.To == "" || edge.To == req.To) && (req.Type == "" || edge.Type == req.Type) && matchesProperties(edge.Properties, req.Properties) {
+			edges = append(edges, edge)
+		}
+	}
+	sortEdges(edges)
+	result := FindResult[*Edge]{Items: edges[:min(len(edges), int(req.Limit))], Total: len(edges)}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: result})
+}
+
+func (s *Server) handleDeleteEdges(w http.ResponseWriter, r *http.Request) {
+	var req DeleteEdgesRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if len(req.Edges) == 0 {
+		toolkit.WriteError(w, http.StatusBadRequest, "edges are required")
+		return
+	}
+	bucket, g, ok := s.loadGraph(w, r)
+	if !ok {
+		return
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	deleted := 0
+	for _, edge := range req.Edges {
+		if _, ok := g.edge(edge.key()); !ok {
+			continue
+		}
+		if err := deleteEdge(bucket, g, edge.key()); err != nil {
+			toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		deleted++
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: map[string]int{"deleted": deleted}})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"toolkit"
+)
+
+const (
+	maxIDLength    = 256
+	maxLabelLength = 64
+)
+
+// Nodes are stored as node.<id>, edges as edge.<from>.<type>.<to>, with each part base64
+// encoded so any string can be one. An edge is identified by its ends and type, so adding
+// the same relationship twice updates it.
+type Node struct {
+	ID         string             `json:"id"`
+	Label      string             `json:"label,omitempty"`
+	Properties toolkit.JSONObject `json:"properties,omitempty"`
+	Updated    time.Time          `json:"updated"`
+}
+
+type Edge struct {
+	From       string             `json:"from"`
+	To         string             `json:"to"`
+	Type       string             `json:"type"`
+	Properties toolkit.JSONObject `json:"properties,omitempty"`
+	Updated    time.Time          `json:"updated"`
+}
+
+type edgeKey struct {
+	from, typ, to string
+}
+
+func (e *Edge) key() edgeKey {
+	return edgeKey{from: e.From, typ: e.Type, to: e.To}
+}
+
+func encode(part string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(part))
+}
+
+func nodeKey(id string) string {
+	return "node." + encode(id)
+}
+
+func edgeStorageKey(key edgeKey) string {
+	return "edge." + encode(key.from) + "." + encode(key.typ) + "." + encode(key.to)
+}
+
+// graph is the graph of a workspace, with the edges of each node indexed both ways
+type graph struct {
+	lock  sync.RWMutex
+	nodes map[string]*Node
+	out   map[string]map[edgeKey]*Edge
+	in    map[string]map[edgeKey]*Edge
+}
+
+func newGraph() *graph {
+	return &graph{
+		nodes: map[string]*Node{},
+		out:   map[string]map[edgeKey]*Edge{},
+		in:    map[string]map[edgeKey]*Edge{},
+	}
+}
+
+func (g *graph) addEdge(edge *Edge) {
+	key := edge.key()
+	if g.out[edge.From] == nil {
+		g.out[edge.From] = map[edgeKey]*Edge{}
+	}
+	if g.in[edge.To] == nil {
+		g.in[edge.To] = map[edgeKey]*Edge{}
+	}
+	g.out[edge.From][key] = edge
+	g.in[edge.To][key] = edge
+}
+
+func (g *graph) removeEdge(key edgeKey) {
+	delete(g.out[key.from], key)
+	if len(g.out[key.from]) == 0 {
+		delete(g.out, key.from)
+	}
+	delete(g.in[key.to], key)
+	if len(g.in[key.to]) == 0 {
+		delete(g.in, key.to)
+	}
+}
+
+func (g *graph) edge(key edgeKey) (*Edge, bool) {
+	edge, ok := g.out[key.from][key]
+	return edge, ok
+}
+
+// edgesOf returns the edges of a node, outgoing, incoming or both
+func (g *graph) edgesOf(id, direction string) []*Edge {
+	var edges []*Edge
+	if direction != directionIn {
+		for _, edge := range g.out[id] {
+			edges = append(edges, edge)
+		}
+	}
+	if direction != directionOut {
+		for _, edge := range g.in[id] {
+			// A self loop is already among the outgoing edges
+			if direction == directionBoth && edge.From == id {
+				continue
+			}
+			edges = append(edges, edge)
+		}
+	}
+	return edges
+}
+
+// graphCache holds the graph of each workspace used. Writes go through the cache.
+type graphCache struct {
+	lock   sync.Mutex
+	graphs map[string]*graph
+}
+
+func newGraphCache() *graphCache {
+	return &graphCache{graphs: map[string]*graph{}}
+}
+
+// get returns the graph of a bucket, reading it the first time
+func (c *graphCache) get(bucket nats.KeyValue) (*graph, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if g, ok := c.graphs[bucket.Bucket()]; ok {
+		return g, nil
+	}
+
+	g := newGraph()
+	watcher, err := bucket.WatchAll(nats.IgnoreDeletes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the graph: %v", err)
+	}
+	defer watcher.Stop()
+	// The watcher sends the current values, then nil once it is up to date
+	var edges []*Edge
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		switch {
+		case strings.HasPrefix(entry.Key(), "node."):
+			var node Node
+			if err := json.Unmarshal(entry.Value(), &node); err != nil {
+				return nil, fmt.Errorf("failed to read %s: %v", entry.Key(), err)
+			}
+			g.nodes[node.ID] = &node
+		case strings.HasPrefix(entry.Key(), "edge."):
+			var edge Edge
+			if err := json.Unmarshal(entry.Value(), &edge); err != nil {
+				return nil, fmt.Errorf("failed to read %s: %v", entry.Key(), err)
+			}
+			edges = append(edges, &edge)
+		}
+	}
+	// Edges left behind by a node delete that failed part way are skipped
+	for _, edge := range edges {
+		if g.nodes[edge.From] != nil && g.nodes[edge.To] != nil {
+			g.addEdge(edge)
+		}
+	}
+	c.graphs[bucket.Bucket()] = g
+	return g, nil
+}
+
+// loadGraph reads the graph of the workspace of a request, writing an error response when
+// it can't
+func (s *Server) loadGraph(w http.ResponseWriter, r *http.Request) (nats.KeyValue, *graph, bool) {
+	bucket, err := s.getBucket(getPrefixFromEnv(r.Header))
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return nil, nil, false
+	}
+	g, err := s.graphs.get(bucket)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return nil, nil, false
+	}
+	return bucket, g, true
+}
+
+// matchesProperties reports whether properties hold every field of the filter. Values are
+// compared as decoded from JSON, so 1 matches 1.0.
+func matchesProperties(properties, filter map[string]interface{}) bool {
+	for field, want := range filter {
+		got, ok := properties[field]
+		if !ok || !reflect.DeepEqual(normalizeJSON(got), normalizeJSON(want)) {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeJSON(value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var normalized interface{}
+	json.Unmarshal(data, &normalized)
+	return normalized
+}
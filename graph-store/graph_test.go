@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"toolkit"
+)
+
+// testGraph builds a graph of a -knows-> b -knows-> c -works_at-> d and a -works_at-> d,
+// with a self loop on d and e on its own
+func testGraph() *graph {
+	g := newGraph()
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		g.nodes[id] = &Node{ID: id}
+	}
+	for _, edge := range []Edge{
+		{From: "a", To: "b", Type: "knows"},
+		{From: "b", To: "c", Type: "knows"},
+		{From: "c", To: "d", Type: "works_at"},
+		{From: "a", To: "d", Type: "works_at"},
+		{From: "d", To: "d", Type: "owns"},
+	} {
+		g.addEdge(&edge)
+	}
+	return g
+}
+
+func ids(nodes []*Node) []string {
+	var ids []string
+	for _, node := range nodes {
+		ids = append(ids, node.ID)
+	}
+	return ids
+}
+
+func TestEdgesOf(t *testing.T) {
+	g := testGraph()
+	tests := []struct {
+		id, direction string
+		want          int
+	}{
+		{"a", directionOut, 2},
+		{"a", directionIn, 0},
+		{"d", directionIn, 3},
+		{"d", directionOut, 1},
+		{"d", directionBoth, 3},
+		{"e", directionBoth, 0},
+	}
+	for _, tt := range tests {
+		if got := g.edgesOf(tt.id, tt.direction); len(got) != tt.want {
+			t.Errorf("edgesOf(%s, %s) returned %d edges, want %d", tt.id, tt.direction, len(got), tt.want)
+		}
+	}
+
+	g.removeEdge(edgeKey{from: "a", typ: "knows", to: "b"})
+	if _, ok := g.edge(edgeKey{from: "a", typ: "knows", to: "b"}); ok {
+		t.Error("the edge is still there after removeEdge")
+	}
+	if got := g.edgesOf("b", directionIn); len(got) != 0 {
+		t.Errorf("b has %d incoming edges after removeEdge, want 0", len(got))
+	}
+}
+
+func TestNeighbors(t *testing.T) {
+	g := testGraph()
+	result := g.neighbors("a", directionOut, nil, 2, 100)
+	var got []string
+	for _, neighbor := range result.Nodes {
+		got = append(got, neighbor.ID)
+	}
+	if want := []string{"b", "d", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("neighbors of a = %v, want %v", got, want)
+	}
+	if result.Nodes[2].Distance != 2 || len(result.Edges) != 3 || result.Truncated {
+		t.Errorf("unexpected neighbors result %+v", result)
+	}
+
+	result = g.neighbors("d", directionIn, []string{"knows", "works_at"}, 1, 100)
+	if len(result.Nodes) != 2 {
+		t.Errorf("d has %d incoming works_at neighbors, want 2", len(result.Nodes))
+	}
+
+	result = g.neighbors("a", directionBoth, nil, 5, 2)
+	if len(result.Nodes) != 2 || !result.Truncated {
+		t.Errorf("neighbors with a limit of 2 returned %d nodes, truncated %v", len(result.Nodes), result.Truncated)
+	}
+}
+
+func TestShortestPath(t *testing.T) {
+	g := testGraph()
+	tests := []struct {
+		from, to, direction string
+		types               []string
+		maxDepth            int
+		want                []string
+	}{
+		{"a", "d", directionOut, nil, 6, []string{"a", "d"}},
+		{"a", "d", directionOut, []string{"knows", "works_at"}, 6, []string{"a", "d"}},
+		{"b", "d", directionOut, nil, 6, []string{"b", "c", "d"}},
+		{"d", "a", directionOut, nil, 6, nil},
+		{"d", "a", directionIn, nil, 6, []string{"d", "a"}},
+		{"b", "d", directionOut, nil, 1, nil},
+		{"c", "a", directionBoth, []string{"knows"}, 6, []string{"c", "b", "a"}},
+		{"a", "a", directionOut, nil, 6, []string{"a"}},
+		{"a", "e", directionBoth, nil, 6, nil},
+	}
+	for _, tt := range tests {
+		result := g.shortestPath(tt.from, tt.to, tt.direction, tt.types, tt.maxDepth)
+		if result.Found != (tt.want != nil) || !reflect.DeepEqual(ids(result.Nodes), tt.want) {
+			t.Errorf("shortestPath(%s, %s, %s, %v) = %v, want %v", tt.from, tt.to, tt.direction, tt.types, ids(result.Nodes), tt.want)
+			continue
+		}
+		if result.Found && len(result.Edges) != len(result.Nodes)-1 {
+			t.Errorf("shortestPath(%s, %s) returned %d edges for %d nodes", tt.from, tt.to, len(result.Edges), len(result.Nodes))
+		}
+	}
+}
+
+func TestMergeProperties(t *testing.T) {
+	existing := toolkit.JSONObject{"name": "Ada", "age": 36.0}
+	got := mergeProperties(existing, toolkit.JSONObject{"age": 37.0, "name": nil, "city": "London"})
+	if want := (toolkit.JSONObject{"age": 37.0, "city": "London"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeProperties = %v, want %v", got, want)
+	}
+	if got := mergeProperties(toolkit.JSONObject{"name": "Ada"}, toolkit.JSONObject{"name": nil}); got != nil {
+		t.Errorf("mergeProperties removing every property = %v, want nil", got)
+	}
+}
+
+func TestMatchesProperties(t *testing.T) {
+	properties := map[string]interface{}{"age": 36.0, "tags": []interface{}{"a", "b"}}
+	if !matchesProperties(properties, map[string]interface{}{"age": 36, "tags": []string{"a", "b"}}) {
+		t.Error("expected the properties to match")
+	}
+	if matchesProperties(properties, map[string]interface{}{"age": "36"}) {
+		t.Error("expected a string not to match a number")
+	}
+	if matchesProperties(properties, map[string]interface{}{"name": nil}) {
+		t.Error("expected a missing property not to match")
+	}
+}
+
+func TestParams(t *testing.T) {
+	var req struct {
+		Nodes nodeList           `json:"nodes"`
+		Edges edgeList           `json:"edges"`
+		IDs   toolkit.StringList `json:"ids"`
+		Depth toolkit.Int        `json:"depth"`
+		Merge toolkit.Bool       `json:"merge"`
+		Props toolkit.JSONObject `json:"props"`
+	}
+	data := `{
+		"nodes": "[{\"id\": \"a\", \"label\": \"person\"}]",
+		"edges": [{"from": "a", "to": "b", "type": "knows"}],
+		"ids": "a, b",
+		"depth": "2",
+		"merge": "true",
+		"props": "{\"x\": 1}"
+	}`
+	if err := json.Unmarshal([]byte(data), &req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.Nodes) != 1 || req.Nodes[0].Label != "person" || len(req.Edges) != 1 || req.Edges[0].Type != "knows" {
+		t.Errorf("unexpected nodes %+v and edges %+v", req.Nodes, req.Edges)
+	}
+	if !reflect.DeepEqual([]string(req.IDs), []string{"a", "b"}) || req.Depth != 2 || !bool(req.Merge) || req.Props["x"] != 1.0 {
+		t.Errorf("unexpected params %+v", req)
+	}
+	if err := json.Unmarshal([]byte(`{"nodes": "not json"}`), &req); err == nil {
+		t.Error("expected an error for an invalid node list")
+	}
+}
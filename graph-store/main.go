@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"toolkit"
+)
+
+type Server struct {
+	nc     *nats.Conn
+	graphs *graphCache
+}
+
+// getPrefixFromEnv generates a SHA1 prefix from the workspace of a request, which names the
+// bucket holding its graph
+func getPrefixFromEnv(headers http.Header) string {
+	workspaceID := toolkit.GPTScriptEnv(headers, "GPTSCRIPT_WORKSPACE_ID")
+	if workspaceID == "" {
+		return "default"
+	}
+	hasher := sha1.New()
+	hasher.Write([]byte(workspaceID))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func NewServer(nc *nats.Conn) (*Server, error) {
+	return &Server{
+		nc:     nc,
+		graphs: newGraphCache(),
+	}, nil
+}
+
+// getBucket gets or creates the bucket of a workspace
+func (s *Server) getBucket(prefix string) (nats.KeyValue, error) {
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+
+	kv, err := js.CreateKeyValue(&nats.KeyValueConfig{
+		Bucket: "graph-" + prefix,
+	})
+	if err != nil {
+		// If it already exists, try to get it
+		kv, err = js.KeyValue("graph-" + prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create/get KV store: %v", err)
+		}
+	}
+	return kv, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rw := toolkit.NewResponseWriter(w)
+	w = rw
+	log.Printf("Request: %s %s", r.Method, r.URL.Path)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Handle health check endpoint
+	if r.URL.Path == "/api/ready" && r.Method == http.MethodGet {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// All other endpoints should be POST
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		log.Printf("Response: %d - Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/v1/nodes/upsert":
+		s.handleUpsertNodes(w, r)
+	case "/api/v1/nodes/get":
+		s.handleGetNodes(w, r)
+	case "/api/v1/nodes/find":
+		s.handleFindNodes(w, r)
+	case "/api/v1/nodes/delete":
+		s.handleDeleteNodes(w, r)
+	case "/api/v1/edges/upsert":
+		s.handleUpsertEdges(w, r)
+	case "/api/v1/edges/find":
+		s.handleFindEdges(w, r)
+	case "/api/v1/edges/delete":
+		s.handleDeleteEdges(w, r)
+	case "/api/v1/neighbors":
+		s.handleNeighbors(w, r)
+	case "/api/v1/path":
+		s.handlePath(w, r)
+	default:
+		http.NotFound(w, r)
+		log.Printf("Response: 404 - Not Found")
+		return
+	}
+
+	log.Printf("Response Status: %d", rw.Status)
+}
+
+func main() {
+	port := getEnvOrDefault("PORT", "8080")
+	storageDir := flag.String("s", getEnvOrDefault("NATS_STORAGE", "./data"), "Directory for storing data (env: NATS_STORAGE)")
+	flag.Parse()
+
+	// Ensure storage directory exists
+	if err := os.MkdirAll(*storageDir, 0755); err != nil {
+		log.Fatalf("Failed to create storage directory: %v", err)
+	}
+
+	// The embedded NATS server only serves this process, so it doesn't listen on a port
+	ns, err := server.NewServer(&server.Options{
+		JetStream:  true,
+		StoreDir:   filepath.Clean(*storageDir),
+		DontListen: true,
+		NoSigs:     true,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create server: %v", err)
+	}
+	ns.ConfigureLogger()
+	go ns.Start()
+	if !ns.ReadyForConnections(4 * time.Second) {
+		log.Fatal("Failed to start server")
+	}
+
+	nc, err := nats.Connect("", nats.InProcessServer(ns))
+	if err != nil {
+		log.Fatalf("Failed to connect to NATS: %v", err)
+	}
+	defer nc.Close()
+
+	httpServer, err := NewServer(nc)
+	if err != nil {
+		log.Fatalf("Failed to create HTTP server: %v", err)
+	}
+
+	go func() {
+		log.Printf("Starting HTTP server on port %s", port)
+		if err := http.ListenAndServe(":"+port, httpServer); err != nil {
+			log.Fatalf("HTTP server error: %v", err)
+		}
+	}()
+	log.Printf("Storage directory: %s", *storageDir)
+
+	// Handle graceful shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	<-sigChan
+	log.Print("Shutting down servers...")
+	ns.Shutdown()
+	ns.WaitForShutdown()
+}
+
+func getEnvOrDefault(key, defaultValue string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"toolkit"
+)
+
+const (
+	maxUpsert   = 1000
+	maxFindSize = 1000
+)
+
+type UpsertNodesRequest struct {
+	Nodes nodeList     `json:"nodes"`
+	Merge toolkit.Bool `json:"merge,omitempty"`
+}
+
+type NodesRequest struct {
+	IDs       toolkit.StringList `json:"ids"`
+	WithEdges toolkit.Bool       `json:"with_edges,omitempty"`
+}
+
+type FindNodesRequest struct {
+	Label      string             `json:"label,omitempty"`
+	Properties toolkit.JSONObject `json:"properties,omitempty"`
+	Limit      toolkit.Int        `json:"limit,omitempty"`
+}
+
+type NodeResult struct {
+	*Node
+	Edges []*Edge `json:"edges,omitempty"`
+}
+
+type FindResult[T any] struct {
+	Items []T `json:"items"`
+	// Total is the number of matches, of which Items holds up to the limit
+	Total int `json:"total"`
+}
+
+func validateNode(node Node) error {
+	if node.ID == "" || len(node.ID) > maxIDLength {
+		return fmt.Errorf("id must be 1 to %d characters", maxIDLength)
+	}
+	if len(node.Label) > maxLabelLength {
+		return fmt.Errorf("label can be at most %d characters", maxLabelLength)
+	}
+	return nil
+}
+
+// mergeProperties adds properties to existing ones. A null property removes it.
+func mergeProperties(existing, properties toolkit.JSONObject) toolkit.JSONObject {
+	merged := toolkit.JSONObject{}
+	for name, value := range existing {
+		merged[name] = value
+	}
+	for name, value := range properties {
+		if value == nil {
+			delete(merged, name)
+		} else {
+			merged[name] = value
+		}
+	}
+	if len(merged) == 0 {
+		return nil
+	}
+	return merged
+}
+
+// sortEdges orders edges by their ends and type, so results don't depend on map order
+func sortEdges(edges []*Edge) {
+	slices.SortFunc(edges, func(a, b *Edge) int {
+		return cmp.Or(cmp.Compare(a.From, b.From), cmp.Compare(a.Type, b.Type), cmp.Compare(a.To, b.To))
+	})
+}
+
+// handleUpsertNodes adds nodes or replaces them. With merge, the properties of existing
+// nodes are added to rather than replaced, and their label kept unless one is given.
+func (s *Server) handleUpsertNodes(w http.ResponseWriter, r *http.Request) {
+	var req UpsertNodesRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if len(req.Nodes) == 0 || len(req.Nodes) > maxUpsert {
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("between 1 and %d nodes are required", maxUpsert))
+		return
+	}
+	for i, node := range req.Nodes {
+		if err := validateNode(node); err != nil {
+			toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("node %d: %v", i, err))
+			return
+		}
+	}
+	bucket, g, ok := s.loadGraph(w, r)
+	if !ok {
+		return
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	now := time.Now().UTC()
+	for _, node := range req.Nodes {
+		if existing, ok := g.nodes[node.ID]; ok && bool(req.Merge) {
+			node.Properties = mergeProperties(existing.Properties, node.Properties)
+			if node.Label == "" {
+				node.Label = existing.Label
+			}
+		}
+		node.Updated = now
+		data, _ := json.Marshal(node)
+		if _, err := bucket.Put(nodeKey(node.ID), data); err != nil {
+			toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to write node %s: %v", node.ID, err))
+			return
+		}
+		g.nodes[node.ID] = &node
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: map[string]int{"upserted": len(req.Nodes)}})
+}
+
+func (s *Server) handleGetNodes(w http.ResponseWriter, r *http.Request) {
+	var req NodesRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	_, g, ok := s.loadGraph(w, r)
+	if !ok {
+		return
+	}
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	nodes := make([]NodeResult, 0, len(req.IDs))
+	for _, id := range req.IDs {
+		node, ok := g.nodes[id]
+		if !ok {
+			continue
+		}
+		result := NodeResult{Node: node}
+		if req.WithEdges {
+			result.Edges = g.edgesOf(id, directionBoth)
+			sortEdges(result.Edges)
+		}
+		nodes = append(nodes, result)
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: nodes})
+}
+
+// handleFindNodes returns the nodes with a label and properties, sorted by ID
+func (s *Server) handleFindNodes(w http.ResponseWriter, r *http.Request) {
+	var req FindNodesRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = 100
+	}
+	if req.Limit < 1 || req.Limit > maxFindSize {
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxFindSize))
+		return
+	}
+	_, g, ok := s.loadGraph(w, r)
+	if !ok {
+		return
+	}
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	var nodes []*Node
+	for _, node := range g.nodes {
+		if (req.Label == "" || node.Label == req.Label) && matchesProperties(node.Properties, req.Properties) {
+			nodes = append(nodes, node)
+		}
+	}
+	slices.SortFunc(nodes, func(a, b *Node) int { return cmp.Compare(a.ID, b.ID) })
+	result := FindResult[*Node]{Items: nodes[:min(len(nodes), int(req.Limit))], Total: len(nodes)}
+	if result.Items == nil {
+		result.Items = []*Node{}
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: result})
+}
+
+// handleDeleteNodes removes nodes with their edges. The edges go first, so a failure part
+// way leaves no edge to a missing node.
+func (s *Server) handleDeleteNodes(w http.ResponseWriter, r *http.Request) {
+	var req NodesRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if len(req.IDs) == 0 {
+		toolkit.WriteError(w, http.StatusBadRequest, "ids are required")
+		return
+	}
+	bucket, g, ok := s.loadGraph(w, r)
+	if !ok {
+		return
+	}
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	deleted, deletedEdges := 0, 0
+	for _, id := range req.IDs {
+		if _, ok := g.nodes[id]; !ok {
+			continue
+		}
+		for _, edge := range g.edgesOf(id, directionBoth) {
+			if err := deleteEdge(bucket, g, edge.key()); err != nil {
+				toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			deletedEdges++
+		}
+		if err := bucket.Purge(nodeKey(id)); err != nil {
+			toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to delete node %s: %v", id, err))
+			return
+		}
+		delete(g.nodes, id)
+		deleted++
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: map[string]int{"deleted": deleted, "deleted_edges": deletedEdges}})
+}
+
+// deleteEdge removes an edge from the bucket and the graph. The caller holds the lock of
+// the graph.
+func deleteEdge(bucket nats.KeyValue, g *graph, key edgeKey) error {
+	if err := bucket.Purge(edgeStorageKey(key)); err != nil {
+		return fmt.Errorf("failed to delete edge %s -%s-> %s: %v", key.from, key.typ, key.to, err)
+	}
+	g.removeEdge(key)
+	return nil
+}
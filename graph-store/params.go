@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// nodeList is a list of nodes that can also be given as a string holding a JSON array
+type nodeList []Node
+
+func (l *nodeList) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		data = []byte(str)
+	}
+	var nodes []Node
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		return fmt.Errorf("expected a list of nodes: %v", err)
+	}
+	*l = nodes
+	return nil
+}
+
+// edgeList is a list of edges that can also be given as a string holding a JSON array
+type edgeList []Edge
+
+func (l *edgeList) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		data = []byte(str)
+	}
+	var edges []Edge
+	if err := json.Unmarshal(data, &edges); err != nil {
+		return fmt.Errorf("expected a list of edges: %v", err)
+	}
+	*l = edges
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"toolkit"
+)
+
+// Directions edges are followed in
+const (
+	directionOut  = "out"
+	directionIn   = "in"
+	directionBoth = "both"
+)
+
+const (
+	maxNeighborDepth = 5
+	maxPathDepth     = 10
+)
+
+type NeighborsRequest struct {
+	ID        string             `json:"id"`
+	Direction string             `json:"direction,omitempty"`
+	Types     toolkit.StringList `json:"types,omitempty"`
+	Depth     toolkit.Int        `json:"depth,omitempty"`
+	Limit     toolkit.Int        `json:"limit,omitempty"`
+}
+
+type Neighbor struct {
+	*Node
+	// Distance is the number of edges from the start node
+	Distance int `json:"distance"`
+}
+
+type NeighborsResult struct {
+	Nodes []Neighbor `json:"nodes"`
+	// Edges are the edges followed to reach the nodes
+	Edges     []*Edge `json:"edges"`
+	Truncated bool    `json:"truncated,omitempty"`
+}
+
+type PathRequest struct {
+	From      string             `json:"from"`
+	To        string             `json:"to"`
+	Direction string             `json:"direction,omitempty"`
+	Types     toolkit.StringList `json:"types,omitempty"`
+	MaxDepth  toolkit.Int        `json:"max_depth,omitempty"`
+}
+
+type PathResult struct {
+	Found bool `json:"found"`
+	// Length is the number of edges of the path
+	Length int     `json:"length,omitempty"`
+	Nodes  []*Node `json:"nodes,omitempty"`
+	Edges  []*Edge `json:"edges,omitempty"`
+}
+
+// step is an edge followed from a node to another
+type step struct {
+	edge *Edge
+	next string
+}
+
+// steps returns the edges that can be followed from a node, in a stable order
+func (g *graph) steps(id, direction string, types []string) []step {
+	var steps []step
+	for _, edge := range g.edgesOf(id, direction) {
+		if len(types) > 0 && !slices.Contains(types, edge.Type) {
+			continue
+		}
+		next := edge.To
+		if edge.To == id {
+			next = edge.From
+		}
+		steps = append(steps, step{edge: edge, next: next})
+	}
+	slices.SortFunc(steps, func(a, b step) int {
+		return cmp.Or(cmp.Compare(a.edge.Type, b.edge.Type), cmp.Compare(a.next, b.next))
+	})
+	return steps
+}
+
+// neighbors returns the nodes within depth edges of a node, nearest first, with the edges
+// followed to reach them
+func (g *graph) neighbors(start, direction string, types []string, depth, limit int) NeighborsResult {
+	result := NeighborsResult{Nodes: []Neighbor{}, Edges: []*Edge{}}
+	distances := map[string]int{start: 0}
+	frontier := []string{start}
+	for distance := 1; distance <= depth && len(frontier) > 0; distance++ {
+		var next []string
+		for _, id := range frontier {
+			for _, step := range g.steps(id, direction, types) {
+				if _, seen := distances[step.next]; seen {
+					continue
+				}
+				if len(result.Nodes) == limit {
+					result.Truncated = true
+					return result
+				}
+				distances[step.next] = distance
+				next = append(next, step.next)
+				result.Nodes = append(result.Nodes, Neighbor{Node: g.nodes[step.next], Distance: distance})
+				result.Edges = append(result.Edges, step.edge)
+			}
+		}
+		frontier = next
+	}
+	return result
+}
+
+// shortestPath finds a path with the fewest edges between two nodes by breadth first search
+func (g *graph) shortestPath(from, to, direction string, types []string, maxDepth int) PathResult {
+	if from == to {
+		return PathResult{Found: true, Nodes: []*Node{g.nodes[from]}, Edges: []*Edge{}}
+	}
+	// previous holds the step that reached each node
+	previous := map[string]step{from: {}}
+	frontier := []string{from}
+	for depth := 1; depth <= maxDepth && len(frontier) > 0; depth++ {
+		var next []string
+		for _, id := range frontier {
+			for _, s := range g.steps(id, direction, types) {
+				if _, seen := previous[s.next]; seen {
+					continue
+				}
+				previous[s.next] = step{edge: s.edge, next: id}
+				if s.next == to {
+					return g.path(previous, from, to)
+				}
+				next = append(next, s.next)
+			}
+		}
+		frontier = next
+	}
+	return PathResult{Found: false}
+}
+
+// path walks back from the end of a search to its start
+func (g *graph) path(previous map[string]step, from, to string) PathResult {
+	result := PathResult{Found: true}
+	for id := to; id != from; id = previous[id].next {
+		result.Nodes = append(result.Nodes, g.nodes[id])
+		result.Edges = append(result.Edges, previous[id].edge)
+	}
+	result.Nodes = append(result.Nodes, g.nodes[from])
+	slices.Reverse(result.Nodes)
+	slices.Reverse(result.Edges)
+	result.Length = len(result.Edges)
+	return result
+}
+
+func validDirection(direction string) bool {
+	return direction == directionOut || direction == directionIn || direction == directionBoth
+}
+
+// handleNeighbors returns the neighborhood of a node: the nodes reachable within a number
+// of edges, optionally only following edges in one direction or of some types
+func (s *Server) handleNeighbors(w http.ResponseWriter, r *http.Request) {
+	var req NeighborsRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if req.Direction == "" {
+		req.Direction = directionBoth
+	}
+	if req.Depth == 0 {
+		req.Depth = 1
+	}
+	if req.Limit == 0 {
+		req.Limit = 100
+	}
+	switch {
+	case !validDirection(req.Direction):
+		toolkit.WriteError(w, http.StatusBadRequest, "direction must be out, in or both")
+		return
+	case req.Depth < 1 || req.Depth > maxNeighborDepth:
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("depth must be between 1 and %d", maxNeighborDepth))
+		return
+	case req.Limit < 1 || req.Limit > maxFindSize:
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxFindSize))
+		return
+	}
+	_, g, ok := s.loadGraph(w, r)
+	if !ok {
+		return
+	}
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	if _, ok := g.nodes[req.ID]; !ok {
+		toolkit.WriteError(w, http.StatusNotFound, fmt.Sprintf("node %s does not exist", req.ID))
+		return
+	}
+	result := g.neighbors(req.ID, req.Direction, req.Types, int(req.Depth), int(req.Limit))
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: result})
+}
+
+// handlePath returns a shortest path between two nodes, or found false when there is none
+// within max_depth edges
+func (s *Server) handlePath(w http.ResponseWriter, r *http.Request) {
+	var req PathRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if req.Direction == "" {
+		req.Direction = directionOut
+	}
+	if req.MaxDepth == 0 {
+		req.MaxDepth = 6
+	}
+	switch {
+	case !validDirection(req.Direction):
+		toolkit.WriteError(w, http.StatusBadRequest, "direction must be out, in or both")
+		return
+	case req.MaxDepth < 1 || req.MaxDepth > maxPathDepth:
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("max_depth must be between 1 and %d", maxPathDepth))
+		return
+	}
+	_, g, ok := s.loadGraph(w, r)
+	if !ok {
+		return
+	}
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	for _, id := range []string{req.From, req.To} {
+		if _, ok := g.nodes[id]; !ok {
+			toolkit.WriteError(w, http.StatusNotFound, fmt.Sprintf("node %s does not exist", id))
+			return
+		}
+	}
+	result := g.shortestPath(req.From, req.To, req.Direction, req.Types, int(req.MaxDepth))
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: result})
+}
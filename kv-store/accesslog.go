@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access log formats. Common is the Common Log Format with the workspace as the user and
+// the latency in microseconds appended, JSON an object per request.
+const (
+	accessLogCommon = "common"
+	accessLogJSON   = "json"
+)
+
+// accessLog writes a line per request, apart from the debug log, for log analyzers
+type accessLog struct {
+	format string
+	lock   sync.Mutex
+	out    io.Writer
+}
+
+// AccessLogEntry is a line of the JSON access log
+type AccessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	LatencyMS float64   `json:"latency_ms"`
+	Workspace string    `json:"workspace,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	latency   time.Duration
+}
+
+// newAccessLog reads KV_ACCESS_LOG, the format of the access log: common, json or off, and
+// KV_ACCESS_LOG_FILE, the file to write it to instead of stdout. The file is rotated like
+// the log file, by KV_LOG_MAX_SIZE, KV_LOG_MAX_AGE and KV_LOG_MAX_FILES.
+func newAccessLog() (*accessLog, error) {
+	format := getEnvOrDefault("KV_ACCESS_LOG", "off")
+	if format == "off" {
+		return nil, nil
+	}
+	if format != accessLogCommon && format != accessLogJSON {
+		return nil, fmt.Errorf("invalid KV_ACCESS_LOG %q, must be common, json or off", format)
+	}
+	a := &accessLog{format: format, out: os.Stdout}
+
+	if path := getEnvOrDefault("KV_ACCESS_LOG_FILE", ""); path != "" {
+		file, err := newRotatingFile(path)
+		if err != nil {
+			return nil, err
+		}
+		a.out = file
+	}
+	return a, nil
+}
+
+// record logs a request once it was answered. Only the path is logged, as query parameters
+// can hold keys.
+func (a *accessLog) record(r *http.Request, rw *responseWriter, start time.Time) {
+	if a == nil {
+		return
+	}
+	latency := time.Since(start)
+	entry := AccessLogEntry{
+		Time:      start,
+		Remote:    r.RemoteAddr,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Proto:     r.Proto,
+		Status:    rw.status,
+		Bytes:     rw.written,
+		LatencyMS: float64(latency.Microseconds()) / 1000,
+		RequestID: getRequestID(r),
+		latency:   latency,
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		entry.Remote = host
+	}
+	// Only workspace requests have a workspace, others would be logged as the default one
+	if strings.HasPrefix(r.URL.Path, "/api/v1/") {
+		entry.Workspace = getRequestPrefix(r)
+	}
+
+	line, err := a.formatEntry(entry)
+	if err != nil {
+		log.Printf("Failed to write the access log: %v", err)
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, err := a.out.Write(line); err != nil {
+		log.Printf("Failed to write the access log: %v", err)
+	}
+}
+
+// formatEntry writes an entry as a line of the log format
+func (a *accessLog) formatEntry(entry AccessLogEntry) ([]byte, error) {
+	if a.format == accessLogJSON {
+		data, err := json.Marshal(entry)
+		return append(data, '\n'), err
+	}
+	workspace := entry.Workspace
+	if workspace == "" {
+		workspace = "-"
+	}
+	return fmt.Appendf(nil, "%s - %s [%s] \"%s %s %s\" %d %d %d\n",
+		entry.Remote, workspace, entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method, entry.Path, entry.Proto, entry.Status, entry.Bytes,
+		entry.latency.Microseconds()), nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/v1/get?key=secret", nil)
+	r.RemoteAddr = "10.0.0.1:5555"
+	r.Header.Set("X-GPTScript-Env", "GPTSCRIPT_WORKSPACE_ID=ws1")
+	rw := &responseWriter{status: 404, written: 42}
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var out bytes.Buffer
+	a := &accessLog{format: accessLogCommon, out: &out}
+	a.record(r, rw, start)
+	line := out.String()
+	want := `10.0.0.1 - ` + getWorkspacePrefix("ws1") + ` [02/Jan/2026:03:04:05 +0000] "GET /api/v1/get HTTP/1.1" 404 42 `
+	if !strings.HasPrefix(line, want) || strings.Contains(line, "secret") {
+		t.Errorf("common log line = %q", line)
+	}
+
+	out.Reset()
+	a.format = accessLogJSON
+	a.record(r, rw, start)
+	var entry AccessLogEntry
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Status != 404 || entry.Bytes != 42 || entry.Path != "/api/v1/get" || entry.Workspace != getWorkspacePrefix("ws1") {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+}
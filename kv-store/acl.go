@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// ACL permissions
+const (
+	permRead   = "read"
+	permWrite  = "write"
+	permDelete = "delete"
+)
+
+// ACLRule grants a principal permissions on the keys under a prefix. Principals are
+// "token:<id>" for delegated tokens, "tool:<name>" for GPTScript tools, "user:<id>" for
+// obot users, or "*". Object store handlers check object names the same way, e.g.
+// artifacts/<id> or snapshots/<name>.
+type ACLRule struct {
+	ID          string   `json:"id"`
+	Principal   string   `json:"principal"`
+	Prefix      string   `json:"prefix"`
+	Permissions []string `json:"permissions"`
+}
+
+type ACLRequest struct {
+	Workspace   string   `json:"workspace,omitempty"`
+	WorkspaceID string   `json:"workspace_prefix,omitempty"`
+	ID          string   `json:"id,omitempty"`
+	Principal   string   `json:"principal,omitempty"`
+	Prefix      string   `json:"prefix,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+// aclCache keeps the ACL rules of each workspace in memory. Rules only change through the
+// admin endpoints of this server, which invalidate the cache.
+type aclCache struct {
+	lock  sync.RWMutex
+	rules map[string][]ACLRule
+}
+
+func newACLCache() *aclCache {
+	return &aclCache{
+		rules: map[string][]ACLRule{},
+	}
+}
+
+// getACLBucket gets the bucket holding the ACL rules of a workspace
+func (s *Server) getACLBucket(prefix string) (nats.KeyValue, error) {
+	return s.getBucket(prefix + "-acl")
+}
+
+// getACLRules returns the ACL rules of a workspace, loading them on first use
+func (s *Server) getACLRules(prefix string) ([]ACLRule, error) {
+	s.acls.lock.RLock()
+	rules, ok := s.acls.rules[prefix]
+	s.acls.lock.RUnlock()
+	if ok {
+		return rules, nil
+	}
+
+	bucket, err := s.getACLBucket(prefix)
+	if err != nil {
+		return nil, err
+	}
+	rules = make([]ACLRule, 0)
+	err = scanBucket(bucket, func(entry nats.KeyValueEntry) {
+		var rule ACLRule
+		if err := json.Unmarshal(entry.Value(), &rule); err != nil {
+			log.Printf("Skipping invalid ACL rule %s: %v", entry.Key(), err)
+			return
+		}
+		rules = append(rules, rule)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.acls.lock.Lock()
+	s.acls.rules[prefix] = rules
+	s.acls.lock.Unlock()
+	return rules, nil
+}
+
+// invalidateACL drops the cached rules of a workspace
+func (s *Server) invalidateACL(prefix string) {
+	s.acls.lock.Lock()
+	delete(s.acls.rules, prefix)
+	s.acls.lock.Unlock()
+}
+
+// accessScope identifies who is accessing keys, so that access checks can be repeated
+// outside of the request, e.g. when a computed key is recomputed by a watcher
+type accessScope struct {
+	Workspace  string   `json:"workspace"`
+	KeyPrefix  string   `json:"key_prefix,omitempty"`
+	Principals []string `json:"principals"`
+}
+
+// getPrincipals returns the principals a request acts as
+func getPrincipals(r *http.Request) []string {
+	principals := []string{"*"}
+	if claims := getClaims(r); claims != nil && claims.ID != "" {
+		principals = append(principals, "token:"+claims.ID)
+	}
+	if tool := r.Header.Get("X-Gptscript-Tool-Name"); tool != "" {
+		principals = append(principals, "tool:"+tool)
+	}
+	if user := getUserID(r); user != "" {
+		principals = append(principals, "user:"+user)
+	}
+	return principals
+}
+
+// getAccessScope returns the access scope of a request
+func getAccessScope(r *http.Request) accessScope {
+	scope := accessScope{
+		Workspace:  getRequestPrefix(r),
+		Principals: getPrincipals(r),
+	}
+	if claims := getClaims(r); claims != nil {
+		scope.KeyPrefix = claims.KeyPrefix
+	}
+	return scope
+}
+
+// allowed reports whether the request has a permission on a key. Workspaces without any
+// ACL rules allow everything, and delegated tokens are additionally bound to their prefix.
+func (s *Server) allowed(r *http.Request, key, perm string) (bool, error) {
+	return s.scopeAllowed(getAccessScope(r), key, perm)
+}
+
+// scopeAllowed reports whether an access scope has a permission on a key
+func (s *Server) scopeAllowed(scope accessScope, key, perm string) (bool, error) {
+	if !strings.HasPrefix(key, scope.KeyPrefix) {
+		return false, nil
+	}
+
+	rules, err := s.getACLRules(scope.Workspace)
+	if err != nil {
+		return false, err
+	}
+	if len(rules) == 0 {
+		return true, nil
+	}
+
+	for _, rule := range rules {
+		if slices.Contains(scope.Principals, rule.Principal) && strings.HasPrefix(key, rule.Prefix) && slices.Contains(rule.Permissions, perm) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkKeyAccess writes an error response and returns false if the request does not have
+// the permission on the key
+func (s *Server) checkKeyAccess(w http.ResponseWriter, r *http.Request, key, perm string) bool {
+	ok, err := s.allowed(r, key, perm)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return false
+	}
+	if !ok {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("%s access to key %s is not allowed", perm, key)})
+		return false
+	}
+	return true
+}
+
+// readFilter returns a function reporting which keys the request may read, for handlers
+// that return many keys at once
+func (s *Server) readFilter(r *http.Request) func(key string) bool {
+	return func(key string) bool {
+		ok, err := s.allowed(r, key, permRead)
+		return err == nil && ok
+	}
+}
+
+// getACLPrefix returns the workspace prefix an admin ACL request refers to
+func getACLPrefix(req ACLRequest) string {
+	if req.WorkspaceID != "" {
+		return req.WorkspaceID
+	}
+	return getWorkspacePrefix(req.Workspace)
+}
+
+func (s *Server) handleACLSet(w http.ResponseWriter, r *http.Request) {
+	var req ACLRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+
+	if (req.Workspace == "" && req.WorkspaceID == "") || req.Principal == "" || len(req.Permissions) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "workspace, principal and permissions are required"})
+		return
+	}
+	for _, perm := range req.Permissions {
+		if perm != permRead && perm != permWrite && perm != permDelete {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("unknown permission %s, must be read, write or delete", perm)})
+			return
+		}
+	}
+
+	prefix := getACLPrefix(req)
+	bucket, err := s.getACLBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	rule := ACLRule{
+		ID:          req.ID,
+		Principal:   req.Principal,
+		Prefix:      strings.TrimSuffix(req.Prefix, "*"),
+		Permissions: req.Permissions,
+	}
+	if rule.ID == "" {
+		rule.ID = uuid.New().String()
+	}
+
+	value, err := json.Marshal(rule)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if _, err := bucket.Put(rule.ID, value); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	s.invalidateACL(prefix)
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: rule})
+}
+
+func (s *Server) handleACLList(w http.ResponseWriter, r *http.Request) {
+	var req ACLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	if req.Workspace == "" && req.WorkspaceID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "workspace is required"})
+		return
+	}
+
+	rules, err := s.getACLRules(getACLPrefix(req))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: rules})
+}
+
+func (s *Server) handleACLDelete(w http.ResponseWriter, r *http.Request) {
+	var req ACLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	if (req.Workspace == "" && req.WorkspaceID == "") || req.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "workspace and id are required"})
+		return
+	}
+
+	prefix := getACLPrefix(req)
+	bucket, err := s.getACLBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	if err := bucket.Purge(req.ID); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	s.invalidateACL(prefix)
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowed(t *testing.T) {
+	workspace := getWorkspacePrefix("ws1")
+	s := &Server{acls: newACLCache()}
+	s.acls.rules[workspace] = []ACLRule{
+		{ID: "1", Principal: "*", Prefix: "public/", Permissions: []string{permRead}},
+		{ID: "2", Principal: "tool:writer", Prefix: "public/", Permissions: []string{permRead, permWrite}},
+		{ID: "3", Principal: "token:t1", Prefix: "reports/", Permissions: []string{permRead, permWrite, permDelete}},
+	}
+	s.acls.rules[getWorkspacePrefix("open")] = []ACLRule{}
+
+	tests := []struct {
+		name      string
+		workspace string
+		tool      string
+		claims    *TokenClaims
+		key       string
+		perm      string
+		want      bool
+	}{
+		{name: "no rules allow everything", workspace: "open", key: "anything", perm: permDelete, want: true},
+		{name: "wildcard read", workspace: "ws1", key: "public/a", perm: permRead, want: true},
+		{name: "wildcard has no write", workspace: "ws1", key: "public/a", perm: permWrite, want: false},
+		{name: "tool write", workspace: "ws1", tool: "writer", key: "public/a", perm: permWrite, want: true},
+		{name: "other tool", workspace: "ws1", tool: "other", key: "public/a", perm: permWrite, want: false},
+		{name: "unmatched prefix", workspace: "ws1", key: "private/a", perm: permRead, want: false},
+		{name: "token rule", workspace: "ws1", claims: &TokenClaims{ID: "t1", Workspace: workspace}, key: "reports/a", perm: permDelete, want: true},
+		{name: "other token", workspace: "ws1", claims: &TokenClaims{ID: "t2", Workspace: workspace}, key: "reports/a", perm: permRead, want: false},
+		{name: "token prefix", workspace: "open", claims: &TokenClaims{ID: "t1", Workspace: getWorkspacePrefix("open"), KeyPrefix: "reports/"}, key: "reports/a", perm: permRead, want: true},
+		{name: "outside token prefix", workspace: "open", claims: &TokenClaims{ID: "t1", Workspace: getWorkspacePrefix("open"), KeyPrefix: "reports/"}, key: "secret", perm: permRead, want: false},
+		{name: "token prefix and rule", workspace: "ws1", claims: &TokenClaims{ID: "t1", Workspace: workspace, KeyPrefix: "reports/q1/"}, key: "reports/q2", perm: permRead, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/v1/get", nil)
+			r.Header.Set("X-GPTScript-Env", "GPTSCRIPT_WORKSPACE_ID="+tt.workspace)
+			if tt.tool != "" {
+				r.Header.Set("X-Gptscript-Tool-Name", tt.tool)
+			}
+			if tt.claims != nil {
+				r = r.WithContext(context.WithValue(r.Context(), claimsContextKey, tt.claims))
+			}
+
+			got, err := s.allowed(r, tt.key, tt.perm)
+			if err != nil {
+				t.Fatalf("allowed returned error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("allowed(%s, %s) = %v, want %v", tt.key, tt.perm, got, tt.want)
+			}
+		})
+	}
+}
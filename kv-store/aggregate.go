@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+type AggregateRequest struct {
+	Prefix  string `json:"prefix,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+}
+
+type AggregateResult struct {
+	Count   int      `json:"count"`
+	Sum     float64  `json:"sum"`
+	Min     *float64 `json:"min,omitempty"`
+	Max     *float64 `json:"max,omitempty"`
+	Avg     *float64 `json:"avg,omitempty"`
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// handleAggregate computes count/sum/min/max/avg over the numeric values of matching keys.
+// Keys whose values are not numbers are reported as skipped.
+func (s *Server) handleAggregate(w http.ResponseWriter, r *http.Request) {
+	var req AggregateRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+
+	// Get the bucket for this request
+	prefix := s.getDataPrefix(r, false)
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	canRead := s.readFilter(r)
+	result := AggregateResult{}
+	minValue, maxValue := math.Inf(1), math.Inf(-1)
+	err = scanBucket(bucket, func(entry nats.KeyValueEntry) {
+		key := entry.Key()
+		if !matchKey(key, req.Prefix, req.Pattern) || !canRead(key) {
+			return
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(string(entry.Value())), 64)
+		if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+			result.Skipped = append(result.Skipped, key)
+			return
+		}
+		result.Count++
+		result.Sum += value
+		minValue = math.Min(minValue, value)
+		maxValue = math.Max(maxValue, value)
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	if result.Count > 0 {
+		avg := result.Sum / float64(result.Count)
+		result.Min, result.Max, result.Avg = &minValue, &maxValue, &avg
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: result})
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// apiKeyBucket is the system bucket holding API key records. System bucket names contain a
+// dash, so they never collide with workspace buckets.
+const apiKeyBucket = "system-apikeys"
+
+// APIKey is a managed API key. Only the SHA-256 hash of the secret is stored.
+type APIKey struct {
+	ID                 string     `json:"id"`
+	Name               string     `json:"name,omitempty"`
+	Workspace          string     `json:"workspace_prefix"`
+	KeyPrefix          string     `json:"prefix,omitempty"`
+	Operations         []string   `json:"operations"`
+	ReadOnly           bool       `json:"read_only,omitempty"`
+	RateLimit          int        `json:"rate_limit,omitempty"`
+	Created            time.Time  `json:"created"`
+	Rotated            *time.Time `json:"rotated,omitempty"`
+	Expires            *time.Time `json:"expires,omitempty"`
+	Hash               string     `json:"hash,omitempty"`
+	PreviousHash       string     `json:"previous_hash,omitempty"`
+	PreviousHashExpiry *time.Time `json:"previous_hash_expires,omitempty"`
+}
+
+type APIKeyRequest struct {
+	ID          string       `json:"id,omitempty"`
+	Name        string       `json:"name,omitempty"`
+	Workspace   string       `json:"workspace,omitempty"`
+	WorkspaceID string       `json:"workspace_prefix,omitempty"`
+	Prefix      string       `json:"prefix,omitempty"`
+	Operations  stringList   `json:"operations,omitempty"`
+	ReadOnly    flexibleBool `json:"read_only,omitempty"`
+	RateLimit   flexibleInt  `json:"rate_limit,omitempty"`
+	ExpiresIn   string       `json:"expires_in,omitempty"`
+	GracePeriod string       `json:"grace_period,omitempty"`
+}
+
+// apiKeyCache keeps API key records in memory. Keys only change through the admin
+// endpoints of this server, which update the cache.
+type apiKeyCache struct {
+	lock   sync.RWMutex
+	keys   map[string]*APIKey
+	loaded bool
+}
+
+func newAPIKeyCache() *apiKeyCache {
+	return &apiKeyCache{
+		keys: map[string]*APIKey{},
+	}
+}
+
+// public returns a copy of the key without its secret hashes
+func (k *APIKey) public() APIKey {
+	copied := *k
+	copied.Hash = ""
+	copied.PreviousHash = ""
+	copied.PreviousHashExpiry = nil
+	return copied
+}
+
+// hashAPIKeySecret returns the stored form of an API key secret
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKeySecret generates a random secret and the bearer token for a key ID. Tokens have
+// the form kvk_<id>_<secret>.
+func newAPIKeySecret(id string) (token, hash string, err error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	encoded := hex.EncodeToString(secret)
+	return "kvk_" + id + "_" + encoded, hashAPIKeySecret(encoded), nil
+}
+
+// parseAPIKeyToken splits a bearer token into its key ID and secret
+func parseAPIKeyToken(token string) (id, secret string, ok bool) {
+	rest, ok := strings.CutPrefix(token, "kvk_")
+	if !ok {
+		return "", "", false
+	}
+	id, secret, ok = strings.Cut(rest, "_")
+	if !ok || id == "" || secret == "" {
+		return "", "", false
+	}
+	return id, secret, true
+}
+
+// isAPIKey reports whether a bearer token is a managed API key
+func isAPIKey(token string) bool {
+	_, _, ok := parseAPIKeyToken(token)
+	return ok
+}
+
+// loadAPIKeys fills the cache from the system bucket on first use
+func (s *Server) loadAPIKeys() error {
+	s.apiKeys.lock.RLock()
+	loaded := s.apiKeys.loaded
+	s.apiKeys.lock.RUnlock()
+	if loaded {
+		return nil
+	}
+
+	bucket, err := s.getBucket(apiKeyBucket)
+	if err != nil {
+		return err
+	}
+	keys := map[string]*APIKey{}
+	err = scanBucket(bucket, func(entry nats.KeyValueEntry) {
+		var key APIKey
+		if err := json.Unmarshal(entry.Value(), &key); err != nil {
+			log.Printf("Skipping invalid API key %s: %v", entry.Key(), err)
+			return
+		}
+		keys[key.ID] = &key
+	})
+	if err != nil {
+		return err
+	}
+
+	s.apiKeys.lock.Lock()
+	s.apiKeys.keys = keys
+	s.apiKeys.loaded = true
+	s.apiKeys.lock.Unlock()
+	return nil
+}
+
+// validateAPIKey checks a managed API key and returns the claims it grants
+func (s *Server) validateAPIKey(token string) (*TokenClaims, error) {
+	id, secret, ok := parseAPIKeyToken(token)
+	if !ok {
+		return nil, fmt.Errorf("malformed API key")
+	}
+	if err := s.loadAPIKeys(); err != nil {
+		return nil, err
+	}
+
+	s.apiKeys.lock.RLock()
+	key, ok := s.apiKeys.keys[id]
+	s.apiKeys.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("invalid API key")
+	}
+
+	now := time.Now()
+	hash := hashAPIKeySecret(secret)
+	valid := hmac.Equal([]byte(hash), []byte(key.Hash)) ||
+		key.PreviousHash != "" && key.PreviousHashExpiry != nil && now.Before(*key.PreviousHashExpiry) && hmac.Equal([]byte(hash), []byte(key.PreviousHash))
+	if !valid {
+		return nil, fmt.Errorf("invalid API key")
+	}
+	if key.Expires != nil && now.After(*key.Expires) {
+		return nil, fmt.Errorf("API key expired")
+	}
+	return key.claims(), nil
+}
+
+// claims returns the token claims granted by an API key
+func (k *APIKey) claims() *TokenClaims {
+	expires := int64(1<<63 - 1)
+	if k.Expires != nil {
+		expires = k.Expires.Unix()
+	}
+	return &TokenClaims{
+		ID:         "key-" + k.ID,
+		Workspace:  k.Workspace,
+		KeyPrefix:  k.KeyPrefix,
+		Operations: k.Operations,
+		Expires:    expires,
+		ReadOnly:   k.ReadOnly,
+		RateLimit:  k.RateLimit,
+	}
+}
+
+// storeAPIKey persists an API key record and updates the cache
+func (s *Server) storeAPIKey(key *APIKey) error {
+	bucket, err := s.getBucket(apiKeyBucket)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	if _, err := bucket.Put(key.ID, value); err != nil {
+		return err
+	}
+	s.apiKeys.lock.Lock()
+	s.apiKeys.keys[key.ID] = key
+	s.apiKeys.lock.Unlock()
+	return nil
+}
+
+// getAPIKey returns a copy of a cached API key record
+func (s *Server) getAPIKey(id string) (*APIKey, error) {
+	if err := s.loadAPIKeys(); err != nil {
+		return nil, err
+	}
+	s.apiKeys.lock.RLock()
+	defer s.apiKeys.lock.RUnlock()
+	key, ok := s.apiKeys.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("API key %s not found", id)
+	}
+	copied := *key
+	return &copied, nil
+}
+
+func (s *Server) handleAPIKeyCreate(w http.ResponseWriter, r *http.Request) {
+	var req APIKeyRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+
+	if req.Workspace == "" && req.WorkspaceID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "workspace is required"})
+		return
+	}
+
+	ops := allOperations()
+	if len(req.Operations) > 0 {
+		var err error
+		if ops, err = expandOperations(req.Operations); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+	}
+
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	key := &APIKey{
+		ID:         hex.EncodeToString(id),
+		Name:       req.Name,
+		Workspace:  req.WorkspaceID,
+		KeyPrefix:  strings.TrimSuffix(req.Prefix, "*"),
+		Operations: ops,
+		ReadOnly:   bool(req.ReadOnly),
+		RateLimit:  int(req.RateLimit),
+		Created:    time.Now().UTC(),
+	}
+	if key.Workspace == "" {
+		key.Workspace = getWorkspacePrefix(req.Workspace)
+	}
+	if key.RateLimit < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "rate_limit must be a number of requests per minute"})
+		return
+	}
+	if req.ExpiresIn != "" {
+		expiresIn, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || expiresIn <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "expires_in must be a positive duration such as 720h"})
+			return
+		}
+		expires := key.Created.Add(expiresIn)
+		key.Expires = &expires
+	}
+
+	token, hash, err := newAPIKeySecret(key.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	key.Hash = hash
+
+	if err := s.loadAPIKeys(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if err := s.storeAPIKey(key); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	// The key itself is only ever returned here and on rotation
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: map[string]interface{}{
+		"key":  token,
+		"info": key.public(),
+	}})
+}
+
+func (s *Server) handleAPIKeyList(w http.ResponseWriter, r *http.Request) {
+	var req APIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	if err := s.loadAPIKeys(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	workspace := req.WorkspaceID
+	if workspace == "" && req.Workspace != "" {
+		workspace = getWorkspacePrefix(req.Workspace)
+	}
+
+	s.apiKeys.lock.RLock()
+	keys := make([]APIKey, 0, len(s.apiKeys.keys))
+	for _, key := range s.apiKeys.keys {
+		if workspace == "" || key.Workspace == workspace {
+			keys = append(keys, key.public())
+		}
+	}
+	s.apiKeys.lock.RUnlock()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: keys})
+}
+
+// handleAPIKeyRotate replaces the secret of an API key. With a grace_period the previous
+// secret keeps working for that long, so clients can be updated without downtime.
+func (s *Server) handleAPIKeyRotate(w http.ResponseWriter, r *http.Request) {
+	var req APIKeyRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+
+	if req.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "id is required"})
+		return
+	}
+
+	var grace time.Duration
+	if req.GracePeriod != "" {
+		var err error
+		grace, err = time.ParseDuration(req.GracePeriod)
+		if err != nil || grace < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "grace_period must be a duration such as 1h"})
+			return
+		}
+	}
+
+	key, err := s.getAPIKey(req.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	token, hash, err := newAPIKeySecret(key.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	now := time.Now().UTC()
+	key.PreviousHash = ""
+	key.PreviousHashExpiry = nil
+	if grace > 0 {
+		graceEnd := now.Add(grace)
+		key.PreviousHash = key.Hash
+		key.PreviousHashExpiry = &graceEnd
+	}
+	key.Hash = hash
+	key.Rotated = &now
+
+	if err := s.storeAPIKey(key); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: map[string]interface{}{
+		"key":  token,
+		"info": key.public(),
+	}})
+}
+
+func (s *Server) handleAPIKeyRevoke(w http.ResponseWriter, r *http.Request) {
+	var req APIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	if req.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "id is required"})
+		return
+	}
+
+	if _, err := s.getAPIKey(req.ID); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	bucket, err := s.getBucket(apiKeyBucket)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if err := bucket.Purge(req.ID); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	s.apiKeys.lock.Lock()
+	delete(s.apiKeys.keys, req.ID)
+	s.apiKeys.lock.Unlock()
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseAPIKeyToken(t *testing.T) {
+	tests := []struct {
+		token  string
+		id     string
+		secret string
+		ok     bool
+	}{
+		{token: "kvk_abc_def", id: "abc", secret: "def", ok: true},
+		{token: "kvk_abc_", ok: false},
+		{token: "kvk__def", ok: false},
+		{token: "kvk_abc", ok: false},
+		{token: "kvt.abc.def", ok: false},
+		{token: "abc_def", ok: false},
+	}
+	for _, tt := range tests {
+		id, secret, ok := parseAPIKeyToken(tt.token)
+		if ok != tt.ok || id != tt.id || secret != tt.secret {
+			t.Errorf("parseAPIKeyToken(%q) = %q, %q, %v", tt.token, id, secret, ok)
+		}
+	}
+}
+
+func TestValidateAPIKey(t *testing.T) {
+	s := newTestServer()
+	s.apiKeys = newAPIKeyCache()
+	s.apiKeys.loaded = true
+
+	token, hash, err := newAPIKeySecret("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken, oldHash, _ := newAPIKeySecret("k1")
+	expiredToken, expiredHash, _ := newAPIKeySecret("k2")
+	staleToken, staleHash, _ := newAPIKeySecret("k3")
+	newerToken, newerHash, _ := newAPIKeySecret("k3")
+
+	workspace := getWorkspacePrefix("ws1")
+	inAnHour := time.Now().Add(time.Hour)
+	aMinuteAgo := time.Now().Add(-time.Minute)
+	s.apiKeys.keys["k1"] = &APIKey{ID: "k1", Workspace: workspace, KeyPrefix: "reports/", Operations: []string{"get"}, ReadOnly: true, Hash: hash, PreviousHash: oldHash, PreviousHashExpiry: &inAnHour}
+	s.apiKeys.keys["k2"] = &APIKey{ID: "k2", Workspace: workspace, Operations: []string{"get"}, Hash: expiredHash, Expires: &aMinuteAgo}
+	s.apiKeys.keys["k3"] = &APIKey{ID: "k3", Workspace: workspace, Operations: []string{"get"}, Hash: newerHash, PreviousHash: staleHash, PreviousHashExpiry: &aMinuteAgo}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "current secret", token: token},
+		{name: "previous secret in grace period", token: oldToken},
+		{name: "previous secret after grace period", token: staleToken, wantErr: true},
+		{name: "rotated secret", token: newerToken},
+		{name: "expired key", token: expiredToken, wantErr: true},
+		{name: "wrong secret", token: "kvk_k1_0000", wantErr: true},
+		{name: "unknown key", token: "kvk_nope_" + token[len("kvk_k1_"):], wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := s.validateAPIKey(tt.token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && claims.Workspace != workspace {
+				t.Errorf("workspace = %s, want %s", claims.Workspace, workspace)
+			}
+		})
+	}
+
+	// API keys go through the same operation, read-only and prefix checks as other tokens
+	for path, want := range map[string]int{"/api/v1/get": http.StatusOK, "/api/v1/put": http.StatusForbidden, "/api/v1/list": http.StatusForbidden} {
+		r := httptest.NewRequest("POST", path, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		r, status, _ := s.authenticate(r)
+		if status != want {
+			t.Errorf("%s: status = %d, want %d", path, status, want)
+		}
+		if status == http.StatusOK {
+			if ok, _ := s.allowed(r, "secrets/a", permRead); ok {
+				t.Errorf("API key read outside its prefix")
+			}
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+type ArtifactRequest struct {
+	ID            string `json:"id,omitempty"`
+	Name          string `json:"name,omitempty"`
+	ContentType   string `json:"content_type,omitempty"`
+	Description   string `json:"description,omitempty"`
+	Content       string `json:"content,omitempty"`
+	ContentBase64 string `json:"content_base64,omitempty"`
+	Object        string `json:"object,omitempty"`
+	ExpiresIn     int64  `json:"expires_in,omitempty"`
+}
+
+type Artifact struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	ContentType string    `json:"content_type"`
+	Description string    `json:"description,omitempty"`
+	Object      string    `json:"object"`
+	Size        uint64    `json:"size"`
+	Created     time.Time `json:"created"`
+	DownloadURL string    `json:"download_url,omitempty"`
+}
+
+// getArtifactBucket gets the bucket holding artifact metadata for the given prefix
+func (s *Server) getArtifactBucket(prefix string) (nats.KeyValue, error) {
+	return s.getBucket(prefix + "-artifacts")
+}
+
+// artifactDownloadURL returns a pre-signed public download URL for an artifact. The
+// requested lifetime is capped at KV_ARTIFACT_URL_MAX_TTL.
+func (s *Server) artifactDownloadURL(prefix, id string, expiresIn int64) string {
+	ttl := s.artifactURLTTL
+	if expiresIn > 0 {
+		ttl = time.Duration(expiresIn) * time.Second
+	}
+	if ttl > s.artifactURLMaxTTL || ttl <= 0 {
+		ttl = s.artifactURLMaxTTL
+	}
+	return s.publicURL + s.signer.sign("/artifacts/download/"+prefix+"/"+id, ttl)
+}
+
+// getArtifact loads the metadata of a single artifact
+func getArtifact(bucket nats.KeyValue, id string) (*Artifact, error) {
+	entry, err := bucket.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	var artifact Artifact
+	if err := json.Unmarshal(entry.Value(), &artifact); err != nil {
+		return nil, fmt.Errorf("invalid artifact metadata: %v", err)
+	}
+	return &artifact, nil
+}
+
+func (s *Server) handleArtifactCreate(w http.ResponseWriter, r *http.Request) {
+	var req ArtifactRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+
+	if req.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "name is required"})
+		return
+	}
+
+	sources := 0
+	for _, v := range []string{req.Content, req.ContentBase64, req.Object} {
+		if v != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "exactly one of content, content_base64 or object is required"})
+		return
+	}
+
+	content := []byte(req.Content)
+	if req.ContentBase64 != "" {
+		decoded, err := base64.StdEncoding.DecodeString(req.ContentBase64)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid content_base64: %v", err)})
+			return
+		}
+		content = decoded
+	}
+
+	// Objects managed by the server, such as snapshots, cannot be published as artifacts
+	if req.Object != "" && isReservedObject(req.Object) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("object must not start with %s", strings.Join(reservedObjectPrefixes, ", "))})
+		return
+	}
+
+	contentType := req.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// Get the stores for this request
+	prefix := getRequestPrefix(r)
+	store, err := s.getObjectStore(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	bucket, err := s.getArtifactBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	artifact := Artifact{
+		ID:          uuid.New().String(),
+		Name:        req.Name,
+		ContentType: contentType,
+		Description: req.Description,
+		Created:     time.Now().UTC(),
+	}
+
+	// Publishing a referenced object hands out a public URL for it, so it must be readable
+	if !s.checkKeyAccess(w, r, "artifacts/"+artifact.ID, permWrite) {
+		return
+	}
+	if req.Object != "" && !s.checkKeyAccess(w, r, req.Object, permRead) {
+		return
+	}
+
+	var info *nats.ObjectInfo
+	if req.Object != "" {
+		// Reference an object that is already in the object store
+		info, err = store.GetInfo(req.Object)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("object %s: %v", req.Object, err)})
+			return
+		}
+		artifact.Object = req.Object
+		if req.ContentType == "" && info.Headers.Get("Content-Type") != "" {
+			artifact.ContentType = info.Headers.Get("Content-Type")
+		}
+	} else {
+		artifact.Object = "artifacts/" + artifact.ID
+		info, err = store.PutBytes(artifact.Object, content)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+	}
+	artifact.Size = info.Size
+
+	value, err := json.Marshal(artifact)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if _, err := bucket.Put(artifact.ID, value); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	artifact.DownloadURL = s.artifactDownloadURL(prefix, artifact.ID, req.ExpiresIn)
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: artifact})
+}
+
+func (s *Server) handleArtifactList(w http.ResponseWriter, r *http.Request) {
+	// Get the bucket for this request
+	prefix := getRequestPrefix(r)
+	bucket, err := s.getArtifactBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	keys, err := bucket.ListKeys()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	canRead := s.readFilter(r)
+	artifacts := make([]Artifact, 0)
+	for id := range keys.Keys() {
+		artifact, err := getArtifact(bucket, id)
+		if err != nil {
+			log.Printf("Skipping artifact %s: %v", id, err)
+			continue
+		}
+		if canRead(artifact.Object) {
+			artifacts = append(artifacts, *artifact)
+		}
+	}
+	sort.Slice(artifacts, func(i, j int) bool {
+		return artifacts[i].Created.Before(artifacts[j].Created)
+	})
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: artifacts})
+}
+
+func (s *Server) handleArtifactGet(w http.ResponseWriter, r *http.Request) {
+	var req ArtifactRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	if req.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "id is required"})
+		return
+	}
+
+	// Get the bucket for this request
+	prefix := getRequestPrefix(r)
+	bucket, err := s.getArtifactBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	artifact, err := getArtifact(bucket, req.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if !s.checkKeyAccess(w, r, artifact.Object, permRead) {
+		return
+	}
+
+	artifact.DownloadURL = s.artifactDownloadURL(prefix, artifact.ID, req.ExpiresIn)
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: artifact})
+}
+
+func (s *Server) handleArtifactDelete(w http.ResponseWriter, r *http.Request) {
+	var req ArtifactRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	if req.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "id is required"})
+		return
+	}
+
+	// Get the stores for this request
+	prefix := getRequestPrefix(r)
+	bucket, err := s.getArtifactBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	artifact, err := getArtifact(bucket, req.ID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if !s.checkKeyAccess(w, r, "artifacts/"+artifact.ID, permDelete) {
+		return
+	}
+
+	// Only remove content that was uploaded for this artifact, not referenced objects
+	if artifact.Object == "artifacts/"+artifact.ID {
+		store, err := s.getObjectStore(prefix)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		if err := store.Delete(artifact.Object); err != nil {
+			log.Printf("Failed to delete artifact content %s: %v", artifact.Object, err)
+		}
+	}
+
+	if err := bucket.Delete(req.ID); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true})
+}
+
+func (s *Server) handleArtifactDownload(w http.ResponseWriter, r *http.Request) {
+	var req ArtifactRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	if req.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "id is required"})
+		return
+	}
+
+	s.writeArtifact(w, r, getRequestPrefix(r), req.ID)
+}
+
+// handleArtifactPublicDownload serves pre-signed download URLs, which need no workspace headers
+func (s *Server) handleArtifactPublicDownload(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/artifacts/download/"), "/")
+	query := r.URL.Query()
+	if len(parts) != 2 || !s.signer.verify(r.URL.Path, query.Get("expires"), query.Get("signature")) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid or expired download URL"})
+		return
+	}
+
+	s.writeArtifact(w, nil, parts[0], parts[1])
+}
+
+// writeArtifact streams the content of an artifact to the response. Requests are checked
+// for read access to the artifact's object, while pre-signed downloads pass a nil request
+// since access was checked when the URL was issued.
+func (s *Server) writeArtifact(w http.ResponseWriter, r *http.Request, prefix, id string) {
+	bucket, err := s.getArtifactBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	artifact, err := getArtifact(bucket, id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if r != nil && !s.checkKeyAccess(w, r, artifact.Object, permRead) {
+		return
+	}
+
+	store, err := s.getObjectStore(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	result, err := store.Get(artifact.Object)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	defer result.Close()
+
+	w.Header().Set("Content-Type", artifact.ContentType)
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", artifact.Size))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", artifact.Name))
+	if _, err := io.Copy(w, result); err != nil {
+		log.Printf("Error streaming artifact %s: %v", id, err)
+	}
+}
@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type contextKey string
+
+const claimsContextKey contextKey = "claims"
+
+// tokenOperations lists the operations a delegated token can be granted. The read and
+// write aliases expand to the key operations they cover.
+var tokenOperations = map[string][]string{
+	"get":        {"get"},
+	"put":        {"put"},
+	"delete":     {"delete"},
+	"list":       {"list"},
+	"artifacts":  {"artifacts"},
+	"objects":    {"objects"},
+	"embeddings": {"embeddings"},
+	"output":     {"output"},
+	"delegate":   {"delegate"},
+	"cdc":        {"cdc"},
+	"snapshots":  {"snapshots"},
+	"webhooks":   {"webhooks"},
+	"read":       {"get", "list"},
+	"write":      {"put", "delete"},
+}
+
+// routeOperations maps API paths to the operation a token must allow to call them.
+// /api/v1/batch isn't listed, as each of its operations is checked instead.
+var routeOperations = map[string]string{
+	"/api/v1/get":                          "get",
+	"/api/v1/put":                          "put",
+	"/api/v1/mput":                         "put",
+	"/api/v1/delete":                       "delete",
+	"/api/v1/delete/cancel":                "put",
+	"/api/v1/list":                         "list",
+	"/api/v1/history":                      "get",
+	"/api/v1/find":                         "list",
+	"/api/v1/output/stats":                 "list",
+	"/api/v1/sql":                          "list",
+	"/api/v1/delete-prefix":                "delete",
+	"/api/v1/export":                       "list",
+	"/api/v1/import":                       "put",
+	"/api/v1/incr":                         "put",
+	"/api/v1/json/get":                     "get",
+	"/api/v1/json/patch":                   "put",
+	"/api/v1/hll/add":                      "put",
+	"/api/v1/hll/count":                    "get",
+	"/api/v1/hll/delete":                   "delete",
+	"/api/v1/crdt/update":                  "put",
+	"/api/v1/crdt/get":                     "get",
+	"/api/v1/crdt/delete":                  "delete",
+	"/api/v1/output-filter":                "output",
+	"/api/v1/embeddings-cache":             "embeddings",
+	"/api/v1/artifacts/create":             "artifacts",
+	"/api/v1/artifacts/list":               "artifacts",
+	"/api/v1/artifacts/get":                "artifacts",
+	"/api/v1/artifacts/download":           "artifacts",
+	"/api/v1/artifacts/delete":             "artifacts",
+	"/api/v1/objects/upload/initiate":      "objects",
+	"/api/v1/objects/upload/part":          "objects",
+	"/api/v1/objects/upload/status":        "objects",
+	"/api/v1/objects/upload/complete":      "objects",
+	"/api/v1/objects/upload/abort":         "objects",
+	"/api/v1/tokens/delegate":              "delegate",
+	"/api/v1/metadata":                     "get",
+	"/api/v1/cdc":                          "cdc",
+	"/api/v1/watch":                        "get",
+	"/api/v1/namespaces":                   "list",
+	"/api/v1/namespaces/clear":             "delete",
+	"/api/v1/schedule":                     "put",
+	"/api/v1/schedule/list":                "list",
+	"/api/v1/schedule/cancel":              "put",
+	"/api/v1/webhooks/create":              "webhooks",
+	"/api/v1/webhooks/list":                "webhooks",
+	"/api/v1/webhooks/delete":              "webhooks",
+	"/api/v1/webhooks/replay":              "cdc",
+	"/api/v1/webhooks/dead-letters":        "webhooks",
+	"/api/v1/webhooks/dead-letters/delete": "webhooks",
+	"/api/v1/computed/define":              "put",
+	"/api/v1/computed/list":                "list",
+	"/api/v1/computed/delete":              "delete",
+	"/api/v1/index/define":                 "put",
+	"/api/v1/index/list":                   "list",
+	"/api/v1/index/delete":                 "delete",
+	"/api/v1/index/query":                  "list",
+	"/api/v1/aggregate":                    "get",
+	"/api/v1/snapshot/create":              "snapshots",
+	"/api/v1/snapshot/list":                "snapshots",
+	"/api/v1/snapshot/delete":              "snapshots",
+	"/api/v1/snapshot/restore":             "snapshots",
+}
+
+// TokenClaims describes the access granted by a delegated token
+type TokenClaims struct {
+	ID         string   `json:"id,omitempty"`
+	Workspace  string   `json:"ws"`
+	KeyPrefix  string   `json:"prefix,omitempty"`
+	Operations []string `json:"ops"`
+	Expires    int64    `json:"exp"`
+	ReadOnly   bool     `json:"ro,omitempty"`
+	// Root is the ID of the credential a delegated token was minted from
+	Root string `json:"root,omitempty"`
+	// User and Thread are the obot user and thread the token acts for, inherited from the
+	// request minting it
+	User   string `json:"usr,omitempty"`
+	Thread string `json:"thr,omitempty"`
+	// RateLimit overrides KV_TOKEN_RATE_LIMIT, in requests per minute
+	RateLimit int `json:"rl,omitempty"`
+}
+
+type DelegateRequest struct {
+	Prefix     string       `json:"prefix,omitempty"`
+	Operations stringList   `json:"operations"`
+	TTL        flexibleInt  `json:"ttl,omitempty"`
+	ReadOnly   flexibleBool `json:"read_only,omitempty"`
+}
+
+// secretResponseRoutes return credentials, so their response bodies are never logged
+var secretResponseRoutes = map[string]bool{
+	"/api/v1/tokens/delegate":     true,
+	"/api/admin/keys/create":      true,
+	"/api/admin/keys/rotate":      true,
+	"/api/admin/nats/credentials": true,
+	"/api/v1/webhooks/create":     true,
+}
+
+// secretRequestRoutes accept credentials, so their request bodies are never logged
+var secretRequestRoutes = map[string]bool{
+	"/api/v1/webhooks/create": true,
+}
+
+// readOnlyRoutes are the only API paths a read-only token may call. Anything not listed
+// here is treated as mutating, so new endpoints are closed to read-only tokens by default.
+var readOnlyRoutes = map[string]bool{
+	"/api/v1/get":                   true,
+	"/api/v1/list":                  true,
+	"/api/v1/history":               true,
+	"/api/v1/json/get":              true,
+	"/api/v1/find":                  true,
+	"/api/v1/output/stats":          true,
+	"/api/v1/sql":                   true,
+	"/api/v1/export":                true,
+	"/api/v1/metadata":              true,
+	"/api/v1/cdc":                   true,
+	"/api/v1/watch":                 true,
+	"/api/v1/namespaces":            true,
+	"/api/v1/schedule/list":         true,
+	"/api/v1/webhooks/list":         true,
+	"/api/v1/webhooks/dead-letters": true,
+	"/api/v1/aggregate":             true,
+	"/api/v1/hll/count":             true,
+	"/api/v1/crdt/get":              true,
+	"/api/v1/artifacts/list":        true,
+	"/api/v1/artifacts/get":         true,
+	"/api/v1/artifacts/download":    true,
+	"/api/v1/objects/upload/status": true,
+	"/api/v1/computed/list":         true,
+	"/api/v1/index/list":            true,
+	"/api/v1/index/query":           true,
+	"/api/v1/snapshot/list":         true,
+	"/api/v1/tokens/delegate":       true,
+	// Each operation of a batch is checked against the route it is served by
+	"/api/v1/batch": true,
+}
+
+// allOperations returns every operation a token can be granted, without the aliases
+func allOperations() []string {
+	var ops []string
+	for op, expanded := range tokenOperations {
+		if len(expanded) == 1 && expanded[0] == op {
+			ops = append(ops, op)
+		}
+	}
+	slices.Sort(ops)
+	return ops
+}
+
+// expandOperations resolves operation names and aliases into the operations they grant
+func expandOperations(names []string) ([]string, error) {
+	var ops []string
+	for _, op := range names {
+		expanded, ok := tokenOperations[op]
+		if !ok {
+			return nil, fmt.Errorf("unknown operation %s", op)
+		}
+		for _, e := range expanded {
+			if !slices.Contains(ops, e) {
+				ops = append(ops, e)
+			}
+		}
+	}
+	return ops, nil
+}
+
+// allows reports whether the claims grant the operation
+func (c *TokenClaims) allows(op string) bool {
+	return slices.Contains(c.Operations, op)
+}
+
+// allowsKey reports whether the key is inside the prefix the claims are restricted to
+func (c *TokenClaims) allowsKey(key string) bool {
+	return strings.HasPrefix(key, c.KeyPrefix)
+}
+
+// mintToken signs the claims into a bearer token
+func (s *Server) mintToken(claims TokenClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	signature := base64.RawURLEncoding.EncodeToString(s.signer.mac([]byte(encoded)))
+	return "kvt." + encoded + "." + signature, nil
+}
+
+// parseToken verifies a bearer token and returns its claims
+func (s *Server) parseToken(token string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != "kvt" {
+		return nil, fmt.Errorf("malformed token")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, s.signer.mac([]byte(parts[1]))) {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	var claims TokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed token")
+	}
+	if time.Now().Unix() > claims.Expires {
+		return nil, fmt.Errorf("token expired")
+	}
+	return &claims, nil
+}
+
+// authenticate validates any bearer token on the request and attaches its claims to the
+// request context. Requests without a token keep the full access of their workspace
+// unless KV_REQUIRE_AUTH is set.
+func (s *Server) authenticate(r *http.Request) (*http.Request, int, error) {
+	auth := r.Header.Get("Authorization")
+
+	// Verified client certificates authenticate as the identity they are mapped to, ahead of
+	// any bearer token
+	var certRole, certWorkspace string
+	cert := clientCertificate(r)
+	if cert != nil && s.tls != nil {
+		certRole, certWorkspace, _ = s.tls.identify(cert)
+	}
+
+	// Admin endpoints are only available with the configured admin token or an admin
+	// certificate
+	if strings.HasPrefix(r.URL.Path, "/api/admin/") {
+		if certRole == certRoleAdmin {
+			return r, http.StatusOK, nil
+		}
+		if s.adminToken == "" {
+			return r, http.StatusForbidden, fmt.Errorf("admin endpoints are disabled, set KV_ADMIN_TOKEN to enable them")
+		}
+		if !hmac.Equal([]byte(auth), []byte("Bearer "+s.adminToken)) {
+			return r, http.StatusUnauthorized, fmt.Errorf("invalid admin token")
+		}
+		return r, http.StatusOK, nil
+	}
+
+	if certRole == certRoleWorkspace {
+		claims := certificateClaims(cert, certWorkspace)
+		return r.WithContext(context.WithValue(r.Context(), claimsContextKey, claims)), http.StatusOK, nil
+	}
+
+	if auth == "" {
+		if s.requireAuth {
+			return r, http.StatusUnauthorized, fmt.Errorf("authorization is required")
+		}
+		return r, http.StatusOK, nil
+	}
+	token, ok := strings.CutPrefix(auth, "Bearer ")
+	if !ok {
+		return r, http.StatusUnauthorized, fmt.Errorf("unsupported authorization scheme")
+	}
+
+	var claims *TokenClaims
+	var err error
+	switch {
+	case isAPIKey(token):
+		claims, err = s.validateAPIKey(token)
+	case s.jwt != nil && isJWT(token):
+		claims, err = s.jwt.validate(token)
+	default:
+		claims, err = s.parseToken(token)
+	}
+	if err != nil {
+		return r, http.StatusUnauthorized, err
+	}
+	if op, ok := routeOperations[r.URL.Path]; ok && !claims.allows(op) {
+		return r, http.StatusForbidden, fmt.Errorf("token does not allow %s", op)
+	}
+	if claims.ReadOnly && !readOnlyRoutes[r.URL.Path] {
+		return r, http.StatusForbidden, fmt.Errorf("token is read-only")
+	}
+	return r.WithContext(context.WithValue(r.Context(), claimsContextKey, claims)), http.StatusOK, nil
+}
+
+// getClaims returns the delegated token claims of the request, if any
+func getClaims(r *http.Request) *TokenClaims {
+	claims, _ := r.Context().Value(claimsContextKey).(*TokenClaims)
+	return claims
+}
+
+// getRequestPrefix returns the bucket prefix of the request, preferring the workspace
+// bound into a delegated token over the X-GPTScript-Env header
+func getRequestPrefix(r *http.Request) string {
+	if claims := getClaims(r); claims != nil {
+		return claims.Workspace
+	}
+	return getPrefixFromEnv(r.Header)
+}
+
+func (s *Server) handleDelegate(w http.ResponseWriter, r *http.Request) {
+	if s.signer.ephemeral {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: errEphemeralKey.Error()})
+		return
+	}
+	var req DelegateRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+
+	if len(req.Operations) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "operations are required"})
+		return
+	}
+
+	ops, err := expandOperations(req.Operations)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	ttl := s.delegatedTokenTTL
+	if req.TTL > 0 {
+		ttl = time.Duration(req.TTL) * time.Second
+	}
+	if ttl > s.delegatedTokenMaxTTL {
+		ttl = s.delegatedTokenMaxTTL
+	}
+
+	claims := TokenClaims{
+		ID:         uuid.New().String(),
+		Workspace:  getRequestPrefix(r),
+		KeyPrefix:  strings.TrimSuffix(req.Prefix, "*"),
+		Operations: ops,
+		Expires:    time.Now().Add(ttl).Unix(),
+		ReadOnly:   bool(req.ReadOnly),
+		User:       getUserID(r),
+		Thread:     getThreadID(r),
+	}
+
+	// A delegated token can only hand out a subset of its own access
+	if parent := getClaims(r); parent != nil {
+		claims.ReadOnly = claims.ReadOnly || parent.ReadOnly
+		claims.Root = parent.rateLimitKey()
+		claims.RateLimit = parent.RateLimit
+		if !strings.HasPrefix(claims.KeyPrefix, parent.KeyPrefix) {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "prefix must be within the token's own prefix"})
+			return
+		}
+		for _, op := range ops {
+			if !parent.allows(op) {
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("token does not allow %s", op)})
+				return
+			}
+		}
+		if claims.Expires > parent.Expires {
+			claims.Expires = parent.Expires
+		}
+	}
+
+	token, err := s.mintToken(claims)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: map[string]interface{}{
+		"id":         claims.ID,
+		"token":      token,
+		"prefix":     claims.KeyPrefix,
+		"operations": claims.Operations,
+		"expires":    time.Unix(claims.Expires, 0).UTC(),
+		"read_only":  claims.ReadOnly,
+	}})
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer() *Server {
+	return &Server{
+		signer:               &urlSigner{key: []byte("test-key")},
+		adminToken:           "admin-secret",
+		delegatedTokenTTL:    15 * time.Minute,
+		delegatedTokenMaxTTL: time.Hour,
+		acls:                 newACLCache(),
+	}
+}
+
+func mustMint(t *testing.T, s *Server, claims TokenClaims) string {
+	t.Helper()
+	token, err := s.mintToken(claims)
+	if err != nil {
+		t.Fatalf("failed to mint token: %v", err)
+	}
+	return token
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := newTestServer()
+	workspace := getWorkspacePrefix("ws1")
+	valid := mustMint(t, s, TokenClaims{ID: "t1", Workspace: workspace, Operations: []string{"get", "list"}, Expires: time.Now().Add(time.Hour).Unix()})
+	expired := mustMint(t, s, TokenClaims{ID: "t2", Workspace: workspace, Operations: []string{"get"}, Expires: time.Now().Add(-time.Minute).Unix()})
+	tampered := valid[:len(valid)-2] + "xx"
+
+	other := newTestServer()
+	other.signer = &urlSigner{key: []byte("other-key")}
+	foreign := mustMint(t, other, TokenClaims{ID: "t3", Workspace: workspace, Operations: []string{"get"}, Expires: time.Now().Add(time.Hour).Unix()})
+
+	tests := []struct {
+		name       string
+		path       string
+		auth       string
+		wantStatus int
+		wantClaims bool
+	}{
+		{name: "no token", path: "/api/v1/get", wantStatus: http.StatusOK},
+		{name: "valid token", path: "/api/v1/get", auth: "Bearer " + valid, wantStatus: http.StatusOK, wantClaims: true},
+		{name: "operation not granted", path: "/api/v1/put", auth: "Bearer " + valid, wantStatus: http.StatusForbidden},
+		{name: "expired token", path: "/api/v1/get", auth: "Bearer " + expired, wantStatus: http.StatusUnauthorized},
+		{name: "tampered signature", path: "/api/v1/get", auth: "Bearer " + tampered, wantStatus: http.StatusUnauthorized},
+		{name: "signed by another key", path: "/api/v1/get", auth: "Bearer " + foreign, wantStatus: http.StatusUnauthorized},
+		{name: "garbage token", path: "/api/v1/get", auth: "Bearer nope", wantStatus: http.StatusUnauthorized},
+		{name: "unsupported scheme", path: "/api/v1/get", auth: "Basic abc", wantStatus: http.StatusUnauthorized},
+		{name: "admin token", path: "/api/admin/acl/list", auth: "Bearer admin-secret", wantStatus: http.StatusOK},
+		{name: "admin without token", path: "/api/admin/acl/list", wantStatus: http.StatusUnauthorized},
+		{name: "admin with delegated token", path: "/api/admin/acl/list", auth: "Bearer " + valid, wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", tt.path, nil)
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			r, status, err := s.authenticate(r)
+			if status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (err %v)", status, tt.wantStatus, err)
+			}
+			if (err == nil) != (tt.wantStatus == http.StatusOK) {
+				t.Fatalf("unexpected error %v for status %d", err, status)
+			}
+			if got := getClaims(r) != nil; got != tt.wantClaims {
+				t.Errorf("claims attached = %v, want %v", got, tt.wantClaims)
+			}
+		})
+	}
+}
+
+func TestAuthenticateReadOnly(t *testing.T) {
+	s := newTestServer()
+	token := mustMint(t, s, TokenClaims{ID: "ro", Workspace: getWorkspacePrefix("ws1"), Operations: allOperations(), Expires: time.Now().Add(time.Hour).Unix(), ReadOnly: true})
+
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{path: "/api/v1/get", wantStatus: http.StatusOK},
+		{path: "/api/v1/list", wantStatus: http.StatusOK},
+		{path: "/api/v1/tokens/delegate", wantStatus: http.StatusOK},
+		{path: "/api/v1/put", wantStatus: http.StatusForbidden},
+		{path: "/api/v1/delete", wantStatus: http.StatusForbidden},
+		{path: "/api/v1/snapshot/restore", wantStatus: http.StatusForbidden},
+		{path: "/api/v1/not-yet-known", wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			r := httptest.NewRequest("POST", tt.path, nil)
+			r.Header.Set("Authorization", "Bearer "+token)
+			if _, status, err := s.authenticate(r); status != tt.wantStatus {
+				t.Errorf("status = %d, want %d (err %v)", status, tt.wantStatus, err)
+			}
+		})
+	}
+}
+
+func TestAuthenticateAdminDisabled(t *testing.T) {
+	s := newTestServer()
+	s.adminToken = ""
+	r := httptest.NewRequest("POST", "/api/admin/acl/list", nil)
+	r.Header.Set("Authorization", "Bearer ")
+	if _, status, _ := s.authenticate(r); status != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", status, http.StatusForbidden)
+	}
+}
+
+func TestHandleDelegate(t *testing.T) {
+	s := newTestServer()
+	workspace := getWorkspacePrefix("ws1")
+	parent := &TokenClaims{ID: "parent", Workspace: workspace, KeyPrefix: "reports/", Operations: []string{"delegate", "get", "list", "put"}, Expires: time.Now().Add(30 * time.Minute).Unix(), RateLimit: 30}
+
+	tests := []struct {
+		name       string
+		parent     *TokenClaims
+		body       string
+		wantStatus int
+		check      func(t *testing.T, claims *TokenClaims)
+	}{
+		{
+			name:       "unscoped caller",
+			body:       `{"operations":["read"],"prefix":"notes/*"}`,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, claims *TokenClaims) {
+				if claims.KeyPrefix != "notes/" || !claims.allows("get") || !claims.allows("list") || claims.allows("put") {
+					t.Errorf("unexpected claims %+v", claims)
+				}
+			},
+		},
+		{
+			name:       "string params",
+			body:       `{"operations":"get, put","ttl":"60","read_only":"true"}`,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, claims *TokenClaims) {
+				if !claims.ReadOnly || !claims.allows("put") || claims.Expires > time.Now().Add(61*time.Second).Unix() {
+					t.Errorf("unexpected claims %+v", claims)
+				}
+			},
+		},
+		{
+			name:       "ttl capped",
+			body:       `{"operations":["get"],"ttl":999999}`,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, claims *TokenClaims) {
+				if claims.Expires > time.Now().Add(time.Hour).Unix()+1 {
+					t.Errorf("expiry %d exceeds the max TTL", claims.Expires)
+				}
+			},
+		},
+		{name: "unknown operation", body: `{"operations":["admin"]}`, wantStatus: http.StatusBadRequest},
+		{name: "no operations", body: `{"operations":[]}`, wantStatus: http.StatusBadRequest},
+		{
+			name:       "child within parent",
+			parent:     parent,
+			body:       `{"operations":["get"],"prefix":"reports/q1/","ttl":86400}`,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, claims *TokenClaims) {
+				if claims.Expires > parent.Expires {
+					t.Errorf("child expires after its parent")
+				}
+				if claims.Workspace != workspace {
+					t.Errorf("child workspace = %s, want %s", claims.Workspace, workspace)
+				}
+				if claims.Root != "parent" || claims.RateLimit != parent.RateLimit {
+					t.Errorf("child must share the rate limit of its parent, got %+v", claims)
+				}
+			},
+		},
+		{name: "child widens prefix", parent: parent, body: `{"operations":["get"],"prefix":"secrets/"}`, wantStatus: http.StatusForbidden},
+		{name: "child without prefix", parent: parent, body: `{"operations":["get"]}`, wantStatus: http.StatusForbidden},
+		{name: "child adds operation", parent: parent, body: `{"operations":["delete"],"prefix":"reports/"}`, wantStatus: http.StatusForbidden},
+		{
+			name:       "read-only parent",
+			parent:     &TokenClaims{ID: "ro", Workspace: workspace, Operations: []string{"delegate", "get", "put"}, Expires: parent.Expires, ReadOnly: true},
+			body:       `{"operations":["get"],"read_only":false}`,
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, claims *TokenClaims) {
+				if !claims.ReadOnly {
+					t.Errorf("child of a read-only token must be read-only")
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/v1/tokens/delegate", strings.NewReader(tt.body))
+			r.Header.Set("X-GPTScript-Env", "GPTSCRIPT_WORKSPACE_ID=ws1")
+			if tt.parent != nil {
+				token := mustMint(t, s, *tt.parent)
+				r.Header.Set("Authorization", "Bearer "+token)
+				var err error
+				if r, _, err = s.authenticate(r); err != nil {
+					t.Fatalf("failed to authenticate parent: %v", err)
+				}
+			}
+
+			w := httptest.NewRecorder()
+			s.handleDelegate(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.check == nil {
+				return
+			}
+
+			var resp struct {
+				Data struct {
+					Token string `json:"token"`
+				} `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("invalid response: %v", err)
+			}
+			claims, err := s.parseToken(resp.Data.Token)
+			if err != nil {
+				t.Fatalf("minted token does not parse: %v", err)
+			}
+			tt.check(t, claims)
+		})
+	}
+}
+
+func TestEphemeralSigningKeyIssuesNoCredentials(t *testing.T) {
+	s := newTestServer()
+	s.signer.ephemeral = true
+	for path, handler := range map[string]http.HandlerFunc{
+		"/api/v1/tokens/delegate":     s.handleDelegate,
+		"/api/admin/nats/credentials": s.handleNATSCredentials,
+	} {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", path, strings.NewReader(`{"operations":["get"],"workspace":"ws1"}`)))
+		if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "KV_SIGNING_KEY") {
+			t.Errorf("%s = %d %s, want 503", path, w.Code, w.Body.String())
+		}
+	}
+}
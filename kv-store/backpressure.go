@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// admissionControl limits how many requests are handled at once. Requests beyond the limit
+// wait in a bounded queue, and are shed once the queue is full or their wait times out, so
+// bursts are smoothed instead of all hitting JetStream at the same time.
+type admissionControl struct {
+	slots    chan struct{}
+	maxQueue int
+	timeout  time.Duration
+
+	lock   sync.Mutex
+	queued int
+	shed   int64
+}
+
+// newAdmissionControl configures the limiter from KV_MAX_CONCURRENT_REQUESTS,
+// KV_MAX_QUEUED_REQUESTS and KV_QUEUE_TIMEOUT. It returns nil when concurrency is not
+// limited.
+func newAdmissionControl() (*admissionControl, error) {
+	maxConcurrent, err := strconv.Atoi(getEnvOrDefault("KV_MAX_CONCURRENT_REQUESTS", "0"))
+	if err != nil || maxConcurrent < 0 {
+		return nil, fmt.Errorf("invalid KV_MAX_CONCURRENT_REQUESTS: must be a number of requests")
+	}
+	maxQueue, err := strconv.Atoi(getEnvOrDefault("KV_MAX_QUEUED_REQUESTS", strconv.Itoa(maxConcurrent*4)))
+	if err != nil || maxQueue < 0 {
+		return nil, fmt.Errorf("invalid KV_MAX_QUEUED_REQUESTS: must be a number of requests")
+	}
+	timeout, err := time.ParseDuration(getEnvOrDefault("KV_QUEUE_TIMEOUT", "10s"))
+	if err != nil || timeout <= 0 {
+		return nil, fmt.Errorf("invalid KV_QUEUE_TIMEOUT: must be a positive duration")
+	}
+	if maxConcurrent == 0 {
+		return nil, nil
+	}
+	return &admissionControl{
+		slots:    make(chan struct{}, maxConcurrent),
+		maxQueue: maxQueue,
+		timeout:  timeout,
+	}, nil
+}
+
+// acquire waits for a free slot and returns the function releasing it, or false when the
+// request is shed
+func (a *admissionControl) acquire(ctx context.Context) (func(), bool) {
+	release := func() { <-a.slots }
+	select {
+	case a.slots <- struct{}{}:
+		return release, true
+	default:
+	}
+
+	a.lock.Lock()
+	if a.queued >= a.maxQueue {
+		a.shed++
+		a.lock.Unlock()
+		return nil, false
+	}
+	a.queued++
+	a.lock.Unlock()
+	defer func() {
+		a.lock.Lock()
+		a.queued--
+		a.lock.Unlock()
+	}()
+
+	timer := time.NewTimer(a.timeout)
+	defer timer.Stop()
+	select {
+	case a.slots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	a.lock.Lock()
+	a.shed++
+	a.lock.Unlock()
+	return nil, false
+}
+
+// AdmissionStatus reports the load of the limiter
+type AdmissionStatus struct {
+	InFlight      int   `json:"in_flight"`
+	MaxConcurrent int   `json:"max_concurrent"`
+	Queued        int   `json:"queued"`
+	MaxQueued     int   `json:"max_queued"`
+	Shed          int64 `json:"shed"`
+}
+
+func (a *admissionControl) status() AdmissionStatus {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return AdmissionStatus{
+		InFlight:      len(a.slots),
+		MaxConcurrent: cap(a.slots),
+		Queued:        a.queued,
+		MaxQueued:     a.maxQueue,
+		Shed:          a.shed,
+	}
+}
+
+// admit waits until the request may be handled. Shed requests get a 503 telling the
+// client to retry shortly.
+func (s *Server) admit(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	if s.admission == nil {
+		return func() {}, true
+	}
+	release, ok := s.admission.acquire(r.Context())
+	if !ok {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Code: errCodeOverloaded, Error: "server is overloaded, retry later"})
+	}
+	return release, ok
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdmissionControl(t *testing.T) {
+	a := &admissionControl{slots: make(chan struct{}, 1), maxQueue: 1, timeout: 100 * time.Millisecond}
+
+	release, ok := a.acquire(context.Background())
+	if !ok {
+		t.Fatal("the first request must be admitted")
+	}
+
+	// The second request queues until the first one finishes
+	admitted := make(chan bool)
+	go func() {
+		release, ok := a.acquire(context.Background())
+		if ok {
+			release()
+		}
+		admitted <- ok
+	}()
+	for a.status().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is full, so the third request is shed right away
+	if _, ok := a.acquire(context.Background()); ok {
+		t.Error("requests beyond the queue must be shed")
+	}
+	release()
+	if !<-admitted {
+		t.Error("the queued request must be admitted once a slot is free")
+	}
+
+	// Queued requests are shed when their wait times out
+	release, _ = a.acquire(context.Background())
+	start := time.Now()
+	if _, ok := a.acquire(context.Background()); ok || time.Since(start) < 100*time.Millisecond {
+		t.Error("queued requests must be shed after the queue timeout")
+	}
+	release()
+
+	if status := a.status(); status.Shed != 2 || status.InFlight != 0 || status.Queued != 0 {
+		t.Errorf("status = %+v", status)
+	}
+}
+
+func TestAdmitSheds(t *testing.T) {
+	s := newTestServer()
+	s.admission = &admissionControl{slots: make(chan struct{}, 1), maxQueue: 0, timeout: time.Second}
+	release, _ := s.admission.acquire(context.Background())
+	defer release()
+
+	w := httptest.NewRecorder()
+	if _, ok := s.admit(w, httptest.NewRequest("POST", "/api/v1/get", nil)); ok {
+		t.Fatal("the request must be shed")
+	}
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("shed requests must be a 503 with Retry-After, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,733 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Backups are named kv-store-backup-<time>.tar.gz so they sort by creation time
+const (
+	backupFilePrefix = "kv-store-backup-"
+	backupFileSuffix = ".tar.gz"
+)
+
+// BackupManifest describes the contents of a backup archive. Backup archives are gzip
+// compressed tar files holding manifest.json, one kv/<bucket>.json archive per KV bucket
+// and every object as objects/<store>/<name>.
+type BackupManifest struct {
+	Version      int       `json:"version"`
+	Created      time.Time `json:"created"`
+	Buckets      []string  `json:"buckets"`
+	ObjectStores []string  `json:"object_stores"`
+	Keys         int       `json:"keys"`
+	Objects      int       `json:"objects"`
+}
+
+// BackupStatus reports the configuration and the outcome of the latest backups
+type BackupStatus struct {
+	Target       string    `json:"target"`
+	Schedule     string    `json:"schedule,omitempty"`
+	Retention    int       `json:"retention"`
+	Running      bool      `json:"running"`
+	LastBackup   string    `json:"last_backup,omitempty"`
+	LastSuccess  time.Time `json:"last_success,omitempty"`
+	LastAttempt  time.Time `json:"last_attempt,omitempty"`
+	LastDuration string    `json:"last_duration,omitempty"`
+	LastSize     int64     `json:"last_size,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+	NextRun      time.Time `json:"next_run,omitempty"`
+}
+
+// backupTarget is where backup archives are kept
+type backupTarget interface {
+	// write stores a finished archive under name
+	write(name string, file *os.File, size int64) error
+	// list returns the names of all backups, oldest first
+	list() ([]string, error)
+	remove(name string) error
+	String() string
+}
+
+// dirTarget keeps backups in a local directory
+type dirTarget struct {
+	dir string
+}
+
+func (d *dirTarget) write(name string, file *os.File, size int64) error {
+	// The archive is written next to the target and renamed, so a backup never shows up
+	// half written
+	return os.Rename(file.Name(), filepath.Join(d.dir, name))
+}
+
+func (d *dirTarget) list() ([]string, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if isBackupName(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (d *dirTarget) remove(name string) error {
+	return os.Remove(filepath.Join(d.dir, name))
+}
+
+func (d *dirTarget) String() string {
+	return d.dir
+}
+
+// s3Target keeps backups in an S3 bucket under a key prefix
+type s3Target struct {
+	client *s3Client
+	prefix string
+}
+
+func (t *s3Target) write(name string, file *os.File, size int64) error {
+	defer os.Remove(file.Name())
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return t.client.put(t.prefix+name, file, size)
+}
+
+func (t *s3Target) list() ([]string, error) {
+	keys, err := t.client.list(t.prefix)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, key := range keys {
+		if name := strings.TrimPrefix(key, t.prefix); isBackupName(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (t *s3Target) remove(name string) error {
+	return t.client.delete(t.prefix + name)
+}
+
+func (t *s3Target) String() string {
+	return "s3://" + t.client.bucket + "/" + t.prefix
+}
+
+func isBackupName(name string) bool {
+	return strings.HasPrefix(name, backupFilePrefix) && strings.HasSuffix(name, backupFileSuffix)
+}
+
+// parseS3URI splits s3://bucket/key into the bucket and key
+func parseS3URI(uri string) (bucket, key string, ok bool) {
+	rest, ok := strings.CutPrefix(uri, "s3://")
+	if !ok {
+		return "", "", false
+	}
+	bucket, key, _ = strings.Cut(rest, "/")
+	return bucket, key, bucket != ""
+}
+
+// parseBackupTarget returns the target for KV_BACKUP_TARGET, an s3://bucket/prefix URI or
+// a local directory
+func parseBackupTarget(target string) (backupTarget, error) {
+	if bucket, prefix, ok := parseS3URI(target); ok {
+		client, err := newS3Client(bucket)
+		if err != nil {
+			return nil, err
+		}
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		return &s3Target{client: client, prefix: prefix}, nil
+	}
+	if strings.HasPrefix(target, "s3://") {
+		return nil, fmt.Errorf("invalid S3 URI %q", target)
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		return nil, err
+	}
+	return &dirTarget{dir: target}, nil
+}
+
+// backupScheduler runs backups on an interval or cron schedule and applies retention
+type backupScheduler struct {
+	lock      sync.Mutex
+	target    backupTarget
+	retention int
+	interval  time.Duration
+	cron      *cronSchedule
+	status    BackupStatus
+}
+
+// newBackupScheduler configures backups from the environment. It returns nil when no
+// KV_BACKUP_TARGET is set. Without an interval or schedule, backups only run on request.
+func newBackupScheduler() (*backupScheduler, error) {
+	targetSpec := getEnvOrDefault("KV_BACKUP_TARGET", "")
+	if targetSpec == "" {
+		return nil, nil
+	}
+	target, err := parseBackupTarget(targetSpec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid KV_BACKUP_TARGET: %v", err)
+	}
+	retention, err := strconv.Atoi(getEnvOrDefault("KV_BACKUP_RETENTION", "7"))
+	if err != nil || retention < 1 {
+		return nil, fmt.Errorf("invalid KV_BACKUP_RETENTION: must be a positive number of backups")
+	}
+
+	b := &backupScheduler{
+		target:    target,
+		retention: retention,
+		status:    BackupStatus{Target: target.String(), Retention: retention},
+	}
+	if interval := getEnvOrDefault("KV_BACKUP_INTERVAL", ""); interval != "" {
+		if b.interval, err = time.ParseDuration(interval); err != nil || b.interval <= 0 {
+			return nil, fmt.Errorf("invalid KV_BACKUP_INTERVAL: must be a positive duration")
+		}
+		b.status.Schedule = "every " + interval
+	}
+	if schedule := getEnvOrDefault("KV_BACKUP_SCHEDULE", ""); schedule != "" {
+		if b.interval > 0 {
+			return nil, fmt.Errorf("set either KV_BACKUP_INTERVAL or KV_BACKUP_SCHEDULE, not both")
+		}
+		if b.cron, err = parseCron(schedule); err != nil {
+			return nil, fmt.Errorf("invalid KV_BACKUP_SCHEDULE: %v", err)
+		}
+		b.status.Schedule = schedule
+	}
+	return b, nil
+}
+
+// nextRun returns when the next scheduled backup is due, or the zero time if backups are
+// not scheduled
+func (b *backupScheduler) nextRun(now time.Time) time.Time {
+	switch {
+	case b.cron != nil:
+		return b.cron.next(now)
+	case b.interval > 0:
+		return now.Add(b.interval)
+	}
+	return time.Time{}
+}
+
+// getStatus returns a copy of the backup status
+func (b *backupScheduler) getStatus() BackupStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.status
+}
+
+// runBackupScheduler runs scheduled backups until the process exits
+func (s *Server) runBackupScheduler() {
+	b := s.backups
+	for {
+		next := b.nextRun(time.Now())
+		if next.IsZero() {
+			return
+		}
+		b.lock.Lock()
+		b.status.NextRun = next.UTC()
+		b.lock.Unlock()
+
+		time.Sleep(time.Until(next))
+		if _, err := s.runBackup(); err != nil {
+			log.Printf("Scheduled backup failed: %v", err)
+		}
+	}
+}
+
+// runBackup writes a backup archive to the target and removes backups beyond the
+// retention count. Only one backup runs at a time.
+func (s *Server) runBackup() (*BackupManifest, error) {
+	b := s.backups
+	b.lock.Lock()
+	if b.status.Running {
+		b.lock.Unlock()
+		return nil, fmt.Errorf("a backup is already running")
+	}
+	b.status.Running = true
+	b.status.LastAttempt = time.Now().UTC()
+	b.lock.Unlock()
+
+	start := time.Now()
+	name := backupFilePrefix + start.UTC().Format("20060102T150405Z") + backupFileSuffix
+	manifest, size, err := s.writeBackupTo(name)
+	if err == nil {
+		err = s.pruneBackups()
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.status.Running = false
+	b.status.LastDuration = time.Since(start).Round(time.Millisecond).String()
+	if err != nil {
+		b.status.LastError = err.Error()
+		return nil, err
+	}
+	b.status.LastError = ""
+	b.status.LastBackup = name
+	b.status.LastSuccess = time.Now().UTC()
+	b.status.LastSize = size
+	log.Printf("Backup %s written to %s: %d keys, %d objects, %d bytes", name, b.target, manifest.Keys, manifest.Objects, size)
+	return manifest, nil
+}
+
+// writeBackupTo writes an archive into a temporary file and hands it to the target
+func (s *Server) writeBackupTo(name string) (*BackupManifest, int64, error) {
+	dir := os.TempDir()
+	if target, ok := s.backups.target.(*dirTarget); ok {
+		dir = target.dir
+	}
+	file, err := os.CreateTemp(dir, ".kv-store-backup-*.tmp")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	manifest, err := s.writeBackup(file)
+	if err == nil {
+		err = file.Sync()
+	}
+	var size int64
+	if err == nil {
+		size, err = file.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		err = s.backups.target.write(name, file, size)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, 0, err
+	}
+	return manifest, size, nil
+}
+
+// pruneBackups removes the oldest backups beyond the retention count
+func (s *Server) pruneBackups() error {
+	names, err := s.backups.target.list()
+	if err != nil {
+		return err
+	}
+	for len(names) > s.backups.retention {
+		if err := s.backups.target.remove(names[0]); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// writeBackup writes every KV bucket and object store into a backup archive. Buckets are
+// read one after another, so the archive is not a point-in-time copy across buckets.
+func (s *Server) writeBackup(w io.Writer) (*BackupManifest, error) {
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	manifest := &BackupManifest{
+		Version:      1,
+		Created:      time.Now().UTC(),
+		Buckets:      make([]string, 0),
+		ObjectStores: make([]string, 0),
+	}
+	writeFile := func(name string, data []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: manifest.Created}); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	names, err := s.listBucketNames()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		bucket, err := js.KeyValue(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open bucket %s: %v", name, err)
+		}
+		// Checksums are checked on the way out and recorded again when restored
+		if isDataBucket(name) {
+			bucket = &checksumBucket{KeyValue: bucket}
+		}
+		archive, err := readArchiveEntries(bucket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bucket %s: %v", name, err)
+		}
+		// Archives only hold the latest revisions, so values stored as changes are stored in full
+		if isDataBucket(name) {
+			for i, entry := range archive.Entries {
+				if archive.Entries[i].Value, err = s.copyableValue(bucket, entry.Key, entry.Revision, entry.Value); err != nil {
+					return nil, fmt.Errorf("failed to read %s/%s: %v", name, entry.Key, err)
+				}
+			}
+		}
+		data, err := json.Marshal(archive)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFile("kv/"+name+".json", data); err != nil {
+			return nil, err
+		}
+		manifest.Buckets = append(manifest.Buckets, name)
+		manifest.Keys += len(archive.Entries)
+	}
+
+	var stores []string
+	for name := range js.ObjectStoreNames() {
+		// The names are reported as the underlying stream names
+		stores = append(stores, strings.TrimPrefix(name, "OBJ_"))
+	}
+	sort.Strings(stores)
+	for _, name := range stores {
+		store, err := js.ObjectStore(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open object store %s: %v", name, err)
+		}
+		objects, err := store.List()
+		if err != nil && !errors.Is(err, nats.ErrNoObjectsFound) {
+			return nil, fmt.Errorf("failed to list object store %s: %v", name, err)
+		}
+		for _, info := range objects {
+			if err := writeBackupObject(tw, store, name, info); err != nil {
+				return nil, err
+			}
+			manifest.Objects++
+		}
+		manifest.ObjectStores = append(manifest.ObjectStores, name)
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile("manifest.json", data); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// writeBackupObject streams one object into the archive. Object headers such as the
+// content type are kept as a PAX record.
+func writeBackupObject(tw *tar.Writer, store nats.ObjectStore, storeName string, info *nats.ObjectInfo) error {
+	header := &tar.Header{
+		Name:    "objects/" + storeName + "/" + info.Name,
+		Mode:    0644,
+		Size:    int64(info.Size),
+		ModTime: info.ModTime,
+		Format:  tar.FormatPAX,
+	}
+	if len(info.Headers) > 0 {
+		headers, err := json.Marshal(info.Headers)
+		if err != nil {
+			return err
+		}
+		header.PAXRecords = map[string]string{"KVSTORE.headers": string(headers)}
+	}
+
+	result, err := store.Get(info.Name)
+	if err != nil {
+		return fmt.Errorf("failed to read object %s/%s: %v", storeName, info.Name, err)
+	}
+	defer result.Close()
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, result); err != nil {
+		return fmt.Errorf("failed to read object %s/%s: %v", storeName, info.Name, err)
+	}
+	return nil
+}
+
+// handleBackupRun runs a backup right away
+func (s *Server) handleBackupRun(w http.ResponseWriter, r *http.Request) {
+	if s.backups == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "backups are disabled, set KV_BACKUP_TARGET to enable them"})
+		return
+	}
+
+	manifest, err := s.runBackup()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: manifest})
+}
+
+// handleBackupStatus reports the backup status and the backups kept in the target
+func (s *Server) handleBackupStatus(w http.ResponseWriter, r *http.Request) {
+	if s.backups == nil {
+		json.NewEncoder(w).Encode(KVResponse{Success: true, Data: map[string]interface{}{"enabled": false}})
+		return
+	}
+
+	backups, err := s.backups.target.list()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: map[string]interface{}{
+		"enabled": true,
+		"status":  s.backups.getStatus(),
+		"backups": backups,
+	}})
+}
+
+// openBackup opens a backup archive from a file path or an s3://bucket/key URI. Archives in
+// S3 are downloaded to a temporary file, since restoring reads the archive twice.
+func openBackup(source string) (*os.File, func(), error) {
+	bucket, key, ok := parseS3URI(source)
+	if !ok {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, nil, err
+		}
+		return file, func() { file.Close() }, nil
+	}
+
+	client, err := newS3Client(bucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := client.get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer body.Close()
+
+	file, err := os.CreateTemp("", ".kv-store-restore-*.tmp")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+	if _, err := io.Copy(file, body); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("failed to download %s: %v", source, err)
+	}
+	return file, cleanup, nil
+}
+
+// readBackup calls fn with every file of a backup archive
+func readBackup(file *os.File, fn func(header *tar.Header, r io.Reader) error) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("invalid backup archive: %v", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid backup archive: %v", err)
+		}
+		if err := fn(header, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// splitBackupObject splits an objects/<store>/<name> archive path
+func splitBackupObject(path string) (store, name string, ok bool) {
+	rest, ok := strings.CutPrefix(path, "objects/")
+	if !ok {
+		return "", "", false
+	}
+	store, name, ok = strings.Cut(rest, "/")
+	return store, name, ok && store != "" && name != ""
+}
+
+// nonEmptyBackupTargets returns the buckets and object stores of a backup that already
+// hold data
+func (s *Server) nonEmptyBackupTargets(manifest *BackupManifest) ([]string, error) {
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+
+	var names []string
+	for _, name := range manifest.Buckets {
+		bucket, err := js.KeyValue(name)
+		if errors.Is(err, nats.ErrBucketNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := bucket.Keys(); err == nil {
+			names = append(names, name)
+		} else if !errors.Is(err, nats.ErrNoKeysFound) {
+			return nil, err
+		}
+	}
+	for _, name := range manifest.ObjectStores {
+		store, err := js.ObjectStore(name)
+		if errors.Is(err, nats.ErrStreamNotFound) || errors.Is(err, nats.ErrBucketNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := store.List(); err == nil {
+			names = append(names, "objects/"+name)
+		} else if !errors.Is(err, nats.ErrNoObjectsFound) {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// restoreBackup seeds the store from a backup archive. Buckets and object stores that
+// already hold data are only overwritten when forced, and are then replaced by their
+// contents in the archive.
+func (s *Server) restoreBackup(source string, force bool) (*BackupManifest, error) {
+	file, cleanup, err := openBackup(source)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	// Read the manifest and the object names first so nothing is written when the
+	// restore is refused
+	var manifest *BackupManifest
+	objects := map[string]map[string]bool{}
+	err = readBackup(file, func(header *tar.Header, r io.Reader) error {
+		if header.Name == "manifest.json" {
+			return json.NewDecoder(r).Decode(&manifest)
+		}
+		if store, name, ok := splitBackupObject(header.Name); ok {
+			if objects[store] == nil {
+				objects[store] = map[string]bool{}
+			}
+			objects[store][name] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("%s is not a kv-store backup, manifest.json is missing", source)
+	}
+	if manifest.Version != 1 {
+		return nil, fmt.Errorf("unsupported backup version %d", manifest.Version)
+	}
+
+	if !force {
+		names, err := s.nonEmptyBackupTargets(manifest)
+		if err != nil {
+			return nil, err
+		}
+		if len(names) > 0 {
+			return nil, fmt.Errorf("refusing to overwrite non-empty buckets %s, restore with -restore-force to replace them", strings.Join(names, ", "))
+		}
+	}
+
+	err = readBackup(file, func(header *tar.Header, r io.Reader) error {
+		if name, ok := strings.CutPrefix(header.Name, "kv/"); ok {
+			var archive Archive
+			if err := json.NewDecoder(r).Decode(&archive); err != nil {
+				return fmt.Errorf("invalid archive %s: %v", header.Name, err)
+			}
+			// Archives hold values as stored, including encrypted values
+			bucket, err := s.getRawBucket(strings.TrimSuffix(name, ".json"))
+			if err != nil {
+				return err
+			}
+			plan, err := planRestore(bucket, &archive, "replace")
+			if err != nil {
+				return err
+			}
+			return applyRestore(bucket, &archive, plan)
+		}
+
+		storeName, name, ok := splitBackupObject(header.Name)
+		if !ok {
+			return nil
+		}
+		store, err := s.getObjectStore(storeName)
+		if err != nil {
+			return err
+		}
+		meta := &nats.ObjectMeta{Name: name}
+		if headers, ok := header.PAXRecords["KVSTORE.headers"]; ok {
+			if err := json.Unmarshal([]byte(headers), &meta.Headers); err != nil {
+				return fmt.Errorf("invalid headers of %s: %v", header.Name, err)
+			}
+		}
+		if _, err := store.Put(meta, r); err != nil {
+			return fmt.Errorf("failed to restore %s: %v", header.Name, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Objects created after the backup are removed, like keys missing from the archives
+	for _, storeName := range manifest.ObjectStores {
+		store, err := s.getObjectStore(storeName)
+		if err != nil {
+			return nil, err
+		}
+		infos, err := store.List()
+		if err != nil && !errors.Is(err, nats.ErrNoObjectsFound) {
+			return nil, err
+		}
+		for _, info := range infos {
+			if objects[storeName][info.Name] {
+				continue
+			}
+			if err := store.Delete(info.Name); err != nil {
+				return nil, fmt.Errorf("failed to delete objects/%s/%s: %v", storeName, info.Name, err)
+			}
+		}
+	}
+	return manifest, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPruneBackups(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"kv-store-backup-20240103T000000Z.tar.gz",
+		"kv-store-backup-20240101T000000Z.tar.gz",
+		"kv-store-backup-20240102T000000Z.tar.gz",
+		"notes.txt",
+		".kv-store-backup-123.tmp",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &Server{backups: &backupScheduler{target: &dirTarget{dir: dir}, retention: 2}}
+	if err := s.pruneBackups(); err != nil {
+		t.Fatalf("prune: %v", err)
+	}
+
+	names, err := s.backups.target.list()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"kv-store-backup-20240102T000000Z.tar.gz", "kv-store-backup-20240103T000000Z.tar.gz"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("kept %v, want %v", names, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("unrelated files must be kept: %v", err)
+	}
+}
+
+func TestSplitBackupObject(t *testing.T) {
+	tests := []struct {
+		path, store, name string
+		ok                bool
+	}{
+		{path: "objects/abc/artifacts/1234", store: "abc", name: "artifacts/1234", ok: true},
+		{path: "objects/abc/", ok: false},
+		{path: "objects//name", ok: false},
+		{path: "kv/abc.json", ok: false},
+	}
+	for _, tt := range tests {
+		store, name, ok := splitBackupObject(tt.path)
+		if ok != tt.ok || (ok && (store != tt.store || name != tt.name)) {
+			t.Errorf("splitBackupObject(%q) = %q, %q, %v", tt.path, store, name, ok)
+		}
+	}
+}
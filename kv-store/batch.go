@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// maxBatchOperations bounds the operations of a single batch
+const maxBatchOperations = 1000
+
+// batchRoutes are the endpoints the operations of a batch are served by
+var batchRoutes = map[string]string{
+	"get":    "/api/v1/get",
+	"put":    "/api/v1/put",
+	"delete": "/api/v1/delete",
+}
+
+type BatchRequest struct {
+	Operations batchOperations `json:"operations"`
+}
+
+// batchOperations is a list of operations, which can also be given as a string holding the
+// list, as tools pass every parameter as a string
+type batchOperations []BatchOperation
+
+func (o *batchOperations) UnmarshalJSON(data []byte) error {
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err == nil {
+		data = []byte(encoded)
+	}
+	var ops []BatchOperation
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&ops); err != nil {
+		return fmt.Errorf("expected a list of operations: %v", err)
+	}
+	*o = ops
+	return nil
+}
+
+// BatchOperation is a get, put or delete with the fields of its own endpoint
+type BatchOperation struct {
+	Op string `json:"op"`
+	KVRequest
+}
+
+// BatchOperationResult is the response an operation would have had on its own endpoint,
+// with its status code
+type BatchOperationResult struct {
+	Op     string `json:"op"`
+	Key    string `json:"key"`
+	Status int    `json:"status"`
+	KVResponse
+}
+
+type BatchResult struct {
+	Results []BatchOperationResult `json:"results"`
+	Failed  int                    `json:"failed"`
+	// Note tells a batch with failed operations apart from an atomic one
+	Note string `json:"note,omitempty"`
+}
+
+// batchNote is the note of a batch with failed operations
+const batchNote = "a batch is not atomic, the operations that succeeded were applied and are not rolled back"
+
+// handleBatch runs a list of gets, puts and deletes in order and answers with the result of
+// each. Every operation is served by its own endpoint, so it's checked and applied the same
+// way as when called alone, rate limited and admitted as a request of its own, and one that
+// fails doesn't stop the ones after it. Unlike mput, a batch is not atomic.
+func (s *Server) handleBatch(w http.ResponseWriter, r *http.Request) {
+	var req BatchRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+
+	if len(req.Operations) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "operations are required"})
+		return
+	}
+	if len(req.Operations) > maxBatchOperations {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("at most %d operations can be batched", maxBatchOperations)})
+		return
+	}
+	for i, op := range req.Operations {
+		if _, ok := batchRoutes[op.Op]; !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("operation %d: op must be get, put or delete", i)})
+			return
+		}
+	}
+
+	result := BatchResult{Results: make([]BatchOperationResult, len(req.Operations))}
+	for i, op := range req.Operations {
+		// The batch itself was charged as the first operation
+		result.Results[i] = s.runBatchOperation(r, op, i > 0)
+		if !result.Results[i].Success {
+			result.Failed++
+		}
+	}
+	if result.Failed > 0 {
+		result.Note = batchNote
+	}
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: result})
+}
+
+// runBatchOperation serves an operation of a batch as a request of its own to its endpoint,
+// carrying the headers and token of the batch. Charged operations count against the rate
+// limit of the token like separate requests.
+func (s *Server) runBatchOperation(r *http.Request, op BatchOperation, charge bool) BatchOperationResult {
+	result := BatchOperationResult{Op: op.Op, Key: op.Key}
+
+	// The batch route isn't tied to an operation and is open to read-only tokens, so each
+	// one is checked against the token
+	claims := getClaims(r)
+	if claims != nil && !claims.allows(op.Op) {
+		result.Status, result.Error = http.StatusForbidden, fmt.Sprintf("token does not allow %s", op.Op)
+		return result
+	}
+	if claims != nil && claims.ReadOnly && !readOnlyRoutes[batchRoutes[op.Op]] {
+		result.Status, result.Error = http.StatusForbidden, "token is read-only"
+		return result
+	}
+
+	body, err := json.Marshal(op.KVRequest)
+	if err != nil {
+		result.Status, result.Error = http.StatusBadRequest, err.Error()
+		return result
+	}
+	sub := r.Clone(r.Context())
+	sub.URL.Path = batchRoutes[op.Op]
+	sub.Body = io.NopCloser(bytes.NewReader(body))
+	sub.ContentLength = int64(len(body))
+	// Conditional headers of the batch don't apply to its gets
+	sub.Header.Del("If-None-Match")
+	sub.Header.Del("If-Modified-Since")
+
+	// Writes of a batch are refused where the writes of their endpoints would be
+	recorder := &batchRecorder{header: http.Header{}, status: http.StatusOK}
+	if s.rejectWrite(recorder, sub) || s.rejectDiskFull(recorder, sub) || (charge && !s.checkRateLimit(recorder, sub)) {
+		return recorder.result(result)
+	}
+	release, ok := s.admit(recorder, sub)
+	if !ok {
+		return recorder.result(result)
+	}
+	defer release()
+
+	switch op.Op {
+	case "get":
+		s.handleGet(recorder, sub)
+	case "put":
+		s.handlePut(recorder, sub)
+	case "delete":
+		s.handleDelete(recorder, sub)
+	}
+	s.publishEvent(sub, body, recorder.status)
+	return recorder.result(result)
+}
+
+// batchRecorder captures the response of an operation of a batch
+type batchRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+	// wroteHeader is set once the status is known
+	wroteHeader bool
+}
+
+func (b *batchRecorder) Header() http.Header {
+	return b.header
+}
+
+func (b *batchRecorder) WriteHeader(status int) {
+	if !b.wroteHeader {
+		b.status, b.wroteHeader = status, true
+	}
+}
+
+func (b *batchRecorder) Write(p []byte) (int, error) {
+	b.wroteHeader = true
+	return b.body.Write(p)
+}
+
+// result fills the result of an operation in with the response it was answered with
+func (b *batchRecorder) result(result BatchOperationResult) BatchOperationResult {
+	result.Status = b.status
+	if err := json.Unmarshal(b.body.Bytes(), &result.KVResponse); err != nil {
+		result.Success, result.Error = false, fmt.Sprintf("invalid response: %v", err)
+	}
+	return result
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleBatchValidation(t *testing.T) {
+	s := newTestServer()
+	for body, want := range map[string]string{
+		`{"operations":[]}`:                                 "operations are required",
+		`{"operations":[{"op":"incr","key":"a"}]}`:          "operation 0: op must be get, put or delete",
+		`{"operations":[{"op":"get","key":"a","extra":1}]}`: "invalid request body",
+	} {
+		w := httptest.NewRecorder()
+		s.handleBatch(w, httptest.NewRequest("POST", "/api/v1/batch", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%s: status %d, body %s, want 400 with %q", body, w.Code, w.Body.String(), want)
+		}
+	}
+}
+
+func TestHandleBatchResults(t *testing.T) {
+	s := newTestServer()
+	r := httptest.NewRequest("POST", "/api/v1/batch", strings.NewReader(`{"operations":[
+		{"op":"put","key":"a"},
+		{"op":"get"},
+		{"op":"delete","key":"a"},
+		{"op":"put","key":"b","value":"2","ttl":"never"}
+	]}`))
+	claims := &TokenClaims{Workspace: "ws1", Operations: []string{"get", "put"}}
+	r = r.WithContext(context.WithValue(r.Context(), claimsContextKey, claims))
+	w := httptest.NewRecorder()
+	s.handleBatch(w, r)
+
+	var response struct {
+		Data BatchResult `json:"data"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	// Each operation fails before the store is used, but the ones after it still run
+	want := []struct {
+		status int
+		error  string
+	}{
+		{http.StatusBadRequest, "key and value are required"},
+		{http.StatusBadRequest, "key is required"},
+		{http.StatusForbidden, "token does not allow delete"},
+		{http.StatusBadRequest, "ttl must be"},
+	}
+	results := response.Data.Results
+	if w.Code != http.StatusOK || len(results) != len(want) || response.Data.Failed != len(want) {
+		t.Fatalf("status %d, results %+v", w.Code, response.Data)
+	}
+	for i, result := range results {
+		if result.Status != want[i].status || result.Success || !strings.Contains(result.Error, want[i].error) {
+			t.Errorf("operation %d: %+v, want %d with %q", i, result, want[i].status, want[i].error)
+		}
+	}
+}
+
+// batchAs runs a batch through the whole server with a token, and decodes its results
+func batchAs(t *testing.T, s *Server, token string, ops ...BatchOperation) (int, BatchResult) {
+	t.Helper()
+	body, err := json.Marshal(BatchRequest{Operations: ops})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/batch", bytes.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	var response struct {
+		Data BatchResult `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+	}
+	return w.Code, response.Data
+}
+
+func batchStatuses(result BatchResult) []int {
+	var statuses []int
+	for _, r := range result.Results {
+		statuses = append(statuses, r.Status)
+	}
+	return statuses
+}
+
+func TestBatchStore(t *testing.T) {
+	t.Setenv("KV_TOKEN_RATE_LIMIT", "4")
+	s := newStoreServer(t)
+	claims := TokenClaims{Workspace: getWorkspacePrefix("ws1"), Operations: []string{"get", "put", "delete"}, Expires: time.Now().Add(time.Hour).Unix()}
+	readOnly := claims
+	readOnly.ReadOnly = true
+	readOnly.ID = "read-only"
+
+	// Operations are applied one by one, and the ones before a failure are kept
+	status, result := batchAs(t, s, mustMint(t, s, claims),
+		BatchOperation{Op: "put", KVRequest: KVRequest{Key: "a", Value: "1"}},
+		BatchOperation{Op: "get", KVRequest: KVRequest{Key: "a"}},
+		BatchOperation{Op: "put", KVRequest: KVRequest{Key: "b"}},
+	)
+	if status != http.StatusOK || result.Failed != 1 || result.Note != batchNote || result.Results[1].Data != "1" {
+		t.Fatalf("batch = %d, %+v", status, result)
+	}
+
+	// Each operation is charged, and the batch before used 3 of the 4 requests a minute
+	_, result = batchAs(t, s, mustMint(t, s, claims),
+		BatchOperation{Op: "get", KVRequest: KVRequest{Key: "a"}},
+		BatchOperation{Op: "get", KVRequest: KVRequest{Key: "a"}},
+	)
+	if statuses := batchStatuses(result); len(statuses) != 2 || statuses[0] != http.StatusOK || statuses[1] != http.StatusTooManyRequests {
+		t.Errorf("statuses past the rate limit = %v, want 200 then 429", statuses)
+	}
+
+	// Read-only tokens can batch reads, and their writes are refused one by one
+	status, result = batchAs(t, s, mustMint(t, s, readOnly),
+		BatchOperation{Op: "get", KVRequest: KVRequest{Key: "a"}},
+		BatchOperation{Op: "delete", KVRequest: KVRequest{Key: "a"}},
+	)
+	if statuses := batchStatuses(result); status != http.StatusOK || len(statuses) != 2 || statuses[0] != http.StatusOK || statuses[1] != http.StatusForbidden {
+		t.Errorf("read-only batch = %d, %v, want the get to succeed", status, statuses)
+	}
+
+	// So do stores whose disk is nearly full
+	s.disk = &diskMonitor{readOnly: true}
+	claims.ID = "disk-full"
+	status, result = batchAs(t, s, mustMint(t, s, claims),
+		BatchOperation{Op: "get", KVRequest: KVRequest{Key: "a"}},
+		BatchOperation{Op: "put", KVRequest: KVRequest{Key: "a", Value: "2"}},
+	)
+	if statuses := batchStatuses(result); status != http.StatusOK || len(statuses) != 2 || statuses[0] != http.StatusOK || statuses[1] != http.StatusInsufficientStorage {
+		t.Errorf("batch on a full disk = %d, %v, want the get to succeed", status, statuses)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// encodingBase64 is the encoding gets return binary values in, as JSON strings can only
+// hold UTF-8 text
+const encodingBase64 = "base64"
+
+// putValue returns the bytes a put stores, from its value or its base64 encoded value
+func (req *KVRequest) putValue() ([]byte, error) {
+	if req.ValueBase64 == "" {
+		return []byte(req.Value), nil
+	}
+	if req.Value != "" {
+		return nil, fmt.Errorf("value and value_base64 can't both be set")
+	}
+	value, err := base64.StdEncoding.DecodeString(req.ValueBase64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value_base64: %v", err)
+	}
+	return value, nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPutValue(t *testing.T) {
+	png := []byte{0x89, 'P', 'N', 'G', 0x0d, 0x0a, 0x1a, 0x0a, 0x00, 0xff}
+	req := KVRequest{ValueBase64: "iVBORw0KGgoA/w=="}
+	if value, err := req.putValue(); err != nil || !bytes.Equal(value, png) {
+		t.Errorf("putValue() = %v, %v, want %v", value, err, png)
+	}
+	req = KVRequest{Value: "plain"}
+	if value, err := req.putValue(); err != nil || string(value) != "plain" {
+		t.Errorf("putValue() = %q, %v", value, err)
+	}
+
+	for _, req := range []KVRequest{{Value: "a", ValueBase64: "YQ=="}, {ValueBase64: "not base64"}} {
+		if _, err := req.putValue(); err == nil {
+			t.Errorf("putValue of %+v succeeded, want an error", req)
+		}
+	}
+}
+
+func TestHandleGetInvalidEncoding(t *testing.T) {
+	s := newTestServer()
+	w := httptest.NewRecorder()
+	s.handleGet(w, httptest.NewRequest("POST", "/api/v1/get", strings.NewReader(`{"key":"a","encoding":"hex"}`)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "must be base64") {
+		t.Errorf("status = %d, body %s, want 400 for an unknown encoding", w.Code, w.Body.String())
+	}
+}
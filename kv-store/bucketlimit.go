@@ -0,0 +1,250 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// errBucketLimit is returned instead of creating a workspace bucket beyond the limit
+var errBucketLimit = errors.New("the store holds the maximum number of workspaces")
+
+// bucketLimit caps the workspace buckets of the store. Any workspace ID a client sends gets
+// its own bucket, so without a cap clients could exhaust JetStream by inventing IDs.
+type bucketLimit struct {
+	max int
+	// evictIdle is how long a workspace must not have been written for to be deleted to make
+	// room for a new one, 0 to never delete workspaces
+	evictIdle time.Duration
+
+	lock  sync.Mutex
+	known map[string]bool
+	// allowed are the workspaces an admin let past the limit
+	allowed map[string]bool
+}
+
+// newBucketLimit reads KV_MAX_WORKSPACES, the workspace buckets the store may hold, and
+// KV_WORKSPACE_EVICT_IDLE, how long a workspace must have been idle for to be deleted when
+// a new one needs room. Eviction deletes data, so it is off unless configured. It returns
+// nil when workspaces aren't limited.
+func newBucketLimit() (*bucketLimit, error) {
+	maxWorkspaces, err := strconv.Atoi(getEnvOrDefault("KV_MAX_WORKSPACES", "0"))
+	if err != nil || maxWorkspaces < 0 {
+		return nil, fmt.Errorf("invalid KV_MAX_WORKSPACES: must be a number of workspaces")
+	}
+	var evictIdle time.Duration
+	if value := getEnvOrDefault("KV_WORKSPACE_EVICT_IDLE", ""); value != "" {
+		if evictIdle, err = time.ParseDuration(value); err != nil || evictIdle <= 0 {
+			return nil, fmt.Errorf("invalid KV_WORKSPACE_EVICT_IDLE: must be a positive duration")
+		}
+	}
+	if maxWorkspaces == 0 {
+		return nil, nil
+	}
+	return &bucketLimit{max: maxWorkspaces, evictIdle: evictIdle, known: map[string]bool{}, allowed: map[string]bool{}}, nil
+}
+
+// isWorkspaceBucket reports whether a bucket is the main bucket of a workspace, rather than
+// one kept alongside it or a system bucket
+func isWorkspaceBucket(name string) bool {
+	return !strings.Contains(name, "-")
+}
+
+// reserveBucket checks a workspace bucket may exist before it is created. Buckets that
+// already exist are always allowed. A new one is allowed while the store is below the
+// limit, when an admin allowed it, or once an idle workspace was evicted to make room.
+func (s *Server) reserveBucket(prefix string) error {
+	l := s.bucketLimit
+	if l == nil || s.follower != nil || !isWorkspaceBucket(prefix) {
+		return nil
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.known[prefix] {
+		return nil
+	}
+
+	// Workspaces are counted again before one is rejected, as buckets may have been deleted
+	// or created by another replica since they were last counted
+	if err := s.loadWorkspaceBuckets(); err != nil {
+		return err
+	}
+	if l.known[prefix] || l.allowed[prefix] || len(l.known) < l.max {
+		l.known[prefix] = true
+		return nil
+	}
+	if l.evictIdle == 0 {
+		return errBucketLimit
+	}
+	evicted, err := s.evictIdleWorkspace()
+	if err != nil {
+		return err
+	}
+	if evicted == "" {
+		return errBucketLimit
+	}
+	delete(l.known, evicted)
+	l.known[prefix] = true
+	return nil
+}
+
+// loadWorkspaceBuckets refreshes the known workspace buckets, with the limit locked
+func (s *Server) loadWorkspaceBuckets() error {
+	prefixes, err := s.listWorkspacePrefixes()
+	if err != nil {
+		return err
+	}
+	l := s.bucketLimit
+	l.known = make(map[string]bool, len(prefixes))
+	for _, prefix := range prefixes {
+		l.known[prefix] = true
+	}
+	return nil
+}
+
+// evictIdleWorkspace deletes the workspace that was written longest ago, with all the
+// buckets kept alongside it, if it has been idle for longer than the eviction age.
+// Workspaces an admin allowed are never evicted. It returns the evicted prefix, or "" when
+// no workspace is idle long enough.
+func (s *Server) evictIdleWorkspace() (string, error) {
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return "", fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+	l := s.bucketLimit
+	type candidate struct {
+		prefix string
+		last   time.Time
+	}
+	var idle []candidate
+	cutoff := time.Now().Add(-l.evictIdle)
+	for prefix := range l.known {
+		if l.allowed[prefix] {
+			continue
+		}
+		info, err := js.StreamInfo("KV_" + prefix)
+		if err != nil {
+			continue
+		}
+		if info.State.LastTime.Before(cutoff) {
+			idle = append(idle, candidate{prefix: prefix, last: info.State.LastTime})
+		}
+	}
+	if len(idle) == 0 {
+		return "", nil
+	}
+	victim := slices.MinFunc(idle, func(a, b candidate) int { return a.last.Compare(b.last) })
+
+	names, err := s.listBucketNames()
+	if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		if name != victim.prefix && !strings.HasPrefix(name, victim.prefix+"-") {
+			continue
+		}
+		if err := js.DeleteKeyValue(name); err != nil && !errors.Is(err, nats.ErrBucketNotFound) {
+			return "", fmt.Errorf("failed to evict idle workspace %s: %v", victim.prefix, err)
+		}
+	}
+	log.Printf("Evicted workspace %s, idle since %s, to make room for a new workspace", victim.prefix, victim.last.Format(time.RFC3339))
+	return victim.prefix, nil
+}
+
+// checkBucketLimit rejects requests that would create a workspace beyond the limit with a
+// 507
+func (s *Server) checkBucketLimit(w http.ResponseWriter, r *http.Request) bool {
+	err := s.reserveBucket(getRequestPrefix(r))
+	if err == nil {
+		return true
+	}
+	status := http.StatusInternalServerError
+	if errors.Is(err, errBucketLimit) {
+		status = http.StatusInsufficientStorage
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(KVResponse{Success: false, Code: errCodeBucketLimit, Error: err.Error()})
+	return false
+}
+
+type BucketLimitRequest struct {
+	WorkspaceID string `json:"workspace_id,omitempty"`
+	Prefix      string `json:"prefix,omitempty"`
+}
+
+// BucketLimitStatus reports the workspaces of the store against the limit
+type BucketLimitStatus struct {
+	Workspaces int      `json:"workspaces"`
+	Max        int      `json:"max"`
+	EvictIdle  string   `json:"evict_idle,omitempty"`
+	Allowed    []string `json:"allowed,omitempty"`
+}
+
+// handleBuckets reports how many workspaces the store holds against the limit
+func (s *Server) handleBuckets(w http.ResponseWriter, r *http.Request) {
+	l := s.bucketLimit
+	if l == nil {
+		json.NewEncoder(w).Encode(KVResponse{Success: true, Data: BucketLimitStatus{}})
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err := s.loadWorkspaceBuckets(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	status := BucketLimitStatus{Workspaces: len(l.known), Max: l.max}
+	if l.evictIdle > 0 {
+		status.EvictIdle = l.evictIdle.String()
+	}
+	for prefix := range l.allowed {
+		status.Allowed = append(status.Allowed, prefix)
+	}
+	slices.SortFunc(status.Allowed, cmp.Compare[string])
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: status})
+}
+
+// handleBucketsAllow lets a workspace past the limit and creates its bucket. The override
+// lasts until the server restarts, after which the bucket counts as existing.
+func (s *Server) handleBucketsAllow(w http.ResponseWriter, r *http.Request) {
+	var req BucketLimitRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+	prefix := req.Prefix
+	if req.WorkspaceID != "" {
+		prefix = getWorkspacePrefix(req.WorkspaceID)
+	}
+	if prefix == "" || !isWorkspaceBucket(prefix) || (req.WorkspaceID != "" && req.Prefix != "") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "either workspace_id or a workspace prefix is required"})
+		return
+	}
+
+	if l := s.bucketLimit; l != nil {
+		l.lock.Lock()
+		l.allowed[prefix] = true
+		l.lock.Unlock()
+	}
+	if _, err := s.getBucket(prefix); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: map[string]string{"prefix": prefix}})
+}
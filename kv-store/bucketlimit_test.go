@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewBucketLimit(t *testing.T) {
+	if l, err := newBucketLimit(); l != nil || err != nil {
+		t.Fatalf("workspaces must not be limited by default, got %+v, %v", l, err)
+	}
+	t.Setenv("KV_MAX_WORKSPACES", "10")
+	t.Setenv("KV_WORKSPACE_EVICT_IDLE", "720h")
+	l, err := newBucketLimit()
+	if err != nil || l.max != 10 || l.evictIdle != 720*time.Hour {
+		t.Fatalf("newBucketLimit = %+v, %v", l, err)
+	}
+	for name, value := range map[string]string{"KV_MAX_WORKSPACES": "-1", "KV_WORKSPACE_EVICT_IDLE": "forever"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := newBucketLimit(); err == nil {
+				t.Errorf("%s=%s should be rejected", name, value)
+			}
+		})
+	}
+}
+
+func TestReserveBucket(t *testing.T) {
+	s := newTestServer()
+	s.bucketLimit = &bucketLimit{max: 1, known: map[string]bool{"abc": true}, allowed: map[string]bool{}}
+
+	if err := s.reserveBucket("abc"); err != nil {
+		t.Errorf("existing workspaces must be allowed, got %v", err)
+	}
+	if err := s.reserveBucket("abc-stats"); err != nil {
+		t.Errorf("buckets kept alongside a workspace must not count, got %v", err)
+	}
+	if err := s.reserveBucket("system-usage"); err != nil {
+		t.Errorf("system buckets must not count, got %v", err)
+	}
+	s.follower = &follower{}
+	if err := s.reserveBucket("def"); err != nil {
+		t.Errorf("followers only mirror buckets, got %v", err)
+	}
+}
+
+func TestHandleBucketsAllowValidation(t *testing.T) {
+	s := newTestServer()
+	for _, body := range []string{`{}`, `{"prefix":"abc-stats"}`, `{"workspace_id":"a","prefix":"b"}`, `{"unknown":true}`} {
+		w := httptest.NewRecorder()
+		s.handleBucketsAllow(w, httptest.NewRequest("POST", "/api/admin/buckets/allow", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", body, w.Code)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type DeletePrefixRequest struct {
+	Prefix string       `json:"prefix"`
+	DryRun flexibleBool `json:"dry_run,omitempty"`
+}
+
+type DeletePrefixResult struct {
+	Count  int      `json:"count"`
+	Keys   []string `json:"keys,omitempty"`
+	DryRun bool     `json:"dry_run,omitempty"`
+}
+
+// handleDeletePrefix deletes every key starting with a prefix. The caller must be allowed to
+// delete all of them, so a prefix never ends up partially deleted because of ACLs. A dry
+// run only reports the keys that would be deleted.
+func (s *Server) handleDeletePrefix(w http.ResponseWriter, r *http.Request) {
+	var req DeletePrefixRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+
+	// An empty prefix would delete the whole store, which is not what this is for
+	req.Prefix = strings.TrimSuffix(req.Prefix, "*")
+	if req.Prefix == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "prefix is required"})
+		return
+	}
+
+	// Get the bucket for this request
+	prefix := s.getDataPrefix(r, false)
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	keys, err := bucket.ListKeys()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	matched := make([]string, 0)
+	for key := range keys.Keys() {
+		if strings.HasPrefix(key, req.Prefix) {
+			matched = append(matched, key)
+		}
+	}
+	for _, key := range matched {
+		if !s.checkKeyAccess(w, r, key, permDelete) {
+			return
+		}
+	}
+
+	if req.DryRun {
+		json.NewEncoder(w).Encode(KVResponse{Success: true, Data: DeletePrefixResult{Count: len(matched), Keys: matched, DryRun: true}})
+		return
+	}
+
+	deleted := 0
+	for _, key := range matched {
+		if err := bucket.Delete(key); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("deleted %d of %d keys, failed to delete %s: %v", deleted, len(matched), key, err)})
+			return
+		}
+		s.deleteKeyStats(prefix, key)
+		deleted++
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: DeletePrefixResult{Count: deleted}})
+}
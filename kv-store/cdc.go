@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type CDCRequest struct {
+	FromSeq uint64 `json:"from_seq,omitempty"`
+	// FromTime starts at the first change made at or after the time, instead of FromSeq
+	FromTime time.Time `json:"from_time,omitempty"`
+	Limit    int       `json:"limit,omitempty"`
+}
+
+// ChangeEvent is a single change read from a bucket's underlying stream
+type ChangeEvent struct {
+	Seq       uint64    `json:"seq"`
+	Key       string    `json:"key"`
+	Operation string    `json:"operation"`
+	Value     string    `json:"value,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+type CDCResult struct {
+	Changes []ChangeEvent `json:"changes"`
+	NextSeq uint64        `json:"next_seq"`
+	LastSeq uint64        `json:"last_seq"`
+}
+
+// getChangeOperation maps the KV operation header of a stream message to an operation name
+func getChangeOperation(msg *nats.Msg) string {
+	switch msg.Header.Get("KV-Operation") {
+	case "DEL":
+		return "delete"
+	case "PURGE":
+		return "purge"
+	default:
+		return "put"
+	}
+}
+
+// readChanges reads up to limit changes from the stream backing a bucket, starting at fromSeq
+// or, when fromTime is set, at the first change made at or after fromTime
+func (s *Server) readChanges(bucket string, fromSeq uint64, fromTime time.Time, limit int) (*CDCResult, error) {
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+
+	stream := "KV_" + bucket
+	info, err := js.StreamInfo(stream)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stream info: %v", err)
+	}
+
+	result := &CDCResult{
+		Changes: make([]ChangeEvent, 0),
+		NextSeq: fromSeq,
+		LastSeq: info.State.LastSeq,
+	}
+	if fromSeq < info.State.FirstSeq {
+		fromSeq = info.State.FirstSeq
+		result.NextSeq = fromSeq
+	}
+	if info.State.Msgs == 0 || fromSeq > info.State.LastSeq {
+		return result, nil
+	}
+
+	start := nats.StartSequence(fromSeq)
+	if !fromTime.IsZero() {
+		start = nats.StartTime(fromTime)
+	}
+	sub, err := js.PullSubscribe("", "", nats.BindStream(stream), start, nats.AckNone())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create stream consumer: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	// Superseded revisions leave gaps in the sequence, so size the fetch from the messages
+	// the consumer actually has pending rather than the sequence range
+	consumer, err := sub.ConsumerInfo()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get consumer info: %v", err)
+	}
+	if consumer.NumPending == 0 {
+		result.NextSeq = info.State.LastSeq + 1
+		return result, nil
+	}
+	if uint64(limit) > consumer.NumPending {
+		limit = int(consumer.NumPending)
+	}
+
+	msgs, err := sub.Fetch(limit, nats.MaxWait(time.Second))
+	if err != nil && !errors.Is(err, nats.ErrTimeout) {
+		return nil, fmt.Errorf("failed to read changes: %v", err)
+	}
+
+	// Values of data buckets are read decrypted and rebuilt if they are stored as changes
+	var raw nats.KeyValue
+	if isDataBucket(bucket) {
+		if raw, err = s.getRawBucket(bucket); err != nil {
+			return nil, err
+		}
+	}
+	subjectPrefix := "$KV." + bucket + "."
+	for _, msg := range msgs {
+		meta, err := msg.Metadata()
+		if err != nil {
+			continue
+		}
+		key := strings.TrimPrefix(msg.Subject, subjectPrefix)
+		value := msg.Data
+		if isDataBucket(bucket) && getChangeOperation(msg) == "put" {
+			if value, _, err = openChecksum(value); err == nil {
+				value, _, err = s.openStoredValue(raw, key, meta.Sequence.Stream, value)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+		}
+		result.Changes = append(result.Changes, ChangeEvent{
+			Seq:       meta.Sequence.Stream,
+			Key:       key,
+			Operation: getChangeOperation(msg),
+			Value:     string(value),
+			Time:      meta.Timestamp.UTC(),
+		})
+		result.NextSeq = meta.Sequence.Stream + 1
+	}
+	return result, nil
+}
+
+// handleCDC returns an ordered page of changes in the workspace bucket. Consumers resume
+// by passing the returned next_seq as from_seq on their next call, or replay the changes
+// since a point in time with from_time. The bucket only keeps KV_HISTORY revisions per key
+// (1 by default) or as many as KV_HISTORY_RULES set for the key, so a revision that has
+// been superseded before it is read is not returned; only the latest state of such keys is
+// seen.
+func (s *Server) handleCDC(w http.ResponseWriter, r *http.Request) {
+	var req CDCRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	if req.FromSeq == 0 {
+		req.FromSeq = 1
+	}
+	if req.Limit <= 0 {
+		req.Limit = 100
+	}
+	if req.Limit > 1000 {
+		req.Limit = 1000
+	}
+
+	// Get the bucket for this request
+	prefix := s.getDataPrefix(r, false)
+	if _, err := s.getBucket(prefix); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	// Sequences are per stream, so there is no single order over the streams of shards
+	if _, sharded := s.shards.state(prefix); sharded {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "the change feed is not available for sharded workspaces, use /api/v1/watch"})
+		return
+	}
+
+	result, err := s.readChanges(prefix, req.FromSeq, req.FromTime, req.Limit)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	// Only return changes to the keys the request is allowed to read
+	canRead := s.readFilter(r)
+	changes := make([]ChangeEvent, 0, len(result.Changes))
+	for _, change := range result.Changes {
+		if canRead(change.Key) {
+			changes = append(changes, change)
+		}
+	}
+	result.Changes = changes
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: result})
+}
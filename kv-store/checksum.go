@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// checksumValuePrefix marks values stored with a checksum. Checksummed values are the
+// prefix, the CRC-32C of the value as written by the layers above (e.g. encrypted) and the
+// value. Values written before checksums were recorded have no prefix and aren't checked.
+var checksumValuePrefix = []byte("\x00kvsum1\x00")
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errChecksumMismatch is returned for values that don't match the checksum stored with them
+var errChecksumMismatch = errors.New("checksum mismatch, the stored value is corrupt")
+
+// addChecksum prefixes a value with its checksum. Values copied as stored already carry one,
+// which is kept if it matches.
+func addChecksum(value []byte) ([]byte, error) {
+	if bytes.HasPrefix(value, checksumValuePrefix) {
+		if _, _, err := openChecksum(value); err != nil {
+			return nil, err
+		}
+		return value, nil
+	}
+	stored := make([]byte, 0, len(checksumValuePrefix)+4+len(value))
+	stored = append(stored, checksumValuePrefix...)
+	stored = binary.BigEndian.AppendUint32(stored, crc32.Checksum(value, checksumTable))
+	return append(stored, value...), nil
+}
+
+// openChecksum returns a stored value without its checksum, whether it had one, and
+// errChecksumMismatch when it doesn't match
+func openChecksum(stored []byte) ([]byte, bool, error) {
+	rest, ok := bytes.CutPrefix(stored, checksumValuePrefix)
+	if !ok {
+		return stored, false, nil
+	}
+	if len(rest) < 4 {
+		return nil, true, errChecksumMismatch
+	}
+	value := rest[4:]
+	if crc32.Checksum(value, checksumTable) != binary.BigEndian.Uint32(rest) {
+		return nil, true, errChecksumMismatch
+	}
+	return value, true, nil
+}
+
+// checksumBucket records a checksum with every value written to a data bucket and checks it
+// when the value is read. It is the layer closest to the stream, so everything else reads
+// and writes values without their checksums.
+type checksumBucket struct {
+	nats.KeyValue
+}
+
+// checkedEntry is a bucket entry with its checksum removed
+type checkedEntry struct {
+	nats.KeyValueEntry
+	value []byte
+}
+
+func (e *checkedEntry) Value() []byte {
+	return e.value
+}
+
+func (b *checksumBucket) checkEntry(entry nats.KeyValueEntry) (nats.KeyValueEntry, error) {
+	if entry == nil || entry.Operation() != nats.KeyValuePut {
+		return entry, nil
+	}
+	value, ok, err := openChecksum(entry.Value())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", entry.Key(), err)
+	}
+	if !ok {
+		return entry, nil
+	}
+	return &checkedEntry{KeyValueEntry: entry, value: value}, nil
+}
+
+func (b *checksumBucket) Get(key string) (nats.KeyValueEntry, error) {
+	entry, err := b.KeyValue.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return b.checkEntry(entry)
+}
+
+func (b *checksumBucket) GetRevision(key string, revision uint64) (nats.KeyValueEntry, error) {
+	entry, err := b.KeyValue.GetRevision(key, revision)
+	if err != nil {
+		return nil, err
+	}
+	return b.checkEntry(entry)
+}
+
+func (b *checksumBucket) Put(key string, value []byte) (uint64, error) {
+	stored, err := addChecksum(value)
+	if err != nil {
+		return 0, err
+	}
+	return b.KeyValue.Put(key, stored)
+}
+
+func (b *checksumBucket) PutString(key string, value string) (uint64, error) {
+	return b.Put(key, []byte(value))
+}
+
+func (b *checksumBucket) Create(key string, value []byte) (uint64, error) {
+	stored, err := addChecksum(value)
+	if err != nil {
+		return 0, err
+	}
+	return b.KeyValue.Create(key, stored)
+}
+
+func (b *checksumBucket) Update(key string, value []byte, last uint64) (uint64, error) {
+	stored, err := addChecksum(value)
+	if err != nil {
+		return 0, err
+	}
+	return b.KeyValue.Update(key, stored, last)
+}
+
+func (b *checksumBucket) History(key string, opts ...nats.WatchOpt) ([]nats.KeyValueEntry, error) {
+	entries, err := b.KeyValue.History(key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		if entries[i], err = b.checkEntry(entry); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func (b *checksumBucket) Watch(keys string, opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	watcher, err := b.KeyValue.Watch(keys, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return transformWatcher(watcher, b.Bucket(), b.checkEntry), nil
+}
+
+func (b *checksumBucket) WatchAll(opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	watcher, err := b.KeyValue.WatchAll(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return transformWatcher(watcher, b.Bucket(), b.checkEntry), nil
+}
+
+type VerifyRequest struct {
+	Workspace   string `json:"workspace,omitempty"`
+	WorkspaceID string `json:"workspace_prefix,omitempty"`
+}
+
+// CorruptEntry is a stored revision that can't be read back intact
+type CorruptEntry struct {
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+	Revision uint64 `json:"revision"`
+	Error    string `json:"error"`
+}
+
+// VerifyResult reports the revisions checked by a verification. Unchecked revisions were
+// written before checksums were recorded, so only whether they can be read is known.
+type VerifyResult struct {
+	Buckets   int            `json:"buckets"`
+	Revisions int            `json:"revisions"`
+	Verified  int            `json:"verified"`
+	Unchecked int            `json:"unchecked"`
+	Corrupt   []CorruptEntry `json:"corrupt"`
+	Duration  string         `json:"duration"`
+}
+
+// verifyBucket checks the checksum of every revision kept in a data bucket, and that the
+// latest value of every key can be read back, i.e. decrypted and rebuilt from the revisions
+// it is stored as changes of
+func (s *Server) verifyBucket(name string, result *VerifyResult) error {
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+	raw, err := js.KeyValue(name)
+	if err != nil {
+		return fmt.Errorf("failed to open bucket %s: %v", name, err)
+	}
+	watcher, err := raw.WatchAll(nats.IncludeHistory(), nats.IgnoreDeletes())
+	if err != nil {
+		return err
+	}
+	defer watcher.Stop()
+
+	var keys []string
+	seen := map[string]bool{}
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		result.Revisions++
+		if !seen[entry.Key()] {
+			seen[entry.Key()] = true
+			keys = append(keys, entry.Key())
+		}
+		switch _, ok, err := openChecksum(entry.Value()); {
+		case err != nil:
+			result.Corrupt = append(result.Corrupt, CorruptEntry{Bucket: name, Key: entry.Key(), Revision: entry.Revision(), Error: err.Error()})
+		case ok:
+			result.Verified++
+		default:
+			result.Unchecked++
+		}
+	}
+
+	// Keys deleted since they were scanned are skipped, and corrupt latest revisions were
+	// reported already
+	bucket := s.wrapDataBucket(&checksumBucket{KeyValue: raw})
+	for _, key := range keys {
+		_, err := bucket.Get(key)
+		if err == nil || errors.Is(err, nats.ErrKeyNotFound) || errors.Is(err, errChecksumMismatch) {
+			continue
+		}
+		result.Corrupt = append(result.Corrupt, CorruptEntry{Bucket: name, Key: key, Revision: revisionOf(raw, key), Error: err.Error()})
+	}
+	return nil
+}
+
+// revisionOf returns the latest revision of a key, or 0 if it can't be read
+func revisionOf(bucket nats.KeyValue, key string) uint64 {
+	entry, err := bucket.Get(key)
+	if err != nil {
+		return 0
+	}
+	return entry.Revision()
+}
+
+// verifyWorkspace checks the data buckets of a workspace, or of every workspace when the
+// prefix is empty
+func (s *Server) verifyWorkspace(prefix string) (*VerifyResult, error) {
+	started := time.Now()
+	names, err := s.listDataBuckets()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	result := &VerifyResult{Corrupt: make([]CorruptEntry, 0)}
+	for _, name := range names {
+		if prefix != "" && name != prefix && !strings.HasPrefix(name, prefix+"-") {
+			continue
+		}
+		if err := s.verifyBucket(name, result); err != nil {
+			return nil, fmt.Errorf("failed to verify %s: %v", name, err)
+		}
+		result.Buckets++
+	}
+	result.Duration = time.Since(started).Round(time.Millisecond).String()
+	return result, nil
+}
+
+// handleVerify re-reads the data buckets of a workspace, or of every workspace, and reports
+// the revisions that don't match their checksum or can't be read back
+func (s *Server) handleVerify(w http.ResponseWriter, r *http.Request) {
+	var req VerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+	var prefix string
+	if req.Workspace != "" || req.WorkspaceID != "" {
+		prefix = getACLPrefix(ACLRequest{Workspace: req.Workspace, WorkspaceID: req.WorkspaceID})
+	}
+
+	result, err := s.verifyWorkspace(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: result})
+}
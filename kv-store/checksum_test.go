@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	stored, err := addChecksum([]byte("agent state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, ok, err := openChecksum(stored)
+	if err != nil || !ok || string(value) != "agent state" {
+		t.Errorf("openChecksum = %q, %t, %v", value, ok, err)
+	}
+
+	// Values copied as stored keep their checksum rather than getting a second one
+	if again, err := addChecksum(stored); err != nil || !bytes.Equal(again, stored) {
+		t.Errorf("addChecksum of a checksummed value = %q, %v", again, err)
+	}
+
+	corrupt := bytes.Clone(stored)
+	corrupt[len(corrupt)-1] ^= 0x01
+	if _, _, err := openChecksum(corrupt); !errors.Is(err, errChecksumMismatch) {
+		t.Errorf("openChecksum of a corrupt value = %v, want a checksum mismatch", err)
+	}
+	if _, err := addChecksum(corrupt); !errors.Is(err, errChecksumMismatch) {
+		t.Errorf("addChecksum of a corrupt value = %v, want a checksum mismatch", err)
+	}
+	if _, _, err := openChecksum(stored[:len(checksumValuePrefix)+2]); !errors.Is(err, errChecksumMismatch) {
+		t.Errorf("openChecksum of a truncated value = %v, want a checksum mismatch", err)
+	}
+
+	value, ok, err = openChecksum([]byte("written before checksums"))
+	if err != nil || ok || string(value) != "written before checksums" {
+		t.Errorf("openChecksum of an unchecked value = %q, %t, %v", value, ok, err)
+	}
+}
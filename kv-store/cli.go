@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// commands are the subcommands run instead of serving the store
+var commands = map[string]func(args []string) error{
+	"export":    runExportCommand,
+	"import":    runImportCommand,
+	"fsck":      runFsckCommand,
+	"replay":    runReplayCommand,
+	"nats-nkey": runNATSNkeyCommand,
+}
+
+// apiClient calls the HTTP API of a running store for a workspace
+type apiClient struct {
+	url       string
+	workspace string
+	token     string
+}
+
+// addClientFlags registers the flags locating the store and the workspace to act on
+func addClientFlags(flags *flag.FlagSet) *apiClient {
+	client := &apiClient{}
+	flags.StringVar(&client.url, "url", getEnvOrDefault("KV_URL", "http://localhost:"+getEnvOrDefault("PORT", "8080")), "URL of the store (env: KV_URL)")
+	flags.StringVar(&client.workspace, "workspace", getEnvOrDefault("GPTSCRIPT_WORKSPACE_ID", ""), "Workspace ID (env: GPTSCRIPT_WORKSPACE_ID)")
+	flags.StringVar(&client.token, "token", getEnvOrDefault("KV_TOKEN", ""), "Bearer token or API key (env: KV_TOKEN)")
+	return client
+}
+
+// call posts a body to an API path and returns the response body, or the error the store
+// responded with
+func (c *apiClient) call(path string, query url.Values, contentType string, body []byte) ([]byte, error) {
+	target := c.url + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if c.workspace != "" {
+		req.Header.Set("X-GPTScript-Env", "GPTSCRIPT_WORKSPACE_ID="+c.workspace)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var response KVResponse
+		if json.Unmarshal(data, &response) == nil && response.Error != "" {
+			return nil, fmt.Errorf("%s", response.Error)
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	return data, nil
+}
+
+// runExportCommand writes the keys of a workspace as CSV to a file or stdout
+func runExportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	client := addClientFlags(flags)
+	prefix := flags.String("prefix", "", "Only export keys starting with this prefix")
+	pattern := flags.String("pattern", "", "Only export keys matching this glob")
+	exclude := flags.String("exclude", "", "Comma separated globs of keys not to export, such as output-*")
+	scope := flags.String("scope", "", "Only export the thread, user or workspace level")
+	expand := flags.Bool("expand", false, "Spread values holding JSON objects over one column per field")
+	output := flags.String("o", "", "File to write, stdout by default")
+	flags.Parse(args)
+
+	req := CSVExportRequest{Prefix: *prefix, Pattern: *pattern, Scope: *scope, Expand: flexibleBool(*expand)}
+	if *exclude != "" {
+		req.Exclude = strings.Split(*exclude, ",")
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	data, err := client.call("/api/v1/export", nil, "application/json", body)
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(*output, data, 0644)
+}
+
+// runImportCommand stores a key for every row of a CSV file, read from the file given as
+// argument or stdin
+func runImportCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	client := addClientFlags(flags)
+	keyColumn := flags.String("key-column", "", "Header name or 1-based number of the key column, the first by default")
+	valueColumns := flags.String("value-columns", "", "Comma-separated value columns, every other column by default")
+	keyPrefix := flags.String("key-prefix", "", "Prefix added to every key")
+	scope := flags.String("scope", "", "Import into the thread, user or workspace level")
+	noHeader := flags.Bool("no-header", false, "The file has no header row")
+	dryRun := flags.Bool("dry-run", false, "Only report the keys that would be set")
+	flags.Parse(args)
+
+	var data []byte
+	var err error
+	switch flags.NArg() {
+	case 0:
+		data, err = io.ReadAll(os.Stdin)
+	case 1:
+		data, err = os.ReadFile(flags.Arg(0))
+	default:
+		return fmt.Errorf("import takes a single CSV file")
+	}
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	for name, value := range map[string]string{
+		"key_column":    *keyColumn,
+		"value_columns": *valueColumns,
+		"key_prefix":    *keyPrefix,
+		"scope":         *scope,
+	} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	if *noHeader {
+		query.Set("no_header", strconv.FormatBool(*noHeader))
+	}
+	if *dryRun {
+		query.Set("dry_run", strconv.FormatBool(*dryRun))
+	}
+	response, err := client.call("/api/v1/import", query, "text/csv", data)
+	if err != nil {
+		return err
+	}
+
+	var result struct {
+		Data CSVImportResult `json:"data"`
+	}
+	if err := json.Unmarshal(response, &result); err != nil {
+		return err
+	}
+	verb := "Imported"
+	if result.Data.DryRun {
+		verb = "Would import"
+	}
+	fmt.Printf("%s %d keys\n", verb, result.Data.Imported)
+	for _, key := range result.Data.Keys {
+		fmt.Printf("  %s\n", key)
+	}
+	if len(result.Data.Skipped) > 0 {
+		fmt.Printf("Skipped rows without a key or value: %v\n", result.Data.Skipped)
+	}
+	return nil
+}
+
+// runFsckCommand scrubs the data directory of a stopped store and prints what it repaired
+func runFsckCommand(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	storageDir := flags.String("s", getEnvOrDefault("NATS_STORAGE", "./data"), "Directory the store keeps its data in, the store must be stopped (env: NATS_STORAGE)")
+	dryRun := flags.Bool("dry-run", false, "Only report what would be removed")
+	flags.Parse(args)
+
+	s, closeStore, err := openStore(*storageDir)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	report, err := s.fsck(*dryRun)
+	if err != nil {
+		return err
+	}
+	printFsckReport(os.Stdout, report)
+	return nil
+}
+
+// openStore opens the data directory of a stopped store in an embedded NATS server of its
+// own. closeStore shuts the server down.
+func openStore(storageDir string) (s *Server, closeStore func(), err error) {
+	if _, err := os.Stat(storageDir); err != nil {
+		return nil, nil, err
+	}
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  filepath.Clean(storageDir),
+		NoSigs:    true,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	go ns.Start()
+	stop := func() {
+		ns.Shutdown()
+		ns.WaitForShutdown()
+	}
+	if !ns.ReadyForConnections(10 * time.Second) {
+		stop()
+		return nil, nil, fmt.Errorf("failed to open the store in %s", storageDir)
+	}
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		stop()
+		return nil, nil, err
+	}
+	s, err = NewServer(nc)
+	if err != nil {
+		nc.Close()
+		stop()
+		return nil, nil, err
+	}
+	return s, func() {
+		nc.Close()
+		stop()
+	}, nil
+}
+
+// runReplayCommand applies the changes journaled by a stopped store to the same or another
+// stopped store, such as one restored from a backup, to bring it to a point in time
+func runReplayCommand(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	storageDir := flags.String("s", getEnvOrDefault("NATS_STORAGE", "./data"), "Directory of the store to replay into, the store must be stopped (env: NATS_STORAGE)")
+	journalDir := flags.String("journal", "", "Directory of the stopped store whose journal is replayed, the store replayed into by default")
+	since := flags.String("since", "", "Only replay changes made at or after this time, such as when the backup the store was restored from was taken")
+	until := flags.String("until", "", "Only replay changes made up to this time, a date, RFC 3339 time or age such as 1h")
+	workspace := flags.String("workspace", "", "Only replay the changes of this workspace ID")
+	dryRun := flags.Bool("dry-run", false, "Only list the changes that would be applied")
+	flags.Parse(args)
+
+	var from, to time.Time
+	var err error
+	if *since != "" {
+		if from, err = parseQueryTime(*since); err != nil {
+			return fmt.Errorf("invalid -since: %v", err)
+		}
+	}
+	if *until != "" {
+		if to, err = parseQueryTime(*until); err != nil {
+			return fmt.Errorf("invalid -until: %v", err)
+		}
+	}
+	prefix := ""
+	if *workspace != "" {
+		prefix = getWorkspacePrefix(*workspace)
+	}
+
+	s, closeStore, err := openStore(*storageDir)
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+	// Replayed changes are already in the journal they come from
+	s.journal = nil
+	source := s
+	if *journalDir != "" && filepath.Clean(*journalDir) != filepath.Clean(*storageDir) {
+		var closeSource func()
+		if source, closeSource, err = openStore(*journalDir); err != nil {
+			return err
+		}
+		defer closeSource()
+	}
+
+	verb := "Applied"
+	if *dryRun {
+		verb = "Would apply"
+	}
+	report, err := s.replayJournal(source, prefix, from, to, *dryRun, func(change JournalChange) {
+		fmt.Printf("%s %d %s %s %s/%s\n", verb, change.Seq, change.Time.Format(time.RFC3339Nano), change.Operation, change.Bucket, change.Key)
+	})
+	if report != nil {
+		printReplayReport(os.Stdout, report)
+	}
+	return err
+}
+
+// printReplayReport writes a replay report for people to read
+func printReplayReport(w io.Writer, report *ReplayReport) {
+	verb := "applied"
+	if report.DryRun {
+		verb = "would be applied"
+	}
+	fmt.Fprintf(w, "Replayed %d changes: %d %s, %d already made\n", report.Changes, report.Applied, verb, report.Unchanged)
+	if report.Changes > 0 {
+		fmt.Fprintf(w, "Last change replayed: %d at %s\n", report.LastSeq, report.LastTime.Format(time.RFC3339Nano))
+	}
+}
+
+// printFsckReport writes a scrub report for people to read
+func printFsckReport(w io.Writer, report *FsckReport) {
+	fmt.Fprintf(w, "Checked %d revisions in %d buckets and %d objects\n", report.Revisions, report.Buckets, report.Objects)
+	verb := "Removed"
+	if report.DryRun {
+		verb = "Would remove"
+	}
+	for _, entry := range report.BrokenRevisions {
+		fmt.Fprintf(w, "Broken revision %d of %s/%s: %s\n", entry.Revision, entry.Bucket, entry.Key, entry.Error)
+	}
+	repaired := "Repaired"
+	if report.DryRun {
+		repaired = "Would repair"
+	}
+	for _, key := range report.RepairedKeys {
+		fmt.Fprintf(w, "%s %s\n", repaired, key)
+	}
+	for _, object := range report.BrokenObjects {
+		fmt.Fprintf(w, "%s object %s/%s: %s\n", verb, object.Store, object.Name, object.Error)
+	}
+	for _, subject := range report.OrphanedChunks {
+		fmt.Fprintf(w, "%s orphaned chunks %s\n", verb, subject)
+	}
+	for _, record := range report.StaleRecords {
+		fmt.Fprintf(w, "%s stale record %s\n", verb, record)
+	}
+	for _, gap := range report.JournalGaps {
+		fmt.Fprintf(w, "Change to %s/%s at %s is missing from the journal: %s\n", gap.Bucket, gap.Key, gap.Time.Format(time.RFC3339), gap.Error)
+	}
+	if len(report.BrokenRevisions)+len(report.BrokenObjects)+len(report.OrphanedChunks)+len(report.StaleRecords)+len(report.JournalGaps) == 0 {
+		fmt.Fprintln(w, "No problems found")
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// k8sServiceAccountDir holds the credentials Kubernetes mounts into every pod
+const k8sServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// clusterDiscovery finds the routes to the other kv-store replicas of a cluster. Peers come
+// from a static list, DNS records of a headless service, SRV records, or the endpoints of
+// a Kubernetes service.
+type clusterDiscovery struct {
+	method   string
+	target   string
+	port     int
+	static   []*url.URL
+	user     string
+	password string
+	interval time.Duration
+	k8s      *k8sClient
+}
+
+// configureCluster enables clustering of the embedded server when KV_CLUSTER_ROUTES or
+// KV_CLUSTER_DISCOVERY is set. Discovery is dns:<name>, srv:<name>, or
+// k8s:[<namespace>/]<service>, for example dns:kv-store-headless.default.svc.cluster.local
+// for the headless service of a StatefulSet.
+func configureCluster(opts *server.Options, clientPort int) (*clusterDiscovery, error) {
+	routes := getEnvOrDefault("KV_CLUSTER_ROUTES", "")
+	discovery := getEnvOrDefault("KV_CLUSTER_DISCOVERY", "")
+	if routes == "" && discovery == "" {
+		return nil, nil
+	}
+
+	port, err := strconv.Atoi(getEnvOrDefault("KV_CLUSTER_PORT", strconv.Itoa(clientPort+2)))
+	if err != nil || port <= 0 {
+		return nil, fmt.Errorf("invalid KV_CLUSTER_PORT: must be a port number")
+	}
+	interval, err := time.ParseDuration(getEnvOrDefault("KV_CLUSTER_DISCOVERY_INTERVAL", "30s"))
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid KV_CLUSTER_DISCOVERY_INTERVAL: must be a positive duration")
+	}
+	serverName := getEnvOrDefault("KV_SERVER_NAME", "")
+	if serverName == "" {
+		if serverName, err = os.Hostname(); err != nil {
+			return nil, fmt.Errorf("KV_SERVER_NAME is required when the hostname is unknown: %v", err)
+		}
+	}
+
+	d := &clusterDiscovery{
+		port:     port,
+		interval: interval,
+		password: getEnvOrDefault("KV_CLUSTER_PASSWORD", ""),
+	}
+	if d.password != "" {
+		d.user = "route"
+	}
+	if routes != "" {
+		d.static = server.RoutesFromStr(routes)
+	}
+	if discovery != "" {
+		var ok bool
+		d.method, d.target, ok = strings.Cut(discovery, ":")
+		if !ok || d.target == "" || (d.method != "dns" && d.method != "srv" && d.method != "k8s") {
+			return nil, fmt.Errorf("invalid KV_CLUSTER_DISCOVERY %q, must be dns:<name>, srv:<name> or k8s:[<namespace>/]<service>", discovery)
+		}
+		if d.method == "k8s" {
+			if d.k8s, err = newK8sClient(); err != nil {
+				return nil, fmt.Errorf("Kubernetes discovery: %v", err)
+			}
+		}
+	}
+
+	opts.ServerName = serverName
+	opts.Cluster.Name = getEnvOrDefault("KV_CLUSTER_NAME", "kv-store")
+	opts.Cluster.Host = opts.Host
+	opts.Cluster.Port = port
+	opts.Cluster.Username = d.user
+	opts.Cluster.Password = d.password
+	opts.Routes = d.routes()
+	return d, nil
+}
+
+// peers returns the host:port of every discovered peer
+func (d *clusterDiscovery) peers() ([]string, error) {
+	switch d.method {
+	case "dns":
+		addrs, err := net.LookupHost(d.target)
+		if err != nil {
+			return nil, err
+		}
+		peers := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			peers = append(peers, net.JoinHostPort(addr, strconv.Itoa(d.port)))
+		}
+		return peers, nil
+	case "srv":
+		_, records, err := net.LookupSRV("", "", d.target)
+		if err != nil {
+			return nil, err
+		}
+		peers := make([]string, 0, len(records))
+		for _, record := range records {
+			peers = append(peers, net.JoinHostPort(strings.TrimSuffix(record.Target, "."), strconv.Itoa(int(record.Port))))
+		}
+		return peers, nil
+	case "k8s":
+		return d.k8s.endpoints(d.target, d.port)
+	}
+	return nil, nil
+}
+
+// routes returns the static routes and the routes to every discovered peer, with the
+// cluster credentials unless a static route has its own. Routes to this server itself are
+// detected and ignored by NATS.
+func (d *clusterDiscovery) routes() []*url.URL {
+	var routes []*url.URL
+	for _, static := range d.static {
+		route := *static
+		if route.User == nil && d.user != "" {
+			route.User = url.UserPassword(d.user, d.password)
+		}
+		routes = append(routes, &route)
+	}
+	peers, err := d.peers()
+	if err != nil {
+		log.Printf("Cluster discovery with %s:%s failed: %v", d.method, d.target, err)
+	}
+	slices.Sort(peers)
+	for _, peer := range peers {
+		route := &url.URL{Scheme: "nats-route", Host: peer}
+		if d.user != "" {
+			route.User = url.UserPassword(d.user, d.password)
+		}
+		routes = append(routes, route)
+	}
+	return routes
+}
+
+// run rediscovers peers periodically and updates the routes of the running server, so
+// replicas that are added or rescheduled join the cluster
+func (d *clusterDiscovery) run(ns *server.Server, opts *server.Options) {
+	if d.method == "" {
+		return
+	}
+	current := routeStrings(opts.Routes)
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		routes := d.routes()
+		if slices.Equal(routeStrings(routes), current) {
+			continue
+		}
+		updated := opts.Clone()
+		updated.Routes = routes
+		if err := ns.ReloadOptions(updated); err != nil {
+			log.Printf("Failed to update cluster routes: %v", err)
+			continue
+		}
+		current = routeStrings(routes)
+		log.Printf("Cluster routes updated: %d peers", len(routes))
+	}
+}
+
+func routeStrings(routes []*url.URL) []string {
+	strs := make([]string, 0, len(routes))
+	for _, route := range routes {
+		strs = append(strs, route.String())
+	}
+	return strs
+}
+
+// k8sClient reads service endpoints from the Kubernetes API with the pod's service account
+type k8sClient struct {
+	baseURL   string
+	token     string
+	namespace string
+	client    *http.Client
+}
+
+func newK8sClient() (*k8sClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes pod")
+	}
+	token, err := os.ReadFile(k8sServiceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := os.ReadFile(k8sServiceAccountDir + "/namespace")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(k8sServiceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid service account CA certificate")
+	}
+	return &k8sClient{
+		baseURL:   "https://" + net.JoinHostPort(host, port),
+		token:     strings.TrimSpace(string(token)),
+		namespace: strings.TrimSpace(string(namespace)),
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+// endpoints returns the addresses behind a service, including pods that are not ready yet
+// since replicas have to form the cluster before they become ready. The port named
+// "cluster" is used when the service has one.
+func (k *k8sClient) endpoints(service string, defaultPort int) ([]string, error) {
+	namespace := k.namespace
+	if ns, name, ok := strings.Cut(service, "/"); ok {
+		namespace, service = ns, name
+	}
+	req, err := http.NewRequest(http.MethodGet, k.baseURL+"/api/v1/namespaces/"+url.PathEscape(namespace)+"/endpoints/"+url.PathEscape(service), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+k.token)
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("reading endpoints of %s/%s: %s", namespace, service, resp.Status)
+	}
+
+	var endpoints struct {
+		Subsets []struct {
+			Addresses []struct {
+				IP string `json:"ip"`
+			} `json:"addresses"`
+			NotReadyAddresses []struct {
+				IP string `json:"ip"`
+			} `json:"notReadyAddresses"`
+			Ports []struct {
+				Name string `json:"name"`
+				Port int    `json:"port"`
+			} `json:"ports"`
+		} `json:"subsets"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&endpoints); err != nil {
+		return nil, err
+	}
+
+	var peers []string
+	for _, subset := range endpoints.Subsets {
+		port := defaultPort
+		for _, p := range subset.Ports {
+			if p.Name == "cluster" {
+				port = p.Port
+			}
+		}
+		for _, addr := range subset.Addresses {
+			peers = append(peers, net.JoinHostPort(addr.IP, strconv.Itoa(port)))
+		}
+		for _, addr := range subset.NotReadyAddresses {
+			peers = append(peers, net.JoinHostPort(addr.IP, strconv.Itoa(port)))
+		}
+	}
+	return peers, nil
+}
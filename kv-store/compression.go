@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/nats-io/nats.go"
+)
+
+// compressedValuePrefix marks compressed values. Compressed values are the prefix, the name
+// of the codec, a NUL byte, the length of the value as a uvarint and the compressed data.
+// Each value names its codec, so values stay readable when the codec is changed or
+// compression is turned off.
+var compressedValuePrefix = []byte("\x00kvzip1\x00")
+
+// maxDecompressedSize bounds the values compressed data may expand to, which is above any
+// value a put accepts
+const maxDecompressedSize = 256 << 20
+
+// Compression codecs
+const (
+	codecZstd = "zstd"
+	codecLZ4  = "lz4"
+	codecGzip = "gzip"
+)
+
+// valueCodec compresses values and expands them again
+type valueCodec interface {
+	compress(value []byte) ([]byte, error)
+	decompress(data []byte, size int) ([]byte, error)
+}
+
+var valueCodecs = map[string]valueCodec{
+	codecZstd: zstdCodec{},
+	codecLZ4:  lz4Codec{},
+	codecGzip: gzipCodec{},
+}
+
+// compressor compresses the values of data buckets that are large enough to benefit
+type compressor struct {
+	codec   string
+	minSize int
+}
+
+// newCompressor reads KV_COMPRESSION, the codec values are compressed with: zstd, lz4, gzip
+// or off, and KV_COMPRESSION_MIN_SIZE, the size in bytes below which values are stored as
+// they are. It returns nil when values aren't compressed, which still reads the values
+// compressed before.
+func newCompressor() (*compressor, error) {
+	codec := getEnvOrDefault("KV_COMPRESSION", "off")
+	if _, ok := valueCodecs[codec]; !ok && codec != "off" {
+		return nil, fmt.Errorf("invalid KV_COMPRESSION %q, must be zstd, lz4, gzip or off", codec)
+	}
+	minSize, err := strconv.Atoi(getEnvOrDefault("KV_COMPRESSION_MIN_SIZE", "1024"))
+	if err != nil || minSize < 0 {
+		return nil, fmt.Errorf("invalid KV_COMPRESSION_MIN_SIZE: must be a number of bytes")
+	}
+	if codec == "off" {
+		return nil, nil
+	}
+	return &compressor{codec: codec, minSize: minSize}, nil
+}
+
+// compress returns a value as it is stored, compressed unless it is too small or doesn't
+// get any smaller
+func (c *compressor) compress(value []byte) ([]byte, error) {
+	if c == nil || len(value) < c.minSize || bytes.HasPrefix(value, compressedValuePrefix) {
+		return value, nil
+	}
+	data, err := valueCodecs[c.codec].compress(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress the value: %v", err)
+	}
+	stored := make([]byte, 0, len(compressedValuePrefix)+len(c.codec)+1+binary.MaxVarintLen64+len(data))
+	stored = append(stored, compressedValuePrefix...)
+	stored = append(append(stored, c.codec...), 0)
+	stored = binary.AppendUvarint(stored, uint64(len(value)))
+	stored = append(stored, data...)
+	if len(stored) >= len(value) {
+		return value, nil
+	}
+	return stored, nil
+}
+
+// decompressValue expands a stored value with the codec it names. Values stored as they are
+// are returned unchanged.
+func decompressValue(stored []byte) ([]byte, error) {
+	body, ok := bytes.CutPrefix(stored, compressedValuePrefix)
+	if !ok {
+		return stored, nil
+	}
+	name, rest, ok := bytes.Cut(body, []byte{0})
+	if !ok {
+		return nil, fmt.Errorf("compressed value is truncated")
+	}
+	codec, ok := valueCodecs[string(name)]
+	if !ok {
+		return nil, fmt.Errorf("value is compressed with unknown codec %q", name)
+	}
+	size, n := binary.Uvarint(rest)
+	if n <= 0 || size > maxDecompressedSize {
+		return nil, fmt.Errorf("compressed value has an invalid size")
+	}
+	value, err := codec.decompress(rest[n:], int(size))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress the value: %v", err)
+	}
+	if len(value) != int(size) {
+		return nil, fmt.Errorf("failed to decompress the value: expected %d bytes, got %d", size, len(value))
+	}
+	return value, nil
+}
+
+type zstdCodec struct{}
+
+// The zstd encoder and decoder are safe for concurrent use, and expensive to create
+var (
+	zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+		return zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	})
+	zstdDecoder = sync.OnceValues(func() (*zstd.Decoder, error) {
+		return zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(maxDecompressedSize))
+	})
+)
+
+func (zstdCodec) compress(value []byte) ([]byte, error) {
+	encoder, err := zstdEncoder()
+	if err != nil {
+		return nil, err
+	}
+	return encoder.EncodeAll(value, nil), nil
+}
+
+func (zstdCodec) decompress(data []byte, size int) ([]byte, error) {
+	decoder, err := zstdDecoder()
+	if err != nil {
+		return nil, err
+	}
+	return decoder.DecodeAll(data, make([]byte, 0, size))
+}
+
+type lz4Codec struct{}
+
+func (lz4Codec) compress(value []byte) ([]byte, error) {
+	return lz4CompressBlock(value), nil
+}
+
+func (lz4Codec) decompress(data []byte, size int) ([]byte, error) {
+	return lz4DecompressBlock(data, size)
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) compress(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(value); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCodec) decompress(data []byte, size int) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	// Read one byte past the size, so values that expand further are caught
+	value := bytes.NewBuffer(make([]byte, 0, size))
+	if _, err := io.Copy(value, io.LimitReader(gz, int64(size)+1)); err != nil {
+		return nil, err
+	}
+	return value.Bytes(), nil
+}
+
+// compressedBucket compresses the values written to a data bucket with the configured codec
+// and expands compressed values when they are read. It sits below delta encoding, which
+// works on the values as written, and above encryption, as ciphertexts don't compress.
+type compressedBucket struct {
+	nats.KeyValue
+	c *compressor
+}
+
+// decompressedEntry is a bucket entry with its value expanded
+type decompressedEntry struct {
+	nats.KeyValueEntry
+	value []byte
+}
+
+func (e *decompressedEntry) Value() []byte {
+	return e.value
+}
+
+func (b *compressedBucket) decompressEntry(entry nats.KeyValueEntry) (nats.KeyValueEntry, error) {
+	if entry == nil || entry.Operation() != nats.KeyValuePut || !bytes.HasPrefix(entry.Value(), compressedValuePrefix) {
+		return entry, nil
+	}
+	value, err := decompressValue(entry.Value())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", entry.Key(), err)
+	}
+	return &decompressedEntry{KeyValueEntry: entry, value: value}, nil
+}
+
+func (b *compressedBucket) Get(key string) (nats.KeyValueEntry, error) {
+	entry, err := b.KeyValue.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return b.decompressEntry(entry)
+}
+
+func (b *compressedBucket) GetRevision(key string, revision uint64) (nats.KeyValueEntry, error) {
+	entry, err := b.KeyValue.GetRevision(key, revision)
+	if err != nil {
+		return nil, err
+	}
+	return b.decompressEntry(entry)
+}
+
+func (b *compressedBucket) Put(key string, value []byte) (uint64, error) {
+	stored, err := b.c.compress(value)
+	if err != nil {
+		return 0, err
+	}
+	return b.KeyValue.Put(key, stored)
+}
+
+func (b *compressedBucket) PutString(key string, value string) (uint64, error) {
+	return b.Put(key, []byte(value))
+}
+
+func (b *compressedBucket) Create(key string, value []byte) (uint64, error) {
+	stored, err := b.c.compress(value)
+	if err != nil {
+		return 0, err
+	}
+	return b.KeyValue.Create(key, stored)
+}
+
+func (b *compressedBucket) Update(key string, value []byte, last uint64) (uint64, error) {
+	stored, err := b.c.compress(value)
+	if err != nil {
+		return 0, err
+	}
+	return b.KeyValue.Update(key, stored, last)
+}
+
+func (b *compressedBucket) History(key string, opts ...nats.WatchOpt) ([]nats.KeyValueEntry, error) {
+	entries, err := b.KeyValue.History(key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		if entries[i], err = b.decompressEntry(entry); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func (b *compressedBucket) Watch(keys string, opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	watcher, err := b.KeyValue.Watch(keys, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return transformWatcher(watcher, b.Bucket(), b.decompressEntry), nil
+}
+
+func (b *compressedBucket) WatchAll(opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	watcher, err := b.KeyValue.WatchAll(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return transformWatcher(watcher, b.Bucket(), b.decompressEntry), nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCompressionCodecs(t *testing.T) {
+	random := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(random)
+	values := map[string][]byte{
+		"text":     []byte(strings.Repeat(`{"task":"summarize","status":"running","progress":42}`, 200)),
+		"repeated": bytes.Repeat([]byte{'a'}, 70000),
+		"random":   random,
+		"short":    []byte("abc"),
+		"empty":    {},
+	}
+	for name, codec := range valueCodecs {
+		for value, data := range values {
+			compressed, err := codec.compress(data)
+			if err != nil {
+				t.Fatalf("%s: failed to compress %s: %v", name, value, err)
+			}
+			expanded, err := codec.decompress(compressed, len(data))
+			if err != nil || !bytes.Equal(expanded, data) {
+				t.Errorf("%s: %s did not survive compression: %v", name, value, err)
+			}
+		}
+	}
+}
+
+func TestCompressor(t *testing.T) {
+	c := &compressor{codec: codecLZ4, minSize: 100}
+	small := []byte(strings.Repeat("x", 99))
+	if stored, _ := c.compress(small); !bytes.Equal(stored, small) {
+		t.Error("values below the minimum size should be stored as they are")
+	}
+
+	value := []byte(strings.Repeat("hello world ", 100))
+	stored, err := c.compress(value)
+	if err != nil || !bytes.HasPrefix(stored, compressedValuePrefix) || len(stored) >= len(value) {
+		t.Fatalf("value was not compressed: %v", err)
+	}
+	// Values compressed with one codec stay readable whatever is configured now
+	if expanded, err := decompressValue(stored); err != nil || !bytes.Equal(expanded, value) {
+		t.Errorf("failed to expand the value: %v", err)
+	}
+	if expanded, err := decompressValue(small); err != nil || !bytes.Equal(expanded, small) {
+		t.Error("uncompressed values should be read as they are")
+	}
+
+	for _, corrupt := range [][]byte{
+		stored[:len(stored)-3],
+		append(bytes.Clone(compressedValuePrefix), "brotli\x00\x05abcde"...),
+		append(bytes.Clone(compressedValuePrefix), "lz4\x00\x05\xf0"...),
+	} {
+		if _, err := decompressValue(corrupt); err == nil {
+			t.Errorf("%q should fail to expand", corrupt)
+		}
+	}
+}
+
+func TestCompressedStore(t *testing.T) {
+	value := strings.Repeat(`{"task":"summarize","status":"running","progress":42}`, 200)
+	for name, encrypted := range map[string]bool{"plain": false, "encrypted": true} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("KV_COMPRESSION", codecZstd)
+			if encrypted {
+				t.Setenv("KV_ENCRYPTION_MASTER_KEY", "MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=")
+			}
+			s := newStoreServer(t)
+			for key, value := range map[string]string{"large": value, "small": "abc"} {
+				if status, response := call(t, s, "ws1", "/api/v1/put", KVRequest{Key: key, Value: value}); status != http.StatusOK {
+					t.Fatalf("put = %d, %+v", status, response)
+				}
+			}
+
+			raw, err := s.getRawBucket(getWorkspacePrefix("ws1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry, err := raw.Get("large")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Values are compressed before they are encrypted, as ciphertexts don't compress
+			if len(entry.Value()) > len(value)/4 {
+				t.Errorf("value is stored in %d of %d bytes", len(entry.Value()), len(value))
+			}
+			if !encrypted && !bytes.HasPrefix(entry.Value(), compressedValuePrefix) {
+				t.Error("value is not marked as compressed")
+			}
+
+			for key, want := range map[string]string{"large": value, "small": "abc"} {
+				if status, response := call(t, s, "ws1", "/api/v1/get", KVRequest{Key: key}); status != http.StatusOK || response.Data != want {
+					t.Errorf("get %s = %d, %v", key, status, response.Error)
+				}
+			}
+		})
+	}
+}
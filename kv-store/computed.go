@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ComputedKey defines a key whose value is rendered from the values of source keys.
+// Sources are key names or glob patterns such as "scores/*".
+type ComputedKey struct {
+	Key      string   `json:"key"`
+	Sources  []string `json:"sources"`
+	Template string   `json:"template"`
+}
+
+// computedDefinition is a stored computed key. It records the access scope of whoever
+// defined it, so recomputing only ever reads the sources the definer could read.
+type computedDefinition struct {
+	ComputedKey
+	Definer accessScope `json:"definer"`
+}
+
+// computedWatcher recomputes the computed keys of one workspace when their sources change
+type computedWatcher struct {
+	lock    sync.Mutex
+	keys    map[string]computedDefinition
+	watcher nats.KeyWatcher
+}
+
+// computedFuncs are available to computed key templates
+var computedFuncs = template.FuncMap{
+	"num": func(v string) float64 {
+		f, _ := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f
+	},
+	"json": func(v string) interface{} {
+		var out interface{}
+		_ = json.Unmarshal([]byte(v), &out)
+		return out
+	},
+	"sum": func(values map[string]string) float64 {
+		var total float64
+		for _, v := range values {
+			f, _ := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			total += f
+		}
+		return total
+	},
+	"add": func(a, b float64) float64 {
+		return a + b
+	},
+	"join": strings.Join,
+}
+
+// matchesSource reports whether a key is one of the sources of a computed key
+func (c ComputedKey) matchesSource(key string) bool {
+	for _, source := range c.Sources {
+		if source == key {
+			return true
+		}
+		if ok, _ := path.Match(source, key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// getComputedBucket gets the bucket holding computed key definitions for the given prefix
+func (s *Server) getComputedBucket(prefix string) (nats.KeyValue, error) {
+	return s.getBucket(prefix + "-computed")
+}
+
+// compute renders the value of a computed key from the current values of its sources.
+// Sources the definer is not allowed to read are left out.
+func (s *Server) compute(bucket nats.KeyValue, def computedDefinition) ([]byte, error) {
+	tmpl, err := template.New(def.Key).Funcs(computedFuncs).Option("missingkey=zero").Parse(def.Template)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %v", err)
+	}
+
+	canRead := func(key string) bool {
+		ok, err := s.scopeAllowed(def.Definer, key, permRead)
+		return err == nil && ok
+	}
+
+	values := map[string]string{}
+	var allKeys []string
+	for _, source := range def.Sources {
+		if !strings.ContainsAny(source, "*?[") {
+			if !canRead(source) {
+				continue
+			}
+			if entry, err := bucket.Get(source); err == nil {
+				values[source] = string(entry.Value())
+			}
+			continue
+		}
+
+		if allKeys == nil {
+			allKeys, err = bucket.Keys()
+			if err != nil && err != nats.ErrNoKeysFound {
+				return nil, err
+			}
+		}
+		for _, key := range allKeys {
+			if ok, _ := path.Match(source, key); ok && key != def.Key && canRead(key) {
+				if entry, err := bucket.Get(key); err == nil {
+					values[key] = string(entry.Value())
+				}
+			}
+		}
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, map[string]interface{}{"Values": values}); err != nil {
+		return nil, fmt.Errorf("failed to render template: %v", err)
+	}
+	return out.Bytes(), nil
+}
+
+// recompute renders a computed key and stores it if its value changed
+func (s *Server) recompute(bucket nats.KeyValue, def computedDefinition) error {
+	value, err := s.compute(bucket, def)
+	if err != nil {
+		return err
+	}
+	// Skipping unchanged values keeps computed keys that depend on each other from looping
+	if entry, err := bucket.Get(def.Key); err == nil && bytes.Equal(entry.Value(), value) {
+		return nil
+	}
+	_, err = bucket.Put(def.Key, value)
+	return err
+}
+
+// watchComputed starts (or refreshes) the watcher that maintains the computed keys of a workspace
+func (s *Server) watchComputed(prefix string) error {
+	defs, err := s.getComputedBucket(prefix)
+	if err != nil {
+		return err
+	}
+	keys := map[string]computedDefinition{}
+	names, err := defs.Keys()
+	if err != nil && err != nats.ErrNoKeysFound {
+		return err
+	}
+	for _, name := range names {
+		entry, err := defs.Get(name)
+		if err != nil {
+			continue
+		}
+		var def computedDefinition
+		if err := json.Unmarshal(entry.Value(), &def); err != nil {
+			log.Printf("Skipping invalid computed key %s: %v", name, err)
+			continue
+		}
+		keys[name] = def
+	}
+
+	s.computedLock.Lock()
+	defer s.computedLock.Unlock()
+
+	if existing, ok := s.computed[prefix]; ok {
+		existing.lock.Lock()
+		existing.keys = keys
+		existing.lock.Unlock()
+		return nil
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		return err
+	}
+	watcher, err := bucket.WatchAll(nats.UpdatesOnly())
+	if err != nil {
+		return err
+	}
+
+	cw := &computedWatcher{keys: keys, watcher: watcher}
+	s.computed[prefix] = cw
+	go func() {
+		for update := range watcher.Updates() {
+			if update == nil {
+				continue
+			}
+			cw.lock.Lock()
+			var affected []computedDefinition
+			for _, def := range cw.keys {
+				if def.Key != update.Key() && def.matchesSource(update.Key()) {
+					affected = append(affected, def)
+				}
+			}
+			cw.lock.Unlock()
+
+			for _, def := range affected {
+				if err := s.recompute(bucket, def); err != nil {
+					log.Printf("Failed to recompute %s: %v", def.Key, err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// startComputedWatchers starts watchers for every workspace with computed keys
+func (s *Server) startComputedWatchers() {
+	names, err := s.listBucketNames()
+	if err != nil {
+		log.Printf("Failed to list buckets for computed keys: %v", err)
+		return
+	}
+	for _, name := range names {
+		if prefix, ok := strings.CutSuffix(name, "-computed"); ok {
+			if err := s.watchComputed(prefix); err != nil {
+				log.Printf("Failed to watch computed keys for %s: %v", prefix, err)
+			}
+		}
+	}
+}
+
+func (s *Server) handleComputedDefine(w http.ResponseWriter, r *http.Request) {
+	var req ComputedKey
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+
+	if req.Key == "" || len(req.Sources) == 0 || req.Template == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "key, sources and template are required"})
+		return
+	}
+	if slices.Contains(req.Sources, req.Key) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "a computed key cannot be its own source"})
+		return
+	}
+
+	// The definer must be able to read every named source, and glob sources are filtered
+	// down to the keys the definer can read whenever the value is computed
+	if !s.checkKeyAccess(w, r, req.Key, permWrite) {
+		return
+	}
+	for _, source := range req.Sources {
+		if !strings.ContainsAny(source, "*?[") && !s.checkKeyAccess(w, r, source, permRead) {
+			return
+		}
+	}
+	def := computedDefinition{ComputedKey: req, Definer: getAccessScope(r)}
+
+	// Get the buckets for this request
+	prefix := s.getDataPrefix(r, false)
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	defs, err := s.getComputedBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	// Compute the value up front so invalid templates are rejected
+	if err := s.recompute(bucket, def); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	value, err := json.Marshal(def)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if _, err := defs.Put(req.Key, value); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	if err := s.watchComputed(prefix); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true})
+}
+
+func (s *Server) handleComputedList(w http.ResponseWriter, r *http.Request) {
+	// Get the bucket for this request
+	prefix := s.getDataPrefix(r, false)
+	defs, err := s.getComputedBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	names, err := defs.Keys()
+	if err != nil && err != nats.ErrNoKeysFound {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	canRead := s.readFilter(r)
+	keys := make([]ComputedKey, 0)
+	for _, name := range names {
+		if !canRead(name) {
+			continue
+		}
+		entry, err := defs.Get(name)
+		if err != nil {
+			continue
+		}
+		var def computedDefinition
+		if err := json.Unmarshal(entry.Value(), &def); err == nil {
+			keys = append(keys, def.ComputedKey)
+		}
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: keys})
+}
+
+func (s *Server) handleComputedDelete(w http.ResponseWriter, r *http.Request) {
+	var req KVRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	if req.Key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "key is required"})
+		return
+	}
+
+	if !s.checkKeyAccess(w, r, req.Key, permDelete) {
+		return
+	}
+
+	// Get the bucket for this request
+	prefix := s.getDataPrefix(r, false)
+	defs, err := s.getComputedBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	// The last computed value is left in place as a regular key
+	if err := defs.Purge(req.Key); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	if err := s.watchComputed(prefix); err != nil {
+		log.Printf("Failed to refresh computed keys for %s: %v", prefix, err)
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// entryETag identifies a revision of a key. Revisions are only unique within a bucket, so
+// the tag also hashes the bucket and key.
+func entryETag(bucket string, entry nats.KeyValueEntry) string {
+	h := fnv.New64a()
+	h.Write([]byte(bucket + "/" + entry.Key()))
+	return fmt.Sprintf(`"%x-%d"`, h.Sum64(), entry.Revision())
+}
+
+// setCacheHeaders describes the revision of a value being returned. Values can change at any
+// time, so clients may keep them but must revalidate before each use.
+func setCacheHeaders(w http.ResponseWriter, etag string, modified time.Time) {
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "private, no-cache")
+}
+
+// notModified reports whether the client already has the revision, from If-None-Match or,
+// when that is not sent, If-Modified-Since
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, tag := range strings.Split(match, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.Truncate(time.Second).After(since)
+}
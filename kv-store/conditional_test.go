@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestNotModified(t *testing.T) {
+	modified := time.Date(2026, 1, 2, 3, 4, 5, 600, time.UTC)
+	etag := `"abc-7"`
+	tests := []struct {
+		header, value string
+		want          bool
+	}{
+		{"If-None-Match", `"abc-7"`, true},
+		{"If-None-Match", `"abc-6", W/"abc-7"`, true},
+		{"If-None-Match", `*`, true},
+		{"If-None-Match", `"abc-6"`, false},
+		{"If-Modified-Since", modified.Format(http.TimeFormat), true},
+		{"If-Modified-Since", modified.Add(-time.Second).Format(http.TimeFormat), false},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/get", nil)
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		if got := notModified(r, etag, modified); got != test.want {
+			t.Errorf("%s: %s = %v, want %v", test.header, test.value, got, test.want)
+		}
+	}
+}
+
+// entryBucket holds a single entry
+type entryBucket struct {
+	nats.KeyValue
+	entry *testEntry
+}
+
+func (b *entryBucket) Get(key string) (nats.KeyValueEntry, error) {
+	if b.entry == nil || b.entry.key != key {
+		return nil, nats.ErrKeyNotFound
+	}
+	return b.entry, nil
+}
+
+func TestWritePutConflict(t *testing.T) {
+	s := newTestServer()
+	tests := []struct {
+		bucket   *entryBucket
+		expected uint64
+		want     uint64
+		error    string
+	}{
+		{&entryBucket{entry: &testEntry{key: "plan", revision: 7}}, 5, 7, "plan is at revision 7, not 5"},
+		{&entryBucket{entry: &testEntry{key: "plan", revision: 7}}, 0, 7, "plan already exists at revision 7"},
+		{&entryBucket{}, 5, 0, "plan is at revision 0, not 5"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		s.writePutConflict(w, test.bucket, "plan", test.expected)
+		var response KVResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusConflict || response.Code != errCodeConflict || response.Revision != test.want || response.Error != test.error {
+			t.Errorf("expected %d: status %d, response %+v", test.expected, w.Code, response)
+		}
+	}
+}
+
+func TestRevisionParams(t *testing.T) {
+	var req KVRequest
+	if err := json.Unmarshal([]byte(`{"key":"k","value":"v","revision":"3","expected_revision":"0"}`), &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Revision != 3 || req.ExpectedRevision == nil || *req.ExpectedRevision != 0 {
+		t.Errorf("got revision %d and expected revision %v", req.Revision, req.ExpectedRevision)
+	}
+
+	req = KVRequest{}
+	if err := json.Unmarshal([]byte(`{"key":"k","value":"v"}`), &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.ExpectedRevision != nil {
+		t.Errorf("got expected revision %d without one", *req.ExpectedRevision)
+	}
+}
+
+func TestCompareAndSwapStore(t *testing.T) {
+	s := newStoreServer(t)
+	// Revision 0 creates the key, and only once
+	status, response := call(t, s, "ws1", "/api/v1/put", map[string]any{"key": "a", "value": "1", "expected_revision": 0})
+	if status != http.StatusOK {
+		t.Fatalf("create = %d, %+v", status, response)
+	}
+	created := response.Revision
+	status, response = call(t, s, "ws1", "/api/v1/put", map[string]any{"key": "a", "value": "2", "expected_revision": 0})
+	if status != http.StatusConflict || response.Code != errCodeConflict || response.Revision != created {
+		t.Errorf("create of an existing key = %d, %+v, want a conflict at revision %d", status, response, created)
+	}
+
+	// Tools send revisions as strings
+	status, response = call(t, s, "ws1", "/api/v1/put", map[string]any{"key": "a", "value": "2", "expected_revision": strconv.FormatUint(created, 10)})
+	if status != http.StatusOK || response.Revision <= created {
+		t.Fatalf("update = %d, %+v", status, response)
+	}
+	current := response.Revision
+
+	// The revision read before the update is stale now
+	status, response = call(t, s, "ws1", "/api/v1/put", map[string]any{"key": "a", "value": "3", "expected_revision": created})
+	if status != http.StatusConflict || response.Revision != current {
+		t.Errorf("update at a stale revision = %d, %+v, want a conflict at revision %d", status, response, current)
+	}
+	if status, response := call(t, s, "ws1", "/api/v1/get", KVRequest{Key: "a"}); status != http.StatusOK || response.Data != "2" {
+		t.Errorf("get = %d, %+v, want the value of the update", status, response)
+	}
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Read consistency levels. Strong reads go to JetStream and see every acknowledged write.
+// Eventual reads are served from a local copy of the bucket's keys kept up to date by a
+// watch, and the values of hot keys, so they may miss writes made in the last moments.
+const (
+	consistencyStrong   = "strong"
+	consistencyEventual = "eventual"
+)
+
+// readCache holds local copies of the keys of the buckets read with eventual consistency. A
+// bucket is copied on its first eventual read, and dropped once it hasn't been read that
+// way for the idle time.
+type readCache struct {
+	lock    sync.Mutex
+	buckets map[string]*cachedBucket
+	idle    time.Duration
+	// consistency is the level of reads that don't ask for one
+	consistency string
+}
+
+// cachedBucket is the latest revision of every key of a bucket, fed by a watch that skips
+// the values. Values of hot keys are kept by the hot key cache, which only serves them
+// while they are the latest revision.
+type cachedBucket struct {
+	lock      sync.RWMutex
+	revisions map[string]uint64
+	synced    bool
+	lastRead  time.Time
+	watcher   nats.KeyWatcher
+}
+
+// newReadCache reads KV_READ_CONSISTENCY, the level of reads that don't ask for one, and
+// KV_READ_CACHE_IDLE, how long a bucket nobody reads eventually stays copied
+func newReadCache() (*readCache, error) {
+	consistency := getEnvOrDefault("KV_READ_CONSISTENCY", consistencyStrong)
+	if consistency != consistencyStrong && consistency != consistencyEventual {
+		return nil, fmt.Errorf("invalid KV_READ_CONSISTENCY %q, must be strong or eventual", consistency)
+	}
+	idle, err := time.ParseDuration(getEnvOrDefault("KV_READ_CACHE_IDLE", "10m"))
+	if err != nil || idle <= 0 {
+		return nil, fmt.Errorf("invalid KV_READ_CACHE_IDLE: must be a positive duration")
+	}
+	return &readCache{buckets: map[string]*cachedBucket{}, idle: idle, consistency: consistency}, nil
+}
+
+// readConsistency resolves the consistency a read asked for
+func (c *readCache) readConsistency(value string) (string, error) {
+	switch value {
+	case "":
+		return c.consistency, nil
+	case consistencyStrong, consistencyEventual:
+		return value, nil
+	case "cached":
+		return consistencyEventual, nil
+	}
+	return "", fmt.Errorf("invalid consistency %q, must be strong or eventual", value)
+}
+
+// cachedBucket returns the local copy of a bucket, starting to copy it if it isn't yet. Copies
+// that haven't received the current contents of the bucket yet can't serve reads.
+func (s *Server) cachedBucket(prefix string) (*cachedBucket, error) {
+	s.readCache.lock.Lock()
+	defer s.readCache.lock.Unlock()
+	if cached, ok := s.readCache.buckets[prefix]; ok {
+		cached.touch()
+		return cached, nil
+	}
+
+	bucket, err := s.getRawBucket(prefix)
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := s.shardBuckets(prefix, bucket, s.getRawBucket).WatchAll(nats.MetaOnly())
+	if err != nil {
+		return nil, err
+	}
+	cached := &cachedBucket{revisions: map[string]uint64{}, lastRead: time.Now(), watcher: watcher}
+	s.readCache.buckets[prefix] = cached
+	go s.feedCachedBucket(prefix, cached)
+	return cached, nil
+}
+
+// feedCachedBucket applies the changes of a bucket to its local copy until the watch stops
+func (s *Server) feedCachedBucket(prefix string, cached *cachedBucket) {
+	for entry := range cached.watcher.Updates() {
+		cached.lock.Lock()
+		switch {
+		case entry == nil:
+			cached.synced = true
+		case entry.Operation() == nats.KeyValuePut:
+			cached.revisions[entry.Key()] = entry.Revision()
+		default:
+			delete(cached.revisions, entry.Key())
+		}
+		cached.lock.Unlock()
+		if entry != nil {
+			s.hotKeys.invalidate(prefix, entry.Key(), entry.Revision())
+		}
+	}
+
+	// The watch failed or the copy was dropped, either way the next read starts over
+	s.readCache.lock.Lock()
+	if s.readCache.buckets[prefix] == cached {
+		delete(s.readCache.buckets, prefix)
+	}
+	s.readCache.lock.Unlock()
+	s.hotKeys.dropBucket(prefix)
+}
+
+func (c *cachedBucket) touch() {
+	c.lock.Lock()
+	c.lastRead = time.Now()
+	c.lock.Unlock()
+}
+
+// revision returns the latest revision of a key, 0 if it doesn't exist, and false if the
+// copy can't serve reads yet
+func (c *cachedBucket) revision(key string) (uint64, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.revisions[key], c.synced
+}
+
+// keys returns the cached keys in order, and false if the copy can't serve reads yet
+func (c *cachedBucket) keys() ([]string, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if !c.synced {
+		return nil, false
+	}
+	keys := make([]string, 0, len(c.revisions))
+	for key := range c.revisions {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys, true
+}
+
+// readEntry reads the latest entry of a key with the given consistency. Eventual reads of
+// hot keys are served from memory, and fall back to JetStream until the local copy of the
+// bucket is in sync.
+func (s *Server) readEntry(prefix, key, consistency string) (nats.KeyValueEntry, error) {
+	var revision uint64
+	var synced bool
+	if consistency == consistencyEventual {
+		cached, err := s.cachedBucket(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if revision, synced = cached.revision(key); synced {
+			if revision == 0 {
+				return nil, nats.ErrKeyNotFound
+			}
+			if entry, ok := s.hotKeys.get(prefix, key, revision); ok {
+				return entry, nil
+			}
+		}
+	}
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := bucket.Get(key)
+	if err == nil && synced {
+		s.hotKeys.add(prefix, key, entry)
+	}
+	return entry, err
+}
+
+// readKeys lists the keys of a bucket with the given consistency. A subject filter narrows
+// the keys a strong read lists, which the caller still has to match, as eventual reads and
+// keys outside the filter's tokens aren't narrowed.
+func (s *Server) readKeys(prefix, consistency, subject string) ([]string, error) {
+	if consistency == consistencyEventual {
+		cached, err := s.cachedBucket(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if keys, synced := cached.keys(); synced {
+			return keys, nil
+		}
+	}
+	if subject != "" {
+		return s.listKeysFiltered(prefix, subject)
+	}
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		return nil, err
+	}
+	lister, err := bucket.ListKeys()
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for key := range lister.Keys() {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// listKeysFiltered lists the keys of a bucket matching a subject filter. Only the matching
+// keys are sent by the server, so listing a few keys of a large bucket stays cheap.
+func (s *Server) listKeysFiltered(prefix, subject string) ([]string, error) {
+	bucket, err := s.getRawBucket(prefix)
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := s.shardBuckets(prefix, bucket, s.getRawBucket).Watch(subject, nats.MetaOnly(), nats.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	defer watcher.Stop()
+	var keys []string
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		keys = append(keys, entry.Key())
+	}
+	return keys, nil
+}
+
+// keySubjectFilter returns a subject filter covering the keys matchKey accepts for a prefix
+// and glob pattern, or "" when neither pins down a leading token. Only the tokens before
+// the first wildcard of the pattern and the complete tokens of the prefix are used, so the
+// filter can include keys that don't match but never leaves out one that does.
+func keySubjectFilter(prefix, pattern string) string {
+	// A pattern without wildcards matches a single key
+	if pattern != "" && !strings.ContainsAny(pattern, "*?[\\") && isSubjectTokens(pattern) {
+		return pattern
+	}
+
+	var tokens []string
+	for _, token := range strings.Split(pattern, ".") {
+		if !isSubjectTokens(token) || strings.ContainsAny(token, "*?[\\") {
+			break
+		}
+		tokens = append(tokens, token)
+	}
+	// The last token of a prefix can be the start of a longer one
+	if i := strings.LastIndex(prefix, "."); i > 0 && isSubjectTokens(prefix[:i]) {
+		if complete := strings.Split(prefix[:i], "."); len(complete) > len(tokens) {
+			tokens = complete
+		}
+	}
+	if len(tokens) == 0 {
+		return ""
+	}
+	return strings.Join(tokens, ".") + ".>"
+}
+
+// isSubjectTokens reports whether a string is a dot separated list of literal subject tokens
+func isSubjectTokens(value string) bool {
+	for _, token := range strings.Split(value, ".") {
+		if token == "" || strings.ContainsAny(token, "*> \t") {
+			return false
+		}
+	}
+	return true
+}
+
+// dropCachedBucket stops copying a bucket, so its next eventual read copies it afresh
+func (s *Server) dropCachedBucket(prefix string) {
+	s.readCache.lock.Lock()
+	cached, ok := s.readCache.buckets[prefix]
+	delete(s.readCache.buckets, prefix)
+	s.readCache.lock.Unlock()
+	if !ok {
+		return
+	}
+	s.hotKeys.dropBucket(prefix)
+	if err := cached.watcher.Stop(); err != nil {
+		log.Printf("Failed to stop the read cache of %s: %v", prefix, err)
+	}
+}
+
+// runReadCacheJanitor stops copying the buckets that haven't been read eventually for the
+// idle time
+func (s *Server) runReadCacheJanitor() {
+	ticker := time.NewTicker(s.readCache.idle / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.readCache.lock.Lock()
+		for prefix, cached := range s.readCache.buckets {
+			cached.lock.RLock()
+			idle := time.Since(cached.lastRead) > s.readCache.idle
+			cached.lock.RUnlock()
+			if idle {
+				delete(s.readCache.buckets, prefix)
+				s.hotKeys.dropBucket(prefix)
+				if err := cached.watcher.Stop(); err != nil {
+					log.Printf("Failed to stop the read cache of %s: %v", prefix, err)
+				}
+			}
+		}
+		s.readCache.lock.Unlock()
+	}
+}
+
+// setConsistencyHeader tells the client how consistent the data it was sent is
+func setConsistencyHeader(w http.ResponseWriter, consistency string) {
+	w.Header().Set("X-KV-Consistency", consistency)
+}
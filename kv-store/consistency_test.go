@@ -0,0 +1,78 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestReadConsistency(t *testing.T) {
+	c := &readCache{consistency: consistencyStrong}
+	for value, want := range map[string]string{
+		"":         consistencyStrong,
+		"strong":   consistencyStrong,
+		"eventual": consistencyEventual,
+		"cached":   consistencyEventual,
+	} {
+		if got, err := c.readConsistency(value); err != nil || got != want {
+			t.Errorf("readConsistency(%q) = %q, %v, want %q", value, got, err, want)
+		}
+	}
+	if _, err := c.readConsistency("linearizable"); err == nil {
+		t.Error("unknown consistency levels should be rejected")
+	}
+
+	t.Setenv("KV_READ_CONSISTENCY", "eventual")
+	c, err := newReadCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.readConsistency(""); got != consistencyEventual {
+		t.Errorf("default consistency = %q, want eventual", got)
+	}
+}
+
+func TestCachedBucket(t *testing.T) {
+	c := &cachedBucket{revisions: map[string]uint64{}}
+	if _, synced := c.revision("a"); synced {
+		t.Error("a copy that isn't in sync should not serve reads")
+	}
+	if _, synced := c.keys(); synced {
+		t.Error("a copy that isn't in sync should not list keys")
+	}
+
+	c.revisions["b"] = 2
+	c.revisions["a"] = 1
+	c.synced = true
+	if keys, _ := c.keys(); !slices.Equal(keys, []string{"a", "b"}) {
+		t.Errorf("keys = %v", keys)
+	}
+	if revision, synced := c.revision("c"); !synced || revision != 0 {
+		t.Errorf("revision of a missing key = %d, %v", revision, synced)
+	}
+}
+
+func TestKeySubjectFilter(t *testing.T) {
+	tests := []struct {
+		prefix, pattern string
+		want            string
+	}{
+		{"", "", ""},
+		{"output-", "", ""},
+		{"notes.", "", "notes.>"},
+		{"notes.2024", "", "notes.>"},
+		{"notes.2024.", "", "notes.2024.>"},
+		{"", "output-*", ""},
+		{"", "notes.*", "notes.>"},
+		{"", "notes.2024.*.md", "notes.2024.>"},
+		{"", "notes.todo", "notes.todo"},
+		{"notes.", "notes.2024.*", "notes.2024.>"},
+		{"notes.2024.06.", "notes.*", "notes.2024.06.>"},
+		{"", "a b.*", ""},
+		{"", `notes\*.x`, ""},
+	}
+	for _, tt := range tests {
+		if got := keySubjectFilter(tt.prefix, tt.pattern); got != tt.want {
+			t.Errorf("keySubjectFilter(%q, %q) = %q, want %q", tt.prefix, tt.pattern, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// CRDT types a key can be managed as
+const (
+	crdtCounter = "counter"
+	crdtGSet    = "gset"
+	crdtLWWMap  = "lwwmap"
+)
+
+type CRDTRequest struct {
+	Key     string      `json:"key"`
+	Type    string      `json:"type,omitempty"`
+	Delta   flexibleInt `json:"delta,omitempty"`
+	Add     stringList  `json:"add,omitempty"`
+	Set     jsonObject  `json:"set,omitempty"`
+	Remove  stringList  `json:"remove,omitempty"`
+	Replica string      `json:"replica,omitempty"`
+	State   *CRDTState  `json:"state,omitempty"`
+}
+
+// CRDTState is the replicated state of a CRDT key. Two states of the same key always merge
+// into the same result regardless of the order they are merged in.
+type CRDTState struct {
+	Type string `json:"type"`
+	// Inc and Dec hold the increments and decrements of a counter per replica
+	Inc map[string]int64 `json:"inc,omitempty"`
+	Dec map[string]int64 `json:"dec,omitempty"`
+	// Items holds the sorted members of a grow-only set
+	Items []string `json:"items,omitempty"`
+	// Fields holds the registers of a last-writer-wins map
+	Fields map[string]lwwRegister `json:"fields,omitempty"`
+}
+
+// lwwRegister is a map field. Concurrent writes are ordered by time, then by replica.
+type lwwRegister struct {
+	Value   json.RawMessage `json:"value,omitempty"`
+	Time    int64           `json:"time"`
+	Replica string          `json:"replica"`
+	Deleted bool            `json:"deleted,omitempty"`
+}
+
+type CRDTResult struct {
+	Key   string     `json:"key"`
+	Type  string     `json:"type"`
+	Value string     `json:"value"`
+	State *CRDTState `json:"state,omitempty"`
+}
+
+// crdtLocks serializes updates of the same key within this server, so the value written to
+// the data bucket always reflects the latest merged state
+var crdtLocks [64]sync.Mutex
+
+func crdtLock(bucket, key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(bucket + "/" + key))
+	return &crdtLocks[h.Sum32()%uint32(len(crdtLocks))]
+}
+
+// getReplicaID returns the replica name CRDT updates of this server are recorded under
+func getReplicaID() string {
+	if id := getEnvOrDefault("KV_REPLICA_ID", ""); id != "" {
+		return id
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		return hostname
+	}
+	return "kv-store"
+}
+
+// after reports whether the register wins over other
+func (r lwwRegister) after(other lwwRegister) bool {
+	if r.Time != other.Time {
+		return r.Time > other.Time
+	}
+	return r.Replica > other.Replica
+}
+
+// merge merges another state of the same type into the state
+func (c *CRDTState) merge(other *CRDTState) error {
+	if other.Type != c.Type {
+		return fmt.Errorf("cannot merge a %s into a %s", other.Type, c.Type)
+	}
+	switch c.Type {
+	case crdtCounter:
+		c.Inc = mergeMax(c.Inc, other.Inc)
+		c.Dec = mergeMax(c.Dec, other.Dec)
+	case crdtGSet:
+		items := append(slices.Clone(c.Items), other.Items...)
+		slices.Sort(items)
+		c.Items = slices.Compact(items)
+	case crdtLWWMap:
+		if c.Fields == nil {
+			c.Fields = map[string]lwwRegister{}
+		}
+		for field, register := range other.Fields {
+			if current, ok := c.Fields[field]; !ok || register.after(current) {
+				c.Fields[field] = register
+			}
+		}
+	default:
+		return fmt.Errorf("unknown CRDT type %s, must be counter, gset or lwwmap", c.Type)
+	}
+	return nil
+}
+
+// mergeMax merges per replica counts by keeping the larger count of each replica
+func mergeMax(a, b map[string]int64) map[string]int64 {
+	if len(a) == 0 && len(b) == 0 {
+		return nil
+	}
+	merged := map[string]int64{}
+	for replica, n := range a {
+		merged[replica] = n
+	}
+	for replica, n := range b {
+		merged[replica] = max(merged[replica], n)
+	}
+	return merged
+}
+
+// value renders the state as the plain value stored under the key: the total of a
+// counter, a JSON array of set members or a JSON object of map fields
+func (c *CRDTState) value() (string, error) {
+	switch c.Type {
+	case crdtCounter:
+		var total int64
+		for _, n := range c.Inc {
+			total += n
+		}
+		for _, n := range c.Dec {
+			total -= n
+		}
+		return strconv.FormatInt(total, 10), nil
+	case crdtGSet:
+		items := c.Items
+		if items == nil {
+			items = []string{}
+		}
+		data, err := json.Marshal(items)
+		return string(data), err
+	case crdtLWWMap:
+		fields := map[string]json.RawMessage{}
+		for field, register := range c.Fields {
+			if !register.Deleted {
+				fields[field] = register.Value
+			}
+		}
+		data, err := json.Marshal(fields)
+		return string(data), err
+	}
+	return "", fmt.Errorf("unknown CRDT type %s", c.Type)
+}
+
+// apply turns the operations of a request into a state to merge into current
+func (req *CRDTRequest) apply(current *CRDTState, replica string) (*CRDTState, error) {
+	delta := &CRDTState{Type: current.Type}
+	if req.State != nil {
+		delta = req.State
+	}
+
+	switch current.Type {
+	case crdtCounter:
+		if len(req.Add) > 0 || len(req.Set) > 0 || len(req.Remove) > 0 {
+			return nil, fmt.Errorf("counters only support delta")
+		}
+		if req.Delta > 0 {
+			delta.Inc = mergeMax(delta.Inc, map[string]int64{replica: current.Inc[replica] + int64(req.Delta)})
+		} else if req.Delta < 0 {
+			delta.Dec = mergeMax(delta.Dec, map[string]int64{replica: current.Dec[replica] - int64(req.Delta)})
+		}
+	case crdtGSet:
+		if req.Delta != 0 || len(req.Set) > 0 || len(req.Remove) > 0 {
+			return nil, fmt.Errorf("grow-only sets only support add")
+		}
+		delta.Items = append(delta.Items, req.Add...)
+	case crdtLWWMap:
+		if req.Delta != 0 || len(req.Add) > 0 {
+			return nil, fmt.Errorf("last-writer-wins maps only support set and remove")
+		}
+		if delta.Fields == nil {
+			delta.Fields = map[string]lwwRegister{}
+		}
+		write := func(field string, register lwwRegister) {
+			// Make sure a write always wins over the value it replaces, even if clocks drift
+			if current, ok := current.Fields[field]; ok && register.Time <= current.Time {
+				register.Time = current.Time + 1
+			}
+			delta.Fields[field] = register
+		}
+		now := time.Now().UnixNano()
+		for field, value := range req.Set {
+			if !json.Valid(value) {
+				return nil, fmt.Errorf("value of %s is not valid JSON", field)
+			}
+			write(field, lwwRegister{Value: value, Time: now, Replica: replica})
+		}
+		for _, field := range req.Remove {
+			write(field, lwwRegister{Time: now, Replica: replica, Deleted: true})
+		}
+	}
+	return delta, nil
+}
+
+// getCRDTBucket gets the bucket holding the CRDT states of the keys in a data bucket
+func (s *Server) getCRDTBucket(prefix string) (nats.KeyValue, error) {
+	return s.getBucket(prefix + "-crdt")
+}
+
+// loadCRDTState reads the state of a key and its revision, returning nil and revision 0
+// when the key is not managed as a CRDT
+func loadCRDTState(bucket nats.KeyValue, key string) (*CRDTState, uint64, error) {
+	entry, err := bucket.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var state CRDTState
+	if err := json.Unmarshal(entry.Value(), &state); err != nil {
+		return nil, 0, fmt.Errorf("invalid CRDT state of %s: %v", key, err)
+	}
+	return &state, entry.Revision(), nil
+}
+
+// handleCRDTUpdate applies an update to a key managed as a CRDT. Concurrent updates from
+// different agents are merged instead of overwriting each other, and the merged value is
+// written to the key so it can be read with get like any other key. The first update of
+// a key sets its type. Passing state merges the full state of another replica.
+func (s *Server) handleCRDTUpdate(w http.ResponseWriter, r *http.Request) {
+	var req CRDTRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+
+	if req.Key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "key is required"})
+		return
+	}
+	if req.State != nil && req.Type != "" && req.State.Type != req.Type {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "type does not match the type of state"})
+		return
+	}
+	if req.State != nil {
+		req.Type = req.State.Type
+	}
+	replica := req.Replica
+	if replica == "" {
+		replica = s.replicaID
+	}
+
+	if !s.checkKeyAccess(w, r, req.Key, permWrite) {
+		return
+	}
+
+	// Get the bucket for this request
+	prefix := s.getDataPrefix(r, false)
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	states, err := s.getCRDTBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	lock := crdtLock(prefix, req.Key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	for attempt := 0; attempt < incrMaxAttempts; attempt++ {
+		current, revision, err := loadCRDTState(states, req.Key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		if current == nil {
+			if req.Type == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "type is required for the first update of a key"})
+				return
+			}
+			current = &CRDTState{Type: req.Type}
+		}
+		if req.Type != "" && req.Type != current.Type {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("%s is a %s", req.Key, current.Type)})
+			return
+		}
+
+		delta, err := req.apply(current, replica)
+		if err == nil {
+			err = current.merge(delta)
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		value, err := current.value()
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		data, err := json.Marshal(current)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+
+		// Only write if no other server changed the state since it was read
+		if revision == 0 {
+			_, err = states.Create(req.Key, data)
+		} else {
+			_, err = states.Update(req.Key, data, revision)
+		}
+		if isRevisionConflict(err) {
+			continue
+		}
+		if err == nil {
+			_, err = bucket.Put(req.Key, []byte(value))
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+
+		s.access.record(prefix, req.Key, true)
+		json.NewEncoder(w).Encode(KVResponse{Success: true, Data: CRDTResult{Key: req.Key, Type: current.Type, Value: value}})
+		return
+	}
+
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("%s is changing too often, try again", req.Key)})
+}
+
+// handleCRDTGet returns the value and full state of a CRDT key, e.g. to merge it into
+// another replica
+func (s *Server) handleCRDTGet(w http.ResponseWriter, r *http.Request) {
+	var req CRDTRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	if req.Key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "key is required"})
+		return
+	}
+
+	if !s.checkKeyAccess(w, r, req.Key, permRead) {
+		return
+	}
+
+	states, err := s.getCRDTBucket(s.getDataPrefix(r, false))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	state, _, err := loadCRDTState(states, req.Key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if state == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("%s is not a CRDT key", req.Key)})
+		return
+	}
+	value, err := state.value()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: CRDTResult{Key: req.Key, Type: state.Type, Value: value, State: state}})
+}
+
+// handleCRDTDelete deletes a CRDT key together with its state. A plain delete only
+// removes the value, which the next update would bring back.
+func (s *Server) handleCRDTDelete(w http.ResponseWriter, r *http.Request) {
+	var req CRDTRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	if req.Key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "key is required"})
+		return
+	}
+
+	if !s.checkKeyAccess(w, r, req.Key, permDelete) {
+		return
+	}
+
+	prefix := s.getDataPrefix(r, false)
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	states, err := s.getCRDTBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	lock := crdtLock(prefix, req.Key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := states.Purge(req.Key); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if err := bucket.Delete(req.Key); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	s.deleteKeyStats(prefix, req.Key)
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCRDTMergeConverges(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b *CRDTState
+		want string
+	}{
+		{
+			name: "counter",
+			a:    &CRDTState{Type: crdtCounter, Inc: map[string]int64{"r1": 5, "r2": 1}, Dec: map[string]int64{"r1": 2}},
+			b:    &CRDTState{Type: crdtCounter, Inc: map[string]int64{"r1": 3, "r2": 4}},
+			want: "7",
+		},
+		{
+			name: "grow-only set",
+			a:    &CRDTState{Type: crdtGSet, Items: []string{"b", "a"}},
+			b:    &CRDTState{Type: crdtGSet, Items: []string{"c", "a"}},
+			want: `["a","b","c"]`,
+		},
+		{
+			name: "last-writer-wins map",
+			a: &CRDTState{Type: crdtLWWMap, Fields: map[string]lwwRegister{
+				"x": {Value: json.RawMessage(`1`), Time: 10, Replica: "r1"},
+				"y": {Value: json.RawMessage(`"old"`), Time: 10, Replica: "r1"},
+				"z": {Value: json.RawMessage(`true`), Time: 5, Replica: "r1"},
+			}},
+			b: &CRDTState{Type: crdtLWWMap, Fields: map[string]lwwRegister{
+				"x": {Value: json.RawMessage(`2`), Time: 10, Replica: "r2"},
+				"y": {Value: json.RawMessage(`"new"`), Time: 11, Replica: "r0"},
+				"z": {Time: 6, Replica: "r2", Deleted: true},
+			}},
+			want: `{"x":2,"y":"new"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, order := range [][2]*CRDTState{{tt.a, tt.b}, {tt.b, tt.a}} {
+				data, _ := json.Marshal(order[0])
+				var merged CRDTState
+				json.Unmarshal(data, &merged)
+				if err := merged.merge(order[1]); err != nil {
+					t.Fatalf("merge: %v", err)
+				}
+				// Merging the same state again must not change anything
+				if err := merged.merge(order[1]); err != nil {
+					t.Fatalf("merge: %v", err)
+				}
+				if got, _ := merged.value(); got != tt.want {
+					t.Errorf("value = %s, want %s", got, tt.want)
+				}
+			}
+		})
+	}
+
+	if err := (&CRDTState{Type: crdtCounter}).merge(&CRDTState{Type: crdtGSet}); err == nil {
+		t.Errorf("merging different types should fail")
+	}
+}
+
+func TestCRDTApply(t *testing.T) {
+	counter := &CRDTState{Type: crdtCounter, Inc: map[string]int64{"r1": 5}}
+	for _, delta := range []flexibleInt{3, -2} {
+		update, err := (&CRDTRequest{Delta: delta}).apply(counter, "r1")
+		if err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+		counter.merge(update)
+	}
+	if got, _ := counter.value(); got != "6" {
+		t.Errorf("counter = %s, want 6", got)
+	}
+
+	m := &CRDTState{Type: crdtLWWMap, Fields: map[string]lwwRegister{"a": {Value: json.RawMessage(`1`), Time: 1 << 62, Replica: "r9"}}}
+	update, err := (&CRDTRequest{Set: jsonObject{"a": json.RawMessage(`2`)}}).apply(m, "r1")
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	m.merge(update)
+	if got, _ := m.value(); got != `{"a":2}` {
+		t.Errorf("a write must win over the value it replaces even with a clock behind, got %s", got)
+	}
+
+	if _, err := (&CRDTRequest{Add: stringList{"x"}}).apply(&CRDTState{Type: crdtCounter}, "r1"); err == nil {
+		t.Errorf("adding items to a counter should fail")
+	}
+	if _, err := (&CRDTRequest{Set: jsonObject{"a": json.RawMessage(`nope`)}}).apply(&CRDTState{Type: crdtLWWMap}, "r1"); err == nil {
+		t.Errorf("invalid JSON values should fail")
+	}
+}
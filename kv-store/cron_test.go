@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2024, 1, 15, 10, 30, 20, 0, time.UTC) // a Monday
+
+	tests := []struct {
+		spec string
+		want time.Time
+	}{
+		{spec: "* * * * *", want: time.Date(2024, 1, 15, 10, 31, 0, 0, time.UTC)},
+		{spec: "*/15 * * * *", want: time.Date(2024, 1, 15, 10, 45, 0, 0, time.UTC)},
+		{spec: "0 3 * * *", want: time.Date(2024, 1, 16, 3, 0, 0, 0, time.UTC)},
+		{spec: "30 10 * * *", want: time.Date(2024, 1, 16, 10, 30, 0, 0, time.UTC)},
+		{spec: "0 0 1 * *", want: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{spec: "0 12 * * 0", want: time.Date(2024, 1, 21, 12, 0, 0, 0, time.UTC)},
+		{spec: "0 12 * * 7", want: time.Date(2024, 1, 21, 12, 0, 0, 0, time.UTC)},
+		{spec: "0 9 * * 1-5", want: time.Date(2024, 1, 16, 9, 0, 0, 0, time.UTC)},
+		{spec: "0 0 29 2 *", want: time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Both day fields restricted: either may match
+		{spec: "0 0 20 * 3", want: time.Date(2024, 1, 17, 0, 0, 0, 0, time.UTC)},
+		{spec: "0,30 8-9 * 6 *", want: time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		schedule, err := parseCron(tt.spec)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.spec, err)
+			continue
+		}
+		if got := schedule.next(from); !got.Equal(tt.want) {
+			t.Errorf("%q: next = %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("%q should be rejected", spec)
+		}
+	}
+}
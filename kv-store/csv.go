@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxImportRows bounds the rows of a single CSV import
+const maxImportRows = 10000
+
+type CSVExportRequest struct {
+	Prefix string `json:"prefix,omitempty"`
+	// Pattern is a glob keys must match, such as config-*
+	Pattern string `json:"pattern,omitempty"`
+	// Exclude are globs of keys to leave out, such as output-*
+	Exclude stringList `json:"exclude,omitempty"`
+	Scope   string     `json:"scope,omitempty"`
+	// Expand spreads values holding JSON objects over one column per field
+	Expand flexibleBool `json:"expand,omitempty"`
+}
+
+type CSVImportRequest struct {
+	CSV string `json:"csv"`
+	// KeyColumn is the header name or 1-based number of the column holding the keys, the
+	// first column by default
+	KeyColumn string `json:"key_column,omitempty"`
+	// ValueColumns are the columns making up the values, every other column by default. A
+	// single column is stored as is, several as a JSON object keyed by column name.
+	ValueColumns stringList   `json:"value_columns,omitempty"`
+	KeyPrefix    string       `json:"key_prefix,omitempty"`
+	NoHeader     flexibleBool `json:"no_header,omitempty"`
+	Scope        string       `json:"scope,omitempty"`
+	DryRun       flexibleBool `json:"dry_run,omitempty"`
+}
+
+type CSVImportResult struct {
+	Imported int      `json:"imported"`
+	Keys     []string `json:"keys,omitempty"`
+	// Skipped are the rows without a key or value, numbered as in the file
+	Skipped []int `json:"skipped,omitempty"`
+	DryRun  bool  `json:"dry_run,omitempty"`
+}
+
+// csvEntry is a key and value read from an imported row
+type csvEntry struct {
+	key   string
+	value string
+}
+
+// findColumn resolves a column given by header name or 1-based number
+func findColumn(header []string, width int, spec string) (int, error) {
+	if n, err := strconv.Atoi(spec); err == nil {
+		if n < 1 || n > width {
+			return 0, fmt.Errorf("column %d is out of range, the file has %d columns", n, width)
+		}
+		return n - 1, nil
+	}
+	if i := slices.Index(header, spec); i >= 0 {
+		return i, nil
+	}
+	if header == nil {
+		return 0, fmt.Errorf("column %q must be a number when the file has no header", spec)
+	}
+	return 0, fmt.Errorf("column %q is not in the header", spec)
+}
+
+// parseCSVImport maps the rows of a CSV file to keys and values. Rows without a key or
+// value are skipped and reported by their line number, and a key may only appear once.
+func parseCSVImport(data string, req CSVImportRequest) ([]csvEntry, []int, error) {
+	reader := csv.NewReader(strings.NewReader(data))
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CSV: %v", err)
+	}
+	if len(records) == 0 {
+		return nil, nil, fmt.Errorf("the CSV file is empty")
+	}
+
+	var header []string
+	width, first := len(records[0]), 1
+	if !req.NoHeader {
+		header, records, first = records[0], records[1:], 2
+	}
+	if len(records) > maxImportRows {
+		return nil, nil, fmt.Errorf("the CSV file has %d rows, at most %d can be imported at once", len(records), maxImportRows)
+	}
+
+	keyColumn := 0
+	if req.KeyColumn != "" {
+		if keyColumn, err = findColumn(header, width, req.KeyColumn); err != nil {
+			return nil, nil, err
+		}
+	}
+	var valueColumns []int
+	for _, spec := range req.ValueColumns {
+		column, err := findColumn(header, width, spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		valueColumns = append(valueColumns, column)
+	}
+	if len(valueColumns) == 0 {
+		for i := range width {
+			if i != keyColumn {
+				valueColumns = append(valueColumns, i)
+			}
+		}
+	}
+	if len(valueColumns) == 0 {
+		return nil, nil, fmt.Errorf("the CSV file has no value columns")
+	}
+	names := make([]string, len(valueColumns))
+	for i, column := range valueColumns {
+		names[i] = strconv.Itoa(column + 1)
+		if header != nil {
+			names[i] = header[column]
+		}
+	}
+
+	var entries []csvEntry
+	var skipped []int
+	seen := map[string]int{}
+	for i, record := range records {
+		line := first + i
+		key := req.KeyPrefix + strings.TrimSpace(record[keyColumn])
+		if key == req.KeyPrefix {
+			skipped = append(skipped, line)
+			continue
+		}
+		if previous, ok := seen[key]; ok {
+			return nil, nil, fmt.Errorf("row %d: key %s is already set by row %d", line, key, previous)
+		}
+
+		var value string
+		if len(valueColumns) == 1 {
+			value = record[valueColumns[0]]
+		} else {
+			fields := make(map[string]string, len(valueColumns))
+			for j, column := range valueColumns {
+				fields[names[j]] = record[column]
+			}
+			encoded, err := json.Marshal(fields)
+			if err != nil {
+				return nil, nil, err
+			}
+			value = string(encoded)
+		}
+		if value == "" {
+			skipped = append(skipped, line)
+			continue
+		}
+		seen[key] = line
+		entries = append(entries, csvEntry{key: key, value: value})
+	}
+	return entries, skipped, nil
+}
+
+// writeCSVExport writes keys and values as CSV. Expanded exports spread values holding JSON
+// objects over one column per field, so they import back with the same columns.
+func writeCSVExport(w io.Writer, entries []csvEntry, expand bool) error {
+	writer := csv.NewWriter(w)
+	var fields []string
+	objects := make([]map[string]any, len(entries))
+	if expand {
+		for i, entry := range entries {
+			if json.Unmarshal([]byte(entry.value), &objects[i]) != nil {
+				objects[i] = nil
+				continue
+			}
+			for field := range objects[i] {
+				if !slices.Contains(fields, field) {
+					fields = append(fields, field)
+				}
+			}
+		}
+		slices.Sort(fields)
+	}
+
+	header := []string{"key"}
+	if len(fields) > 0 {
+		header = append(header, fields...)
+	} else {
+		header = append(header, "value")
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		record := []string{entry.key}
+		switch {
+		case len(fields) == 0:
+			record = append(record, entry.value)
+		case objects[i] == nil:
+			// Values that aren't objects can't be spread, so they stay whole in the first column
+			record = append(record, entry.value)
+			record = append(record, make([]string, len(fields)-1)...)
+		default:
+			for _, field := range fields {
+				record = append(record, csvCell(objects[i][field]))
+			}
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// csvCell formats a JSON field for a spreadsheet cell, strings without their quotes
+func csvCell(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	default:
+		encoded, _ := json.Marshal(value)
+		return string(encoded)
+	}
+}
+
+// exportFilter returns whether a key is exported, checking the patterns of the request are
+// valid globs
+func (req *CSVExportRequest) exportFilter() (func(key string) bool, error) {
+	for _, pattern := range append([]string{req.Pattern}, req.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	return func(key string) bool {
+		if !matchKey(key, req.Prefix, req.Pattern) {
+			return false
+		}
+		for _, pattern := range req.Exclude {
+			if ok, _ := path.Match(pattern, key); ok {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// handleCSVExport returns the keys starting with a prefix and matching the patterns of the
+// request and their values as CSV, each key once as reads see it
+func (s *Server) handleCSVExport(w http.ResponseWriter, r *http.Request) {
+	var req CSVExportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+	exported, err := req.exportFilter()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	prefixes, err := s.getReadPrefixes(r, req.Scope)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	canRead := s.readFilter(r)
+	entries := make([]csvEntry, 0)
+	seen := map[string]bool{}
+	for _, prefix := range prefixes {
+		bucket, err := s.getBucket(prefix)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		keys, err := bucket.ListKeys()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		for key := range keys.Keys() {
+			if seen[key] || !exported(key) || !canRead(key) {
+				continue
+			}
+			seen[key] = true
+			entry, err := bucket.Get(key)
+			if err != nil {
+				// The key was deleted since it was listed
+				continue
+			}
+			entries = append(entries, csvEntry{key: key, value: string(entry.Value())})
+		}
+	}
+	slices.SortFunc(entries, func(a, b csvEntry) int { return strings.Compare(a.key, b.key) })
+
+	var out bytes.Buffer
+	if err := writeCSVExport(&out, entries, bool(req.Expand)); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="export.csv"`)
+	w.Write(out.Bytes())
+}
+
+// decodeCSVImport reads an import request. The CSV file can be uploaded as is with a text/csv
+// content type and the options as query parameters, or inline in a JSON request.
+func decodeCSVImport(r *http.Request) (CSVImportRequest, error) {
+	var req CSVImportRequest
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "text/csv" {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			return req, err
+		}
+		query := r.URL.Query()
+		req.CSV = string(data)
+		req.KeyColumn = query.Get("key_column")
+		if columns := query.Get("value_columns"); columns != "" {
+			req.ValueColumns = strings.Split(columns, ",")
+		}
+		req.KeyPrefix = query.Get("key_prefix")
+		req.Scope = query.Get("scope")
+		noHeader, _ := strconv.ParseBool(query.Get("no_header"))
+		dryRun, _ := strconv.ParseBool(query.Get("dry_run"))
+		req.NoHeader, req.DryRun = flexibleBool(noHeader), flexibleBool(dryRun)
+		return req, nil
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&req)
+	return req, err
+}
+
+// handleCSVImport stores a key for every row of a CSV file. The caller must be allowed to
+// write all of them and none may be rejected for PII, so a file is never partially
+// imported because of ACLs or policies. A dry run only reports the keys that would be set.
+func (s *Server) handleCSVImport(w http.ResponseWriter, r *http.Request) {
+	req, err := decodeCSVImport(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+	entries, skipped, err := parseCSVImport(req.CSV, req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	for _, entry := range entries {
+		if !s.checkKeyAccess(w, r, entry.key, permWrite) {
+			return
+		}
+	}
+	prefix, ok := s.getWritePrefix(w, r, req.Scope)
+	if !ok {
+		return
+	}
+
+	keys := make([]string, len(entries))
+	for i := range entries {
+		keys[i] = entries[i].key
+	}
+	if req.DryRun {
+		json.NewEncoder(w).Encode(KVResponse{Success: true, Data: CSVImportResult{Imported: len(entries), Keys: keys, Skipped: skipped, DryRun: true}})
+		return
+	}
+
+	for i := range entries {
+		if entries[i].value, ok = s.checkPII(w, r, entries[i].key, entries[i].value); !ok {
+			return
+		}
+	}
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	for i, entry := range entries {
+		if _, err := bucket.Put(entry.key, []byte(entry.value)); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("imported %d of %d keys, failed to put %s: %v", i, len(entries), entry.key, err)})
+			return
+		}
+		s.access.record(prefix, entry.key, true)
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: CSVImportResult{Imported: len(entries), Skipped: skipped}})
+}
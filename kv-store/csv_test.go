@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+func TestParseCSVImport(t *testing.T) {
+	data := "name,email,plan\nalice,alice@example.com,pro\n,nobody@example.com,free\nbob,,\n"
+
+	entries, skipped, err := parseCSVImport(data, CSVImportRequest{KeyColumn: "name", ValueColumns: stringList{"email"}, KeyPrefix: "users/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []csvEntry{{"users/alice", "alice@example.com"}}; !slices.Equal(entries, want) {
+		t.Errorf("entries = %v, want %v", entries, want)
+	}
+	if want := []int{3, 4}; !slices.Equal(skipped, want) {
+		t.Errorf("skipped = %v, want %v", skipped, want)
+	}
+
+	entries, _, err = parseCSVImport(data, CSVImportRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"email":"alice@example.com","plan":"pro"}`; len(entries) != 2 || entries[0].value != want {
+		t.Errorf("entries = %v, want alice = %s", entries, want)
+	}
+
+	entries, _, err = parseCSVImport("a,1\nb,2\n", CSVImportRequest{NoHeader: true, KeyColumn: "2", ValueColumns: stringList{"1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []csvEntry{{"1", "a"}, {"2", "b"}}; !slices.Equal(entries, want) {
+		t.Errorf("entries = %v, want %v", entries, want)
+	}
+
+	for _, invalid := range []struct {
+		data string
+		req  CSVImportRequest
+	}{
+		{"", CSVImportRequest{}},
+		{"key,value\na,1\na,2\n", CSVImportRequest{}},
+		{"key,value\na,1\n", CSVImportRequest{KeyColumn: "id"}},
+		{"key,value\na,1\n", CSVImportRequest{KeyColumn: "3"}},
+		{"a,1\n", CSVImportRequest{NoHeader: true, KeyColumn: "key"}},
+		{"key\na\n", CSVImportRequest{}},
+		{"key,value\na,1,2\n", CSVImportRequest{}},
+	} {
+		if _, _, err := parseCSVImport(invalid.data, invalid.req); err == nil {
+			t.Errorf("parseCSVImport(%q, %+v) should fail", invalid.data, invalid.req)
+		}
+	}
+}
+
+func TestWriteCSVExport(t *testing.T) {
+	entries := []csvEntry{{"a", `{"plan":"pro","seats":3}`}, {"b", "plain, text"}}
+
+	var out bytes.Buffer
+	if err := writeCSVExport(&out, entries, false); err != nil {
+		t.Fatal(err)
+	}
+	if want := "key,value\na,\"{\"\"plan\"\":\"\"pro\"\",\"\"seats\"\":3}\"\nb,\"plain, text\"\n"; out.String() != want {
+		t.Errorf("export = %q, want %q", out.String(), want)
+	}
+
+	out.Reset()
+	if err := writeCSVExport(&out, entries, true); err != nil {
+		t.Fatal(err)
+	}
+	if want := "key,plan,seats\na,pro,3\nb,\"plain, text\",\n"; out.String() != want {
+		t.Errorf("expanded export = %q, want %q", out.String(), want)
+	}
+}
+
+func TestExportFilter(t *testing.T) {
+	req := CSVExportRequest{Prefix: "task-", Exclude: stringList{"task-*-output", "task-tmp*"}}
+	exported, err := req.exportFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{
+		"task-1-config": true,
+		"task-1-output": false,
+		"task-tmp1":     false,
+		"config":        false,
+	} {
+		if exported(key) != want {
+			t.Errorf("exported(%q) = %v", key, !want)
+		}
+	}
+
+	req = CSVExportRequest{Exclude: stringList{"output-["}}
+	if _, err := req.exportFilter(); err == nil {
+		t.Error("an invalid exclude pattern should be rejected")
+	}
+}
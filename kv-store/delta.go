@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strconv"
+
+	"github.com/nats-io/nats.go"
+)
+
+// deltaValuePrefix marks values stored as a change of an earlier revision of their key.
+// Delta values are the prefix, the revision they change, their distance from the last
+// revision stored in full, and the edits, all but the edits as uvarints. Like encrypted
+// values the prefix starts with a NUL byte so it never collides with text values.
+var deltaValuePrefix = []byte("\x00kvdelta1\x00")
+
+// deltaBlockSize is the length of the runs of bytes matched between revisions
+const deltaBlockSize = 16
+
+// Delta edits are a uvarint of the edit's length shifted left by one, with the low bit set
+// for copies. Inserts are followed by the inserted bytes, copies by the offset they copy
+// from in the base revision.
+const (
+	deltaInsert = 0
+	deltaCopy   = 1
+)
+
+// deltaEncoder stores new revisions of large values as changes of the previous revision,
+// so documents that are updated often don't keep many full copies in their history
+type deltaEncoder struct {
+	snapshotInterval int
+	minSize          int
+}
+
+// newDeltaEncoder enables delta encoding with KV_DELTA_ENCODING=on. A full revision is
+// stored every KV_DELTA_SNAPSHOT_INTERVAL revisions, and only values of at least
+// KV_DELTA_MIN_SIZE bytes are encoded. It returns nil when every revision is stored in full.
+func newDeltaEncoder() (*deltaEncoder, error) {
+	mode := getEnvOrDefault("KV_DELTA_ENCODING", "off")
+	if mode != "off" && mode != "on" {
+		return nil, fmt.Errorf("invalid KV_DELTA_ENCODING %q, must be off or on", mode)
+	}
+	interval, err := strconv.Atoi(getEnvOrDefault("KV_DELTA_SNAPSHOT_INTERVAL", "10"))
+	if err != nil || interval < 2 {
+		return nil, fmt.Errorf("invalid KV_DELTA_SNAPSHOT_INTERVAL: must be a number of revisions of at least 2")
+	}
+	minSize, err := strconv.Atoi(getEnvOrDefault("KV_DELTA_MIN_SIZE", "1024"))
+	if err != nil || minSize < 0 {
+		return nil, fmt.Errorf("invalid KV_DELTA_MIN_SIZE: must be a number of bytes")
+	}
+	if mode == "off" {
+		return nil, nil
+	}
+	return &deltaEncoder{snapshotInterval: interval, minSize: minSize}, nil
+}
+
+// checkHistory rejects delta encoding when no key keeps the revision a change would be
+// stored against, which makes it a no-op, and warns when only some keys do
+func (d *deltaEncoder) checkHistory(history uint8, rules []historyRule) error {
+	if d == nil {
+		return nil
+	}
+	deepest := history
+	for _, rule := range rules {
+		deepest = max(deepest, rule.history)
+	}
+	if deepest < 2 {
+		return fmt.Errorf("KV_DELTA_ENCODING=on needs KV_HISTORY or a KV_HISTORY_RULES entry of at least 2, as changes are stored against the previous revision of a key")
+	}
+	if history < 2 {
+		log.Printf("Warning: KV_HISTORY=%d, so only keys with a KV_HISTORY_RULES entry of at least 2 are delta encoded", history)
+	}
+	return nil
+}
+
+func isDeltaValue(value []byte) bool {
+	return bytes.HasPrefix(value, deltaValuePrefix)
+}
+
+// encodeDelta builds a delta value from the revision it changes, its distance from the
+// last full revision and its edits
+func encodeDelta(base, depth uint64, edits []byte) []byte {
+	value := append([]byte{}, deltaValuePrefix...)
+	value = binary.AppendUvarint(value, base)
+	value = binary.AppendUvarint(value, depth)
+	return append(value, edits...)
+}
+
+// parseDelta returns the base revision, depth and edits of a delta value
+func parseDelta(value []byte) (base, depth uint64, edits []byte, err error) {
+	rest := bytes.TrimPrefix(value, deltaValuePrefix)
+	base, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return 0, 0, nil, fmt.Errorf("invalid delta value")
+	}
+	rest = rest[n:]
+	depth, n = binary.Uvarint(rest)
+	if n <= 0 {
+		return 0, 0, nil, fmt.Errorf("invalid delta value")
+	}
+	return base, depth, rest[n:], nil
+}
+
+func appendDeltaInsert(edits, data []byte) []byte {
+	if len(data) == 0 {
+		return edits
+	}
+	edits = binary.AppendUvarint(edits, uint64(len(data))<<1|deltaInsert)
+	return append(edits, data...)
+}
+
+func appendDeltaCopy(edits []byte, offset, length int) []byte {
+	edits = binary.AppendUvarint(edits, uint64(length)<<1|deltaCopy)
+	return binary.AppendUvarint(edits, uint64(offset))
+}
+
+// diffValues returns the edits turning base into target: runs of target found in base are
+// copied and everything else is inserted
+func diffValues(base, target []byte) []byte {
+	index := make(map[string]int, len(base)/deltaBlockSize)
+	for i := 0; i+deltaBlockSize <= len(base); i += deltaBlockSize {
+		if _, ok := index[string(base[i:i+deltaBlockSize])]; !ok {
+			index[string(base[i:i+deltaBlockSize])] = i
+		}
+	}
+
+	var edits []byte
+	pending, i := 0, 0
+	for i+deltaBlockSize <= len(target) {
+		offset, ok := index[string(target[i:i+deltaBlockSize])]
+		if !ok {
+			i++
+			continue
+		}
+		// Grow the match over the bytes around the block that are the same too
+		start := i
+		for start > pending && offset > 0 && base[offset-1] == target[start-1] {
+			start--
+			offset--
+		}
+		end := i + deltaBlockSize
+		for end < len(target) && offset+end-start < len(base) && target[end] == base[offset+end-start] {
+			end++
+		}
+		edits = appendDeltaInsert(edits, target[pending:start])
+		edits = appendDeltaCopy(edits, offset, end-start)
+		i, pending = end, end
+	}
+	return appendDeltaInsert(edits, target[pending:])
+}
+
+// applyDelta applies edits to the base revision they were made against
+func applyDelta(base, edits []byte) ([]byte, error) {
+	var value []byte
+	for len(edits) > 0 {
+		header, n := binary.Uvarint(edits)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid delta edit")
+		}
+		edits = edits[n:]
+		length := header >> 1
+		if header&1 == deltaInsert {
+			if length > uint64(len(edits)) {
+				return nil, fmt.Errorf("delta insert of %d bytes is truncated", length)
+			}
+			value = append(value, edits[:length]...)
+			edits = edits[length:]
+			continue
+		}
+		offset, n := binary.Uvarint(edits)
+		if n <= 0 || offset+length > uint64(len(base)) {
+			return nil, fmt.Errorf("delta copy is outside of the base revision")
+		}
+		value = append(value, base[offset:offset+length]...)
+		edits = edits[n:]
+	}
+	return value, nil
+}
+
+// deltaBucket rebuilds the values of a data bucket that are stored as changes of earlier
+// revisions, and stores new revisions that way when delta encoding is enabled. Values are
+// rebuilt whether or not it is enabled, so turning it off leaves existing values readable.
+type deltaBucket struct {
+	nats.KeyValue
+	s *Server
+}
+
+// rebuiltEntry is a bucket entry with its value rebuilt from the revisions it changes
+type rebuiltEntry struct {
+	nats.KeyValueEntry
+	value []byte
+}
+
+func (e *rebuiltEntry) Value() []byte {
+	return e.value
+}
+
+// rebuild applies the chain of changes a revision is stored as to the last revision before
+// it that is stored in full. Values already rebuilt can be given by revision.
+func (b *deltaBucket) rebuild(key string, revision uint64, value []byte, known map[uint64][]byte) ([]byte, error) {
+	var chain [][]byte
+	for isDeltaValue(value) {
+		base, _, edits, err := parseDelta(value)
+		if err != nil {
+			return nil, err
+		}
+		if base >= revision {
+			return nil, fmt.Errorf("revision %d is stored as a change of the later revision %d", revision, base)
+		}
+		chain = append(chain, edits)
+		if full, ok := known[base]; ok {
+			value = full
+			break
+		}
+		entry, err := b.KeyValue.GetRevision(key, base)
+		if err != nil {
+			return nil, fmt.Errorf("revision %d is stored as a change of revision %d, which is unavailable: %w", revision, base, err)
+		}
+		revision, value = base, entry.Value()
+	}
+
+	var err error
+	for i := len(chain) - 1; i >= 0; i-- {
+		if value, err = applyDelta(value, chain[i]); err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
+}
+
+func (b *deltaBucket) rebuildEntry(entry nats.KeyValueEntry) (nats.KeyValueEntry, error) {
+	if entry == nil || entry.Operation() != nats.KeyValuePut || !isDeltaValue(entry.Value()) {
+		return entry, nil
+	}
+	value, err := b.rebuild(entry.Key(), entry.Revision(), entry.Value(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", entry.Key(), err)
+	}
+	return &rebuiltEntry{KeyValueEntry: entry, value: value}, nil
+}
+
+func (b *deltaBucket) Get(key string) (nats.KeyValueEntry, error) {
+	entry, err := b.KeyValue.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return b.rebuildEntry(entry)
+}
+
+func (b *deltaBucket) GetRevision(key string, revision uint64) (nats.KeyValueEntry, error) {
+	entry, err := b.KeyValue.GetRevision(key, revision)
+	if err != nil {
+		return nil, err
+	}
+	return b.rebuildEntry(entry)
+}
+
+// History rebuilds the revisions oldest first, so each one is rebuilt from the one before
+// without reading it again. Revisions whose base was trimmed with a shorter history are
+// left out.
+func (b *deltaBucket) History(key string, opts ...nats.WatchOpt) ([]nats.KeyValueEntry, error) {
+	entries, err := b.KeyValue.History(key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	known := map[uint64][]byte{}
+	history := entries[:0]
+	for _, entry := range entries {
+		if entry.Operation() == nats.KeyValuePut && isDeltaValue(entry.Value()) {
+			value, err := b.rebuild(key, entry.Revision(), entry.Value(), known)
+			if err != nil {
+				log.Printf("Leaving revision %d of %s out of its history: %v", entry.Revision(), key, err)
+				continue
+			}
+			entry = &rebuiltEntry{KeyValueEntry: entry, value: value}
+		}
+		known[entry.Revision()] = entry.Value()
+		history = append(history, entry)
+	}
+	return history, nil
+}
+
+func (b *deltaBucket) Watch(keys string, opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	watcher, err := b.KeyValue.Watch(keys, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return transformWatcher(watcher, b.Bucket(), b.rebuildEntry), nil
+}
+
+func (b *deltaBucket) WatchAll(opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	watcher, err := b.KeyValue.WatchAll(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return transformWatcher(watcher, b.Bucket(), b.rebuildEntry), nil
+}
+
+// encode returns a value as a change of the latest revision of its key, and that revision,
+// when that is worth it. The chain of changes back to a full revision is kept shorter than
+// the history of the key, so the revision it starts from is never trimmed while needed.
+func (b *deltaBucket) encode(key string, value []byte) ([]byte, uint64, bool) {
+	d := b.s.deltas
+	if d == nil || len(value) < d.minSize {
+		return nil, 0, false
+	}
+	limit := min(uint64(d.snapshotInterval), uint64(b.s.keyHistory(key)))
+	latest, err := b.KeyValue.Get(key)
+	if err != nil {
+		return nil, 0, false
+	}
+	var depth uint64
+	if isDeltaValue(latest.Value()) {
+		if _, depth, _, err = parseDelta(latest.Value()); err != nil {
+			return nil, 0, false
+		}
+	}
+	if depth+1 >= limit {
+		return nil, 0, false
+	}
+	base, err := b.rebuild(key, latest.Revision(), latest.Value(), nil)
+	if err != nil {
+		log.Printf("Storing %s in full, its latest revision can't be rebuilt: %v", key, err)
+		return nil, 0, false
+	}
+	edits := diffValues(base, value)
+	if len(edits) > len(value)/2 {
+		return nil, 0, false
+	}
+	return encodeDelta(latest.Revision(), depth+1, edits), latest.Revision(), true
+}
+
+func (b *deltaBucket) Put(key string, value []byte) (uint64, error) {
+	if delta, last, ok := b.encode(key, value); ok {
+		revision, err := b.KeyValue.Update(key, delta, last)
+		if !isRevisionConflict(err) {
+			return revision, err
+		}
+		// Another write got in first, so there's no telling what the change would be against
+	}
+	return b.KeyValue.Put(key, value)
+}
+
+func (b *deltaBucket) PutString(key string, value string) (uint64, error) {
+	return b.Put(key, []byte(value))
+}
+
+func (b *deltaBucket) Update(key string, value []byte, last uint64) (uint64, error) {
+	if delta, latest, ok := b.encode(key, value); ok && latest == last {
+		return b.KeyValue.Update(key, delta, last)
+	}
+	return b.KeyValue.Update(key, value, last)
+}
+
+// openStoredValue returns the plaintext of a value read from a raw data bucket, decrypted,
+// expanded and rebuilt if it is stored as a change of an earlier revision, and whether it was
+func (s *Server) openStoredValue(raw nats.KeyValue, key string, revision uint64, value []byte) ([]byte, bool, error) {
+	var err error
+	if s.encryption != nil {
+		if value, err = s.encryption.decrypt(value); err != nil {
+			return nil, false, err
+		}
+	}
+	if value, err = decompressValue(value); err != nil {
+		return nil, false, err
+	}
+	if !isDeltaValue(value) {
+		return value, false, nil
+	}
+	entry, err := s.wrapDataBucket(raw).GetRevision(key, revision)
+	if err != nil {
+		return nil, true, err
+	}
+	return entry.Value(), true, nil
+}
+
+// copyableValue returns a value read from a raw data bucket in a form that can be stored
+// in another bucket: as stored, unless it is a change of a revision the other bucket
+// doesn't have, in which case it is rebuilt and stored in full
+func (s *Server) copyableValue(raw nats.KeyValue, key string, revision uint64, value []byte) ([]byte, error) {
+	plaintext, delta, err := s.openStoredValue(raw, key, revision, value)
+	if err != nil || !delta {
+		return value, err
+	}
+	if plaintext, err = s.compression.compress(plaintext); err != nil {
+		return nil, err
+	}
+	if s.encryption != nil {
+		return s.encryption.encrypt(plaintext)
+	}
+	return plaintext, nil
+}
+
+// storeDeltasInFull rewrites the latest values of a data bucket that are stored as changes,
+// before the revisions they change are trimmed by a shorter history
+func (s *Server) storeDeltasInFull(name string) error {
+	raw, err := s.getRawBucket(name)
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		key      string
+		value    []byte
+		revision uint64
+	}
+	var deltas []pending
+	err = scanBucket(raw, func(entry nats.KeyValueEntry) {
+		value, delta, err := s.openStoredValue(raw, entry.Key(), entry.Revision(), entry.Value())
+		if err != nil {
+			log.Printf("Failed to read %s/%s: %v", name, entry.Key(), err)
+		} else if delta {
+			deltas = append(deltas, pending{key: entry.Key(), value: value, revision: entry.Revision()})
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, delta := range deltas {
+		value := delta.value
+		if s.encryption != nil {
+			if value, err = s.encryption.encrypt(value); err != nil {
+				return err
+			}
+		}
+		// A value changed in the meantime was written for the new history already
+		if _, err := raw.Update(delta.key, value, delta.revision); err != nil && !isRevisionConflict(err) {
+			return fmt.Errorf("failed to store %s in full: %v", delta.key, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDiffValues(t *testing.T) {
+	document := strings.Repeat("The quick brown fox jumps over the lazy dog. ", 200)
+	tests := map[string][2]string{
+		"append":  {document, document + "One more sentence."},
+		"edit":    {document, strings.Replace(document, "lazy", "sleepy", 3)},
+		"prepend": {document, "Title\n" + document},
+		"remove":  {document, document[100:2000] + document[3000:]},
+		"rewrite": {document, strings.Repeat("Something else entirely. ", 50)},
+		"empty":   {"", document},
+		"cleared": {document, ""},
+	}
+	for name, test := range tests {
+		base, target := []byte(test[0]), []byte(test[1])
+		edits := diffValues(base, target)
+		got, err := applyDelta(base, edits)
+		if err != nil {
+			t.Errorf("%s: applyDelta failed: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(got, target) {
+			t.Errorf("%s: applyDelta did not rebuild the target", name)
+		}
+	}
+
+	if edits := diffValues([]byte(document), []byte(document+"!")); len(edits) > 16 {
+		t.Errorf("a one byte append took %d bytes of edits", len(edits))
+	}
+}
+
+func TestParseDelta(t *testing.T) {
+	edits := diffValues([]byte("hello world, hello world"), []byte("hello world, goodbye world"))
+	value := encodeDelta(300, 4, edits)
+	if !isDeltaValue(value) {
+		t.Fatal("encoded delta is not recognized")
+	}
+	base, depth, got, err := parseDelta(value)
+	if err != nil || base != 300 || depth != 4 || !bytes.Equal(got, edits) {
+		t.Errorf("parseDelta = %d, %d, %q, %v", base, depth, got, err)
+	}
+	if isDeltaValue([]byte("plain value")) {
+		t.Error("plain value is recognized as a delta")
+	}
+
+	for _, invalid := range [][]byte{{0x05}, {0x0b, 0x00}, {0x03}} {
+		if _, err := applyDelta([]byte("base"), invalid); err == nil {
+			t.Errorf("applyDelta(%v) should fail", invalid)
+		}
+	}
+}
+
+func TestDeltaCheckHistory(t *testing.T) {
+	d := &deltaEncoder{snapshotInterval: 10}
+	if err := d.checkHistory(1, nil); err == nil {
+		t.Error("delta encoding without history to store changes against should be rejected")
+	}
+	if err := d.checkHistory(1, []historyRule{{pattern: "docs/*", history: 5}}); err != nil {
+		t.Errorf("keys with a deeper history can be delta encoded: %v", err)
+	}
+	if err := (*deltaEncoder)(nil).checkHistory(1, nil); err != nil {
+		t.Errorf("disabled delta encoding: %v", err)
+	}
+}
+
+func TestDeltaStore(t *testing.T) {
+	t.Setenv("KV_DELTA_ENCODING", "on")
+	t.Setenv("KV_HISTORY", "5")
+	s := newStoreServer(t)
+
+	document := strings.Repeat("The quick brown fox jumps over the lazy dog. ", 100)
+	values := []string{document, document + "One more sentence.", strings.Replace(document, "lazy", "sleepy", 1)}
+	for _, value := range values {
+		if status, response := call(t, s, "ws1", "/api/v1/put", KVRequest{Key: "doc", Value: value}); status != http.StatusOK {
+			t.Fatalf("put = %d, %+v", status, response)
+		}
+	}
+
+	raw, err := s.getRawBucket(getWorkspacePrefix("ws1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := raw.Get("doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isDeltaValue(entry.Value()) || len(entry.Value()) > len(document)/2 {
+		t.Errorf("latest revision is stored in full (%d bytes)", len(entry.Value()))
+	}
+
+	if status, response := call(t, s, "ws1", "/api/v1/get", KVRequest{Key: "doc"}); status != http.StatusOK || response.Data != values[2] {
+		t.Fatalf("get = %d, %v", status, response.Error)
+	}
+	status, response := call(t, s, "ws1", "/api/v1/history", HistoryRequest{Key: "doc"})
+	if status != http.StatusOK {
+		t.Fatalf("history = %d, %+v", status, response)
+	}
+	var history KeyHistory
+	data, _ := json.Marshal(response.Data)
+	if err := json.Unmarshal(data, &history); err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Revisions) != len(values) {
+		t.Fatalf("history has %d revisions, want %d", len(history.Revisions), len(values))
+	}
+	for i, revision := range history.Revisions {
+		if revision.Value != values[i] {
+			t.Errorf("revision %d was not rebuilt", revision.Revision)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// enableDirectGets turns on direct gets for the buckets created before they were used.
+// CreateKeyValue creates buckets that allow them, and the client reads keys of such buckets
+// with a single request to the servers holding the stream, instead of a JetStream API
+// request to the stream leader. In a cluster a replica answers direct gets once it has
+// nearly caught up with the leader, so a read may briefly miss the latest write.
+func (s *Server) enableDirectGets() error {
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+	enabled := 0
+	for info := range js.StreamsInfo() {
+		if !strings.HasPrefix(info.Config.Name, "KV_") || info.Config.AllowDirect || info.Config.Mirror != nil {
+			continue
+		}
+		config := info.Config
+		config.AllowDirect = true
+		if _, err := js.UpdateStream(&config); err != nil {
+			return fmt.Errorf("failed to enable direct gets on %s: %v", strings.TrimPrefix(config.Name, "KV_"), err)
+		}
+		enabled++
+	}
+	if enabled > 0 {
+		log.Printf("Enabled direct gets on %d existing buckets", enabled)
+	}
+	return nil
+}
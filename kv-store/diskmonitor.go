@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// diskMonitor watches the free space of the storage directory and suspends writes when it
+// runs low, as JetStream can corrupt its stores when the disk fills up. Writes resume once
+// more space than the resume threshold is free again, so the store doesn't flap around the
+// limit. dir is set once the NATS server is running.
+type diskMonitor struct {
+	dir        string
+	minFree    uint64
+	resumeFree uint64
+	interval   time.Duration
+
+	lock     sync.Mutex
+	free     uint64
+	total    uint64
+	readOnly bool
+	since    time.Time
+	err      error
+}
+
+// DiskStatus reports the free space of the storage directory and whether writes are
+// suspended
+type DiskStatus struct {
+	Path         string     `json:"path"`
+	FreeBytes    uint64     `json:"free_bytes"`
+	TotalBytes   uint64     `json:"total_bytes"`
+	MinFreeBytes uint64     `json:"min_free_bytes"`
+	ReadOnly     bool       `json:"read_only"`
+	Since        *time.Time `json:"read_only_since,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// newDiskMonitor reads KV_DISK_MIN_FREE, the free bytes below which writes are rejected,
+// KV_DISK_RESUME_FREE, the free bytes at which they are accepted again, twice the minimum
+// by default, and KV_DISK_CHECK_INTERVAL, how often the space is read. It returns nil when
+// a minimum of 0 turns the monitor off.
+func newDiskMonitor() (*diskMonitor, error) {
+	minFree, err := strconv.ParseUint(getEnvOrDefault("KV_DISK_MIN_FREE", "268435456"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid KV_DISK_MIN_FREE: must be a number of bytes")
+	}
+	resumeFree, err := strconv.ParseUint(getEnvOrDefault("KV_DISK_RESUME_FREE", strconv.FormatUint(minFree*2, 10)), 10, 64)
+	if err != nil || resumeFree < minFree {
+		return nil, fmt.Errorf("invalid KV_DISK_RESUME_FREE: must be a number of bytes of at least KV_DISK_MIN_FREE")
+	}
+	interval, err := time.ParseDuration(getEnvOrDefault("KV_DISK_CHECK_INTERVAL", "10s"))
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid KV_DISK_CHECK_INTERVAL: must be a positive duration")
+	}
+	if minFree == 0 {
+		return nil, nil
+	}
+	return &diskMonitor{minFree: minFree, resumeFree: resumeFree, interval: interval}, nil
+}
+
+// diskSpace reads the space of the file system holding a directory
+func diskSpace(dir string) (*DiskHealth, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return nil, fmt.Errorf("failed to read the free space of %s: %v", dir, err)
+	}
+	disk := &DiskHealth{
+		Path:       dir,
+		FreeBytes:  fs.Bavail * uint64(fs.Bsize),
+		TotalBytes: fs.Blocks * uint64(fs.Bsize),
+	}
+	if disk.TotalBytes > 0 {
+		disk.Usage = 1 - float64(disk.FreeBytes)/float64(disk.TotalBytes)
+	}
+	return disk, nil
+}
+
+// run checks the free space until the process exits
+func (d *diskMonitor) run() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.check()
+	}
+}
+
+// check reads the free space and updates whether writes are suspended. When the space can't
+// be read, the store keeps its current mode.
+func (d *diskMonitor) check() {
+	disk, err := diskSpace(d.dir)
+	if err != nil {
+		d.lock.Lock()
+		d.err = err
+		d.lock.Unlock()
+		log.Printf("Disk monitor: %v", err)
+		return
+	}
+	d.update(disk.FreeBytes, disk.TotalBytes)
+}
+
+func (d *diskMonitor) update(free, total uint64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.free, d.total, d.err = free, total, nil
+	switch {
+	case !d.readOnly && free < d.minFree:
+		d.readOnly, d.since = true, time.Now()
+		log.Printf("Only %d bytes are free in %s, rejecting writes until %d bytes are free", free, d.dir, d.resumeFree)
+	case d.readOnly && free >= d.resumeFree:
+		d.readOnly = false
+		log.Printf("%d bytes are free in %s, accepting writes again", free, d.dir)
+	}
+}
+
+func (d *diskMonitor) isReadOnly() bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.readOnly
+}
+
+func (d *diskMonitor) status() DiskStatus {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	status := DiskStatus{
+		Path:         d.dir,
+		FreeBytes:    d.free,
+		TotalBytes:   d.total,
+		MinFreeBytes: d.minFree,
+		ReadOnly:     d.readOnly,
+	}
+	if d.readOnly {
+		since := d.since
+		status.Since = &since
+	}
+	if d.err != nil {
+		status.Error = d.err.Error()
+	}
+	return status
+}
+
+// rejectDiskFull answers writes with a 507 while the disk is nearly full. Reads go on, and
+// so do admin requests, which operators need to free space by compacting or purging.
+func (s *Server) rejectDiskFull(w http.ResponseWriter, r *http.Request) bool {
+	if s.disk == nil || readOnlyRoutes[r.URL.Path] || strings.HasPrefix(r.URL.Path, "/api/admin/") || !s.disk.isReadOnly() {
+		return false
+	}
+	w.WriteHeader(http.StatusInsufficientStorage)
+	json.NewEncoder(w).Encode(KVResponse{
+		Success: false,
+		Code:    errCodeDiskFull,
+		Error:   "the store is read-only, its disk is nearly full",
+	})
+	return true
+}
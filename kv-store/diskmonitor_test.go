@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDiskMonitor(t *testing.T) {
+	d := &diskMonitor{dir: "/data", minFree: 100, resumeFree: 200}
+
+	d.update(150, 1000)
+	if d.isReadOnly() {
+		t.Fatalf("store is read-only above the minimum")
+	}
+	d.update(99, 1000)
+	if !d.isReadOnly() {
+		t.Fatalf("store accepts writes below the minimum")
+	}
+	if status := d.status(); !status.ReadOnly || status.Since == nil || status.FreeBytes != 99 {
+		t.Errorf("status = %+v, want read-only since now with 99 bytes free", status)
+	}
+	d.update(150, 1000)
+	if !d.isReadOnly() {
+		t.Errorf("writes resumed below the resume threshold")
+	}
+	d.update(200, 1000)
+	if d.isReadOnly() {
+		t.Errorf("writes did not resume at the resume threshold")
+	}
+}
+
+func TestRejectDiskFull(t *testing.T) {
+	s := newTestServer()
+	s.disk = &diskMonitor{minFree: 100, resumeFree: 200}
+	s.disk.update(50, 1000)
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "/api/v1/put", want: true},
+		{path: "/api/v1/delete", want: true},
+		{path: "/api/v1/get", want: false},
+		{path: "/api/admin/compact", want: false},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		if got := s.rejectDiskFull(w, httptest.NewRequest("POST", tt.path, nil)); got != tt.want {
+			t.Errorf("rejectDiskFull(%s) = %v, want %v", tt.path, got, tt.want)
+			continue
+		}
+		if !tt.want {
+			continue
+		}
+		var resp KVResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		if w.Code != http.StatusInsufficientStorage || resp.Code != errCodeDiskFull {
+			t.Errorf("rejection of %s = %d %q, want 507 %q", tt.path, w.Code, resp.Code, errCodeDiskFull)
+		}
+	}
+
+	s.disk.update(500, 1000)
+	if s.rejectDiskFull(httptest.NewRecorder(), httptest.NewRequest("POST", "/api/v1/put", nil)) {
+		t.Errorf("writes are rejected once space was freed")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// Bucket classes that can have their own replica count
+const (
+	bucketClassData     = "data"
+	bucketClassObjects  = "objects"
+	bucketClassMetadata = "metadata"
+	bucketClassSystem   = "system"
+)
+
+// natsDefaultSyncInterval is how often JetStream flushes to disk unless configured otherwise
+const natsDefaultSyncInterval = 2 * time.Minute
+
+// durability controls how writes are persisted: how often JetStream flushes them to disk,
+// and how many replicas each class of bucket keeps when clustered
+type durability struct {
+	syncAlways   bool
+	syncInterval time.Duration
+	replicas     map[string]int
+}
+
+// newDurability reads KV_SYNC (always, or a flush interval), KV_REPLICAS (the default
+// replica count) and KV_BUCKET_REPLICAS (per class overrides such as
+// data=3,objects=3,metadata=1,system=3). Replica counts apply when a bucket is created.
+func newDurability() (*durability, error) {
+	d := &durability{syncInterval: natsDefaultSyncInterval, replicas: map[string]int{}}
+	switch sync := getEnvOrDefault("KV_SYNC", ""); sync {
+	case "":
+	case "always":
+		d.syncAlways = true
+	default:
+		interval, err := time.ParseDuration(sync)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid KV_SYNC %q, must be always or a positive duration", sync)
+		}
+		d.syncInterval = interval
+	}
+
+	replicas, err := parseReplicas(getEnvOrDefault("KV_REPLICAS", "1"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid KV_REPLICAS: %v", err)
+	}
+	for _, class := range []string{bucketClassData, bucketClassObjects, bucketClassMetadata, bucketClassSystem} {
+		d.replicas[class] = replicas
+	}
+	if overrides := getEnvOrDefault("KV_BUCKET_REPLICAS", ""); overrides != "" {
+		for _, override := range strings.Split(overrides, ",") {
+			class, value, _ := strings.Cut(strings.TrimSpace(override), "=")
+			if _, ok := d.replicas[class]; !ok {
+				return nil, fmt.Errorf("invalid KV_BUCKET_REPLICAS: unknown bucket class %q, must be data, objects, metadata or system", class)
+			}
+			if d.replicas[class], err = parseReplicas(value); err != nil {
+				return nil, fmt.Errorf("invalid KV_BUCKET_REPLICAS: %s: %v", class, err)
+			}
+		}
+	}
+	return d, nil
+}
+
+// parseReplicas parses a replica count, which JetStream limits to 5
+func parseReplicas(value string) (int, error) {
+	replicas, err := strconv.Atoi(value)
+	if err != nil || replicas < 1 || replicas > 5 {
+		return 0, fmt.Errorf("must be between 1 and 5")
+	}
+	return replicas, nil
+}
+
+// apply sets the sync options of the embedded server
+func (d *durability) apply(opts *server.Options) {
+	opts.SyncAlways = d.syncAlways
+	opts.SyncInterval = d.syncInterval
+}
+
+// bucketClass returns the class of a KV bucket: workspace data, the system buckets, or the
+// metadata buckets kept alongside a workspace
+func bucketClass(name string) string {
+	switch {
+	case strings.HasPrefix(name, "system-"):
+		return bucketClassSystem
+	case isDataBucket(name):
+		return bucketClassData
+	}
+	return bucketClassMetadata
+}
+
+// bucketReplicas returns the replica count for new buckets of a class
+func (d *durability) bucketReplicas(class string) int {
+	if d == nil {
+		return 1
+	}
+	return d.replicas[class]
+}
+
+// DurabilityStatus reports how writes are persisted, along with what the settings risk
+type DurabilityStatus struct {
+	Sync     string         `json:"sync"`
+	Replicas map[string]int `json:"replicas"`
+	TradeOff string         `json:"trade_off"`
+}
+
+func (d *durability) status() DurabilityStatus {
+	status := DurabilityStatus{Sync: d.syncInterval.String(), Replicas: d.replicas}
+	if d.syncAlways {
+		status.Sync = "always"
+		status.TradeOff = "every write is flushed to disk before it is acknowledged, so acknowledged writes survive a crash or power loss at the cost of write latency"
+	} else {
+		status.TradeOff = fmt.Sprintf("writes are flushed to disk every %s, so a crash or power loss of a server can lose up to %s of acknowledged writes that are not held by another replica", d.syncInterval, d.syncInterval)
+	}
+	if d.replicas[bucketClassData] > 1 {
+		status.TradeOff += fmt.Sprintf("; data is written to %d replicas, which survives losing a minority of them", d.replicas[bucketClassData])
+	}
+	return status
+}
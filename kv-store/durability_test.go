@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNewDurability(t *testing.T) {
+	tests := []struct {
+		name         string
+		sync         string
+		replicas     string
+		overrides    string
+		wantAlways   bool
+		wantInterval time.Duration
+		wantReplicas map[string]int
+		wantErr      bool
+	}{
+		{
+			name:         "defaults",
+			wantInterval: natsDefaultSyncInterval,
+			wantReplicas: map[string]int{"data": 1, "objects": 1, "metadata": 1, "system": 1},
+		},
+		{
+			name:         "sync always with overrides",
+			sync:         "always",
+			replicas:     "3",
+			overrides:    "metadata=1, objects=2",
+			wantAlways:   true,
+			wantInterval: natsDefaultSyncInterval,
+			wantReplicas: map[string]int{"data": 3, "objects": 2, "metadata": 1, "system": 3},
+		},
+		{
+			name:         "sync interval",
+			sync:         "1s",
+			wantInterval: time.Second,
+			wantReplicas: map[string]int{"data": 1, "objects": 1, "metadata": 1, "system": 1},
+		},
+		{name: "invalid sync", sync: "sometimes", wantErr: true},
+		{name: "too many replicas", replicas: "7", wantErr: true},
+		{name: "unknown class", overrides: "cache=3", wantErr: true},
+		{name: "invalid override", overrides: "data=0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range map[string]string{"KV_SYNC": tt.sync, "KV_REPLICAS": tt.replicas, "KV_BUCKET_REPLICAS": tt.overrides} {
+				t.Setenv(key, value)
+				if value == "" {
+					os.Unsetenv(key)
+				}
+			}
+			d, err := newDurability()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.syncAlways != tt.wantAlways || d.syncInterval != tt.wantInterval {
+				t.Errorf("sync = %v/%s, want %v/%s", d.syncAlways, d.syncInterval, tt.wantAlways, tt.wantInterval)
+			}
+			for class, want := range tt.wantReplicas {
+				if got := d.bucketReplicas(class); got != want {
+					t.Errorf("replicas of %s = %d, want %d", class, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestBucketClass(t *testing.T) {
+	tests := map[string]string{
+		"0123abcd":             bucketClassData,
+		"0123abcd-tool-writer": bucketClassData,
+		"0123abcd-stats":       bucketClassMetadata,
+		"system-apikeys":       bucketClassSystem,
+		"system-encryption":    bucketClassSystem,
+		"0123abcd-artifacts":   bucketClassMetadata,
+	}
+	for name, want := range tests {
+		if got := bucketClass(name); got != want {
+			t.Errorf("bucketClass(%q) = %s, want %s", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type EmbeddingsCacheRequest struct {
+	Content string `json:"content"`
+	Model   string `json:"model,omitempty"`
+}
+
+type EmbeddingsCacheResult struct {
+	Key       string    `json:"key"`
+	Model     string    `json:"model"`
+	Cached    bool      `json:"cached"`
+	Embedding []float64 `json:"embedding"`
+}
+
+// embeddingsClient calls an OpenAI-compatible embeddings API
+type embeddingsClient struct {
+	url    string
+	apiKey string
+	model  string
+	client *http.Client
+}
+
+func newEmbeddingsClient() *embeddingsClient {
+	apiKey := getEnvOrDefault("EMBEDDINGS_API_KEY", "")
+	if apiKey == "" {
+		apiKey = getEnvOrDefault("OPENAI_API_KEY", "")
+	}
+	return &embeddingsClient{
+		url:    getEnvOrDefault("EMBEDDINGS_API_URL", "https://api.openai.com/v1/embeddings"),
+		apiKey: apiKey,
+		model:  getEnvOrDefault("EMBEDDINGS_MODEL", "text-embedding-3-small"),
+		client: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// embed requests the embedding vector for content from the configured API
+func (c *embeddingsClient) embed(model, content string) ([]float64, error) {
+	body, err := json.Marshal(map[string]string{
+		"model": model,
+		"input": content,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create embeddings request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("embeddings request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("embeddings API returned status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Data []struct {
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode embeddings response: %v", err)
+	}
+	if len(result.Data) == 0 || len(result.Data[0].Embedding) == 0 {
+		return nil, fmt.Errorf("embeddings API returned no data")
+	}
+	return result.Data[0].Embedding, nil
+}
+
+// getEmbeddingsBucket gets the bucket caching embeddings for the given prefix. Vectors are
+// kept out of the workspace bucket so they don't show up in kv_list or kv_get.
+func (s *Server) getEmbeddingsBucket(prefix string) (nats.KeyValue, error) {
+	return s.getBucket(prefix + "-embeddings")
+}
+
+// getEmbeddingKey returns the cache key for content embedded with the given model
+func getEmbeddingKey(model, content string) string {
+	hasher := sha1.New()
+	hasher.Write([]byte(model))
+	hasher.Write([]byte{0})
+	hasher.Write([]byte(content))
+	return "embedding-" + hex.EncodeToString(hasher.Sum(nil))
+}
+
+func (s *Server) handleEmbeddingsCache(w http.ResponseWriter, r *http.Request) {
+	var req EmbeddingsCacheRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+
+	if req.Content == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "content is required"})
+		return
+	}
+
+	model := req.Model
+	if model == "" {
+		model = s.embeddings.model
+	}
+	key := getEmbeddingKey(model, req.Content)
+	if !s.checkKeyAccess(w, r, key, permWrite) {
+		return
+	}
+
+	// Get the embeddings bucket for this request
+	prefix := getRequestPrefix(r)
+	bucket, err := s.getEmbeddingsBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	// Serve from the cache when the embedding was already computed
+	if entry, err := bucket.Get(key); err == nil {
+		var embedding []float64
+		if err := json.Unmarshal(entry.Value(), &embedding); err == nil {
+			json.NewEncoder(w).Encode(KVResponse{Success: true, Data: EmbeddingsCacheResult{
+				Key:       key,
+				Model:     model,
+				Cached:    true,
+				Embedding: embedding,
+			}})
+			return
+		}
+		log.Printf("Discarding unreadable cached embedding %s", key)
+	}
+
+	embedding, err := s.embeddings.embed(model, req.Content)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	value, err := json.Marshal(embedding)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	if _, err := bucket.Put(key, value); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: EmbeddingsCacheResult{
+		Key:       key,
+		Model:     model,
+		Cached:    false,
+		Embedding: embedding,
+	}})
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// encryptionBucket is the system bucket holding the data keys, sealed with the master key
+const (
+	encryptionBucket = "system-encryption"
+	keyringKey       = "keyring"
+	masterKeyID      = "master"
+)
+
+// encryptedValuePrefix marks values encrypted at rest. Encrypted values are the prefix,
+// the data key ID, a NUL byte, the nonce and the AES-GCM ciphertext. The prefix starts
+// with a NUL byte so it never collides with text values.
+var encryptedValuePrefix = []byte("\x00kvenc1\x00")
+
+// DataKey is a key values are encrypted with. Retired keys stay in the keyring so old
+// ciphertexts remain readable until they are re-encrypted.
+type DataKey struct {
+	ID      string    `json:"id"`
+	Key     []byte    `json:"key,omitempty"`
+	Created time.Time `json:"created"`
+	Primary bool      `json:"primary,omitempty"`
+}
+
+type keyringState struct {
+	Primary string    `json:"primary"`
+	Keys    []DataKey `json:"keys"`
+}
+
+// ReencryptStatus reports the progress of the job rewriting values encrypted with old keys
+type ReencryptStatus struct {
+	Running   bool      `json:"running"`
+	Started   time.Time `json:"started,omitempty"`
+	Finished  time.Time `json:"finished,omitempty"`
+	Buckets   int       `json:"buckets"`
+	Scanned   int       `json:"scanned"`
+	Rewritten int       `json:"rewritten"`
+	Skipped   int       `json:"skipped"`
+	Failed    int       `json:"failed"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// keyring encrypts the values of data buckets with the primary data key and decrypts them
+// with any key in the ring. Data keys are stored in the system bucket sealed with the
+// master key, so every instance sharing the store uses the same ring.
+type keyring struct {
+	lock      sync.RWMutex
+	master    cipher.AEAD
+	masterKey []byte
+	source    *masterKeySource
+	bucket    nats.KeyValue
+	state     keyringState
+	revision  uint64
+	primary   string
+	keys      map[string]cipher.AEAD
+	reencrypt ReencryptStatus
+}
+
+// newAEAD returns AES-256-GCM for a 32 byte key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption keys must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealValue encrypts a value with the given key. The key ID is authenticated along with the
+// ciphertext.
+func sealValue(aead cipher.AEAD, keyID string, plaintext []byte) ([]byte, error) {
+	header := append(append(bytes.Clone(encryptedValuePrefix), keyID...), 0)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(header, nonce...)
+	return aead.Seal(sealed, nonce, plaintext, header), nil
+}
+
+// parseSealedValue returns the key ID and the remainder of an encrypted value, or ok false
+// for plain values
+func parseSealedValue(value []byte) (keyID string, header, rest []byte, ok bool) {
+	body, found := bytes.CutPrefix(value, encryptedValuePrefix)
+	if !found {
+		return "", nil, nil, false
+	}
+	id, rest, found := bytes.Cut(body, []byte{0})
+	if !found {
+		return "", nil, nil, false
+	}
+	return string(id), value[:len(value)-len(rest)], rest, true
+}
+
+// openValue decrypts the remainder of an encrypted value
+func openValue(aead cipher.AEAD, header, rest []byte) ([]byte, error) {
+	if len(rest) < aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted value is truncated")
+	}
+	nonce, ciphertext := rest[:aead.NonceSize()], rest[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, header)
+}
+
+// newDataKey generates a random data key
+func newDataKey() (DataKey, error) {
+	id := make([]byte, 4)
+	key := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return DataKey{}, err
+	}
+	if _, err := rand.Read(key); err != nil {
+		return DataKey{}, err
+	}
+	return DataKey{ID: hex.EncodeToString(id), Key: key, Created: time.Now().UTC()}, nil
+}
+
+// parseMasterKey decodes a base64 encoded 32 byte master key
+func parseMasterKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("must be base64 encoded: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// newKeyring enables encryption at rest when a master key is configured, loading the data
+// keys or creating the first one. It returns nil when encryption is disabled.
+func (s *Server) newKeyring() (*keyring, error) {
+	source, err := newMasterKeySource()
+	if err != nil || source == nil {
+		return nil, err
+	}
+	masterKey, err := source.fetch()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the master key from %s: %v", source.name, err)
+	}
+	master, err := newAEAD(masterKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid master key from %s: %v", source.name, err)
+	}
+	bucket, err := s.getBucket(encryptionBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &keyring{master: master, masterKey: masterKey, source: source, bucket: bucket}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	// Followers read the data keys of the primary once they are mirrored
+	if s.follower != nil {
+		for started := time.Now(); k.revision == 0; {
+			if time.Since(started) > followerSyncTimeout {
+				return nil, fmt.Errorf("the encryption keys were not mirrored from the primary within %s", followerSyncTimeout)
+			}
+			time.Sleep(time.Second)
+			if err := k.load(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if k.revision == 0 {
+		if _, err := k.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// load reads the data keys from the system bucket
+func (k *keyring) load() error {
+	entry, err := k.bucket.Get(keyringKey)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load encryption keys: %v", err)
+	}
+	k.lock.RLock()
+	master := k.master
+	k.lock.RUnlock()
+	data, err := unsealKeyring(master, entry.Value())
+	if err != nil {
+		return fmt.Errorf("failed to unseal encryption keys, is the master key correct? %v", err)
+	}
+	var state keyringState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("invalid encryption keys: %v", err)
+	}
+
+	keys := make(map[string]cipher.AEAD, len(state.Keys))
+	for _, key := range state.Keys {
+		if keys[key.ID], err = newAEAD(key.Key); err != nil {
+			return fmt.Errorf("invalid data key %s: %v", key.ID, err)
+		}
+	}
+	if keys[state.Primary] == nil {
+		return fmt.Errorf("primary data key %s is missing", state.Primary)
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.state = state
+	k.revision = entry.Revision()
+	k.primary = state.Primary
+	k.keys = keys
+	return nil
+}
+
+// unsealKeyring opens the stored data keys with a master key
+func unsealKeyring(master cipher.AEAD, value []byte) ([]byte, error) {
+	_, header, rest, ok := parseSealedValue(value)
+	if !ok {
+		return nil, fmt.Errorf("encryption keys are not sealed")
+	}
+	return openValue(master, header, rest)
+}
+
+// rotate adds a new data key and makes it the primary key. Instances sharing the store
+// pick it up the first time they read a value encrypted with it.
+func (k *keyring) rotate() (DataKey, error) {
+	for attempt := 0; attempt < incrMaxAttempts; attempt++ {
+		key, err := newDataKey()
+		if err != nil {
+			return DataKey{}, err
+		}
+		k.lock.RLock()
+		state := keyringState{Primary: key.ID, Keys: append([]DataKey{key}, k.state.Keys...)}
+		revision := k.revision
+		master := k.master
+		k.lock.RUnlock()
+
+		data, err := json.Marshal(state)
+		if err != nil {
+			return DataKey{}, err
+		}
+		sealed, err := sealValue(master, masterKeyID, data)
+		if err != nil {
+			return DataKey{}, err
+		}
+		if revision == 0 {
+			_, err = k.bucket.Create(keyringKey, sealed)
+		} else {
+			_, err = k.bucket.Update(keyringKey, sealed, revision)
+		}
+		if isRevisionConflict(err) {
+			// Another instance rotated at the same time, retry on top of its keys
+			if err := k.load(); err != nil {
+				return DataKey{}, err
+			}
+			continue
+		}
+		if err != nil {
+			return DataKey{}, err
+		}
+		if err := k.load(); err != nil {
+			return DataKey{}, err
+		}
+		log.Printf("Rotated the primary data key to %s", key.ID)
+		key.Key = nil
+		key.Primary = true
+		return key, nil
+	}
+	return DataKey{}, fmt.Errorf("encryption keys are changing too often")
+}
+
+// encrypt seals a value with the primary data key
+func (k *keyring) encrypt(value []byte) ([]byte, error) {
+	k.lock.RLock()
+	id, aead := k.primary, k.keys[k.primary]
+	k.lock.RUnlock()
+	return sealValue(aead, id, value)
+}
+
+// decrypt opens a value with the data key it was sealed with, reloading the keys once if
+// another instance rotated in a new key. Values written before encryption was enabled are
+// returned as they are.
+func (k *keyring) decrypt(value []byte) ([]byte, error) {
+	id, header, rest, ok := parseSealedValue(value)
+	if !ok {
+		return value, nil
+	}
+	k.lock.RLock()
+	aead := k.keys[id]
+	k.lock.RUnlock()
+	if aead == nil {
+		if err := k.load(); err != nil {
+			return nil, err
+		}
+		k.lock.RLock()
+		aead = k.keys[id]
+		k.lock.RUnlock()
+		if aead == nil {
+			return nil, fmt.Errorf("value is encrypted with unknown data key %s", id)
+		}
+	}
+	plaintext, err := openValue(aead, header, rest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt value: %v", err)
+	}
+	return plaintext, nil
+}
+
+// needsReencryption reports whether a stored value is not sealed with the primary key
+func (k *keyring) needsReencryption(value []byte) bool {
+	id, _, _, ok := parseSealedValue(value)
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	return !ok || id != k.primary
+}
+
+// encryptedBucket encrypts values written to a data bucket and decrypts values read from
+// it. Key operations pass straight through to the bucket.
+type encryptedBucket struct {
+	nats.KeyValue
+	keys *keyring
+}
+
+// decryptedEntry is a bucket entry with its value decrypted
+type decryptedEntry struct {
+	nats.KeyValueEntry
+	value []byte
+}
+
+func (e *decryptedEntry) Value() []byte {
+	return e.value
+}
+
+func (b *encryptedBucket) decryptEntry(entry nats.KeyValueEntry) (nats.KeyValueEntry, error) {
+	if entry == nil || entry.Operation() != nats.KeyValuePut {
+		return entry, nil
+	}
+	value, err := b.keys.decrypt(entry.Value())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", entry.Key(), err)
+	}
+	return &decryptedEntry{KeyValueEntry: entry, value: value}, nil
+}
+
+func (b *encryptedBucket) Get(key string) (nats.KeyValueEntry, error) {
+	entry, err := b.KeyValue.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return b.decryptEntry(entry)
+}
+
+func (b *encryptedBucket) GetRevision(key string, revision uint64) (nats.KeyValueEntry, error) {
+	entry, err := b.KeyValue.GetRevision(key, revision)
+	if err != nil {
+		return nil, err
+	}
+	return b.decryptEntry(entry)
+}
+
+func (b *encryptedBucket) Put(key string, value []byte) (uint64, error) {
+	sealed, err := b.keys.encrypt(value)
+	if err != nil {
+		return 0, err
+	}
+	return b.KeyValue.Put(key, sealed)
+}
+
+func (b *encryptedBucket) PutString(key string, value string) (uint64, error) {
+	return b.Put(key, []byte(value))
+}
+
+func (b *encryptedBucket) Create(key string, value []byte) (uint64, error) {
+	sealed, err := b.keys.encrypt(value)
+	if err != nil {
+		return 0, err
+	}
+	return b.KeyValue.Create(key, sealed)
+}
+
+func (b *encryptedBucket) Update(key string, value []byte, last uint64) (uint64, error) {
+	sealed, err := b.keys.encrypt(value)
+	if err != nil {
+		return 0, err
+	}
+	return b.KeyValue.Update(key, sealed, last)
+}
+
+func (b *encryptedBucket) History(key string, opts ...nats.WatchOpt) ([]nats.KeyValueEntry, error) {
+	entries, err := b.KeyValue.History(key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		if entries[i], err = b.decryptEntry(entry); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+func (b *encryptedBucket) Watch(keys string, opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	watcher, err := b.KeyValue.Watch(keys, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return b.decryptWatcher(watcher), nil
+}
+
+func (b *encryptedBucket) WatchAll(opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	watcher, err := b.KeyValue.WatchAll(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return b.decryptWatcher(watcher), nil
+}
+
+// transformingWatcher passes on the updates of a watcher with their values transformed, e.g.
+// decrypted
+type transformingWatcher struct {
+	nats.KeyWatcher
+	updates chan nats.KeyValueEntry
+	stop    chan struct{}
+	once    sync.Once
+}
+
+func (b *encryptedBucket) decryptWatcher(watcher nats.KeyWatcher) nats.KeyWatcher {
+	return transformWatcher(watcher, b.Bucket(), b.decryptEntry)
+}
+
+func transformWatcher(watcher nats.KeyWatcher, bucket string, transform func(nats.KeyValueEntry) (nats.KeyValueEntry, error)) nats.KeyWatcher {
+	w := &transformingWatcher{
+		KeyWatcher: watcher,
+		updates:    make(chan nats.KeyValueEntry, 256),
+		stop:       make(chan struct{}),
+	}
+	go func() {
+		for {
+			var entry nats.KeyValueEntry
+			select {
+			case entry = <-watcher.Updates():
+			case <-w.stop:
+				return
+			}
+			if transformed, err := transform(entry); err != nil {
+				// The value is passed on as stored rather than stalling the watch
+				log.Printf("Watch of %s: %v", bucket, err)
+			} else {
+				entry = transformed
+			}
+			select {
+			case w.updates <- entry:
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+func (w *transformingWatcher) Updates() <-chan nats.KeyValueEntry {
+	return w.updates
+}
+
+func (w *transformingWatcher) Stop() error {
+	w.once.Do(func() { close(w.stop) })
+	return w.KeyWatcher.Stop()
+}
+
+// runReencryption rewrites every value of the data buckets that is not sealed with the
+// primary key. Values changed while the job runs are skipped, since their new value is
+// already sealed with the primary key.
+func (s *Server) runReencryption() {
+	k := s.encryption
+	k.lock.Lock()
+	if k.reencrypt.Running {
+		k.lock.Unlock()
+		return
+	}
+	k.reencrypt = ReencryptStatus{Running: true, Started: time.Now().UTC()}
+	k.lock.Unlock()
+
+	update := func(fn func(status *ReencryptStatus)) {
+		k.lock.Lock()
+		defer k.lock.Unlock()
+		fn(&k.reencrypt)
+	}
+	defer update(func(status *ReencryptStatus) {
+		status.Running = false
+		status.Finished = time.Now().UTC()
+		log.Printf("Re-encryption finished: %d values rewritten, %d skipped, %d failed", status.Rewritten, status.Skipped, status.Failed)
+	})
+
+	names, err := s.listDataBuckets()
+	if err != nil {
+		update(func(status *ReencryptStatus) { status.LastError = err.Error() })
+		return
+	}
+	for _, name := range names {
+		bucket, err := s.getRawBucket(name)
+		if err != nil {
+			update(func(status *ReencryptStatus) { status.LastError = err.Error() })
+			continue
+		}
+		type pending struct {
+			key      string
+			value    []byte
+			revision uint64
+		}
+		var stale []pending
+		scanned := 0
+		err = scanBucket(bucket, func(entry nats.KeyValueEntry) {
+			scanned++
+			if k.needsReencryption(entry.Value()) {
+				stale = append(stale, pending{key: entry.Key(), value: entry.Value(), revision: entry.Revision()})
+			}
+		})
+		update(func(status *ReencryptStatus) {
+			status.Buckets++
+			status.Scanned += scanned
+			if err != nil {
+				status.LastError = fmt.Sprintf("%s: %v", name, err)
+			}
+		})
+
+		for _, value := range stale {
+			plaintext, _, err := s.openStoredValue(bucket, value.key, value.revision, value.value)
+			var sealed []byte
+			if err == nil {
+				sealed, err = k.encrypt(plaintext)
+			}
+			if err == nil {
+				_, err = bucket.Update(value.key, sealed, value.revision)
+			}
+			update(func(status *ReencryptStatus) {
+				switch {
+				case isRevisionConflict(err):
+					status.Skipped++
+				case err != nil:
+					status.Failed++
+					status.LastError = fmt.Sprintf("%s/%s: %v", name, value.key, err)
+				default:
+					status.Rewritten++
+				}
+			})
+		}
+	}
+}
+
+// status returns the data keys without their key material, and the re-encryption progress
+func (k *keyring) status() ([]DataKey, ReencryptStatus) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	keys := make([]DataKey, 0, len(k.state.Keys))
+	for _, key := range k.state.Keys {
+		keys = append(keys, DataKey{ID: key.ID, Created: key.Created, Primary: key.ID == k.primary})
+	}
+	return keys, k.reencrypt
+}
+
+func (s *Server) checkEncryptionEnabled(w http.ResponseWriter) bool {
+	if s.encryption == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "encryption at rest is disabled, set KV_ENCRYPTION_MASTER_KEY to enable it"})
+		return false
+	}
+	return true
+}
+
+// handleEncryptionStatus lists the data keys and the progress of re-encryption
+func (s *Server) handleEncryptionStatus(w http.ResponseWriter, r *http.Request) {
+	if s.encryption == nil {
+		json.NewEncoder(w).Encode(KVResponse{Success: true, Data: map[string]interface{}{"enabled": false}})
+		return
+	}
+	keys, reencrypt := s.encryption.status()
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: map[string]interface{}{
+		"enabled":   true,
+		"keys":      keys,
+		"reencrypt": reencrypt,
+	}})
+}
+
+// handleEncryptionRotate makes a new data key primary and re-encrypts existing values with
+// it in the background
+func (s *Server) handleEncryptionRotate(w http.ResponseWriter, r *http.Request) {
+	if !s.checkEncryptionEnabled(w) {
+		return
+	}
+	key, err := s.encryption.rotate()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	go s.runReencryption()
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: key})
+}
+
+// handleEncryptionReencrypt starts re-encrypting values not sealed with the primary key,
+// e.g. values written before encryption was enabled
+func (s *Server) handleEncryptionReencrypt(w http.ResponseWriter, r *http.Request) {
+	if !s.checkEncryptionEnabled(w) {
+		return
+	}
+	go s.runReencryption()
+	json.NewEncoder(w).Encode(KVResponse{Success: true})
+}
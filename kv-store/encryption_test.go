@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"net/http"
+	"testing"
+)
+
+func testKeyring(t *testing.T, ids ...string) *keyring {
+	t.Helper()
+	k := &keyring{keys: map[string]cipher.AEAD{}}
+	for _, id := range ids {
+		key, err := newDataKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k.keys[id], err = newAEAD(key.Key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	k.primary = ids[0]
+	return k
+}
+
+func TestKeyringEncryptDecrypt(t *testing.T) {
+	k := testKeyring(t, "old")
+	sealed, err := k.encrypt([]byte("secret value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("secret value")) {
+		t.Fatalf("value is stored in the clear: %q", sealed)
+	}
+
+	// Rotating keeps values sealed with the previous key readable
+	k.keys["new"] = testKeyring(t, "new").keys["new"]
+	k.primary = "new"
+	if !k.needsReencryption(sealed) {
+		t.Error("a value sealed with a retired key needs re-encryption")
+	}
+	plaintext, err := k.decrypt(sealed)
+	if err != nil || string(plaintext) != "secret value" {
+		t.Fatalf("decrypt = %q, %v", plaintext, err)
+	}
+
+	resealed, err := k.encrypt(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _, _, _ := parseSealedValue(resealed); id != "new" || k.needsReencryption(resealed) {
+		t.Errorf("value sealed with %q, want the primary key", id)
+	}
+
+	// Values written before encryption was enabled are read as they are
+	if plain, err := k.decrypt([]byte("legacy")); err != nil || string(plain) != "legacy" || !k.needsReencryption([]byte("legacy")) {
+		t.Errorf("plain values: %q, %v", plain, err)
+	}
+}
+
+func TestKeyringRejectsTampering(t *testing.T) {
+	k := testKeyring(t, "a", "b")
+	sealed, err := k.encrypt([]byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	flipped := bytes.Clone(sealed)
+	flipped[len(flipped)-1] ^= 1
+	if _, err := k.decrypt(flipped); err == nil {
+		t.Error("a modified ciphertext must not decrypt")
+	}
+
+	// The key ID is authenticated, so a value can't be pointed at another key
+	relabeled := bytes.Replace(sealed, append(bytes.Clone(encryptedValuePrefix), 'a'), append(bytes.Clone(encryptedValuePrefix), 'b'), 1)
+	if _, err := k.decrypt(relabeled); err == nil {
+		t.Error("a relabeled ciphertext must not decrypt")
+	}
+
+	if _, err := k.decrypt(append(bytes.Clone(encryptedValuePrefix), "a\x00short"...)); err == nil {
+		t.Error("a truncated ciphertext must not decrypt")
+	}
+}
+
+func TestParseMasterKey(t *testing.T) {
+	if _, err := parseMasterKey("MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE="); err != nil {
+		t.Errorf("valid key: %v", err)
+	}
+	for _, value := range []string{"not base64!", "c2hvcnQ="} {
+		if _, err := parseMasterKey(value); err == nil {
+			t.Errorf("%q should be rejected", value)
+		}
+	}
+}
+
+func TestEncryptedStore(t *testing.T) {
+	t.Setenv("KV_ENCRYPTION_MASTER_KEY", "MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=")
+	s := newStoreServer(t)
+	if status, response := call(t, s, "ws1", "/api/v1/put", KVRequest{Key: "a", Value: "secret value"}); status != http.StatusOK {
+		t.Fatalf("put = %d, %+v", status, response)
+	}
+
+	raw, err := s.getRawBucket(getWorkspacePrefix("ws1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	storedKey := func() string {
+		t.Helper()
+		entry, err := raw.Get("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(entry.Value(), []byte("secret value")) {
+			t.Fatalf("value is stored in the clear: %q", entry.Value())
+		}
+		id, _, _, ok := parseSealedValue(entry.Value())
+		if !ok {
+			t.Fatalf("value is not sealed: %q", entry.Value())
+		}
+		return id
+	}
+	old := storedKey()
+
+	// Rotating re-encrypts stored values with the new primary key
+	key, err := s.encryption.rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.runReencryption()
+	if _, status := s.encryption.status(); status.Rewritten != 1 || status.Failed != 0 {
+		t.Errorf("re-encryption = %+v, want one value rewritten", status)
+	}
+	if id := storedKey(); id != key.ID || id == old {
+		t.Errorf("value sealed with %q after rotating to %q", id, key.ID)
+	}
+	if status, response := call(t, s, "ws1", "/api/v1/get", KVRequest{Key: "a"}); status != http.StatusOK || response.Data != "secret value" {
+		t.Fatalf("get = %d, %+v", status, response)
+	}
+}
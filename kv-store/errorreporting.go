@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// maxPendingReports bounds the reports being sent at once. Reports beyond it are dropped,
+// so a burst of failures doesn't pile up requests to the collector.
+const maxPendingReports = 16
+
+// errorReporter sends panics and server errors of requests to a Sentry-compatible collector
+type errorReporter struct {
+	endpoint    string
+	auth        string
+	environment string
+	serverName  string
+	client      *http.Client
+	pending     chan struct{}
+}
+
+// ErrorEvent is an event of the Sentry store API
+type ErrorEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Message     string            `json:"message,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Request     *ErrorRequest     `json:"request,omitempty"`
+	Exception   *ErrorExceptions  `json:"exception,omitempty"`
+}
+
+// ErrorRequest is the request an event happened in. Bodies and headers are left out, as
+// they can hold credentials and workspace data.
+type ErrorRequest struct {
+	URL    string `json:"url"`
+	Method string `json:"method"`
+}
+
+type ErrorExceptions struct {
+	Values []ErrorException `json:"values"`
+}
+
+type ErrorException struct {
+	Type       string           `json:"type"`
+	Value      string           `json:"value"`
+	Stacktrace *ErrorStacktrace `json:"stacktrace,omitempty"`
+}
+
+type ErrorStacktrace struct {
+	Frames []ErrorFrame `json:"frames"`
+}
+
+type ErrorFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	Line     int    `json:"lineno"`
+}
+
+// newErrorReporter reads KV_SENTRY_DSN, the DSN of the project to report to, and
+// KV_SENTRY_ENVIRONMENT, the environment events are tagged with. Reporting is off without
+// a DSN.
+func newErrorReporter(serverName string) (*errorReporter, error) {
+	dsn := getEnvOrDefault("KV_SENTRY_DSN", "")
+	if dsn == "" {
+		return nil, nil
+	}
+	endpoint, key, err := parseSentryDSN(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid KV_SENTRY_DSN: %v", err)
+	}
+	return &errorReporter{
+		endpoint:    endpoint,
+		auth:        fmt.Sprintf("Sentry sentry_version=7, sentry_client=kv-store/1.0, sentry_key=%s", key),
+		environment: getEnvOrDefault("KV_SENTRY_ENVIRONMENT", "production"),
+		serverName:  serverName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		pending:     make(chan struct{}, maxPendingReports),
+	}, nil
+}
+
+// parseSentryDSN returns the store endpoint and public key of a DSN like
+// https://key@host/path/project
+func parseSentryDSN(dsn string) (string, string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return "", "", fmt.Errorf("must be an http or https URL")
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return "", "", fmt.Errorf("missing the public key")
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	if i < 0 || path[i+1:] == "" {
+		return "", "", fmt.Errorf("missing the project ID")
+	}
+	endpoint := fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, path[:i], path[i+1:])
+	return endpoint, u.User.Username(), nil
+}
+
+// reportRequest reports a request that failed with a server error. Shed requests are not
+// failures.
+func (s *Server) reportRequest(r *http.Request, rw *responseWriter) {
+	if s.reporter == nil || rw.status < 500 || rw.status == http.StatusServiceUnavailable {
+		return
+	}
+	message := http.StatusText(rw.status)
+	var resp KVResponse
+	if json.Unmarshal(rw.body.Bytes(), &resp) == nil && resp.Error != "" {
+		message = resp.Error
+	}
+	event := s.reporter.newEvent(r, "error", message)
+	event.Tags["status"] = fmt.Sprint(rw.status)
+	s.reporter.send(event)
+}
+
+// reportPanic reports a request that panicked, with the stack it panicked in
+func (s *Server) reportPanic(r *http.Request, recovered any, stack *ErrorStacktrace) {
+	if s.reporter == nil {
+		return
+	}
+	event := s.reporter.newEvent(r, "fatal", fmt.Sprintf("panic: %v", recovered))
+	event.Exception = &ErrorExceptions{Values: []ErrorException{{
+		Type:       "panic",
+		Value:      fmt.Sprint(recovered),
+		Stacktrace: stack,
+	}}}
+	s.reporter.send(event)
+}
+
+// newEvent starts an event about a request, tagged with what the request was doing and the
+// bucket prefix of its workspace, which is a hash rather than the workspace ID
+func (e *errorReporter) newEvent(r *http.Request, level, message string) *ErrorEvent {
+	id := make([]byte, 16)
+	rand.Read(id)
+	tags := map[string]string{"path": r.URL.Path}
+	if id := getRequestID(r); id != "" {
+		tags["request_id"] = id
+	}
+	if workspace := getRequestPrefix(r); workspace != "" {
+		tags["workspace"] = workspace
+	}
+	if operation, ok := routeOperations[r.URL.Path]; ok {
+		tags["operation"] = operation
+	}
+	return &ErrorEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   time.Now().UTC(),
+		Level:       level,
+		Platform:    "go",
+		Logger:      "kv-store",
+		ServerName:  e.serverName,
+		Environment: e.environment,
+		Message:     message,
+		Tags:        tags,
+		Request:     &ErrorRequest{URL: r.URL.Path, Method: r.Method},
+	}
+}
+
+// send posts an event in the background, dropping it if too many are being sent
+func (e *errorReporter) send(event *ErrorEvent) {
+	select {
+	case e.pending <- struct{}{}:
+	default:
+		log.Printf("Dropped error report %s, too many reports are being sent", event.EventID)
+		return
+	}
+	go func() {
+		defer func() { <-e.pending }()
+		if err := e.post(event); err != nil {
+			log.Printf("Failed to send error report %s: %v", event.EventID, err)
+		}
+	}()
+}
+
+func (e *errorReporter) post(event *ErrorEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", e.auth)
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// panicStacktrace returns the stack of the goroutine that panicked, called from the function
+// that recovered. Frames are ordered from the outermost call, as Sentry expects.
+func panicStacktrace() *ErrorStacktrace {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var stack []ErrorFrame
+	for {
+		frame, more := frames.Next()
+		stack = append(stack, ErrorFrame{Function: frame.Function, Filename: frame.File, Line: frame.Line})
+		if !more {
+			break
+		}
+	}
+	for i, j := 0, len(stack)-1; i < j; i, j = i+1, j-1 {
+		stack[i], stack[j] = stack[j], stack[i]
+	}
+	return &ErrorStacktrace{Frames: stack}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseSentryDSN(t *testing.T) {
+	endpoint, key, err := parseSentryDSN("https://abc123@sentry.example.com/prefix/42")
+	if err != nil || endpoint != "https://sentry.example.com/prefix/api/42/store/" || key != "abc123" {
+		t.Errorf("got %s, %s, %v", endpoint, key, err)
+	}
+	for _, dsn := range []string{"https://sentry.example.com/42", "https://abc@sentry.example.com/", "ftp://abc@host/1"} {
+		if _, _, err := parseSentryDSN(dsn); err == nil {
+			t.Errorf("%s should be rejected", dsn)
+		}
+	}
+}
+
+func TestReportRequest(t *testing.T) {
+	events := make(chan ErrorEvent, 2)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.Header.Get("X-Sentry-Auth"), "sentry_key=key") {
+			t.Errorf("unexpected auth %q", r.Header.Get("X-Sentry-Auth"))
+		}
+		var event ErrorEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer collector.Close()
+
+	t.Setenv("KV_SENTRY_DSN", strings.Replace(collector.URL, "://", "://key@", 1)+"/1")
+	reporter, err := newErrorReporter("replica-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{reporter: reporter}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/put", nil)
+	r.Header.Set("X-GPTScript-Env", "GPTSCRIPT_WORKSPACE_ID=ws1")
+	rw := &responseWriter{ResponseWriter: httptest.NewRecorder(), status: http.StatusInternalServerError, body: bytes.NewBufferString(`{"success":false,"error":"disk full"}`)}
+	s.reportRequest(r, rw)
+	event := <-events
+	if event.Message != "disk full" || event.Tags["workspace"] != getWorkspacePrefix("ws1") || event.Tags["operation"] != routeOperations["/api/v1/put"] || event.ServerName != "replica-1" {
+		t.Errorf("unexpected event %+v", event)
+	}
+
+	rec := httptest.NewRecorder()
+	panicked := &responseWriter{ResponseWriter: rec, status: http.StatusOK, body: new(bytes.Buffer), requestID: "req-1"}
+	func() {
+		defer func() { s.recoverRequest(r, panicked, recover()) }()
+		panic("boom")
+	}()
+	var resp struct {
+		KVResponse
+		RequestID string `json:"request_id"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || rec.Code != http.StatusInternalServerError || resp.Code != errCodeInternal || resp.RequestID != "req-1" {
+		t.Errorf("unexpected panic response %d %s", rec.Code, rec.Body.String())
+	}
+	event = <-events
+	if event.Level != "fatal" || event.Exception == nil || len(event.Exception.Values[0].Stacktrace.Frames) == 0 {
+		t.Errorf("unexpected panic event %+v", event)
+	}
+
+	rw.status = http.StatusServiceUnavailable
+	s.reportRequest(r, rw)
+	select {
+	case event := <-events:
+		t.Errorf("shed requests should not be reported, got %+v", event)
+	default:
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OperationEvent is published to NATS for every API operation
+type OperationEvent struct {
+	Time      time.Time `json:"time"`
+	Workspace string    `json:"workspace"`
+	Operation string    `json:"operation"`
+	Key       string    `json:"key,omitempty"`
+	Tool      string    `json:"tool,omitempty"`
+	Status    int       `json:"status"`
+	Success   bool      `json:"success"`
+}
+
+// getOperationName derives the operation name from an API path
+func getOperationName(path string) string {
+	if op, ok := strings.CutPrefix(path, "/api/v1/"); ok {
+		return op
+	}
+	return strings.TrimPrefix(path, "/api/")
+}
+
+// publishEvent publishes an operation event to <subject>.<workspace> so other components
+// can follow store activity without scraping logs
+func (s *Server) publishEvent(r *http.Request, body []byte, status int) {
+	if s.eventsSubject == "" {
+		return
+	}
+
+	workspace := "admin"
+	if !strings.HasPrefix(r.URL.Path, "/api/admin/") {
+		workspace = getRequestPrefix(r)
+	}
+
+	event := OperationEvent{
+		Time:      time.Now().UTC(),
+		Workspace: workspace,
+		Operation: getOperationName(r.URL.Path),
+		Tool:      r.Header.Get("X-Gptscript-Tool-Name"),
+		Status:    status,
+		Success:   status < http.StatusBadRequest,
+	}
+
+	// Pick up the key from JSON request bodies when there is one
+	var req struct {
+		Key string `json:"key"`
+	}
+	if len(body) > 0 && !isUploadPart(r) && json.Unmarshal(body, &req) == nil {
+		event.Key = req.Key
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	// The request ID goes in a header, for subscribers to correlate the event with the logs
+	if err := s.nc.PublishMsg(newRequestMsg(r, s.eventsSubject+"."+workspace, data)); err != nil {
+		logRequestf(r, "Failed to publish operation event: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// partitionRetention is the maximum age of partition messages in JetStream. Keys are
+// expired by the sweeper, which knows which keys it removes, so JetStream only removes
+// what the sweeper missed.
+func (s *Server) partitionRetention() time.Duration {
+	if s.partitionTTL <= 0 {
+		return 0
+	}
+	return s.partitionTTL + 2*s.expirySweepInterval
+}
+
+// expirePartition deletes the keys of a partition that were last written more than
+// KV_PARTITION_TTL ago and notifies about them. Keys are deleted at the revision that was
+// found, so a key written in the meantime is kept.
+func (s *Server) expirePartition(prefix string) ([]string, error) {
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-s.partitionTTL)
+	var candidates []nats.KeyValueEntry
+	err = scanBucket(bucket, func(entry nats.KeyValueEntry) {
+		if entry.Created().Before(cutoff) {
+			candidates = append(candidates, entry)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []string
+	for _, entry := range candidates {
+		if err := bucket.Delete(entry.Key(), nats.LastRevision(entry.Revision())); err != nil {
+			if !isRevisionConflict(err) {
+				log.Printf("Failed to expire %s/%s: %v", prefix, entry.Key(), err)
+			}
+			continue
+		}
+		s.deleteKeyStats(prefix, entry.Key())
+		expired = append(expired, entry.Key())
+	}
+	if len(expired) > 0 {
+		s.notifyKeys(prefix, webhookEventExpired, "expire", "ttl", expired)
+	}
+	return expired, nil
+}
+
+// runExpirySweeper periodically expires the keys put with a TTL and, with KV_PARTITION_TTL,
+// the keys of every partition
+func (s *Server) runExpirySweeper() {
+	ticker := time.NewTicker(s.expirySweepInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if expired, err := s.expireKeys(now); err != nil {
+			log.Printf("Expiry sweep of keys with a TTL failed: %v", err)
+		} else if expired > 0 {
+			log.Printf("Expired %d keys with a TTL", expired)
+		}
+		if s.partitionTTL <= 0 {
+			continue
+		}
+
+		names, err := s.listDataBuckets()
+		if err != nil {
+			log.Printf("Expiry sweep failed to list partitions: %v", err)
+			continue
+		}
+		for _, name := range names {
+			if !isPartition(name) {
+				continue
+			}
+			expired, err := s.expirePartition(name)
+			if err != nil {
+				log.Printf("Expiry sweep of %s failed: %v", name, err)
+				continue
+			}
+			if len(expired) > 0 {
+				log.Printf("Expired %d keys in %s", len(expired), name)
+			}
+		}
+	}
+}
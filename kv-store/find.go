@@ -0,0 +1,553 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	maxQueryLength   = 2000
+	maxQueryTerms    = 50
+	maxQueryDepth    = 20
+	defaultFindLimit = 100
+	maxFindLimit     = 1000
+)
+
+type FindRequest struct {
+	Query string      `json:"query"`
+	Scope string      `json:"scope,omitempty"`
+	Limit flexibleInt `json:"limit,omitempty"`
+	// Values returns the value of each matching key along with its metadata
+	Values flexibleBool `json:"values,omitempty"`
+}
+
+type FoundKey struct {
+	KeyMetadata
+	Value *string `json:"value,omitempty"`
+}
+
+type FindResult struct {
+	Keys []FoundKey `json:"keys"`
+	// Scanned is the number of keys the query was evaluated against
+	Scanned   int  `json:"scanned"`
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// findDoc is a key a query is evaluated against. Its value is decoded as JSON and its
+// access statistics loaded only when a term needs them.
+type findDoc struct {
+	key      string
+	revision uint64
+	modified time.Time
+	value    []byte
+
+	decoded   bool
+	data      any
+	stats     *KeyStats
+	loadStats func() *KeyStats
+}
+
+func (d *findDoc) json() any {
+	if !d.decoded {
+		d.decoded = true
+		if json.Unmarshal(d.value, &d.data) != nil {
+			d.data = nil
+		}
+	}
+	return d.data
+}
+
+func (d *findDoc) keyStats() *KeyStats {
+	if d.stats == nil {
+		d.stats = d.loadStats()
+	}
+	return d.stats
+}
+
+// query is a parsed find query. It is a boolean expression of terms such as
+// prefix:"task-", size<10000 or value.status:open, combined with AND, OR, NOT and
+// parentheses. Adjacent terms are combined with AND.
+type query struct {
+	match func(doc *findDoc) bool
+	terms int
+	// stats is set when a term needs the access statistics of keys
+	stats bool
+}
+
+// queryParser parses a query by recursive descent
+type queryParser struct {
+	input string
+	pos   int
+	depth int
+	q     *query
+}
+
+func parseQuery(input string) (*query, error) {
+	if strings.TrimSpace(input) == "" {
+		return nil, fmt.Errorf("query is required")
+	}
+	if len(input) > maxQueryLength {
+		return nil, fmt.Errorf("query can be at most %d characters", maxQueryLength)
+	}
+	p := &queryParser{input: input, q: &query{}}
+	match, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.input) {
+		return nil, p.errorf("unexpected %q", p.input[p.pos:])
+	}
+	p.q.match = match
+	return p.q, nil
+}
+
+func (p *queryParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("invalid query at position %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *queryParser) skipSpace() {
+	for p.pos < len(p.input) && unicode.IsSpace(rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// keyword consumes a keyword such as AND when it is next, in any case
+func (p *queryParser) keyword(word string) bool {
+	p.skipSpace()
+	end := p.pos + len(word)
+	if end > len(p.input) || !strings.EqualFold(p.input[p.pos:end], word) {
+		return false
+	}
+	if end < len(p.input) && !unicode.IsSpace(rune(p.input[end])) && p.input[end] != '(' {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+func (p *queryParser) parseOr() (func(*findDoc) bool, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(doc *findDoc) bool { return l(doc) || right(doc) }
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (func(*findDoc) bool, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if !p.keyword("AND") {
+			// Terms follow each other without AND, unless the expression ends
+			p.skipSpace()
+			if p.pos >= len(p.input) || p.input[p.pos] == ')' || p.peekKeyword("OR") {
+				return left, nil
+			}
+		}
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(doc *findDoc) bool { return l(doc) && right(doc) }
+	}
+}
+
+func (p *queryParser) peekKeyword(word string) bool {
+	pos := p.pos
+	ok := p.keyword(word)
+	p.pos = pos
+	return ok
+}
+
+func (p *queryParser) parseNot() (func(*findDoc) bool, error) {
+	if p.keyword("NOT") {
+		inner, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return func(doc *findDoc) bool { return !inner(doc) }, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *queryParser) parsePrimary() (func(*findDoc) bool, error) {
+	p.skipSpace()
+	if p.pos >= len(p.input) {
+		return nil, p.errorf("expected a term")
+	}
+	if p.input[p.pos] != '(' {
+		return p.parseTerm()
+	}
+	if p.depth++; p.depth > maxQueryDepth {
+		return nil, p.errorf("parentheses can be nested at most %d deep", maxQueryDepth)
+	}
+	p.pos++
+	inner, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos >= len(p.input) || p.input[p.pos] != ')' {
+		return nil, p.errorf("expected )")
+	}
+	p.pos++
+	p.depth--
+	return inner, nil
+}
+
+// parseTerm parses field, operator and value, such as size<10000 or prefix:"task-"
+func (p *queryParser) parseTerm() (func(*findDoc) bool, error) {
+	if p.q.terms++; p.q.terms > maxQueryTerms {
+		return nil, p.errorf("a query can have at most %d terms", maxQueryTerms)
+	}
+	start := p.pos
+	for p.pos < len(p.input) && (isFieldChar(p.input[p.pos])) {
+		p.pos++
+	}
+	field := p.input[start:p.pos]
+	if field == "" {
+		return nil, p.errorf("expected a field such as key, prefix, size or updated")
+	}
+	op := ""
+	for _, candidate := range []string{"!=", "<=", ">=", ":", "=", "<", ">"} {
+		if strings.HasPrefix(p.input[p.pos:], candidate) {
+			op = candidate
+			break
+		}
+	}
+	if op == "" {
+		return nil, p.errorf("expected an operator after %s, one of : = != < <= > >=", field)
+	}
+	p.pos += len(op)
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	match, err := compileTerm(field, op, value)
+	if err != nil {
+		return nil, p.errorf("%v", err)
+	}
+	if statsFields[field] {
+		p.q.stats = true
+	}
+	return match, nil
+}
+
+func isFieldChar(c byte) bool {
+	return c == '_' || c == '.' || c == '-' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// parseValue parses a quoted string, in which \" and \\ are escapes, or a bare word
+func (p *queryParser) parseValue() (string, error) {
+	if p.pos < len(p.input) && p.input[p.pos] == '"' {
+		var value strings.Builder
+		for p.pos++; p.pos < len(p.input); p.pos++ {
+			switch c := p.input[p.pos]; {
+			case c == '"':
+				p.pos++
+				return value.String(), nil
+			case c == '\\' && p.pos+1 < len(p.input):
+				p.pos++
+				value.WriteByte(p.input[p.pos])
+			default:
+				value.WriteByte(c)
+			}
+		}
+		return "", p.errorf("unterminated quoted value")
+	}
+	start := p.pos
+	for p.pos < len(p.input) && !unicode.IsSpace(rune(p.input[p.pos])) && p.input[p.pos] != '(' && p.input[p.pos] != ')' {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", p.errorf("expected a value")
+	}
+	return p.input[start:p.pos], nil
+}
+
+// statsFields are the fields read from the access statistics of keys
+var statsFields = map[string]bool{"reads": true, "writes": true, "last_read": true, "last_write": true, "last_access": true}
+
+// compileTerm builds the predicate of a term
+func compileTerm(field, op, value string) (func(*findDoc) bool, error) {
+	switch field {
+	case "key":
+		return compareStrings(op, value, func(doc *findDoc) (string, bool) { return doc.key, true })
+	case "prefix", "pattern", "tag", "contains":
+		if op != ":" && op != "=" {
+			return nil, fmt.Errorf("%s only takes :", field)
+		}
+	}
+	switch field {
+	case "prefix":
+		return func(doc *findDoc) bool { return strings.HasPrefix(doc.key, value) }, nil
+	case "pattern":
+		if _, err := path.Match(value, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q", value)
+		}
+		return func(doc *findDoc) bool { ok, _ := path.Match(value, doc.key); return ok }, nil
+	case "contains":
+		return func(doc *findDoc) bool { return strings.Contains(string(doc.value), value) }, nil
+	case "tag":
+		// Keys have no tags of their own, so tags are those of values holding a JSON object
+		// with a tags array
+		return func(doc *findDoc) bool {
+			object, _ := doc.json().(map[string]any)
+			tags, _ := object["tags"].([]any)
+			return slices.Contains(tags, any(value))
+		}, nil
+	case "size":
+		return compareNumbers(op, value, func(doc *findDoc) (float64, bool) { return float64(len(doc.value)), true })
+	case "revision":
+		return compareNumbers(op, value, func(doc *findDoc) (float64, bool) { return float64(doc.revision), true })
+	case "reads":
+		return compareNumbers(op, value, func(doc *findDoc) (float64, bool) { return float64(doc.keyStats().Reads), true })
+	case "writes":
+		return compareNumbers(op, value, func(doc *findDoc) (float64, bool) { return float64(doc.keyStats().Writes), true })
+	case "updated", "modified":
+		return compareTimes(op, value, func(doc *findDoc) time.Time { return doc.modified })
+	case "updated_after", "modified_after":
+		return compareTimes(">", value, func(doc *findDoc) time.Time { return doc.modified })
+	case "updated_before", "modified_before":
+		return compareTimes("<", value, func(doc *findDoc) time.Time { return doc.modified })
+	case "last_read":
+		return compareTimes(op, value, func(doc *findDoc) time.Time { return doc.keyStats().LastRead })
+	case "last_write":
+		return compareTimes(op, value, func(doc *findDoc) time.Time { return doc.keyStats().LastWrite })
+	case "last_access":
+		return compareTimes(op, value, func(doc *findDoc) time.Time { return doc.keyStats().LastAccess })
+	}
+	if fieldPath, ok := strings.CutPrefix(field, "value."); ok && fieldPath != "" {
+		return compareJSONField(op, value, strings.Split(fieldPath, "."))
+	}
+	return nil, fmt.Errorf("unknown field %q", field)
+}
+
+// compareResult reports whether the comparison of a value with the term's value, as -1, 0
+// or 1, satisfies an operator
+func compareResult(op string, c int) bool {
+	switch op {
+	case ":", "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+func compareStrings(op, value string, get func(*findDoc) (string, bool)) (func(*findDoc) bool, error) {
+	return func(doc *findDoc) bool {
+		s, ok := get(doc)
+		return ok && compareResult(op, strings.Compare(s, value))
+	}, nil
+}
+
+func compareNumbers(op, value string, get func(*findDoc) (float64, bool)) (func(*findDoc) bool, error) {
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a number", value)
+	}
+	return func(doc *findDoc) bool {
+		n, ok := get(doc)
+		if !ok {
+			return false
+		}
+		switch {
+		case n < number:
+			return compareResult(op, -1)
+		case n > number:
+			return compareResult(op, 1)
+		}
+		return compareResult(op, 0)
+	}, nil
+}
+
+// parseQueryTime parses the time of a term: a date, an RFC 3339 time, or an age such as 24h
+// or 7d before now
+func parseQueryTime(value string) (time.Time, error) {
+	if day, err := time.Parse(time.DateOnly, value); err == nil {
+		return day, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n >= 0 {
+			return time.Now().AddDate(0, 0, -n), nil
+		}
+	}
+	if age, err := time.ParseDuration(value); err == nil && age >= 0 {
+		return time.Now().Add(-age), nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date, time or age such as 2024-06-01, 2024-06-01T12:00:00Z or 7d", value)
+}
+
+func compareTimes(op, value string, get func(*findDoc) time.Time) (func(*findDoc) bool, error) {
+	at, err := parseQueryTime(value)
+	if err != nil {
+		return nil, err
+	}
+	return func(doc *findDoc) bool {
+		t := get(doc)
+		// Keys never read or written have no time to compare
+		return !t.IsZero() && compareResult(op, t.Compare(at))
+	}, nil
+}
+
+// jsonField returns the field of a decoded JSON value at a path of object field names
+func jsonField(data any, fieldPath []string) (any, bool) {
+	for _, name := range fieldPath {
+		object, ok := data.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if data, ok = object[name]; !ok {
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+// compareJSONField compares a field of values holding JSON objects, numerically when both
+// are numbers and as text otherwise. Values without the field don't match.
+func compareJSONField(op, value string, fieldPath []string) (func(*findDoc) bool, error) {
+	number, numErr := strconv.ParseFloat(value, 64)
+	return func(doc *findDoc) bool {
+		current, ok := jsonField(doc.json(), fieldPath)
+		if !ok {
+			return false
+		}
+		switch v := current.(type) {
+		case float64:
+			if numErr == nil {
+				switch {
+				case v < number:
+					return compareResult(op, -1)
+				case v > number:
+					return compareResult(op, 1)
+				}
+				return compareResult(op, 0)
+			}
+			return compareResult(op, strings.Compare(strconv.FormatFloat(v, 'f', -1, 64), value))
+		case string:
+			return compareResult(op, strings.Compare(v, value))
+		case bool:
+			return compareResult(op, strings.Compare(strconv.FormatBool(v), value))
+		case nil:
+			return compareResult(op, strings.Compare("null", value))
+		}
+		return false
+	}, nil
+}
+
+// handleFind returns the keys matching a query on their names, metadata and values, so
+// clients can select keys in one request instead of listing and reading them all
+func (s *Server) handleFind(w http.ResponseWriter, r *http.Request) {
+	var req FindRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = defaultFindLimit
+	}
+	if req.Limit < 1 || req.Limit > maxFindLimit {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("limit must be between 1 and %d", maxFindLimit)})
+		return
+	}
+	q, err := parseQuery(req.Query)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	prefixes, err := s.getReadPrefixes(r, req.Scope)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	// Keys are found once, at the level reads see them
+	canRead := s.readFilter(r)
+	result := FindResult{Keys: make([]FoundKey, 0)}
+	seen := map[string]bool{}
+	for _, prefix := range prefixes {
+		bucket, err := s.getBucket(prefix)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		err = scanBucket(bucket, func(entry nats.KeyValueEntry) {
+			key := entry.Key()
+			if seen[key] || !canRead(key) {
+				return
+			}
+			seen[key] = true
+			result.Scanned++
+			doc := &findDoc{
+				key:       key,
+				revision:  entry.Revision(),
+				modified:  entry.Created(),
+				value:     entry.Value(),
+				loadStats: func() *KeyStats { return s.getKeyStats(prefix, key) },
+			}
+			if !q.match(doc) {
+				return
+			}
+			found := FoundKey{KeyMetadata: KeyMetadata{Key: key, Revision: doc.revision, Modified: doc.modified, Size: len(doc.value)}}
+			if q.stats {
+				found.Stats = doc.keyStats()
+			}
+			if req.Values {
+				value := string(doc.value)
+				found.Value = &value
+			}
+			result.Keys = append(result.Keys, found)
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+	}
+
+	slices.SortFunc(result.Keys, func(a, b FoundKey) int { return strings.Compare(a.Key, b.Key) })
+	if len(result.Keys) > int(req.Limit) {
+		result.Keys = result.Keys[:req.Limit]
+		result.Truncated = true
+	}
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: result})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseQuery(t *testing.T) {
+	doc := func(key, value string, modified time.Time) *findDoc {
+		return &findDoc{key: key, value: []byte(value), modified: modified, revision: 3,
+			loadStats: func() *KeyStats { return &KeyStats{Reads: 5, LastRead: modified} }}
+	}
+	june := time.Date(2024, 6, 15, 0, 0, 0, 0, time.UTC)
+	task := doc("task-1", `{"status": "open", "priority": 2, "tags": ["urgent", "ops"], "owner": {"name": "kim"}}`, june)
+	note := doc("note-1", "remember the milk", june.AddDate(0, -2, 0))
+
+	for query, want := range map[string][2]bool{
+		`prefix:"task-" AND updated_after:"2024-06-01" AND size<10000`: {true, false},
+		`prefix:task- size<10`:     {false, false},
+		`key=note-1 OR tag:urgent`: {true, true},
+		`NOT prefix:task-`:         {false, true},
+		`pattern:"*-1" AND NOT (value.status:closed OR value.priority>=3)`: {true, true},
+		`value.priority>1 value.owner.name:kim`:                            {true, false},
+		`contains:milk`:                                                    {false, true},
+		`updated_before:2024-05-01`:                                        {false, true},
+		`revision=3 and reads>=5 and last_read<=2024-06-15T00:00:00Z`:      {true, true},
+		`key!=task-1`: {false, true},
+	} {
+		q, err := parseQuery(query)
+		if err != nil {
+			t.Errorf("%s: %v", query, err)
+			continue
+		}
+		if got := [2]bool{q.match(task), q.match(note)}; got != want {
+			t.Errorf("%s matched %v, want %v", query, got, want)
+		}
+	}
+
+	for _, query := range []string{"", "size<", "size<big", "colour:red", `key:"open`, "(prefix:a", "prefix:a)", "prefix<a", "updated>soon", "AND prefix:a", "pattern:[", "key"} {
+		if _, err := parseQuery(query); err == nil {
+			t.Errorf("parseQuery(%q) succeeded, want an error", query)
+		}
+	}
+	if q, _ := parseQuery("reads>1"); !q.stats {
+		t.Error("a query on reads must load access statistics")
+	}
+	if _, err := parseQuery(strings.Repeat("prefix:a ", maxQueryTerms+1)); err == nil {
+		t.Error("expected an error for too many terms")
+	}
+}
+
+func TestHandleFindValidation(t *testing.T) {
+	s := newTestServer()
+	for _, body := range []string{`{}`, `{"query":"size<"}`, `{"query":"size<1","limit":5000}`, `{"query":"size<1","unknown":1}`, `not json`} {
+		w := httptest.NewRecorder()
+		s.handleFind(w, httptest.NewRequest("POST", "/api/v1/find", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", body, w.Code)
+		}
+	}
+}
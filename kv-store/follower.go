@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// followerSyncTimeout is how long a follower waits at startup for the encryption keys to be
+// mirrored from the primary
+const followerSyncTimeout = 30 * time.Second
+
+// follower runs an instance as a read replica of a primary deployment. Its embedded server
+// connects to the primary's as a leafnode, every bucket and object store is a JetStream
+// mirror of the primary's, and only read endpoints are served. Writes are refused with the
+// URL of the primary.
+type follower struct {
+	// primaryURL is the HTTP URL of the primary, advertised for writes
+	primaryURL string
+	// leafURL is the leafnode URL of the primary, carrying the primary's KV_NATS_PASSWORD
+	leafURL *url.URL
+	// domain is the JetStream domain of the primary, and localDomain this instance's
+	domain      string
+	localDomain string
+}
+
+// newFollower configures read replica mode from KV_PRIMARY_NATS_URL, the leafnode URL of the
+// primary such as nats-leaf://kv-store:<password>@primary:8083, and KV_PRIMARY_URL. It
+// returns nil when no primary is configured.
+func newFollower() (*follower, error) {
+	leafURL := getEnvOrDefault("KV_PRIMARY_NATS_URL", "")
+	if leafURL == "" {
+		return nil, nil
+	}
+	parsed, err := url.Parse(leafURL)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid KV_PRIMARY_NATS_URL %q, must be nats-leaf://kv-store:<password>@host:port", leafURL)
+	}
+	f := &follower{
+		primaryURL:  getEnvOrDefault("KV_PRIMARY_URL", ""),
+		leafURL:     parsed,
+		domain:      getEnvOrDefault("KV_PRIMARY_DOMAIN", "primary"),
+		localDomain: getEnvOrDefault("KV_JETSTREAM_DOMAIN", "follower"),
+	}
+	if f.primaryURL == "" {
+		return nil, fmt.Errorf("KV_PRIMARY_URL is required with KV_PRIMARY_NATS_URL, writes are sent there")
+	}
+	if f.domain == f.localDomain {
+		return nil, fmt.Errorf("KV_JETSTREAM_DOMAIN must differ from the primary's domain %q", f.domain)
+	}
+	return f, nil
+}
+
+// apply connects the embedded server to the primary's as a leafnode. Each side keeps its
+// own JetStream domain, so API requests are only forwarded to the primary when addressed
+// to its domain.
+func (f *follower) apply(opts *server.Options) {
+	opts.JetStreamDomain = f.localDomain
+	opts.LeafNode.Remotes = append(opts.LeafNode.Remotes, &server.RemoteLeafOpts{
+		URLs: []*url.URL{f.leafURL},
+	})
+}
+
+// configurePrimary opens a leafnode port for followers when KV_LEAFNODE_PORT is set. Followers
+// authenticate as the internal user, and address this server's JetStream API through its
+// domain, KV_JETSTREAM_DOMAIN.
+func configurePrimary(opts *server.Options, password string) error {
+	value := getEnvOrDefault("KV_LEAFNODE_PORT", "")
+	if value == "" {
+		return nil
+	}
+	port, err := strconv.Atoi(value)
+	if err != nil || port <= 0 {
+		return fmt.Errorf("invalid KV_LEAFNODE_PORT: must be a port number")
+	}
+	opts.LeafNode.Host = opts.Host
+	opts.LeafNode.Port = port
+	opts.LeafNode.Username = natsInternalUser
+	opts.LeafNode.Password = password
+	opts.JetStreamDomain = getEnvOrDefault("KV_JETSTREAM_DOMAIN", "primary")
+	return nil
+}
+
+// source is the stream a local bucket or object store mirrors
+func (f *follower) source(stream string) *nats.StreamSource {
+	return &nats.StreamSource{Name: stream, Domain: f.domain}
+}
+
+// runFollower mirrors every bucket and object store of the primary as they are created, so
+// they are in sync before they are first read
+func (s *Server) runFollower() {
+	if s.follower == nil {
+		return
+	}
+	for {
+		if err := s.mirrorPrimary(); err != nil {
+			log.Printf("Failed to mirror the primary: %v", err)
+		}
+		time.Sleep(replicationDiscoveryInterval)
+	}
+}
+
+// mirrorPrimary creates a mirror of each bucket and object store of the primary that isn't
+// mirrored yet
+func (s *Server) mirrorPrimary() error {
+	primary, err := s.nc.JetStream(nats.Domain(s.follower.domain))
+	if err != nil {
+		return err
+	}
+	for name := range primary.KeyValueStoreNames() {
+		if _, err := s.getRawBucket(name); err != nil {
+			log.Printf("Failed to mirror bucket %s: %v", name, err)
+		}
+	}
+	for name := range primary.ObjectStoreNames() {
+		if _, err := s.getObjectStore(name); err != nil {
+			log.Printf("Failed to mirror object store %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// createObjectStoreMirror creates a local object store mirroring the primary's
+func (s *Server) createObjectStoreMirror(js nats.JetStreamContext, prefix string) error {
+	stream := "OBJ_" + prefix
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     stream,
+		Storage:  nats.FileStorage,
+		Replicas: s.durability.bucketReplicas(bucketClassObjects),
+		Mirror:   s.follower.source(stream),
+	})
+	return err
+}
+
+// rejectWrite refuses requests a follower can't serve, pointing the client at the primary
+func (s *Server) rejectWrite(w http.ResponseWriter, r *http.Request) bool {
+	if s.follower == nil || readOnlyRoutes[r.URL.Path] || followerAdminRoutes[r.URL.Path] {
+		return false
+	}
+	w.Header().Set("X-KV-Primary", s.follower.primaryURL)
+	w.WriteHeader(http.StatusMisdirectedRequest)
+	json.NewEncoder(w).Encode(KVResponse{
+		Success: false,
+		Error:   fmt.Sprintf("this instance is a read replica, send %s to the primary at %s", r.URL.Path, s.follower.primaryURL+r.URL.Path),
+	})
+	return true
+}
+
+// followerAdminRoutes are the admin endpoints a follower serves, as they only read
+var followerAdminRoutes = map[string]bool{
+	"/api/admin/hot-keys":          true,
+	"/api/admin/cache":             true,
+	"/api/admin/shards":            true,
+	"/api/admin/buckets":           true,
+	"/api/admin/health":            true,
+	"/api/admin/acl/list":          true,
+	"/api/admin/pii/policy/get":    true,
+	"/api/admin/pii/audit":         true,
+	"/api/admin/keys/list":         true,
+	"/api/admin/usage":             true,
+	"/api/admin/replication":       true,
+	"/api/admin/encryption/status": true,
+	"/api/admin/verify":            true,
+	"/api/admin/backup/status":     true,
+}
+
+// status reports the primary a follower mirrors for the readiness endpoint
+func (f *follower) status() map[string]interface{} {
+	return map[string]interface{}{
+		"primary": f.primaryURL,
+		"domain":  f.domain,
+	}
+}
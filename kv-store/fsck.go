@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// BrokenObject is an object that can't be read back intact
+type BrokenObject struct {
+	Store string `json:"store"`
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// FsckReport lists what a scrub found and removed, or would remove in a dry run
+type FsckReport struct {
+	DryRun    bool `json:"dry_run"`
+	Buckets   int  `json:"buckets"`
+	Revisions int  `json:"revisions"`
+	Objects   int  `json:"objects"`
+	// Revisions that don't match their checksum or can't be read back
+	BrokenRevisions []CorruptEntry `json:"broken_revisions"`
+	// How the keys with broken revisions were repaired
+	RepairedKeys []string `json:"repaired_keys"`
+	// Objects whose manifest lists chunks that are missing, or whose content doesn't match
+	// its digest
+	BrokenObjects []BrokenObject `json:"broken_objects"`
+	// Chunks left behind by objects that no longer exist
+	OrphanedChunks []string `json:"orphaned_chunks"`
+	// Metadata and index records pointing at keys, objects or parts that don't exist
+	StaleRecords []string `json:"stale_records"`
+	// Changes that are missing from the journal, which a replay won't make
+	JournalGaps []JournalGap `json:"journal_gaps"`
+}
+
+// fsck scans the store and removes what can't be read back, then the records that pointed
+// at it. Keys with broken revisions are reset to their latest revision that can be read, or
+// deleted if there is none.
+func (s *Server) fsck(dryRun bool) (*FsckReport, error) {
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+	report := &FsckReport{
+		DryRun:          dryRun,
+		BrokenRevisions: make([]CorruptEntry, 0),
+		RepairedKeys:    make([]string, 0),
+		BrokenObjects:   make([]BrokenObject, 0),
+		OrphanedChunks:  make([]string, 0),
+		StaleRecords:    make([]string, 0),
+		JournalGaps:     make([]JournalGap, 0),
+	}
+
+	names, err := s.listDataBuckets()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if err := s.fsckBucket(js, name, report); err != nil {
+			return nil, err
+		}
+	}
+
+	var stores []string
+	for name := range js.ObjectStoreNames() {
+		stores = append(stores, strings.TrimPrefix(name, "OBJ_"))
+	}
+	for _, name := range stores {
+		if err := s.fsckObjectStore(js, name, report); err != nil {
+			return nil, err
+		}
+	}
+
+	bucketNames, err := s.listBucketNames()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range bucketNames {
+		var err error
+		switch {
+		case strings.HasSuffix(name, "-stats"):
+			err = s.fsckStats(name, report)
+		case strings.HasSuffix(name, "-artifacts"):
+			err = s.fsckArtifacts(name, report)
+		case strings.HasSuffix(name, "-uploads"):
+			err = s.fsckUploads(name, report)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to check %s: %v", name, err)
+		}
+	}
+
+	if s.journal != nil {
+		if report.JournalGaps, err = s.listJournalGaps(); err != nil {
+			return nil, fmt.Errorf("failed to list the journal gaps: %v", err)
+		}
+	}
+	return report, nil
+}
+
+// fsckBucket repairs the keys of a data bucket with revisions that don't match their
+// checksum or can't be rebuilt. Streams backing buckets don't allow removing single
+// revisions, so the latest revision of the key that can be read is stored again in full and
+// the revisions before it are purged, or the key is deleted if no revision can be read.
+func (s *Server) fsckBucket(js nats.JetStreamContext, name string, report *FsckReport) error {
+	result := &VerifyResult{}
+	if err := s.verifyBucket(name, result); err != nil {
+		return fmt.Errorf("failed to check %s: %v", name, err)
+	}
+	report.Buckets++
+	report.Revisions += result.Revisions
+	report.BrokenRevisions = append(report.BrokenRevisions, result.Corrupt...)
+
+	var keys []string
+	for _, entry := range result.Corrupt {
+		if !slices.Contains(keys, entry.Key) {
+			keys = append(keys, entry.Key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	stored, err := js.KeyValue(name)
+	if err != nil {
+		return err
+	}
+	raw, err := s.getRawBucket(name)
+	if err != nil {
+		return err
+	}
+	bucket := s.wrapDataBucket(raw)
+
+	for _, key := range keys {
+		// Find the latest revision that can be read back
+		revisions, err := stored.History(key)
+		if err != nil && !errors.Is(err, nats.ErrKeyNotFound) {
+			return fmt.Errorf("failed to read the history of %s/%s: %v", name, key, err)
+		}
+		var keep nats.KeyValueEntry
+		for i := len(revisions) - 1; i >= 0 && keep == nil; i-- {
+			if revisions[i].Operation() != nats.KeyValuePut {
+				break
+			}
+			if entry, err := bucket.GetRevision(key, revisions[i].Revision()); err == nil {
+				keep = entry
+			}
+		}
+
+		repair := fmt.Sprintf("%s/%s: deleted, no revision can be read", name, key)
+		if keep != nil {
+			repair = fmt.Sprintf("%s/%s: reset to revision %d", name, key, keep.Revision())
+		}
+		report.RepairedKeys = append(report.RepairedKeys, repair)
+		if report.DryRun {
+			continue
+		}
+
+		var revision uint64
+		if keep == nil {
+			err = raw.Delete(key)
+			if err == nil {
+				revision, err = lastRevision(stored, key)
+			}
+		} else {
+			value := keep.Value()
+			if s.encryption != nil {
+				value, err = s.encryption.encrypt(value)
+			}
+			if err == nil {
+				revision, err = raw.Put(key, value)
+			}
+		}
+		if err == nil {
+			err = js.PurgeStream("KV_"+name, &nats.StreamPurgeRequest{Subject: "$KV." + name + "." + key, Sequence: revision})
+		}
+		if err != nil {
+			return fmt.Errorf("failed to repair %s/%s: %v", name, key, err)
+		}
+	}
+	return nil
+}
+
+// lastRevision returns the revision of the latest change of a key, including deletes
+func lastRevision(bucket nats.KeyValue, key string) (uint64, error) {
+	revisions, err := bucket.History(key)
+	if err != nil {
+		return 0, err
+	}
+	return revisions[len(revisions)-1].Revision(), nil
+}
+
+// fsckObjectStore removes the objects of a store whose chunks are missing or don't match
+// their digest, and the chunks no object refers to
+func (s *Server) fsckObjectStore(js nats.JetStreamContext, name string, report *FsckReport) error {
+	store, err := js.ObjectStore(name)
+	if err != nil {
+		return fmt.Errorf("failed to open object store %s: %v", name, err)
+	}
+	chunkPrefix := "$O." + name + ".C."
+	info, err := js.StreamInfo("OBJ_"+name, &nats.StreamInfoRequest{SubjectsFilter: chunkPrefix + ">"})
+	if err != nil {
+		return fmt.Errorf("failed to read the chunks of %s: %v", name, err)
+	}
+	chunks := info.State.Subjects
+
+	objects, err := store.List()
+	if err != nil && !errors.Is(err, nats.ErrNoObjectsFound) {
+		return fmt.Errorf("failed to list object store %s: %v", name, err)
+	}
+	referenced := map[string]bool{}
+	for _, object := range objects {
+		if object.Opts != nil && object.Opts.Link != nil {
+			continue
+		}
+		report.Objects++
+		subject := chunkPrefix + object.NUID
+		referenced[subject] = true
+
+		var problem string
+		if stored := chunks[subject]; stored != uint64(object.Chunks) {
+			problem = fmt.Sprintf("%d of %d chunks are missing", uint64(object.Chunks)-min(stored, uint64(object.Chunks)), object.Chunks)
+		} else if err := readObject(store, object.Name); err != nil {
+			problem = err.Error()
+		}
+		if problem == "" {
+			continue
+		}
+		report.BrokenObjects = append(report.BrokenObjects, BrokenObject{Store: name, Name: object.Name, Error: problem})
+		if !report.DryRun {
+			if err := store.Delete(object.Name); err != nil {
+				return fmt.Errorf("failed to remove %s/%s: %v", name, object.Name, err)
+			}
+		}
+	}
+
+	for subject := range chunks {
+		if referenced[subject] {
+			continue
+		}
+		report.OrphanedChunks = append(report.OrphanedChunks, subject)
+		if !report.DryRun {
+			if err := js.PurgeStream("OBJ_"+name, &nats.StreamPurgeRequest{Subject: subject}); err != nil {
+				return fmt.Errorf("failed to remove chunks %s: %v", subject, err)
+			}
+		}
+	}
+	return nil
+}
+
+// readObject reads an object to its end, which checks its digest
+func readObject(store nats.ObjectStore, name string) error {
+	result, err := store.Get(name)
+	if err != nil {
+		return err
+	}
+	defer result.Close()
+	_, err = io.Copy(io.Discard, result)
+	return err
+}
+
+// removeStaleRecord reports a record and purges it unless this is a dry run
+func removeStaleRecord(bucket nats.KeyValue, key, reason string, report *FsckReport) error {
+	report.StaleRecords = append(report.StaleRecords, fmt.Sprintf("%s/%s: %s", bucket.Bucket(), key, reason))
+	if report.DryRun {
+		return nil
+	}
+	return bucket.Purge(key)
+}
+
+// fsckStats removes the access statistics of keys that no longer exist
+func (s *Server) fsckStats(name string, report *FsckReport) error {
+	data, err := s.getBucket(strings.TrimSuffix(name, "-stats"))
+	if err != nil {
+		return err
+	}
+	bucket, err := s.getBucket(name)
+	if err != nil {
+		return err
+	}
+	var stale []string
+	err = scanBucket(bucket, func(entry nats.KeyValueEntry) {
+		if _, err := data.Get(entry.Key()); errors.Is(err, nats.ErrKeyNotFound) {
+			stale = append(stale, entry.Key())
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range stale {
+		if err := removeStaleRecord(bucket, key, "the key doesn't exist", report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fsckArtifacts removes the metadata of artifacts whose object is gone
+func (s *Server) fsckArtifacts(name string, report *FsckReport) error {
+	store, err := s.getObjectStore(strings.TrimSuffix(name, "-artifacts"))
+	if err != nil {
+		return err
+	}
+	bucket, err := s.getBucket(name)
+	if err != nil {
+		return err
+	}
+	stale := map[string]string{}
+	err = scanBucket(bucket, func(entry nats.KeyValueEntry) {
+		var artifact Artifact
+		if err := json.Unmarshal(entry.Value(), &artifact); err != nil {
+			stale[entry.Key()] = "invalid artifact metadata"
+		} else if _, err := store.GetInfo(artifact.Object); err != nil {
+			stale[entry.Key()] = fmt.Sprintf("object %s is missing", artifact.Object)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for key, reason := range stale {
+		if err := removeStaleRecord(bucket, key, reason, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fsckUploads removes the records of upload parts whose object is gone, so the part can be
+// uploaded again, and of parts of uploads that no longer exist
+func (s *Server) fsckUploads(name string, report *FsckReport) error {
+	store, err := s.getObjectStore(strings.TrimSuffix(name, "-uploads"))
+	if err != nil {
+		return err
+	}
+	bucket, err := s.getBucket(name)
+	if err != nil {
+		return err
+	}
+	uploads := map[string]bool{}
+	parts := map[string]UploadPart{}
+	stale := map[string]string{}
+	err = scanBucket(bucket, func(entry nats.KeyValueEntry) {
+		id, _, isPart := strings.Cut(entry.Key(), ".part.")
+		if !isPart {
+			uploads[id] = true
+			return
+		}
+		var part UploadPart
+		if err := json.Unmarshal(entry.Value(), &part); err != nil {
+			stale[entry.Key()] = "invalid part record"
+			return
+		}
+		parts[entry.Key()] = part
+	})
+	if err != nil {
+		return err
+	}
+	for key, part := range parts {
+		id, _, _ := strings.Cut(key, ".part.")
+		if !uploads[id] {
+			stale[key] = fmt.Sprintf("upload %s doesn't exist", id)
+		} else if _, err := store.GetInfo(uploadPartObject(id, part.Number)); err != nil {
+			stale[key] = fmt.Sprintf("part %d is missing", part.Number)
+		}
+	}
+	for key, reason := range stale {
+		if err := removeStaleRecord(bucket, key, reason, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrintFsckReport(t *testing.T) {
+	var out bytes.Buffer
+	printFsckReport(&out, &FsckReport{Buckets: 2, Revisions: 10})
+	if !strings.Contains(out.String(), "No problems found") {
+		t.Errorf("clean report = %q", out.String())
+	}
+
+	out.Reset()
+	printFsckReport(&out, &FsckReport{
+		DryRun:          true,
+		BrokenRevisions: []CorruptEntry{{Bucket: "b", Key: "k", Revision: 3, Error: "checksum mismatch"}},
+		RepairedKeys:    []string{"b/k: reset to revision 2"},
+		OrphanedChunks:  []string{"$O.b.C.x"},
+		JournalGaps:     []JournalGap{{Bucket: "b", Key: "j", Time: time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC), Error: "no responders"}},
+	})
+	for _, want := range []string{"Broken revision 3 of b/k", "Would repair b/k: reset to revision 2", "Would remove orphaned chunks $O.b.C.x", "Change to b/j at 2024-06-01T12:00:00Z is missing from the journal: no responders"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report %q is missing %q", out.String(), want)
+		}
+	}
+	if strings.Contains(out.String(), "No problems found") {
+		t.Errorf("report with problems says there are none")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type OutputGCRequest struct {
+	Workspace string `json:"workspace,omitempty"`
+	Prefix    string `json:"prefix,omitempty"`
+	OlderThan string `json:"older_than,omitempty"`
+	DryRun    bool   `json:"dry_run,omitempty"`
+}
+
+type OutputGCResult struct {
+	DryRun         bool     `json:"dry_run"`
+	Scanned        int      `json:"scanned"`
+	Removed        []string `json:"removed"`
+	ReclaimedBytes int      `json:"reclaimed_bytes"`
+	// Untracked counts output keys that were kept because no write was ever recorded for
+	// them, such as keys stored before access statistics existed
+	Untracked int `json:"untracked"`
+}
+
+// collectOutputs removes output-filter keys in a workspace that were never read and are
+// older than maxAge. Only keys with a recorded write are considered, since a missing stats
+// record says nothing about whether the key was read.
+func (s *Server) collectOutputs(prefix string, maxAge time.Duration, dryRun bool, result *OutputGCResult) error {
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-maxAge)
+	var orphaned []nats.KeyValueEntry
+	err = scanBucket(bucket, func(entry nats.KeyValueEntry) {
+		if !strings.HasPrefix(entry.Key(), "output-") {
+			return
+		}
+		result.Scanned++
+		if entry.Created().After(cutoff) {
+			return
+		}
+		stats := s.getKeyStats(prefix, entry.Key())
+		if stats.Writes == 0 {
+			result.Untracked++
+			return
+		}
+		if stats.Reads > 0 {
+			return
+		}
+		orphaned = append(orphaned, entry)
+	})
+	if err != nil {
+		return err
+	}
+
+	var removed []string
+	for _, entry := range orphaned {
+		if !dryRun {
+			if err := bucket.Purge(entry.Key()); err != nil {
+				log.Printf("Failed to remove orphaned output %s/%s: %v", prefix, entry.Key(), err)
+				continue
+			}
+			s.deleteKeyStats(prefix, entry.Key())
+			removed = append(removed, entry.Key())
+		}
+		result.Removed = append(result.Removed, entry.Key())
+		result.ReclaimedBytes += len(entry.Value())
+	}
+	if len(removed) > 0 {
+		s.notifyKeys(prefix, webhookEventExpired, "expire", "retention", removed)
+	}
+	return nil
+}
+
+// collectAllOutputs runs output garbage collection across the given workspaces
+func (s *Server) collectAllOutputs(prefixes []string, maxAge time.Duration, dryRun bool) (*OutputGCResult, error) {
+	// Flush first so recent reads protect their keys
+	s.flushStats()
+
+	result := &OutputGCResult{
+		DryRun:  dryRun,
+		Removed: make([]string, 0),
+	}
+	for _, prefix := range prefixes {
+		// Shards are collected with their workspace
+		if isShardBucket(prefix) {
+			continue
+		}
+		if err := s.collectOutputs(prefix, maxAge, dryRun, result); err != nil {
+			return nil, fmt.Errorf("failed to collect outputs for %s: %v", prefix, err)
+		}
+	}
+	return result, nil
+}
+
+// runOutputGC periodically removes orphaned output-filter keys from all workspaces
+func (s *Server) runOutputGC(interval, maxAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		prefixes, err := s.listDataBuckets()
+		if err != nil {
+			log.Printf("Output GC failed to list workspaces: %v", err)
+			continue
+		}
+		result, err := s.collectAllOutputs(prefixes, maxAge, false)
+		if err != nil {
+			log.Printf("Output GC failed: %v", err)
+			continue
+		}
+		log.Printf("Output GC removed %d of %d output keys, reclaimed %d bytes, skipped %d untracked", len(result.Removed), result.Scanned, result.ReclaimedBytes, result.Untracked)
+	}
+}
+
+func (s *Server) handleOutputGC(w http.ResponseWriter, r *http.Request) {
+	var req OutputGCRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+
+	maxAge := s.outputGCAge
+	if req.OlderThan != "" {
+		var err error
+		maxAge, err = time.ParseDuration(req.OlderThan)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid older_than: %v", err)})
+			return
+		}
+	}
+
+	var prefixes []string
+	switch {
+	case req.Prefix != "":
+		prefixes = []string{req.Prefix}
+	case req.Workspace != "":
+		prefixes = []string{getWorkspacePrefix(req.Workspace)}
+		partitions, err := s.listPartitions(prefixes[0])
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		prefixes = append(prefixes, partitions...)
+	default:
+		var err error
+		prefixes, err = s.listDataBuckets()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+	}
+
+	result, err := s.collectAllOutputs(prefixes, maxAge, req.DryRun)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: result})
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// maxReportedConsumers bounds the consumers a health report lists, the furthest behind first
+const maxReportedConsumers = 20
+
+// healthMonitor reports whether the store can keep taking writes and keep its consumers up
+// to date. storageDir and maxStore are set once the NATS server they describe is running.
+type healthMonitor struct {
+	storageDir string
+	maxStore   int64
+	// warnUsage is the share of the store limit or the disk above which the store is degraded
+	warnUsage float64
+	// warnLag is the pending messages of a consumer or mirror above which it is degraded
+	warnLag uint64
+}
+
+// HealthReport is the state of the store's storage and of everything reading from it
+type HealthReport struct {
+	Status    string         `json:"status"`
+	Problems  []string       `json:"problems,omitempty"`
+	Storage   StorageHealth  `json:"storage"`
+	Disk      *DiskHealth    `json:"disk,omitempty"`
+	Consumers ConsumerHealth `json:"consumers"`
+	Mirrors   []MirrorLag    `json:"mirrors,omitempty"`
+	Webhooks  WebhookHealth  `json:"webhooks"`
+}
+
+// StorageHealth is the JetStream storage used against its limits, where -1 is no limit
+type StorageHealth struct {
+	StoreBytes  uint64  `json:"store_bytes"`
+	StoreLimit  int64   `json:"store_limit"`
+	StoreUsage  float64 `json:"store_usage,omitempty"`
+	MemoryBytes uint64  `json:"memory_bytes"`
+	MemoryLimit int64   `json:"memory_limit"`
+	Streams     int     `json:"streams"`
+}
+
+// DiskHealth is the space of the file system the store keeps its data in
+type DiskHealth struct {
+	Path       string  `json:"path"`
+	FreeBytes  uint64  `json:"free_bytes"`
+	TotalBytes uint64  `json:"total_bytes"`
+	Usage      float64 `json:"usage"`
+	ReadOnly   bool    `json:"read_only,omitempty"`
+}
+
+// ConsumerHealth sums up the consumers of every stream, such as watches and computed keys,
+// and lists the ones with messages still to deliver
+type ConsumerHealth struct {
+	Count      int           `json:"count"`
+	MaxPending uint64        `json:"max_pending"`
+	Lagging    []ConsumerLag `json:"lagging,omitempty"`
+}
+
+type ConsumerLag struct {
+	Stream     string `json:"stream"`
+	Consumer   string `json:"consumer"`
+	Pending    uint64 `json:"pending"`
+	AckPending int    `json:"ack_pending"`
+}
+
+// MirrorLag is how far a mirrored bucket of a follower is behind the primary
+type MirrorLag struct {
+	Stream string `json:"stream"`
+	Lag    uint64 `json:"lag"`
+	Active string `json:"last_active"`
+}
+
+type WebhookHealth struct {
+	Pending   int64 `json:"pending"`
+	Failing   int   `json:"failing_targets"`
+	Suspended int   `json:"suspended_targets"`
+}
+
+// newHealthMonitor reads KV_HEALTH_WARN_USAGE, the share of storage or disk used above
+// which the store reports degraded health, and KV_HEALTH_WARN_LAG, the messages a consumer
+// or mirror may be behind
+func newHealthMonitor() (*healthMonitor, error) {
+	warnUsage, err := strconv.ParseFloat(getEnvOrDefault("KV_HEALTH_WARN_USAGE", "0.85"), 64)
+	if err != nil || warnUsage <= 0 || warnUsage > 1 {
+		return nil, fmt.Errorf("invalid KV_HEALTH_WARN_USAGE: must be a fraction between 0 and 1")
+	}
+	warnLag, err := strconv.ParseUint(getEnvOrDefault("KV_HEALTH_WARN_LAG", "10000"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid KV_HEALTH_WARN_LAG: must be a number of messages")
+	}
+	return &healthMonitor{maxStore: -1, warnUsage: warnUsage, warnLag: warnLag}, nil
+}
+
+// checkHealth builds a health report. A store is degraded when its storage or disk is
+// nearly full, or something reading from it fell too far behind.
+func (s *Server) checkHealth() (*HealthReport, error) {
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+	account, err := js.AccountInfo()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get JetStream usage: %v", err)
+	}
+
+	h := s.health
+	report := &HealthReport{Status: "ok"}
+	report.Storage = StorageHealth{
+		StoreBytes:  account.Store,
+		StoreLimit:  account.Limits.MaxStore,
+		MemoryBytes: account.Memory,
+		MemoryLimit: account.Limits.MaxMemory,
+		Streams:     account.Streams,
+	}
+	// Without an account limit the server's limit applies
+	if report.Storage.StoreLimit <= 0 {
+		report.Storage.StoreLimit = h.maxStore
+	}
+	if report.Storage.StoreLimit > 0 {
+		report.Storage.StoreUsage = float64(account.Store) / float64(report.Storage.StoreLimit)
+		if report.Storage.StoreUsage > h.warnUsage {
+			report.Problems = append(report.Problems, fmt.Sprintf("JetStream storage is %.0f%% full", report.Storage.StoreUsage*100))
+		}
+	}
+
+	if h.storageDir != "" {
+		disk, err := diskSpace(h.storageDir)
+		if err != nil {
+			report.Problems = append(report.Problems, err.Error())
+		} else {
+			if disk.Usage > h.warnUsage {
+				report.Problems = append(report.Problems, fmt.Sprintf("the disk of %s is %.0f%% full", h.storageDir, disk.Usage*100))
+			}
+			report.Disk = disk
+		}
+	}
+	if s.disk != nil && s.disk.isReadOnly() {
+		report.Problems = append(report.Problems, "writes are suspended until disk space is freed")
+		if report.Disk != nil {
+			report.Disk.ReadOnly = true
+		}
+	}
+
+	for info := range js.StreamsInfo() {
+		if mirror := info.Mirror; mirror != nil {
+			report.Mirrors = append(report.Mirrors, MirrorLag{Stream: info.Config.Name, Lag: mirror.Lag, Active: mirror.Active.String()})
+			if mirror.Lag > h.warnLag {
+				report.Problems = append(report.Problems, fmt.Sprintf("mirror %s is %d messages behind", info.Config.Name, mirror.Lag))
+			}
+		}
+		if info.State.Consumers == 0 {
+			continue
+		}
+		for consumer := range js.ConsumersInfo(info.Config.Name) {
+			report.Consumers.Count++
+			report.Consumers.MaxPending = max(report.Consumers.MaxPending, consumer.NumPending)
+			if consumer.NumPending > 0 || consumer.NumAckPending > 0 {
+				report.Consumers.Lagging = append(report.Consumers.Lagging, ConsumerLag{
+					Stream:     consumer.Stream,
+					Consumer:   consumer.Name,
+					Pending:    consumer.NumPending,
+					AckPending: consumer.NumAckPending,
+				})
+			}
+		}
+	}
+	slices.SortFunc(report.Consumers.Lagging, func(a, b ConsumerLag) int { return cmp.Compare(b.Pending, a.Pending) })
+	if len(report.Consumers.Lagging) > maxReportedConsumers {
+		report.Consumers.Lagging = report.Consumers.Lagging[:maxReportedConsumers]
+	}
+	if report.Consumers.MaxPending > h.warnLag {
+		report.Problems = append(report.Problems, fmt.Sprintf("a consumer is %d messages behind", report.Consumers.MaxPending))
+	}
+
+	if s.webhooks != nil {
+		report.Webhooks.Pending = s.webhooks.pending.Load()
+		report.Webhooks.Failing, report.Webhooks.Suspended = s.webhooks.failing()
+		if report.Webhooks.Suspended > 0 {
+			report.Problems = append(report.Problems, fmt.Sprintf("%d webhook targets are suspended", report.Webhooks.Suspended))
+		}
+	}
+
+	if len(report.Problems) > 0 {
+		report.Status = "degraded"
+	}
+	return report, nil
+}
+
+// handleHealth reports the storage, disk and consumer lag of the store. Degraded stores
+// answer 503 so probes can alert on the status alone.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	report, err := s.checkHealth()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: strings.Join(report.Problems, "; "), Data: report})
+		return
+	}
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: report})
+}
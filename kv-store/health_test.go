@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHealthMonitorConfig(t *testing.T) {
+	h, err := newHealthMonitor()
+	if err != nil || h.warnUsage != 0.85 || h.warnLag != 10000 || h.maxStore != -1 {
+		t.Fatalf("unexpected defaults %+v, %v", h, err)
+	}
+	for _, usage := range []string{"0", "1.5", "full"} {
+		t.Setenv("KV_HEALTH_WARN_USAGE", usage)
+		if _, err := newHealthMonitor(); err == nil {
+			t.Errorf("KV_HEALTH_WARN_USAGE=%s should be rejected", usage)
+		}
+	}
+}
+
+func TestWebhookFailingTargets(t *testing.T) {
+	d := &webhookDispatcher{budget: 2, suspend: time.Minute, targets: map[string]*webhookTargetState{}}
+	d.record("a", errors.New("refused"))
+	d.record("b", errors.New("refused"))
+	d.record("b", errors.New("refused"))
+	if failing, suspended := d.failing(); failing != 2 || suspended != 1 {
+		t.Errorf("failing = %d, suspended = %d", failing, suspended)
+	}
+}
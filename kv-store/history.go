@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// historyRule sets how many revisions are kept for the keys matching a pattern. A pattern
+// ending in * matches every key with that prefix, any other pattern a single key.
+type historyRule struct {
+	pattern string
+	history uint8
+}
+
+// parseHistoryRules parses KV_HISTORY_RULES, e.g. config/*=50,cache/*=1
+func parseHistoryRules(spec string) ([]historyRule, error) {
+	var rules []historyRule
+	if spec == "" {
+		return rules, nil
+	}
+	for _, rule := range strings.Split(spec, ",") {
+		pattern, value, ok := strings.Cut(strings.TrimSpace(rule), "=")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("rule %q must be <pattern>=<revisions>", rule)
+		}
+		history, err := strconv.ParseUint(value, 10, 8)
+		if err != nil || history < 1 || history > 64 {
+			return nil, fmt.Errorf("history of %s must be between 1 and 64", pattern)
+		}
+		rules = append(rules, historyRule{pattern: pattern, history: uint8(history)})
+	}
+	return rules, nil
+}
+
+// keyHistory returns the number of revisions kept for a key, from the most specific rule
+// matching it or KV_HISTORY
+func (s *Server) keyHistory(key string) uint8 {
+	history, longest := s.history, -1
+	for _, rule := range s.historyRules {
+		if rule.pattern == key {
+			return rule.history
+		}
+		if prefix, ok := strings.CutSuffix(rule.pattern, "*"); ok && strings.HasPrefix(key, prefix) && len(prefix) > longest {
+			history, longest = rule.history, len(prefix)
+		}
+	}
+	return history
+}
+
+// bucketHistory is the history of data buckets, which is the deepest history of any key.
+// Keys with a shorter history are trimmed when written.
+func (s *Server) bucketHistory() uint8 {
+	history := s.history
+	for _, rule := range s.historyRules {
+		history = max(history, rule.history)
+	}
+	return history
+}
+
+// historyBucket trims the revisions of keys whose history is shorter than the bucket's
+type historyBucket struct {
+	nats.KeyValue
+	s  *Server
+	js nats.JetStreamContext
+}
+
+// trim purges all but the revisions a key keeps. A failure only leaves extra revisions, so
+// it doesn't fail the write.
+func (b *historyBucket) trim(key string) {
+	history := b.s.keyHistory(key)
+	if history >= b.s.bucketHistory() {
+		return
+	}
+	err := b.js.PurgeStream("KV_"+b.Bucket(), &nats.StreamPurgeRequest{
+		Subject: "$KV." + b.Bucket() + "." + key,
+		Keep:    uint64(history),
+	})
+	if err != nil {
+		log.Printf("Failed to trim the history of %s in %s: %v", key, b.Bucket(), err)
+	}
+}
+
+func (b *historyBucket) Put(key string, value []byte) (uint64, error) {
+	revision, err := b.KeyValue.Put(key, value)
+	if err == nil {
+		b.trim(key)
+	}
+	return revision, err
+}
+
+func (b *historyBucket) PutString(key string, value string) (uint64, error) {
+	return b.Put(key, []byte(value))
+}
+
+func (b *historyBucket) Create(key string, value []byte) (uint64, error) {
+	revision, err := b.KeyValue.Create(key, value)
+	if err == nil {
+		b.trim(key)
+	}
+	return revision, err
+}
+
+func (b *historyBucket) Update(key string, value []byte, last uint64) (uint64, error) {
+	revision, err := b.KeyValue.Update(key, value, last)
+	if err == nil {
+		b.trim(key)
+	}
+	return revision, err
+}
+
+// applyBucketRetention updates data buckets created with a different history or retention,
+// so changes to KV_HISTORY, KV_HISTORY_RULES or KV_PARTITION_TTL apply to existing
+// workspaces too
+func (s *Server) applyBucketRetention() error {
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return err
+	}
+	names, err := s.listDataBuckets()
+	if err != nil {
+		return err
+	}
+	history := int64(s.bucketHistory())
+	for _, name := range names {
+		info, err := js.StreamInfo("KV_" + name)
+		if err != nil {
+			return err
+		}
+		var maxAge time.Duration
+		if isPartition(name) {
+			maxAge = s.partitionRetention()
+		}
+		if info.Config.MaxMsgsPerSubject == history && info.Config.MaxAge == maxAge {
+			continue
+		}
+		// Values stored as changes of revisions the shorter history drops are stored in full first
+		if history < info.Config.MaxMsgsPerSubject {
+			if err := s.storeDeltasInFull(name); err != nil {
+				return fmt.Errorf("failed to prepare %s for a shorter history: %v", name, err)
+			}
+		}
+		config := info.Config
+		config.MaxMsgsPerSubject = history
+		config.MaxAge = maxAge
+		if maxAge > 0 && config.Duplicates > maxAge {
+			config.Duplicates = maxAge
+		}
+		if _, err := js.UpdateStream(&config); err != nil {
+			return fmt.Errorf("failed to update the retention of %s: %v", name, err)
+		}
+		log.Printf("Updated %s to keep %d revisions for %s", name, history, maxAge)
+	}
+	return nil
+}
+
+type HistoryRequest struct {
+	Key string `json:"key"`
+	// Scope addresses the thread, user or workspace level instead of the first that has the key
+	Scope string `json:"scope,omitempty"`
+}
+
+// KeyRevision is a revision of a key: a value it was put with, or its deletion
+type KeyRevision struct {
+	Revision  uint64    `json:"revision"`
+	Operation string    `json:"operation"`
+	Value     string    `json:"value,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+type KeyHistory struct {
+	Key string `json:"key"`
+	// Kept is how many revisions of the key are kept, from KV_HISTORY or KV_HISTORY_RULES
+	Kept      uint8         `json:"kept"`
+	Revisions []KeyRevision `json:"revisions"`
+}
+
+// errRevisionNotKept is returned for an earlier revision of a key that was trimmed from its
+// history, or can't be rebuilt because the revision it was stored against was
+type errRevisionNotKept struct {
+	key      string
+	revision uint64
+	kept     uint8
+}
+
+func (e *errRevisionNotKept) Error() string {
+	return fmt.Sprintf("revision %d of %s is no longer kept, only its last %d revisions are", e.revision, e.key, e.kept)
+}
+
+// readRevision reads a revision of a key. Revisions of deletes are not found, and revisions
+// before the ones still kept return errRevisionNotKept.
+func (s *Server) readRevision(prefix, key string, revision uint64) (nats.KeyValueEntry, error) {
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := bucket.GetRevision(key, revision)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		if latest, lerr := bucket.Get(key); lerr == nil && latest.Revision() > revision {
+			return nil, &errRevisionNotKept{key: key, revision: revision, kept: s.keyHistory(key)}
+		}
+	}
+	return entry, err
+}
+
+// handleHistory returns the revisions of a key that are still kept, oldest first, from the
+// thread, user or workspace level that has the key like get. A single revision can be read
+// back with the revision option of get.
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	var req HistoryRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+	if req.Key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "key is required"})
+		return
+	}
+	if !s.checkKeyAccess(w, r, req.Key, permRead) {
+		return
+	}
+
+	prefixes, err := s.getReadPrefixes(r, req.Scope)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	var entries []nats.KeyValueEntry
+	for _, prefix := range prefixes {
+		bucket, err := s.getBucket(prefix)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		if entries, err = bucket.History(req.Key); err == nil {
+			break
+		} else if !errors.Is(err, nats.ErrKeyNotFound) {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+	}
+	if len(entries) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: nats.ErrKeyNotFound.Error()})
+		return
+	}
+
+	history := KeyHistory{Key: req.Key, Kept: s.keyHistory(req.Key), Revisions: make([]KeyRevision, 0, len(entries))}
+	for _, entry := range entries {
+		history.Revisions = append(history.Revisions, KeyRevision{
+			Revision:  entry.Revision(),
+			Operation: watchOperation(entry.Operation()),
+			Value:     string(entry.Value()),
+			Time:      entry.Created().UTC(),
+		})
+	}
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: history})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestKeyHistory(t *testing.T) {
+	rules, err := parseHistoryRules("config/*=50, cache/*=1,config/secrets/*=5,config/main=10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{history: 3, historyRules: rules}
+
+	tests := map[string]uint8{
+		"config/app":        50,
+		"config/secrets/db": 5,
+		"config/main":       10,
+		"cache/page":        1,
+		"notes":             3,
+		"configs":           3,
+	}
+	for key, want := range tests {
+		if got := s.keyHistory(key); got != want {
+			t.Errorf("keyHistory(%q) = %d, want %d", key, got, want)
+		}
+	}
+	if got := s.bucketHistory(); got != 50 {
+		t.Errorf("bucketHistory() = %d, want 50", got)
+	}
+}
+
+func TestParseHistoryRules(t *testing.T) {
+	for _, spec := range []string{"config/*", "=5", "cache/*=0", "cache/*=65", "cache/*=x"} {
+		if _, err := parseHistoryRules(spec); err == nil {
+			t.Errorf("parseHistoryRules(%q) should fail", spec)
+		}
+	}
+}
+
+func TestHandleHistoryValidation(t *testing.T) {
+	s := newTestServer()
+	for _, body := range []string{`{}`, `{"key":"a","revision":2}`, `not json`} {
+		w := httptest.NewRecorder()
+		s.handleHistory(w, httptest.NewRequest("POST", "/api/v1/history", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", body, w.Code)
+		}
+	}
+}
+
+func TestHistoryTrimmed(t *testing.T) {
+	t.Setenv("KV_HISTORY", "2")
+	s := newStoreServer(t)
+	for _, value := range []string{"1", "2", "3"} {
+		if status, response := call(t, s, "ws1", "/api/v1/put", KVRequest{Key: "a", Value: value}); status != http.StatusOK {
+			t.Fatalf("put %s = %d, %+v", value, status, response)
+		}
+	}
+
+	status, response := call(t, s, "ws1", "/api/v1/history", HistoryRequest{Key: "a"})
+	if status != http.StatusOK {
+		t.Fatalf("history = %d, %+v", status, response)
+	}
+	history := response.Data.(map[string]any)
+	if revisions := history["revisions"].([]any); history["kept"] != float64(2) || len(revisions) != 2 || revisions[0].(map[string]any)["value"] != "2" {
+		t.Errorf("history = %v, want the last 2 revisions", history)
+	}
+
+	if status, response := call(t, s, "ws1", "/api/v1/get", map[string]any{"key": "a", "revision": 2}); status != http.StatusOK || response.Data != "2" {
+		t.Errorf("get revision 2 = %d, %+v", status, response)
+	}
+	status, response = call(t, s, "ws1", "/api/v1/get", map[string]any{"key": "a", "revision": 1})
+	if status != http.StatusNotFound || response.Error != "revision 1 of a is no longer kept, only its last 2 revisions are" {
+		t.Errorf("get revision 1 = %d, %+v, want 404 no longer kept", status, response)
+	}
+	if status, response := call(t, s, "ws1", "/api/v1/get", map[string]any{"key": "b", "revision": 1}); status != http.StatusNotFound || response.Error != "nats: key not found" {
+		t.Errorf("get a missing key = %d, %+v", status, response)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"net/http"
+	"regexp"
+
+	"github.com/nats-io/nats.go"
+)
+
+// HyperLogLog sketches use 2^14 registers, for a standard error of about 0.8%
+const (
+	hllPrecision = 14
+	hllRegisters = 1 << hllPrecision
+)
+
+// Sketch encodings. Sparse sketches store only the registers that are set, as a 2 byte
+// index and a 1 byte value each, which keeps sketches of small sets small.
+const (
+	hllDense  = 'd'
+	hllSparse = 's'
+)
+
+// sketchNamePattern matches the names a sketch can be stored under
+var sketchNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+(\.[a-zA-Z0-9_-]+)*$`)
+
+const sketchNameError = "sketch names may only contain letters, numbers, '.', '_' and '-'"
+
+type HLLRequest struct {
+	Name  string     `json:"name,omitempty"`
+	Names stringList `json:"names,omitempty"`
+	Items stringList `json:"items,omitempty"`
+}
+
+type HLLResult struct {
+	Name     string `json:"name,omitempty"`
+	Estimate uint64 `json:"estimate"`
+	Changed  *bool  `json:"changed,omitempty"`
+}
+
+// hyperLogLog estimates the number of distinct items added to it
+type hyperLogLog struct {
+	registers []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{registers: make([]uint8, hllRegisters)}
+}
+
+// hashItem hashes an item to 64 bits. FNV-1a is finalized with the murmur3 mixer, since
+// the estimate relies on the high bits being well distributed.
+func hashItem(item string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(item))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// add adds an item and reports whether the sketch changed
+func (h *hyperLogLog) add(item string) bool {
+	x := hashItem(item)
+	index := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+		return true
+	}
+	return false
+}
+
+// merge adds all items of another sketch
+func (h *hyperLogLog) merge(other *hyperLogLog) {
+	for i, value := range other.registers {
+		h.registers[i] = max(h.registers[i], value)
+	}
+}
+
+// estimate returns the estimated number of distinct items, using linear counting for
+// small cardinalities where the raw estimate is biased
+func (h *hyperLogLog) estimate() uint64 {
+	m := float64(hllRegisters)
+	sum, zeros := 0.0, 0
+	for _, value := range h.registers {
+		sum += math.Ldexp(1, -int(value))
+		if value == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(estimate))
+}
+
+// encode serializes the sketch, picking the sparse encoding when it is smaller
+func (h *hyperLogLog) encode() []byte {
+	set := 0
+	for _, value := range h.registers {
+		if value != 0 {
+			set++
+		}
+	}
+	if 3*set >= hllRegisters {
+		return append([]byte{hllPrecision, hllDense}, h.registers...)
+	}
+
+	data := make([]byte, 2, 2+3*set)
+	data[0], data[1] = hllPrecision, hllSparse
+	for i, value := range h.registers {
+		if value != 0 {
+			data = binary.BigEndian.AppendUint16(data, uint16(i))
+			data = append(data, value)
+		}
+	}
+	return data
+}
+
+// decodeHyperLogLog deserializes a sketch written by encode
+func decodeHyperLogLog(data []byte) (*hyperLogLog, error) {
+	if len(data) < 2 || data[0] != hllPrecision {
+		return nil, fmt.Errorf("invalid sketch")
+	}
+	h := newHyperLogLog()
+	switch data[1] {
+	case hllDense:
+		if len(data) != 2+hllRegisters {
+			return nil, fmt.Errorf("invalid sketch")
+		}
+		copy(h.registers, data[2:])
+	case hllSparse:
+		if (len(data)-2)%3 != 0 {
+			return nil, fmt.Errorf("invalid sketch")
+		}
+		for i := 2; i < len(data); i += 3 {
+			index := binary.BigEndian.Uint16(data[i:])
+			if index >= hllRegisters {
+				return nil, fmt.Errorf("invalid sketch")
+			}
+			h.registers[index] = data[i+2]
+		}
+	default:
+		return nil, fmt.Errorf("invalid sketch")
+	}
+	return h, nil
+}
+
+// getSketchBucket gets the bucket holding the distinct count sketches of a workspace
+func (s *Server) getSketchBucket(prefix string) (nats.KeyValue, error) {
+	return s.getBucket(prefix + "-sketches")
+}
+
+// loadSketch reads a sketch and its revision, returning an empty sketch and revision 0
+// when it does not exist
+func loadSketch(bucket nats.KeyValue, name string) (*hyperLogLog, uint64, error) {
+	entry, err := bucket.Get(name)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return newHyperLogLog(), 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	h, err := decodeHyperLogLog(entry.Value())
+	if err != nil {
+		return nil, 0, err
+	}
+	return h, entry.Revision(), nil
+}
+
+// sketchKey is the name ACL rules and token prefixes are checked against for a sketch
+func sketchKey(name string) string {
+	return "hll/" + name
+}
+
+// handleHLLAdd adds items to a named HyperLogLog sketch and returns its new estimate
+func (s *Server) handleHLLAdd(w http.ResponseWriter, r *http.Request) {
+	var req HLLRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+
+	if req.Name == "" || len(req.Items) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "name and items are required"})
+		return
+	}
+
+	if !sketchNamePattern.MatchString(req.Name) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: sketchNameError})
+		return
+	}
+	if !s.checkKeyAccess(w, r, sketchKey(req.Name), permWrite) {
+		return
+	}
+
+	bucket, err := s.getSketchBucket(getRequestPrefix(r))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	for attempt := 0; attempt < incrMaxAttempts; attempt++ {
+		h, revision, err := loadSketch(bucket, req.Name)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+
+		changed := false
+		for _, item := range req.Items {
+			changed = h.add(item) || changed
+		}
+		if !changed {
+			json.NewEncoder(w).Encode(KVResponse{Success: true, Data: HLLResult{Name: req.Name, Estimate: h.estimate(), Changed: &changed}})
+			return
+		}
+
+		// Only write if nobody else changed the sketch since it was read
+		if revision == 0 {
+			_, err = bucket.Create(req.Name, h.encode())
+		} else {
+			_, err = bucket.Update(req.Name, h.encode(), revision)
+		}
+		if isRevisionConflict(err) {
+			continue
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+
+		json.NewEncoder(w).Encode(KVResponse{Success: true, Data: HLLResult{Name: req.Name, Estimate: h.estimate(), Changed: &changed}})
+		return
+	}
+
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("%s is changing too often, try again", req.Name)})
+}
+
+// handleHLLCount returns the estimated number of distinct items of a sketch, or of the
+// union of several sketches
+func (s *Server) handleHLLCount(w http.ResponseWriter, r *http.Request) {
+	var req HLLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	names := req.Names
+	if req.Name != "" {
+		names = append(names, req.Name)
+	}
+	if len(names) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "name or names is required"})
+		return
+	}
+	for _, name := range names {
+		if !sketchNamePattern.MatchString(name) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: sketchNameError})
+			return
+		}
+		if !s.checkKeyAccess(w, r, sketchKey(name), permRead) {
+			return
+		}
+	}
+
+	bucket, err := s.getSketchBucket(getRequestPrefix(r))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	union := newHyperLogLog()
+	for _, name := range names {
+		h, _, err := loadSketch(bucket, name)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		union.merge(h)
+	}
+
+	result := HLLResult{Estimate: union.estimate()}
+	if len(names) == 1 {
+		result.Name = names[0]
+	}
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: result})
+}
+
+// handleHLLDelete removes a sketch
+func (s *Server) handleHLLDelete(w http.ResponseWriter, r *http.Request) {
+	var req HLLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	if req.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "name is required"})
+		return
+	}
+
+	if !sketchNamePattern.MatchString(req.Name) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: sketchNameError})
+		return
+	}
+	if !s.checkKeyAccess(w, r, sketchKey(req.Name), permDelete) {
+		return
+	}
+
+	bucket, err := s.getSketchBucket(getRequestPrefix(r))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	if err := bucket.Purge(req.Name); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true})
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	for _, n := range []int{0, 1, 100, 5000, 200000} {
+		h := newHyperLogLog()
+		for i := 0; i < n; i++ {
+			h.add(fmt.Sprintf("https://example.com/page/%d", i))
+			// Duplicates must not be counted
+			h.add(fmt.Sprintf("https://example.com/page/%d", i/2))
+		}
+		got := float64(h.estimate())
+		if n == 0 {
+			if got != 0 {
+				t.Errorf("empty sketch estimate = %v", got)
+			}
+			continue
+		}
+		if relErr := math.Abs(got-float64(n)) / float64(n); relErr > 0.03 {
+			t.Errorf("estimate for %d items = %v, error %.2f%%", n, got, relErr*100)
+		}
+	}
+}
+
+func TestHyperLogLogEncoding(t *testing.T) {
+	for _, n := range []int{0, 10, 100000} {
+		h := newHyperLogLog()
+		for i := 0; i < n; i++ {
+			h.add(fmt.Sprint(i))
+		}
+		data := h.encode()
+		if n == 10 && data[1] != hllSparse {
+			t.Errorf("small sketch should use the sparse encoding")
+		}
+		if n == 100000 && data[1] != hllDense {
+			t.Errorf("large sketch should use the dense encoding")
+		}
+		decoded, err := decodeHyperLogLog(data)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if decoded.estimate() != h.estimate() {
+			t.Errorf("estimate changed after decoding: %d != %d", decoded.estimate(), h.estimate())
+		}
+	}
+
+	for _, data := range [][]byte{nil, {hllPrecision}, {12, hllDense}, {hllPrecision, hllSparse, 0xff, 0xff, 1}, {hllPrecision, hllDense, 1}, {hllPrecision, 'x'}} {
+		if _, err := decodeHyperLogLog(data); err == nil {
+			t.Errorf("decoding %v should fail", data)
+		}
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	a, b := newHyperLogLog(), newHyperLogLog()
+	for i := 0; i < 1000; i++ {
+		a.add(fmt.Sprint(i))
+		b.add(fmt.Sprint(i + 500))
+	}
+	a.merge(b)
+	if got := float64(a.estimate()); math.Abs(got-1500)/1500 > 0.03 {
+		t.Errorf("union estimate = %v, want about 1500", got)
+	}
+}
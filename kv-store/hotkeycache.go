@@ -0,0 +1,156 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+// hotKeyOverhead approximates the memory a cached value takes beyond its key and value
+const hotKeyOverhead = 128
+
+// hotKeyCache keeps the values of the keys read eventually, up to a total size, evicting the
+// least recently read first. Entries are only served while they are the latest revision of
+// their key as seen by the watch of their bucket, so a change made anywhere replaces them.
+type hotKeyCache struct {
+	lock      sync.Mutex
+	maxBytes  int64
+	bytes     int64
+	order     *list.List
+	items     map[hotKeyID]*list.Element
+	hits      int64
+	misses    int64
+	evictions int64
+}
+
+type hotKeyID struct {
+	bucket string
+	key    string
+}
+
+type hotKeyItem struct {
+	id    hotKeyID
+	entry nats.KeyValueEntry
+	size  int64
+}
+
+// HotKeyCacheStatus reports the use of the hot key cache
+type HotKeyCacheStatus struct {
+	Enabled   bool    `json:"enabled"`
+	Buckets   int     `json:"buckets"`
+	Keys      int     `json:"keys"`
+	Bytes     int64   `json:"bytes"`
+	MaxBytes  int64   `json:"max_bytes"`
+	Hits      int64   `json:"hits"`
+	Misses    int64   `json:"misses"`
+	Evictions int64   `json:"evictions"`
+	HitRate   float64 `json:"hit_rate"`
+}
+
+// newHotKeyCache reads KV_HOT_KEY_CACHE_SIZE, the bytes of values kept in memory. Zero
+// turns the cache off, so every eventual read of a value goes to JetStream.
+func newHotKeyCache() (*hotKeyCache, error) {
+	maxBytes, err := strconv.ParseInt(getEnvOrDefault("KV_HOT_KEY_CACHE_SIZE", "67108864"), 10, 64)
+	if err != nil || maxBytes < 0 {
+		return nil, fmt.Errorf("invalid KV_HOT_KEY_CACHE_SIZE: must be a number of bytes")
+	}
+	return &hotKeyCache{maxBytes: maxBytes, order: list.New(), items: map[hotKeyID]*list.Element{}}, nil
+}
+
+// get returns the cached value of a key if it is the given revision
+func (c *hotKeyCache) get(bucket, key string, revision uint64) (nats.KeyValueEntry, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, ok := c.items[hotKeyID{bucket, key}]
+	if !ok || element.Value.(*hotKeyItem).entry.Revision() != revision {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(element)
+	return element.Value.(*hotKeyItem).entry, true
+}
+
+// add caches the value of a key read from JetStream, evicting the least recently read
+// values to make room
+func (c *hotKeyCache) add(bucket, key string, entry nats.KeyValueEntry) {
+	size := int64(len(bucket)+len(key)+len(entry.Value())) + hotKeyOverhead
+	if size > c.maxBytes {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	id := hotKeyID{bucket, key}
+	if element, ok := c.items[id]; ok {
+		if element.Value.(*hotKeyItem).entry.Revision() >= entry.Revision() {
+			return
+		}
+		c.remove(element)
+	}
+	for c.bytes+size > c.maxBytes {
+		c.remove(c.order.Back())
+		c.evictions++
+	}
+	c.items[id] = c.order.PushFront(&hotKeyItem{id: id, entry: entry, size: size})
+	c.bytes += size
+}
+
+// remove drops a cached value, with the lock held
+func (c *hotKeyCache) remove(element *list.Element) {
+	item := c.order.Remove(element).(*hotKeyItem)
+	delete(c.items, item.id)
+	c.bytes -= item.size
+}
+
+// invalidate drops the cached value of a key older than a revision the watch delivered
+func (c *hotKeyCache) invalidate(bucket, key string, revision uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.items[hotKeyID{bucket, key}]; ok && element.Value.(*hotKeyItem).entry.Revision() < revision {
+		c.remove(element)
+	}
+}
+
+// dropBucket drops the cached values of a bucket that is no longer watched, as nothing
+// would replace them when they change
+func (c *hotKeyCache) dropBucket(bucket string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for id, element := range c.items {
+		if id.bucket == bucket {
+			c.remove(element)
+		}
+	}
+}
+
+func (c *hotKeyCache) status() HotKeyCacheStatus {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	status := HotKeyCacheStatus{
+		Enabled:   c.maxBytes > 0,
+		Keys:      len(c.items),
+		Bytes:     c.bytes,
+		MaxBytes:  c.maxBytes,
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+	}
+	if c.hits+c.misses > 0 {
+		status.HitRate = float64(c.hits) / float64(c.hits+c.misses)
+	}
+	return status
+}
+
+// handleCacheStatus reports the hit rate and memory use of the hot key cache
+func (s *Server) handleCacheStatus(w http.ResponseWriter, r *http.Request) {
+	status := s.hotKeys.status()
+	s.readCache.lock.Lock()
+	status.Buckets = len(s.readCache.buckets)
+	s.readCache.lock.Unlock()
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: status})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// testEntry is a bucket entry with a value and revision
+type testEntry struct {
+	key      string
+	value    []byte
+	revision uint64
+}
+
+func (e *testEntry) Bucket() string             { return "test" }
+func (e *testEntry) Key() string                { return e.key }
+func (e *testEntry) Value() []byte              { return e.value }
+func (e *testEntry) Revision() uint64           { return e.revision }
+func (e *testEntry) Created() time.Time         { return time.Time{} }
+func (e *testEntry) Delta() uint64              { return 0 }
+func (e *testEntry) Operation() nats.KeyValueOp { return nats.KeyValuePut }
+
+func TestHotKeyCache(t *testing.T) {
+	c := &hotKeyCache{maxBytes: 3 * (hotKeyOverhead + 110), order: list.New(), items: map[hotKeyID]*list.Element{}}
+	value := []byte(strings.Repeat("x", 100))
+	for i, key := range []string{"k1", "k2", "k3"} {
+		c.add("b", key, &testEntry{key: key, value: value, revision: uint64(i + 1)})
+	}
+	if _, ok := c.get("b", "k1", 1); !ok {
+		t.Fatal("k1 should be cached")
+	}
+	if _, ok := c.get("b", "k1", 4); ok {
+		t.Error("an older revision should not be served")
+	}
+
+	// k2 is now the least recently read
+	c.add("b", "k4", &testEntry{key: "k4", value: value, revision: 5})
+	if _, ok := c.get("b", "k2", 2); ok {
+		t.Error("k2 should have been evicted")
+	}
+	if status := c.status(); status.Evictions != 1 || status.Keys != 3 || status.Bytes > c.maxBytes {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	c.invalidate("b", "k3", 6)
+	if _, ok := c.get("b", "k3", 3); ok {
+		t.Error("k3 should have been invalidated")
+	}
+	c.dropBucket("b")
+	if status := c.status(); status.Keys != 0 || status.Bytes != 0 {
+		t.Errorf("dropping the bucket left %+v", status)
+	}
+	if status := c.status(); status.HitRate <= 0 || status.HitRate >= 1 {
+		t.Errorf("hit rate = %v", status.HitRate)
+	}
+}
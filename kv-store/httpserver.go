@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// httpOptions tunes the connections of the HTTP API. Clients making many calls can keep a
+// few connections open and, over HTTP/2, multiplex their calls as streams on them.
+type httpOptions struct {
+	h2c         bool
+	keepAlives  bool
+	idleTimeout time.Duration
+	maxStreams  uint32
+	// http3Port is the UDP port HTTP/3 is served on, empty when it isn't
+	http3Port string
+}
+
+// newHTTPOptions reads KV_H2C, whether HTTP/2 is served without TLS, KV_HTTP_KEEP_ALIVE,
+// whether connections are kept open between requests, KV_HTTP_IDLE_TIMEOUT, how long an
+// idle connection stays open, and KV_HTTP2_MAX_CONCURRENT_STREAMS, the calls a client can
+// have in flight on one HTTP/2 or HTTP/3 connection. HTTP/2 is always offered over TLS.
+// KV_HTTP3 serves HTTP/3 over QUIC as well, on the UDP port KV_HTTP3_PORT or the port of the
+// API, which needs TLS.
+func newHTTPOptions(port string) (*httpOptions, error) {
+	idleTimeout, err := time.ParseDuration(getEnvOrDefault("KV_HTTP_IDLE_TIMEOUT", "120s"))
+	if err != nil || idleTimeout <= 0 {
+		return nil, fmt.Errorf("invalid KV_HTTP_IDLE_TIMEOUT: must be a positive duration")
+	}
+	maxStreams, err := strconv.ParseUint(getEnvOrDefault("KV_HTTP2_MAX_CONCURRENT_STREAMS", "250"), 10, 32)
+	if err != nil || maxStreams == 0 {
+		return nil, fmt.Errorf("invalid KV_HTTP2_MAX_CONCURRENT_STREAMS: must be a positive number of streams")
+	}
+	o := &httpOptions{
+		h2c:         getEnvOrDefault("KV_H2C", "false") == "true",
+		keepAlives:  getEnvOrDefault("KV_HTTP_KEEP_ALIVE", "true") == "true",
+		idleTimeout: idleTimeout,
+		maxStreams:  uint32(maxStreams),
+	}
+	if getEnvOrDefault("KV_HTTP3", "false") == "true" {
+		o.http3Port = getEnvOrDefault("KV_HTTP3_PORT", port)
+		if _, err := strconv.ParseUint(o.http3Port, 10, 16); err != nil {
+			return nil, fmt.Errorf("invalid KV_HTTP3_PORT: must be a port number")
+		}
+	}
+	return o, nil
+}
+
+// newHTTPServer builds the server of the HTTP API. HTTP/2 is negotiated over TLS, and
+// without TLS accepted from clients that upgrade or start with it when h2c is on. Responses
+// advertise the HTTP/3 server if there is one, so clients can switch to it.
+func (s *Server) newHTTPServer(addr string, h3 *http3.Server) (*http.Server, error) {
+	h2 := &http2.Server{MaxConcurrentStreams: s.httpOptions.maxStreams, IdleTimeout: s.httpOptions.idleTimeout}
+	var handler http.Handler = s
+	if h3 != nil {
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h3.SetQUICHeaders(w.Header())
+			s.ServeHTTP(w, r)
+		})
+	}
+	srv := &http.Server{Addr: addr, Handler: handler, IdleTimeout: s.httpOptions.idleTimeout}
+	srv.SetKeepAlivesEnabled(s.httpOptions.keepAlives)
+	switch {
+	case s.tls != nil:
+		srv.TLSConfig = s.tls.config
+		if err := http2.ConfigureServer(srv, h2); err != nil {
+			return nil, err
+		}
+	case s.httpOptions.h2c:
+		srv.Handler = h2c.NewHandler(handler, h2)
+	}
+	return srv, nil
+}
+
+// newHTTP3Server builds the HTTP/3 server of the API, which takes the TLS configuration of
+// the HTTPS server, client certificates included. QUIC recovers lost packets per stream, so
+// large uploads over lossy networks don't stall every call on the connection. It returns
+// nil when HTTP/3 is off.
+func (s *Server) newHTTP3Server() (*http3.Server, error) {
+	if s.httpOptions.http3Port == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(s.tls.certFile, s.tls.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := s.tls.config.Clone()
+	config.Certificates = []tls.Certificate{cert}
+	return &http3.Server{
+		Addr:        ":" + s.httpOptions.http3Port,
+		Handler:     s,
+		TLSConfig:   http3.ConfigureTLSConfig(config),
+		IdleTimeout: s.httpOptions.idleTimeout,
+		QUICConfig: &quic.Config{
+			MaxIdleTimeout:     s.httpOptions.idleTimeout,
+			MaxIncomingStreams: int64(s.httpOptions.maxStreams),
+		},
+	}, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+)
+
+func TestHTTPOptions(t *testing.T) {
+	for env, value := range map[string]string{"KV_HTTP_IDLE_TIMEOUT": "0s", "KV_HTTP2_MAX_CONCURRENT_STREAMS": "0"} {
+		t.Run(env, func(t *testing.T) {
+			t.Setenv(env, value)
+			if _, err := newHTTPOptions("8080"); err == nil {
+				t.Errorf("%s=%s should be rejected", env, value)
+			}
+		})
+	}
+}
+
+func TestH2C(t *testing.T) {
+	t.Setenv("KV_H2C", "true")
+	options, err := newHTTPOptions("8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{httpOptions: options}
+	srv, err := s.newHTTPServer("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv.Handler)
+	defer ts.Close()
+
+	// Clients that know the server speaks HTTP/2 start with it without TLS
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}}
+	resp, err := client.Get(ts.URL + "/api/ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+		t.Errorf("got %s %d", resp.Proto, resp.StatusCode)
+	}
+}
+
+func TestHTTP3Port(t *testing.T) {
+	t.Setenv("KV_HTTP3", "true")
+	options, err := newHTTPOptions("8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.http3Port != "8080" {
+		t.Errorf("HTTP/3 port = %q, should default to the API port", options.http3Port)
+	}
+	t.Setenv("KV_HTTP3_PORT", "70000")
+	if _, err := newHTTPOptions("8080"); err == nil {
+		t.Error("an invalid KV_HTTP3_PORT should be rejected")
+	}
+}
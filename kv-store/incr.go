@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// incrMaxAttempts bounds the compare-and-set retries of an increment under contention
+const incrMaxAttempts = 20
+
+// decimalMaxScale bounds the number of decimals of an increment, so values such as 1e-9999
+// cannot produce huge results
+const decimalMaxScale = 64
+
+type IncrRequest struct {
+	Key   string         `json:"key"`
+	Delta flexibleNumber `json:"delta,omitempty"`
+	// TTL expires a counter created by the increment after a duration such as 1m, e.g. for
+	// the window of a rate limit. Increments of an existing counter keep its expiry.
+	TTL string `json:"ttl,omitempty"`
+}
+
+type IncrResult struct {
+	Value    string `json:"value"`
+	Revision uint64 `json:"revision"`
+}
+
+// isRevisionConflict reports whether a create or update failed because the key changed
+// since it was read
+func isRevisionConflict(err error) bool {
+	return errors.Is(err, nats.ErrKeyExists)
+}
+
+// parseDecimal parses an integer or decimal number exactly and returns it with its scale,
+// the number of decimals it is written with. Exponent notation is accepted and gets the
+// smallest scale that represents the number exactly.
+func parseDecimal(value string) (*big.Rat, int, error) {
+	value = strings.TrimSpace(value)
+	number, ok := new(big.Rat).SetString(value)
+	if !ok || value == "" || strings.ContainsAny(value, "/") {
+		return nil, 0, fmt.Errorf("%q is not a number", value)
+	}
+
+	if !strings.ContainsAny(value, "eE") {
+		scale := 0
+		if _, decimals, ok := strings.Cut(value, "."); ok {
+			scale = len(decimals)
+		}
+		if scale > decimalMaxScale {
+			return nil, 0, fmt.Errorf("%q has more than %d decimals", value, decimalMaxScale)
+		}
+		return number, scale, nil
+	}
+
+	scaled := new(big.Rat).Set(number)
+	ten := big.NewRat(10, 1)
+	for scale := 0; scale <= decimalMaxScale; scale++ {
+		if scaled.IsInt() {
+			return number, scale, nil
+		}
+		scaled.Mul(scaled, ten)
+	}
+	return nil, 0, fmt.Errorf("%q has more than %d decimals", value, decimalMaxScale)
+}
+
+// addDecimal adds two numbers exactly. Integers stay integers of any size, and a result
+// with decimals is written with as many decimals as the more precise operand, so
+// "0.10" + "0.2" is "0.30".
+func addDecimal(current, delta string) (string, error) {
+	a, aScale, err := parseDecimal(current)
+	if err != nil {
+		return "", err
+	}
+	b, bScale, err := parseDecimal(delta)
+	if err != nil {
+		return "", err
+	}
+	sum := new(big.Rat).Add(a, b)
+	return sum.FloatString(max(aScale, bScale)), nil
+}
+
+// handleIncr atomically adds a delta to the number stored under a key, creating the key
+// when it does not exist. Values are exact decimals of arbitrary precision, so counts and
+// amounts such as costs in dollars never pick up rounding errors. A counter that expired
+// but wasn't swept yet starts again from 0.
+func (s *Server) handleIncr(w http.ResponseWriter, r *http.Request) {
+	var req IncrRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+
+	if req.Key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "key is required"})
+		return
+	}
+	if req.Delta == "" {
+		req.Delta = "1"
+	}
+	if _, _, err := parseDecimal(string(req.Delta)); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid delta: %v", err)})
+		return
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		if ttl, err = parseTTL(req.TTL); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+	}
+
+	if !s.checkKeyAccess(w, r, req.Key, permWrite) || !s.checkKeyAccess(w, r, req.Key, permRead) {
+		return
+	}
+
+	// Get the bucket for this request
+	prefix := s.getDataPrefix(r, false)
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	for attempt := 0; attempt < incrMaxAttempts; attempt++ {
+		current, revision := "0", uint64(0)
+		var expiresAt time.Time
+		entry, err := bucket.Get(req.Key)
+		switch {
+		case err == nil:
+			current, revision = string(entry.Value()), entry.Revision()
+			expiresAt, _, err = s.getKeyTTL(prefix, entry)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+				return
+			}
+			// The revision is kept, so the counter is only reset if nobody else did first
+			if !expiresAt.IsZero() && !expiresAt.After(time.Now()) {
+				current, expiresAt, entry = "0", time.Time{}, nil
+			}
+		case !errors.Is(err, nats.ErrKeyNotFound):
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		if expiresAt.IsZero() && ttl > 0 {
+			expiresAt = time.Now().Add(ttl)
+		}
+
+		value, err := addDecimal(current, string(req.Delta))
+		if err != nil {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("value of %s is not a number", req.Key)})
+			return
+		}
+
+		// Only write if nobody else changed the key since it was read
+		if revision == 0 {
+			revision, err = bucket.Create(req.Key, []byte(value))
+		} else {
+			revision, err = bucket.Update(req.Key, []byte(value), revision)
+		}
+		if isRevisionConflict(err) {
+			continue
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+
+		s.access.record(prefix, req.Key, true)
+		response := KVResponse{Success: true, Data: IncrResult{Value: value, Revision: revision}}
+		// The expiry is moved to the new revision, which the record of the old one doesn't cover
+		if !expiresAt.IsZero() {
+			if err := s.setExpiryOrUndo(bucket, prefix, req.Key, revision, expiresAt, entry); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+				return
+			}
+			response.TTL = remainingTTL(expiresAt, time.Now())
+		}
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("%s is changing too often, try again", req.Key)})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAddDecimal(t *testing.T) {
+	tests := []struct {
+		current, delta string
+		want           string
+		wantErr        bool
+	}{
+		{current: "0", delta: "1", want: "1"},
+		{current: "41", delta: "-42", want: "-1"},
+		{current: "9223372036854775807", delta: "1", want: "9223372036854775808"},
+		{current: "123456789012345678901234567890", delta: "123456789012345678901234567890", want: "246913578024691357802469135780"},
+		{current: "0.1", delta: "0.2", want: "0.3"},
+		{current: "0.10", delta: "0.2", want: "0.30"},
+		{current: "1.25", delta: "3", want: "4.25"},
+		{current: "10", delta: "-0.005", want: "9.995"},
+		{current: "1", delta: "1e3", want: "1001"},
+		{current: "1", delta: "2.5e-2", want: "1.025"},
+		{current: " 7 ", delta: "1", want: "8"},
+		{current: "hello", delta: "1", wantErr: true},
+		{current: "1", delta: "1/3", wantErr: true},
+		{current: "1", delta: "1e-100", wantErr: true},
+		{current: "", delta: "1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := addDecimal(tt.current, tt.delta)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("addDecimal(%q, %q) = %q, want an error", tt.current, tt.delta, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("addDecimal(%q, %q) = %q, %v, want %q", tt.current, tt.delta, got, err, tt.want)
+		}
+	}
+}
+
+func TestHandleIncrInvalidTTL(t *testing.T) {
+	s := newTestServer()
+	w := httptest.NewRecorder()
+	s.handleIncr(w, httptest.NewRequest("POST", "/api/v1/incr", strings.NewReader(`{"key":"runs","ttl":"0s"}`)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "ttl must be at least 1s") {
+		t.Errorf("status = %d, body %s, want 400 for an invalid ttl", w.Code, w.Body.String())
+	}
+}
+
+func TestIncrConcurrent(t *testing.T) {
+	s := newStoreServer(t)
+	const clients, increments = 8, 10
+	var wg sync.WaitGroup
+	errs := make(chan string, clients*increments)
+	for range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range increments {
+				// A counter changing too often asks the client to try again
+				for {
+					r := httptest.NewRequest(http.MethodPost, "/api/v1/incr", strings.NewReader(`{"key":"hits","delta":"1"}`))
+					r.Header.Set("X-GPTScript-Env", "GPTSCRIPT_WORKSPACE_ID=ws1")
+					w := httptest.NewRecorder()
+					s.ServeHTTP(w, r)
+					if w.Code == http.StatusOK {
+						break
+					}
+					if w.Code != http.StatusConflict {
+						errs <- w.Body.String()
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("incr failed: %s", err)
+	}
+
+	if status, response := call(t, s, "ws1", "/api/v1/get", KVRequest{Key: "hits"}); status != http.StatusOK || response.Data != "80" {
+		t.Errorf("hits = %d, %+v, want 80", status, response)
+	}
+}
+
+func TestIncrKeepsExpiry(t *testing.T) {
+	s := newStoreServer(t)
+	incr := func(ttl string) IncrResult {
+		t.Helper()
+		status, response := call(t, s, "ws1", "/api/v1/incr", IncrRequest{Key: "window", Delta: "1", TTL: ttl})
+		if status != http.StatusOK {
+			t.Fatalf("incr = %d, %+v", status, response)
+		}
+		var result IncrResult
+		data, _ := json.Marshal(response.Data)
+		if err := json.NewDecoder(bytes.NewReader(data)).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	expiresAt := func() time.Time {
+		t.Helper()
+		bucket, err := s.getBucket(getWorkspacePrefix("ws1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, err := bucket.Get("window")
+		if err != nil {
+			t.Fatal(err)
+		}
+		at, ok, err := s.getKeyTTL(getWorkspacePrefix("ws1"), entry)
+		if err != nil || !ok {
+			t.Fatalf("TTL of window = %v, %v, %v", at, ok, err)
+		}
+		return at
+	}
+
+	incr("1h")
+	first := expiresAt()
+	// The TTL of a later increment doesn't move the expiry of the counter
+	if result := incr("1m"); result.Value != "2" {
+		t.Errorf("second incr = %+v, want 2", result)
+	}
+	if second := expiresAt(); !second.Equal(first) {
+		t.Errorf("expiry moved from %v to %v", first, second)
+	}
+	if status, response := call(t, s, "ws1", "/api/v1/get", KVRequest{Key: "window"}); status != http.StatusOK || response.TTL < 3500 {
+		t.Errorf("get = %d, %+v, want a TTL of about an hour", status, response)
+	}
+}
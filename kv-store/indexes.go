@@ -0,0 +1,598 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	defaultIndexLimit = 100
+	maxIndexLimit     = 1000
+)
+
+var indexNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// IndexDefinition declares a secondary index on a field of the JSON values of the keys
+// matching a glob pattern, such as status under tasks/*. Fields are paths of object field
+// names such as owner.name. Keys are indexed by every value of array fields, so an index on
+// tags finds keys by any of their tags.
+type IndexDefinition struct {
+	Name    string `json:"name"`
+	Field   string `json:"field"`
+	Pattern string `json:"pattern,omitempty"`
+}
+
+type IndexQueryRequest struct {
+	Name string `json:"name"`
+	// Value is the field value to look up, a string, number or boolean
+	Value  any          `json:"value"`
+	Limit  flexibleInt  `json:"limit,omitempty"`
+	Values flexibleBool `json:"values,omitempty"`
+}
+
+// indexWatcher maintains the indexes of one workspace as its keys change
+type indexWatcher struct {
+	lock    sync.Mutex
+	indexes map[string]IndexDefinition
+	watcher nats.KeyWatcher
+	// update serializes the updates of index entries, which read and replace the entries
+	// of a key
+	update sync.Mutex
+}
+
+// getIndexDefinitionBucket gets the bucket holding index definitions for the given prefix
+func (s *Server) getIndexDefinitionBucket(prefix string) (nats.KeyValue, error) {
+	return s.getBucket(prefix + "-indexes")
+}
+
+// getIndexBucket gets the bucket holding the index entries for the given prefix. An entry
+// v.<index>.<value hash>.<key> is kept for each indexed value of a key, so lookups only read
+// the entries of one value, and an entry k.<index>.<key> lists the hashes a key is indexed
+// by, so they can be removed when it changes. Values are hashed so they aren't stored in the
+// clear outside the encrypted data buckets.
+func (s *Server) getIndexBucket(prefix string) (nats.KeyValue, error) {
+	return s.getBucket(prefix + "-index")
+}
+
+func indexHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:16])
+}
+
+func indexKeyEntry(name, key string) string {
+	return "k." + name + "." + base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func indexValueEntry(name, hash, key string) string {
+	return "v." + name + "." + hash + "." + base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// validate checks an index definition, naming it after its field when it has no name
+func (d *IndexDefinition) validate() error {
+	if d.Field == "" {
+		return fmt.Errorf("field is required")
+	}
+	if slices.Contains(strings.Split(d.Field, "."), "") {
+		return fmt.Errorf("field must be a path of field names such as status or owner.name")
+	}
+	if d.Name == "" {
+		d.Name = strings.NewReplacer(".", "_").Replace(d.Field)
+	}
+	if !indexNamePattern.MatchString(d.Name) {
+		return fmt.Errorf("name must be up to 64 letters, digits, - and _")
+	}
+	if _, err := path.Match(d.Pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q", d.Pattern)
+	}
+	return nil
+}
+
+// indexString is the form a field value is indexed and looked up by. Only strings, numbers
+// and booleans are indexed.
+func indexString(value any) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
+
+// indexHashes returns the hashes of the values a key is indexed by
+func (d IndexDefinition) indexHashes(value []byte) []string {
+	var data any
+	if json.Unmarshal(value, &data) != nil {
+		return nil
+	}
+	field, ok := jsonField(data, strings.Split(d.Field, "."))
+	if !ok {
+		return nil
+	}
+	values, ok := field.([]any)
+	if !ok {
+		values = []any{field}
+	}
+	hashes := make([]string, 0, len(values))
+	for _, value := range values {
+		if s, ok := indexString(value); ok && !slices.Contains(hashes, indexHash(s)) {
+			hashes = append(hashes, indexHash(s))
+		}
+	}
+	return hashes
+}
+
+// updateIndex replaces the entries of a key in an index with those of its current value,
+// removing them when the key was deleted
+func updateIndex(index nats.KeyValue, def IndexDefinition, key string, value []byte, deleted bool) error {
+	var hashes []string
+	if !deleted {
+		hashes = def.indexHashes(value)
+	}
+	var indexed []string
+	if entry, err := index.Get(indexKeyEntry(def.Name, key)); err == nil {
+		_ = json.Unmarshal(entry.Value(), &indexed)
+	}
+
+	for _, hash := range indexed {
+		if !slices.Contains(hashes, hash) {
+			if err := index.Purge(indexValueEntry(def.Name, hash, key)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, hash := range hashes {
+		if !slices.Contains(indexed, hash) {
+			if _, err := index.Put(indexValueEntry(def.Name, hash, key), nil); err != nil {
+				return err
+			}
+		}
+	}
+	if len(hashes) == 0 {
+		if len(indexed) == 0 {
+			return nil
+		}
+		return index.Purge(indexKeyEntry(def.Name, key))
+	}
+	data, err := json.Marshal(hashes)
+	if err != nil {
+		return err
+	}
+	_, err = index.Put(indexKeyEntry(def.Name, key), data)
+	return err
+}
+
+// indexEntries returns the keys of the index entries matching a subject filter
+func indexEntries(index nats.KeyValue, filter string) ([]string, error) {
+	watcher, err := index.Watch(filter, nats.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	defer watcher.Stop()
+
+	var entries []string
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		entries = append(entries, entry.Key())
+	}
+	return entries, nil
+}
+
+// clearIndex removes every entry of an index
+func clearIndex(index nats.KeyValue, name string) error {
+	for _, filter := range []string{"v." + name + ".>", "k." + name + ".>"} {
+		entries, err := indexEntries(index, filter)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err := index.Purge(entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reindex updates the entries of a key in indexes. The current value is indexed rather
+// than the one a change was seen with, so changes that are processed late never index a
+// value the key no longer holds.
+func (iw *indexWatcher) reindex(bucket, index nats.KeyValue, defs []IndexDefinition, key string) error {
+	iw.update.Lock()
+	defer iw.update.Unlock()
+
+	var value []byte
+	entry, err := bucket.Get(key)
+	deleted := errors.Is(err, nats.ErrKeyNotFound)
+	if err != nil && !deleted {
+		return err
+	}
+	if !deleted {
+		value = entry.Value()
+	}
+	for _, def := range defs {
+		if err := updateIndex(index, def, key, value, deleted); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildIndex indexes the keys already in a bucket
+func (iw *indexWatcher) buildIndex(bucket, index nats.KeyValue, def IndexDefinition) error {
+	var keys []string
+	err := scanBucket(bucket, func(entry nats.KeyValueEntry) {
+		if matchKey(entry.Key(), "", def.Pattern) {
+			keys = append(keys, entry.Key())
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := iw.reindex(bucket, index, []IndexDefinition{def}, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchIndexes starts (or refreshes) the watcher that maintains the indexes of a workspace
+func (s *Server) watchIndexes(prefix string) error {
+	defs, err := s.getIndexDefinitionBucket(prefix)
+	if err != nil {
+		return err
+	}
+	indexes := map[string]IndexDefinition{}
+	err = scanBucket(defs, func(entry nats.KeyValueEntry) {
+		var def IndexDefinition
+		if err := json.Unmarshal(entry.Value(), &def); err != nil {
+			log.Printf("Skipping invalid index %s: %v", entry.Key(), err)
+			return
+		}
+		indexes[def.Name] = def
+	})
+	if err != nil {
+		return err
+	}
+
+	s.indexLock.Lock()
+	defer s.indexLock.Unlock()
+
+	if existing, ok := s.indexes[prefix]; ok {
+		existing.lock.Lock()
+		existing.indexes = indexes
+		existing.lock.Unlock()
+		return nil
+	}
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		return err
+	}
+	index, err := s.getIndexBucket(prefix)
+	if err != nil {
+		return err
+	}
+	watcher, err := bucket.WatchAll(nats.UpdatesOnly())
+	if err != nil {
+		return err
+	}
+
+	iw := &indexWatcher{indexes: indexes, watcher: watcher}
+	s.indexes[prefix] = iw
+	go func() {
+		for update := range watcher.Updates() {
+			if update == nil {
+				continue
+			}
+			key := update.Key()
+			iw.lock.Lock()
+			var affected []IndexDefinition
+			for _, def := range iw.indexes {
+				if matchKey(key, "", def.Pattern) {
+					affected = append(affected, def)
+				}
+			}
+			iw.lock.Unlock()
+			if len(affected) == 0 {
+				continue
+			}
+			if err := iw.reindex(bucket, index, affected, key); err != nil {
+				log.Printf("Failed to update the indexes of %s: %v", key, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// startIndexWatchers starts watchers for every workspace with indexes
+func (s *Server) startIndexWatchers() {
+	names, err := s.listBucketNames()
+	if err != nil {
+		log.Printf("Failed to list buckets for indexes: %v", err)
+		return
+	}
+	for _, name := range names {
+		if prefix, ok := strings.CutSuffix(name, "-indexes"); ok {
+			if err := s.watchIndexes(prefix); err != nil {
+				log.Printf("Failed to watch indexes for %s: %v", prefix, err)
+			}
+		}
+	}
+}
+
+// handleIndexDefine declares an index and indexes the keys already stored before returning,
+// so lookups find them right away
+func (s *Server) handleIndexDefine(w http.ResponseWriter, r *http.Request) {
+	var req IndexDefinition
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+	if err := req.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	// Get the buckets for this request
+	prefix := s.getDataPrefix(r, false)
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	defs, err := s.getIndexDefinitionBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	index, err := s.getIndexBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	// The definition is stored first so writes made while the existing keys are indexed
+	// are indexed too. Redefining an index rebuilds it.
+	value, err := json.Marshal(req)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if _, err := defs.Put(req.Name, value); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if err := s.watchIndexes(prefix); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	s.indexLock.Lock()
+	iw := s.indexes[prefix]
+	s.indexLock.Unlock()
+	if err := clearIndex(index, req.Name); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if err := iw.buildIndex(bucket, index, req); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("failed to build the index: %v", err)})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: req})
+}
+
+func (s *Server) handleIndexList(w http.ResponseWriter, r *http.Request) {
+	// Get the bucket for this request
+	prefix := s.getDataPrefix(r, false)
+	defs, err := s.getIndexDefinitionBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	indexes := make([]IndexDefinition, 0)
+	err = scanBucket(defs, func(entry nats.KeyValueEntry) {
+		var def IndexDefinition
+		if err := json.Unmarshal(entry.Value(), &def); err == nil {
+			indexes = append(indexes, def)
+		}
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	slices.SortFunc(indexes, func(a, b IndexDefinition) int { return strings.Compare(a.Name, b.Name) })
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: indexes})
+}
+
+func (s *Server) handleIndexDelete(w http.ResponseWriter, r *http.Request) {
+	var req IndexDefinition
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+	if req.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "name is required"})
+		return
+	}
+
+	// Get the buckets for this request
+	prefix := s.getDataPrefix(r, false)
+	defs, err := s.getIndexDefinitionBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	index, err := s.getIndexBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	if _, err := defs.Get(req.Name); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "index not found"})
+		return
+	}
+	if err := defs.Purge(req.Name); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if err := s.watchIndexes(prefix); err != nil {
+		log.Printf("Failed to refresh indexes for %s: %v", prefix, err)
+	}
+	if err := clearIndex(index, req.Name); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true})
+}
+
+// handleIndexQuery looks up the keys whose indexed field holds a value. Only the entries of
+// that value are read, and the keys found are checked against their current values, so
+// writes the index hasn't caught up with yet are never returned.
+func (s *Server) handleIndexQuery(w http.ResponseWriter, r *http.Request) {
+	var req IndexQueryRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+	value, ok := indexString(req.Value)
+	if req.Name == "" || !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "name and a string, number or boolean value are required"})
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = defaultIndexLimit
+	}
+	if req.Limit < 1 || req.Limit > maxIndexLimit {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("limit must be between 1 and %d", maxIndexLimit)})
+		return
+	}
+
+	// Get the buckets for this request
+	prefix := s.getDataPrefix(r, false)
+	defs, err := s.getIndexDefinitionBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	entry, err := defs.Get(req.Name)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "index not found"})
+		return
+	}
+	var def IndexDefinition
+	if err := json.Unmarshal(entry.Value(), &def); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	index, err := s.getIndexBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	hash := indexHash(value)
+	entries, err := indexEntries(index, "v."+def.Name+"."+hash+".*")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		key, err := base64.RawURLEncoding.DecodeString(entry[strings.LastIndex(entry, ".")+1:])
+		if err == nil {
+			keys = append(keys, string(key))
+		}
+	}
+	slices.Sort(keys)
+
+	canRead := s.readFilter(r)
+	result := FindResult{Keys: make([]FoundKey, 0)}
+	for _, key := range keys {
+		if !canRead(key) {
+			continue
+		}
+		result.Scanned++
+		entry, err := bucket.Get(key)
+		if err != nil || !slices.Contains(def.indexHashes(entry.Value()), hash) {
+			continue
+		}
+		if len(result.Keys) == int(req.Limit) {
+			result.Truncated = true
+			break
+		}
+		found := FoundKey{KeyMetadata: KeyMetadata{Key: key, Revision: entry.Revision(), Modified: entry.Created(), Size: len(entry.Value())}}
+		if req.Values {
+			value := string(entry.Value())
+			found.Value = &value
+		}
+		result.Keys = append(result.Keys, found)
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: result})
+}
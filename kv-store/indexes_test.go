@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+// mapBucket keeps the latest value of each key in a map
+type mapBucket struct {
+	nats.KeyValue
+	values map[string][]byte
+}
+
+func (b *mapBucket) Get(key string) (nats.KeyValueEntry, error) {
+	value, ok := b.values[key]
+	if !ok {
+		return nil, nats.ErrKeyNotFound
+	}
+	return &testEntry{key: key, value: value}, nil
+}
+
+func (b *mapBucket) Put(key string, value []byte) (uint64, error) {
+	b.values[key] = value
+	return uint64(len(b.values)), nil
+}
+
+func (b *mapBucket) Delete(key string, opts ...nats.DeleteOpt) error {
+	delete(b.values, key)
+	return nil
+}
+
+func (b *mapBucket) Purge(key string, opts ...nats.DeleteOpt) error {
+	delete(b.values, key)
+	return nil
+}
+
+func (b *mapBucket) keys() []string {
+	keys := make([]string, 0, len(b.values))
+	for key := range b.values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func TestIndexDefinitionValidate(t *testing.T) {
+	def := IndexDefinition{Field: "owner.name", Pattern: "tasks/*"}
+	if err := def.validate(); err != nil || def.Name != "owner_name" {
+		t.Errorf("validate = %v, name %q", err, def.Name)
+	}
+	for _, def := range []IndexDefinition{{}, {Field: "a..b"}, {Field: "status", Name: "a.b"}, {Field: "status", Pattern: "["}} {
+		if err := def.validate(); err == nil {
+			t.Errorf("validate(%+v) succeeded, want an error", def)
+		}
+	}
+}
+
+func TestIndexHashes(t *testing.T) {
+	def := IndexDefinition{Name: "tags", Field: "tags"}
+	if hashes := def.indexHashes([]byte(`{"tags": ["a", "b", "a", 3, {"x": 1}]}`)); !slices.Equal(hashes, []string{indexHash("a"), indexHash("b"), indexHash("3")}) {
+		t.Errorf("unexpected hashes %v", hashes)
+	}
+	for _, value := range []string{`not json`, `{"other": 1}`, `{"tags": null}`, `["a"]`} {
+		if hashes := def.indexHashes([]byte(value)); len(hashes) != 0 {
+			t.Errorf("%s was indexed by %v", value, hashes)
+		}
+	}
+}
+
+func TestUpdateIndex(t *testing.T) {
+	index := &mapBucket{values: map[string][]byte{}}
+	def := IndexDefinition{Name: "status", Field: "status"}
+	if err := updateIndex(index, def, "tasks/1", []byte(`{"status": "failed"}`), false); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{indexKeyEntry("status", "tasks/1"), indexValueEntry("status", indexHash("failed"), "tasks/1")}
+	if keys := index.keys(); !slices.Equal(keys, want) {
+		t.Errorf("entries %v, want %v", keys, want)
+	}
+
+	// A changed value replaces the entries of the old one
+	updateIndex(index, def, "tasks/1", []byte(`{"status": "done"}`), false)
+	want = []string{indexKeyEntry("status", "tasks/1"), indexValueEntry("status", indexHash("done"), "tasks/1")}
+	if keys := index.keys(); !slices.Equal(keys, want) {
+		t.Errorf("entries %v, want %v", keys, want)
+	}
+
+	updateIndex(index, def, "tasks/1", nil, true)
+	if len(index.values) != 0 {
+		t.Errorf("deleting left entries %v", index.keys())
+	}
+}
+
+func TestHandleIndexValidation(t *testing.T) {
+	s := newTestServer()
+	for _, body := range []string{`{}`, `{"field":"a..b"}`, `not json`} {
+		w := httptest.NewRecorder()
+		s.handleIndexDefine(w, httptest.NewRequest("POST", "/api/v1/index/define", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("define %s: status = %d, want 400", body, w.Code)
+		}
+	}
+	for _, body := range []string{`{}`, `{"name":"status"}`, `{"name":"status","value":{"a":1}}`, `{"name":"status","value":"x","limit":0.5}`} {
+		w := httptest.NewRecorder()
+		s.handleIndexQuery(w, httptest.NewRequest("POST", "/api/v1/index/query", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("query %s: status = %d, want 400", body, w.Code)
+		}
+	}
+}
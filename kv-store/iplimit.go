@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// ipRateLimit limits the requests of each client address across workspaces and tokens, so
+// a single misbehaving client can be throttled whatever it authenticates as
+type ipRateLimit struct {
+	limiter   *rateLimiter
+	perMinute int
+	burst     int
+	// trusted are the proxies whose X-Forwarded-For entries are believed
+	trusted []netip.Prefix
+}
+
+// newIPRateLimit reads KV_IP_RATE_LIMIT, the requests per minute allowed per client
+// address, and KV_IP_RATE_BURST, the requests a client may send at once, the per minute
+// limit by default. Behind proxies, the client address is taken from X-Forwarded-For when
+// the request comes from one of KV_TRUSTED_PROXIES, a comma separated list of addresses and
+// CIDR ranges. It returns nil when clients aren't limited.
+func newIPRateLimit() (*ipRateLimit, error) {
+	perMinute, err := strconv.Atoi(getEnvOrDefault("KV_IP_RATE_LIMIT", "0"))
+	if err != nil || perMinute < 0 {
+		return nil, fmt.Errorf("invalid KV_IP_RATE_LIMIT: must be a number of requests per minute")
+	}
+	burst, err := strconv.Atoi(getEnvOrDefault("KV_IP_RATE_BURST", "0"))
+	if err != nil || burst < 0 {
+		return nil, fmt.Errorf("invalid KV_IP_RATE_BURST: must be a number of requests")
+	}
+	trusted, err := parseTrustedProxies(getEnvOrDefault("KV_TRUSTED_PROXIES", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid KV_TRUSTED_PROXIES: %v", err)
+	}
+	if perMinute == 0 {
+		return nil, nil
+	}
+	return &ipRateLimit{limiter: newRateLimiter(), perMinute: perMinute, burst: burst, trusted: trusted}, nil
+}
+
+func parseTrustedProxies(value string) ([]netip.Prefix, error) {
+	var trusted []netip.Prefix
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(item); err == nil {
+			trusted = append(trusted, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an address or CIDR range", item)
+		}
+		trusted = append(trusted, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+	}
+	return trusted, nil
+}
+
+func (l *ipRateLimit) isTrusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range l.trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address of the client of a request. X-Forwarded-For is read from
+// the right, as trusted proxies append the address they received the request from, and the
+// first address that isn't a trusted proxy is the client. Entries left of it were sent by
+// the client and could be forged.
+func (l *ipRateLimit) clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !l.isTrusted(addr) {
+		return host
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			// A malformed entry can't be traced further, so the proxy that added it is
+			// the client as far as the limit is concerned
+			return addr.Unmap().String()
+		}
+		addr = hop
+		if !l.isTrusted(hop) {
+			break
+		}
+	}
+	return addr.Unmap().String()
+}
+
+// checkIPRateLimit takes a token for the client of a request, writing a 429 response and
+// returning false when it has none left
+func (s *Server) checkIPRateLimit(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if s.ipLimit == nil {
+		return "", true
+	}
+	client := s.ipLimit.clientAddr(r)
+	result := s.ipLimit.limiter.take("ip:"+client, s.ipLimit.perMinute, s.ipLimit.burst)
+	if result.Allowed {
+		return client, true
+	}
+	setRateLimitHeaders(w, result)
+	w.Header().Set("Retry-After", formatRetryAfter(result.RetryAfter))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(KVResponse{Success: false, Code: errCodeRateLimited, Error: "rate limit exceeded for this client address"})
+	return client, false
+}
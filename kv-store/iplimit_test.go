@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	trusted, err := parseTrustedProxies(" 10.0.0.0/8, 192.168.1.7 ,,::1")
+	if err != nil {
+		t.Fatalf("parseTrustedProxies: %v", err)
+	}
+	if len(trusted) != 3 {
+		t.Fatalf("parsed %d proxies, want 3", len(trusted))
+	}
+	if _, err := parseTrustedProxies("10.0.0.0/8,proxy.local"); err == nil {
+		t.Errorf("host names must be rejected")
+	}
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Errorf("invalid ranges must be rejected")
+	}
+}
+
+func TestClientAddr(t *testing.T) {
+	trusted, err := parseTrustedProxies("10.0.0.0/8,192.168.1.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &ipRateLimit{trusted: trusted}
+
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{name: "direct", remote: "203.0.113.5:4000", want: "203.0.113.5"},
+		{name: "untrusted peer is not believed", remote: "203.0.113.5:4000", forwarded: []string{"198.51.100.1"}, want: "203.0.113.5"},
+		{name: "trusted proxy", remote: "10.1.2.3:4000", forwarded: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "chain of proxies", remote: "10.1.2.3:4000", forwarded: []string{"198.51.100.1, 192.168.1.7"}, want: "198.51.100.1"},
+		{name: "forged entries are skipped", remote: "10.1.2.3:4000", forwarded: []string{"1.2.3.4, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "repeated headers", remote: "10.1.2.3:4000", forwarded: []string{"1.2.3.4", "198.51.100.1"}, want: "198.51.100.1"},
+		{name: "malformed entry", remote: "10.1.2.3:4000", forwarded: []string{"198.51.100.1, junk"}, want: "10.1.2.3"},
+		{name: "only proxies", remote: "10.1.2.3:4000", forwarded: []string{"10.9.9.9"}, want: "10.9.9.9"},
+		{name: "mapped address", remote: "[::ffff:10.1.2.3]:4000", forwarded: []string{"198.51.100.1"}, want: "198.51.100.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/v1/get", nil)
+			r.RemoteAddr = tt.remote
+			for _, header := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", header)
+			}
+			if got := l.clientAddr(r); got != tt.want {
+				t.Errorf("clientAddr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckIPRateLimit(t *testing.T) {
+	s := newTestServer()
+	s.ipLimit = &ipRateLimit{limiter: newRateLimiter(), perMinute: 60, burst: 1}
+
+	r := httptest.NewRequest("POST", "/api/v1/get", nil)
+	r.RemoteAddr = "203.0.113.5:4000"
+	if _, ok := s.checkIPRateLimit(httptest.NewRecorder(), r); !ok {
+		t.Fatalf("first request was rejected")
+	}
+	w := httptest.NewRecorder()
+	client, ok := s.checkIPRateLimit(w, r)
+	if ok || client != "203.0.113.5" {
+		t.Fatalf("checkIPRateLimit = %q, %v, want the client rejected", client, ok)
+	}
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("rejection must be a 429 with Retry-After, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	r.RemoteAddr = "203.0.113.6:4000"
+	if _, ok := s.checkIPRateLimit(httptest.NewRecorder(), r); !ok {
+		t.Errorf("clients must have separate limits")
+	}
+}
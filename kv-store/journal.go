@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// The journal is kept in its own stream, under subjects that mirror those of the buckets'
+// streams: kv.journal.<bucket>.<key>
+const (
+	journalStream        = "JOURNAL"
+	journalSubjectPrefix = "kv.journal."
+	// journalReplicaHeader names the replica that made a change
+	journalReplicaHeader = "KV-Replica"
+	// journalFetchSize is how many changes a replay reads at a time
+	journalFetchSize = 1000
+)
+
+// journal records every change made to workspace data, in order, so the data can be
+// rebuilt as it was at any point in time and the writes leading to a state can be followed
+type journal struct {
+	maxAge   time.Duration
+	maxBytes int64
+}
+
+// newJournal reads KV_JOURNAL, whether changes are journaled, KV_JOURNAL_MAX_AGE, how long
+// changes are kept (forever by default), and KV_JOURNAL_MAX_BYTES, the size past which the
+// oldest changes are dropped (unlimited by default). It returns nil when the journal is off.
+func newJournal() (*journal, error) {
+	maxAge, err := time.ParseDuration(getEnvOrDefault("KV_JOURNAL_MAX_AGE", "0s"))
+	if err != nil || maxAge < 0 {
+		return nil, fmt.Errorf("invalid KV_JOURNAL_MAX_AGE: must be a duration, or 0 to keep changes forever")
+	}
+	maxBytes, err := strconv.ParseInt(getEnvOrDefault("KV_JOURNAL_MAX_BYTES", "-1"), 10, 64)
+	if err != nil || maxBytes == 0 || maxBytes < -1 {
+		return nil, fmt.Errorf("invalid KV_JOURNAL_MAX_BYTES: must be a positive number of bytes, or -1 for no limit")
+	}
+	if getEnvOrDefault("KV_JOURNAL", "false") != "true" {
+		return nil, nil
+	}
+	return &journal{maxAge: maxAge, maxBytes: maxBytes}, nil
+}
+
+// ensureJournalStream creates the journal stream, or updates the limits of an existing one
+func (s *Server) ensureJournalStream() error {
+	if s.journal == nil {
+		return nil
+	}
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+	config := &nats.StreamConfig{
+		Name:      journalStream,
+		Subjects:  []string{journalSubjectPrefix + ">"},
+		Storage:   nats.FileStorage,
+		Replicas:  s.durability.bucketReplicas(bucketClassData),
+		MaxAge:    s.journal.maxAge,
+		MaxBytes:  s.journal.maxBytes,
+		Discard:   nats.DiscardOld,
+		Retention: nats.LimitsPolicy,
+	}
+	if _, err := js.AddStream(config); err != nil {
+		if _, err := js.UpdateStream(config); err != nil {
+			return fmt.Errorf("failed to create the journal stream: %v", err)
+		}
+	}
+	return nil
+}
+
+// journalGapBucket is the system bucket holding the changes that are missing from the
+// journal, keyed by <bucket>.<key>, so fsck can list them
+const journalGapBucket = "system-journal-gaps"
+
+// JournalGap is the latest change to a key that couldn't be journaled
+type JournalGap struct {
+	Bucket string    `json:"bucket"`
+	Key    string    `json:"key"`
+	Time   time.Time `json:"time"`
+	Error  string    `json:"error"`
+}
+
+// journalLocks serializes the writes of a key within this server, so its changes are
+// journaled in the order they were made
+var journalLocks [64]sync.Mutex
+
+func journalLock(bucket, key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(bucket + "/" + key))
+	return &journalLocks[h.Sum32()%uint32(len(journalLocks))]
+}
+
+// recordChange appends a change made to a data bucket to the journal. Values are sealed
+// like the bucket's when encryption is enabled. The change is already made, so a failure
+// leaves a gap in the journal: a replay won't make the change, and keys changed later are
+// replayed from their next journaled change. Gaps are recorded for fsck to list.
+func (s *Server) recordChange(bucket, key string, op nats.KeyValueOp, value []byte) {
+	msg := nats.NewMsg(journalSubjectPrefix + bucket + "." + key)
+	switch op {
+	case nats.KeyValueDelete:
+		msg.Header.Set("KV-Operation", "DEL")
+	case nats.KeyValuePurge:
+		msg.Header.Set("KV-Operation", "PURGE")
+	default:
+		msg.Header.Set("KV-Operation", "PUT")
+		msg.Data = value
+		if s.encryption != nil {
+			sealed, err := s.encryption.encrypt(value)
+			if err != nil {
+				s.recordJournalGap(bucket, key, err)
+				return
+			}
+			msg.Data = sealed
+		}
+	}
+	msg.Header.Set(journalReplicaHeader, s.replicaID)
+
+	js, err := s.nc.JetStream()
+	if err == nil {
+		_, err = js.PublishMsg(msg)
+	}
+	if err != nil {
+		s.recordJournalGap(bucket, key, err)
+	}
+}
+
+// recordJournalGap logs a change that couldn't be journaled and records it in the gaps
+func (s *Server) recordJournalGap(bucket, key string, cause error) {
+	log.Printf("Failed to journal the change to %s in %s: %v", key, bucket, cause)
+	gaps, err := s.getBucket(journalGapBucket)
+	if err == nil {
+		var data []byte
+		data, err = json.Marshal(JournalGap{Bucket: bucket, Key: key, Time: time.Now().UTC(), Error: cause.Error()})
+		if err == nil {
+			_, err = gaps.Put(bucket+"."+key, data)
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to record the journal gap of %s in %s: %v", key, bucket, err)
+	}
+}
+
+// listJournalGaps returns the changes that are missing from the journal
+func (s *Server) listJournalGaps() ([]JournalGap, error) {
+	bucket, err := s.getBucket(journalGapBucket)
+	if err != nil {
+		return nil, err
+	}
+	gaps := make([]JournalGap, 0)
+	err = scanBucket(bucket, func(entry nats.KeyValueEntry) {
+		var gap JournalGap
+		if json.Unmarshal(entry.Value(), &gap) == nil {
+			gaps = append(gaps, gap)
+		}
+	})
+	return gaps, err
+}
+
+// journaledBucket records the changes made through a data bucket in the journal. It wraps
+// the bucket of a workspace as a whole, so changes are journaled under the workspace bucket
+// whichever shard holds the key.
+type journaledBucket struct {
+	nats.KeyValue
+	s      *Server
+	prefix string
+}
+
+func (b *journaledBucket) Put(key string, value []byte) (uint64, error) {
+	lock := journalLock(b.prefix, key)
+	lock.Lock()
+	defer lock.Unlock()
+	revision, err := b.KeyValue.Put(key, value)
+	if err == nil {
+		b.s.recordChange(b.prefix, key, nats.KeyValuePut, value)
+	}
+	return revision, err
+}
+
+func (b *journaledBucket) PutString(key string, value string) (uint64, error) {
+	return b.Put(key, []byte(value))
+}
+
+func (b *journaledBucket) Create(key string, value []byte) (uint64, error) {
+	lock := journalLock(b.prefix, key)
+	lock.Lock()
+	defer lock.Unlock()
+	revision, err := b.KeyValue.Create(key, value)
+	if err == nil {
+		b.s.recordChange(b.prefix, key, nats.KeyValuePut, value)
+	}
+	return revision, err
+}
+
+func (b *journaledBucket) Update(key string, value []byte, last uint64) (uint64, error) {
+	lock := journalLock(b.prefix, key)
+	lock.Lock()
+	defer lock.Unlock()
+	revision, err := b.KeyValue.Update(key, value, last)
+	if err == nil {
+		b.s.recordChange(b.prefix, key, nats.KeyValuePut, value)
+	}
+	return revision, err
+}
+
+func (b *journaledBucket) Delete(key string, opts ...nats.DeleteOpt) error {
+	lock := journalLock(b.prefix, key)
+	lock.Lock()
+	defer lock.Unlock()
+	err := b.KeyValue.Delete(key, opts...)
+	if err == nil {
+		b.s.recordChange(b.prefix, key, nats.KeyValueDelete, nil)
+	}
+	return err
+}
+
+func (b *journaledBucket) Purge(key string, opts ...nats.DeleteOpt) error {
+	lock := journalLock(b.prefix, key)
+	lock.Lock()
+	defer lock.Unlock()
+	err := b.KeyValue.Purge(key, opts...)
+	if err == nil {
+		b.s.recordChange(b.prefix, key, nats.KeyValuePurge, nil)
+	}
+	return err
+}
+
+// JournalChange is a change read back from the journal
+type JournalChange struct {
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	Operation string    `json:"operation"`
+	Replica   string    `json:"replica,omitempty"`
+	Value     []byte    `json:"value,omitempty"`
+}
+
+// parseJournalMsg reads a change from a message of the journal stream
+func parseJournalMsg(msg *nats.Msg) (JournalChange, error) {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return JournalChange{}, err
+	}
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(msg.Subject, journalSubjectPrefix), ".")
+	if !ok || bucket == "" || key == "" {
+		return JournalChange{}, fmt.Errorf("invalid journal subject %s", msg.Subject)
+	}
+	return JournalChange{
+		Seq:       meta.Sequence.Stream,
+		Time:      meta.Timestamp.UTC(),
+		Bucket:    bucket,
+		Key:       key,
+		Operation: getChangeOperation(msg),
+		Replica:   msg.Header.Get(journalReplicaHeader),
+		Value:     msg.Data,
+	}, nil
+}
+
+// readJournal calls fn with the changes in the journal made from since up to and including
+// until, in the order they were made. Zero times read from the start and to the end. Values
+// are returned decrypted.
+func (s *Server) readJournal(since, until time.Time, fn func(change JournalChange) error) error {
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+	info, err := js.StreamInfo(journalStream)
+	if errors.Is(err, nats.ErrStreamNotFound) {
+		return fmt.Errorf("the store has no journal, it is only kept with KV_JOURNAL=true")
+	} else if err != nil {
+		return fmt.Errorf("failed to get the journal stream info: %v", err)
+	}
+	if info.State.Msgs == 0 {
+		return nil
+	}
+
+	start := nats.DeliverAll()
+	if !since.IsZero() {
+		start = nats.StartTime(since)
+	}
+	sub, err := js.PullSubscribe("", "", nats.BindStream(journalStream), start, nats.AckNone())
+	if err != nil {
+		return fmt.Errorf("failed to create journal consumer: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	for {
+		consumer, err := sub.ConsumerInfo()
+		if err != nil {
+			return fmt.Errorf("failed to get consumer info: %v", err)
+		}
+		if consumer.NumPending == 0 {
+			return nil
+		}
+		msgs, err := sub.Fetch(int(min(consumer.NumPending, journalFetchSize)), nats.MaxWait(5*time.Second))
+		if err != nil && !errors.Is(err, nats.ErrTimeout) {
+			return fmt.Errorf("failed to read the journal: %v", err)
+		}
+		for _, msg := range msgs {
+			change, err := parseJournalMsg(msg)
+			if err != nil {
+				return err
+			}
+			if !until.IsZero() && change.Time.After(until) {
+				return nil
+			}
+			if change.Operation == "put" {
+				if change.Value, err = s.openJournalValue(change.Value); err != nil {
+					return fmt.Errorf("change %d to %s: %v", change.Seq, change.Key, err)
+				}
+			}
+			if err := fn(change); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// openJournalValue decrypts a journaled value, which needs the master key it was sealed
+// under
+func (s *Server) openJournalValue(value []byte) ([]byte, error) {
+	if s.encryption != nil {
+		return s.encryption.decrypt(value)
+	}
+	if _, _, _, ok := parseSealedValue(value); ok {
+		return nil, fmt.Errorf("the value is encrypted, set the master key it was encrypted with")
+	}
+	return value, nil
+}
+
+// ReplayReport sums up what replaying a journal changed, or would change in a dry run
+type ReplayReport struct {
+	DryRun  bool `json:"dry_run"`
+	Changes int  `json:"changes"`
+	Applied int  `json:"applied"`
+	// Changes that left the key as it already was
+	Unchanged int       `json:"unchanged"`
+	LastSeq   uint64    `json:"last_seq"`
+	LastTime  time.Time `json:"last_time,omitempty"`
+}
+
+// applyJournalChange makes a journaled change to its bucket and reports whether it changed
+// anything. Changes are applied as made, not as the operations that made them, so
+// replaying a journal twice leaves the same state.
+func applyJournalChange(bucket nats.KeyValue, change JournalChange, dryRun bool) (bool, error) {
+	current, err := bucket.Get(change.Key)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		current, err = nil, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	switch change.Operation {
+	case "put":
+		if current != nil && bytes.Equal(current.Value(), change.Value) {
+			return false, nil
+		}
+		if !dryRun {
+			_, err = bucket.Put(change.Key, change.Value)
+		}
+	case "delete":
+		if current == nil {
+			return false, nil
+		}
+		if !dryRun {
+			err = bucket.Delete(change.Key)
+		}
+	case "purge":
+		if !dryRun {
+			err = bucket.Purge(change.Key)
+		}
+	}
+	return err == nil, err
+}
+
+// replayJournal applies the changes journaled by source from since up to until to the
+// store, optionally only those of a workspace, and calls progress with each change applied
+// or, in a dry run, that would be applied. The store replays into itself when it is the
+// source. A dry run checks each change against the store as it is, not as the changes
+// before it would leave it.
+func (s *Server) replayJournal(source *Server, workspace string, since, until time.Time, dryRun bool, progress func(change JournalChange)) (*ReplayReport, error) {
+	report := &ReplayReport{DryRun: dryRun}
+	err := source.readJournal(since, until, func(change JournalChange) error {
+		if !isDataBucket(change.Bucket) {
+			return nil
+		}
+		if prefix, _ := splitDataPrefix(change.Bucket); workspace != "" && prefix != workspace {
+			return nil
+		}
+		report.Changes++
+		report.LastSeq, report.LastTime = change.Seq, change.Time
+		bucket, err := s.getBucket(change.Bucket)
+		if err != nil {
+			return err
+		}
+		applied, err := applyJournalChange(bucket, change, dryRun)
+		if err != nil {
+			return fmt.Errorf("failed to replay change %d to %s in %s: %v", change.Seq, change.Key, change.Bucket, err)
+		}
+		if !applied {
+			report.Unchanged++
+			return nil
+		}
+		report.Applied++
+		if progress != nil {
+			progress(change)
+		}
+		return nil
+	})
+	return report, err
+}
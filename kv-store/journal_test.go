@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestNewJournal(t *testing.T) {
+	if j, err := newJournal(); j != nil || err != nil {
+		t.Errorf("newJournal() = %v, %v, want the journal off", j, err)
+	}
+
+	t.Setenv("KV_JOURNAL", "true")
+	t.Setenv("KV_JOURNAL_MAX_AGE", "720h")
+	j, err := newJournal()
+	if err != nil || j.maxAge != 720*time.Hour || j.maxBytes != -1 {
+		t.Errorf("newJournal() = %+v, %v", j, err)
+	}
+
+	for name, value := range map[string]string{"KV_JOURNAL_MAX_AGE": "-1h", "KV_JOURNAL_MAX_BYTES": "0"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := newJournal(); err == nil {
+				t.Errorf("%s=%s succeeded, want an error", name, value)
+			}
+		})
+	}
+}
+
+func TestParseJournalMsg(t *testing.T) {
+	msg := nats.NewMsg(journalSubjectPrefix + "abc123-tool-search.notes.2024")
+	msg.Header.Set("KV-Operation", "DEL")
+	msg.Header.Set(journalReplicaHeader, "kv-0")
+	// Metadata is parsed from the reply subject of messages received by a subscription
+	msg.Reply, msg.Sub = "$JS.ACK.JOURNAL.replay.1.42.1.1717243200000000000.0", &nats.Subscription{}
+	change, err := parseJournalMsg(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Bucket != "abc123-tool-search" || change.Key != "notes.2024" || change.Operation != "delete" || change.Replica != "kv-0" {
+		t.Errorf("unexpected change %+v", change)
+	}
+	if change.Seq != 42 || !change.Time.Equal(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("change %d at %s, want 42 at 2024-06-01T12:00:00Z", change.Seq, change.Time)
+	}
+
+	msg = nats.NewMsg(journalSubjectPrefix + "abc123")
+	msg.Reply, msg.Sub = "$JS.ACK.JOURNAL.replay.1.43.2.1717243200000000000.0", &nats.Subscription{}
+	if _, err := parseJournalMsg(msg); err == nil {
+		t.Error("expected an error for a subject without a key")
+	}
+}
+
+func TestOpenJournalValue(t *testing.T) {
+	s := newTestServer()
+	if value, err := s.openJournalValue([]byte("plain")); err != nil || string(value) != "plain" {
+		t.Errorf("openJournalValue = %q, %v", value, err)
+	}
+
+	aead, err := newAEAD(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sealValue(aead, "key-1", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.openJournalValue(sealed); err == nil {
+		t.Error("expected an error for an encrypted value without the master key")
+	}
+}
+
+func TestApplyJournalChange(t *testing.T) {
+	bucket := &mapBucket{values: map[string][]byte{"a": []byte("1")}}
+	changes := []struct {
+		change  JournalChange
+		applied bool
+	}{
+		{JournalChange{Key: "a", Operation: "put", Value: []byte("1")}, false},
+		{JournalChange{Key: "a", Operation: "put", Value: []byte("2")}, true},
+		{JournalChange{Key: "b", Operation: "delete"}, false},
+		{JournalChange{Key: "b", Operation: "put", Value: []byte("3")}, true},
+		{JournalChange{Key: "a", Operation: "delete"}, true},
+	}
+	for _, c := range changes {
+		applied, err := applyJournalChange(bucket, c.change, false)
+		if err != nil || applied != c.applied {
+			t.Errorf("%s %s: applied = %v, %v, want %v", c.change.Operation, c.change.Key, applied, err, c.applied)
+		}
+	}
+	if keys := bucket.keys(); len(keys) != 1 || string(bucket.values["b"]) != "3" {
+		t.Errorf("unexpected values %v", bucket.values)
+	}
+
+	// A dry run leaves the bucket as it is
+	for _, change := range []JournalChange{{Key: "b", Operation: "put", Value: []byte("4")}, {Key: "c", Operation: "put", Value: []byte("5")}} {
+		if applied, err := applyJournalChange(bucket, change, true); err != nil || !applied {
+			t.Errorf("dry run of %s: applied = %v, %v", change.Key, applied, err)
+		}
+	}
+	if keys := bucket.keys(); len(keys) != 1 || string(bucket.values["b"]) != "3" {
+		t.Errorf("dry run changed the values to %v", bucket.values)
+	}
+}
+
+func TestReplayJournal(t *testing.T) {
+	t.Setenv("KV_JOURNAL", "true")
+	s := newStoreServer(t)
+	if err := s.ensureJournalStream(); err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range []KVRequest{{Key: "a", Value: "1"}, {Key: "a", Value: "2"}, {Key: "b", Value: "x"}} {
+		if status, response := call(t, s, "ws1", "/api/v1/put", req); status != http.StatusOK {
+			t.Fatalf("put %s = %d, %+v", req.Key, status, response)
+		}
+	}
+	if status, response := call(t, s, "ws1", "/api/v1/delete", KVRequest{Key: "b"}); status != http.StatusOK {
+		t.Fatalf("delete = %d, %+v", status, response)
+	}
+
+	// Changes made past the journal are undone by the replay
+	journal := s.journal
+	s.journal = nil
+	prefix := getWorkspacePrefix("ws1")
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.PutString("a", "3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.PutString("b", "y"); err != nil {
+		t.Fatal(err)
+	}
+	s.journal = journal
+
+	dryRun, err := s.replayJournal(s, prefix, time.Time{}, time.Time{}, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dryRun.Changes != 4 || dryRun.Applied != 4 {
+		t.Errorf("dry run = %+v, want 4 changes to apply", dryRun)
+	}
+	if entry, err := bucket.Get("a"); err != nil || string(entry.Value()) != "3" {
+		t.Fatalf("a after the dry run = %v, %v", entry, err)
+	}
+
+	s.journal = nil
+	var replayed []string
+	report, err := s.replayJournal(s, prefix, time.Time{}, time.Time{}, false, func(change JournalChange) {
+		replayed = append(replayed, change.Operation+" "+change.Key)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Changes != 4 || report.Applied != 4 || len(replayed) != 4 || replayed[3] != "delete b" {
+		t.Errorf("replay = %+v, %v", report, replayed)
+	}
+	if entry, err := bucket.Get("a"); err != nil || string(entry.Value()) != "2" {
+		t.Errorf("a = %v, %v, want 2", entry, err)
+	}
+	if _, err := bucket.Get("b"); err != nats.ErrKeyNotFound {
+		t.Errorf("b = %v, want it deleted", err)
+	}
+
+	// Replaying again leaves the same state
+	if _, err := s.replayJournal(s, prefix, time.Time{}, time.Time{}, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := bucket.Get("a"); err != nil || string(entry.Value()) != "2" {
+		t.Errorf("a after a second replay = %v, %v, want 2", entry, err)
+	}
+}
+
+func TestJournalGaps(t *testing.T) {
+	t.Setenv("KV_JOURNAL", "true")
+	// Without the journal stream, changes can't be journaled
+	s := newStoreServer(t)
+	if status, response := call(t, s, "ws1", "/api/v1/put", KVRequest{Key: "a", Value: "1"}); status != http.StatusOK {
+		t.Fatalf("put = %d, %+v", status, response)
+	}
+
+	report, err := s.fsck(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.JournalGaps) != 1 || report.JournalGaps[0].Key != "a" || report.JournalGaps[0].Bucket != getWorkspacePrefix("ws1") {
+		t.Errorf("journal gaps = %+v, want the put of a", report.JournalGaps)
+	}
+}
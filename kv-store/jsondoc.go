@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type JSONGetRequest struct {
+	Key string `json:"key"`
+	// Path is a JSON pointer such as /tasks/0 or a JSONPath such as $.tasks[0], the whole
+	// document when empty
+	Path        string `json:"path,omitempty"`
+	Scope       string `json:"scope,omitempty"`
+	Consistency string `json:"consistency,omitempty"`
+}
+
+type JSONPatchRequest struct {
+	Key   string    `json:"key"`
+	Patch jsonPatch `json:"patch"`
+	// ExpectedRevision only applies the patch to this revision of the document. Without it,
+	// the patch is applied to the latest revision, retrying when it changes meanwhile.
+	ExpectedRevision flexibleInt `json:"expected_revision,omitempty"`
+	Scope            string      `json:"scope,omitempty"`
+}
+
+// handleJSONGet returns the part of a JSON value at a path, so clients can read a field of
+// a large document without downloading all of it
+func (s *Server) handleJSONGet(w http.ResponseWriter, r *http.Request) {
+	var req JSONGetRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+
+	if req.Key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "key is required"})
+		return
+	}
+	path, err := parseJSONPath(req.Path)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	if !s.checkKeyAccess(w, r, req.Key, permRead) {
+		return
+	}
+
+	consistency, err := s.readCache.readConsistency(req.Consistency)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	prefixes, err := s.getReadPrefixes(r, req.Scope)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	prefix, entry, _, err := s.findEntry(prefixes, req.Key, 0, consistency)
+	setConsistencyHeader(w, consistency)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	s.access.record(prefix, req.Key, false)
+
+	doc, err := decodeJSON(entry.Value())
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("value of %s is not JSON: %v", req.Key, err)})
+		return
+	}
+	value, err := jsonLookup(doc, path)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: value, Revision: entry.Revision()})
+}
+
+// handleJSONPatch applies a JSON patch (RFC 6902) to a JSON value on the server, so clients
+// can change part of a large document without uploading all of it. The document is written
+// back only if it wasn't changed since it was read, so concurrent patches of different
+// fields don't undo each other. The patched document is stored compactly, with the fields
+// of objects sorted.
+func (s *Server) handleJSONPatch(w http.ResponseWriter, r *http.Request) {
+	var req JSONPatchRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+
+	if req.Key == "" || len(req.Patch) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "key and patch are required"})
+		return
+	}
+	if len(req.Patch) > maxPatchOperations {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("a patch can have at most %d operations", maxPatchOperations)})
+		return
+	}
+	if req.ExpectedRevision < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "expected_revision must not be negative"})
+		return
+	}
+	if err := req.Patch.validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	if !s.checkKeyAccess(w, r, req.Key, permWrite) || !s.checkKeyAccess(w, r, req.Key, permRead) {
+		return
+	}
+
+	prefix, ok := s.getWritePrefix(w, r, req.Scope)
+	if !ok {
+		return
+	}
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	for attempt := 0; attempt < incrMaxAttempts; attempt++ {
+		entry, err := bucket.Get(req.Key)
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		if req.ExpectedRevision != 0 && entry.Revision() != uint64(req.ExpectedRevision) {
+			s.writePutConflict(w, bucket, req.Key, uint64(req.ExpectedRevision))
+			return
+		}
+		expiresAt, _, err := s.getKeyTTL(prefix, entry)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		if !expiresAt.IsZero() && !expiresAt.After(time.Now()) {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: nats.ErrKeyNotFound.Error()})
+			return
+		}
+
+		doc, err := decodeJSON(entry.Value())
+		if err != nil {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("value of %s is not JSON: %v", req.Key, err)})
+			return
+		}
+		if doc, err = applyPatch(doc, req.Patch); err != nil {
+			// A failed test is a precondition that doesn't hold, other failures are patches
+			// that don't fit the document
+			var failed *errPatchTest
+			status := http.StatusUnprocessableEntity
+			if errors.As(err, &failed) {
+				status = http.StatusConflict
+			}
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error(), Revision: entry.Revision()})
+			return
+		}
+		patched, err := encodeJSON(doc)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		value, ok := s.checkPII(w, r, req.Key, string(patched))
+		if !ok {
+			return
+		}
+
+		revision, err := bucket.Update(req.Key, []byte(value), entry.Revision())
+		if isRevisionConflict(err) {
+			if req.ExpectedRevision != 0 {
+				s.writePutConflict(w, bucket, req.Key, uint64(req.ExpectedRevision))
+				return
+			}
+			continue
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		s.access.record(prefix, req.Key, true)
+
+		// Like an increment, a patch keeps the expiry of the document
+		if !expiresAt.IsZero() {
+			if err := s.setExpiryOrUndo(bucket, prefix, req.Key, revision, expiresAt, entry); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(KVResponse{Success: true, Revision: revision})
+		return
+	}
+
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("%s is changing too often, try again", req.Key)})
+}
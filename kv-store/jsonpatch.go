@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxPatchOperations bounds the operations of a single JSON patch
+const maxPatchOperations = 1000
+
+// PatchOperation is an operation of a JSON patch (RFC 6902). Paths are JSON pointers.
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// jsonPatch is a list of patch operations, which can also be given as a string holding
+// the list, as tools pass every parameter as a string
+type jsonPatch []PatchOperation
+
+func (p *jsonPatch) UnmarshalJSON(data []byte) error {
+	var encoded string
+	if err := json.Unmarshal(data, &encoded); err == nil {
+		data = []byte(encoded)
+	}
+	var ops []PatchOperation
+	if err := json.Unmarshal(data, &ops); err != nil {
+		return fmt.Errorf("expected a list of patch operations")
+	}
+	*p = ops
+	return nil
+}
+
+// validate checks the operations are well formed before they're applied to a document
+func (p jsonPatch) validate() error {
+	for i, op := range p {
+		if _, err := parsePointer(op.Path); err != nil {
+			return fmt.Errorf("operation %d: %v", i, err)
+		}
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return fmt.Errorf("operation %d: %s requires a value", i, op.Op)
+			}
+		case "move", "copy":
+			if _, err := parsePointer(op.From); err != nil {
+				return fmt.Errorf("operation %d: from: %v", i, err)
+			}
+			if op.Op == "move" && strings.HasPrefix(op.Path, op.From+"/") {
+				return fmt.Errorf("operation %d: a value can't be moved into itself", i)
+			}
+		case "remove":
+		default:
+			return fmt.Errorf("operation %d: op must be add, remove, replace, move, copy or test", i)
+		}
+	}
+	return nil
+}
+
+// decodeJSON decodes a JSON document keeping numbers as written, so a patch doesn't round
+// the numbers it doesn't touch
+func decodeJSON(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc any
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	return doc, nil
+}
+
+// encodeJSON encodes a JSON document compactly, without escaping HTML characters
+func encodeJSON(doc any) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// parsePointer splits a JSON pointer (RFC 6901) such as /tasks/0/status into its tokens.
+// The empty pointer is the whole document.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid JSON pointer %q, must start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+// parseJSONPath splits a path into tokens. Paths starting with $ are JSONPath, limited to
+// field names and array indexes such as $.tasks[0].status or $['a b'], as a path must
+// select a single value. Other paths are JSON pointers.
+func parseJSONPath(path string) ([]string, error) {
+	if !strings.HasPrefix(path, "$") {
+		return parsePointer(path)
+	}
+	unsupported := fmt.Errorf("unsupported JSONPath %q, only field names and array indexes are supported", path)
+	var tokens []string
+	rest := path[1:]
+	for rest != "" {
+		switch {
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end == -1 {
+				end = len(rest) - 1
+			}
+			name := rest[1 : end+1]
+			if name == "" || name == "*" {
+				return nil, unsupported
+			}
+			tokens, rest = append(tokens, name), rest[end+1:]
+		case strings.HasPrefix(rest, "['") || strings.HasPrefix(rest, `["`):
+			quote := rest[1:2]
+			end := strings.Index(rest[2:], quote+"]")
+			if end == -1 {
+				return nil, unsupported
+			}
+			tokens, rest = append(tokens, rest[2:2+end]), rest[2+end+2:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end == -1 {
+				return nil, unsupported
+			}
+			if _, err := strconv.ParseUint(rest[1:end], 10, 32); err != nil {
+				return nil, unsupported
+			}
+			tokens, rest = append(tokens, rest[1:end]), rest[end+1:]
+		default:
+			return nil, unsupported
+		}
+	}
+	return tokens, nil
+}
+
+// pointerString formats tokens as a JSON pointer, for error messages
+func pointerString(tokens []string) string {
+	var b strings.Builder
+	for _, token := range tokens {
+		b.WriteString("/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(token))
+	}
+	return b.String()
+}
+
+// arrayIndex parses a token addressing an element of an array of the given length. Adding
+// can also address the end of the array, by its length or -.
+func arrayIndex(token string, length int, adding bool) (int, error) {
+	if adding && token == "-" {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if index > length || (index == length && !adding) {
+		return 0, fmt.Errorf("array index %d is out of range", index)
+	}
+	return index, nil
+}
+
+// jsonLookup returns the value at a path of a document
+func jsonLookup(doc any, tokens []string) (any, error) {
+	for i, token := range tokens {
+		switch node := doc.(type) {
+		case map[string]any:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("%s not found", pointerString(tokens[:i+1]))
+			}
+			doc = value
+		case []any:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", pointerString(tokens[:i+1]), err)
+			}
+			doc = node[index]
+		default:
+			return nil, fmt.Errorf("%s not found, %s is not an object or array", pointerString(tokens[:i+1]), pointerString(tokens[:i]))
+		}
+	}
+	return doc, nil
+}
+
+// jsonUpdate changes the container holding the last token of a path and returns the
+// document, which is replaced when an array is grown or shrunk
+func jsonUpdate(doc any, tokens []string, change func(container any, token string) (any, error)) (any, error) {
+	if len(tokens) == 1 {
+		return change(doc, tokens[0])
+	}
+	child, err := jsonLookup(doc, tokens[:1])
+	if err != nil {
+		return nil, err
+	}
+	if child, err = jsonUpdate(child, tokens[1:], change); err != nil {
+		return nil, err
+	}
+	switch node := doc.(type) {
+	case map[string]any:
+		node[tokens[0]] = child
+	case []any:
+		index, _ := arrayIndex(tokens[0], len(node), false)
+		node[index] = child
+	}
+	return doc, nil
+}
+
+// jsonAdd adds a value at a path, replacing a field or inserting into an array
+func jsonAdd(doc any, tokens []string, value any) (any, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return jsonUpdate(doc, tokens, func(container any, token string) (any, error) {
+		switch node := container.(type) {
+		case map[string]any:
+			node[token] = value
+			return node, nil
+		case []any:
+			index, err := arrayIndex(token, len(node), true)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", pointerString(tokens), err)
+			}
+			return append(node[:index], append([]any{value}, node[index:]...)...), nil
+		default:
+			return nil, fmt.Errorf("%s is not an object or array", pointerString(tokens[:len(tokens)-1]))
+		}
+	})
+}
+
+// jsonReplace replaces the value at a path, which must exist
+func jsonReplace(doc any, tokens []string, value any) (any, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	if _, err := jsonLookup(doc, tokens); err != nil {
+		return nil, err
+	}
+	return jsonUpdate(doc, tokens, func(container any, token string) (any, error) {
+		switch node := container.(type) {
+		case map[string]any:
+			node[token] = value
+		case []any:
+			index, _ := arrayIndex(token, len(node), false)
+			node[index] = value
+		}
+		return container, nil
+	})
+}
+
+// jsonRemove removes the value at a path and returns it
+func jsonRemove(doc any, tokens []string) (any, any, error) {
+	if len(tokens) == 0 {
+		return nil, nil, fmt.Errorf("the whole document can't be removed")
+	}
+	removed, err := jsonLookup(doc, tokens)
+	if err != nil {
+		return nil, nil, err
+	}
+	doc, err = jsonUpdate(doc, tokens, func(container any, token string) (any, error) {
+		switch node := container.(type) {
+		case map[string]any:
+			delete(node, token)
+			return node, nil
+		case []any:
+			index, _ := arrayIndex(token, len(node), false)
+			return append(node[:index], node[index+1:]...), nil
+		}
+		return container, nil
+	})
+	return doc, removed, err
+}
+
+// jsonEqual compares JSON values as RFC 6902 tests do, numbers by their value
+func jsonEqual(a, b any) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, _, errA := parseDecimal(a.String())
+		y, _, errB := parseDecimal(b.String())
+		if errA != nil || errB != nil {
+			return a == b
+		}
+		return x.Cmp(y) == 0
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for name, value := range a {
+			other, ok := b[name]
+			if !ok || !jsonEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		b, ok := b.([]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+// errPatchTest is returned when a test operation of a patch doesn't hold
+type errPatchTest struct {
+	path string
+}
+
+func (e *errPatchTest) Error() string {
+	return fmt.Sprintf("test of %s failed", e.path)
+}
+
+// applyPatch applies the operations of a patch in order to a document. The patch fails as
+// a whole when an operation does, leaving the stored value as it is.
+func applyPatch(doc any, patch jsonPatch) (any, error) {
+	for i, op := range patch {
+		path, _ := parsePointer(op.Path)
+		from, _ := parsePointer(op.From)
+		var value any
+		if op.Value != nil {
+			var err error
+			if value, err = decodeJSON(op.Value); err != nil {
+				return nil, fmt.Errorf("operation %d: invalid value: %v", i, err)
+			}
+		}
+
+		var err error
+		switch op.Op {
+		case "add":
+			doc, err = jsonAdd(doc, path, value)
+		case "remove":
+			doc, _, err = jsonRemove(doc, path)
+		case "replace":
+			doc, err = jsonReplace(doc, path, value)
+		case "move":
+			if op.From == op.Path {
+				break
+			}
+			var moved any
+			if doc, moved, err = jsonRemove(doc, from); err == nil {
+				doc, err = jsonAdd(doc, path, moved)
+			}
+		case "copy":
+			var copied any
+			if copied, err = jsonLookup(doc, from); err == nil {
+				// The copy must not share maps or slices with the original
+				var data []byte
+				if data, err = encodeJSON(copied); err == nil {
+					if copied, err = decodeJSON(data); err == nil {
+						doc, err = jsonAdd(doc, path, copied)
+					}
+				}
+			}
+		case "test":
+			var current any
+			if current, err = jsonLookup(doc, path); err == nil && !jsonEqual(current, value) {
+				err = &errPatchTest{path: op.Path}
+			}
+		}
+		if err != nil {
+			if _, ok := err.(*errPatchTest); ok {
+				return nil, err
+			}
+			return nil, fmt.Errorf("operation %d (%s %s): %v", i, op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
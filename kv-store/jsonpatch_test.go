@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestApplyPatch(t *testing.T) {
+	// Examples from RFC 6902, appendix A
+	tests := []struct {
+		doc, patch, want string
+		fails            bool
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`, false},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`, false},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`, false},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`, false},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`, false},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`, false},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`, false},
+		{`{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, `{"baz":"qux","foo":["a",2,"c"]}`, false},
+		{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, ``, true},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"child":{"grandchild":{}},"foo":"bar"}`, false},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, ``, true},
+		{`{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10}]`, `{"/":9,"~1":10}`, false},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`, false},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/3","value":"x"}]`, ``, true},
+		// Numbers keep their precision and compare by value
+		{`{"n":12345678901234567890.5}`, `[{"op":"test","path":"/n","value":12345678901234567890.50}]`, `{"n":12345678901234567890.5}`, false},
+		{`{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"},{"op":"replace","path":"/c/b","value":2}]`, `{"a":{"b":1},"c":{"b":2}}`, false},
+		{`{"a":1}`, `[{"op":"replace","path":"","value":[1,"<b>"]}]`, `[1,"<b>"]`, false},
+		// A failing operation fails the whole patch
+		{`{"a":1}`, `[{"op":"add","path":"/b","value":2},{"op":"remove","path":"/c"}]`, ``, true},
+	}
+	for _, tt := range tests {
+		var patch jsonPatch
+		if err := json.Unmarshal([]byte(tt.patch), &patch); err != nil {
+			t.Fatal(err)
+		}
+		if err := patch.validate(); err != nil {
+			t.Fatalf("%s: %v", tt.patch, err)
+		}
+		doc, err := decodeJSON([]byte(tt.doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err = applyPatch(doc, patch)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("%s applied to %s, want an error", tt.patch, tt.doc)
+			}
+			continue
+		}
+		got, _ := encodeJSON(doc)
+		if err != nil || string(got) != tt.want {
+			t.Errorf("%s on %s = %s, %v, want %s", tt.patch, tt.doc, got, err, tt.want)
+		}
+	}
+}
+
+func TestJSONPatchValidate(t *testing.T) {
+	for _, patch := range []string{
+		`[{"op":"add","path":"/a"}]`,
+		`[{"op":"remove","path":"a"}]`,
+		`[{"op":"move","from":"/a","path":"/a/b"}]`,
+		`[{"op":"merge","path":"/a","value":1}]`,
+	} {
+		var p jsonPatch
+		if err := json.Unmarshal([]byte(patch), &p); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.validate(); err == nil {
+			t.Errorf("%s is valid, want an error", patch)
+		}
+	}
+
+	// Tools pass the patch as a string
+	var p jsonPatch
+	if err := json.Unmarshal([]byte(`"[{\"op\":\"remove\",\"path\":\"/a\"}]"`), &p); err != nil || len(p) != 1 || p[0].Path != "/a" {
+		t.Errorf("patch from a string = %+v, %v", p, err)
+	}
+}
+
+func TestParseJSONPath(t *testing.T) {
+	for path, want := range map[string][]string{
+		"":                  nil,
+		"/tasks/0/status":   {"tasks", "0", "status"},
+		"/a~1b/c~0d":        {"a/b", "c~d"},
+		"$":                 nil,
+		"$.tasks[0].status": {"tasks", "0", "status"},
+		"$['a b'][\"c.d\"]": {"a b", "c.d"},
+		"$.matrix[1][2]":    {"matrix", "1", "2"},
+	} {
+		if tokens, err := parseJSONPath(path); err != nil || !slices.Equal(tokens, want) {
+			t.Errorf("parseJSONPath(%q) = %q, %v, want %q", path, tokens, err, want)
+		}
+	}
+	for _, path := range []string{"tasks", "$.tasks[*]", "$..name", "$.a[?(@.b)]", "$['a"} {
+		if tokens, err := parseJSONPath(path); err == nil {
+			t.Errorf("parseJSONPath(%q) = %q, want an error", path, tokens)
+		}
+	}
+}
+
+func TestHandleJSONPatchValidation(t *testing.T) {
+	s := newTestServer()
+	for body, want := range map[string]string{
+		`{"key":"doc"}`: "key and patch are required",
+		`{"key":"doc","patch":[{"op":"add","path":"/a"}]}`: "add requires a value",
+		`{"key":"doc","patch":"not a patch"}`:              "expected a list of patch operations",
+	} {
+		w := httptest.NewRecorder()
+		s.handleJSONPatch(w, httptest.NewRequest("POST", "/api/v1/json/patch", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%s: status %d, body %s, want 400 with %q", body, w.Code, w.Body.String(), want)
+		}
+	}
+}
+
+func TestJSONPatchStore(t *testing.T) {
+	s := newStoreServer(t)
+	status, response := call(t, s, "ws1", "/api/v1/put", KVRequest{Key: "doc", Value: `{"status":"open","tasks":[]}`, TTL: "1h"})
+	if status != http.StatusOK {
+		t.Fatalf("put = %d, %+v", status, response)
+	}
+	created := response.Revision
+
+	// Tools send the patch as a string
+	status, response = call(t, s, "ws1", "/api/v1/json/patch", map[string]any{"key": "doc", "patch": `[{"op":"replace","path":"/status","value":"done"}]`})
+	if status != http.StatusOK {
+		t.Fatalf("patch = %d, %+v", status, response)
+	}
+
+	// Patches to a stale revision, with failed tests or to values that aren't JSON change nothing
+	for _, tc := range []struct {
+		req  map[string]any
+		want int
+	}{
+		{map[string]any{"key": "doc", "patch": `[{"op":"replace","path":"/status","value":"open"}]`, "expected_revision": created}, http.StatusConflict},
+		{map[string]any{"key": "doc", "patch": `[{"op":"test","path":"/status","value":"open"},{"op":"remove","path":"/tasks"}]`}, http.StatusConflict},
+		{map[string]any{"key": "doc", "patch": `[{"op":"remove","path":"/missing"}]`}, http.StatusUnprocessableEntity},
+		{map[string]any{"key": "missing", "patch": `[{"op":"remove","path":"/status"}]`}, http.StatusNotFound},
+	} {
+		if status, response := call(t, s, "ws1", "/api/v1/json/patch", tc.req); status != tc.want {
+			t.Errorf("%v = %d, %+v, want %d", tc.req, status, response, tc.want)
+		}
+	}
+
+	// Concurrent patches are all kept
+	var wg sync.WaitGroup
+	for i := range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, _ := json.Marshal(map[string]any{"key": "doc", "patch": []map[string]any{{"op": "add", "path": "/tasks/-", "value": i}}})
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/json/patch", strings.NewReader(string(body)))
+			r.Header.Set("X-GPTScript-Env", "GPTSCRIPT_WORKSPACE_ID=ws1")
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Errorf("patch %d = %d, %s", i, w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	status, response = call(t, s, "ws1", "/api/v1/get", KVRequest{Key: "doc"})
+	if status != http.StatusOK {
+		t.Fatalf("get = %d, %+v", status, response)
+	}
+	var doc struct {
+		Status string `json:"status"`
+		Tasks  []int  `json:"tasks"`
+	}
+	if err := json.Unmarshal([]byte(response.Data.(string)), &doc); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(doc.Tasks)
+	if doc.Status != "done" || !slices.Equal(doc.Tasks, []int{0, 1, 2, 3, 4}) {
+		t.Errorf("doc = %+v", doc)
+	}
+	// Like increments, patches keep the expiry of the document
+	if response.TTL < 3500 {
+		t.Errorf("TTL = %d, want about an hour", response.TTL)
+	}
+}
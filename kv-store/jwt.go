@@ -0,0 +1,330 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwtValidator validates JWTs issued by the obot platform against its JWKS
+type jwtValidator struct {
+	jwksURL        string
+	issuer         string
+	audience       string
+	workspaceClaim string
+	client         *http.Client
+
+	lock        sync.Mutex
+	keys        map[string]crypto.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	lastError   error
+	// refreshing is closed when the JWKS fetch in flight finishes, nil when there is none
+	refreshing chan struct{}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+const (
+	// jwksRefreshInterval is how long a fetched JWKS is used before it is refreshed
+	jwksRefreshInterval = 5 * time.Minute
+	// jwksRetryInterval is the minimum time between fetch attempts, so unknown key IDs and
+	// an unreachable identity provider cannot cause a fetch per request
+	jwksRetryInterval = 10 * time.Second
+)
+
+// newJWTValidator configures JWT validation from the environment. It returns nil when no
+// JWKS URL is set, and requires the issuer and audience whenever one is.
+func newJWTValidator() (*jwtValidator, error) {
+	jwksURL := getEnvOrDefault("KV_JWT_JWKS_URL", "")
+	if jwksURL == "" {
+		return nil, nil
+	}
+	v := &jwtValidator{
+		jwksURL:        jwksURL,
+		issuer:         getEnvOrDefault("KV_JWT_ISSUER", ""),
+		audience:       getEnvOrDefault("KV_JWT_AUDIENCE", ""),
+		workspaceClaim: getEnvOrDefault("KV_JWT_WORKSPACE_CLAIM", "workspace_id"),
+		client:         &http.Client{Timeout: 10 * time.Second},
+		keys:           map[string]crypto.PublicKey{},
+	}
+	if v.issuer == "" || v.audience == "" {
+		return nil, fmt.Errorf("KV_JWT_ISSUER and KV_JWT_AUDIENCE are required with KV_JWT_JWKS_URL")
+	}
+	return v, nil
+}
+
+// isJWT reports whether a bearer token has the shape of a JWT
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2 && !strings.HasPrefix(token, "kvt.")
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// parseJWK converts a JSON web key into a public key
+func parseJWK(key jsonWebKey) (crypto.PublicKey, error) {
+	switch key.Kty {
+	case "RSA":
+		n, err := decodeBigInt(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(key.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", key.Crv)
+		}
+		x, err := decodeBigInt(key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(key.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", key.Kty)
+	}
+}
+
+// fetch downloads and parses the JWKS
+func (v *jwtValidator) fetch() (map[string]crypto.PublicKey, error) {
+	resp, err := v.client.Get(v.jwksURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: status %d", resp.StatusCode)
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, key := range jwks.Keys {
+		publicKey, err := parseJWK(key)
+		if err != nil {
+			continue
+		}
+		keys[key.Kid] = publicKey
+	}
+	return keys, nil
+}
+
+// refresh fetches the JWKS without holding the lock and signals done when finished
+func (v *jwtValidator) refresh(done chan struct{}) {
+	keys, err := v.fetch()
+
+	v.lock.Lock()
+	if err == nil {
+		v.keys = keys
+		v.fetchedAt = time.Now()
+	} else {
+		log.Printf("JWKS refresh failed: %v", err)
+	}
+	v.lastError = err
+	v.refreshing = nil
+	v.lock.Unlock()
+	close(done)
+}
+
+// getKey returns the public key with the given ID. A stale JWKS is refreshed in the
+// background while its keys keep being served; an unknown key ID waits for a refresh.
+// Only one fetch runs at a time and attempts are at least jwksRetryInterval apart.
+func (v *jwtValidator) getKey(kid string) (crypto.PublicKey, error) {
+	v.lock.Lock()
+	key, ok := v.keys[kid]
+	stale := !ok || time.Since(v.fetchedAt) > jwksRefreshInterval
+	done := v.refreshing
+	if stale && done == nil && time.Since(v.attemptedAt) > jwksRetryInterval {
+		done = make(chan struct{})
+		v.refreshing = done
+		v.attemptedAt = time.Now()
+		go v.refresh(done)
+	}
+	v.lock.Unlock()
+
+	if ok {
+		return key, nil
+	}
+	if done != nil {
+		<-done
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if v.lastError != nil {
+		return nil, v.lastError
+	}
+	return nil, fmt.Errorf("unknown signing key %s", kid)
+}
+
+// verifySignature checks the JWT signature for the supported algorithms
+func verifySignature(alg string, key crypto.PublicKey, signed, signature []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %s", alg)
+	}
+	hasher := hash.New()
+	hasher.Write(signed)
+	digest := hasher.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if strings.HasPrefix(alg, "RS") {
+			return rsa.VerifyPKCS1v15(k, hash, digest, signature)
+		}
+		if strings.HasPrefix(alg, "PS") {
+			return rsa.VerifyPSS(k, hash, digest, signature, nil)
+		}
+	case *ecdsa.PublicKey:
+		if strings.HasPrefix(alg, "ES") {
+			size := (k.Curve.Params().BitSize + 7) / 8
+			if len(signature) != 2*size {
+				return fmt.Errorf("invalid signature")
+			}
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if !ecdsa.Verify(k, digest, r, s) {
+				return fmt.Errorf("invalid signature")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("algorithm %s does not match key type", alg)
+}
+
+// validate verifies a JWT and derives token claims scoped to the workspace in its claims
+func (v *jwtValidator) validate(token string) (*TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed JWT")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT header")
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("malformed JWT header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT signature")
+	}
+
+	key, err := v.getKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, fmt.Errorf("invalid JWT signature: %v", err)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("malformed JWT payload")
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("malformed JWT payload")
+	}
+
+	now := float64(time.Now().Unix())
+	exp, ok := claims["exp"].(float64)
+	if !ok || now > exp {
+		return nil, fmt.Errorf("JWT expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return nil, fmt.Errorf("JWT not yet valid")
+	}
+	if claims["iss"] != v.issuer {
+		return nil, fmt.Errorf("invalid JWT issuer")
+	}
+	if !hasAudience(claims["aud"], v.audience) {
+		return nil, fmt.Errorf("invalid JWT audience")
+	}
+
+	workspace, _ := claims[v.workspaceClaim].(string)
+	if workspace == "" {
+		return nil, fmt.Errorf("JWT has no %s claim", v.workspaceClaim)
+	}
+	subject, _ := claims["sub"].(string)
+
+	return &TokenClaims{
+		ID:         "jwt-" + subject,
+		Workspace:  getWorkspacePrefix(workspace),
+		Operations: allOperations(),
+		Expires:    int64(exp),
+	}, nil
+}
+
+// hasAudience checks the aud claim, which may be a string or a list of strings
+func hasAudience(aud interface{}, audience string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == audience
+	case []interface{}:
+		return slices.ContainsFunc(a, func(v interface{}) bool { return v == audience })
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func encodeSegment(t *testing.T, v interface{}) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	signed := encodeSegment(t, map[string]string{"alg": "RS256", "kid": kid}) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func signES256(t *testing.T, key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	signed := encodeSegment(t, map[string]string{"alg": "ES256", "kid": kid}) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTValidate(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks := map[string]interface{}{"keys": []map[string]string{
+		{"kid": "rsa", "kty": "RSA", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+		{"kid": "ec", "kty": "EC", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+	}}
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer server.Close()
+
+	v := &jwtValidator{
+		jwksURL:        server.URL,
+		issuer:         "https://obot.example.com",
+		audience:       "kv-store",
+		workspaceClaim: "workspace_id",
+		client:         server.Client(),
+		keys:           map[string]crypto.PublicKey{},
+	}
+
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":          "user1",
+			"iss":          "https://obot.example.com",
+			"aud":          "kv-store",
+			"exp":          time.Now().Add(time.Hour).Unix(),
+			"workspace_id": "ws1",
+		}
+		for k, val := range overrides {
+			if val == nil {
+				delete(c, k)
+			} else {
+				c[k] = val
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr bool
+	}{
+		{name: "rsa", token: signRS256(t, rsaKey, "rsa", claims(nil))},
+		{name: "ec", token: signES256(t, ecKey, "ec", claims(nil))},
+		{name: "audience list", token: signRS256(t, rsaKey, "rsa", claims(map[string]interface{}{"aud": []string{"other", "kv-store"}}))},
+		{name: "wrong audience", token: signRS256(t, rsaKey, "rsa", claims(map[string]interface{}{"aud": "other"})), wantErr: true},
+		{name: "missing audience", token: signRS256(t, rsaKey, "rsa", claims(map[string]interface{}{"aud": nil})), wantErr: true},
+		{name: "wrong issuer", token: signRS256(t, rsaKey, "rsa", claims(map[string]interface{}{"iss": "https://evil.example.com"})), wantErr: true},
+		{name: "missing issuer", token: signRS256(t, rsaKey, "rsa", claims(map[string]interface{}{"iss": nil})), wantErr: true},
+		{name: "expired", token: signRS256(t, rsaKey, "rsa", claims(map[string]interface{}{"exp": time.Now().Add(-time.Minute).Unix()})), wantErr: true},
+		{name: "no expiry", token: signRS256(t, rsaKey, "rsa", claims(map[string]interface{}{"exp": nil})), wantErr: true},
+		{name: "not yet valid", token: signRS256(t, rsaKey, "rsa", claims(map[string]interface{}{"nbf": time.Now().Add(time.Hour).Unix()})), wantErr: true},
+		{name: "no workspace", token: signRS256(t, rsaKey, "rsa", claims(map[string]interface{}{"workspace_id": nil})), wantErr: true},
+		{name: "signed by unknown key", token: signRS256(t, otherKey, "rsa", claims(nil)), wantErr: true},
+		{name: "unknown key id", token: signRS256(t, otherKey, "other", claims(nil)), wantErr: true},
+		{name: "algorithm none", token: encodeSegment(t, map[string]string{"alg": "none", "kid": "rsa"}) + "." + encodeSegment(t, claims(nil)) + ".", wantErr: true},
+		{name: "algorithm does not match key", token: signRS256(t, rsaKey, "ec", claims(nil)), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := v.validate(tt.token)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got claims %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.Workspace != getWorkspacePrefix("ws1") || got.ID != "jwt-user1" {
+				t.Errorf("unexpected claims %+v", got)
+			}
+		})
+	}
+
+	// Unknown key IDs must not trigger a fetch per request
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("JWKS fetched %d times, want 1", n)
+	}
+}
+
+func TestNewJWTValidatorRequiresIssuerAndAudience(t *testing.T) {
+	t.Setenv("KV_JWT_JWKS_URL", "http://127.0.0.1/jwks")
+	t.Setenv("KV_JWT_ISSUER", "https://obot.example.com")
+	if _, err := newJWTValidator(); err == nil {
+		t.Error("expected an error without KV_JWT_AUDIENCE")
+	}
+	t.Setenv("KV_JWT_AUDIENCE", "kv-store")
+	if v, err := newJWTValidator(); err != nil || v == nil {
+		t.Errorf("unexpected result %v, %v", v, err)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// Log formats. Text keeps the free-form lines of the standard logger, JSON writes an object
+// with a time, level and message per line for log pipelines to ingest.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logOutput is where the service and the embedded NATS server log to
+type logOutput struct {
+	format string
+	lock   sync.Mutex
+	out    io.Writer
+	// file is set when logging to a file, which is rotated
+	file *rotatingFile
+}
+
+// LogEntry is a line of the JSON log format
+type LogEntry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Source  string    `json:"source"`
+	Message string    `json:"msg"`
+}
+
+// configureLogging reads KV_LOG_FORMAT, text or json, and KV_LOG_FILE, a file to log to
+// instead of stderr, and sends the standard logger there. Log files are rotated once they
+// reach KV_LOG_MAX_SIZE bytes or are older than KV_LOG_MAX_AGE, keeping the newest
+// KV_LOG_MAX_FILES rotated files.
+func configureLogging() (*logOutput, error) {
+	format := getEnvOrDefault("KV_LOG_FORMAT", logFormatText)
+	if format != logFormatText && format != logFormatJSON {
+		return nil, fmt.Errorf("invalid KV_LOG_FORMAT %q, must be text or json", format)
+	}
+	o := &logOutput{format: format, out: os.Stderr}
+
+	if path := getEnvOrDefault("KV_LOG_FILE", ""); path != "" {
+		var err error
+		if o.file, err = newRotatingFile(path); err != nil {
+			return nil, err
+		}
+		o.out = o.file
+	}
+
+	log.SetOutput(o)
+	if format == logFormatJSON {
+		log.SetFlags(0)
+	}
+	return o, nil
+}
+
+// Write takes the lines of the standard logger. They carry no level, so lines about a
+// failure are logged as errors and the others as info.
+func (o *logOutput) Write(p []byte) (int, error) {
+	if o.format == logFormatJSON {
+		message := strings.TrimSuffix(string(p), "\n")
+		return len(p), o.writeJSON(messageLevel(message), "kv-store", message)
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.out.Write(p)
+}
+
+func (o *logOutput) writeJSON(level, source, message string) error {
+	data, err := json.Marshal(LogEntry{Time: time.Now().UTC(), Level: level, Source: source, Message: message})
+	if err != nil {
+		return err
+	}
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	_, err = o.out.Write(append(data, '\n'))
+	return err
+}
+
+// messageLevel guesses the level of a line of the standard logger
+func messageLevel(message string) string {
+	lower := strings.ToLower(message)
+	for _, word := range []string{"failed", "error", "invalid", "panic"} {
+		if strings.Contains(lower, word) {
+			return "error"
+		}
+	}
+	return "info"
+}
+
+// configureNATSLogger sends the logs of the embedded NATS server to the same output. Its
+// default logger is kept when logging text to stderr, as nothing changes then.
+func (o *logOutput) configureNATSLogger(ns *server.Server, opts *server.Options) {
+	if o.format == logFormatText && o.file == nil {
+		ns.ConfigureLogger()
+		return
+	}
+	ns.SetLoggerV2(&natsLogger{o}, opts.Debug, opts.Trace, false)
+}
+
+// natsLogger logs for the NATS server with the levels it gives its lines
+type natsLogger struct {
+	o *logOutput
+}
+
+func (l *natsLogger) log(level, format string, v ...any) {
+	message := fmt.Sprintf(format, v...)
+	if l.o.format == logFormatJSON {
+		l.o.writeJSON(level, "nats", message)
+		return
+	}
+	log.Printf("[nats] [%s] %s", strings.ToUpper(level), message)
+}
+
+func (l *natsLogger) Noticef(format string, v ...any) { l.log("info", format, v...) }
+func (l *natsLogger) Warnf(format string, v ...any)   { l.log("warn", format, v...) }
+func (l *natsLogger) Errorf(format string, v ...any)  { l.log("error", format, v...) }
+func (l *natsLogger) Debugf(format string, v ...any)  { l.log("debug", format, v...) }
+func (l *natsLogger) Tracef(format string, v ...any)  { l.log("trace", format, v...) }
+
+func (l *natsLogger) Fatalf(format string, v ...any) {
+	l.log("fatal", format, v...)
+	os.Exit(1)
+}
+
+// rotatingFile is a log file that is moved aside, named after the time it was rotated,
+// once it grows too large or too old. Callers serialize writes.
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// newRotatingFile opens a log file rotated by KV_LOG_MAX_SIZE, KV_LOG_MAX_AGE and
+// KV_LOG_MAX_FILES
+func newRotatingFile(path string) (*rotatingFile, error) {
+	maxSize, err := strconv.ParseInt(getEnvOrDefault("KV_LOG_MAX_SIZE", "104857600"), 10, 64)
+	if err != nil || maxSize <= 0 {
+		return nil, fmt.Errorf("invalid KV_LOG_MAX_SIZE: must be a positive number of bytes")
+	}
+	maxAge, err := time.ParseDuration(getEnvOrDefault("KV_LOG_MAX_AGE", "0s"))
+	if err != nil || maxAge < 0 {
+		return nil, fmt.Errorf("invalid KV_LOG_MAX_AGE: must be a duration")
+	}
+	maxFiles, err := strconv.Atoi(getEnvOrDefault("KV_LOG_MAX_FILES", "5"))
+	if err != nil || maxFiles < 0 {
+		return nil, fmt.Errorf("invalid KV_LOG_MAX_FILES: must be a number of files")
+	}
+	f := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return fmt.Errorf("failed to create the log directory: %v", err)
+	}
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open the log file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open the log file: %v", err)
+	}
+	f.file, f.size, f.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	full := f.size > 0 && f.size+int64(len(p)) > f.maxSize
+	old := f.maxAge > 0 && time.Since(f.opened) > f.maxAge
+	if full || old {
+		if err := f.rotate(); err != nil {
+			// Keep logging to the current file rather than losing lines
+			fmt.Fprintf(os.Stderr, "Failed to rotate the log file: %v\n", err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside, starts a new one and removes the oldest rotated
+// files beyond the number kept
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	rotated := f.path + "." + time.Now().UTC().Format("20060102T150405.000000")
+	if err := os.Rename(f.path, rotated); err != nil {
+		f.open()
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	// Rotated names sort by the time they were rotated
+	names, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return err
+	}
+	slices.Sort(names)
+	for len(names) > f.maxFiles {
+		if err := os.Remove(names[0]); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
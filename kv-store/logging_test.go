@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJSONLogs(t *testing.T) {
+	var out bytes.Buffer
+	o := &logOutput{format: logFormatJSON, out: &out}
+	o.Write([]byte("Failed to flush stats: timeout\n"))
+	(&natsLogger{o}).Warnf("slow consumer %d", 3)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", out.String())
+	}
+	var entry LogEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Level != "error" || entry.Source != "kv-store" || entry.Message != "Failed to flush stats: timeout" || entry.Time.IsZero() {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Level != "warn" || entry.Source != "nats" || entry.Message != "slow consumer 3" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logs", "kv.log")
+	f := &rotatingFile{path: path, maxSize: 100, maxFiles: 2}
+	if err := f.open(); err != nil {
+		t.Fatal(err)
+	}
+	line := []byte(strings.Repeat("x", 59) + "\n")
+	for i := 0; i < 5; i++ {
+		if _, err := f.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 2 {
+		t.Errorf("expected 2 rotated files, got %v", rotated)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(len(line)) {
+		t.Errorf("the current file should hold the last line, got %v, %v", info, err)
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The LZ4 block format: a sequence of a token, whose high nibble is the length of the
+// literals that follow and low nibble the length of the match after them less 4, the
+// literals, and the little endian offset of the match. Lengths of 15 continue in the bytes
+// after the token or offset, adding each until one is below 255. The last sequence only has
+// literals. Blocks don't record their size, which compressed values store instead.
+const (
+	lz4MinMatch = 4
+	// lz4MatchLimit is how close to the end a match may start, and lz4LastLiterals how many
+	// bytes at the end are always literals
+	lz4MatchLimit   = 12
+	lz4LastLiterals = 5
+	lz4MaxOffset    = 65535
+	lz4HashLog      = 14
+)
+
+// lz4CompressBlock compresses a value as an LZ4 block, finding matches of 4 bytes with a
+// hash table of the positions they were last seen at
+func lz4CompressBlock(src []byte) []byte {
+	dst := make([]byte, 0, len(src)/2)
+	var table [1 << lz4HashLog]int32
+	anchor := 0
+	for i := 0; i < len(src)-lz4MatchLimit; {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := (seq * 2654435761) >> (32 - lz4HashLog)
+		// Positions are stored plus one, so 0 means none
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+
+		length := lz4MinMatch
+		for i+length < len(src)-lz4LastLiterals && src[ref+length] == src[i+length] {
+			length++
+		}
+		dst = lz4AppendSequence(dst, src[anchor:i], i-ref, length)
+		i += length
+		anchor = i
+	}
+	return lz4AppendSequence(dst, src[anchor:], 0, 0)
+}
+
+// lz4AppendSequence appends literals followed by a match, or only the literals for the last
+// sequence, which has no match
+func lz4AppendSequence(dst, literals []byte, offset, length int) []byte {
+	token := byte(min(len(literals), 15)) << 4
+	if offset > 0 {
+		token |= byte(min(length-lz4MinMatch, 15))
+	}
+	dst = append(dst, token)
+	dst = lz4AppendLength(dst, len(literals))
+	dst = append(dst, literals...)
+	if offset == 0 {
+		return dst
+	}
+	dst = binary.LittleEndian.AppendUint16(dst, uint16(offset))
+	return lz4AppendLength(dst, length-lz4MinMatch)
+}
+
+// lz4AppendLength appends the continuation of a length that doesn't fit in its nibble
+func lz4AppendLength(dst []byte, n int) []byte {
+	if n < 15 {
+		return dst
+	}
+	for n -= 15; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+// lz4DecompressBlock expands an LZ4 block to a value of the given size
+func lz4DecompressBlock(src []byte, size int) ([]byte, error) {
+	dst := make([]byte, 0, size)
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+		literals, n, err := lz4ReadLength(src[i:], int(token>>4))
+		if err != nil {
+			return nil, err
+		}
+		i += n
+		if literals > len(src)-i || literals > size-len(dst) {
+			return nil, fmt.Errorf("lz4 literals overrun the block")
+		}
+		dst = append(dst, src[i:i+literals]...)
+		i += literals
+		if i == len(src) {
+			break
+		}
+
+		if len(src)-i < 2 {
+			return nil, fmt.Errorf("lz4 block is truncated")
+		}
+		offset := int(binary.LittleEndian.Uint16(src[i:]))
+		i += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, fmt.Errorf("lz4 match offset is out of range")
+		}
+		length, n, err := lz4ReadLength(src[i:], int(token&15))
+		if err != nil {
+			return nil, err
+		}
+		i += n
+		length += lz4MinMatch
+		if length > size-len(dst) {
+			return nil, fmt.Errorf("lz4 match overruns the value")
+		}
+		// Matches can overlap the bytes they produce, so they are copied a byte at a time
+		start := len(dst) - offset
+		for j := 0; j < length; j++ {
+			dst = append(dst, dst[start+j])
+		}
+	}
+	return dst, nil
+}
+
+// lz4ReadLength reads the continuation of a length starting at its nibble, returning the
+// length and the bytes read
+func lz4ReadLength(src []byte, nibble int) (int, int, error) {
+	if nibble < 15 {
+		return nibble, 0, nil
+	}
+	length := nibble
+	for i, b := range src {
+		length += int(b)
+		if length > maxDecompressedSize {
+			return 0, 0, fmt.Errorf("lz4 length is out of range")
+		}
+		if b < 255 {
+			return length, i + 1, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("lz4 block is truncated")
+}
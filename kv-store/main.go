@@ -3,8 +3,10 @@ package main
 import (
 	"bytes"
 	"crypto/sha1"
+	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -12,9 +14,14 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"github.com/nats-io/nats-server/v2/server"
@@ -25,11 +32,72 @@ type KVResponse struct {
 	Success bool        `json:"success"`
 	Data    interface{} `json:"data,omitempty"`
 	Error   string      `json:"error,omitempty"`
+	Code    string      `json:"code,omitempty"`
+	// TTL is the number of seconds left before a key that was read expires
+	TTL int64 `json:"ttl,omitempty"`
+	// Revision is the revision of a key that was read or put, or the revision it has when a
+	// put expecting another one conflicts
+	Revision uint64 `json:"revision,omitempty"`
+	// NextCursor continues a paged list, and is empty on its last page
+	NextCursor string `json:"next_cursor,omitempty"`
 }
 
+// Error codes identify the errors clients can handle, e.g. by backing off
+const (
+	errCodeRateLimited = "rate_limited"
+	errCodeOverloaded  = "overloaded"
+	errCodeInternal    = "internal_error"
+	errCodeDiskFull    = "disk_full"
+	errCodeBucketLimit = "bucket_limit"
+	errCodeConflict    = "revision_conflict"
+)
+
 type KVRequest struct {
 	Key   string `json:"key"`
 	Value string `json:"value"`
+	// ValueBase64 puts a binary value, such as an image, encoded as base64 instead of Value
+	ValueBase64 string `json:"value_base64,omitempty"`
+	// Encoding is base64 to get the value encoded as base64, for binary values
+	Encoding string `json:"encoding,omitempty"`
+	// Scope addresses the thread, user or workspace level instead of all of them
+	Scope string `json:"scope,omitempty"`
+	// Grace delays a delete by a duration such as 10m, during which it can be canceled
+	Grace string `json:"grace,omitempty"`
+	// TTL expires a put key after a duration such as 10m or a number of seconds
+	TTL string `json:"ttl,omitempty"`
+	// Consistency is strong, or eventual for reads served from a local copy of the bucket
+	Consistency string `json:"consistency,omitempty"`
+	// Revision gets a prior revision of the key instead of its latest value
+	Revision flexibleInt `json:"revision,omitempty"`
+	// ExpectedRevision only puts the key if it's still at this revision, or 0 if the key
+	// must not exist yet
+	ExpectedRevision *flexibleInt `json:"expected_revision,omitempty"`
+}
+
+type ListRequest struct {
+	Stats       bool   `json:"stats,omitempty"`
+	Scope       string `json:"scope,omitempty"`
+	Consistency string `json:"consistency,omitempty"`
+	// Prefix and Pattern only list the keys starting with the prefix and matching the glob
+	Prefix  string `json:"prefix,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+	// Limit and Cursor page through the keys in order, instead of listing them all at once
+	Limit  flexibleInt `json:"limit,omitempty"`
+	Cursor string      `json:"cursor,omitempty"`
+	// Include adds the metadata or the values of the keys, each read on the server
+	Include stringList `json:"include,omitempty"`
+}
+
+type KeyInfo struct {
+	Key   string    `json:"key"`
+	Stats *KeyStats `json:"stats,omitempty"`
+	// Revision, Created, Modified and Size are set when a list includes metadata, and Value
+	// when it includes values. Created is only known for keys written since it's recorded.
+	Revision uint64     `json:"revision,omitempty"`
+	Created  *time.Time `json:"created,omitempty"`
+	Modified *time.Time `json:"modified,omitempty"`
+	Size     *int       `json:"size,omitempty"`
+	Value    *string    `json:"value,omitempty"`
 }
 
 type OutputFilterRequest struct {
@@ -42,10 +110,77 @@ type OutputFilterResponse struct {
 	Success bool   `json:"success"`
 	Error   string `json:"error,omitempty"`
 	Key     string `json:"key,omitempty"`
+	// Redacted names the kinds of secrets removed from the output before it was stored
+	Redacted []string `json:"redacted,omitempty"`
 }
 
 type Server struct {
-	nc *nats.Conn
+	nc                   *nats.Conn
+	embeddings           *embeddingsClient
+	signer               *urlSigner
+	publicURL            string
+	artifactURLTTL       time.Duration
+	artifactURLMaxTTL    time.Duration
+	uploadPartMaxSize    int64
+	history              uint8
+	historyRules         []historyRule
+	delegatedTokenTTL    time.Duration
+	delegatedTokenMaxTTL time.Duration
+	adminToken           string
+	access               *accessTracker
+	eventsSubject        string
+	computedLock         sync.Mutex
+	computed             map[string]*computedWatcher
+	indexLock            sync.Mutex
+	indexes              map[string]*indexWatcher
+	outputGCAge          time.Duration
+	partitionMode        string
+	partitionTTL         time.Duration
+	expirySweepInterval  time.Duration
+	scheduleInterval     time.Duration
+	scheduleMaxDelay     time.Duration
+	webhooks             *webhookDispatcher
+	acls                 *aclCache
+	jwt                  *jwtValidator
+	apiKeys              *apiKeyCache
+	requireAuth          bool
+	usage                *usageMeter
+	usageRecordInterval  time.Duration
+	sqlTimeout           time.Duration
+	sqlMaxBytes          int64
+	shutdownTimeout      time.Duration
+	// stopping is closed when the store starts shutting down, to end requests that would
+	// otherwise run until their client leaves
+	stopping       chan struct{}
+	tokenLimiter   *rateLimiter
+	tokenRateLimit int
+	tokenRateBurst int
+	ipLimit        *ipRateLimit
+	disk           *diskMonitor
+	bucketLimit    *bucketLimit
+	replicaID      string
+	replication    *replicator
+	backups        *backupScheduler
+	encryption     *keyring
+	admission      *admissionControl
+	durability     *durability
+	secrets        *secretScanner
+	pii            *piiDetector
+	deltas         *deltaEncoder
+	compression    *compressor
+	accessLog      *accessLog
+	follower       *follower
+	readCache      *readCache
+	hotKeys        *hotKeyCache
+	shards         *sharding
+	journal        *journal
+	reporter       *errorReporter
+	health         *healthMonitor
+	tls            *httpTLS
+	httpOptions    *httpOptions
+	userScope      bool
+	threadScope    bool
+	natsURL        string
 }
 
 // getGPTScriptEnv extracts environment values from the X-GPTScript-Env header
@@ -80,13 +215,18 @@ func getPrefixFromEnv(headers http.Header) string {
 		return "default"
 	}
 
-	hasher := sha1.New()
-	hasher.Write([]byte(envValue))
-	prefix := hex.EncodeToString(hasher.Sum(nil))
+	prefix := getWorkspacePrefix(envValue)
 	log.Printf("Using bucket prefix: %s (from GPTSCRIPT_WORKSPACE_ID: %s)", prefix, envValue)
 	return prefix
 }
 
+// getWorkspacePrefix generates the SHA1 bucket prefix of a workspace ID
+func getWorkspacePrefix(workspaceID string) string {
+	hasher := sha1.New()
+	hasher.Write([]byte(workspaceID))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
 // getFullKey converts a user key to a full internal key path
 func getFullKey(headers http.Header, userKey string) string {
 	prefix := getPrefixFromEnv(headers)
@@ -104,21 +244,350 @@ func getUserKey(fullKey string) string {
 }
 
 func NewServer(nc *nats.Conn) (*Server, error) {
-	return &Server{
-		nc: nc,
-	}, nil
+	artifactURLTTL, err := time.ParseDuration(getEnvOrDefault("KV_ARTIFACT_URL_TTL", "24h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid KV_ARTIFACT_URL_TTL: %v", err)
+	}
+	artifactURLMaxTTL, err := time.ParseDuration(getEnvOrDefault("KV_ARTIFACT_URL_MAX_TTL", "168h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid KV_ARTIFACT_URL_MAX_TTL: %v", err)
+	}
+
+	uploadPartMaxSize, err := strconv.ParseInt(getEnvOrDefault("KV_UPLOAD_PART_MAX_SIZE", "67108864"), 10, 64)
+	if err != nil || uploadPartMaxSize <= 0 {
+		return nil, fmt.Errorf("invalid KV_UPLOAD_PART_MAX_SIZE: must be a positive number of bytes")
+	}
+
+	history, err := strconv.ParseUint(getEnvOrDefault("KV_HISTORY", "1"), 10, 8)
+	if err != nil || history < 1 || history > 64 {
+		return nil, fmt.Errorf("invalid KV_HISTORY: must be between 1 and 64")
+	}
+	historyRules, err := parseHistoryRules(getEnvOrDefault("KV_HISTORY_RULES", ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid KV_HISTORY_RULES: %v", err)
+	}
+
+	delegatedTokenTTL, err := time.ParseDuration(getEnvOrDefault("KV_DELEGATED_TOKEN_TTL", "15m"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid KV_DELEGATED_TOKEN_TTL: %v", err)
+	}
+	delegatedTokenMaxTTL, err := time.ParseDuration(getEnvOrDefault("KV_DELEGATED_TOKEN_MAX_TTL", "24h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid KV_DELEGATED_TOKEN_MAX_TTL: %v", err)
+	}
+
+	outputGCAge, err := time.ParseDuration(getEnvOrDefault("KV_OUTPUT_GC_AGE", "24h"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid KV_OUTPUT_GC_AGE: %v", err)
+	}
+
+	partitionMode := getEnvOrDefault("KV_PARTITION_MODE", partitionNone)
+	if partitionMode != partitionNone && partitionMode != partitionOutput && partitionMode != partitionAll {
+		return nil, fmt.Errorf("invalid KV_PARTITION_MODE %q, must be none, output or all", partitionMode)
+	}
+	partitionTTL, err := time.ParseDuration(getEnvOrDefault("KV_PARTITION_TTL", "0s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid KV_PARTITION_TTL: %v", err)
+	}
+	expirySweepInterval, err := time.ParseDuration(getEnvOrDefault("KV_EXPIRY_SWEEP_INTERVAL", "1m"))
+	if err != nil || expirySweepInterval <= 0 {
+		return nil, fmt.Errorf("invalid KV_EXPIRY_SWEEP_INTERVAL: must be a positive duration")
+	}
+	scheduleInterval, err := time.ParseDuration(getEnvOrDefault("KV_SCHEDULE_INTERVAL", "5s"))
+	if err != nil || scheduleInterval <= 0 {
+		return nil, fmt.Errorf("invalid KV_SCHEDULE_INTERVAL: must be a positive duration")
+	}
+	scheduleMaxDelay, err := time.ParseDuration(getEnvOrDefault("KV_SCHEDULE_MAX_DELAY", "720h"))
+	if err != nil || scheduleMaxDelay <= 0 {
+		return nil, fmt.Errorf("invalid KV_SCHEDULE_MAX_DELAY: must be a positive duration")
+	}
+	usageRecordInterval, err := time.ParseDuration(getEnvOrDefault("KV_USAGE_RECORD_INTERVAL", "1h"))
+	if err != nil || usageRecordInterval < 0 || (usageRecordInterval > 0 && usageRecordInterval < time.Minute) {
+		return nil, fmt.Errorf("invalid KV_USAGE_RECORD_INTERVAL: must be 0 to disable usage records, or at least 1m")
+	}
+	sqlTimeout, err := time.ParseDuration(getEnvOrDefault("KV_SQL_TIMEOUT", "10s"))
+	if err != nil || sqlTimeout <= 0 {
+		return nil, fmt.Errorf("invalid KV_SQL_TIMEOUT: must be a positive duration")
+	}
+	sqlMaxBytes, err := strconv.ParseInt(getEnvOrDefault("KV_SQL_MAX_BYTES", "67108864"), 10, 64)
+	if err != nil || sqlMaxBytes <= 0 {
+		return nil, fmt.Errorf("invalid KV_SQL_MAX_BYTES: must be a positive number of bytes")
+	}
+	shutdownTimeout, err := time.ParseDuration(getEnvOrDefault("KV_SHUTDOWN_TIMEOUT", "30s"))
+	if err != nil || shutdownTimeout <= 0 {
+		return nil, fmt.Errorf("invalid KV_SHUTDOWN_TIMEOUT: must be a positive duration")
+	}
+	webhooks, err := newWebhookDispatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	tokenRateLimit, err := strconv.Atoi(getEnvOrDefault("KV_TOKEN_RATE_LIMIT", "0"))
+	if err != nil || tokenRateLimit < 0 {
+		return nil, fmt.Errorf("invalid KV_TOKEN_RATE_LIMIT: must be a number of requests per minute")
+	}
+	tokenRateBurst, err := strconv.Atoi(getEnvOrDefault("KV_TOKEN_RATE_BURST", "0"))
+	if err != nil || tokenRateBurst < 0 {
+		return nil, fmt.Errorf("invalid KV_TOKEN_RATE_BURST: must be a number of requests")
+	}
+
+	jwt, err := newJWTValidator()
+	if err != nil {
+		return nil, err
+	}
+
+	replicaID := getReplicaID()
+	replication, err := newReplicator(replicaID)
+	if err != nil {
+		return nil, err
+	}
+
+	reporter, err := newErrorReporter(replicaID)
+	if err != nil {
+		return nil, err
+	}
+
+	health, err := newHealthMonitor()
+	if err != nil {
+		return nil, err
+	}
+
+	httpTLS, err := newHTTPTLS()
+	if err != nil {
+		return nil, err
+	}
+
+	httpOptions, err := newHTTPOptions(getEnvOrDefault("PORT", "8080"))
+	if err != nil {
+		return nil, err
+	}
+	if httpOptions.http3Port != "" && httpTLS == nil {
+		return nil, fmt.Errorf("KV_HTTP3 requires KV_TLS_CERT and KV_TLS_KEY, as QUIC is always encrypted")
+	}
+
+	backups, err := newBackupScheduler()
+	if err != nil {
+		return nil, err
+	}
+
+	admission, err := newAdmissionControl()
+	if err != nil {
+		return nil, err
+	}
+
+	durability, err := newDurability()
+	if err != nil {
+		return nil, err
+	}
+
+	secrets, err := newSecretScanner()
+	if err != nil {
+		return nil, err
+	}
+
+	pii, err := newPIIDetector()
+	if err != nil {
+		return nil, err
+	}
+
+	deltas, err := newDeltaEncoder()
+	if err != nil {
+		return nil, err
+	}
+	if err := deltas.checkHistory(uint8(history), historyRules); err != nil {
+		return nil, err
+	}
+
+	compression, err := newCompressor()
+	if err != nil {
+		return nil, err
+	}
+
+	accessLog, err := newAccessLog()
+	if err != nil {
+		return nil, err
+	}
+
+	ipLimit, err := newIPRateLimit()
+	if err != nil {
+		return nil, err
+	}
+
+	disk, err := newDiskMonitor()
+	if err != nil {
+		return nil, err
+	}
+
+	bucketLimit, err := newBucketLimit()
+	if err != nil {
+		return nil, err
+	}
+
+	follower, err := newFollower()
+	if err != nil {
+		return nil, err
+	}
+
+	readCache, err := newReadCache()
+	if err != nil {
+		return nil, err
+	}
+
+	hotKeys, err := newHotKeyCache()
+	if err != nil {
+		return nil, err
+	}
+
+	shards, err := newSharding()
+	if err != nil {
+		return nil, err
+	}
+
+	journal, err := newJournal()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		nc:                   nc,
+		embeddings:           newEmbeddingsClient(),
+		signer:               newURLSigner(),
+		publicURL:            strings.TrimSuffix(getEnvOrDefault("KV_PUBLIC_URL", ""), "/"),
+		artifactURLTTL:       artifactURLTTL,
+		artifactURLMaxTTL:    artifactURLMaxTTL,
+		uploadPartMaxSize:    uploadPartMaxSize,
+		history:              uint8(history),
+		historyRules:         historyRules,
+		delegatedTokenTTL:    delegatedTokenTTL,
+		delegatedTokenMaxTTL: delegatedTokenMaxTTL,
+		adminToken:           getEnvOrDefault("KV_ADMIN_TOKEN", ""),
+		access:               newAccessTracker(),
+		eventsSubject:        getEnvOrDefault("KV_EVENTS_SUBJECT", "kv.events"),
+		computed:             map[string]*computedWatcher{},
+		indexes:              map[string]*indexWatcher{},
+		outputGCAge:          outputGCAge,
+		partitionMode:        partitionMode,
+		partitionTTL:         partitionTTL,
+		expirySweepInterval:  expirySweepInterval,
+		scheduleInterval:     scheduleInterval,
+		scheduleMaxDelay:     scheduleMaxDelay,
+		webhooks:             webhooks,
+		acls:                 newACLCache(),
+		jwt:                  jwt,
+		apiKeys:              newAPIKeyCache(),
+		requireAuth:          getEnvOrDefault("KV_REQUIRE_AUTH", "false") == "true",
+		usage:                newUsageMeter(usageRecordInterval > 0),
+		usageRecordInterval:  usageRecordInterval,
+		sqlTimeout:           sqlTimeout,
+		sqlMaxBytes:          sqlMaxBytes,
+		shutdownTimeout:      shutdownTimeout,
+		stopping:             make(chan struct{}),
+		tokenLimiter:         newRateLimiter(),
+		tokenRateLimit:       tokenRateLimit,
+		tokenRateBurst:       tokenRateBurst,
+		replicaID:            replicaID,
+		replication:          replication,
+		backups:              backups,
+		admission:            admission,
+		durability:           durability,
+		secrets:              secrets,
+		pii:                  pii,
+		deltas:               deltas,
+		compression:          compression,
+		accessLog:            accessLog,
+		ipLimit:              ipLimit,
+		disk:                 disk,
+		bucketLimit:          bucketLimit,
+		follower:             follower,
+		readCache:            readCache,
+		hotKeys:              hotKeys,
+		shards:               shards,
+		journal:              journal,
+		reporter:             reporter,
+		health:               health,
+		tls:                  httpTLS,
+		httpOptions:          httpOptions,
+		userScope:            getEnvOrDefault("KV_USER_SCOPE", "false") == "true",
+		threadScope:          getEnvOrDefault("KV_THREAD_SCOPE", "false") == "true",
+	}
+	if s.encryption, err = s.newKeyring(); err != nil {
+		return nil, err
+	}
+	if err := s.watchShards(); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
-// getBucket gets or creates a bucket for the given prefix
+// getBucket gets or creates a bucket for the given prefix. Values of data buckets are
+// encrypted, compressed and delta encoded when those are enabled, and spread over shards
+// when the workspace is sharded. Their changes are recorded in the journal when it is kept.
 func (s *Server) getBucket(prefix string) (nats.KeyValue, error) {
+	kv, err := s.getRawBucket(prefix)
+	if err != nil || !isDataBucket(prefix) {
+		return kv, err
+	}
+	kv = s.shardBuckets(prefix, s.wrapDataBucket(kv), func(name string) (nats.KeyValue, error) {
+		shard, err := s.getRawBucket(name)
+		if err != nil {
+			return nil, err
+		}
+		return s.wrapDataBucket(shard), nil
+	})
+	if s.journal != nil {
+		kv = &journaledBucket{KeyValue: kv, s: s, prefix: prefix}
+	}
+	return kv, nil
+}
+
+// wrapDataBucket reads and writes the values of a raw data bucket decrypted, expanded and
+// rebuilt from the revisions they are stored as changes of
+func (s *Server) wrapDataBucket(kv nats.KeyValue) nats.KeyValue {
+	if s.encryption != nil {
+		kv = &encryptedBucket{KeyValue: kv, keys: s.encryption}
+	}
+	// Compressed values are read even with compression off, as they may have been written
+	// before it was turned off
+	kv = &compressedBucket{KeyValue: kv, c: s.compression}
+	return &deltaBucket{KeyValue: kv, s: s}
+}
+
+// getRawBucket gets or creates a bucket for the given prefix, reading and writing values as
+// they are stored
+func (s *Server) getRawBucket(prefix string) (nats.KeyValue, error) {
 	js, err := s.nc.JetStream()
 	if err != nil {
 		return nil, fmt.Errorf("failed to create JetStream context: %v", err)
 	}
 
-	kv, err := js.CreateKeyValue(&nats.KeyValueConfig{
-		Bucket: prefix,
-	})
+	config := &nats.KeyValueConfig{
+		Bucket:   prefix,
+		Replicas: s.durability.bucketReplicas(bucketClass(prefix)),
+	}
+	// Data buckets keep the deepest configured history, and trim keys that keep less
+	if isDataBucket(prefix) {
+		config.History = s.bucketHistory()
+	}
+	// Per-tool partitions can have their own retention
+	if isPartition(prefix) {
+		config.TTL = s.partitionRetention()
+	}
+	if strings.HasSuffix(prefix, "-deadletters") && s.webhooks != nil {
+		config.TTL = s.webhooks.deadLetter
+	}
+	if strings.HasSuffix(prefix, "-pii-audit") && s.pii != nil {
+		config.TTL = s.pii.auditTTL
+	}
+	// Followers only hold mirrors of the primary's buckets, which fill in once the primary
+	// creates them
+	if s.follower != nil {
+		config.Mirror = s.follower.source(prefix)
+	}
+
+	if err := s.reserveBucket(prefix); err != nil {
+		return nil, err
+	}
+	kv, err := js.CreateKeyValue(config)
 	if err != nil {
 		// If it already exists, try to get it
 		kv, err = js.KeyValue(prefix)
@@ -126,9 +595,47 @@ func (s *Server) getBucket(prefix string) (nats.KeyValue, error) {
 			return nil, fmt.Errorf("failed to create/get KV store: %v", err)
 		}
 	}
+	if !isDataBucket(prefix) {
+		return kv, nil
+	}
+	kv = &checksumBucket{KeyValue: kv}
+	if len(s.historyRules) > 0 {
+		return &historyBucket{KeyValue: kv, s: s, js: js}, nil
+	}
 	return kv, nil
 }
 
+// scanBucket calls fn with the latest entry of every key in the bucket, reading them in a
+// single pass over the underlying stream instead of a get per key
+func scanBucket(bucket nats.KeyValue, fn func(entry nats.KeyValueEntry)) error {
+	watcher, err := bucket.WatchAll(nats.IgnoreDeletes())
+	if err != nil {
+		return err
+	}
+	defer watcher.Stop()
+
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		fn(entry)
+	}
+	return nil
+}
+
+// matchKey reports whether a key has the given prefix and matches the glob pattern, where
+// empty values match every key
+func matchKey(key, prefix, pattern string) bool {
+	if !strings.HasPrefix(key, prefix) {
+		return false
+	}
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, key)
+	return ok
+}
+
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Create a response wrapper to capture the response
 	rw := &responseWriter{
@@ -138,26 +645,58 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	w = rw
 
-	// Log incoming request
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("Error reading request body: %v", err)
-		http.Error(w, "Error reading request", http.StatusInternalServerError)
-		return
+	// Every request has an ID, which its log lines and responses carry
+	r, requestID := withRequestID(r)
+	rw.requestID = requestID
+	w.Header().Set(requestIDHeader, requestID)
+
+	// Requests are logged once answered. Panics are recovered into a server error, and
+	// server errors are reported with the request they happened in.
+	start := time.Now()
+	defer func() { s.accessLog.record(r, rw, start) }()
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			s.recoverRequest(r, rw, recovered)
+			return
+		}
+		s.reportRequest(r, rw)
+	}()
+
+	// Log incoming request. Upload parts are streamed into the object store instead of
+	// being buffered, up to the configured part size.
+	var body []byte
+	bodyReader := &countingReader{}
+	if isUploadPart(r) {
+		bodyReader.reader = http.MaxBytesReader(w, r.Body, s.uploadPartMaxSize)
+		r.Body = bodyReader
+	} else {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			logRequestf(r, "Error reading request body: %v", err)
+			http.Error(w, "Error reading request", http.StatusInternalServerError)
+			return
+		}
+		// Replace the body for further processing
+		r.Body = io.NopCloser(bytes.NewBuffer(body))
+		bodyReader.count = int64(len(body))
 	}
-	// Replace the body for further processing
-	r.Body = io.NopCloser(bytes.NewBuffer(body))
 
 	// Log request details including headers
-	log.Printf("Request: %s %s", r.Method, r.URL.Path)
-	log.Printf("Headers:")
+	logRequestf(r, "Request: %s %s", r.Method, r.URL.Path)
+	logRequestf(r, "Headers:")
 	for name, values := range r.Header {
 		for _, value := range values {
-			log.Printf("  %s: %s", name, value)
+			if name == "Authorization" {
+				value = "[REDACTED]"
+			}
+			logRequestf(r, "  %s: %s", name, value)
 		}
 	}
-	if len(body) > 0 {
-		log.Printf("Request Body: %s", string(body))
+	if len(body) > 0 && secretRequestRoutes[r.URL.Path] {
+		logRequestf(r, "Request Body: [REDACTED]")
+	} else if len(body) > 0 {
+		logRequestf(r, "Request Body: %s", s.loggedBody(r, body))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -165,55 +704,366 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// Handle health check endpoint
 	if r.URL.Path == "/api/ready" && r.Method == http.MethodGet {
 		w.WriteHeader(http.StatusOK)
-		log.Printf("Response: %d", http.StatusOK)
+		status := map[string]interface{}{}
+		if s.backups != nil {
+			status["backup"] = s.backups.getStatus()
+		}
+		if s.admission != nil {
+			status["load"] = s.admission.status()
+		}
+		if s.durability != nil {
+			status["durability"] = s.durability.status()
+		}
+		if s.follower != nil {
+			status["follower"] = s.follower.status()
+		}
+		if s.disk != nil {
+			status["disk"] = s.disk.status()
+		}
+		if len(status) > 0 {
+			json.NewEncoder(w).Encode(KVResponse{Success: true, Data: status})
+		}
+		logRequestf(r, "Response: %d", http.StatusOK)
+		return
+	}
+
+	// Handle pre-signed artifact downloads, which are authorized by their signature
+	if strings.HasPrefix(r.URL.Path, "/artifacts/download/") && r.Method == http.MethodGet {
+		s.handleArtifactPublicDownload(w, r)
+		logRequestf(r, "Response Status: %d", rw.status)
 		return
 	}
 
+	// Simple reads can also be made with GET, their query parameters standing in for the body
+	queryBody, queryRead, err := queryReadBody(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		logRequestf(r, "Response: %d - %v", http.StatusBadRequest, err)
+		return
+	}
+	if queryRead {
+		r.Body = io.NopCloser(bytes.NewReader(queryBody))
+	}
+
 	// All other endpoints should be POST
-	if r.Method != http.MethodPost {
+	if r.Method != http.MethodPost && !queryRead {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		log.Printf("Response: %d - Method not allowed", http.StatusMethodNotAllowed)
+		logRequestf(r, "Response: %d - Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Limit clients by address before authenticating them, so failed logins are limited too
+	if !strings.HasPrefix(r.URL.Path, "/api/admin/") {
+		if client, ok := s.checkIPRateLimit(w, r); !ok {
+			logRequestf(r, "Response: %d - rate limit exceeded for %s", http.StatusTooManyRequests, client)
+			return
+		}
+	}
+
+	// Validate delegated tokens before dispatching
+	r, status, err := s.authenticate(r)
+	if err != nil {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		logRequestf(r, "Response: %d - %v", status, err)
+		return
+	}
+
+	// Read replicas send writes to the primary
+	if s.rejectWrite(w, r) {
+		logRequestf(r, "Response: %d - read replica, %s is a write", http.StatusMisdirectedRequest, r.URL.Path)
+		return
+	}
+
+	// Writes are suspended while the disk is nearly full
+	if s.rejectDiskFull(w, r) {
+		logRequestf(r, "Response: %d - disk is nearly full, %s is a write", http.StatusInsufficientStorage, r.URL.Path)
+		return
+	}
+
+	// Requests of a new workspace create its bucket, which the store may hold no more of
+	if strings.HasPrefix(r.URL.Path, "/api/v1/") && !s.checkBucketLimit(w, r) {
+		logRequestf(r, "Response: %d - workspace limit reached", rw.status)
 		return
 	}
 
+	// Enforce per-token rate limits and meter usage per workspace and principal. Admin
+	// requests are neither limited nor queued, so operators can act on an overloaded server.
+	if !strings.HasPrefix(r.URL.Path, "/api/admin/") {
+		workspace, principal := getRequestPrefix(r), getPrincipal(r)
+		if !s.checkRateLimit(w, r) {
+			s.usage.record(workspace, principal, bodyReader.count, rw.written, true)
+			logRequestf(r, "Response: %d - rate limit exceeded for %s", http.StatusTooManyRequests, principal)
+			return
+		}
+		// Watches stay open until the client leaves, so they don't hold a request slot, and
+		// the operations of a batch are admitted one by one
+		release, ok := func() {}, true
+		if r.URL.Path != "/api/v1/watch" && r.URL.Path != "/api/v1/batch" {
+			release, ok = s.admit(w, r)
+		}
+		if !ok {
+			s.usage.record(workspace, principal, bodyReader.count, rw.written, true)
+			logRequestf(r, "Response: %d - request shed, the server is overloaded", http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+		defer func() {
+			s.usage.record(workspace, principal, bodyReader.count, rw.written, false)
+		}()
+	}
+
 	// Handle KV operations
 	switch r.URL.Path {
 	case "/api/v1/get":
 		s.handleGet(w, r)
 	case "/api/v1/put":
 		s.handlePut(w, r)
+	case "/api/v1/mput":
+		s.handleMPut(w, r)
 	case "/api/v1/delete":
 		s.handleDelete(w, r)
+	case "/api/v1/batch":
+		s.handleBatch(w, r)
+	case "/api/v1/delete/cancel":
+		s.handleDeleteCancel(w, r)
 	case "/api/v1/list":
 		s.handleList(w, r)
+	case "/api/v1/history":
+		s.handleHistory(w, r)
+	case "/api/v1/find":
+		s.handleFind(w, r)
+	case "/api/v1/sql":
+		s.handleSQL(w, r)
+	case "/api/v1/export":
+		s.handleCSVExport(w, r)
+	case "/api/v1/import":
+		s.handleCSVImport(w, r)
+	case "/api/v1/incr":
+		s.handleIncr(w, r)
+	case "/api/v1/json/get":
+		s.handleJSONGet(w, r)
+	case "/api/v1/json/patch":
+		s.handleJSONPatch(w, r)
+	case "/api/v1/hll/add":
+		s.handleHLLAdd(w, r)
+	case "/api/v1/hll/count":
+		s.handleHLLCount(w, r)
+	case "/api/v1/hll/delete":
+		s.handleHLLDelete(w, r)
+	case "/api/v1/crdt/update":
+		s.handleCRDTUpdate(w, r)
+	case "/api/v1/crdt/get":
+		s.handleCRDTGet(w, r)
+	case "/api/v1/crdt/delete":
+		s.handleCRDTDelete(w, r)
+	case "/api/v1/delete-prefix":
+		s.handleDeletePrefix(w, r)
 	case "/api/v1/output-filter":
 		s.handleOutputFilter(w, r)
+	case "/api/v1/output/stats":
+		s.handleOutputStats(w, r)
+	case "/api/v1/embeddings-cache":
+		s.handleEmbeddingsCache(w, r)
+	case "/api/v1/artifacts/create":
+		s.handleArtifactCreate(w, r)
+	case "/api/v1/artifacts/list":
+		s.handleArtifactList(w, r)
+	case "/api/v1/artifacts/get":
+		s.handleArtifactGet(w, r)
+	case "/api/v1/artifacts/download":
+		s.handleArtifactDownload(w, r)
+	case "/api/v1/artifacts/delete":
+		s.handleArtifactDelete(w, r)
+	case "/api/v1/objects/upload/initiate":
+		s.handleUploadInitiate(w, r)
+	case "/api/v1/objects/upload/part":
+		s.handleUploadPart(w, r)
+	case "/api/v1/objects/upload/status":
+		s.handleUploadStatus(w, r)
+	case "/api/v1/objects/upload/complete":
+		s.handleUploadComplete(w, r)
+	case "/api/v1/objects/upload/abort":
+		s.handleUploadAbort(w, r)
+	case "/api/v1/tokens/delegate":
+		s.handleDelegate(w, r)
+	case "/api/v1/metadata":
+		s.handleMetadata(w, r)
+	case "/api/v1/cdc":
+		s.handleCDC(w, r)
+	case "/api/v1/watch":
+		s.handleWatch(w, r)
+	case "/api/v1/namespaces":
+		s.handleNamespaceList(w, r)
+	case "/api/v1/namespaces/clear":
+		s.handleNamespaceClear(w, r)
+	case "/api/v1/schedule":
+		s.handleSchedule(w, r)
+	case "/api/v1/schedule/list":
+		s.handleScheduleList(w, r)
+	case "/api/v1/schedule/cancel":
+		s.handleScheduleCancel(w, r)
+	case "/api/v1/webhooks/create":
+		s.handleWebhookCreate(w, r)
+	case "/api/v1/webhooks/list":
+		s.handleWebhookList(w, r)
+	case "/api/v1/webhooks/delete":
+		s.handleWebhookDelete(w, r)
+	case "/api/v1/webhooks/replay":
+		s.handleWebhookReplay(w, r)
+	case "/api/v1/webhooks/dead-letters":
+		s.handleDeadLetterList(w, r)
+	case "/api/v1/webhooks/dead-letters/delete":
+		s.handleDeadLetterDelete(w, r)
+	case "/api/v1/computed/define":
+		s.handleComputedDefine(w, r)
+	case "/api/v1/computed/list":
+		s.handleComputedList(w, r)
+	case "/api/v1/computed/delete":
+		s.handleComputedDelete(w, r)
+	case "/api/v1/index/define":
+		s.handleIndexDefine(w, r)
+	case "/api/v1/index/list":
+		s.handleIndexList(w, r)
+	case "/api/v1/index/delete":
+		s.handleIndexDelete(w, r)
+	case "/api/v1/index/query":
+		s.handleIndexQuery(w, r)
+	case "/api/v1/aggregate":
+		s.handleAggregate(w, r)
+	case "/api/v1/snapshot/create":
+		s.handleSnapshotCreate(w, r)
+	case "/api/v1/snapshot/list":
+		s.handleSnapshotList(w, r)
+	case "/api/v1/snapshot/delete":
+		s.handleSnapshotDelete(w, r)
+	case "/api/v1/snapshot/restore":
+		s.handleSnapshotRestore(w, r)
+	case "/api/admin/hot-keys":
+		s.handleHotKeys(w, r)
+	case "/api/admin/cache":
+		s.handleCacheStatus(w, r)
+	case "/api/admin/shards":
+		s.handleShards(w, r)
+	case "/api/admin/buckets":
+		s.handleBuckets(w, r)
+	case "/api/admin/buckets/allow":
+		s.handleBucketsAllow(w, r)
+	case "/api/admin/health":
+		s.handleHealth(w, r)
+	case "/api/admin/gc-outputs":
+		s.handleOutputGC(w, r)
+	case "/api/admin/acl/set":
+		s.handleACLSet(w, r)
+	case "/api/admin/acl/list":
+		s.handleACLList(w, r)
+	case "/api/admin/acl/delete":
+		s.handleACLDelete(w, r)
+	case "/api/admin/pii/policy/set":
+		s.handlePIIPolicySet(w, r)
+	case "/api/admin/pii/policy/get":
+		s.handlePIIPolicyGet(w, r)
+	case "/api/admin/pii/audit":
+		s.handlePIIAudit(w, r)
+	case "/api/admin/keys/create":
+		s.handleAPIKeyCreate(w, r)
+	case "/api/admin/keys/list":
+		s.handleAPIKeyList(w, r)
+	case "/api/admin/keys/rotate":
+		s.handleAPIKeyRotate(w, r)
+	case "/api/admin/keys/revoke":
+		s.handleAPIKeyRevoke(w, r)
+	case "/api/admin/usage":
+		s.handleUsage(w, r)
+	case "/api/admin/usage/records":
+		s.handleUsageRecords(w, r)
+	case "/api/admin/replication":
+		s.handleReplicationStatus(w, r)
+	case "/api/admin/encryption/status":
+		s.handleEncryptionStatus(w, r)
+	case "/api/admin/encryption/rotate":
+		s.handleEncryptionRotate(w, r)
+	case "/api/admin/encryption/reencrypt":
+		s.handleEncryptionReencrypt(w, r)
+	case "/api/admin/nats/credentials":
+		s.handleNATSCredentials(w, r)
+	case "/api/admin/verify":
+		s.handleVerify(w, r)
+	case "/api/admin/backup/run":
+		s.handleBackupRun(w, r)
+	case "/api/admin/backup/status":
+		s.handleBackupStatus(w, r)
 	default:
 		http.NotFound(w, r)
-		log.Printf("Response: 404 - Not Found")
+		logRequestf(r, "Response: 404 - Not Found")
 		return
 	}
 
 	// Log response
-	log.Printf("Response Status: %d", rw.status)
-	log.Printf("Response Body: %s", rw.body.String())
+	logRequestf(r, "Response Status: %d", rw.status)
+	if secretResponseRoutes[r.URL.Path] {
+		logRequestf(r, "Response Body: [REDACTED]")
+	} else {
+		logRequestf(r, "Response Body: %s", rw.body.String())
+	}
+
+	s.publishEvent(r, body, rw.status)
 }
 
 // responseWriter is a wrapper for http.ResponseWriter that captures the status code and response body
 type responseWriter struct {
 	http.ResponseWriter
-	status int
-	body   *bytes.Buffer
+	status    int
+	body      *bytes.Buffer
+	written   int64
+	requestID string
+	// wroteHeader is set once the status has been sent
+	wroteHeader bool
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
 	rw.status = code
+	rw.wroteHeader = true
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController flush streamed responses
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 func (rw *responseWriter) Write(b []byte) (int, error) {
-	rw.body.Write(b)
-	return rw.ResponseWriter.Write(b)
+	// Only capture JSON bodies so streamed downloads are not buffered for logging
+	rw.wroteHeader = true
+	written := b
+	if strings.HasPrefix(rw.Header().Get("Content-Type"), "application/json") {
+		written = rw.addRequestID(b)
+		rw.body.Write(written)
+	}
+	n, err := rw.ResponseWriter.Write(written)
+	rw.written += int64(n)
+	// Callers only know of the bytes they wrote
+	if err == nil {
+		n = len(b)
+	}
+	return n, err
+}
+
+// countingReader counts the bytes read from a request body that is streamed to a handler
+type countingReader struct {
+	reader io.ReadCloser
+	count  int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	return c.reader.Close()
 }
 
 func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
@@ -229,24 +1079,84 @@ func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "key is required"})
 		return
 	}
+	if req.Encoding != "" && req.Encoding != encodingBase64 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid encoding %q, must be base64", req.Encoding)})
+		return
+	}
+	if req.Revision < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "revision must not be negative"})
+		return
+	}
 
-	// Get the bucket for this request
-	prefix := getPrefixFromEnv(r.Header)
-	bucket, err := s.getBucket(prefix)
+	if !s.checkKeyAccess(w, r, req.Key, permRead) {
+		return
+	}
+
+	consistency, err := s.readCache.readConsistency(req.Consistency)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
 		return
 	}
 
-	entry, err := bucket.Get(req.Key)
+	// Look for the key in the thread, then the user's keys, then the workspace's
+	prefixes, err := s.getReadPrefixes(r, req.Scope)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	prefix, entry, expiresAt, err := s.findEntry(prefixes, req.Key, uint64(req.Revision), consistency)
+	setConsistencyHeader(w, consistency)
 	if err != nil {
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
 		return
 	}
 
-	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: string(entry.Value())})
+	s.access.record(prefix, req.Key, false)
+
+	// Clients that already have this revision don't download the value again
+	etag := entryETag(prefix, entry)
+	setCacheHeaders(w, etag, entry.Created())
+	if notModified(r, etag, entry.Created()) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	response := KVResponse{Success: true, Data: string(entry.Value()), Revision: entry.Revision()}
+	if req.Encoding == encodingBase64 {
+		response.Data = base64.StdEncoding.EncodeToString(entry.Value())
+	}
+	if !expiresAt.IsZero() {
+		response.TTL = remainingTTL(expiresAt, time.Now())
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// findEntry reads a key, or a revision of it, from the first of the levels that has it. It
+// returns the level, the entry and when the entry expires, if it was put with a TTL.
+func (s *Server) findEntry(prefixes []string, key string, revision uint64, consistency string) (string, nats.KeyValueEntry, time.Time, error) {
+	var prefix string
+	var entry nats.KeyValueEntry
+	var expiresAt time.Time
+	var err error
+	for _, prefix = range prefixes {
+		if revision > 0 {
+			entry, err = s.readRevision(prefix, key, revision)
+		} else if entry, err = s.readEntry(prefix, key, consistency); err == nil {
+			// Keys past their TTL are gone, even before the sweeper deletes them
+			var expires bool
+			if expiresAt, expires, err = s.getKeyTTL(prefix, entry); err == nil && expires && !expiresAt.After(time.Now()) {
+				err = nats.ErrKeyNotFound
+			}
+		}
+		if err == nil || !errors.Is(err, nats.ErrKeyNotFound) {
+			break
+		}
+	}
+	return prefix, entry, expiresAt, err
 }
 
 func (s *Server) handlePut(w http.ResponseWriter, r *http.Request) {
@@ -260,14 +1170,41 @@ func (s *Server) handlePut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if req.Key == "" || req.Value == "" {
+	value, err := req.putValue()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if req.Key == "" || len(value) == 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "key and value are required"})
 		return
 	}
+	if req.ExpectedRevision != nil && *req.ExpectedRevision < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "expected_revision must not be negative"})
+		return
+	}
+	var ttl time.Duration
+	if req.TTL != "" {
+		var err error
+		if ttl, err = parseTTL(req.TTL); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+	}
+
+	if !s.checkKeyAccess(w, r, req.Key, permWrite) {
+		return
+	}
 
 	// Get the bucket for this request
-	prefix := getPrefixFromEnv(r.Header)
+	prefix, ok := s.getWritePrefix(w, r, req.Scope)
+	if !ok {
+		return
+	}
 	bucket, err := s.getBucket(prefix)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -275,14 +1212,78 @@ func (s *Server) handlePut(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = bucket.Put(req.Key, []byte(req.Value))
+	// PII is looked for in text, which binary values that aren't UTF-8 are not
+	if utf8.Valid(value) {
+		checked, ok := s.checkPII(w, r, req.Key, string(value))
+		if !ok {
+			return
+		}
+		value = []byte(checked)
+	}
+
+	// A put with a TTL is undone if the TTL can't be recorded, which needs the value it replaces
+	var previous nats.KeyValueEntry
+	if ttl > 0 {
+		previous, err = bucket.Get(req.Key)
+		if errors.Is(err, nats.ErrKeyNotFound) {
+			previous, err = nil, nil
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+	}
+
+	var revision uint64
+	switch {
+	case req.ExpectedRevision == nil:
+		revision, err = bucket.Put(req.Key, value)
+	case *req.ExpectedRevision == 0:
+		revision, err = bucket.Create(req.Key, value)
+	default:
+		revision, err = bucket.Update(req.Key, value, uint64(*req.ExpectedRevision))
+	}
+	if isRevisionConflict(err) {
+		s.writePutConflict(w, bucket, req.Key, uint64(*req.ExpectedRevision))
+		return
+	}
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
 		return
 	}
+	s.access.record(prefix, req.Key, true)
+	if ttl > 0 {
+		if err := s.setExpiryOrUndo(bucket, prefix, req.Key, revision, time.Now().Add(ttl), previous); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+	}
 
-	json.NewEncoder(w).Encode(KVResponse{Success: true})
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Revision: revision})
+}
+
+// writePutConflict answers a put that expected another revision of a key with the revision
+// the key has now, 0 if it doesn't exist, so the client can read it again and retry
+func (s *Server) writePutConflict(w http.ResponseWriter, bucket nats.KeyValue, key string, expected uint64) {
+	var current uint64
+	entry, err := bucket.Get(key)
+	switch {
+	case err == nil:
+		current = entry.Revision()
+	case !errors.Is(err, nats.ErrKeyNotFound):
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	message := fmt.Sprintf("%s is at revision %d, not %d", key, current, expected)
+	if expected == 0 {
+		message = fmt.Sprintf("%s already exists at revision %d", key, current)
+	}
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(KVResponse{Success: false, Code: errCodeConflict, Error: message, Revision: current})
 }
 
 func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
@@ -299,8 +1300,19 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !s.checkKeyAccess(w, r, req.Key, permDelete) {
+		return
+	}
+
 	// Get the bucket for this request
-	prefix := getPrefixFromEnv(r.Header)
+	prefix, ok := s.getWritePrefix(w, r, req.Scope)
+	if !ok {
+		return
+	}
+	if req.Grace != "" {
+		s.scheduleGraceDelete(w, r, prefix, req.Key, req.Grace)
+		return
+	}
 	bucket, err := s.getBucket(prefix)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -314,33 +1326,144 @@ func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
 		return
 	}
+	s.deleteKeyStats(prefix, req.Key)
 
 	json.NewEncoder(w).Encode(KVResponse{Success: true})
 }
 
 func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
-	// Get the bucket for this request
-	prefix := getPrefixFromEnv(r.Header)
-	bucket, err := s.getBucket(prefix)
+	// The request body is optional for list
+	var req ListRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	consistency, err := s.readCache.readConsistency(req.Consistency)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
 		return
 	}
+	if _, err := path.Match(req.Pattern, ""); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid pattern %q", req.Pattern)})
+		return
+	}
+	subject := keySubjectFilter(req.Prefix, req.Pattern)
+
+	paged := req.Limit != 0 || req.Cursor != ""
+	if paged && req.Limit == 0 {
+		req.Limit = defaultListLimit
+	}
+	if paged && (req.Limit < 1 || req.Limit > maxListLimit) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("limit must be between 1 and %d", maxListLimit)})
+		return
+	}
+	var includeMetadata, includeValues bool
+	for _, include := range req.Include {
+		switch include {
+		case "metadata":
+			includeMetadata = true
+		case "values":
+			includeValues = true
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid include %q, must be metadata or values", include)})
+			return
+		}
+	}
+	var after string
+	if req.Cursor != "" {
+		if after, err = decodeListCursor(req.Cursor); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+	}
 
-	keys, err := bucket.ListKeys()
+	// List the keys of every level, each key once as reads see it
+	prefixes, err := s.getReadPrefixes(r, req.Scope)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
 		return
 	}
 
+	// Only return the keys the request is allowed to read
+	canRead := s.readFilter(r)
 	keyList := make([]string, 0)
-	for k := range keys.Keys() {
-		keyList = append(keyList, k)
+	keyPrefixes := map[string]string{}
+	for _, prefix := range prefixes {
+		keys, err := s.readKeys(prefix, consistency, subject)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+
+		for _, k := range keys {
+			if _, seen := keyPrefixes[k]; seen || !matchKey(k, req.Prefix, req.Pattern) || !canRead(k) {
+				continue
+			}
+			keyPrefixes[k] = prefix
+			keyList = append(keyList, k)
+		}
+	}
+
+	// Only the keys of the page are returned, and only their stats are read
+	var next string
+	if paged {
+		keyList, next = pageKeys(keyList, after, int(req.Limit))
 	}
 
-	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: keyList})
+	setConsistencyHeader(w, consistency)
+	if req.Stats || includeMetadata || includeValues {
+		infos := make([]KeyInfo, 0, len(keyList))
+		for _, k := range keyList {
+			info := KeyInfo{Key: k}
+			var stats *KeyStats
+			if req.Stats || includeMetadata {
+				stats = s.getKeyStats(keyPrefixes[k], k)
+			}
+			if req.Stats {
+				info.Stats = stats
+			}
+			if includeMetadata || includeValues {
+				entry, err := s.readEntry(keyPrefixes[k], k, consistency)
+				if errors.Is(err, nats.ErrKeyNotFound) {
+					// Deleted since it was listed
+					continue
+				} else if err != nil {
+					w.WriteHeader(http.StatusInternalServerError)
+					json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("failed to read %s: %v", k, err)})
+					return
+				}
+				if includeMetadata {
+					modified, size := entry.Created(), len(entry.Value())
+					info.Revision, info.Modified, info.Size = entry.Revision(), &modified, &size
+					// The first write is recorded just after the put, so it can trail the entry
+					if created := stats.FirstWrite; !created.IsZero() {
+						if created.After(modified) {
+							created = modified
+						}
+						info.Created = &created
+					}
+				}
+				if includeValues {
+					value := string(entry.Value())
+					info.Value = &value
+				}
+			}
+			infos = append(infos, info)
+		}
+		json.NewEncoder(w).Encode(KVResponse{Success: true, Data: infos, NextCursor: next})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: keyList, NextCursor: next})
 }
 
 func (s *Server) handleOutputFilter(w http.ResponseWriter, r *http.Request) {
@@ -354,6 +1477,13 @@ func (s *Server) handleOutputFilter(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	output, redacted, err := s.secrets.scan(req.Output)
+	if err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(OutputFilterResponse{Success: false, Error: err.Error(), Redacted: redacted})
+		return
+	}
+
 	// Get tool name from header
 	toolName := r.Header.Get("X-Gptscript-Tool-Name")
 	if toolName == "" {
@@ -369,8 +1499,12 @@ func (s *Server) handleOutputFilter(w http.ResponseWriter, r *http.Request) {
 	key := fmt.Sprintf("output-%s-%s", toolName, uniqueHash)
 	log.Printf("Generated output key: %s", key)
 
+	if !s.checkKeyAccess(w, r, key, permWrite) {
+		return
+	}
+
 	// Get the bucket for this request
-	prefix := getPrefixFromEnv(r.Header)
+	prefix := s.getDataPrefix(r, true)
 	bucket, err := s.getBucket(prefix)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
@@ -379,20 +1513,41 @@ func (s *Server) handleOutputFilter(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Store just the output as the value
-	_, err = bucket.Put(key, []byte(req.Output))
+	_, err = bucket.Put(key, []byte(output))
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(OutputFilterResponse{Success: false, Error: err.Error()})
 		return
 	}
+	s.access.record(prefix, key, true)
+	if len(redacted) > 0 {
+		log.Printf("Redacted %s from output %s", strings.Join(redacted, ", "), key)
+	}
 
 	json.NewEncoder(w).Encode(OutputFilterResponse{
-		Success: true,
-		Key:     key,
+		Success:  true,
+		Key:      key,
+		Redacted: redacted,
 	})
 }
 
 func main() {
+	// Subcommands act on a running store, anything else serves it
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatalf("%s failed: %v", os.Args[1], err)
+			}
+			return
+		}
+	}
+
+	// Logs go to stderr or a rotated file, as text or JSON
+	logs, err := configureLogging()
+	if err != nil {
+		log.Fatalf("Failed to configure logging: %v", err)
+	}
+
 	// Get PORT from environment and calculate NATS port
 	port := getEnvOrDefault("PORT", "8080")
 	portInt := 0
@@ -400,6 +1555,9 @@ func main() {
 		log.Fatalf("Invalid PORT number: %v", err)
 	}
 	natsPort := portInt + 1
+	if portInt < 1 || natsPort > 65535 {
+		log.Fatalf("Invalid PORT %d: the NATS server listens on PORT+1, so PORT must be between 1 and 65534", portInt)
+	}
 
 	// Get default values from environment variables
 	defaultAddr := getEnvOrDefault("NATS_HOST", "0.0.0.0")
@@ -408,21 +1566,62 @@ func main() {
 	// Define command line flags with shorter names
 	addr := flag.String("h", defaultAddr, "Address to listen on (env: NATS_HOST)")
 	storageDir := flag.String("s", defaultStorage, "Directory for storing data (env: NATS_STORAGE)")
+	restoreFrom := flag.String("restore-from", "", "Backup archive to seed the store from before serving, a file path or s3://bucket/key")
+	restoreForce := flag.Bool("restore-force", false, "Replace buckets that already hold data when restoring a backup")
 	flag.Parse()
 
 	// Ensure storage directory exists
 	if err := os.MkdirAll(*storageDir, 0755); err != nil {
 		log.Fatalf("Failed to create storage directory: %v", err)
 	}
+	if err := checkStorageDir(*storageDir); err != nil {
+		log.Fatalf("Preflight check failed: %v", err)
+	}
+
+	// Every NATS client has to authenticate, as this tool or as a single workspace
+	natsAuth, err := newNATSAuthenticator()
+	if err != nil {
+		log.Fatalf("Failed to configure NATS authentication: %v", err)
+	}
+
+	// Writes are flushed and replicated as configured
+	durability, err := newDurability()
+	if err != nil {
+		log.Fatalf("Failed to configure durability: %v", err)
+	}
+
+	// Configure NATS server options, over those of the config passed through
+	opts, err := loadNATSOptions()
+	if err != nil {
+		log.Fatalf("Failed to load the NATS server configuration: %v", err)
+	}
+	opts.Host = *addr
+	opts.Port = natsPort
+	opts.JetStream = true
+	opts.StoreDir = filepath.Clean(*storageDir)
+	opts.NoLog = false
+	opts.NoSigs = true
+	opts.CustomClientAuthentication = natsAuth
+	// Clients can only sign a nonce the server presents
+	opts.AlwaysEnableNonce = natsAuth.nkey != nil
+	durability.apply(opts)
+
+	// Primaries accept leafnode connections from their followers, and followers mirror a
+	// primary over one
+	follower, err := newFollower()
+	if err != nil {
+		log.Fatalf("Failed to configure read replica mode: %v", err)
+	}
+	if follower != nil {
+		follower.apply(opts)
+	} else if err := configurePrimary(opts, natsAuth.password); err != nil {
+		log.Fatalf("Failed to configure followers: %v", err)
+	}
 
-	// Configure NATS server options
-	opts := &server.Options{
-		Host:      *addr,
-		Port:      natsPort,
-		JetStream: true,
-		StoreDir:  filepath.Clean(*storageDir),
-		NoLog:     false,
-		NoSigs:    true,
+	// Replicas form a JetStream cluster with the peers they are configured with or discover
+	discovery, err := configureCluster(opts, portInt)
+	if err != nil {
+		log.Fatalf("Failed to configure clustering: %v", err)
 	}
 
 	// Create and start the NATS server
@@ -432,7 +1631,7 @@ func main() {
 	}
 
 	// Configure server logging
-	ns.ConfigureLogger()
+	logs.configureNATSLogger(ns, opts)
 
 	// Start the server
 	go ns.Start()
@@ -440,9 +1639,17 @@ func main() {
 	if !ns.ReadyForConnections(4 * 1e9) { // Wait up to 4 seconds for server to be ready
 		log.Fatal("Failed to start server")
 	}
+	if discovery != nil {
+		go discovery.run(ns, opts)
+	}
 
-	// Connect to NATS
-	nc, err := nats.Connect(fmt.Sprintf("nats://%s:%d", *addr, natsPort))
+	// Connect to NATS. When the config requires TLS of clients, the store connects in process,
+	// which needs no certificate.
+	connectOpts := natsAuth.connectOptions()
+	if opts.TLSConfig != nil {
+		connectOpts = append(connectOpts, nats.InProcessServer(ns))
+	}
+	nc, err := nats.Connect(fmt.Sprintf("nats://%s:%d", *addr, natsPort), connectOpts...)
 	if err != nil {
 		log.Fatalf("Failed to connect to NATS: %v", err)
 	}
@@ -453,11 +1660,104 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to create HTTP server: %v", err)
 	}
+	httpServer.natsURL = getEnvOrDefault("KV_NATS_PUBLIC_URL", fmt.Sprintf("nats://%s:%d", *addr, natsPort))
+	natsAuth.server.Store(httpServer)
+	httpServer.health.storageDir = opts.StoreDir
+	httpServer.health.maxStore = ns.JetStreamConfig().MaxStore
+	if httpServer.disk != nil {
+		httpServer.disk.dir = opts.StoreDir
+		httpServer.disk.check()
+		go httpServer.disk.run()
+	}
+	if err := httpServer.preflight(*restoreFrom); err != nil {
+		log.Fatalf("Preflight check failed: %v", err)
+	}
+
+	// Seed the store before any traffic is served
+	if *restoreFrom != "" {
+		manifest, err := httpServer.restoreBackup(*restoreFrom, *restoreForce)
+		if err != nil {
+			log.Fatalf("Failed to restore backup %s: %v", *restoreFrom, err)
+		}
+		log.Printf("Restored backup %s from %s: %d keys, %d objects", *restoreFrom, manifest.Created.Format(time.RFC3339), manifest.Keys, manifest.Objects)
+	}
+
+	// Followers only mirror the primary, which runs the jobs that write
+	if httpServer.follower != nil {
+		go httpServer.runFollower()
+		go httpServer.runMasterKeyRefresh()
+	} else {
+		if err := httpServer.ensureJournalStream(); err != nil {
+			log.Fatalf("Failed to set up the journal: %v", err)
+		}
+		// Existing buckets keep the history and retention they were created with unless updated
+		if err := httpServer.applyBucketRetention(); err != nil {
+			log.Printf("Failed to apply the retention configuration to existing buckets: %v", err)
+		}
+		if err := httpServer.enableDirectGets(); err != nil {
+			log.Printf("Failed to enable direct gets on existing buckets: %v", err)
+		}
+
+		statsFlushInterval, err := time.ParseDuration(getEnvOrDefault("KV_STATS_FLUSH_INTERVAL", "10s"))
+		if err != nil {
+			log.Fatalf("Invalid KV_STATS_FLUSH_INTERVAL: %v", err)
+		}
+		go httpServer.runStatsFlusher(statsFlushInterval)
+		if httpServer.usageRecordInterval > 0 {
+			go httpServer.runUsageRecorder()
+		}
+		httpServer.startComputedWatchers()
+		httpServer.startIndexWatchers()
+		httpServer.startReplication()
+
+		// Orphaned output collection is off unless an interval is configured
+		if interval := getEnvOrDefault("KV_OUTPUT_GC_INTERVAL", ""); interval != "" {
+			outputGCInterval, err := time.ParseDuration(interval)
+			if err != nil {
+				log.Fatalf("Invalid KV_OUTPUT_GC_INTERVAL: %v", err)
+			}
+			go httpServer.runOutputGC(outputGCInterval, httpServer.outputGCAge)
+		}
+		if httpServer.backups != nil {
+			go httpServer.runBackupScheduler()
+		}
+		go httpServer.runExpirySweeper()
+		go httpServer.runMasterKeyRefresh()
+		go httpServer.runScheduler()
+		if httpServer.shards.threshold > 0 {
+			go httpServer.runShardMonitor()
+		}
+	}
+
+	go httpServer.runReadCacheJanitor()
 
 	// Start HTTP server
+	h3, err := httpServer.newHTTP3Server()
+	if err != nil {
+		log.Fatalf("Failed to configure the HTTP/3 server: %v", err)
+	}
+	srv, err := httpServer.newHTTPServer(":"+port, h3)
+	if err != nil {
+		log.Fatalf("Failed to configure the HTTP server: %v", err)
+	}
+	if h3 != nil {
+		go func() {
+			log.Printf("Starting HTTP/3 server on UDP port %s", httpServer.httpOptions.http3Port)
+			if err := h3.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("HTTP/3 server error: %v", err)
+			}
+		}()
+	}
 	go func() {
+		if httpServer.tls != nil {
+			log.Printf("Starting HTTPS server on port %s", port)
+			if err := srv.ListenAndServeTLS(httpServer.tls.certFile, httpServer.tls.keyFile); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				log.Fatalf("HTTP server error: %v", err)
+			}
+			return
+		}
 		log.Printf("Starting HTTP server on port %s", port)
-		if err := http.ListenAndServe(":"+port, httpServer); err != nil {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatalf("HTTP server error: %v", err)
 		}
 	}()
@@ -470,9 +1770,8 @@ func main() {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	<-sigChan
-	fmt.Println("\nShutting down servers...")
-	ns.Shutdown()
-	ns.WaitForShutdown()
+	log.Print("Shutting down servers...")
+	httpServer.shutdown(srv, h3, ns)
 }
 
 func getEnvOrDefault(key, defaultValue string) string {
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// masterKeySource fetches the master key that seals the data keys. Keys held by a key
+// management service are fetched again periodically, so rotating them there takes effect
+// without a restart.
+type masterKeySource struct {
+	name    string
+	fetch   func() ([]byte, error)
+	refresh time.Duration
+}
+
+// kmsClient is the HTTP client for key management services
+var kmsClient = &http.Client{Timeout: 30 * time.Second}
+
+// newMasterKeySource configures where the master key comes from with
+// KV_ENCRYPTION_MASTER_KEY_SOURCE: env (the default), aws-kms, gcp-kms or vault. It returns
+// nil when encryption is disabled.
+func newMasterKeySource() (*masterKeySource, error) {
+	name := getEnvOrDefault("KV_ENCRYPTION_MASTER_KEY_SOURCE", "env")
+	refresh, err := time.ParseDuration(getEnvOrDefault("KV_ENCRYPTION_MASTER_KEY_REFRESH", "1h"))
+	if err != nil || refresh < 0 {
+		return nil, fmt.Errorf("invalid KV_ENCRYPTION_MASTER_KEY_REFRESH: must be a duration")
+	}
+	source := &masterKeySource{name: name, refresh: refresh}
+
+	switch name {
+	case "env":
+		encoded := getEnvOrDefault("KV_ENCRYPTION_MASTER_KEY", "")
+		if encoded == "" {
+			return nil, nil
+		}
+		key, err := parseMasterKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KV_ENCRYPTION_MASTER_KEY: %v", err)
+		}
+		source.fetch = func() ([]byte, error) { return key, nil }
+		source.refresh = 0
+	case "aws-kms":
+		ciphertext := getEnvOrDefault("KV_ENCRYPTION_KMS_CIPHERTEXT", "")
+		if ciphertext == "" {
+			return nil, fmt.Errorf("KV_ENCRYPTION_KMS_CIPHERTEXT is required for the aws-kms master key source")
+		}
+		creds, err := getAWSCredentials()
+		if err != nil {
+			return nil, err
+		}
+		source.fetch = func() ([]byte, error) { return fetchAWSKMSKey(ciphertext, creds) }
+	case "gcp-kms":
+		keyName := getEnvOrDefault("KV_ENCRYPTION_GCP_KMS_KEY", "")
+		ciphertext := getEnvOrDefault("KV_ENCRYPTION_KMS_CIPHERTEXT", "")
+		if keyName == "" || ciphertext == "" {
+			return nil, fmt.Errorf("KV_ENCRYPTION_GCP_KMS_KEY and KV_ENCRYPTION_KMS_CIPHERTEXT are required for the gcp-kms master key source")
+		}
+		source.fetch = func() ([]byte, error) { return fetchGCPKMSKey(keyName, ciphertext) }
+	case "vault":
+		addr := strings.TrimSuffix(getEnvOrDefault("VAULT_ADDR", ""), "/")
+		path := strings.Trim(getEnvOrDefault("KV_ENCRYPTION_VAULT_PATH", ""), "/")
+		if addr == "" || path == "" {
+			return nil, fmt.Errorf("VAULT_ADDR and KV_ENCRYPTION_VAULT_PATH are required for the vault master key source")
+		}
+		field := getEnvOrDefault("KV_ENCRYPTION_VAULT_FIELD", "master_key")
+		source.fetch = func() ([]byte, error) { return fetchVaultKey(addr, path, field) }
+	default:
+		return nil, fmt.Errorf("invalid KV_ENCRYPTION_MASTER_KEY_SOURCE %q, must be env, aws-kms, gcp-kms or vault", name)
+	}
+	return source, nil
+}
+
+// doJSON sends a request and decodes the JSON response, returning an error for
+// non-2xx responses
+func doJSON(req *http.Request, result interface{}) error {
+	resp, err := kmsClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Host, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// fetchAWSKMSKey decrypts the master key with AWS KMS. The ciphertext is the base64
+// CiphertextBlob of a 32 byte data key, e.g. from aws kms generate-data-key.
+func fetchAWSKMSKey(ciphertext string, creds awsCredentials) ([]byte, error) {
+	region := getEnvOrDefault("AWS_REGION", getEnvOrDefault("AWS_DEFAULT_REGION", "us-east-1"))
+	endpoint := getEnvOrDefault("AWS_ENDPOINT_URL_KMS", getEnvOrDefault("AWS_ENDPOINT_URL", "https://kms."+region+".amazonaws.com"))
+
+	body, err := json.Marshal(map[string]string{"CiphertextBlob": ciphertext})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+	hash := sha256.Sum256(body)
+	signAWSRequest(req, hex.EncodeToString(hash[:]), "kms", region, creds, time.Now())
+
+	var result struct {
+		Plaintext []byte `json:"Plaintext"`
+	}
+	if err := doJSON(req, &result); err != nil {
+		return nil, err
+	}
+	return result.Plaintext, nil
+}
+
+// getGCPAccessToken returns an OAuth access token from GOOGLE_OAUTH_ACCESS_TOKEN or the
+// metadata server of the instance
+func getGCPAccessToken() (string, error) {
+	if token := getEnvOrDefault("GOOGLE_OAUTH_ACCESS_TOKEN", ""); token != "" {
+		return token, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	var result struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := doJSON(req, &result); err != nil {
+		return "", fmt.Errorf("failed to get an access token from the metadata server: %v", err)
+	}
+	return result.AccessToken, nil
+}
+
+// fetchGCPKMSKey decrypts the master key with Cloud KMS. The key name is the full resource
+// name, projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>.
+func fetchGCPKMSKey(keyName, ciphertext string) ([]byte, error) {
+	token, err := getGCPAccessToken()
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(map[string]string{"ciphertext": ciphertext})
+	if err != nil {
+		return nil, err
+	}
+	endpoint := getEnvOrDefault("KV_GCP_KMS_ENDPOINT", "https://cloudkms.googleapis.com")
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/v1/"+keyName+":decrypt", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	var result struct {
+		Plaintext []byte `json:"plaintext"`
+	}
+	if err := doJSON(req, &result); err != nil {
+		return nil, err
+	}
+	return result.Plaintext, nil
+}
+
+// fetchVaultKey reads the base64 encoded master key from a field of a Vault secret. Both
+// KV version 1 and version 2 (secret/data/...) paths are supported.
+func fetchVaultKey(addr, path, field string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, addr+"/v1/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", getEnvOrDefault("VAULT_TOKEN", ""))
+	if namespace := getEnvOrDefault("VAULT_NAMESPACE", ""); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	var result struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := doJSON(req, &result); err != nil {
+		return nil, err
+	}
+	fields := result.Data
+	if nested, ok := result.Data["data"]; ok {
+		if err := json.Unmarshal(nested, &fields); err != nil {
+			return nil, fmt.Errorf("invalid Vault secret: %v", err)
+		}
+	}
+	var encoded string
+	if err := json.Unmarshal(fields[field], &encoded); err != nil || encoded == "" {
+		return nil, fmt.Errorf("Vault secret %s has no %s field", path, field)
+	}
+	return base64.StdEncoding.DecodeString(encoded)
+}
+
+// refreshMaster fetches the master key again. When it changed, the data keys are sealed
+// with the new key, unless another instance already did.
+func (k *keyring) refreshMaster() error {
+	masterKey, err := k.source.fetch()
+	if err != nil {
+		return err
+	}
+	k.lock.RLock()
+	unchanged := bytes.Equal(masterKey, k.masterKey)
+	previous := k.master
+	k.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+	master, err := newAEAD(masterKey)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < incrMaxAttempts; attempt++ {
+		entry, err := k.bucket.Get(keyringKey)
+		if err != nil {
+			return err
+		}
+		if _, err := unsealKeyring(master, entry.Value()); err != nil {
+			data, err := unsealKeyring(previous, entry.Value())
+			if err != nil {
+				return fmt.Errorf("encryption keys are sealed with neither the new nor the previous master key")
+			}
+			sealed, err := sealValue(master, masterKeyID, data)
+			if err != nil {
+				return err
+			}
+			if _, err := k.bucket.Update(keyringKey, sealed, entry.Revision()); isRevisionConflict(err) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			log.Printf("Sealed the data keys with the new master key from %s", k.source.name)
+		}
+
+		k.lock.Lock()
+		k.master = master
+		k.masterKey = masterKey
+		k.lock.Unlock()
+		return k.load()
+	}
+	return fmt.Errorf("encryption keys are changing too often")
+}
+
+// runMasterKeyRefresh fetches the master key periodically. Failures keep the current key,
+// so an unavailable key management service doesn't take the store down.
+func (s *Server) runMasterKeyRefresh() {
+	if s.encryption == nil || s.encryption.source.refresh <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.encryption.source.refresh)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.encryption.refreshMaster(); err != nil {
+			log.Printf("Failed to refresh the master key from %s: %v", s.encryption.source.name, err)
+		}
+	}
+}
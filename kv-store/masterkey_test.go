@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchVaultKey(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "vault-token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		secret := map[string]string{"master_key": base64.StdEncoding.EncodeToString(key)}
+		switch r.URL.Path {
+		case "/v1/secret/data/kv-store":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"data": secret}})
+		case "/v1/kv/kv-store":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": secret})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	t.Setenv("VAULT_TOKEN", "vault-token")
+
+	for _, path := range []string{"secret/data/kv-store", "kv/kv-store"} {
+		got, err := fetchVaultKey(server.URL, path, "master_key")
+		if err != nil || !bytes.Equal(got, key) {
+			t.Errorf("%s: got %x, %v", path, got, err)
+		}
+	}
+	if _, err := fetchVaultKey(server.URL, "kv/kv-store", "other"); err == nil {
+		t.Error("a missing field should fail")
+	}
+	t.Setenv("VAULT_TOKEN", "wrong")
+	if _, err := fetchVaultKey(server.URL, "kv/kv-store", "master_key"); err == nil {
+		t.Error("a rejected token should fail")
+	}
+}
+
+func TestFetchAWSKMSKey(t *testing.T) {
+	key := bytes.Repeat([]byte{9}, 32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			CiphertextBlob string
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.Header.Get("X-Amz-Target") != "TrentService.Decrypt" ||
+			!strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") ||
+			req.CiphertextBlob != "c2VhbGVk" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string][]byte{"Plaintext": key})
+	}))
+	defer server.Close()
+	t.Setenv("AWS_ENDPOINT_URL_KMS", server.URL)
+
+	got, err := fetchAWSKMSKey("c2VhbGVk", awsCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"})
+	if err != nil || !bytes.Equal(got, key) {
+		t.Errorf("got %x, %v", got, err)
+	}
+}
+
+func TestFetchGCPKMSKey(t *testing.T) {
+	key := bytes.Repeat([]byte{3}, 32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer gcp-token" || r.URL.Path != "/v1/projects/p/locations/global/keyRings/r/cryptoKeys/k:decrypt" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string][]byte{"plaintext": key})
+	}))
+	defer server.Close()
+	t.Setenv("KV_GCP_KMS_ENDPOINT", server.URL)
+	t.Setenv("GOOGLE_OAUTH_ACCESS_TOKEN", "gcp-token")
+
+	got, err := fetchGCPKMSKey("projects/p/locations/global/keyRings/r/cryptoKeys/k", "c2VhbGVk")
+	if err != nil || !bytes.Equal(got, key) {
+		t.Errorf("got %x, %v", got, err)
+	}
+}
+
+func TestNewMasterKeySource(t *testing.T) {
+	t.Setenv("KV_ENCRYPTION_MASTER_KEY", "")
+	if source, err := newMasterKeySource(); source != nil || err != nil {
+		t.Errorf("encryption should be disabled without a key: %v, %v", source, err)
+	}
+
+	t.Setenv("KV_ENCRYPTION_MASTER_KEY_SOURCE", "vault")
+	t.Setenv("VAULT_ADDR", "")
+	if _, err := newMasterKeySource(); err == nil {
+		t.Error("vault without an address should be rejected")
+	}
+
+	t.Setenv("KV_ENCRYPTION_MASTER_KEY_SOURCE", "hsm")
+	if _, err := newMasterKeySource(); err == nil {
+		t.Error("unknown sources should be rejected")
+	}
+}
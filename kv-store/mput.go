@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/nats-io/nats.go"
+)
+
+// maxMPutKeys bounds the keys of a single bulk put
+const maxMPutKeys = 1000
+
+type MPutRequest struct {
+	Values map[string]string `json:"values"`
+	Scope  string            `json:"scope,omitempty"`
+}
+
+type MPutResult struct {
+	Written   int               `json:"written"`
+	Revisions map[string]uint64 `json:"revisions"`
+}
+
+// stagedWrite is a key of a bulk put with the value it had when the put started, which it
+// is restored to if the put is rolled back
+type stagedWrite struct {
+	key      string
+	value    []byte
+	existed  bool
+	previous []byte
+	// revision is the revision the key was read at, then the revision written
+	revision uint64
+}
+
+// handleMPut writes a set of keys all or nothing. Every key is read first, and each is then
+// only written if it still has the revision it was read at. When a write fails, the keys
+// already written are restored to their previous values, so the workspace never keeps part
+// of the set. Readers can see the new values of some keys while the put is in progress.
+func (s *Server) handleMPut(w http.ResponseWriter, r *http.Request) {
+	var req MPutRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+
+	if len(req.Values) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "values are required"})
+		return
+	}
+	if len(req.Values) > maxMPutKeys {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("at most %d keys can be put at once", maxMPutKeys)})
+		return
+	}
+
+	// Keys are written in order, so concurrent bulk puts of overlapping keys conflict on the
+	// first key they share
+	keys := make([]string, 0, len(req.Values))
+	for key, value := range req.Values {
+		if key == "" || value == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "keys and values must not be empty"})
+			return
+		}
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		if !s.checkKeyAccess(w, r, key, permWrite) {
+			return
+		}
+	}
+	prefix, ok := s.getWritePrefix(w, r, req.Scope)
+	if !ok {
+		return
+	}
+	writes := make([]*stagedWrite, len(keys))
+	for i, key := range keys {
+		value, ok := s.checkPII(w, r, key, req.Values[key])
+		if !ok {
+			return
+		}
+		writes[i] = &stagedWrite{key: key, value: []byte(value)}
+	}
+
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	// Stage the writes with the revisions the keys have now
+	for _, write := range writes {
+		entry, err := bucket.Get(write.key)
+		switch {
+		case err == nil:
+			write.existed, write.previous, write.revision = true, entry.Value(), entry.Revision()
+		case !errors.Is(err, nats.ErrKeyNotFound):
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("failed to read %s: %v", write.key, err)})
+			return
+		}
+	}
+
+	for i, write := range writes {
+		var revision uint64
+		if write.existed {
+			revision, err = bucket.Update(write.key, write.value, write.revision)
+		} else {
+			revision, err = bucket.Create(write.key, write.value)
+		}
+		if err == nil {
+			write.revision = revision
+			continue
+		}
+
+		status, message := http.StatusInternalServerError, fmt.Sprintf("failed to put %s: %v", write.key, err)
+		if isRevisionConflict(err) {
+			status, message = http.StatusConflict, fmt.Sprintf("%s changed during the put", write.key)
+		}
+		if failed := rollbackMPut(bucket, writes[:i]); len(failed) > 0 {
+			message += fmt.Sprintf(", and %v could not be restored", failed)
+		} else {
+			message += ", no keys were written"
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: message})
+		return
+	}
+
+	result := MPutResult{Written: len(writes), Revisions: map[string]uint64{}}
+	for _, write := range writes {
+		s.access.record(prefix, write.key, true)
+		result.Revisions[write.key] = write.revision
+	}
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: result})
+}
+
+// rollbackMPut restores the keys a failed bulk put wrote, newest first. A key that was
+// changed again since it was written keeps the newer value, as undoing the put must not
+// undo other writes. It returns the keys that could not be restored.
+func rollbackMPut(bucket nats.KeyValue, written []*stagedWrite) []string {
+	var failed []string
+	for i := len(written) - 1; i >= 0; i-- {
+		write := written[i]
+		var err error
+		if write.existed {
+			_, err = bucket.Update(write.key, write.previous, write.revision)
+		} else {
+			err = bucket.Delete(write.key, nats.LastRevision(write.revision))
+		}
+		if isRevisionConflict(err) {
+			log.Printf("Kept %s when rolling back a bulk put, it was changed by another write", write.key)
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to restore %s when rolling back a bulk put: %v", write.key, err)
+			failed = append(failed, write.key)
+		}
+	}
+	return failed
+}
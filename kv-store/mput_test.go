@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+// rollbackBucket records the writes of a rollback, and fails those of keys changed since
+type rollbackBucket struct {
+	nats.KeyValue
+	changed  map[string]bool
+	restored []string
+}
+
+func (b *rollbackBucket) Update(key string, value []byte, last uint64) (uint64, error) {
+	if b.changed[key] {
+		return 0, nats.ErrKeyExists
+	}
+	b.restored = append(b.restored, key+"="+string(value))
+	return last + 1, nil
+}
+
+func (b *rollbackBucket) Delete(key string, opts ...nats.DeleteOpt) error {
+	if b.changed[key] {
+		return nats.ErrKeyExists
+	}
+	b.restored = append(b.restored, key+" deleted")
+	return nil
+}
+
+func TestRollbackMPut(t *testing.T) {
+	bucket := &rollbackBucket{changed: map[string]bool{"b": true}}
+	failed := rollbackMPut(bucket, []*stagedWrite{
+		{key: "a", existed: true, previous: []byte("old"), revision: 5},
+		{key: "b", existed: true, previous: []byte("old"), revision: 6},
+		{key: "c", revision: 7},
+	})
+	if len(failed) != 0 {
+		t.Errorf("failed to restore %v", failed)
+	}
+	// b was changed by another write, which is kept
+	if want := []string{"c deleted", "a=old"}; !slices.Equal(bucket.restored, want) {
+		t.Errorf("restored %v, want %v", bucket.restored, want)
+	}
+}
+
+func TestMPutStore(t *testing.T) {
+	s := newStoreServer(t)
+	for key, value := range map[string]string{"a": "old", "b": "old"} {
+		if status, response := call(t, s, "ws1", "/api/v1/put", KVRequest{Key: key, Value: value}); status != http.StatusOK {
+			t.Fatalf("put = %d, %+v", status, response)
+		}
+	}
+	if status, response := call(t, s, "ws1", "/api/v1/mput", MPutRequest{Values: map[string]string{"a": "new", "c": "new"}}); status != http.StatusOK || !response.Success {
+		t.Fatalf("mput = %d, %+v", status, response)
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, response := call(t, s, "ws1", "/api/v1/get", KVRequest{Key: key}); response.Data != "new" {
+			t.Errorf("%s = %v, want the new value", key, response.Data)
+		}
+	}
+
+	// Roll back a put that wrote a, b and c against the bucket, after b was changed again
+	bucket, err := s.getBucket(getWorkspacePrefix("ws1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written []*stagedWrite
+	for _, key := range []string{"a", "b", "c"} {
+		entry, err := bucket.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write := &stagedWrite{key: key, existed: key != "c", previous: entry.Value()}
+		if write.revision, err = bucket.Put(key, []byte("staged")); err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, write)
+	}
+	if _, err := bucket.Put("b", []byte("newer")); err != nil {
+		t.Fatal(err)
+	}
+	if failed := rollbackMPut(bucket, written); len(failed) != 0 {
+		t.Fatalf("failed to restore %v", failed)
+	}
+	for key, want := range map[string]string{"a": "new", "b": "newer"} {
+		if _, response := call(t, s, "ws1", "/api/v1/get", KVRequest{Key: key}); response.Data != want {
+			t.Errorf("%s = %v after the rollback, want %s", key, response.Data, want)
+		}
+	}
+	if status, _ := call(t, s, "ws1", "/api/v1/get", KVRequest{Key: "c"}); status != http.StatusNotFound {
+		t.Errorf("c was created by the rolled back put, get = %d, want 404", status)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Roles a client certificate identity can be mapped to
+const (
+	certRoleAdmin     = "admin"
+	certRoleWorkspace = "workspace"
+)
+
+// httpTLS serves the HTTP API over TLS, and authenticates clients by their certificates when
+// a client CA is configured
+type httpTLS struct {
+	certFile   string
+	keyFile    string
+	config     *tls.Config
+	identities []certIdentity
+}
+
+// certIdentity maps certificates with a subject field or SAN of a value to a role. A value
+// ending in * matches any value with that prefix, and the workspace * takes the rest of the
+// value as the workspace ID.
+type certIdentity struct {
+	field     string
+	value     string
+	role      string
+	workspace string
+}
+
+// newHTTPTLS reads KV_TLS_CERT and KV_TLS_KEY, the certificate the HTTP API is served with,
+// and KV_TLS_CLIENT_CA, the CAs client certificates must be issued by. Clients must present
+// a certificate unless KV_TLS_CLIENT_AUTH is optional. KV_TLS_CLIENT_IDENTITIES maps
+// certificates to roles as a comma separated list of field:value=role, where the field is
+// cn, ou, dns, uri or email and the role is admin or workspace:<id>, for example
+// ou:kv-admins=admin,uri:spiffe://obot/workspace/*=workspace:*. It returns nil when no
+// certificate is set.
+func newHTTPTLS() (*httpTLS, error) {
+	t := &httpTLS{
+		certFile: getEnvOrDefault("KV_TLS_CERT", ""),
+		keyFile:  getEnvOrDefault("KV_TLS_KEY", ""),
+	}
+	caFile := getEnvOrDefault("KV_TLS_CLIENT_CA", "")
+	if t.certFile == "" && t.keyFile == "" {
+		if caFile != "" {
+			return nil, fmt.Errorf("KV_TLS_CLIENT_CA requires KV_TLS_CERT and KV_TLS_KEY")
+		}
+		return nil, nil
+	}
+	if t.certFile == "" || t.keyFile == "" {
+		return nil, fmt.Errorf("KV_TLS_CERT and KV_TLS_KEY must be set together")
+	}
+	if _, err := tls.LoadX509KeyPair(t.certFile, t.keyFile); err != nil {
+		return nil, fmt.Errorf("invalid KV_TLS_CERT or KV_TLS_KEY: %v", err)
+	}
+	t.config = &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile == "" {
+		return t, nil
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid KV_TLS_CLIENT_CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("invalid KV_TLS_CLIENT_CA: no certificates found")
+	}
+	t.config.ClientCAs = pool
+	switch mode := getEnvOrDefault("KV_TLS_CLIENT_AUTH", "require"); mode {
+	case "require":
+		t.config.ClientAuth = tls.RequireAndVerifyClientCert
+	case "optional":
+		t.config.ClientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("invalid KV_TLS_CLIENT_AUTH %q, must be require or optional", mode)
+	}
+	if t.identities, err = parseCertIdentities(getEnvOrDefault("KV_TLS_CLIENT_IDENTITIES", "")); err != nil {
+		return nil, fmt.Errorf("invalid KV_TLS_CLIENT_IDENTITIES: %v", err)
+	}
+	return t, nil
+}
+
+func parseCertIdentities(value string) ([]certIdentity, error) {
+	var identities []certIdentity
+	for _, rule := range strings.Split(value, ",") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+		match, role, ok := strings.Cut(rule, "=")
+		field, matchValue, ok2 := strings.Cut(match, ":")
+		if !ok || !ok2 || matchValue == "" {
+			return nil, fmt.Errorf("%q must be field:value=role", rule)
+		}
+		identity := certIdentity{field: field, value: matchValue}
+		switch field {
+		case "cn", "ou", "dns", "uri", "email":
+		default:
+			return nil, fmt.Errorf("unknown field %q, must be cn, ou, dns, uri or email", field)
+		}
+		if workspace, ok := strings.CutPrefix(role, certRoleWorkspace+":"); ok && workspace != "" {
+			identity.role, identity.workspace = certRoleWorkspace, workspace
+		} else if role == certRoleAdmin {
+			identity.role = certRoleAdmin
+		} else {
+			return nil, fmt.Errorf("unknown role %q, must be admin or workspace:<id>", role)
+		}
+		if identity.workspace == "*" && !strings.HasSuffix(identity.value, "*") {
+			return nil, fmt.Errorf("%q takes the workspace from the value, which must end in *", rule)
+		}
+		identities = append(identities, identity)
+	}
+	return identities, nil
+}
+
+// certFieldValues returns the values of a subject field or SAN of a certificate
+func certFieldValues(cert *x509.Certificate, field string) []string {
+	switch field {
+	case "cn":
+		return []string{cert.Subject.CommonName}
+	case "ou":
+		return cert.Subject.OrganizationalUnit
+	case "dns":
+		return cert.DNSNames
+	case "email":
+		return cert.EmailAddresses
+	case "uri":
+		uris := make([]string, len(cert.URIs))
+		for i, u := range cert.URIs {
+			uris[i] = u.String()
+		}
+		return uris
+	}
+	return nil
+}
+
+// identify returns the role of a certificate and the workspace it acts in, from the first
+// identity matching it
+func (t *httpTLS) identify(cert *x509.Certificate) (string, string, bool) {
+	for _, identity := range t.identities {
+		for _, value := range certFieldValues(cert, identity.field) {
+			rest, matched := value, value == identity.value
+			if prefix, ok := strings.CutSuffix(identity.value, "*"); ok {
+				rest, matched = strings.CutPrefix(value, prefix)
+			}
+			if !matched {
+				continue
+			}
+			workspace := identity.workspace
+			if workspace == "*" {
+				if rest == "" {
+					continue
+				}
+				workspace = rest
+			}
+			return identity.role, workspace, true
+		}
+	}
+	return "", "", false
+}
+
+// clientCertificate returns the verified certificate the client presented, if any
+func clientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// certificateClaims returns the claims of a request authenticated by a client certificate
+// mapped to a workspace, with the access a token of the workspace would have
+func certificateClaims(cert *x509.Certificate, workspace string) *TokenClaims {
+	return &TokenClaims{
+		ID:         "cert-" + cert.SerialNumber.String(),
+		Workspace:  getWorkspacePrefix(workspace),
+		Operations: allOperations(),
+		Expires:    cert.NotAfter.Unix(),
+	}
+}
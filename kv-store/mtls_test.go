@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCertIdentities(t *testing.T) {
+	identities, err := parseCertIdentities("ou:kv-admins=admin, uri:spiffe://obot/workspace/*=workspace:*, dns:agent.internal=workspace:ws1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := &httpTLS{identities: identities}
+
+	spiffe, _ := url.Parse("spiffe://obot/workspace/ws2")
+	tests := []struct {
+		name          string
+		cert          *x509.Certificate
+		wantRole      string
+		wantWorkspace string
+	}{
+		{"admin unit", &x509.Certificate{Subject: pkix.Name{OrganizationalUnit: []string{"eng", "kv-admins"}}}, certRoleAdmin, ""},
+		{"workspace from uri", &x509.Certificate{URIs: []*url.URL{spiffe}}, certRoleWorkspace, "ws2"},
+		{"fixed workspace", &x509.Certificate{DNSNames: []string{"agent.internal"}}, certRoleWorkspace, "ws1"},
+		{"unmapped", &x509.Certificate{DNSNames: []string{"other.internal"}}, "", ""},
+	}
+	for _, tt := range tests {
+		role, workspace, _ := tl.identify(tt.cert)
+		if role != tt.wantRole || workspace != tt.wantWorkspace {
+			t.Errorf("%s: got %q, %q", tt.name, role, workspace)
+		}
+	}
+
+	for _, rule := range []string{"cn=admin", "serial:1=admin", "cn:x=owner", "cn:x=workspace:*"} {
+		if _, err := parseCertIdentities(rule); err == nil {
+			t.Errorf("%q should be rejected", rule)
+		}
+	}
+}
+
+func TestAuthenticateClientCertificate(t *testing.T) {
+	s := newTestServer()
+	identities, _ := parseCertIdentities("cn:ops=admin,cn:agent-*=workspace:*")
+	s.tls = &httpTLS{identities: identities}
+
+	request := func(path, cn string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: cn}, SerialNumber: big.NewInt(7), NotAfter: time.Now().Add(time.Hour)}
+		r.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return r
+	}
+
+	if _, status, err := s.authenticate(request("/api/admin/acl/list", "ops")); status != http.StatusOK {
+		t.Errorf("admin certificate: %d %v", status, err)
+	}
+	if _, status, _ := s.authenticate(request("/api/admin/acl/list", "agent-ws1")); status != http.StatusUnauthorized {
+		t.Errorf("a workspace certificate should not reach admin endpoints, got %d", status)
+	}
+	r, status, err := s.authenticate(request("/api/v1/put", "agent-ws1"))
+	if status != http.StatusOK {
+		t.Fatalf("workspace certificate: %d %v", status, err)
+	}
+	if claims := getClaims(r); claims == nil || claims.Workspace != getWorkspacePrefix("ws1") || !claims.allows("put") {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Namespace levels, from the most general to the most specific. Reads fall back from a
+// thread to its user to the workspace, so session state can override user defaults which
+// override workspace defaults.
+const (
+	scopeWorkspace = "workspace"
+	scopeUser      = "user"
+	scopeThread    = "thread"
+)
+
+// namespaceBucketName matches exactly the <prefix>-user-<user> and <prefix>-thread-<thread>
+// data buckets of a workspace
+var namespaceBucketName = regexp.MustCompile(`^[^-]+-(user|thread)-[0-9a-f]{16}$`)
+
+// isNamespaceBucket reports whether a bucket holds the keys of a user or thread of a
+// workspace
+func isNamespaceBucket(name string) bool {
+	return namespaceBucketName.MatchString(name)
+}
+
+// namespace is a level of the hierarchy a request can address
+type namespace struct {
+	Scope  string `json:"scope"`
+	ID     string `json:"id,omitempty"`
+	Prefix string `json:"-"`
+	Keys   int    `json:"keys"`
+}
+
+// getUserID returns the obot user a request is made for, preferring the user bound into a
+// delegated token over the OBOT_USER_ID env and the X-Obot-User-Id header
+func getUserID(r *http.Request) string {
+	if claims := getClaims(r); claims != nil {
+		return claims.User
+	}
+	if user := getGPTScriptEnv(r.Header, "OBOT_USER_ID"); user != "" {
+		return user
+	}
+	return r.Header.Get("X-Obot-User-Id")
+}
+
+// getThreadID returns the thread a request is made in, preferring the thread bound into a
+// delegated token over the OBOT_THREAD_ID env and the X-Obot-Thread-Id header
+func getThreadID(r *http.Request) string {
+	if claims := getClaims(r); claims != nil {
+		return claims.Thread
+	}
+	if thread := getGPTScriptEnv(r.Header, "OBOT_THREAD_ID"); thread != "" {
+		return thread
+	}
+	return r.Header.Get("X-Obot-Thread-Id")
+}
+
+// namespacePrefix names the bucket of a level below the workspace. The name hashes the ID
+// so it is safe to use and doesn't reveal it.
+func namespacePrefix(workspace, scope, id string) string {
+	hash := sha1.Sum([]byte(id))
+	return workspace + "-" + scope + "-" + hex.EncodeToString(hash[:8])
+}
+
+// getNamespaces returns the levels a request can address, most specific first. The user
+// level needs KV_USER_SCOPE and a user ID, the thread level KV_THREAD_SCOPE and a thread ID.
+// Threads belong to their user, so the same thread ID of another user is another thread.
+func (s *Server) getNamespaces(r *http.Request) []namespace {
+	workspace := getRequestPrefix(r)
+	user, thread := getUserID(r), getThreadID(r)
+	var namespaces []namespace
+	if s.threadScope && thread != "" {
+		namespaces = append(namespaces, namespace{Scope: scopeThread, ID: thread, Prefix: namespacePrefix(workspace, scopeThread, user+"/"+thread)})
+	}
+	if s.userScope && user != "" {
+		namespaces = append(namespaces, namespace{Scope: scopeUser, ID: user, Prefix: namespacePrefix(workspace, scopeUser, user)})
+	}
+	return append(namespaces, namespace{Scope: scopeWorkspace, Prefix: s.getSharedDataPrefix(r, false)})
+}
+
+// getReadPrefixes returns the buckets a read looks in, in order: every level the request
+// can address, or only the level it picks with scope
+func (s *Server) getReadPrefixes(r *http.Request, scope string) ([]string, error) {
+	var prefixes []string
+	for _, ns := range s.getNamespaces(r) {
+		if scope == "" || scope == ns.Scope {
+			prefixes = append(prefixes, ns.Prefix)
+		}
+	}
+	if len(prefixes) == 0 {
+		return nil, scopeError(scope)
+	}
+	return prefixes, nil
+}
+
+// getWritePrefix returns the bucket a write goes to, the most specific level unless the
+// request picks another with scope. Requests made for a user can't write the keys shared by
+// the workspace. It writes an error response and returns false when the scope can't be
+// written.
+func (s *Server) getWritePrefix(w http.ResponseWriter, r *http.Request, scope string) (string, bool) {
+	namespaces := s.getNamespaces(r)
+	if scope == "" {
+		return namespaces[0].Prefix, true
+	}
+	for _, ns := range namespaces {
+		if ns.Scope != scope {
+			continue
+		}
+		if scope == scopeWorkspace && s.userScope && getUserID(r) != "" {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "requests made for a user can't write at workspace scope"})
+			return "", false
+		}
+		return ns.Prefix, true
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(KVResponse{Success: false, Error: scopeError(scope).Error()})
+	return "", false
+}
+
+// scopeError explains why a request can't address a scope
+func scopeError(scope string) error {
+	switch scope {
+	case scopeUser:
+		return fmt.Errorf("the user scope requires KV_USER_SCOPE and a user ID")
+	case scopeThread:
+		return fmt.Errorf("the thread scope requires KV_THREAD_SCOPE and a thread ID")
+	default:
+		return fmt.Errorf("unknown scope %s, must be thread, user or workspace", scope)
+	}
+}
+
+type NamespaceRequest struct {
+	Scope string `json:"scope,omitempty"`
+}
+
+// handleNamespaceList lists the levels the request can address in the order reads fall
+// back through them, with the number of keys each holds
+func (s *Server) handleNamespaceList(w http.ResponseWriter, r *http.Request) {
+	namespaces := s.getNamespaces(r)
+	for i, ns := range namespaces {
+		bucket, err := s.getBucket(ns.Prefix)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		if err := scanBucket(bucket, func(nats.KeyValueEntry) { namespaces[i].Keys++ }); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: namespaces})
+}
+
+// handleNamespaceClear deletes every key of the request's thread or user level, e.g. when a
+// session ends. The keys shared by the workspace can't be cleared this way.
+func (s *Server) handleNamespaceClear(w http.ResponseWriter, r *http.Request) {
+	var req NamespaceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+	if req.Scope != scopeThread && req.Scope != scopeUser {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "scope must be thread or user"})
+		return
+	}
+	prefixes, err := s.getReadPrefixes(r, req.Scope)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	bucket, err := s.getBucket(prefixes[0])
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	keys, err := bucket.ListKeys()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	deleted := make([]string, 0)
+	var denied []string
+	for key := range keys.Keys() {
+		if ok, err := s.allowed(r, key, permDelete); err != nil || !ok {
+			denied = append(denied, key)
+			continue
+		}
+		if err := bucket.Delete(key); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		s.deleteKeyStats(prefixes[0], key)
+		deleted = append(deleted, key)
+	}
+	if len(denied) > 0 {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Data: deleted, Error: fmt.Sprintf("delete access to %s is not allowed", strings.Join(denied, ", "))})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: deleted})
+}
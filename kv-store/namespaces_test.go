@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNamespaces(t *testing.T) {
+	s := &Server{userScope: true, threadScope: true, partitionMode: partitionNone}
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/get", nil)
+	r.Header.Set("X-GPTScript-Env", "GPTSCRIPT_WORKSPACE_ID=ws1,OBOT_USER_ID=u1,OBOT_THREAD_ID=t1")
+	workspace := getWorkspacePrefix("ws1")
+
+	namespaces := s.getNamespaces(r)
+	if len(namespaces) != 3 || namespaces[0].Scope != scopeThread || namespaces[1].Scope != scopeUser || namespaces[2].Prefix != workspace {
+		t.Fatalf("unexpected namespaces %+v", namespaces)
+	}
+	thread, user := namespaces[0].Prefix, namespaces[1].Prefix
+	for _, prefix := range []string{thread, user} {
+		if !strings.HasPrefix(prefix, workspace+"-") || !isNamespaceBucket(prefix) || !isDataBucket(prefix) {
+			t.Errorf("unexpected bucket %s", prefix)
+		}
+		if ws, tool := splitDataPrefix(prefix); ws != workspace || tool != "" {
+			t.Errorf("got %s, %s", ws, tool)
+		}
+	}
+
+	for scope, want := range map[string]string{"": thread + "," + user + "," + workspace, scopeUser: user, scopeWorkspace: workspace} {
+		if prefixes, err := s.getReadPrefixes(r, scope); err != nil || strings.Join(prefixes, ",") != want {
+			t.Errorf("scope %q: got %v, %v", scope, prefixes, err)
+		}
+	}
+	if _, err := s.getReadPrefixes(r, "team"); err == nil {
+		t.Error("unknown scopes should be rejected")
+	}
+	if s.getDataPrefix(r, false) != thread {
+		t.Error("writes should go to the most specific level")
+	}
+
+	w := httptest.NewRecorder()
+	if prefix, ok := s.getWritePrefix(w, r, scopeUser); !ok || prefix != user {
+		t.Errorf("threads should be able to write user defaults, got %s", prefix)
+	}
+	if _, ok := s.getWritePrefix(w, r, scopeWorkspace); ok || w.Code != http.StatusForbidden {
+		t.Errorf("users should not write workspace keys, got %d", w.Code)
+	}
+
+	// Threads belong to their user, and tokens act for the user and thread that minted them
+	other := r.Clone(r.Context())
+	other.Header.Set("X-GPTScript-Env", "GPTSCRIPT_WORKSPACE_ID=ws1,OBOT_USER_ID=u2,OBOT_THREAD_ID=t1")
+	if s.getNamespaces(other)[0].Prefix == thread {
+		t.Error("the same thread ID of another user should be another thread")
+	}
+	claims := &TokenClaims{Workspace: workspace, User: "u1", Thread: "t1"}
+	tokenRequest := httptest.NewRequest(http.MethodPost, "/api/v1/get", nil)
+	tokenRequest = tokenRequest.WithContext(context.WithValue(tokenRequest.Context(), claimsContextKey, claims))
+	if s.getDataPrefix(tokenRequest, false) != thread {
+		t.Error("tokens should address the thread they were minted in")
+	}
+
+	s.userScope, s.threadScope = false, false
+	if prefixes, _ := s.getReadPrefixes(r, ""); strings.Join(prefixes, ",") != workspace {
+		t.Errorf("without namespaces only the workspace should be read, got %v", prefixes)
+	}
+	if _, err := s.getReadPrefixes(r, scopeThread); err == nil {
+		t.Error("the thread scope should require KV_THREAD_SCOPE")
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// natsInternalUser is the user the tool's own connections authenticate as. Workspace users
+// are named ws-<prefix>.
+const (
+	natsInternalUser  = "kv-store"
+	natsWorkspaceUser = "ws-"
+)
+
+// natsAuthenticator authenticates clients of the embedded NATS server. The tool's own
+// connections get full access, and each workspace gets credentials limited to its own
+// buckets and object store, so NATS access to one workspace doesn't expose the others.
+type natsAuthenticator struct {
+	password string
+	// nkey is set from KV_NATS_NKEY_SEED, for the tool's own connections to sign the nonce
+	// of the server with instead of sending a password
+	nkey      nkeys.KeyPair
+	publicKey string
+	// server is set once the HTTP server exists, since workspace passwords are derived from
+	// its signing key
+	server atomic.Pointer[Server]
+}
+
+// newNATSAuthenticator uses KV_NATS_PASSWORD for the internal user, or a random password
+// when the embedded server is only used by this process
+func newNATSAuthenticator() (*natsAuthenticator, error) {
+	password := getEnvOrDefault("KV_NATS_PASSWORD", "")
+	if password == "" {
+		secret := make([]byte, 24)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+		password = hex.EncodeToString(secret)
+	}
+	a := &natsAuthenticator{password: password}
+	if seed := getEnvOrDefault("KV_NATS_NKEY_SEED", ""); seed != "" {
+		nkey, err := nkeys.FromSeed([]byte(seed))
+		if err != nil {
+			return nil, fmt.Errorf("invalid KV_NATS_NKEY_SEED: %v", err)
+		}
+		publicKey, err := nkey.PublicKey()
+		if err != nil || !nkeys.IsValidPublicUserKey(publicKey) {
+			return nil, fmt.Errorf("invalid KV_NATS_NKEY_SEED: must be the seed of a user nkey, starting with SU")
+		}
+		a.nkey, a.publicKey = nkey, publicKey
+	}
+	return a, nil
+}
+
+// connectOptions are the options the tool's own connections authenticate with
+func (a *natsAuthenticator) connectOptions() []nats.Option {
+	if a.nkey != nil {
+		return []nats.Option{nats.Nkey(a.publicKey, a.nkey.Sign)}
+	}
+	return []nats.Option{nats.UserInfo(natsInternalUser, a.password)}
+}
+
+// checkNkey verifies the signature of the server's nonce by a client connecting with an
+// nkey, which must be the tool's own
+func (a *natsAuthenticator) checkNkey(c server.ClientAuthentication) bool {
+	opts := c.GetOpts()
+	if a.nkey == nil || opts.Nkey != a.publicKey || len(c.GetNonce()) == 0 {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(opts.Sig)
+	if err != nil {
+		if sig, err = base64.StdEncoding.DecodeString(opts.Sig); err != nil {
+			return false
+		}
+	}
+	if err := a.nkey.Verify(c.GetNonce(), sig); err != nil {
+		return false
+	}
+	c.RegisterUser(&server.User{Username: natsInternalUser})
+	return true
+}
+
+// Check implements server.Authentication
+func (a *natsAuthenticator) Check(c server.ClientAuthentication) bool {
+	opts := c.GetOpts()
+	if opts.Nkey != "" {
+		return a.checkNkey(c)
+	}
+	if opts.Username == natsInternalUser {
+		// With an nkey, the password is only left for the leafnode connections of followers
+		if a.nkey != nil && c.Kind() != server.LEAF {
+			return false
+		}
+		if !hmac.Equal([]byte(opts.Password), []byte(a.password)) {
+			return false
+		}
+		c.RegisterUser(&server.User{Username: natsInternalUser})
+		return true
+	}
+
+	prefix, ok := strings.CutPrefix(opts.Username, natsWorkspaceUser)
+	s := a.server.Load()
+	if !ok || s == nil || !isDataBucket(prefix) || isPartition(prefix) {
+		return false
+	}
+	if !hmac.Equal([]byte(opts.Password), []byte(s.workspaceNATSPassword(prefix))) {
+		return false
+	}
+
+	// Partitions are looked up when connecting, so partitions created later need a reconnect
+	buckets := []string{prefix}
+	if partitions, err := s.listPartitions(prefix); err == nil {
+		buckets = append(buckets, partitions...)
+	}
+	c.RegisterUser(&server.User{
+		Username:    opts.Username,
+		Permissions: workspaceNATSPermissions(prefix, buckets),
+	})
+	return true
+}
+
+// workspaceNATSPassword derives the NATS password of a workspace from the signing key
+func (s *Server) workspaceNATSPassword(prefix string) string {
+	return hex.EncodeToString(s.signer.mac([]byte("nats\n" + prefix)))
+}
+
+// workspaceInboxPrefix is the inbox prefix workspace clients must use, since replies to
+// other clients' inboxes are not visible to them
+func workspaceInboxPrefix(prefix string) string {
+	return "_INBOX_" + prefix
+}
+
+// jetStreamSubjects are the subjects needed to read, write and watch a stream
+func jetStreamSubjects(stream string) []string {
+	return []string{
+		"$JS.API.STREAM.INFO." + stream,
+		"$JS.API.STREAM.MSG.GET." + stream,
+		"$JS.API.DIRECT.GET." + stream,
+		"$JS.API.DIRECT.GET." + stream + ".>",
+		"$JS.API.CONSUMER.CREATE." + stream,
+		"$JS.API.CONSUMER.CREATE." + stream + ".>",
+		"$JS.API.CONSUMER.DELETE." + stream + ".>",
+		"$JS.API.CONSUMER.INFO." + stream + ".>",
+		"$JS.API.CONSUMER.MSG.NEXT." + stream + ".>",
+		"$JS.ACK." + stream + ".>",
+		"$JS.FC." + stream + ".>",
+	}
+}
+
+// workspaceNATSPermissions limits a workspace user to the KV buckets and the object store
+// of the workspace
+func workspaceNATSPermissions(prefix string, buckets []string) *server.Permissions {
+	publish := []string{"$JS.API.INFO", "$O." + prefix + ".>"}
+	publish = append(publish, jetStreamSubjects("OBJ_"+prefix)...)
+	for _, bucket := range buckets {
+		publish = append(publish, "$KV."+bucket+".>")
+		publish = append(publish, jetStreamSubjects("KV_"+bucket)...)
+	}
+	return &server.Permissions{
+		Publish:   &server.SubjectPermission{Allow: publish},
+		Subscribe: &server.SubjectPermission{Allow: []string{workspaceInboxPrefix(prefix) + ".>"}},
+	}
+}
+
+type NATSCredentialsRequest struct {
+	Workspace   string `json:"workspace,omitempty"`
+	WorkspaceID string `json:"workspace_prefix,omitempty"`
+}
+
+// NATSCredentials lets a client connect to the embedded NATS server with access to a
+// single workspace
+type NATSCredentials struct {
+	URL         string   `json:"url"`
+	User        string   `json:"user"`
+	Password    string   `json:"password"`
+	InboxPrefix string   `json:"inbox_prefix"`
+	Buckets     []string `json:"buckets"`
+	ObjectStore string   `json:"object_store"`
+}
+
+// handleNATSCredentials issues the NATS credentials of a workspace
+func (s *Server) handleNATSCredentials(w http.ResponseWriter, r *http.Request) {
+	if s.signer.ephemeral {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: errEphemeralKey.Error()})
+		return
+	}
+	var req NATSCredentialsRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+	if req.Workspace == "" && req.WorkspaceID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "workspace or workspace_prefix is required"})
+		return
+	}
+	prefix := req.WorkspaceID
+	if prefix == "" {
+		prefix = getWorkspacePrefix(req.Workspace)
+	}
+	if !isDataBucket(prefix) || isPartition(prefix) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid workspace_prefix"})
+		return
+	}
+
+	buckets := []string{prefix}
+	if partitions, err := s.listPartitions(prefix); err == nil {
+		buckets = append(buckets, partitions...)
+	} else {
+		log.Printf("Failed to list partitions of %s: %v", prefix, err)
+	}
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: NATSCredentials{
+		URL:         s.natsURL,
+		User:        natsWorkspaceUser + prefix,
+		Password:    s.workspaceNATSPassword(prefix),
+		InboxPrefix: workspaceInboxPrefix(prefix),
+		Buckets:     buckets,
+		ObjectStore: prefix,
+	}})
+}
+
+// runNATSNkeyCommand generates a user nkey for the tool's own NATS connections, printing the
+// seed to set as KV_NATS_NKEY_SEED and its public key
+func runNATSNkeyCommand(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("nats-nkey takes no arguments")
+	}
+	nkey, err := nkeys.CreateUser()
+	if err != nil {
+		return err
+	}
+	seed, err := nkey.Seed()
+	if err != nil {
+		return err
+	}
+	publicKey, err := nkey.PublicKey()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("KV_NATS_NKEY_SEED=%s\n", seed)
+	fmt.Printf("# public key: %s\n", publicKey)
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nkeys"
+)
+
+// fakeNATSClient is a connecting client as seen by the authenticator
+type fakeNATSClient struct {
+	opts  server.ClientOpts
+	user  *server.User
+	nonce []byte
+	kind  int
+}
+
+func (c *fakeNATSClient) GetOpts() *server.ClientOpts                 { return &c.opts }
+func (c *fakeNATSClient) GetTLSConnectionState() *tls.ConnectionState { return nil }
+func (c *fakeNATSClient) RegisterUser(user *server.User)              { c.user = user }
+func (c *fakeNATSClient) RemoteAddress() net.Addr                     { return nil }
+func (c *fakeNATSClient) GetNonce() []byte                            { return c.nonce }
+func (c *fakeNATSClient) Kind() int                                   { return c.kind }
+
+func TestNATSAuthenticator(t *testing.T) {
+	s := newTestServer()
+	a := &natsAuthenticator{password: "internal"}
+	ws1, ws2 := getWorkspacePrefix("ws1"), getWorkspacePrefix("ws2")
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		ready    bool
+		want     bool
+	}{
+		{name: "internal user", user: natsInternalUser, password: "internal", want: true},
+		{name: "internal user with wrong password", user: natsInternalUser, password: "wrong", want: false},
+		{name: "anonymous", want: false},
+		{name: "workspace before the server is ready", user: natsWorkspaceUser + ws1, password: s.workspaceNATSPassword(ws1), want: false},
+		{name: "password of another workspace", user: natsWorkspaceUser + ws1, password: s.workspaceNATSPassword(ws2), ready: true, want: false},
+		{name: "system bucket", user: natsWorkspaceUser + "system-apikeys", password: s.workspaceNATSPassword("system-apikeys"), ready: true, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.ready {
+				a.server.Store(s)
+			}
+			c := &fakeNATSClient{opts: server.ClientOpts{Username: tt.user, Password: tt.password}}
+			if got := a.Check(c); got != tt.want {
+				t.Fatalf("Check = %v, want %v", got, tt.want)
+			}
+			if tt.want && c.user == nil {
+				t.Errorf("authenticated clients must be registered")
+			}
+		})
+	}
+}
+
+func TestWorkspaceNATSPermissions(t *testing.T) {
+	ws1, ws2 := getWorkspacePrefix("ws1"), getWorkspacePrefix("ws2")
+	perms := workspaceNATSPermissions(ws1, []string{ws1, ws1 + "-tool-search"})
+	allowed := perms.Publish.Allow
+
+	for _, subject := range []string{"$KV." + ws1 + ".>", "$KV." + ws1 + "-tool-search.>", "$JS.API.STREAM.INFO.KV_" + ws1, "$O." + ws1 + ".>"} {
+		if !slices.Contains(allowed, subject) {
+			t.Errorf("%s must be allowed", subject)
+		}
+	}
+	for _, subject := range allowed {
+		if slices.Contains([]string{">", "$KV.>", "$JS.API.>"}, subject) || strings.Contains(subject, ws2) {
+			t.Errorf("%s grants access beyond the workspace", subject)
+		}
+	}
+	if len(perms.Subscribe.Allow) != 1 || perms.Subscribe.Allow[0] != workspaceInboxPrefix(ws1)+".>" {
+		t.Errorf("subscriptions must be limited to the workspace inbox, got %v", perms.Subscribe.Allow)
+	}
+}
+
+func TestNATSAuthenticatorNkey(t *testing.T) {
+	nkey, _ := nkeys.CreateUser()
+	seed, _ := nkey.Seed()
+	t.Setenv("KV_NATS_NKEY_SEED", string(seed))
+	t.Setenv("KV_NATS_PASSWORD", "internal")
+	a, err := newNATSAuthenticator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, _ := nkey.PublicKey()
+	other, _ := nkeys.CreateUser()
+	otherKey, _ := other.PublicKey()
+	nonce := []byte("nonce-from-server")
+	sign := func(kp nkeys.KeyPair) string {
+		sig, _ := kp.Sign(nonce)
+		return base64.RawURLEncoding.EncodeToString(sig)
+	}
+
+	tests := []struct {
+		name string
+		c    *fakeNATSClient
+		want bool
+	}{
+		{name: "nkey", c: &fakeNATSClient{opts: server.ClientOpts{Nkey: publicKey, Sig: sign(nkey)}, nonce: nonce}, want: true},
+		{name: "signature of another nkey", c: &fakeNATSClient{opts: server.ClientOpts{Nkey: publicKey, Sig: sign(other)}, nonce: nonce}},
+		{name: "another nkey", c: &fakeNATSClient{opts: server.ClientOpts{Nkey: otherKey, Sig: sign(other)}, nonce: nonce}},
+		{name: "no nonce", c: &fakeNATSClient{opts: server.ClientOpts{Nkey: publicKey, Sig: sign(nkey)}}},
+		{name: "password of a client", c: &fakeNATSClient{opts: server.ClientOpts{Username: natsInternalUser, Password: "internal"}}},
+		{name: "password of a follower", c: &fakeNATSClient{opts: server.ClientOpts{Username: natsInternalUser, Password: "internal"}, kind: server.LEAF}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := a.Check(tt.c); got != tt.want {
+				t.Fatalf("Check = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Setenv("KV_NATS_NKEY_SEED", "SUnotaseed")
+	if _, err := newNATSAuthenticator(); err == nil {
+		t.Error("expected an error for an invalid seed")
+	}
+	account, _ := nkeys.CreateAccount()
+	seed, _ = account.Seed()
+	t.Setenv("KV_NATS_NKEY_SEED", string(seed))
+	if _, err := newNATSAuthenticator(); err == nil {
+		t.Error("expected an error for the seed of an account")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// loadNATSOptions starts the options of the embedded NATS server from KV_NATS_CONFIG, a NATS
+// server config file, and KV_NATS_OPTIONS, a JSON object in the same format applied over
+// it, so JetStream limits, accounts, TLS and anything else the server supports can be
+// tuned. The store then applies its own settings over them: the listen address, JetStream
+// and its store directory, client authentication, durability, clustering and followers.
+func loadNATSOptions() (*server.Options, error) {
+	opts := &server.Options{}
+	if path := getEnvOrDefault("KV_NATS_CONFIG", ""); path != "" {
+		if err := opts.ProcessConfigFile(path); err != nil {
+			return nil, fmt.Errorf("invalid KV_NATS_CONFIG: %v", err)
+		}
+	}
+
+	raw := getEnvOrDefault("KV_NATS_OPTIONS", "")
+	if raw == "" {
+		return opts, nil
+	}
+	var object map[string]any
+	if err := json.Unmarshal([]byte(raw), &object); err != nil {
+		return nil, fmt.Errorf("invalid KV_NATS_OPTIONS: must be a JSON object: %v", err)
+	}
+	// The config parser reads JSON, but only from files
+	file, err := os.CreateTemp("", "kv-nats-options-*.json")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	_, err = file.WriteString(raw)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Options read from a second file keep those of the first they don't set
+	configFile := opts.ConfigFile
+	if err := opts.ProcessConfigFile(file.Name()); err != nil {
+		return nil, fmt.Errorf("invalid KV_NATS_OPTIONS: %v", err)
+	}
+	opts.ConfigFile = configFile
+	return opts, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadNATSOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nats.conf")
+	if err := os.WriteFile(path, []byte("max_payload: 2MB\njetstream {\n  max_file_store: 1GB\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("KV_NATS_CONFIG", path)
+	t.Setenv("KV_NATS_OPTIONS", `{"max_connections": 100, "jetstream": {"max_memory_store": 1048576}}`)
+
+	opts, err := loadNATSOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.MaxPayload != 2*1024*1024 || opts.MaxConn != 100 {
+		t.Errorf("max_payload = %d, max_connections = %d", opts.MaxPayload, opts.MaxConn)
+	}
+	if opts.JetStreamMaxStore != 1024*1024*1024 || opts.JetStreamMaxMemory != 1048576 {
+		t.Errorf("max_file_store = %d, max_memory_store = %d", opts.JetStreamMaxStore, opts.JetStreamMaxMemory)
+	}
+	if opts.ConfigFile != path {
+		t.Errorf("config file = %s", opts.ConfigFile)
+	}
+
+	t.Setenv("KV_NATS_OPTIONS", `["not", "an", "object"]`)
+	if _, err := loadNATSOptions(); err == nil {
+		t.Error("options that aren't an object should be rejected")
+	}
+}
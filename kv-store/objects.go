@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+)
+
+// getObjectStore gets or creates an object store for the given prefix
+func (s *Server) getObjectStore(prefix string) (nats.ObjectStore, error) {
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+
+	// Followers only hold mirrors of the primary's object stores
+	if s.follower != nil {
+		store, err := js.ObjectStore(prefix)
+		if errors.Is(err, nats.ErrStreamNotFound) {
+			if err = s.createObjectStoreMirror(js, prefix); err == nil {
+				store, err = js.ObjectStore(prefix)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to mirror object store: %v", err)
+		}
+		return store, nil
+	}
+
+	store, err := js.CreateObjectStore(&nats.ObjectStoreConfig{
+		Bucket:   prefix,
+		Replicas: s.durability.bucketReplicas(bucketClassObjects),
+	})
+	if err != nil {
+		// If it already exists, try to get it
+		store, err = js.ObjectStore(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create/get object store: %v", err)
+		}
+	}
+	return store, nil
+}
+
+// reservedObjectPrefixes are the object namespaces managed by the server itself
+var reservedObjectPrefixes = []string{"artifacts/", "snapshots/", "uploads/"}
+
+// isReservedObject reports whether an object name is inside a server-managed namespace
+func isReservedObject(name string) bool {
+	for _, prefix := range reservedObjectPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
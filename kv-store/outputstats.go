@@ -0,0 +1,138 @@
+package main
+
+import (
+	"cmp"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type OutputStatsRequest struct {
+	// Tool only returns the statistics of one tool
+	Tool string `json:"tool,omitempty"`
+}
+
+// OutputToolStats sums the output-filter entries stored for one tool
+type OutputToolStats struct {
+	Tool       string    `json:"tool"`
+	Count      int       `json:"count"`
+	Bytes      int64     `json:"bytes"`
+	LastStored time.Time `json:"last_stored"`
+}
+
+type OutputStats struct {
+	Tools []OutputToolStats `json:"tools"`
+	Count int               `json:"count"`
+	Bytes int64             `json:"bytes"`
+}
+
+// outputTool returns the tool an output-filter key was stored for. Keys are named
+// output-<tool>-<sha1>, and tool names can hold dashes themselves.
+func outputTool(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, "output-")
+	if !ok {
+		return "", false
+	}
+	i := strings.LastIndex(rest, "-")
+	if i < 1 || len(rest)-i-1 != 40 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(rest[i+1:]); err != nil {
+		return "", false
+	}
+	return rest[:i], true
+}
+
+// add counts an output-filter entry in the statistics of its tool
+func (o *OutputStats) add(tools map[string]*OutputToolStats, tool string, size int, stored time.Time) {
+	stats, ok := tools[tool]
+	if !ok {
+		stats = &OutputToolStats{Tool: tool}
+		tools[tool] = stats
+	}
+	stats.Count++
+	stats.Bytes += int64(size)
+	if stored.After(stats.LastStored) {
+		stats.LastStored = stored
+	}
+	o.Count++
+	o.Bytes += int64(size)
+}
+
+// handleOutputStats counts the output-filter entries stored in the workspace by tool, largest
+// first, to find the tools whose outputs take up the most space. They are counted from the
+// stored keys, so entries removed by deletes, expiry or output collection are never counted.
+func (s *Server) handleOutputStats(w http.ResponseWriter, r *http.Request) {
+	var req OutputStatsRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+
+	prefixes, err := s.getReadPrefixes(r, "")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	// Outputs may be kept in the per-tool partitions of the workspace
+	if s.partitionMode != partitionNone {
+		partitions, err := s.listPartitions(getRequestPrefix(r))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		for _, partition := range partitions {
+			if !slices.Contains(prefixes, partition) {
+				prefixes = append(prefixes, partition)
+			}
+		}
+	}
+
+	canRead := s.readFilter(r)
+	stats := OutputStats{Tools: make([]OutputToolStats, 0)}
+	tools := map[string]*OutputToolStats{}
+	for _, prefix := range prefixes {
+		bucket, err := s.getBucket(prefix)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		err = scanBucket(bucket, func(entry nats.KeyValueEntry) {
+			tool, ok := outputTool(entry.Key())
+			if !ok || (req.Tool != "" && tool != req.Tool) || !canRead(entry.Key()) {
+				return
+			}
+			stats.add(tools, tool, len(entry.Value()), entry.Created())
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+	}
+
+	for _, tool := range tools {
+		stats.Tools = append(stats.Tools, *tool)
+	}
+	slices.SortFunc(stats.Tools, func(a, b OutputToolStats) int {
+		if c := cmp.Compare(b.Bytes, a.Bytes); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Tool, b.Tool)
+	})
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: stats})
+}
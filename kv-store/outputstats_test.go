@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutputTool(t *testing.T) {
+	hash := strings.Repeat("ab", 20)
+	for key, want := range map[string]string{"output-search-" + hash: "search", "output-web-fetch-" + hash: "web-fetch", "output-unknown-" + hash: "unknown"} {
+		if tool, ok := outputTool(key); !ok || tool != want {
+			t.Errorf("outputTool(%q) = %q, %v, want %q", key, tool, ok, want)
+		}
+	}
+	for _, key := range []string{"search-" + hash, "output-" + hash, "output--" + hash, "output-search-abc", "output-search-" + strings.Repeat("zz", 20)} {
+		if tool, ok := outputTool(key); ok {
+			t.Errorf("outputTool(%q) = %q, want no tool", key, tool)
+		}
+	}
+}
+
+func TestOutputStatsAdd(t *testing.T) {
+	first, last := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC)
+	stats := OutputStats{}
+	tools := map[string]*OutputToolStats{}
+	stats.add(tools, "search", 100, last)
+	stats.add(tools, "search", 50, first)
+	stats.add(tools, "fetch", 10, first)
+	if search := tools["search"]; search.Count != 2 || search.Bytes != 150 || !search.LastStored.Equal(last) {
+		t.Errorf("unexpected search stats %+v", search)
+	}
+	if stats.Count != 3 || stats.Bytes != 160 {
+		t.Errorf("unexpected totals %+v", stats)
+	}
+}
+
+func TestHandleOutputStatsValidation(t *testing.T) {
+	s := newTestServer()
+	w := httptest.NewRecorder()
+	s.handleOutputStats(w, httptest.NewRequest("POST", "/api/v1/output/stats", strings.NewReader(`{"tool":1}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"slices"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// encodeListCursor returns the cursor of the page after a key, which is opaque to clients
+func encodeListCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// decodeListCursor returns the key a page continues after
+func decodeListCursor(cursor string) (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(key) == 0 {
+		return "", fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return string(key), nil
+}
+
+// pageKeys sorts keys and returns up to limit of them after the key of the cursor, with the
+// cursor of the next page, "" when this is the last one. Pages are in key order, so a key
+// written while a client pages through is listed if it sorts after the current page.
+func pageKeys(keys []string, after string, limit int) ([]string, string) {
+	slices.Sort(keys)
+	start, found := slices.BinarySearch(keys, after)
+	if found {
+		start++
+	}
+	keys = keys[start:]
+	if len(keys) <= limit {
+		return keys, ""
+	}
+	return keys[:limit], encodeListCursor(keys[limit-1])
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestPageKeys(t *testing.T) {
+	keys := []string{"d", "a", "e", "b", "c"}
+	var pages [][]string
+	after := ""
+	for {
+		page, next := pageKeys(slices.Clone(keys), after, 2)
+		pages = append(pages, page)
+		if next == "" {
+			break
+		}
+		var err error
+		if after, err = decodeListCursor(next); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := [][]string{{"a", "b"}, {"c", "d"}, {"e"}}; !slices.EqualFunc(pages, want, slices.Equal) {
+		t.Errorf("pages %v, want %v", pages, want)
+	}
+
+	// A page continues after the cursor key even when it was deleted since
+	if page, next := pageKeys([]string{"a", "c", "d"}, "b", 5); !slices.Equal(page, []string{"c", "d"}) || next != "" {
+		t.Errorf("page after a deleted key = %v, %q", page, next)
+	}
+}
+
+func TestDecodeListCursor(t *testing.T) {
+	if key, err := decodeListCursor(encodeListCursor("notes/2024.md")); err != nil || key != "notes/2024.md" {
+		t.Errorf("round trip = %q, %v", key, err)
+	}
+	for _, cursor := range []string{"", "not base64!"} {
+		if _, err := decodeListCursor(cursor); err == nil {
+			t.Errorf("decodeListCursor(%q) succeeded, want an error", cursor)
+		}
+	}
+}
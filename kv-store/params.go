@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// GPTScript passes tool parameters as plain strings, so request fields that are not
+// strings accept both their JSON type and a string form.
+
+// stringList is a list of strings that can also be given as a comma separated string
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*l = list
+		return nil
+	}
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("expected a list or a comma separated string")
+	}
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// flexibleInt is an integer that can also be given as a string
+type flexibleInt int64
+
+func (i *flexibleInt) UnmarshalJSON(data []byte) error {
+	var value int64
+	if err := json.Unmarshal(data, &value); err == nil {
+		*i = flexibleInt(value)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("expected an integer")
+	}
+	if str = strings.TrimSpace(str); str == "" {
+		*i = 0
+		return nil
+	}
+	value, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return fmt.Errorf("expected an integer, got %q", str)
+	}
+	*i = flexibleInt(value)
+	return nil
+}
+
+// flexibleBool is a boolean that can also be given as a string such as "true" or "false"
+type flexibleBool bool
+
+func (b *flexibleBool) UnmarshalJSON(data []byte) error {
+	var value bool
+	if err := json.Unmarshal(data, &value); err == nil {
+		*b = flexibleBool(value)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("expected a boolean")
+	}
+	if str = strings.TrimSpace(str); str == "" {
+		*b = false
+		return nil
+	}
+	value, err := strconv.ParseBool(str)
+	if err != nil {
+		return fmt.Errorf("expected a boolean, got %q", str)
+	}
+	*b = flexibleBool(value)
+	return nil
+}
+
+// flexibleNumber is a number kept in its literal form, so arbitrary precision and the
+// number of decimals survive decoding. It can be given as a JSON number or a string.
+type flexibleNumber string
+
+func (n *flexibleNumber) UnmarshalJSON(data []byte) error {
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err == nil {
+		*n = flexibleNumber(number)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("expected a number")
+	}
+	*n = flexibleNumber(strings.TrimSpace(str))
+	return nil
+}
+
+// jsonObject is a JSON object that can also be given as a string holding a JSON object
+type jsonObject map[string]json.RawMessage
+
+func (o *jsonObject) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		if strings.TrimSpace(str) == "" {
+			*o = nil
+			return nil
+		}
+		data = []byte(str)
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return fmt.Errorf("expected a JSON object")
+	}
+	*o = object
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Partition modes for KV_PARTITION_MODE
+const (
+	partitionNone   = "none"
+	partitionOutput = "output"
+	partitionAll    = "all"
+)
+
+var partitionNameUnsafe = regexp.MustCompile(`[^a-z0-9_]`)
+
+// getPartitionName converts a tool name into a string that is safe to use in a bucket name
+func getPartitionName(tool string) string {
+	name := partitionNameUnsafe.ReplaceAllString(strings.ToLower(tool), "_")
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// getDataPrefix returns the name of the bucket holding the request's data. With namespaces,
+// requests made for a user or in a thread keep their keys in <prefix>-user-<user> or
+// <prefix>-thread-<thread>.
+func (s *Server) getDataPrefix(r *http.Request, output bool) string {
+	if ns := s.getNamespaces(r)[0]; ns.Scope != scopeWorkspace {
+		return ns.Prefix
+	}
+	return s.getSharedDataPrefix(r, output)
+}
+
+// getSharedDataPrefix returns the name of the bucket holding the data shared by the
+// workspace. Depending on the partition mode, output-filter data (or all data) is kept in a
+// per-tool bucket named <prefix>-tool-<tool> so tool-scoped list/watch and retention stay
+// cheap.
+func (s *Server) getSharedDataPrefix(r *http.Request, output bool) string {
+	prefix := getRequestPrefix(r)
+	if s.partitionMode == partitionAll || (output && s.partitionMode == partitionOutput) {
+		if tool := getPartitionName(r.Header.Get("X-Gptscript-Tool-Name")); tool != "" {
+			return prefix + "-tool-" + tool
+		}
+	}
+	return prefix
+}
+
+// partitionBucketName matches exactly the <prefix>-tool-<tool> data bucket of a partition,
+// and not the auxiliary buckets of a partition such as <prefix>-tool-<tool>-stats
+var partitionBucketName = regexp.MustCompile(`^[^-]+-tool-[a-z0-9_]+$`)
+
+// isPartition reports whether a bucket name is a per-tool partition
+func isPartition(name string) bool {
+	return partitionBucketName.MatchString(name)
+}
+
+// isDataBucket reports whether a bucket holds user data, which are the workspace buckets and
+// their shards, their per-tool partitions and the buckets of their users and threads
+func isDataBucket(name string) bool {
+	return !strings.Contains(name, "-") || isPartition(name) || isNamespaceBucket(name) || isShardBucket(name)
+}
+
+// listPartitions returns the per-tool partition buckets of a workspace
+func (s *Server) listPartitions(prefix string) ([]string, error) {
+	names, err := s.listDataBuckets()
+	if err != nil {
+		return nil, err
+	}
+	partitions := make([]string, 0)
+	for _, name := range names {
+		if strings.HasPrefix(name, prefix+"-tool-") {
+			partitions = append(partitions, name)
+		}
+	}
+	return partitions, nil
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// PII policy modes. Flagged values are stored as they are and audited, masked values have
+// the PII replaced, and rejected values are not stored.
+const (
+	piiOff    = "off"
+	piiFlag   = "flag"
+	piiMask   = "mask"
+	piiReject = "reject"
+)
+
+// builtinPIIPatterns recognize the PII that is detected without a detector endpoint
+var builtinPIIPatterns = []namedPattern{
+	{"email", regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)},
+	{"ssn", regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`)},
+	{"phone", regexp.MustCompile(`(?:\+\d{1,3}[\s.-]?)?(?:\(\d{3}\)|\b\d{3})[\s.-]?\d{3}[\s.-]\d{4}\b`)},
+}
+
+// PIIPolicy is how PII in the values written to a workspace is handled
+type PIIPolicy struct {
+	Mode string `json:"mode"`
+	// Types limits detection to these kinds of PII, all kinds are detected when empty
+	Types []string `json:"types,omitempty"`
+	// Prefixes limits detection to the keys under these prefixes, all keys when empty
+	Prefixes []string  `json:"prefixes,omitempty"`
+	Updated  time.Time `json:"updated,omitempty"`
+}
+
+// applies reports whether values written to a key are checked for PII
+func (p PIIPolicy) applies(key string) bool {
+	if p.Mode == "" || p.Mode == piiOff {
+		return false
+	}
+	if len(p.Prefixes) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(p.Prefixes, func(prefix string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+}
+
+// piiFinding is PII found at a byte range of a value
+type piiFinding struct {
+	Type  string `json:"type"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+// piiDetector finds PII in values with the built-in patterns and, when configured, a
+// detector endpoint, and applies the policy of each workspace
+type piiDetector struct {
+	defaultMode string
+	url         string
+	client      *http.Client
+	auditTTL    time.Duration
+
+	lock     sync.RWMutex
+	policies map[string]PIIPolicy
+}
+
+// newPIIDetector configures detection from KV_PII_MODE, the policy of workspaces that
+// don't set their own, KV_PII_DETECTOR_URL and KV_PII_AUDIT_TTL
+func newPIIDetector() (*piiDetector, error) {
+	d := &piiDetector{
+		defaultMode: getEnvOrDefault("KV_PII_MODE", piiOff),
+		url:         getEnvOrDefault("KV_PII_DETECTOR_URL", ""),
+		client:      &http.Client{Timeout: 10 * time.Second},
+		policies:    map[string]PIIPolicy{},
+	}
+	if err := validatePIIMode(d.defaultMode); err != nil {
+		return nil, fmt.Errorf("invalid KV_PII_MODE: %v", err)
+	}
+	if d.url != "" {
+		if err := validateWebhookURL(d.url); err != nil {
+			return nil, fmt.Errorf("invalid KV_PII_DETECTOR_URL: %v", err)
+		}
+	}
+	auditTTL, err := time.ParseDuration(getEnvOrDefault("KV_PII_AUDIT_TTL", "2160h"))
+	if err != nil || auditTTL <= 0 {
+		return nil, fmt.Errorf("invalid KV_PII_AUDIT_TTL: must be a positive duration")
+	}
+	d.auditTTL = auditTTL
+	return d, nil
+}
+
+func validatePIIMode(mode string) error {
+	if mode != piiOff && mode != piiFlag && mode != piiMask && mode != piiReject {
+		return fmt.Errorf("unknown mode %q, must be off, flag, mask or reject", mode)
+	}
+	return nil
+}
+
+// getPIIBucket gets the bucket holding the PII policy of a workspace
+func (s *Server) getPIIBucket(workspace string) (nats.KeyValue, error) {
+	return s.getBucket(workspace + "-pii")
+}
+
+// getPIIAuditBucket gets the bucket recording the PII found in a workspace. Records expire
+// after KV_PII_AUDIT_TTL.
+func (s *Server) getPIIAuditBucket(workspace string) (nats.KeyValue, error) {
+	return s.getBucket(workspace + "-pii-audit")
+}
+
+// getPIIPolicy returns the policy of a workspace, loading it on first use
+func (s *Server) getPIIPolicy(workspace string) (PIIPolicy, error) {
+	d := s.pii
+	d.lock.RLock()
+	policy, ok := d.policies[workspace]
+	d.lock.RUnlock()
+	if ok {
+		return policy, nil
+	}
+
+	policy = PIIPolicy{Mode: d.defaultMode}
+	bucket, err := s.getPIIBucket(workspace)
+	if err != nil {
+		return policy, err
+	}
+	entry, err := bucket.Get("policy")
+	if err == nil {
+		if err := json.Unmarshal(entry.Value(), &policy); err != nil {
+			return policy, fmt.Errorf("invalid PII policy: %v", err)
+		}
+	} else if !errors.Is(err, nats.ErrKeyNotFound) {
+		return policy, err
+	}
+
+	d.lock.Lock()
+	d.policies[workspace] = policy
+	d.lock.Unlock()
+	return policy, nil
+}
+
+// detect returns the PII found in a value, ordered by position without overlaps
+func (d *piiDetector) detect(value string, types []string) ([]piiFinding, error) {
+	var findings []piiFinding
+	for _, pattern := range builtinPIIPatterns {
+		for _, match := range pattern.re.FindAllStringIndex(value, -1) {
+			findings = append(findings, piiFinding{Type: pattern.name, Start: match[0], End: match[1]})
+		}
+	}
+	if d.url != "" {
+		detected, err := d.callDetector(value)
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, detected...)
+	}
+
+	findings = slices.DeleteFunc(findings, func(f piiFinding) bool {
+		return len(types) > 0 && !slices.Contains(types, f.Type)
+	})
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].Start != findings[j].Start {
+			return findings[i].Start < findings[j].Start
+		}
+		return findings[i].End > findings[j].End
+	})
+	merged := findings[:0]
+	for _, f := range findings {
+		if len(merged) > 0 && f.Start < merged[len(merged)-1].End {
+			last := &merged[len(merged)-1]
+			last.End = max(last.End, f.End)
+			continue
+		}
+		merged = append(merged, f)
+	}
+	return merged, nil
+}
+
+// callDetector asks the detector endpoint for the PII in a value. The endpoint receives
+// {"text": ...} and responds with {"findings": [{"type", "start", "end"}]}, where start and
+// end are byte offsets.
+func (d *piiDetector) callDetector(value string) ([]piiFinding, error) {
+	body, err := json.Marshal(map[string]string{"text": value})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := d.client.Post(d.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("PII detector failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("PII detector failed: %s", resp.Status)
+	}
+
+	var result struct {
+		Findings []piiFinding `json:"findings"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid PII detector response: %v", err)
+	}
+	findings := make([]piiFinding, 0, len(result.Findings))
+	for _, f := range result.Findings {
+		if f.Type != "" && f.Start >= 0 && f.Start < f.End && f.End <= len(value) {
+			findings = append(findings, f)
+		}
+	}
+	return findings, nil
+}
+
+// maskPII replaces each finding with a marker naming the kind of PII
+func maskPII(value string, findings []piiFinding) string {
+	var masked strings.Builder
+	last := 0
+	for _, f := range findings {
+		masked.WriteString(value[last:f.Start])
+		masked.WriteString("[PII:" + f.Type + "]")
+		last = f.End
+	}
+	masked.WriteString(value[last:])
+	return masked.String()
+}
+
+// piiTypes returns the kinds of PII in the findings
+func piiTypes(findings []piiFinding) []string {
+	var types []string
+	for _, f := range findings {
+		if !slices.Contains(types, f.Type) {
+			types = append(types, f.Type)
+		}
+	}
+	return types
+}
+
+// PIIAuditRecord records PII found in a value written to a workspace. It never includes
+// the value.
+type PIIAuditRecord struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Key       string    `json:"key"`
+	Tool      string    `json:"tool,omitempty"`
+	Principal string    `json:"principal"`
+	Action    string    `json:"action"`
+	Types     []string  `json:"types"`
+	Findings  int       `json:"findings"`
+}
+
+// checkPII applies the PII policy of the workspace to a value being written to a key. It
+// returns the value to store, or writes an error response and returns false when the value
+// must not be stored. A failing detector fails writes it should mask or reject, but not
+// writes it would only flag.
+func (s *Server) checkPII(w http.ResponseWriter, r *http.Request, key, value string) (string, bool) {
+	if s.pii == nil {
+		return value, true
+	}
+	workspace := getRequestPrefix(r)
+	policy, err := s.getPIIPolicy(workspace)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return "", false
+	}
+	if !policy.applies(key) {
+		return value, true
+	}
+
+	findings, err := s.pii.detect(value, policy.Types)
+	if err != nil {
+		log.Printf("Failed to check %s for PII: %v", key, err)
+		if policy.Mode == piiFlag {
+			return value, true
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return "", false
+	}
+	if len(findings) == 0 {
+		return value, true
+	}
+
+	record := PIIAuditRecord{
+		ID:        uuid.New().String(),
+		Time:      time.Now().UTC(),
+		Key:       key,
+		Tool:      r.Header.Get("X-Gptscript-Tool-Name"),
+		Principal: getPrincipal(r),
+		Action:    map[string]string{piiFlag: "flagged", piiMask: "masked", piiReject: "rejected"}[policy.Mode],
+		Types:     piiTypes(findings),
+		Findings:  len(findings),
+	}
+	s.auditPII(workspace, record)
+	w.Header().Set("X-KV-PII", strings.Join(record.Types, ","))
+
+	switch policy.Mode {
+	case piiMask:
+		return maskPII(value, findings), true
+	case piiReject:
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("value contains PII (%s) and was not stored", strings.Join(record.Types, ", "))})
+		return "", false
+	default:
+		return value, true
+	}
+}
+
+func (s *Server) auditPII(workspace string, record PIIAuditRecord) {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	bucket, err := s.getPIIAuditBucket(workspace)
+	if err == nil {
+		_, err = bucket.Put(record.ID, value)
+	}
+	if err != nil {
+		log.Printf("Failed to audit PII %s in %s: %v", record.Action, record.Key, err)
+	}
+}
+
+type PIIPolicyRequest struct {
+	Workspace   string   `json:"workspace,omitempty"`
+	WorkspaceID string   `json:"workspace_prefix,omitempty"`
+	Mode        string   `json:"mode,omitempty"`
+	Types       []string `json:"types,omitempty"`
+	Prefixes    []string `json:"prefixes,omitempty"`
+	Key         string   `json:"key,omitempty"`
+	Since       string   `json:"since,omitempty"`
+}
+
+// prefix returns the workspace prefix a PII request refers to
+func (req PIIPolicyRequest) prefix() string {
+	return getACLPrefix(ACLRequest{Workspace: req.Workspace, WorkspaceID: req.WorkspaceID})
+}
+
+func (s *Server) handlePIIPolicySet(w http.ResponseWriter, r *http.Request) {
+	var req PIIPolicyRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+	if (req.Workspace == "" && req.WorkspaceID == "") || req.Mode == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "workspace and mode are required"})
+		return
+	}
+	if err := validatePIIMode(req.Mode); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	prefix := req.prefix()
+	bucket, err := s.getPIIBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	policy := PIIPolicy{Mode: req.Mode, Types: req.Types, Prefixes: req.Prefixes, Updated: time.Now().UTC()}
+	value, err := json.Marshal(policy)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if _, err := bucket.Put("policy", value); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	s.pii.lock.Lock()
+	s.pii.policies[prefix] = policy
+	s.pii.lock.Unlock()
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: policy})
+}
+
+func (s *Server) handlePIIPolicyGet(w http.ResponseWriter, r *http.Request) {
+	var req PIIPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+	if req.Workspace == "" && req.WorkspaceID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "workspace is required"})
+		return
+	}
+
+	policy, err := s.getPIIPolicy(req.prefix())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: policy})
+}
+
+// handlePIIAudit lists the PII found in a workspace, optionally for a single key or since a
+// time
+func (s *Server) handlePIIAudit(w http.ResponseWriter, r *http.Request) {
+	var req PIIPolicyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+	if req.Workspace == "" && req.WorkspaceID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "workspace is required"})
+		return
+	}
+	var since time.Time
+	if req.Since != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, req.Since); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "since must be an RFC 3339 time"})
+			return
+		}
+	}
+
+	bucket, err := s.getPIIAuditBucket(req.prefix())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	records := make([]PIIAuditRecord, 0)
+	err = scanBucket(bucket, func(entry nats.KeyValueEntry) {
+		var record PIIAuditRecord
+		if json.Unmarshal(entry.Value(), &record) != nil {
+			return
+		}
+		if (req.Key == "" || record.Key == req.Key) && !record.Time.Before(since) {
+			records = append(records, record)
+		}
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: records})
+}
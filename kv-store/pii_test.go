@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDetectPII(t *testing.T) {
+	d := &piiDetector{}
+	value := "mail jane.doe@example.com or call (555) 123-4567, ssn 123-45-6789"
+	findings, err := d.detect(value, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if types := strings.Join(piiTypes(findings), ","); types != "email,phone,ssn" {
+		t.Errorf("found %s", types)
+	}
+	if masked := maskPII(value, findings); masked != "mail [PII:email] or call [PII:phone], ssn [PII:ssn]" {
+		t.Errorf("masked %q", masked)
+	}
+
+	findings, _ = d.detect(value, []string{"ssn"})
+	if masked := maskPII(value, findings); masked != "mail jane.doe@example.com or call (555) 123-4567, ssn [PII:ssn]" {
+		t.Errorf("only the selected types should be detected, masked %q", masked)
+	}
+	if findings, _ := d.detect("order 1234 shipped", nil); len(findings) != 0 {
+		t.Errorf("unexpected findings %v", findings)
+	}
+}
+
+func TestPIIDetectorEndpoint(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Text string `json:"text"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		start := strings.Index(req.Text, "Jane Doe")
+		json.NewEncoder(w).Encode(map[string]any{"findings": []piiFinding{
+			{Type: "name", Start: start, End: start + len("Jane Doe")},
+			{Type: "name", Start: 5, End: 500},
+		}})
+	}))
+	defer server.Close()
+
+	d := &piiDetector{url: server.URL, client: server.Client()}
+	value := "From Jane Doe <jane@example.com>"
+	findings, err := d.detect(value, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if masked := maskPII(value, findings); masked != "From [PII:name] <[PII:email]>" {
+		t.Errorf("masked %q", masked)
+	}
+
+	d.url = server.URL + "/missing"
+	server.Config.Handler = http.NotFoundHandler()
+	if _, err := d.detect(value, nil); err == nil {
+		t.Error("a failing detector should fail detection")
+	}
+}
+
+func TestPIIPolicyApplies(t *testing.T) {
+	if (PIIPolicy{Mode: piiOff}).applies("a") || (PIIPolicy{}).applies("a") {
+		t.Error("disabled policies should not apply")
+	}
+	policy := PIIPolicy{Mode: piiMask, Prefixes: []string{"users/", "contacts/"}}
+	if !policy.applies("contacts/1") || policy.applies("config/x") {
+		t.Error("policies should only apply to their prefixes")
+	}
+}
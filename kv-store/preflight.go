@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// preflightBucket holds the key written to check the store works before serving
+const preflightBucket = "system-preflight"
+
+// checkStorageDir verifies the NATS server will be able to write its stores, which it
+// otherwise only finds out when the first bucket is created
+func checkStorageDir(dir string) error {
+	file, err := os.CreateTemp(dir, ".preflight-*")
+	if err != nil {
+		return fmt.Errorf("storage directory %s is not writable by uid %d: %v, fix its permissions or point NATS_STORAGE or -s at a writable directory", dir, os.Getuid(), err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if _, err := file.Write([]byte("preflight")); err != nil {
+		return fmt.Errorf("failed to write to storage directory %s: %v", dir, err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync a file in storage directory %s: %v, the file system may not support fsync", dir, err)
+	}
+	return nil
+}
+
+// checkConfig rejects combinations of settings that each parse, but can't work together
+func (s *Server) checkConfig(restoreFrom string) error {
+	if s.follower != nil && restoreFrom != "" {
+		return fmt.Errorf("-restore-from can't be used on a read replica, which mirrors the primary, restore the backup on the primary instead")
+	}
+	if s.requireAuth && s.adminToken == "" && s.jwt == nil && (s.tls == nil || len(s.tls.identities) == 0) {
+		return fmt.Errorf("KV_REQUIRE_AUTH rejects requests without credentials, but no credentials can be issued: set KV_ADMIN_TOKEN to create API keys, configure JWT validation or client certificates")
+	}
+	return nil
+}
+
+// preflight checks the configuration and the store before any traffic is served, so
+// misconfigured deployments fail at startup rather than on their first request
+func (s *Server) preflight(restoreFrom string) error {
+	if err := s.checkConfig(restoreFrom); err != nil {
+		return err
+	}
+
+	// A nearly full disk doesn't stop the store, it is served read-only until space is freed
+	if s.disk != nil {
+		if status := s.disk.status(); status.ReadOnly {
+			log.Printf("Starting read-only, only %d bytes are free in %s and writes need %d", status.FreeBytes, status.Path, status.MinFreeBytes)
+		}
+	}
+
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+	if _, err := js.AccountInfo(); err != nil {
+		return fmt.Errorf("JetStream is not available: %v", err)
+	}
+	// Followers only mirror the primary, so they don't write
+	if s.follower != nil {
+		return nil
+	}
+	return s.checkRoundTrip()
+}
+
+// checkRoundTrip writes, reads and removes a key through the same encryption and
+// compression as workspace values, which catches unusable keys and storage limits
+func (s *Server) checkRoundTrip() error {
+	raw, err := s.getRawBucket(preflightBucket)
+	if err != nil {
+		return fmt.Errorf("failed to create a bucket: %v", err)
+	}
+	bucket := s.wrapDataBucket(raw)
+
+	// Replicas sharing the store each check their own key
+	key := "check-" + s.replicaID
+	value := []byte(fmt.Sprintf("preflight %s", time.Now().Format(time.RFC3339Nano)))
+	if _, err := bucket.Put(key, value); err != nil {
+		return fmt.Errorf("failed to write a key: %v", err)
+	}
+	defer func() {
+		if err := raw.Purge(key); err != nil {
+			log.Printf("Failed to remove the preflight key: %v", err)
+		}
+	}()
+	entry, err := bucket.Get(key)
+	if err != nil {
+		return fmt.Errorf("failed to read a key back: %v", err)
+	}
+	if !bytes.Equal(entry.Value(), value) {
+		return fmt.Errorf("a key read back differs from the value written, check the encryption and compression settings")
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckStorageDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := checkStorageDir(dir); err != nil {
+		t.Fatalf("checkStorageDir: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("the check left %d files behind", len(entries))
+	}
+	if err := checkStorageDir(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("a missing directory must fail the check")
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		setup       func(s *Server)
+		restoreFrom string
+		wantErr     bool
+	}{
+		{name: "defaults", setup: func(s *Server) {}},
+		{name: "restore on a follower", setup: func(s *Server) { s.follower = &follower{} }, restoreFrom: "backup.tar.gz", wantErr: true},
+		{name: "restore on a primary", setup: func(s *Server) {}, restoreFrom: "backup.tar.gz"},
+		{name: "required auth without credentials", setup: func(s *Server) { s.requireAuth, s.adminToken = true, "" }, wantErr: true},
+		{name: "required auth with an admin token", setup: func(s *Server) { s.requireAuth, s.adminToken = true, "adm" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer()
+			tt.setup(s)
+			if err := s.checkConfig(tt.restoreFrom); (err != nil) != tt.wantErr {
+				t.Errorf("checkConfig = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// queryReads are the reads that can be made with GET and query parameters instead of a JSON
+// body, so clients that can't build one, such as curl in a sandbox or a browser, can read
+// values. Each builds the body its POST form takes from the parameters.
+var queryReads = map[string]func(query url.Values) (any, error){
+	"/api/v1/get": func(query url.Values) (any, error) {
+		return KVRequest{
+			Key:         query.Get("key"),
+			Scope:       query.Get("scope"),
+			Consistency: query.Get("consistency"),
+			Encoding:    query.Get("encoding"),
+		}, checkQueryParams(query, "key", "scope", "consistency", "encoding")
+	},
+	"/api/v1/list": func(query url.Values) (any, error) {
+		req := ListRequest{
+			Scope:       query.Get("scope"),
+			Consistency: query.Get("consistency"),
+			Prefix:      query.Get("prefix"),
+			Pattern:     query.Get("pattern"),
+			Cursor:      query.Get("cursor"),
+		}
+		if include := query.Get("include"); include != "" {
+			req.Include = strings.Split(include, ",")
+		}
+		if stats := query.Get("stats"); stats != "" {
+			var err error
+			if req.Stats, err = strconv.ParseBool(stats); err != nil {
+				return nil, fmt.Errorf("invalid stats %q, must be true or false", stats)
+			}
+		}
+		if limit := query.Get("limit"); limit != "" {
+			value, err := strconv.Atoi(limit)
+			if err != nil {
+				return nil, fmt.Errorf("invalid limit %q, must be a number", limit)
+			}
+			req.Limit = flexibleInt(value)
+		}
+		return req, checkQueryParams(query, "scope", "consistency", "stats", "prefix", "pattern", "limit", "cursor", "include")
+	},
+	// A browser's EventSource can only GET, so a watch of a single prefix can be opened with one
+	"/api/v1/watch": func(query url.Values) (any, error) {
+		req := WatchRequest{Prefix: query.Get("prefix")}
+		if id := query.Get("last_event_id"); id != "" {
+			value, err := strconv.Atoi(id)
+			if err != nil {
+				return nil, fmt.Errorf("invalid last_event_id %q, must be a number", id)
+			}
+			req.LastEventID = flexibleInt(value)
+		}
+		return req, checkQueryParams(query, "prefix", "last_event_id")
+	},
+}
+
+// checkQueryParams rejects parameters a read doesn't take, which would otherwise be ignored
+// silently, and parameters given more than once
+func checkQueryParams(query url.Values, names ...string) error {
+	allowed := map[string]bool{}
+	for _, name := range names {
+		allowed[name] = true
+	}
+	for name, values := range query {
+		if !allowed[name] {
+			return fmt.Errorf("unknown query parameter %q", name)
+		}
+		if len(values) > 1 {
+			return fmt.Errorf("query parameter %q is given more than once", name)
+		}
+	}
+	return nil
+}
+
+// queryReadBody returns the JSON body of a GET read from its query parameters, and whether
+// the request is one
+func queryReadBody(r *http.Request) ([]byte, bool, error) {
+	read, ok := queryReads[r.URL.Path]
+	if !ok || r.Method != http.MethodGet {
+		return nil, false, nil
+	}
+	req, err := read(r.URL.Query())
+	if err != nil {
+		return nil, true, err
+	}
+	body, err := json.Marshal(req)
+	return body, true, err
+}
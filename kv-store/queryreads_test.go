@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestQueryReadBody(t *testing.T) {
+	tests := []struct {
+		method, target string
+		body           string
+		read, fails    bool
+	}{
+		{"GET", "/api/v1/get?key=a%2Fb&consistency=eventual", `{"key":"a/b","value":"","consistency":"eventual"}`, true, false},
+		{"GET", "/api/v1/list?stats=true&scope=thread", `{"stats":true,"scope":"thread"}`, true, false},
+		{"GET", "/api/v1/list", `{}`, true, false},
+		{"GET", "/api/v1/list?prefix=notes.&pattern=*.md", `{"prefix":"notes.","pattern":"*.md"}`, true, false},
+		{"GET", "/api/v1/list?stats=maybe", "", true, true},
+		{"GET", "/api/v1/list?limit=50&cursor=YQ", `{"limit":50,"cursor":"YQ"}`, true, false},
+		{"GET", "/api/v1/list?limit=all", "", true, true},
+		{"GET", "/api/v1/list?include=metadata,values", `{"include":["metadata","values"]}`, true, false},
+		{"GET", "/api/v1/get?key=a&value=b", "", true, true},
+		{"GET", "/api/v1/get?key=logo.png&encoding=base64", `{"key":"logo.png","value":"","encoding":"base64"}`, true, false},
+		{"GET", "/api/v1/get?key=a&key=b", "", true, true},
+		{"GET", "/api/v1/watch?prefix=tasks%2F", `{"prefix":"tasks/"}`, true, false},
+		{"GET", "/api/v1/watch", `{}`, true, false},
+		{"GET", "/api/v1/watch?prefix=a&id=b", "", true, true},
+		{"GET", "/api/v1/watch?prefix=a&last_event_id=12", `{"prefix":"a","last_event_id":12}`, true, false},
+		{"GET", "/api/v1/watch?last_event_id=latest", "", true, true},
+		{"POST", "/api/v1/get?key=a", "", false, false},
+		{"GET", "/api/v1/put?key=a", "", false, false},
+	}
+	for _, tt := range tests {
+		body, read, err := queryReadBody(httptest.NewRequest(tt.method, tt.target, nil))
+		if read != tt.read || (err != nil) != tt.fails || string(body) != tt.body {
+			t.Errorf("%s %s = %s, %v, %v", tt.method, tt.target, body, read, err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// rateLimiter keeps a token bucket per key, refilled continuously at the configured rate
+type rateLimiter struct {
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket will have refilled completely
+	full time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// rateLimitResult is the outcome of taking a token, reported to clients in the
+// X-RateLimit-* headers
+type rateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket has refilled completely
+	Reset time.Duration
+	// RetryAfter is how long until the next token is available after a rejection
+	RetryAfter time.Duration
+}
+
+// allow takes a token from the bucket of the key, allowing perMinute requests per minute
+// with bursts of up to burst requests. When the bucket is empty it returns false and how
+// long until the next token is available.
+func (l *rateLimiter) allow(key string, perMinute, burst int) (bool, time.Duration) {
+	result := l.take(key, perMinute, burst)
+	return result.Allowed, result.RetryAfter
+}
+
+// take takes a token like allow and reports the state of the bucket afterwards
+func (l *rateLimiter) take(key string, perMinute, burst int) rateLimitResult {
+	if perMinute <= 0 {
+		return rateLimitResult{Allowed: true}
+	}
+	if burst <= 0 {
+		burst = perMinute
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(burst), updated: now}
+		l.buckets[key] = bucket
+	}
+
+	rate := float64(perMinute) / 60
+	bucket.tokens = math.Min(float64(burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*rate)
+	bucket.updated = now
+
+	result := rateLimitResult{Limit: perMinute}
+	if bucket.tokens < 1 {
+		result.RetryAfter = time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	} else {
+		result.Allowed = true
+		bucket.tokens--
+		bucket.full = now.Add(time.Duration((float64(burst) - bucket.tokens) / rate * float64(time.Second)))
+	}
+	result.Remaining = int(bucket.tokens)
+	result.Reset = time.Duration((float64(burst) - bucket.tokens) / rate * float64(time.Second))
+	return result
+}
+
+// prune drops the buckets that have refilled completely, which behave the same as a new
+// bucket, so idle keys do not accumulate
+func (l *rateLimiter) prune() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	for key, bucket := range l.buckets {
+		if now.After(bucket.full) {
+			delete(l.buckets, key)
+		}
+	}
+}
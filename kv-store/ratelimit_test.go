@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter()
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a", 60, 3); !ok {
+			t.Fatalf("request %d within the burst was rejected", i)
+		}
+	}
+	ok, wait := l.allow("a", 60, 3)
+	if ok {
+		t.Fatalf("request beyond the burst was allowed")
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Errorf("wait = %v, want up to one second at 60 requests per minute", wait)
+	}
+	if ok, _ := l.allow("b", 60, 3); !ok {
+		t.Errorf("keys must have separate buckets")
+	}
+	if ok, _ := l.allow("a", 0, 0); !ok {
+		t.Errorf("a limit of zero must not limit")
+	}
+
+	result := l.take("c", 60, 3)
+	if !result.Allowed || result.Limit != 60 || result.Remaining != 2 || result.Reset <= 0 || result.Reset > time.Second {
+		t.Errorf("take = %+v, want 2 remaining and a reset within a second", result)
+	}
+
+	l.buckets["a"].updated = time.Now().Add(-2 * time.Second)
+	if ok, _ := l.allow("a", 60, 3); !ok {
+		t.Errorf("bucket did not refill")
+	}
+
+	l.buckets["b"].full = time.Now().Add(-time.Second)
+	l.prune()
+	if _, ok := l.buckets["b"]; ok {
+		t.Errorf("full bucket was not pruned")
+	}
+	if _, ok := l.buckets["a"]; !ok {
+		t.Errorf("bucket that is not full was pruned")
+	}
+}
+
+func TestCheckRateLimit(t *testing.T) {
+	s := newTestServer()
+	s.tokenLimiter = newRateLimiter()
+	s.tokenRateLimit = 60
+	s.tokenRateBurst = 1
+	workspace := getWorkspacePrefix("ws1")
+	parent := mustMint(t, s, TokenClaims{ID: "parent", Workspace: workspace, Operations: []string{"get"}, Expires: time.Now().Add(time.Hour).Unix()})
+	child := mustMint(t, s, TokenClaims{ID: "child", Root: "parent", Workspace: workspace, Operations: []string{"get"}, Expires: time.Now().Add(time.Hour).Unix()})
+	other := mustMint(t, s, TokenClaims{ID: "other", Workspace: workspace, Operations: []string{"get"}, Expires: time.Now().Add(time.Hour).Unix(), RateLimit: 6000})
+
+	tests := []struct {
+		name  string
+		token string
+		want  bool
+	}{
+		{name: "first request", token: parent, want: true},
+		{name: "burst exhausted", token: parent, want: false},
+		{name: "delegated token shares the limit", token: child, want: false},
+		{name: "own limit", token: other, want: true},
+		{name: "no token", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/api/v1/get", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			r, _, err := s.authenticate(r)
+			if err != nil {
+				t.Fatalf("authenticate: %v", err)
+			}
+			w := httptest.NewRecorder()
+			if got := s.checkRateLimit(w, r); got != tt.want {
+				t.Fatalf("checkRateLimit = %v, want %v", got, tt.want)
+			}
+			if !tt.want && (w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "") {
+				t.Errorf("rejection must be a 429 with Retry-After, got %d %q", w.Code, w.Header().Get("Retry-After"))
+			}
+			if !tt.want {
+				var resp KVResponse
+				json.NewDecoder(w.Body).Decode(&resp)
+				if resp.Code != errCodeRateLimited {
+					t.Errorf("code = %q, want %q", resp.Code, errCodeRateLimited)
+				}
+			}
+			if tt.token != "" && w.Header().Get("X-RateLimit-Limit") == "" {
+				t.Errorf("rate limited requests must report X-RateLimit-Limit")
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverRequest answers a request whose handler panicked with a 500 response naming the
+// request ID, instead of dropping the connection, which clients such as GPTScript read as
+// an empty reply. The panic is logged with its stack and reported. Handlers abort with
+// http.ErrAbortHandler on purpose, so that panic is passed on.
+func (s *Server) recoverRequest(r *http.Request, rw *responseWriter, recovered any) {
+	if recovered == http.ErrAbortHandler {
+		panic(recovered)
+	}
+	stack := panicStacktrace()
+	logRequestf(r, "Panic serving %s: %v\n%s", r.URL.Path, recovered, debug.Stack())
+	s.reportPanic(r, recovered, stack)
+
+	// Once the response has started, the client can only tell from the truncated body
+	if rw.wroteHeader {
+		logRequestf(r, "Response: %d - panicked after the response started", rw.status)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(rw).Encode(KVResponse{Success: false, Error: "internal server error", Code: errCodeInternal})
+	logRequestf(r, "Response: %d - panic", http.StatusInternalServerError)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// maxReplayChanges limits the changes a single replay request redelivers. Larger replays
+// continue from the returned next_seq.
+const maxReplayChanges = 10000
+
+type ReplayRequest struct {
+	ID       string    `json:"id"`
+	FromSeq  uint64    `json:"from_seq,omitempty"`
+	FromTime time.Time `json:"from_time,omitempty"`
+}
+
+type ReplayResult struct {
+	Events  int    `json:"events"`
+	Changes int    `json:"changes"`
+	NextSeq uint64 `json:"next_seq"`
+	LastSeq uint64 `json:"last_seq"`
+}
+
+// changedKeys returns the keys of changes in the order they were first changed
+func changedKeys(changes []ChangeEvent) []string {
+	keys := make([]string, 0, len(changes))
+	for _, change := range changes {
+		if !slices.Contains(keys, change.Key) {
+			keys = append(keys, change.Key)
+		}
+	}
+	return keys
+}
+
+// handleWebhookReplay redelivers the changes of the workspace from a sequence or a point in
+// time to a registered webhook, so a receiver that was offline can catch up. Changes are
+// read from the bucket's stream and delivered in order as keys.changed events of up to
+// 1000 changes, with the same retries and dead letters as other events.
+func (s *Server) handleWebhookReplay(w http.ResponseWriter, r *http.Request) {
+	var req ReplayRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+	if req.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "id is required"})
+		return
+	}
+	if req.FromSeq == 0 {
+		req.FromSeq = 1
+	}
+
+	bucket, err := s.getWebhookBucket(getRequestPrefix(r))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	entry, err := bucket.Get(req.ID)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "webhook not found"})
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	var webhook Webhook
+	if err := json.Unmarshal(entry.Value(), &webhook); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	prefix := s.getDataPrefix(r, false)
+	if _, err := s.getBucket(prefix); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	// Read the changes up front so the response says how far the replay got, and only
+	// deliver changes to the keys the request is allowed to read
+	canRead := s.readFilter(r)
+	workspace, tool := splitDataPrefix(prefix)
+	result := ReplayResult{NextSeq: req.FromSeq}
+	var events []KeyEvent
+	fromSeq, fromTime := req.FromSeq, req.FromTime
+	for result.Changes < maxReplayChanges {
+		page, err := s.readChanges(prefix, fromSeq, fromTime, min(maxEventKeys, maxReplayChanges-result.Changes))
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		result.NextSeq, result.LastSeq = page.NextSeq, page.LastSeq
+		if len(page.Changes) == 0 {
+			break
+		}
+		changes := make([]ChangeEvent, 0, len(page.Changes))
+		for _, change := range page.Changes {
+			if canRead(change.Key) {
+				changes = append(changes, change)
+			}
+		}
+		result.Changes += len(page.Changes)
+		fromSeq, fromTime = page.NextSeq, time.Time{}
+		if len(changes) == 0 {
+			continue
+		}
+		events = append(events, KeyEvent{
+			ID:        uuid.New().String(),
+			Type:      webhookEventChanged,
+			Operation: "replay",
+			Time:      time.Now().UTC(),
+			Workspace: workspace,
+			Tool:      tool,
+			Reason:    "replay",
+			Keys:      changedKeys(changes),
+			Changes:   changes,
+		})
+	}
+	result.Events = len(events)
+
+	// Deliver the batches one after another so the receiver sees them in order
+	go func() {
+		for _, event := range events {
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			s.deliver(webhook, event, data)
+		}
+	}()
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: result})
+}
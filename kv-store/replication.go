@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// replicationDiscoveryInterval is how often peers are checked for new buckets to replicate
+const replicationDiscoveryInterval = 30 * time.Second
+
+// replicationPeer is another kv-store deployment whose buckets are replicated into this one.
+// Each deployment pulls from its peers, so configuring both sides replicates bidirectionally.
+type replicationPeer struct {
+	Region    string    `json:"region"`
+	URL       string    `json:"-"`
+	Connected bool      `json:"connected"`
+	Buckets   []string  `json:"buckets"`
+	Applied   int64     `json:"applied"`
+	Skipped   int64     `json:"skipped"`
+	LastError string    `json:"last_error,omitempty"`
+	LastApply time.Time `json:"last_apply,omitempty"`
+}
+
+// replicator pulls changes of the selected workspace buckets from peer deployments over
+// NATS, e.g. through a gateway or leafnode connection to the peer's embedded server.
+// Plain keys are resolved last-writer-wins by write time, and CRDT keys are merged.
+type replicator struct {
+	lock       sync.Mutex
+	region     string
+	peers      []*replicationPeer
+	workspaces []string
+}
+
+// parseReplicationPeers parses KV_REPLICATION_PEERS, a comma separated list of
+// region=nats-url pairs. The URLs carry the peer's KV_NATS_PASSWORD, e.g.
+// eu=nats://kv-store:<password>@eu-host:4223.
+func parseReplicationPeers(value string) ([]*replicationPeer, error) {
+	var peers []*replicationPeer
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		region, url, ok := strings.Cut(pair, "=")
+		if !ok || region == "" || url == "" {
+			return nil, fmt.Errorf("invalid KV_REPLICATION_PEERS entry %q, must be region=nats://host:port", pair)
+		}
+		peers = append(peers, &replicationPeer{Region: strings.TrimSpace(region), URL: strings.TrimSpace(url)})
+	}
+	return peers, nil
+}
+
+// newReplicator configures replication from the environment. It returns nil when no peers
+// are configured.
+func newReplicator(replicaID string) (*replicator, error) {
+	peers, err := parseReplicationPeers(getEnvOrDefault("KV_REPLICATION_PEERS", ""))
+	if err != nil || len(peers) == 0 {
+		return nil, err
+	}
+	r := &replicator{
+		region: getEnvOrDefault("KV_REGION", replicaID),
+		peers:  peers,
+	}
+	for _, workspace := range strings.Split(getEnvOrDefault("KV_REPLICATION_WORKSPACES", "*"), ",") {
+		if workspace = strings.TrimSpace(workspace); workspace == "*" {
+			r.workspaces = nil
+			break
+		} else if workspace != "" {
+			r.workspaces = append(r.workspaces, getWorkspacePrefix(workspace))
+		}
+	}
+	return r, nil
+}
+
+// replicates reports whether a bucket is replicated: the data buckets of the selected
+// workspaces, including their partitions, and the CRDT states kept alongside them
+func (r *replicator) replicates(name string) bool {
+	data := strings.TrimSuffix(name, "-crdt")
+	if !isDataBucket(data) {
+		return false
+	}
+	if r.workspaces == nil {
+		return true
+	}
+	workspace, _, _ := strings.Cut(data, "-tool-")
+	return slices.Contains(r.workspaces, workspace)
+}
+
+// startReplication starts pulling from every configured peer
+func (s *Server) startReplication() {
+	if s.replication == nil {
+		return
+	}
+	for _, peer := range s.replication.peers {
+		go s.runReplicationPeer(peer)
+	}
+}
+
+// updatePeer changes the status of a peer under the replicator lock
+func (r *replicator) updatePeer(peer *replicationPeer, update func(peer *replicationPeer)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	update(peer)
+}
+
+// runReplicationPeer connects to a peer and watches each of its replicated buckets,
+// picking up new buckets as they are created
+func (s *Server) runReplicationPeer(peer *replicationPeer) {
+	nc, err := nats.Connect(peer.URL,
+		nats.Name("kv-store-replication-"+s.replication.region),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ConnectHandler(func(*nats.Conn) {
+			s.replication.updatePeer(peer, func(p *replicationPeer) { p.Connected = true })
+		}),
+		nats.ReconnectHandler(func(*nats.Conn) {
+			s.replication.updatePeer(peer, func(p *replicationPeer) { p.Connected = true })
+		}),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			s.replication.updatePeer(peer, func(p *replicationPeer) {
+				p.Connected = false
+				if err != nil {
+					p.LastError = err.Error()
+				}
+			})
+		}),
+	)
+	if err != nil {
+		log.Printf("Replication from %s disabled: %v", peer.Region, err)
+		s.replication.updatePeer(peer, func(p *replicationPeer) { p.LastError = err.Error() })
+		return
+	}
+	s.replication.updatePeer(peer, func(p *replicationPeer) { p.Connected = nc.IsConnected() })
+
+	js, err := nc.JetStream()
+	if err != nil {
+		log.Printf("Replication from %s disabled: %v", peer.Region, err)
+		return
+	}
+
+	watched := map[string]bool{}
+	for {
+		for name := range js.KeyValueStoreNames() {
+			if watched[name] || !s.replication.replicates(name) {
+				continue
+			}
+			bucket, err := js.KeyValue(name)
+			if err != nil {
+				continue
+			}
+			if isDataBucket(name) {
+				bucket = &checksumBucket{KeyValue: bucket}
+			}
+			watched[name] = true
+			s.replication.updatePeer(peer, func(p *replicationPeer) { p.Buckets = append(p.Buckets, name) })
+			go s.watchReplicatedBucket(peer, bucket, name)
+		}
+		time.Sleep(replicationDiscoveryInterval)
+	}
+}
+
+// watchReplicatedBucket applies every change of a peer bucket, starting with its current
+// contents, until the watch fails and is restarted
+func (s *Server) watchReplicatedBucket(peer *replicationPeer, bucket nats.KeyValue, name string) {
+	for {
+		watcher, err := bucket.WatchAll()
+		if err != nil {
+			s.replication.updatePeer(peer, func(p *replicationPeer) { p.LastError = err.Error() })
+			time.Sleep(replicationDiscoveryInterval)
+			continue
+		}
+		for entry := range watcher.Updates() {
+			if entry == nil {
+				continue
+			}
+			// Revisions differ between regions, so values stored as changes are copied in full
+			if isDataBucket(name) && entry.Operation() == nats.KeyValuePut {
+				value, err := s.copyableValue(bucket, entry.Key(), entry.Revision(), entry.Value())
+				if err != nil {
+					s.replication.updatePeer(peer, func(p *replicationPeer) { p.LastError = fmt.Sprintf("%s/%s: %v", name, entry.Key(), err) })
+					continue
+				}
+				entry = &rebuiltEntry{KeyValueEntry: entry, value: value}
+			}
+			applied, err := s.applyReplicated(name, entry)
+			s.replication.updatePeer(peer, func(p *replicationPeer) {
+				switch {
+				case err != nil:
+					p.LastError = fmt.Sprintf("%s/%s: %v", name, entry.Key(), err)
+				case applied:
+					p.Applied++
+					p.LastApply = time.Now().UTC()
+				default:
+					p.Skipped++
+				}
+			})
+		}
+		watcher.Stop()
+		time.Sleep(time.Second)
+	}
+}
+
+// applyReplicated applies a change from a peer to the local bucket of the same name and
+// reports whether anything changed. CRDT states are merged, and plain keys take the
+// remote change only if it was made after the local value was written.
+func (s *Server) applyReplicated(name string, remote nats.KeyValueEntry) (bool, error) {
+	if data, ok := strings.CutSuffix(name, "-crdt"); ok {
+		return s.applyReplicatedCRDT(data, remote)
+	}
+
+	// Values are copied as stored, so encrypted values need the same keys on both sides
+	bucket, err := s.getRawBucket(name)
+	if err != nil {
+		return false, err
+	}
+	key := remote.Key()
+
+	for attempt := 0; attempt < incrMaxAttempts; attempt++ {
+		local, err := bucket.Get(key)
+		if err != nil && !errors.Is(err, nats.ErrKeyNotFound) {
+			return false, err
+		}
+
+		if remote.Operation() != nats.KeyValuePut {
+			if local == nil || local.Created().After(remote.Created()) {
+				return false, nil
+			}
+			err = bucket.Delete(key, nats.LastRevision(local.Revision()))
+		} else {
+			if local != nil && (bytes.Equal(local.Value(), remote.Value()) || local.Created().After(remote.Created())) {
+				return false, nil
+			}
+			if local == nil {
+				_, err = bucket.Create(key, remote.Value())
+			} else {
+				_, err = bucket.Update(key, remote.Value(), local.Revision())
+			}
+		}
+		if isRevisionConflict(err) {
+			continue
+		}
+		return err == nil, err
+	}
+	return false, fmt.Errorf("%s is changing too often", key)
+}
+
+// applyReplicatedCRDT merges a CRDT state from a peer into the local state and writes the
+// merged value
+func (s *Server) applyReplicatedCRDT(prefix string, remote nats.KeyValueEntry) (bool, error) {
+	if remote.Operation() != nats.KeyValuePut {
+		return false, nil
+	}
+	var state CRDTState
+	if err := json.Unmarshal(remote.Value(), &state); err != nil {
+		return false, err
+	}
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		return false, err
+	}
+	states, err := s.getCRDTBucket(prefix)
+	if err != nil {
+		return false, err
+	}
+
+	key := remote.Key()
+	lock := crdtLock(prefix, key)
+	lock.Lock()
+	defer lock.Unlock()
+
+	for attempt := 0; attempt < incrMaxAttempts; attempt++ {
+		current, revision, err := loadCRDTState(states, key)
+		if err != nil {
+			return false, err
+		}
+		if current == nil {
+			current = &CRDTState{Type: state.Type}
+		}
+		before, _ := json.Marshal(current)
+		if err := current.merge(&state); err != nil {
+			return false, err
+		}
+		data, err := json.Marshal(current)
+		if err != nil {
+			return false, err
+		}
+		if bytes.Equal(before, data) {
+			return false, nil
+		}
+		value, err := current.value()
+		if err != nil {
+			return false, err
+		}
+
+		if revision == 0 {
+			_, err = states.Create(key, data)
+		} else {
+			_, err = states.Update(key, data, revision)
+		}
+		if isRevisionConflict(err) {
+			continue
+		}
+		if err == nil {
+			_, err = bucket.Put(key, []byte(value))
+		}
+		return err == nil, err
+	}
+	return false, fmt.Errorf("%s is changing too often", key)
+}
+
+// handleReplicationStatus reports the replication state of every peer
+func (s *Server) handleReplicationStatus(w http.ResponseWriter, r *http.Request) {
+	if s.replication == nil {
+		json.NewEncoder(w).Encode(KVResponse{Success: true, Data: map[string]interface{}{"enabled": false}})
+		return
+	}
+
+	s.replication.lock.Lock()
+	peers := make([]replicationPeer, 0, len(s.replication.peers))
+	for _, peer := range s.replication.peers {
+		copied := *peer
+		copied.Buckets = slices.Clone(peer.Buckets)
+		peers = append(peers, copied)
+	}
+	s.replication.lock.Unlock()
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: map[string]interface{}{
+		"enabled": true,
+		"region":  s.replication.region,
+		"peers":   peers,
+	}})
+}
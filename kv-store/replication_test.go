@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestParseReplicationPeers(t *testing.T) {
+	peers, err := parseReplicationPeers(" us=nats://us:4223, eu=nats://user:pass@eu:4223 ,")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(peers) != 2 || peers[0].Region != "us" || peers[1].URL != "nats://user:pass@eu:4223" {
+		t.Errorf("unexpected peers %+v %+v", peers[0], peers[1])
+	}
+	for _, value := range []string{"nats://us:4223", "=nats://us:4223", "us="} {
+		if _, err := parseReplicationPeers(value); err == nil {
+			t.Errorf("%q should be rejected", value)
+		}
+	}
+}
+
+func TestReplicatorReplicates(t *testing.T) {
+	ws1, ws2 := getWorkspacePrefix("ws1"), getWorkspacePrefix("ws2")
+	selected := &replicator{workspaces: []string{ws1}}
+	everything := &replicator{}
+
+	tests := []struct {
+		bucket   string
+		selected bool
+		all      bool
+	}{
+		{bucket: ws1, selected: true, all: true},
+		{bucket: ws1 + "-crdt", selected: true, all: true},
+		{bucket: ws1 + "-tool-search", selected: true, all: true},
+		{bucket: ws1 + "-tool-search-crdt", selected: true, all: true},
+		{bucket: ws2, selected: false, all: true},
+		{bucket: ws1 + "-stats", selected: false, all: false},
+		{bucket: ws1 + "-acl", selected: false, all: false},
+		{bucket: "system-apikeys", selected: false, all: false},
+	}
+	for _, tt := range tests {
+		if got := selected.replicates(tt.bucket); got != tt.selected {
+			t.Errorf("selected workspaces: replicates(%s) = %v, want %v", tt.bucket, got, tt.selected)
+		}
+		if got := everything.replicates(tt.bucket); got != tt.all {
+			t.Errorf("all workspaces: replicates(%s) = %v, want %v", tt.bucket, got, tt.all)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// requestIDHeader carries the ID of a request, from the client if it sends one, in the
+// response and in the headers of the events the request publishes
+const requestIDHeader = "X-Request-ID"
+
+const requestIDContextKey contextKey = "request-id"
+
+// requestIDPattern is what client request IDs may look like. Others are replaced, so they
+// can't forge log lines or headers.
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:/+=-]{1,128}$`)
+
+// withRequestID returns the request with its ID, taken from X-Request-ID or generated
+func withRequestID(r *http.Request) (*http.Request, string) {
+	id := r.Header.Get(requestIDHeader)
+	if !requestIDPattern.MatchString(id) {
+		id = uuid.New().String()
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestIDContextKey, id)), id
+}
+
+// getRequestID returns the ID of a request, or an empty string outside of one
+func getRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// logRequestf logs a line about a request, prefixed with its ID
+func logRequestf(r *http.Request, format string, v ...any) {
+	log.Printf("[%s] %s", getRequestID(r), fmt.Sprintf(format, v...))
+}
+
+// newRequestMsg returns a message to publish for a request, carrying its ID
+func newRequestMsg(r *http.Request, subject string, data []byte) *nats.Msg {
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	if id := getRequestID(r); id != "" {
+		msg.Header.Set(requestIDHeader, id)
+	}
+	return msg
+}
+
+// errorResponsePrefix starts the JSON body of every failed KVResponse
+var errorResponsePrefix = []byte(`{"success":false`)
+
+// addRequestID adds the request ID to the JSON body of an error response, so clients that
+// only keep the body can still quote it
+func (rw *responseWriter) addRequestID(b []byte) []byte {
+	if rw.requestID == "" || rw.status < http.StatusBadRequest || rw.written > 0 || !bytes.HasPrefix(b, errorResponsePrefix) {
+		return b
+	}
+	return append(fmt.Appendf(nil, `{"request_id":%q,`, rw.requestID), b[1:]...)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithRequestID(t *testing.T) {
+	r := httptest.NewRequest("POST", "/api/v1/get", nil)
+	r.Header.Set(requestIDHeader, "step-42")
+	r, id := withRequestID(r)
+	if id != "step-42" || getRequestID(r) != "step-42" {
+		t.Errorf("client request ID was not kept, got %q", id)
+	}
+
+	if msg := newRequestMsg(r, "kv.events.ws", nil); msg.Header.Get(requestIDHeader) != "step-42" {
+		t.Errorf("event headers %v don't carry the request ID", msg.Header)
+	}
+
+	r.Header.Set(requestIDHeader, "forged\nline")
+	if _, id := withRequestID(r); id == "forged\nline" || id == "" {
+		t.Errorf("invalid request ID %q should be replaced", id)
+	}
+}
+
+func TestErrorResponseRequestID(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rw := &responseWriter{ResponseWriter: rec, status: http.StatusOK, body: new(bytes.Buffer), requestID: "abc"}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusNotFound)
+	json.NewEncoder(rw).Encode(KVResponse{Success: false, Error: "not found"})
+
+	var resp struct {
+		KVResponse
+		RequestID string `json:"request_id"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.RequestID != "abc" || resp.Error != "not found" {
+		t.Errorf("unexpected response %s", rec.Body.String())
+	}
+
+	// Successful responses are left as they are
+	rec = httptest.NewRecorder()
+	rw = &responseWriter{ResponseWriter: rec, status: http.StatusOK, body: new(bytes.Buffer), requestID: "abc"}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(KVResponse{Success: true})
+	if bytes.Contains(rec.Body.Bytes(), []byte("abc")) {
+		t.Errorf("request ID added to a successful response %s", rec.Body.String())
+	}
+}
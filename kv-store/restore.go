@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/nats-io/nats.go"
+)
+
+type RestoreRequest struct {
+	Name   string       `json:"name"`
+	Mode   string       `json:"mode,omitempty"`
+	DryRun flexibleBool `json:"dry_run,omitempty"`
+}
+
+type RestoreResult struct {
+	Mode      string   `json:"mode"`
+	DryRun    bool     `json:"dry_run"`
+	Added     []string `json:"added"`
+	Updated   []string `json:"updated"`
+	Deleted   []string `json:"deleted"`
+	Unchanged int      `json:"unchanged"`
+}
+
+// planRestore works out the changes that restoring an archive into a bucket would make. In
+// replace mode keys missing from the archive are deleted, in merge mode they are kept.
+func planRestore(bucket nats.KeyValue, archive *Archive, mode string) (*RestoreResult, error) {
+	current, err := readArchiveEntries(bucket)
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string][]byte, len(current.Entries))
+	for _, entry := range current.Entries {
+		existing[entry.Key] = entry.Value
+	}
+
+	result := &RestoreResult{
+		Mode:    mode,
+		DryRun:  true,
+		Added:   make([]string, 0),
+		Updated: make([]string, 0),
+		Deleted: make([]string, 0),
+	}
+
+	restored := make(map[string]bool, len(archive.Entries))
+	for _, entry := range archive.Entries {
+		restored[entry.Key] = true
+		value, ok := existing[entry.Key]
+		switch {
+		case !ok:
+			result.Added = append(result.Added, entry.Key)
+		case !bytes.Equal(value, entry.Value):
+			result.Updated = append(result.Updated, entry.Key)
+		default:
+			result.Unchanged++
+		}
+	}
+
+	if mode == "replace" {
+		for key := range existing {
+			if !restored[key] {
+				result.Deleted = append(result.Deleted, key)
+			}
+		}
+		sort.Strings(result.Deleted)
+	}
+
+	return result, nil
+}
+
+// applyRestore writes exactly the changes of a plan made by planRestore, so keys created
+// after the plan was checked are never touched
+func applyRestore(bucket nats.KeyValue, archive *Archive, plan *RestoreResult) error {
+	values := make(map[string][]byte, len(archive.Entries))
+	for _, entry := range archive.Entries {
+		values[entry.Key] = entry.Value
+	}
+	for _, key := range append(plan.Added, plan.Updated...) {
+		if _, err := bucket.Put(key, values[key]); err != nil {
+			return fmt.Errorf("failed to restore %s: %v", key, err)
+		}
+	}
+	for _, key := range plan.Deleted {
+		if err := bucket.Delete(key); err != nil {
+			return fmt.Errorf("failed to delete %s: %v", key, err)
+		}
+	}
+	plan.DryRun = false
+	return nil
+}
+
+func (s *Server) handleSnapshotRestore(w http.ResponseWriter, r *http.Request) {
+	var req RestoreRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+
+	if req.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "name is required"})
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = "replace"
+	}
+	if req.Mode != "replace" && req.Mode != "merge" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "mode must be replace or merge"})
+		return
+	}
+	if !s.checkKeyAccess(w, r, snapshotObject(req.Name), permRead) {
+		return
+	}
+
+	// Get the stores for this request
+	prefix := s.getDataPrefix(r, false)
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	store, err := s.getObjectStore(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	object, err := store.Get(snapshotObject(req.Name))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("snapshot %s: %v", req.Name, err)})
+		return
+	}
+	defer object.Close()
+
+	archive, err := decodeArchive(object)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	// Work out the changes first so ACLs can be checked for every affected key, then apply
+	// that same plan
+	result, err := planRestore(bucket, archive, req.Mode)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	for _, key := range append(result.Added, result.Updated...) {
+		if !s.checkKeyAccess(w, r, key, permWrite) {
+			return
+		}
+	}
+	for _, key := range result.Deleted {
+		if !s.checkKeyAccess(w, r, key, permDelete) {
+			return
+		}
+	}
+	if req.DryRun {
+		json.NewEncoder(w).Encode(KVResponse{Success: true, Data: result})
+		return
+	}
+
+	if err := applyRestore(bucket, archive, result); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: result})
+}
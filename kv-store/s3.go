@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty request body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// awsCredentials are the credentials requests to AWS APIs are signed with
+type awsCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// getAWSCredentials reads AWS credentials from the standard environment variables
+func getAWSCredentials() (awsCredentials, error) {
+	creds := awsCredentials{
+		AccessKeyID:     getEnvOrDefault("AWS_ACCESS_KEY_ID", ""),
+		SecretAccessKey: getEnvOrDefault("AWS_SECRET_ACCESS_KEY", ""),
+		SessionToken:    getEnvOrDefault("AWS_SESSION_TOKEN", ""),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return creds, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+	return creds, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsURIEncode encodes a string the way SigV4 canonical requests expect
+func awsURIEncode(value string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(value) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// signAWSRequest signs a request with AWS Signature Version 4. Every header set on the
+// request is signed, along with the host.
+func signAWSRequest(req *http.Request, payloadHash, service, region string, creds awsCredentials, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			params = append(params, awsURIEncode(key, true)+"="+awsURIEncode(value, true))
+		}
+	}
+
+	path := req.URL.EscapedPath()
+	if unescaped, err := url.PathUnescape(path); err == nil {
+		path = awsURIEncode(unescaped, false)
+	}
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Join(params, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// s3Client is a minimal S3 client for storing backups. It supports AWS and S3 compatible
+// services such as MinIO, which are addressed with path-style URLs.
+type s3Client struct {
+	bucket   string
+	region   string
+	endpoint string
+	creds    awsCredentials
+	client   *http.Client
+}
+
+// newS3Client creates a client for the bucket. The endpoint comes from AWS_ENDPOINT_URL_S3
+// or AWS_ENDPOINT_URL for S3 compatible services.
+func newS3Client(bucket string) (*s3Client, error) {
+	creds, err := getAWSCredentials()
+	if err != nil {
+		return nil, err
+	}
+	region := getEnvOrDefault("AWS_REGION", getEnvOrDefault("AWS_DEFAULT_REGION", "us-east-1"))
+	endpoint := getEnvOrDefault("AWS_ENDPOINT_URL_S3", getEnvOrDefault("AWS_ENDPOINT_URL", ""))
+	return &s3Client{
+		bucket:   bucket,
+		region:   region,
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		creds:    creds,
+		client:   &http.Client{Timeout: 30 * time.Minute},
+	}, nil
+}
+
+// objectURL returns the URL of an object key, or of the bucket for an empty key
+func (c *s3Client) objectURL(key string) string {
+	if c.endpoint != "" {
+		return c.endpoint + "/" + c.bucket + "/" + awsURIEncode(key, false)
+	}
+	return "https://" + c.bucket + ".s3." + c.region + ".amazonaws.com/" + awsURIEncode(key, false)
+}
+
+// do signs and sends a request, returning an error for non-2xx responses
+func (c *s3Client) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	signAWSRequest(req, payloadHash, "s3", c.region, c.creds, time.Now())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("S3 %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// put uploads an object of a known size
+func (c *s3Client) put(key string, body io.Reader, size int64) error {
+	req, err := http.NewRequest(http.MethodPut, c.objectURL(key), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	resp, err := c.do(req, "UNSIGNED-PAYLOAD")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// get downloads an object
+func (c *s3Client) get(key string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, c.objectURL(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// delete removes an object
+func (c *s3Client) delete(key string) error {
+	req, err := http.NewRequest(http.MethodDelete, c.objectURL(key), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(req, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// list returns the keys of all objects starting with prefix
+func (c *s3Client) list(prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := http.NewRequest(http.MethodGet, c.objectURL("")+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.do(req, emptyPayloadHash)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3 list response: %v", err)
+		}
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
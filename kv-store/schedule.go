@@ -0,0 +1,508 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// scheduleBucket is the system bucket holding the pending scheduled operations of every
+// workspace, keyed by <workspace>.<id>
+const scheduleBucket = "system-scheduled"
+
+// maxScheduledOperations limits the operations a workspace can have pending
+const maxScheduledOperations = 1000
+
+// ScheduledOperation is a put or delete that runs at a later time. The bucket is resolved
+// when the operation is scheduled, so it runs against the same namespace or partition, and
+// it is checked against the ACLs again when it runs.
+type ScheduledOperation struct {
+	ID        string      `json:"id"`
+	Operation string      `json:"operation"`
+	Key       string      `json:"key"`
+	Value     string      `json:"value,omitempty"`
+	RunAt     time.Time   `json:"run_at"`
+	Created   time.Time   `json:"created"`
+	Reason    string      `json:"reason,omitempty"`
+	Bucket    string      `json:"-"`
+	Scope     accessScope `json:"-"`
+}
+
+// storedOperation is a scheduled operation as it is kept in the schedule bucket. Values are
+// encrypted like the values of data buckets.
+type storedOperation struct {
+	ScheduledOperation
+	StoredValue []byte      `json:"stored_value,omitempty"`
+	StoredIn    string      `json:"bucket"`
+	StoredScope accessScope `json:"scope"`
+}
+
+type ScheduleRequest struct {
+	ID        string `json:"id,omitempty"`
+	Operation string `json:"operation,omitempty"`
+	Key       string `json:"key,omitempty"`
+	Value     string `json:"value,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	// At is an RFC 3339 time, Delay a duration such as 30m or a number of seconds
+	At    string `json:"at,omitempty"`
+	Delay string `json:"delay,omitempty"`
+}
+
+// getScheduleBucket gets the bucket holding the scheduled operations
+func (s *Server) getScheduleBucket() (nats.KeyValue, error) {
+	return s.getBucket(scheduleBucket)
+}
+
+// parseRunAt returns when a scheduled operation runs, from an absolute time or a delay
+func parseRunAt(at, delay string, now time.Time) (time.Time, error) {
+	switch {
+	case at != "" && delay != "":
+		return time.Time{}, fmt.Errorf("at and delay can't be combined")
+	case at != "":
+		runAt, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("at must be an RFC 3339 time")
+		}
+		return runAt.UTC(), nil
+	case delay != "":
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			seconds, serr := strconv.Atoi(delay)
+			if serr != nil {
+				return time.Time{}, fmt.Errorf("delay must be a duration such as 30m or a number of seconds")
+			}
+			d = time.Duration(seconds) * time.Second
+		}
+		if d < 0 {
+			return time.Time{}, fmt.Errorf("delay can't be negative")
+		}
+		return now.Add(d).UTC(), nil
+	default:
+		return time.Time{}, fmt.Errorf("at or delay is required")
+	}
+}
+
+// scheduleOperation stores an operation to run later and returns it
+func (s *Server) scheduleOperation(workspace string, op ScheduledOperation) (ScheduledOperation, error) {
+	bucket, err := s.getScheduleBucket()
+	if err != nil {
+		return op, err
+	}
+	pending, err := s.listScheduled(workspace)
+	if err != nil {
+		return op, err
+	}
+	if len(pending) >= maxScheduledOperations {
+		return op, fmt.Errorf("a workspace can have at most %d scheduled operations", maxScheduledOperations)
+	}
+
+	op.ID = uuid.New().String()
+	op.Created = time.Now().UTC()
+	stored := storedOperation{ScheduledOperation: op, StoredIn: op.Bucket, StoredScope: op.Scope}
+	stored.Value = ""
+	if op.Operation == "put" {
+		stored.StoredValue = []byte(op.Value)
+		if s.encryption != nil {
+			if stored.StoredValue, err = s.encryption.encrypt(stored.StoredValue); err != nil {
+				return op, err
+			}
+		}
+	}
+	value, err := json.Marshal(stored)
+	if err != nil {
+		return op, err
+	}
+	if _, err := bucket.Put(workspace+"."+op.ID, value); err != nil {
+		return op, err
+	}
+	return op, nil
+}
+
+// decodeScheduled reads a scheduled operation from the schedule bucket
+func (s *Server) decodeScheduled(data []byte) (ScheduledOperation, error) {
+	var stored storedOperation
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return ScheduledOperation{}, err
+	}
+	op := stored.ScheduledOperation
+	op.Bucket, op.Scope = stored.StoredIn, stored.StoredScope
+	if op.Operation == "put" {
+		value := stored.StoredValue
+		if s.encryption != nil {
+			var err error
+			if value, err = s.encryption.decrypt(value); err != nil {
+				return op, err
+			}
+		}
+		op.Value = string(value)
+	}
+	return op, nil
+}
+
+// listScheduled returns the pending operations of a workspace, the next to run first
+func (s *Server) listScheduled(workspace string) ([]ScheduledOperation, error) {
+	bucket, err := s.getScheduleBucket()
+	if err != nil {
+		return nil, err
+	}
+	ops := make([]ScheduledOperation, 0)
+	err = scanBucket(bucket, func(entry nats.KeyValueEntry) {
+		if !strings.HasPrefix(entry.Key(), workspace+".") {
+			return
+		}
+		op, err := s.decodeScheduled(entry.Value())
+		if err != nil {
+			log.Printf("Skipping invalid scheduled operation %s: %v", entry.Key(), err)
+			return
+		}
+		ops = append(ops, op)
+	})
+	sort.Slice(ops, func(i, j int) bool { return ops[i].RunAt.Before(ops[j].RunAt) })
+	return ops, err
+}
+
+// cancelScheduled removes the pending operations of a workspace with an ID, or on a key
+// in a bucket, optionally only those scheduled for a reason, and returns the operations
+// removed
+func (s *Server) cancelScheduled(workspace, id, bucketName, key, reason string) ([]ScheduledOperation, error) {
+	ops, err := s.listScheduled(workspace)
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := s.getScheduleBucket()
+	if err != nil {
+		return nil, err
+	}
+	canceled := make([]ScheduledOperation, 0)
+	for _, op := range ops {
+		if (id != "" && op.ID != id) || (id == "" && (op.Bucket != bucketName || op.Key != key)) || (reason != "" && op.Reason != reason) {
+			continue
+		}
+		if err := bucket.Purge(workspace + "." + op.ID); err != nil {
+			return canceled, err
+		}
+		canceled = append(canceled, op)
+	}
+	return canceled, nil
+}
+
+// runScheduled runs the operations that are due. Each operation is claimed by removing it
+// before it runs, so an operation canceled in the meantime doesn't run, and when several
+// instances share the store only one of them runs it.
+func (s *Server) runScheduled(now time.Time) {
+	bucket, err := s.getScheduleBucket()
+	if err != nil {
+		log.Printf("Failed to open the scheduled operations: %v", err)
+		return
+	}
+	var due []nats.KeyValueEntry
+	err = scanBucket(bucket, func(entry nats.KeyValueEntry) {
+		var stored storedOperation
+		if json.Unmarshal(entry.Value(), &stored) == nil && !stored.RunAt.After(now) {
+			due = append(due, entry)
+		}
+	})
+	if err != nil {
+		log.Printf("Failed to read the scheduled operations: %v", err)
+		return
+	}
+
+	for _, entry := range due {
+		if err := bucket.Delete(entry.Key(), nats.LastRevision(entry.Revision())); err != nil {
+			if !isRevisionConflict(err) {
+				log.Printf("Failed to claim scheduled operation %s: %v", entry.Key(), err)
+			}
+			continue
+		}
+		op, err := s.decodeScheduled(entry.Value())
+		if err == nil {
+			err = s.runOperation(op)
+		}
+		if err != nil {
+			log.Printf("Scheduled %s of %s failed: %v", op.Operation, op.Key, err)
+		}
+	}
+}
+
+// runOperation applies a scheduled operation with the access of the request that scheduled it
+func (s *Server) runOperation(op ScheduledOperation) error {
+	perm := permWrite
+	if op.Operation == "delete" {
+		perm = permDelete
+	}
+	if ok, err := s.scopeAllowed(op.Scope, op.Key, perm); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("%s access to key %s is no longer allowed", perm, op.Key)
+	}
+
+	bucket, err := s.getBucket(op.Bucket)
+	if err != nil {
+		return err
+	}
+	if op.Operation == "delete" {
+		if err := bucket.Delete(op.Key); err != nil {
+			return err
+		}
+		s.deleteKeyStats(op.Bucket, op.Key)
+		return nil
+	}
+	if _, err := bucket.Put(op.Key, []byte(op.Value)); err != nil {
+		return err
+	}
+	s.access.record(op.Bucket, op.Key, true)
+	return nil
+}
+
+// runScheduler runs due operations every KV_SCHEDULE_INTERVAL
+func (s *Server) runScheduler() {
+	ticker := time.NewTicker(s.scheduleInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.runScheduled(now)
+	}
+}
+
+// handleSchedule schedules a put or delete of a key to run at a time or after a delay
+func (s *Server) handleSchedule(w http.ResponseWriter, r *http.Request) {
+	var req ScheduleRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+	if req.Key == "" || (req.Operation != "put" && req.Operation != "delete") {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "key and an operation of put or delete are required"})
+		return
+	}
+	if req.Operation == "put" && req.Value == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "value is required"})
+		return
+	}
+	runAt, err := parseRunAt(req.At, req.Delay, time.Now())
+	if err == nil && runAt.After(time.Now().Add(s.scheduleMaxDelay)) {
+		err = fmt.Errorf("operations can be scheduled at most %s ahead", s.scheduleMaxDelay)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	perm := permWrite
+	if req.Operation == "delete" {
+		perm = permDelete
+		if claims := getClaims(r); claims != nil && !claims.allows("delete") {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "token does not allow delete"})
+			return
+		}
+	}
+	if !s.checkKeyAccess(w, r, req.Key, perm) {
+		return
+	}
+	prefix, ok := s.getWritePrefix(w, r, req.Scope)
+	if !ok {
+		return
+	}
+	value := req.Value
+	if req.Operation == "put" {
+		if value, ok = s.checkPII(w, r, req.Key, req.Value); !ok {
+			return
+		}
+	}
+
+	op, err := s.scheduleOperation(getRequestPrefix(r), ScheduledOperation{
+		Operation: req.Operation,
+		Key:       req.Key,
+		Value:     value,
+		RunAt:     runAt,
+		Bucket:    prefix,
+		Scope:     getAccessScope(r),
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: op})
+}
+
+// handleScheduleList lists the pending operations of the workspace, optionally on one key
+func (s *Server) handleScheduleList(w http.ResponseWriter, r *http.Request) {
+	var req ScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	ops, err := s.listScheduled(getRequestPrefix(r))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	canRead := s.readFilter(r)
+	visible := make([]ScheduledOperation, 0, len(ops))
+	for _, op := range ops {
+		if (req.Key == "" || op.Key == req.Key) && canRead(op.Key) {
+			visible = append(visible, op)
+		}
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: visible})
+}
+
+// handleScheduleCancel cancels a pending operation by ID, or every pending operation on a key
+func (s *Server) handleScheduleCancel(w http.ResponseWriter, r *http.Request) {
+	var req ScheduleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+	if req.ID == "" && req.Key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "id or key is required"})
+		return
+	}
+
+	workspace := getRequestPrefix(r)
+	var prefix string
+	if req.ID != "" {
+		ops, err := s.listScheduled(workspace)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		found := false
+		for _, op := range ops {
+			if op.ID == req.ID {
+				found, req.Key = true, op.Key
+			}
+		}
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "scheduled operation not found"})
+			return
+		}
+	} else {
+		var ok bool
+		if prefix, ok = s.getWritePrefix(w, r, req.Scope); !ok {
+			return
+		}
+	}
+	if !s.checkKeyAccess(w, r, req.Key, permWrite) {
+		return
+	}
+
+	canceled, err := s.cancelScheduled(workspace, req.ID, prefix, req.Key, "")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: canceled})
+}
+
+// graceDelete is the reason of the scheduled deletes of grace-period deletes
+const graceDelete = "grace"
+
+// scheduleGraceDelete marks a key for deletion after a grace period instead of deleting it
+// right away, so a parallel step that still needs it can cancel the delete. Deleting a key
+// that is already marked keeps the earlier deadline.
+func (s *Server) scheduleGraceDelete(w http.ResponseWriter, r *http.Request, prefix, key, grace string) {
+	runAt, err := parseRunAt("", grace, time.Now())
+	if err == nil && runAt.After(time.Now().Add(s.scheduleMaxDelay)) {
+		err = fmt.Errorf("the grace period can be at most %s", s.scheduleMaxDelay)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: strings.Replace(err.Error(), "delay", "grace", 1)})
+		return
+	}
+
+	workspace := getRequestPrefix(r)
+	ops, err := s.listScheduled(workspace)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	for _, op := range ops {
+		if op.Reason == graceDelete && op.Bucket == prefix && op.Key == key {
+			json.NewEncoder(w).Encode(KVResponse{Success: true, Data: op})
+			return
+		}
+	}
+
+	op, err := s.scheduleOperation(workspace, ScheduledOperation{
+		Operation: "delete",
+		Key:       key,
+		RunAt:     runAt,
+		Reason:    graceDelete,
+		Bucket:    prefix,
+		Scope:     getAccessScope(r),
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: op})
+}
+
+// handleDeleteCancel cancels the pending grace-period delete of a key
+func (s *Server) handleDeleteCancel(w http.ResponseWriter, r *http.Request) {
+	var req KVRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+	if req.Key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "key is required"})
+		return
+	}
+	if !s.checkKeyAccess(w, r, req.Key, permWrite) {
+		return
+	}
+	prefix, ok := s.getWritePrefix(w, r, req.Scope)
+	if !ok {
+		return
+	}
+
+	canceled, err := s.cancelScheduled(getRequestPrefix(r), "", prefix, req.Key, graceDelete)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if len(canceled) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "key is not pending deletion"})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: canceled[0]})
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRunAt(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		at, delay string
+		want      time.Time
+	}{
+		{"2026-03-02T09:00:00+01:00", "", time.Date(2026, 3, 2, 8, 0, 0, 0, time.UTC)},
+		{"", "24h", now.Add(24 * time.Hour)},
+		{"", "90", now.Add(90 * time.Second)},
+	}
+	for _, test := range tests {
+		if got, err := parseRunAt(test.at, test.delay, now); err != nil || !got.Equal(test.want) {
+			t.Errorf("parseRunAt(%q, %q) = %s, %v, want %s", test.at, test.delay, got, err, test.want)
+		}
+	}
+	for _, invalid := range [][2]string{{"", ""}, {"tomorrow", ""}, {"", "soon"}, {"", "-5m"}, {"2026-03-02T09:00:00Z", "1h"}} {
+		if _, err := parseRunAt(invalid[0], invalid[1], now); err == nil {
+			t.Errorf("parseRunAt(%q, %q) should fail", invalid[0], invalid[1])
+		}
+	}
+}
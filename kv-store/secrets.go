@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Ways of handling tool outputs that contain secrets
+const (
+	secretsOff    = "off"
+	secretsRedact = "redact"
+	secretsReject = "reject"
+)
+
+// namedPattern is a regular expression recognizing one kind of sensitive value
+type namedPattern struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// builtinSecretPatterns recognize credentials that tools commonly echo in their output
+var builtinSecretPatterns = []namedPattern{
+	{"private-key", regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`)},
+	{"aws-access-key", regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"aws-secret-key", regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?[A-Za-z0-9/+=]{40}`)},
+	{"bearer-token", regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9\-._~+/]{16,}=*`)},
+	{"github-token", regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{22,})\b`)},
+	{"slack-token", regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`)},
+}
+
+// secretScanner finds credentials in tool outputs before they are stored, and either
+// redacts them or refuses to store the output
+type secretScanner struct {
+	mode     string
+	patterns []namedPattern
+}
+
+// newSecretScanner configures scanning from KV_SECRET_REDACTION (off, redact or reject) and
+// KV_SECRET_PATTERNS, extra regular expressions one per line. It returns nil when outputs
+// are stored verbatim.
+func newSecretScanner() (*secretScanner, error) {
+	mode := getEnvOrDefault("KV_SECRET_REDACTION", secretsOff)
+	if mode != secretsOff && mode != secretsRedact && mode != secretsReject {
+		return nil, fmt.Errorf("invalid KV_SECRET_REDACTION %q, must be off, redact or reject", mode)
+	}
+	patterns := slices.Clone(builtinSecretPatterns)
+	for i, line := range strings.Split(getEnvOrDefault("KV_SECRET_PATTERNS", ""), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		re, err := regexp.Compile(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KV_SECRET_PATTERNS: %v", err)
+		}
+		patterns = append(patterns, namedPattern{name: fmt.Sprintf("custom-%d", i+1), re: re})
+	}
+	if mode == secretsOff {
+		return nil, nil
+	}
+	return &secretScanner{mode: mode, patterns: patterns}, nil
+}
+
+// redactPatterns replaces every match of the patterns with a marker naming what was
+// removed, and returns the names of the patterns that matched
+func redactPatterns(patterns []namedPattern, value string) (string, []string) {
+	var found []string
+	for _, pattern := range patterns {
+		replaced := pattern.re.ReplaceAllLiteralString(value, "[REDACTED:"+pattern.name+"]")
+		if replaced != value {
+			found = append(found, pattern.name)
+			value = replaced
+		}
+	}
+	return value, found
+}
+
+// scan returns the output to store and the kinds of secrets found in it, or an error when
+// outputs with secrets are rejected
+func (s *secretScanner) scan(output string) (string, []string, error) {
+	if s == nil {
+		return output, nil, nil
+	}
+	redacted, found := redactPatterns(s.patterns, output)
+	if len(found) > 0 && s.mode == secretsReject {
+		return "", found, fmt.Errorf("output contains secrets (%s) and was not stored", strings.Join(found, ", "))
+	}
+	return redacted, found, nil
+}
+
+// loggedBody returns a request body as it may be logged. Secrets kept out of stored outputs
+// and PII kept out of workspaces that mask or reject it are not written to the log either.
+func (s *Server) loggedBody(r *http.Request, body []byte) string {
+	logged := string(body)
+	if r.URL.Path == "/api/v1/output-filter" && s.secrets != nil {
+		logged, _ = redactPatterns(s.secrets.patterns, logged)
+	}
+	if s.pii != nil && !strings.HasPrefix(r.URL.Path, "/api/admin/") {
+		if policy, err := s.getPIIPolicy(getRequestPrefix(r)); err != nil || (policy.Mode != piiOff && policy.Mode != piiFlag) {
+			logged, _ = redactPatterns(builtinPIIPatterns, logged)
+		}
+	}
+	return logged
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// shardsBucket records which workspaces are sharded and over how many buckets
+const shardsBucket = "system-shards"
+
+// shardPropagationDelay is how long a migration waits after announcing itself, so every
+// instance sharing the store routes writes to the shards before keys start moving
+const shardPropagationDelay = 5 * time.Second
+
+// shardBucketName matches the extra buckets a sharded workspace spreads its keys over. The
+// workspace bucket itself is the first shard.
+var shardBucketName = regexp.MustCompile(`^[^-]+-shard-[0-9]+$`)
+
+// isShardBucket reports whether a bucket holds keys of a sharded workspace beyond its first
+// shard
+func isShardBucket(name string) bool {
+	return shardBucketName.MatchString(name)
+}
+
+// shardName returns the bucket of a shard of a workspace
+func shardName(prefix string, shard int) string {
+	if shard == 0 {
+		return prefix
+	}
+	return fmt.Sprintf("%s-shard-%d", prefix, shard)
+}
+
+// shardOf returns the shard a key is stored in
+func shardOf(key string, shards int) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(shards))
+}
+
+// ShardState is how a workspace is spread over shards. While it is migrating, keys that
+// haven't moved to their shard yet are still read from the workspace bucket.
+type ShardState struct {
+	Shards    int       `json:"shards"`
+	Migrating bool      `json:"migrating,omitempty"`
+	Keys      uint64    `json:"keys"`
+	Moved     int       `json:"moved"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished,omitempty"`
+}
+
+// sharding spreads the keys of workspaces with more keys than the threshold over several
+// buckets, so a single stream doesn't hold them all
+type sharding struct {
+	threshold uint64
+	shards    int
+	interval  time.Duration
+
+	lock   sync.RWMutex
+	states map[string]ShardState
+}
+
+// newSharding reads KV_SHARD_THRESHOLD, the key count above which a workspace is sharded (0
+// never shards), KV_SHARD_COUNT, the buckets it is spread over, and KV_SHARD_CHECK_INTERVAL,
+// how often key counts are checked. Workspaces sharded before stay sharded either way.
+func newSharding() (*sharding, error) {
+	threshold, err := strconv.ParseUint(getEnvOrDefault("KV_SHARD_THRESHOLD", "0"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid KV_SHARD_THRESHOLD: must be a number of keys")
+	}
+	shards, err := strconv.Atoi(getEnvOrDefault("KV_SHARD_COUNT", "8"))
+	if err != nil || shards < 2 || shards > 256 {
+		return nil, fmt.Errorf("invalid KV_SHARD_COUNT: must be between 2 and 256")
+	}
+	interval, err := time.ParseDuration(getEnvOrDefault("KV_SHARD_CHECK_INTERVAL", "5m"))
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid KV_SHARD_CHECK_INTERVAL: must be a positive duration")
+	}
+	return &sharding{threshold: threshold, shards: shards, interval: interval, states: map[string]ShardState{}}, nil
+}
+
+func (sh *sharding) state(prefix string) (ShardState, bool) {
+	sh.lock.RLock()
+	defer sh.lock.RUnlock()
+	state, ok := sh.states[prefix]
+	return state, ok
+}
+
+// setShardState applies the shard layout of a workspace. The local copy of its keys watches
+// the buckets of the previous layout, so it starts over.
+func (s *Server) setShardState(prefix string, state ShardState) {
+	s.shards.lock.Lock()
+	s.shards.states[prefix] = state
+	s.shards.lock.Unlock()
+	s.dropCachedBucket(prefix)
+}
+
+// watchShards loads the shard layout of every workspace and keeps it current as workspaces
+// are sharded, here or by another instance sharing the store
+func (s *Server) watchShards() error {
+	bucket, err := s.getBucket(shardsBucket)
+	if err != nil {
+		return err
+	}
+	watcher, err := bucket.WatchAll()
+	if err != nil {
+		return err
+	}
+	synced := make(chan struct{})
+	go func() {
+		for entry := range watcher.Updates() {
+			if entry == nil {
+				close(synced)
+				continue
+			}
+			var state ShardState
+			if entry.Operation() != nats.KeyValuePut {
+				continue
+			}
+			if err := json.Unmarshal(entry.Value(), &state); err != nil {
+				log.Printf("Invalid shard state of %s: %v", entry.Key(), err)
+				continue
+			}
+			s.setShardState(entry.Key(), state)
+		}
+	}()
+
+	select {
+	case <-synced:
+		return nil
+	case <-time.After(followerSyncTimeout):
+		watcher.Stop()
+		return fmt.Errorf("failed to load the shard layout within %s", followerSyncTimeout)
+	}
+}
+
+// putShardState records the shard layout of a workspace, and applies it here right away
+func (s *Server) putShardState(prefix string, state ShardState) error {
+	bucket, err := s.getBucket(shardsBucket)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if _, err := bucket.Put(prefix, data); err != nil {
+		return err
+	}
+	s.setShardState(prefix, state)
+	return nil
+}
+
+// shardBuckets returns a workspace bucket as a single bucket over its shards if it is
+// sharded. The other shards are opened with open as they are first used.
+func (s *Server) shardBuckets(prefix string, bucket nats.KeyValue, open func(name string) (nats.KeyValue, error)) nats.KeyValue {
+	state, ok := s.shards.state(prefix)
+	if !ok {
+		return bucket
+	}
+	return &shardedBucket{KeyValue: bucket, prefix: prefix, state: state, open: open, opened: map[int]nats.KeyValue{}}
+}
+
+// shardedBucket presents the shards of a workspace as a single bucket. Keys are read and
+// written in the shard their hash picks, and listing and watching fan in over every shard.
+// The embedded bucket is the workspace bucket, which is the first shard.
+type shardedBucket struct {
+	nats.KeyValue
+	prefix string
+	state  ShardState
+	open   func(name string) (nats.KeyValue, error)
+
+	lock   sync.Mutex
+	opened map[int]nats.KeyValue
+}
+
+// shard returns a shard, opening it on first use
+func (b *shardedBucket) shard(i int) (nats.KeyValue, error) {
+	if i == 0 {
+		return b.KeyValue, nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if kv, ok := b.opened[i]; ok {
+		return kv, nil
+	}
+	kv, err := b.open(shardName(b.prefix, i))
+	if err != nil {
+		return nil, err
+	}
+	b.opened[i] = kv
+	return kv, nil
+}
+
+// keyShard returns the shard of a key and whether the key may still be waiting to move there
+func (b *shardedBucket) keyShard(key string) (nats.KeyValue, bool, error) {
+	i := shardOf(key, b.state.Shards)
+	kv, err := b.shard(i)
+	return kv, b.state.Migrating && i != 0, err
+}
+
+// moveKey moves a key that hasn't moved to its shard yet out of the workspace bucket, with
+// its latest value. Earlier revisions are not moved.
+func (b *shardedBucket) moveKey(shard nats.KeyValue, key string) error {
+	entry, err := b.KeyValue.Get(key)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// A key written since the migration started is already newer in its shard
+	if _, err := shard.Create(key, entry.Value()); err != nil && !isRevisionConflict(err) {
+		return err
+	}
+	if err := b.KeyValue.Purge(key, nats.LastRevision(entry.Revision())); err != nil && !isRevisionConflict(err) {
+		return err
+	}
+	return nil
+}
+
+// writeShard returns the shard to write a key to, moving the key there first while the
+// workspace is migrating
+func (b *shardedBucket) writeShard(key string) (nats.KeyValue, error) {
+	kv, migrating, err := b.keyShard(key)
+	if err != nil {
+		return nil, err
+	}
+	if migrating {
+		if err := b.moveKey(kv, key); err != nil {
+			return nil, fmt.Errorf("failed to move %s to its shard: %v", key, err)
+		}
+	}
+	return kv, nil
+}
+
+func (b *shardedBucket) Get(key string) (nats.KeyValueEntry, error) {
+	kv, migrating, err := b.keyShard(key)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := kv.Get(key)
+	if migrating && errors.Is(err, nats.ErrKeyNotFound) {
+		return b.KeyValue.Get(key)
+	}
+	return entry, err
+}
+
+func (b *shardedBucket) GetRevision(key string, revision uint64) (nats.KeyValueEntry, error) {
+	kv, migrating, err := b.keyShard(key)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := kv.GetRevision(key, revision)
+	if migrating && errors.Is(err, nats.ErrKeyNotFound) {
+		return b.KeyValue.GetRevision(key, revision)
+	}
+	return entry, err
+}
+
+func (b *shardedBucket) History(key string, opts ...nats.WatchOpt) ([]nats.KeyValueEntry, error) {
+	kv, migrating, err := b.keyShard(key)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := kv.History(key, opts...)
+	if migrating && errors.Is(err, nats.ErrKeyNotFound) {
+		return b.KeyValue.History(key, opts...)
+	}
+	return entries, err
+}
+
+func (b *shardedBucket) Put(key string, value []byte) (uint64, error) {
+	kv, err := b.writeShard(key)
+	if err != nil {
+		return 0, err
+	}
+	return kv.Put(key, value)
+}
+
+func (b *shardedBucket) PutString(key string, value string) (uint64, error) {
+	return b.Put(key, []byte(value))
+}
+
+func (b *shardedBucket) Create(key string, value []byte) (uint64, error) {
+	kv, err := b.writeShard(key)
+	if err != nil {
+		return 0, err
+	}
+	return kv.Create(key, value)
+}
+
+func (b *shardedBucket) Update(key string, value []byte, last uint64) (uint64, error) {
+	kv, err := b.writeShard(key)
+	if err != nil {
+		return 0, err
+	}
+	return kv.Update(key, value, last)
+}
+
+func (b *shardedBucket) Delete(key string, opts ...nats.DeleteOpt) error {
+	kv, err := b.writeShard(key)
+	if err != nil {
+		return err
+	}
+	return kv.Delete(key, opts...)
+}
+
+func (b *shardedBucket) Purge(key string, opts ...nats.DeleteOpt) error {
+	kv, err := b.writeShard(key)
+	if err != nil {
+		return err
+	}
+	return kv.Purge(key, opts...)
+}
+
+// shardList returns every shard
+func (b *shardedBucket) shardList() ([]nats.KeyValue, error) {
+	shards := make([]nats.KeyValue, b.state.Shards)
+	for i := range shards {
+		kv, err := b.shard(i)
+		if err != nil {
+			return nil, err
+		}
+		shards[i] = kv
+	}
+	return shards, nil
+}
+
+func (b *shardedBucket) Keys(opts ...nats.WatchOpt) ([]string, error) {
+	lister, err := b.ListKeys(opts...)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for key := range lister.Keys() {
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, nats.ErrNoKeysFound
+	}
+	return keys, nil
+}
+
+func (b *shardedBucket) ListKeys(opts ...nats.WatchOpt) (nats.KeyLister, error) {
+	shards, err := b.shardList()
+	if err != nil {
+		return nil, err
+	}
+	listers := make([]nats.KeyLister, 0, len(shards))
+	for _, kv := range shards {
+		lister, err := kv.ListKeys(opts...)
+		if err != nil {
+			for _, l := range listers {
+				l.Stop()
+			}
+			return nil, err
+		}
+		listers = append(listers, lister)
+	}
+
+	l := &shardedLister{listers: listers, keys: make(chan string, 256)}
+	go func() {
+		defer close(l.keys)
+		// A key being moved can briefly be in the workspace bucket and its shard
+		seen := map[string]bool{}
+		for _, lister := range listers {
+			for key := range lister.Keys() {
+				if !seen[key] {
+					seen[key] = true
+					l.keys <- key
+				}
+			}
+		}
+	}()
+	return l, nil
+}
+
+// shardedLister lists the keys of every shard
+type shardedLister struct {
+	listers []nats.KeyLister
+	keys    chan string
+}
+
+func (l *shardedLister) Keys() <-chan string {
+	return l.keys
+}
+
+func (l *shardedLister) Stop() error {
+	var errs []error
+	for _, lister := range l.listers {
+		errs = append(errs, lister.Stop())
+	}
+	return errors.Join(errs...)
+}
+
+func (b *shardedBucket) WatchAll(opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	return b.Watch(">", opts...)
+}
+
+func (b *shardedBucket) Watch(keys string, opts ...nats.WatchOpt) (nats.KeyWatcher, error) {
+	shards, err := b.shardList()
+	if err != nil {
+		return nil, err
+	}
+	watchers := make([]nats.KeyWatcher, 0, len(shards))
+	for _, kv := range shards {
+		watcher, err := kv.Watch(keys, opts...)
+		if err != nil {
+			for _, w := range watchers {
+				w.Stop()
+			}
+			return nil, err
+		}
+		watchers = append(watchers, watcher)
+	}
+
+	w := &shardedWatcher{watchers: watchers, updates: make(chan nats.KeyValueEntry, 256), stopped: make(chan struct{})}
+	var wg sync.WaitGroup
+	var pending sync.WaitGroup
+	pending.Add(len(watchers))
+	for i, watcher := range watchers {
+		wg.Add(1)
+		go func(i int, watcher nats.KeyWatcher) {
+			defer wg.Done()
+			initial := true
+			for entry := range watcher.Updates() {
+				if entry == nil {
+					if initial {
+						initial = false
+						pending.Done()
+					}
+					continue
+				}
+				// Keys leaving the workspace bucket for their shard were not deleted
+				if i == 0 && entry.Operation() != nats.KeyValuePut && shardOf(entry.Key(), b.state.Shards) != 0 {
+					continue
+				}
+				if !w.send(entry) {
+					break
+				}
+			}
+			if initial {
+				pending.Done()
+			}
+		}(i, watcher)
+	}
+	go func() {
+		// Like a single watch, mark the end of the current values once every shard sent them
+		pending.Wait()
+		w.send(nil)
+		wg.Wait()
+		close(w.updates)
+	}()
+	return w, nil
+}
+
+// shardedWatcher merges the watches of every shard
+type shardedWatcher struct {
+	watchers []nats.KeyWatcher
+	updates  chan nats.KeyValueEntry
+	stopped  chan struct{}
+	stop     sync.Once
+}
+
+// send passes an entry on unless the watch was stopped, as nobody reads it then
+func (w *shardedWatcher) send(entry nats.KeyValueEntry) bool {
+	select {
+	case w.updates <- entry:
+		return true
+	case <-w.stopped:
+		return false
+	}
+}
+
+func (w *shardedWatcher) Context() context.Context {
+	return w.watchers[0].Context()
+}
+
+func (w *shardedWatcher) Updates() <-chan nats.KeyValueEntry {
+	return w.updates
+}
+
+func (w *shardedWatcher) Stop() error {
+	w.stop.Do(func() { close(w.stopped) })
+	var errs []error
+	for _, watcher := range w.watchers {
+		errs = append(errs, watcher.Stop())
+	}
+	return errors.Join(errs...)
+}
+
+func (b *shardedBucket) PurgeDeletes(opts ...nats.PurgeOpt) error {
+	shards, err := b.shardList()
+	if err != nil {
+		return err
+	}
+	for _, kv := range shards {
+		if err := kv.PurgeDeletes(opts...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runShardMonitor shards the workspaces that grow past the threshold, and finishes the
+// migrations an earlier run was stopped in the middle of
+func (s *Server) runShardMonitor() {
+	ticker := time.NewTicker(s.shards.interval)
+	defer ticker.Stop()
+	for {
+		if err := s.checkShards(); err != nil {
+			log.Printf("Shard check failed: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+func (s *Server) checkShards() error {
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+	prefixes, err := s.listWorkspacePrefixes()
+	if err != nil {
+		return err
+	}
+	for _, prefix := range prefixes {
+		state, sharded := s.shards.state(prefix)
+		if sharded && !state.Migrating {
+			continue
+		}
+		info, err := js.StreamInfo("KV_" + prefix)
+		if err != nil {
+			log.Printf("Failed to count the keys of %s: %v", prefix, err)
+			continue
+		}
+		if !sharded && info.State.NumSubjects <= s.shards.threshold {
+			continue
+		}
+		if err := s.shardWorkspace(prefix, info.State.NumSubjects); err != nil {
+			log.Printf("Failed to shard %s: %v", prefix, err)
+		}
+	}
+	return nil
+}
+
+// shardWorkspace spreads the keys of a workspace over its shards. Writes go to the shards as
+// soon as the migration starts, moving their key first, and reads fall back to the workspace
+// bucket for the keys that haven't moved yet. Moved keys keep only their latest revision.
+func (s *Server) shardWorkspace(prefix string, keys uint64) error {
+	state, ok := s.shards.state(prefix)
+	if !ok {
+		state = ShardState{Shards: s.shards.shards, Migrating: true, Keys: keys, Started: time.Now().UTC()}
+		if err := s.putShardState(prefix, state); err != nil {
+			return err
+		}
+		log.Printf("Sharding %s with %d keys over %d buckets", prefix, keys, state.Shards)
+		time.Sleep(shardPropagationDelay)
+	}
+
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		return err
+	}
+	// Keys only move between shards, which doesn't change them, so the moves aren't journaled
+	if journaled, ok := bucket.(*journaledBucket); ok {
+		bucket = journaled.KeyValue
+	}
+	sharded, ok := bucket.(*shardedBucket)
+	if !ok {
+		return fmt.Errorf("%s is not sharded", prefix)
+	}
+	names, err := sharded.KeyValue.Keys()
+	if err != nil && !errors.Is(err, nats.ErrNoKeysFound) {
+		return err
+	}
+	for _, key := range names {
+		kv, migrating, err := sharded.keyShard(key)
+		if err != nil {
+			return err
+		}
+		if !migrating {
+			continue
+		}
+		if err := sharded.moveKey(kv, key); err != nil {
+			return fmt.Errorf("failed to move %s: %v", key, err)
+		}
+		state.Moved++
+	}
+
+	state.Migrating = false
+	state.Finished = time.Now().UTC()
+	if err := s.putShardState(prefix, state); err != nil {
+		return err
+	}
+	log.Printf("Sharded %s over %d buckets, moved %d keys", prefix, state.Shards, state.Moved)
+	return nil
+}
+
+// handleShards lists the sharded workspaces
+func (s *Server) handleShards(w http.ResponseWriter, r *http.Request) {
+	s.shards.lock.RLock()
+	states := make(map[string]ShardState, len(s.shards.states))
+	for prefix, state := range s.shards.states {
+		states[prefix] = state
+	}
+	s.shards.lock.RUnlock()
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: states})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestShardNames(t *testing.T) {
+	prefix := getWorkspacePrefix("ws1")
+	if name := shardName(prefix, 0); name != prefix {
+		t.Errorf("the first shard should be the workspace bucket, got %s", name)
+	}
+	name := shardName(prefix, 3)
+	if !isShardBucket(name) || !isDataBucket(name) || isPartition(name) {
+		t.Errorf("%s should be a shard data bucket", name)
+	}
+	for _, name := range []string{prefix, prefix + "-stats", prefix + "-tool-x-shard-1", "system-shards"} {
+		if isShardBucket(name) {
+			t.Errorf("%s is not a shard", name)
+		}
+	}
+}
+
+func TestShardOf(t *testing.T) {
+	counts := make([]int, 8)
+	for i := 0; i < 8000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		shard := shardOf(key, 8)
+		if shard != shardOf(key, 8) {
+			t.Fatalf("%s moved between shards", key)
+		}
+		counts[shard]++
+	}
+	for shard, count := range counts {
+		if count < 800 || count > 1200 {
+			t.Errorf("shard %d holds %d of 8000 keys", shard, count)
+		}
+	}
+}
+
+func TestShardWorkspace(t *testing.T) {
+	t.Setenv("KV_SHARD_COUNT", "4")
+	s := newStoreServer(t)
+	for i := 0; i < 20; i++ {
+		if status, response := call(t, s, "ws1", "/api/v1/put", KVRequest{Key: fmt.Sprintf("key-%d", i), Value: fmt.Sprint(i)}); status != http.StatusOK {
+			t.Fatalf("put = %d, %+v", status, response)
+		}
+	}
+
+	// Recording the migration first skips waiting for other instances to pick it up
+	prefix := getWorkspacePrefix("ws1")
+	if err := s.putShardState(prefix, ShardState{Shards: 4, Migrating: true, Keys: 20}); err != nil {
+		t.Fatal(err)
+	}
+	// Keys written during the migration go straight to their shard
+	if status, response := call(t, s, "ws1", "/api/v1/put", KVRequest{Key: "key-0", Value: "changed"}); status != http.StatusOK {
+		t.Fatalf("put = %d, %+v", status, response)
+	}
+	if err := s.shardWorkspace(prefix, 20); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := s.shards.state(prefix); state.Migrating {
+		t.Errorf("migration did not finish: %+v", state)
+	}
+
+	workspace, err := s.getRawBucket(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		key, want := fmt.Sprintf("key-%d", i), fmt.Sprint(i)
+		if i == 0 {
+			want = "changed"
+		}
+		if status, response := call(t, s, "ws1", "/api/v1/get", KVRequest{Key: key}); status != http.StatusOK || response.Data != want {
+			t.Errorf("get %s = %d, %+v", key, status, response)
+		}
+		shard, err := s.getRawBucket(shardName(prefix, shardOf(key, 4)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := shard.Get(key); err != nil {
+			t.Errorf("%s is not in shard %d: %v", key, shardOf(key, 4), err)
+		}
+		if _, err := workspace.Get(key); shardOf(key, 4) != 0 && !errors.Is(err, nats.ErrKeyNotFound) {
+			t.Errorf("%s was not moved out of the workspace bucket: %v", key, err)
+		}
+	}
+	status, response := call(t, s, "ws1", "/api/v1/list", ListRequest{})
+	if keys, _ := response.Data.([]any); status != http.StatusOK || len(keys) != 20 {
+		t.Errorf("list = %d, %+v", status, response)
+	}
+}
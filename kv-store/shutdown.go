@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// webhookDrainInterval is how often draining checks whether the pending webhook deliveries
+// are done
+const webhookDrainInterval = 100 * time.Millisecond
+
+// drainHTTP stops accepting requests and waits for the ones in flight to finish, up to the
+// deadline of ctx. Watch streams never finish on their own, so they are ended first.
+func (s *Server) drainHTTP(ctx context.Context, srv *http.Server, h3 *http3.Server) {
+	close(s.stopping)
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("HTTP requests were still running at the shutdown deadline: %v", err)
+	}
+	if h3 != nil {
+		if err := h3.Shutdown(ctx); err != nil {
+			log.Printf("HTTP/3 requests were still running at the shutdown deadline: %v", err)
+		}
+	}
+}
+
+// drainWebhooks waits for the webhook deliveries being sent or retried, up to the deadline
+// of ctx. Deliveries still pending then are lost, as they only live in memory.
+func (s *Server) drainWebhooks(ctx context.Context) {
+	if s.webhooks == nil {
+		return
+	}
+	ticker := time.NewTicker(webhookDrainInterval)
+	defer ticker.Stop()
+	for s.webhooks.pending.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			log.Printf("Dropping %d webhook deliveries still pending at the shutdown deadline", s.webhooks.pending.Load())
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// shutdown drains the store before its NATS server stops, so nothing is cut off mid-write:
+// requests in flight finish, webhook deliveries are sent, and statistics, usage and events
+// are written out. Draining takes at most KV_SHUTDOWN_TIMEOUT. Clustered servers then hand
+// their JetStream leaderships to their peers before leaving, so the cluster doesn't wait out
+// an election timeout for the streams they led.
+func (s *Server) shutdown(srv *http.Server, h3 *http3.Server, ns *server.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	s.drainHTTP(ctx, srv, h3)
+	s.drainWebhooks(ctx)
+	if s.follower == nil {
+		s.flushStats()
+		s.flushUsage()
+		if s.usageRecordInterval > 0 {
+			// The partial period is merged into its record when it ends after a restart
+			s.writeUsageRecords(time.Now().UTC().Truncate(s.usageRecordInterval))
+		}
+	}
+	// Events are published without waiting, so they may still be buffered
+	if err := s.nc.FlushWithContext(ctx); err != nil {
+		log.Printf("Failed to flush events to NATS: %v", err)
+	}
+	s.nc.Close()
+
+	if ns.JetStreamIsClustered() {
+		log.Print("Transferring JetStream leadership to the cluster")
+		ns.LameDuckShutdown()
+	}
+	ns.Shutdown()
+	ns.WaitForShutdown()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDrainHTTP(t *testing.T) {
+	s := &Server{stopping: make(chan struct{})}
+	started := make(chan struct{}, 2)
+	finished := make(chan string, 2)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		if r.URL.Path == "/stream" {
+			<-s.stopping
+		} else {
+			time.Sleep(300 * time.Millisecond)
+		}
+		finished <- r.URL.Path
+	})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(listener)
+	for _, path := range []string{"/stream", "/put"} {
+		go http.Get("http://" + listener.Addr().String() + path)
+		<-started
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s.drainHTTP(ctx, srv, nil)
+	// Both requests finished before draining returned
+	if len(finished) != 2 {
+		t.Errorf("%d requests finished when draining returned, want 2", len(finished))
+	}
+	if _, err := http.Get("http://" + listener.Addr().String() + "/put"); err == nil {
+		t.Error("a request was accepted after draining")
+	}
+}
+
+func TestDrainWebhooks(t *testing.T) {
+	s := &Server{webhooks: &webhookDispatcher{}}
+	s.webhooks.pending.Add(1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		s.webhooks.pending.Add(-1)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	s.drainWebhooks(ctx)
+	if s.webhooks.pending.Load() != 0 || time.Since(start) > 2*time.Second {
+		t.Errorf("draining returned after %s with %d pending", time.Since(start), s.webhooks.pending.Load())
+	}
+
+	// Deliveries still pending at the deadline are given up on
+	s.webhooks.pending.Add(1)
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	s.drainWebhooks(ctx)
+	if ctx.Err() == nil {
+		t.Error("draining returned before the deadline with a delivery pending")
+	}
+}
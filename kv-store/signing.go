@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+// urlSigner creates and verifies expiring HMAC signatures for public URLs, and is the key
+// delegated tokens and the NATS passwords of workspaces are derived from
+type urlSigner struct {
+	key []byte
+	// ephemeral is set when the key was generated at startup, so nothing signed with it
+	// outlives the process
+	ephemeral bool
+}
+
+func newURLSigner() *urlSigner {
+	key := []byte(getEnvOrDefault("KV_SIGNING_KEY", ""))
+	if len(key) != 0 {
+		return &urlSigner{key: key}
+	}
+	log.Printf("Warning: No KV_SIGNING_KEY set, signed URLs will not survive a restart, and delegated tokens and NATS credentials are not issued")
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatalf("Failed to generate signing key: %v", err)
+	}
+	return &urlSigner{key: key, ephemeral: true}
+}
+
+// errEphemeralKey is returned for credentials that would silently stop working at the
+// next restart without a configured signing key
+var errEphemeralKey = errors.New("KV_SIGNING_KEY is not set, so credentials would not survive a restart")
+
+// mac returns the HMAC-SHA256 of data under the signing key
+func (u *urlSigner) mac(data []byte) []byte {
+	mac := hmac.New(sha256.New, u.key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func (u *urlSigner) signature(path string, expires int64) string {
+	return hex.EncodeToString(u.mac([]byte(path + "\n" + strconv.FormatInt(expires, 10))))
+}
+
+// sign returns the path with expires and signature query parameters appended
+func (u *urlSigner) sign(path string, ttl time.Duration) string {
+	expires := time.Now().Add(ttl).Unix()
+	return path + "?expires=" + strconv.FormatInt(expires, 10) + "&signature=" + u.signature(path, expires)
+}
+
+// verify checks that the signature matches the path and has not expired
+func (u *urlSigner) verify(path, expires, signature string) bool {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return false
+	}
+	return hmac.Equal([]byte(u.signature(path, exp)), []byte(signature))
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+var snapshotNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+type SnapshotRequest struct {
+	Name string `json:"name"`
+}
+
+// ArchiveEntry is a single key stored in a snapshot or export archive
+type ArchiveEntry struct {
+	Key      string    `json:"key"`
+	Value    []byte    `json:"value"`
+	Revision uint64    `json:"revision"`
+	Created  time.Time `json:"created"`
+}
+
+// Archive is the gzip compressed JSON document holding the contents of a bucket
+type Archive struct {
+	Bucket  string         `json:"bucket"`
+	Created time.Time      `json:"created"`
+	Entries []ArchiveEntry `json:"entries"`
+}
+
+type Snapshot struct {
+	Name    string    `json:"name"`
+	Keys    int       `json:"keys"`
+	Size    uint64    `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+// snapshotObject returns the object store name of a snapshot
+func snapshotObject(name string) string {
+	return "snapshots/" + name
+}
+
+// readArchiveEntries captures the current contents of a bucket
+func readArchiveEntries(bucket nats.KeyValue) (*Archive, error) {
+	archive := &Archive{
+		Bucket:  bucket.Bucket(),
+		Created: time.Now().UTC(),
+		Entries: make([]ArchiveEntry, 0),
+	}
+	err := scanBucket(bucket, func(entry nats.KeyValueEntry) {
+		archive.Entries = append(archive.Entries, ArchiveEntry{
+			Key:      entry.Key(),
+			Value:    entry.Value(),
+			Revision: entry.Revision(),
+			Created:  entry.Created(),
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(archive.Entries, func(i, j int) bool {
+		return archive.Entries[i].Key < archive.Entries[j].Key
+	})
+	return archive, nil
+}
+
+// encodeArchive serializes an archive as gzip compressed JSON
+func encodeArchive(archive *Archive) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(archive); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeArchive reads a gzip compressed JSON archive
+func decodeArchive(r io.Reader) (*Archive, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive: %v", err)
+	}
+	defer gz.Close()
+
+	var archive Archive
+	if err := json.NewDecoder(gz).Decode(&archive); err != nil {
+		return nil, fmt.Errorf("invalid archive: %v", err)
+	}
+	return &archive, nil
+}
+
+func (s *Server) handleSnapshotCreate(w http.ResponseWriter, r *http.Request) {
+	var req SnapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	if !snapshotNamePattern.MatchString(req.Name) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "name is required and may only contain letters, numbers, '.', '_' and '-'"})
+		return
+	}
+	if !s.checkKeyAccess(w, r, snapshotObject(req.Name), permWrite) {
+		return
+	}
+
+	// Get the stores for this request
+	prefix := s.getDataPrefix(r, false)
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	store, err := s.getObjectStore(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	if _, err := store.GetInfo(snapshotObject(req.Name)); err == nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("snapshot %s already exists", req.Name)})
+		return
+	}
+
+	archive, err := readArchiveEntries(bucket)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	// A snapshot captures the whole bucket, so the caller must be able to read every key
+	for _, entry := range archive.Entries {
+		if !s.checkKeyAccess(w, r, entry.Key, permRead) {
+			return
+		}
+	}
+	data, err := encodeArchive(archive)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	info, err := store.Put(&nats.ObjectMeta{
+		Name: snapshotObject(req.Name),
+		Metadata: map[string]string{
+			"keys":    strconv.Itoa(len(archive.Entries)),
+			"created": archive.Created.Format(time.RFC3339Nano),
+		},
+	}, bytes.NewReader(data))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: Snapshot{
+		Name:    req.Name,
+		Keys:    len(archive.Entries),
+		Size:    info.Size,
+		Created: archive.Created,
+	}})
+}
+
+func (s *Server) handleSnapshotList(w http.ResponseWriter, r *http.Request) {
+	// Get the object store for this request
+	prefix := s.getDataPrefix(r, false)
+	store, err := s.getObjectStore(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	canRead := s.readFilter(r)
+	snapshots := make([]Snapshot, 0)
+	objects, err := store.List()
+	if err != nil && err != nats.ErrNoObjectsFound {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	for _, object := range objects {
+		name, ok := strings.CutPrefix(object.Name, "snapshots/")
+		if !ok || !canRead(object.Name) {
+			continue
+		}
+		keys, _ := strconv.Atoi(object.Metadata["keys"])
+		created, err := time.Parse(time.RFC3339Nano, object.Metadata["created"])
+		if err != nil {
+			created = object.ModTime
+		}
+		snapshots = append(snapshots, Snapshot{
+			Name:    name,
+			Keys:    keys,
+			Size:    object.Size,
+			Created: created,
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Created.Before(snapshots[j].Created)
+	})
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: snapshots})
+}
+
+func (s *Server) handleSnapshotDelete(w http.ResponseWriter, r *http.Request) {
+	var req SnapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	if req.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "name is required"})
+		return
+	}
+	if !s.checkKeyAccess(w, r, snapshotObject(req.Name), permDelete) {
+		return
+	}
+
+	// Get the object store for this request
+	prefix := s.getDataPrefix(r, false)
+	store, err := s.getObjectStore(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	if err := store.Delete(snapshotObject(req.Name)); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	defaultSQLLimit = 1000
+	maxSQLLimit     = 10000
+)
+
+// sqlSchema is the table queries read. Keys are loaded into it for each query, so it always
+// holds what the caller can read right now.
+const sqlSchema = `CREATE TABLE kv (
+	key TEXT NOT NULL,
+	value TEXT,
+	revision INTEGER NOT NULL,
+	modified TEXT NOT NULL,
+	size INTEGER NOT NULL,
+	level TEXT NOT NULL
+)`
+
+type SQLRequest struct {
+	SQL   string `json:"sql"`
+	Scope string `json:"scope,omitempty"`
+	// Prefix only loads the keys starting with it, for queries over part of a large store
+	Prefix string      `json:"prefix,omitempty"`
+	Limit  flexibleInt `json:"limit,omitempty"`
+}
+
+type SQLResult struct {
+	Columns []string `json:"columns"`
+	Rows    [][]any  `json:"rows"`
+	// Keys is the number of keys the query ran over
+	Keys      int  `json:"keys"`
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// sqlRow is a key loaded into the kv table
+type sqlRow struct {
+	key      string
+	value    []byte
+	revision uint64
+	modified time.Time
+	level    string
+}
+
+// sqlValue converts a value read from SQLite to one JSON can hold. Blobs that aren't text
+// are returned base64 encoded.
+func sqlValue(value any) any {
+	if v, ok := value.([]byte); ok {
+		if utf8.Valid(v) {
+			return string(v)
+		}
+		return base64.StdEncoding.EncodeToString(v)
+	}
+	return value
+}
+
+// handleSQL runs read-only SQL over the keys the caller can read, as the table
+// kv(key, value, revision, modified, size, level). Values are text, so JSON values can be
+// read with SQLite's JSON functions, such as json_extract(value, '$.status').
+func (s *Server) handleSQL(w http.ResponseWriter, r *http.Request) {
+	var req SQLRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = defaultSQLLimit
+	}
+	switch {
+	case strings.TrimSpace(req.SQL) == "":
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "sql is required"})
+		return
+	case req.Limit < 1 || req.Limit > maxSQLLimit:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("limit must be between 1 and %d", maxSQLLimit)})
+		return
+	}
+	var namespaces []namespace
+	for _, ns := range s.getNamespaces(r) {
+		if req.Scope == "" || req.Scope == ns.Scope {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	if len(namespaces) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: scopeError(req.Scope).Error()})
+		return
+	}
+	if !sqlAvailable {
+		w.WriteHeader(http.StatusNotImplemented)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "SQL queries are not available, the server was built without cgo"})
+		return
+	}
+
+	// Keys are loaded once, at the level reads see them, up to KV_SQL_MAX_BYTES of values.
+	// Keys past their TTL are left out like reads leave them out, even before the sweeper
+	// deletes them.
+	canRead := s.readFilter(r)
+	now := time.Now()
+	var rows []sqlRow
+	var loaded int64
+	seen := map[string]bool{}
+	for _, ns := range namespaces {
+		bucket, err := s.getBucket(ns.Prefix)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		expired, err := s.expiredKeys(ns.Prefix, now)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		err = scanBucket(bucket, func(entry nats.KeyValueEntry) {
+			key := entry.Key()
+			if loaded > s.sqlMaxBytes || seen[key] || !strings.HasPrefix(key, req.Prefix) || !canRead(key) || expired[key] == entry.Revision() {
+				return
+			}
+			seen[key] = true
+			loaded += int64(len(entry.Value()))
+			rows = append(rows, sqlRow{key: key, value: entry.Value(), revision: entry.Revision(), modified: entry.Created(), level: ns.Scope})
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		if loaded > s.sqlMaxBytes {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("the values to query are larger than %d bytes, query fewer keys with prefix or scope", s.sqlMaxBytes)})
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.sqlTimeout)
+	defer cancel()
+	result, err := querySQL(ctx, rows, req.SQL, int(req.Limit))
+	if err != nil {
+		switch {
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			w.WriteHeader(http.StatusRequestTimeout)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("the query took longer than %s", s.sqlTimeout)})
+		case strings.Contains(err.Error(), "not authorized"):
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "only read-only queries are allowed"})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		}
+		return
+	}
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: result})
+}
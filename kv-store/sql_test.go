@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleSQLValidation(t *testing.T) {
+	s := newTestServer()
+	for _, body := range []string{`{}`, `{"sql":" "}`, `{"sql":"SELECT 1","limit":20000}`, `{"sql":"SELECT 1","scope":"galaxy"}`, `not json`} {
+		w := httptest.NewRecorder()
+		s.handleSQL(w, httptest.NewRequest("POST", "/api/v1/sql", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", body, w.Code)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqlAvailable reports whether the server is built with SQLite, which needs cgo
+const sqlAvailable = true
+
+// sqliteRecursive is SQLITE_RECURSIVE, which go-sqlite3 doesn't export
+const sqliteRecursive = 33
+
+// authorizeSQL only lets queries read. The database only lives in memory for one query, but
+// ATTACH could still open files on disk.
+func authorizeSQL(action int, _, _, _ string) int {
+	switch action {
+	case sqlite3.SQLITE_SELECT, sqlite3.SQLITE_READ, sqlite3.SQLITE_FUNCTION, sqliteRecursive:
+		return sqlite3.SQLITE_OK
+	}
+	return sqlite3.SQLITE_DENY
+}
+
+// querySQL loads rows into the kv table of an in-memory database and runs a read-only query
+// over them, returning at most limit rows
+func querySQL(ctx context.Context, rows []sqlRow, query string, limit int) (*SQLResult, error) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	// Every connection to :memory: has a database of its own
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, sqlSchema); err != nil {
+		return nil, err
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	insert, err := tx.PrepareContext(ctx, "INSERT INTO kv VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for _, row := range rows {
+		_, err := insert.ExecContext(ctx, row.key, string(row.value), row.revision, row.modified.UTC().Format(time.RFC3339Nano), len(row.value), row.level)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	err = conn.Raw(func(driverConn any) error {
+		driverConn.(*sqlite3.SQLiteConn).RegisterAuthorizer(authorizeSQL)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer results.Close()
+	columns, err := results.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := &SQLResult{Columns: columns, Rows: [][]any{}, Keys: len(rows)}
+	for results.Next() {
+		if len(result.Rows) == limit {
+			result.Truncated = true
+			break
+		}
+		values := make([]any, len(columns))
+		pointers := make([]any, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := results.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		for i, value := range values {
+			values[i] = sqlValue(value)
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	if err := results.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
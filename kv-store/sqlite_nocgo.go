@@ -0,0 +1,16 @@
+//go:build !cgo
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// sqlAvailable reports whether the server is built with SQLite, which needs cgo. Builds
+// without cgo answer SQL queries with 501 Not Implemented.
+const sqlAvailable = false
+
+func querySQL(ctx context.Context, rows []sqlRow, query string, limit int) (*SQLResult, error) {
+	return nil, errors.New("SQL queries need a build of the server with cgo")
+}
@@ -0,0 +1,80 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuerySQL(t *testing.T) {
+	modified := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	rows := []sqlRow{
+		{key: "tasks/1", value: []byte(`{"status": "failed", "cost": 2.5}`), revision: 1, modified: modified, level: "workspace"},
+		{key: "tasks/2", value: []byte(`{"status": "failed", "cost": 1}`), revision: 2, modified: modified, level: "workspace"},
+		{key: "tasks/3", value: []byte(`{"status": "done"}`), revision: 3, modified: modified, level: "thread"},
+		{key: "note", value: []byte("plain text"), revision: 4, modified: modified, level: "user"},
+	}
+	result, err := querySQL(context.Background(), rows, `SELECT json_extract(value, '$.status') AS status, count(*), sum(json_extract(value, '$.cost'))
+		FROM kv WHERE key LIKE 'tasks/%' GROUP BY status ORDER BY status`, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Keys != 4 || len(result.Rows) != 2 || result.Columns[0] != "status" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if row := result.Rows[1]; row[0] != "failed" || row[1] != int64(2) || row[2] != 3.5 {
+		t.Errorf("unexpected row %v", row)
+	}
+
+	result, err = querySQL(context.Background(), rows, "SELECT key, size, modified, level FROM kv ORDER BY revision", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Truncated || len(result.Rows) != 2 || result.Rows[0][1] != int64(33) || result.Rows[0][2] != "2024-06-01T12:00:00Z" {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	for _, query := range []string{"DELETE FROM kv", "INSERT INTO kv VALUES ('a', 'b', 1, '', 1, '')", "ATTACH DATABASE '/tmp/other.db' AS other", "PRAGMA writable_schema = 1", "DROP TABLE kv"} {
+		if _, err := querySQL(context.Background(), rows, query, 10); err == nil || !strings.Contains(err.Error(), "not authorized") {
+			t.Errorf("%s: err = %v, want not authorized", query, err)
+		}
+	}
+	if _, err := querySQL(context.Background(), rows, "SELECT nope FROM kv", 10); err == nil {
+		t.Error("expected an error for an unknown column")
+	}
+}
+
+func TestHandleSQLSkipsExpiredKeys(t *testing.T) {
+	s := newStoreServer(t)
+	for _, key := range []string{"a", "b", "c"} {
+		if status, response := call(t, s, "ws1", "/api/v1/put", KVRequest{Key: key, Value: key, TTL: "1h"}); status != http.StatusOK {
+			t.Fatalf("put %s = %d, %+v", key, status, response)
+		}
+	}
+	// The TTL of b passed, but the sweeper hasn't deleted it yet
+	prefix := getWorkspacePrefix("ws1")
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := bucket.Get("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.setKeyExpiry(prefix, "b", entry.Revision(), time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	status, response := call(t, s, "ws1", "/api/v1/sql", SQLRequest{SQL: "SELECT key FROM kv ORDER BY key"})
+	if status != http.StatusOK {
+		t.Fatalf("sql = %d, %+v", status, response)
+	}
+	result := response.Data.(map[string]any)
+	if rows := result["rows"].([]any); len(rows) != 2 || rows[0].([]any)[0] != "a" || rows[1].([]any)[0] != "c" {
+		t.Errorf("rows = %v, want a and c", rows)
+	}
+}
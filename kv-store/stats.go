@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// KeyStats records how often and how recently a key has been accessed
+type KeyStats struct {
+	Reads      int64     `json:"reads"`
+	Writes     int64     `json:"writes"`
+	LastRead   time.Time `json:"last_read,omitempty"`
+	LastWrite  time.Time `json:"last_write,omitempty"`
+	LastAccess time.Time `json:"last_access,omitempty"`
+	// FirstWrite is when the key was created, as its stats are removed when it's deleted
+	FirstWrite time.Time `json:"first_write,omitempty"`
+}
+
+type KeyMetadata struct {
+	Key      string    `json:"key"`
+	Revision uint64    `json:"revision"`
+	Modified time.Time `json:"modified"`
+	Size     int       `json:"size"`
+	Stats    *KeyStats `json:"stats,omitempty"`
+}
+
+type HotKeysRequest struct {
+	Workspace string `json:"workspace,omitempty"`
+	Prefix    string `json:"prefix,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+}
+
+type HotKey struct {
+	Prefix string   `json:"prefix"`
+	Key    string   `json:"key"`
+	Stats  KeyStats `json:"stats"`
+}
+
+// merge adds the counts of other to the stats and keeps the latest timestamps. The first
+// write of other is only kept if the stats have no writes, so a key written before first
+// writes were recorded doesn't get a later one.
+func (k *KeyStats) merge(other *KeyStats) {
+	if k.Writes == 0 && k.FirstWrite.IsZero() {
+		k.FirstWrite = other.FirstWrite
+	}
+	k.Reads += other.Reads
+	k.Writes += other.Writes
+	if other.LastRead.After(k.LastRead) {
+		k.LastRead = other.LastRead
+	}
+	if other.LastWrite.After(k.LastWrite) {
+		k.LastWrite = other.LastWrite
+	}
+	if other.LastAccess.After(k.LastAccess) {
+		k.LastAccess = other.LastAccess
+	}
+}
+
+// accessTracker accumulates key accesses in memory and periodically flushes them to a
+// stats bucket per workspace, so recording an access never costs a JetStream round trip
+type accessTracker struct {
+	lock    sync.Mutex
+	pending map[string]map[string]*KeyStats
+	// flushLock serializes flushes, which read, merge and rewrite the same stats keys
+	flushLock sync.Mutex
+}
+
+func newAccessTracker() *accessTracker {
+	return &accessTracker{
+		pending: map[string]map[string]*KeyStats{},
+	}
+}
+
+// record notes a read or write of a key in the workspace with the given prefix
+func (a *accessTracker) record(prefix, key string, write bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	keys, ok := a.pending[prefix]
+	if !ok {
+		keys = map[string]*KeyStats{}
+		a.pending[prefix] = keys
+	}
+	stats, ok := keys[key]
+	if !ok {
+		stats = &KeyStats{}
+		keys[key] = stats
+	}
+
+	now := time.Now().UTC()
+	if write {
+		if stats.Writes == 0 {
+			stats.FirstWrite = now
+		}
+		stats.Writes++
+		stats.LastWrite = now
+	} else {
+		stats.Reads++
+		stats.LastRead = now
+	}
+	stats.LastAccess = now
+}
+
+// forget drops unflushed stats of a key that was deleted
+func (a *accessTracker) forget(prefix, key string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.pending[prefix], key)
+}
+
+// pendingStats returns a copy of the unflushed stats of a key
+func (a *accessTracker) pendingStats(prefix, key string) *KeyStats {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if stats, ok := a.pending[prefix][key]; ok {
+		copied := *stats
+		return &copied
+	}
+	return nil
+}
+
+// take removes and returns all unflushed stats
+func (a *accessTracker) take() map[string]map[string]*KeyStats {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	pending := a.pending
+	a.pending = map[string]map[string]*KeyStats{}
+	return pending
+}
+
+// getStatsBucket gets the bucket holding access statistics for the given prefix
+func (s *Server) getStatsBucket(prefix string) (nats.KeyValue, error) {
+	return s.getBucket(prefix + "-stats")
+}
+
+// runStatsFlusher periodically persists accumulated access statistics and usage
+func (s *Server) runStatsFlusher(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.flushStats()
+		s.flushUsage()
+		s.tokenLimiter.prune()
+		if s.ipLimit != nil {
+			s.ipLimit.limiter.prune()
+		}
+	}
+}
+
+// flushStats merges all unflushed access statistics into the stats buckets
+func (s *Server) flushStats() {
+	s.access.flushLock.Lock()
+	defer s.access.flushLock.Unlock()
+
+	for prefix, keys := range s.access.take() {
+		bucket, err := s.getStatsBucket(prefix)
+		if err != nil {
+			log.Printf("Failed to flush access stats for %s: %v", prefix, err)
+			continue
+		}
+		for key, delta := range keys {
+			stats, _ := loadKeyStats(bucket, key)
+			stats.merge(delta)
+			value, err := json.Marshal(stats)
+			if err != nil {
+				continue
+			}
+			if _, err := bucket.Put(key, value); err != nil {
+				log.Printf("Failed to flush access stats for %s/%s: %v", prefix, key, err)
+			}
+		}
+	}
+}
+
+// loadKeyStats reads the persisted stats of a key, returning empty stats if there are none
+func loadKeyStats(bucket nats.KeyValue, key string) (*KeyStats, error) {
+	stats := &KeyStats{}
+	entry, err := bucket.Get(key)
+	if err != nil {
+		return stats, err
+	}
+	if err := json.Unmarshal(entry.Value(), stats); err != nil {
+		return &KeyStats{}, err
+	}
+	return stats, nil
+}
+
+// getKeyStats returns the persisted and unflushed access statistics of a key
+func (s *Server) getKeyStats(prefix, key string) *KeyStats {
+	stats := &KeyStats{}
+	if bucket, err := s.getStatsBucket(prefix); err == nil {
+		stats, _ = loadKeyStats(bucket, key)
+	}
+	if pending := s.access.pendingStats(prefix, key); pending != nil {
+		stats.merge(pending)
+	}
+	return stats
+}
+
+// deleteKeyStats removes the statistics of a deleted key
+func (s *Server) deleteKeyStats(prefix, key string) {
+	s.access.forget(prefix, key)
+	if bucket, err := s.getStatsBucket(prefix); err == nil {
+		if err := bucket.Purge(key); err != nil {
+			log.Printf("Failed to purge access stats for %s/%s: %v", prefix, key, err)
+		}
+	}
+}
+
+func (s *Server) handleMetadata(w http.ResponseWriter, r *http.Request) {
+	var req KVRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	if req.Key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "key is required"})
+		return
+	}
+
+	if !s.checkKeyAccess(w, r, req.Key, permRead) {
+		return
+	}
+
+	// Get the bucket for this request
+	prefix := s.getDataPrefix(r, false)
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	entry, err := bucket.Get(req.Key)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: KeyMetadata{
+		Key:      req.Key,
+		Revision: entry.Revision(),
+		Modified: entry.Created(),
+		Size:     len(entry.Value()),
+		Stats:    s.getKeyStats(prefix, req.Key),
+	}})
+}
+
+// handleHotKeys reports the most accessed keys of one workspace, or of all workspaces
+func (s *Server) handleHotKeys(w http.ResponseWriter, r *http.Request) {
+	var req HotKeysRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = 20
+	}
+
+	prefixes := []string{}
+	switch {
+	case req.Prefix != "":
+		prefixes = append(prefixes, req.Prefix)
+	case req.Workspace != "":
+		prefixes = append(prefixes, getWorkspacePrefix(req.Workspace))
+	default:
+		names, err := s.listBucketNames()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+		for _, name := range names {
+			if prefix, ok := strings.CutSuffix(name, "-stats"); ok {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+	}
+
+	// Make sure recent accesses are included in the report
+	s.flushStats()
+
+	hotKeys := make([]HotKey, 0)
+	for _, prefix := range prefixes {
+		bucket, err := s.getStatsBucket(prefix)
+		if err != nil {
+			log.Printf("Skipping stats for %s: %v", prefix, err)
+			continue
+		}
+		keys, err := bucket.ListKeys()
+		if err != nil {
+			log.Printf("Skipping stats for %s: %v", prefix, err)
+			continue
+		}
+		for key := range keys.Keys() {
+			stats, err := loadKeyStats(bucket, key)
+			if err != nil {
+				continue
+			}
+			hotKeys = append(hotKeys, HotKey{Prefix: prefix, Key: key, Stats: *stats})
+		}
+	}
+
+	sort.Slice(hotKeys, func(i, j int) bool {
+		return hotKeys[i].Stats.Reads+hotKeys[i].Stats.Writes > hotKeys[j].Stats.Reads+hotKeys[j].Stats.Writes
+	})
+	if len(hotKeys) > limit {
+		hotKeys = hotKeys[:limit]
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: hotKeys})
+}
+
+// listBucketNames returns the names of all KV buckets on the server
+func (s *Server) listBucketNames() ([]string, error) {
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+	names := make([]string, 0)
+	for name := range js.KeyValueStoreNames() {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// listWorkspacePrefixes returns the prefixes of all workspace buckets, skipping the
+// auxiliary buckets kept alongside them such as <prefix>-stats
+func (s *Server) listWorkspacePrefixes() ([]string, error) {
+	names, err := s.listBucketNames()
+	if err != nil {
+		return nil, err
+	}
+	prefixes := make([]string, 0, len(names))
+	for _, name := range names {
+		if !strings.Contains(name, "-") {
+			prefixes = append(prefixes, name)
+		}
+	}
+	return prefixes, nil
+}
+
+// listDataBuckets returns the names of all buckets holding user data, which are the
+// workspace buckets plus any per-tool partitions
+func (s *Server) listDataBuckets() ([]string, error) {
+	names, err := s.listBucketNames()
+	if err != nil {
+		return nil, err
+	}
+	buckets := make([]string, 0, len(names))
+	for _, name := range names {
+		if isDataBucket(name) {
+			buckets = append(buckets, name)
+		}
+	}
+	return buckets, nil
+}
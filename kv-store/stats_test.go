@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyStatsMergeFirstWrite(t *testing.T) {
+	created := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	later := created.Add(time.Hour)
+
+	// The first write of a new key is kept by later flushes
+	stats := &KeyStats{}
+	stats.merge(&KeyStats{Writes: 1, FirstWrite: created, LastWrite: created})
+	stats.merge(&KeyStats{Writes: 2, FirstWrite: later, LastWrite: later})
+	if !stats.FirstWrite.Equal(created) || stats.Writes != 3 || !stats.LastWrite.Equal(later) {
+		t.Errorf("merged stats %+v, want the first write at %s", stats, created)
+	}
+
+	// A key written before first writes were recorded doesn't get one
+	stats = &KeyStats{Writes: 5, LastWrite: created}
+	stats.merge(&KeyStats{Writes: 1, FirstWrite: later, LastWrite: later})
+	if !stats.FirstWrite.IsZero() {
+		t.Errorf("first write = %s, want none", stats.FirstWrite)
+	}
+}
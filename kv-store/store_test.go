@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+)
+
+// newStoreServer returns a server backed by an embedded JetStream server, for tests of
+// behavior that needs real buckets. The settings are read from the environment like in
+// production, so tests can change them with t.Setenv before calling it.
+func newStoreServer(t *testing.T) *Server {
+	t.Helper()
+	ns, err := server.NewServer(&server.Options{DontListen: true, NoSigs: true, NoLog: true, JetStream: true, StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(4 * time.Second) {
+		t.Fatal("failed to start the NATS server")
+	}
+	nc, err := nats.Connect("", nats.InProcessServer(ns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		nc.Close()
+		ns.Shutdown()
+	})
+	return s
+}
+
+// call sends a request as a workspace through the whole server, authentication and
+// routing included, and decodes its response
+func call(t *testing.T, s *Server, workspace, path string, body any) (int, KVResponse) {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+	r.Header.Set("X-GPTScript-Env", "GPTSCRIPT_WORKSPACE_ID="+workspace)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	var response KVResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("%s: invalid response %q: %v", path, w.Body.String(), err)
+	}
+	return w.Code, response
+}
+
+func TestStoreServer(t *testing.T) {
+	s := newStoreServer(t)
+	if status, response := call(t, s, "ws1", "/api/v1/put", KVRequest{Key: "a", Value: "1"}); status != http.StatusOK || !response.Success {
+		t.Fatalf("put = %d, %+v", status, response)
+	}
+	if status, response := call(t, s, "ws1", "/api/v1/get", KVRequest{Key: "a"}); status != http.StatusOK || response.Data != "1" {
+		t.Fatalf("get = %d, %+v", status, response)
+	}
+	// Workspaces don't see each other's keys
+	if status, _ := call(t, s, "ws2", "/api/v1/get", KVRequest{Key: "a"}); status != http.StatusNotFound {
+		t.Fatalf("get from another workspace = %d, want 404", status)
+	}
+}
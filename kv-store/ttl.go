@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// ttlBucket is the system bucket holding when keys put with a TTL expire, keyed by
+// <bucket>.<key>
+const ttlBucket = "system-ttl"
+
+// keyTTL is when the revision of a key that was put with a TTL expires. A later revision
+// put without a TTL doesn't expire, so the record no longer applies to it.
+type keyTTL struct {
+	ExpiresAt time.Time `json:"expires_at"`
+	Revision  uint64    `json:"revision"`
+}
+
+// parseTTL parses the TTL of a put, a duration such as 10m or a number of seconds
+func parseTTL(value string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, serr := strconv.Atoi(value)
+		if serr != nil {
+			return 0, fmt.Errorf("ttl must be a duration such as 10m or a number of seconds")
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+	if ttl < time.Second {
+		return 0, fmt.Errorf("ttl must be at least 1s")
+	}
+	return ttl, nil
+}
+
+// ttlRecordKey is the key of the TTL record of a key in a bucket
+func ttlRecordKey(prefix, key string) string {
+	return prefix + "." + key
+}
+
+// setKeyExpiry records that the revision of a key expires at a given time
+func (s *Server) setKeyExpiry(prefix, key string, revision uint64, expiresAt time.Time) error {
+	bucket, err := s.getBucket(ttlBucket)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(keyTTL{ExpiresAt: expiresAt.UTC(), Revision: revision})
+	if err != nil {
+		return err
+	}
+	_, err = bucket.Put(ttlRecordKey(prefix, key), data)
+	return err
+}
+
+// setExpiryOrUndo records when the revision of a key written with a TTL expires. A key
+// without its record would never expire, so when the record can't be written the write is
+// undone: the key is restored to previous, or deleted if it didn't exist before, unless it
+// was written again since.
+func (s *Server) setExpiryOrUndo(bucket nats.KeyValue, prefix, key string, revision uint64, expiresAt time.Time, previous nats.KeyValueEntry) error {
+	err := s.setKeyExpiry(prefix, key, revision, expiresAt)
+	if err == nil {
+		return nil
+	}
+	var undo error
+	if previous != nil {
+		_, undo = bucket.Update(key, previous.Value(), revision)
+	} else {
+		undo = bucket.Delete(key, nats.LastRevision(revision))
+	}
+	switch {
+	case isRevisionConflict(undo):
+		return fmt.Errorf("the TTL of %s wasn't set and it was written again since: %v", key, err)
+	case undo != nil:
+		return fmt.Errorf("the TTL of %s wasn't set (%v) and the write couldn't be undone: %v", key, err, undo)
+	}
+	return fmt.Errorf("the TTL of %s wasn't set, so the write was undone: %v", key, err)
+}
+
+// getKeyTTL returns when an entry of a bucket expires, if it was put with a TTL
+func (s *Server) getKeyTTL(prefix string, entry nats.KeyValueEntry) (time.Time, bool, error) {
+	bucket, err := s.getBucket(ttlBucket)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	record, err := bucket.Get(ttlRecordKey(prefix, entry.Key()))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return time.Time{}, false, nil
+	} else if err != nil {
+		return time.Time{}, false, err
+	}
+	var ttl keyTTL
+	if err := json.Unmarshal(record.Value(), &ttl); err != nil || ttl.Revision != entry.Revision() {
+		return time.Time{}, false, nil
+	}
+	return ttl.ExpiresAt, true, nil
+}
+
+// expiredKeys returns the revisions of the keys of a bucket whose TTL passed, which reads
+// treat as deleted until the sweeper deletes them, from a single pass over the TTL records
+func (s *Server) expiredKeys(prefix string, now time.Time) (map[string]uint64, error) {
+	bucket, err := s.getBucket(ttlBucket)
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := bucket.Watch(ttlRecordKey(prefix, ">"), nats.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	defer watcher.Stop()
+
+	expired := map[string]uint64{}
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		var ttl keyTTL
+		if json.Unmarshal(entry.Value(), &ttl) == nil && !ttl.ExpiresAt.After(now) {
+			expired[strings.TrimPrefix(entry.Key(), prefix+".")] = ttl.Revision
+		}
+	}
+	return expired, nil
+}
+
+// remainingTTL is the number of seconds left before a key expires, rounded up so a key
+// that hasn't expired yet never reports 0
+func remainingTTL(expiresAt, now time.Time) int64 {
+	return int64(math.Ceil(expiresAt.Sub(now).Seconds()))
+}
+
+// expireKeys deletes the keys whose TTL passed and notifies about them. Keys are deleted at
+// the revision put with the TTL, so a key written again since is kept. Records that no
+// longer apply are removed along the way.
+func (s *Server) expireKeys(now time.Time) (int, error) {
+	bucket, err := s.getBucket(ttlBucket)
+	if err != nil {
+		return 0, err
+	}
+	var due []nats.KeyValueEntry
+	err = scanBucket(bucket, func(entry nats.KeyValueEntry) {
+		var ttl keyTTL
+		if json.Unmarshal(entry.Value(), &ttl) != nil || !ttl.ExpiresAt.After(now) {
+			due = append(due, entry)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	expired := map[string][]string{}
+	count := 0
+	for _, record := range due {
+		var ttl keyTTL
+		if prefix, key, ok := strings.Cut(record.Key(), "."); ok && json.Unmarshal(record.Value(), &ttl) == nil {
+			deleted, err := s.expireKey(prefix, key, ttl.Revision)
+			if err != nil {
+				log.Printf("Failed to expire %s/%s: %v", prefix, key, err)
+				continue
+			}
+			if deleted {
+				expired[prefix] = append(expired[prefix], key)
+				count++
+			}
+		}
+		// The record is only removed if it wasn't set again in the meantime
+		if err := bucket.Purge(record.Key(), nats.LastRevision(record.Revision())); err != nil && !isRevisionConflict(err) {
+			log.Printf("Failed to remove the TTL of %s: %v", record.Key(), err)
+		}
+	}
+	for prefix, keys := range expired {
+		s.notifyKeys(prefix, webhookEventExpired, "expire", "key_ttl", keys)
+	}
+	return count, nil
+}
+
+// expireKey deletes the revision of a key put with a TTL and reports whether it did. A key
+// that was written again or deleted since is left as it is.
+func (s *Server) expireKey(prefix, key string, revision uint64) (bool, error) {
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		return false, err
+	}
+	err = bucket.Delete(key, nats.LastRevision(revision))
+	if isRevisionConflict(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	s.deleteKeyStats(prefix, key)
+	return true, nil
+}
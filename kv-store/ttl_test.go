@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestParseTTL(t *testing.T) {
+	for value, want := range map[string]time.Duration{"10m": 10 * time.Minute, "90": 90 * time.Second, "1s": time.Second, "36h": 36 * time.Hour} {
+		if ttl, err := parseTTL(value); err != nil || ttl != want {
+			t.Errorf("parseTTL(%q) = %s, %v, want %s", value, ttl, err, want)
+		}
+	}
+	for _, value := range []string{"0", "-5m", "500ms", "soon", "1.5"} {
+		if ttl, err := parseTTL(value); err == nil {
+			t.Errorf("parseTTL(%q) = %s, want an error", value, ttl)
+		}
+	}
+}
+
+func TestRemainingTTL(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	for expiresAt, want := range map[time.Time]int64{
+		now.Add(90 * time.Second):                 90,
+		now.Add(1500 * time.Millisecond):          2,
+		now.Add(time.Millisecond):                 1,
+		now.Add(-30 * time.Second):                -30,
+		now.Add(10*time.Minute + time.Nanosecond): 601,
+	} {
+		if got := remainingTTL(expiresAt, now); got != want {
+			t.Errorf("remainingTTL(%s) = %d, want %d", expiresAt.Sub(now), got, want)
+		}
+	}
+}
+
+func TestHandlePutInvalidTTL(t *testing.T) {
+	s := newTestServer()
+	w := httptest.NewRecorder()
+	s.handlePut(w, httptest.NewRequest("POST", "/api/v1/put", strings.NewReader(`{"key":"a","value":"b","ttl":"forever"}`)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "ttl must be") {
+		t.Errorf("status = %d, body %s, want 400 for an invalid ttl", w.Code, w.Body.String())
+	}
+}
+
+func TestExpireKeys(t *testing.T) {
+	s := newStoreServer(t)
+	for _, req := range []KVRequest{{Key: "a", Value: "1", TTL: "1h"}, {Key: "b", Value: "1", TTL: "1h"}, {Key: "c", Value: "1"}, {Key: "b", Value: "2"}} {
+		if status, response := call(t, s, "ws1", "/api/v1/put", req); status != http.StatusOK {
+			t.Fatalf("put %s = %d, %+v", req.Key, status, response)
+		}
+	}
+
+	if count, err := s.expireKeys(time.Now()); err != nil || count != 0 {
+		t.Fatalf("expireKeys before the TTL = %d, %v", count, err)
+	}
+	// b was written again without a TTL, so only a expires
+	count, err := s.expireKeys(time.Now().Add(2 * time.Hour))
+	if err != nil || count != 1 {
+		t.Fatalf("expireKeys = %d, %v, want 1", count, err)
+	}
+	if status, _ := call(t, s, "ws1", "/api/v1/get", KVRequest{Key: "a"}); status != http.StatusNotFound {
+		t.Errorf("get a = %d, want 404", status)
+	}
+	for key, want := range map[string]string{"b": "2", "c": "1"} {
+		if status, response := call(t, s, "ws1", "/api/v1/get", KVRequest{Key: key}); status != http.StatusOK || response.Data != want {
+			t.Errorf("get %s = %d, %+v, want %s", key, status, response, want)
+		}
+	}
+
+	// The records are removed along with the keys
+	bucket, err := s.getBucket(ttlBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := bucket.Keys()
+	if err != nil && !errors.Is(err, nats.ErrNoKeysFound) {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Errorf("TTL records left: %v", keys)
+	}
+}
+
+func TestPutUndoneWithoutTTL(t *testing.T) {
+	s := newStoreServer(t)
+	if status, response := call(t, s, "ws1", "/api/v1/put", KVRequest{Key: "a", Value: "1"}); status != http.StatusOK {
+		t.Fatalf("put = %d, %+v", status, response)
+	}
+	if _, err := s.getBucket(ttlBucket); err != nil {
+		t.Fatal(err)
+	}
+	// A sealed stream takes no more writes, so TTL records can't be set
+	js, err := s.nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := js.StreamInfo("KV_" + ttlBucket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.Config.Sealed = true
+	if _, err := js.UpdateStream(&info.Config); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if status, response := call(t, s, "ws1", "/api/v1/put", KVRequest{Key: key, Value: "2", TTL: "1h"}); status != http.StatusInternalServerError || !strings.Contains(response.Error, "undone") {
+			t.Errorf("put %s = %d, %+v, want it undone", key, status, response)
+		}
+	}
+	if status, response := call(t, s, "ws1", "/api/v1/get", KVRequest{Key: "a"}); status != http.StatusOK || response.Data != "1" {
+		t.Errorf("get a = %d, %+v, want the value before the put", status, response)
+	}
+	if status, _ := call(t, s, "ws1", "/api/v1/get", KVRequest{Key: "b"}); status != http.StatusNotFound {
+		t.Errorf("get b = %d, want 404", status)
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+type UploadRequest struct {
+	UploadID    string `json:"upload_id,omitempty"`
+	Name        string `json:"name,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+type Upload struct {
+	ID          string       `json:"upload_id"`
+	Name        string       `json:"name"`
+	ContentType string       `json:"content_type,omitempty"`
+	Description string       `json:"description,omitempty"`
+	Created     time.Time    `json:"created"`
+	Parts       []UploadPart `json:"parts,omitempty"`
+}
+
+type UploadPart struct {
+	Number int    `json:"part"`
+	Size   uint64 `json:"size"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// getUploadBucket gets the bucket tracking in-progress multipart uploads for the given prefix
+func (s *Server) getUploadBucket(prefix string) (nats.KeyValue, error) {
+	return s.getBucket(prefix + "-uploads")
+}
+
+// uploadPartObject returns the object store name holding a single uploaded part
+func uploadPartObject(uploadID string, part int) string {
+	return fmt.Sprintf("uploads/%s/%d", uploadID, part)
+}
+
+// getUpload loads an upload and the parts received so far
+func getUpload(bucket nats.KeyValue, uploadID string) (*Upload, error) {
+	entry, err := bucket.Get(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	var upload Upload
+	if err := json.Unmarshal(entry.Value(), &upload); err != nil {
+		return nil, fmt.Errorf("invalid upload state: %v", err)
+	}
+
+	watcher, err := bucket.Watch(uploadID+".part.*", nats.IgnoreDeletes())
+	if err != nil {
+		return nil, err
+	}
+	defer watcher.Stop()
+
+	upload.Parts = make([]UploadPart, 0)
+	for update := range watcher.Updates() {
+		if update == nil {
+			break
+		}
+		var part UploadPart
+		if err := json.Unmarshal(update.Value(), &part); err != nil {
+			log.Printf("Skipping invalid part record %s: %v", update.Key(), err)
+			continue
+		}
+		upload.Parts = append(upload.Parts, part)
+	}
+	sort.Slice(upload.Parts, func(i, j int) bool {
+		return upload.Parts[i].Number < upload.Parts[j].Number
+	})
+	return &upload, nil
+}
+
+func (s *Server) handleUploadInitiate(w http.ResponseWriter, r *http.Request) {
+	var req UploadRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+
+	if req.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "name is required"})
+		return
+	}
+	if isReservedObject(req.Name) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("name must not start with %s", strings.Join(reservedObjectPrefixes, ", "))})
+		return
+	}
+	if !s.checkKeyAccess(w, r, req.Name, permWrite) {
+		return
+	}
+
+	// Get the bucket for this request
+	prefix := getRequestPrefix(r)
+	bucket, err := s.getUploadBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	upload := Upload{
+		ID:          uuid.New().String(),
+		Name:        req.Name,
+		ContentType: req.ContentType,
+		Description: req.Description,
+		Created:     time.Now().UTC(),
+	}
+	value, err := json.Marshal(upload)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if _, err := bucket.Put(upload.ID, value); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: upload})
+}
+
+// handleUploadPart stores one part of a multipart upload. The part content is the raw
+// request body, and the upload_id and part number are passed as query parameters.
+// Uploading the same part number again replaces it, so interrupted parts can be retried.
+func (s *Server) handleUploadPart(w http.ResponseWriter, r *http.Request) {
+	uploadID := r.URL.Query().Get("upload_id")
+	part, err := strconv.Atoi(r.URL.Query().Get("part"))
+	if uploadID == "" || err != nil || part < 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "upload_id and a part number of at least 1 are required"})
+		return
+	}
+
+	// Get the stores for this request
+	prefix := getRequestPrefix(r)
+	bucket, err := s.getUploadBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	entry, err := bucket.Get(uploadID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("upload %s: %v", uploadID, err)})
+		return
+	}
+	var upload Upload
+	if err := json.Unmarshal(entry.Value(), &upload); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid upload state: %v", err)})
+		return
+	}
+	if !s.checkKeyAccess(w, r, upload.Name, permWrite) {
+		return
+	}
+	store, err := s.getObjectStore(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	info, err := store.Put(&nats.ObjectMeta{Name: uploadPartObject(uploadID, part)}, r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("part exceeds the maximum size of %d bytes", tooLarge.Limit)})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	record := UploadPart{Number: part, Size: info.Size, Digest: info.Digest}
+	value, err := json.Marshal(record)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if _, err := bucket.Put(fmt.Sprintf("%s.part.%d", uploadID, part), value); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: record})
+}
+
+func (s *Server) handleUploadStatus(w http.ResponseWriter, r *http.Request) {
+	var req UploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	if req.UploadID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "upload_id is required"})
+		return
+	}
+
+	// Get the bucket for this request
+	prefix := getRequestPrefix(r)
+	bucket, err := s.getUploadBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	upload, err := getUpload(bucket, req.UploadID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if !s.checkKeyAccess(w, r, upload.Name, permRead) {
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: upload})
+}
+
+func (s *Server) handleUploadComplete(w http.ResponseWriter, r *http.Request) {
+	var req UploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	if req.UploadID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "upload_id is required"})
+		return
+	}
+
+	// Get the stores for this request
+	prefix := getRequestPrefix(r)
+	bucket, err := s.getUploadBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	store, err := s.getObjectStore(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	upload, err := getUpload(bucket, req.UploadID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if !s.checkKeyAccess(w, r, upload.Name, permWrite) {
+		return
+	}
+
+	// Parts must be contiguous from 1 so that no data is silently missing
+	if len(upload.Parts) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "no parts have been uploaded"})
+		return
+	}
+	for i, part := range upload.Parts {
+		if part.Number != i+1 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("part %d is missing", i+1)})
+			return
+		}
+	}
+
+	// Stream the parts in order into the final object
+	pr, pw := io.Pipe()
+	go func() {
+		for _, part := range upload.Parts {
+			result, err := store.Get(uploadPartObject(upload.ID, part.Number))
+			if err != nil {
+				pw.CloseWithError(fmt.Errorf("failed to read part %d: %v", part.Number, err))
+				return
+			}
+			_, err = io.Copy(pw, result)
+			result.Close()
+			if err != nil {
+				pw.CloseWithError(fmt.Errorf("failed to read part %d: %v", part.Number, err))
+				return
+			}
+		}
+		pw.Close()
+	}()
+
+	meta := &nats.ObjectMeta{
+		Name:        upload.Name,
+		Description: upload.Description,
+	}
+	if upload.ContentType != "" {
+		meta.Headers = nats.Header{"Content-Type": []string{upload.ContentType}}
+	}
+	info, err := store.Put(meta, pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	s.removeUpload(bucket, store, upload)
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: map[string]interface{}{
+		"name":   info.Name,
+		"size":   info.Size,
+		"digest": info.Digest,
+	}})
+}
+
+func (s *Server) handleUploadAbort(w http.ResponseWriter, r *http.Request) {
+	var req UploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	if req.UploadID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "upload_id is required"})
+		return
+	}
+
+	// Get the stores for this request
+	prefix := getRequestPrefix(r)
+	bucket, err := s.getUploadBucket(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	store, err := s.getObjectStore(prefix)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	upload, err := getUpload(bucket, req.UploadID)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if !s.checkKeyAccess(w, r, upload.Name, permWrite) {
+		return
+	}
+
+	s.removeUpload(bucket, store, upload)
+	json.NewEncoder(w).Encode(KVResponse{Success: true})
+}
+
+// removeUpload deletes the stored parts and the tracking records of an upload
+func (s *Server) removeUpload(bucket nats.KeyValue, store nats.ObjectStore, upload *Upload) {
+	for _, part := range upload.Parts {
+		if err := store.Delete(uploadPartObject(upload.ID, part.Number)); err != nil {
+			log.Printf("Failed to delete upload part %s: %v", uploadPartObject(upload.ID, part.Number), err)
+		}
+		if err := bucket.Purge(fmt.Sprintf("%s.part.%d", upload.ID, part.Number)); err != nil {
+			log.Printf("Failed to purge upload part record: %v", err)
+		}
+	}
+	if err := bucket.Purge(upload.ID); err != nil {
+		log.Printf("Failed to purge upload %s: %v", upload.ID, err)
+	}
+}
+
+// isUploadPart reports whether the request carries raw part content rather than JSON
+func isUploadPart(r *http.Request) bool {
+	return r.URL.Path == "/api/v1/objects/upload/part"
+}
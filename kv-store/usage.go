@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// usageBucket is the system bucket holding metered usage per day, workspace and principal
+const usageBucket = "system-usage"
+
+// Usage is the metered usage of one principal in one workspace on one day (UTC)
+type Usage struct {
+	Day       string `json:"day"`
+	Workspace string `json:"workspace_prefix"`
+	Principal string `json:"principal"`
+	Requests  int64  `json:"requests"`
+	Rejected  int64  `json:"rate_limited"`
+	BytesIn   int64  `json:"bytes_in"`
+	BytesOut  int64  `json:"bytes_out"`
+}
+
+type UsageRequest struct {
+	Workspace   string `json:"workspace,omitempty"`
+	WorkspaceID string `json:"workspace_prefix,omitempty"`
+	Principal   string `json:"principal,omitempty"`
+	From        string `json:"from,omitempty"`
+	To          string `json:"to,omitempty"`
+}
+
+// key returns the usage bucket key of the record. Principals may contain characters that
+// are not valid in keys, so they are encoded.
+func (u *Usage) key() string {
+	return u.Day + "." + u.Workspace + "." + base64.RawURLEncoding.EncodeToString([]byte(u.Principal))
+}
+
+// merge adds the counts of other to the usage
+func (u *Usage) merge(other *Usage) {
+	u.Requests += other.Requests
+	u.Rejected += other.Rejected
+	u.BytesIn += other.BytesIn
+	u.BytesOut += other.BytesOut
+}
+
+// usageMeter accumulates usage in memory and periodically flushes it to the usage bucket,
+// the same way the access tracker handles key statistics
+type usageMeter struct {
+	lock    sync.Mutex
+	pending map[string]*Usage
+	// periods accumulates the usage of each workspace since its last usage record, when
+	// usage records are written
+	periods map[string]*Usage
+	// flushLock serializes flushes, which read, merge and rewrite the same usage keys
+	flushLock sync.Mutex
+}
+
+func newUsageMeter(records bool) *usageMeter {
+	m := &usageMeter{
+		pending: map[string]*Usage{},
+	}
+	if records {
+		m.periods = map[string]*Usage{}
+	}
+	return m
+}
+
+// record meters one request of a principal in a workspace
+func (m *usageMeter) record(workspace, principal string, bytesIn, bytesOut int64, rejected bool) {
+	delta := &Usage{
+		Day:       time.Now().UTC().Format(time.DateOnly),
+		Workspace: workspace,
+		Principal: principal,
+		Requests:  1,
+		BytesIn:   bytesIn,
+		BytesOut:  bytesOut,
+	}
+	if rejected {
+		delta.Requests = 0
+		delta.Rejected = 1
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	key := delta.key()
+	if usage, ok := m.pending[key]; ok {
+		usage.merge(delta)
+	} else {
+		m.pending[key] = delta
+	}
+	if m.periods != nil {
+		if usage, ok := m.periods[workspace]; ok {
+			usage.merge(delta)
+		} else {
+			period := *delta
+			m.periods[workspace] = &period
+		}
+	}
+}
+
+// take removes and returns all unflushed usage
+func (m *usageMeter) take() map[string]*Usage {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	pending := m.pending
+	m.pending = map[string]*Usage{}
+	return pending
+}
+
+// getPrincipal returns the principal usage of a request is metered against
+func getPrincipal(r *http.Request) string {
+	if claims := getClaims(r); claims != nil && claims.ID != "" {
+		return "token:" + claims.ID
+	}
+	return "anonymous"
+}
+
+// rateLimitKey returns the key a token is rate limited by. Tokens delegated from another
+// token share the limit of the credential they were delegated from.
+func (c *TokenClaims) rateLimitKey() string {
+	if c.Root != "" {
+		return c.Root
+	}
+	return c.ID
+}
+
+// checkRateLimit writes a 429 response and returns false if the request's token has
+// exceeded its rate limit. Requests without a token are not limited here.
+func (s *Server) checkRateLimit(w http.ResponseWriter, r *http.Request) bool {
+	claims := getClaims(r)
+	if claims == nil {
+		return true
+	}
+	limit := s.tokenRateLimit
+	if claims.RateLimit > 0 {
+		limit = claims.RateLimit
+	}
+	result := s.tokenLimiter.take(claims.rateLimitKey(), limit, s.tokenRateBurst)
+	if result.Limit == 0 {
+		return true
+	}
+	setRateLimitHeaders(w, result)
+	if !result.Allowed {
+		w.Header().Set("Retry-After", formatRetryAfter(result.RetryAfter))
+		w.WriteHeader(http.StatusTooManyRequests)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Code: errCodeRateLimited, Error: "rate limit exceeded"})
+	}
+	return result.Allowed
+}
+
+// setRateLimitHeaders reports the limit, the requests left in the current burst and the
+// seconds until the burst has refilled
+func setRateLimitHeaders(w http.ResponseWriter, result rateLimitResult) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(int64((result.Reset+time.Second-1)/time.Second), 10))
+}
+
+// formatRetryAfter formats a wait as whole seconds for the Retry-After header
+func formatRetryAfter(wait time.Duration) string {
+	seconds := int64((wait + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.FormatInt(seconds, 10)
+}
+
+// flushUsage merges all unflushed usage into the usage bucket
+func (s *Server) flushUsage() {
+	s.usage.flushLock.Lock()
+	defer s.usage.flushLock.Unlock()
+
+	pending := s.usage.take()
+	if len(pending) == 0 {
+		return
+	}
+	bucket, err := s.getBucket(usageBucket)
+	if err != nil {
+		log.Printf("Failed to flush usage: %v", err)
+		return
+	}
+	for key, delta := range pending {
+		usage := *delta
+		if entry, err := bucket.Get(key); err == nil {
+			var stored Usage
+			if err := json.Unmarshal(entry.Value(), &stored); err == nil {
+				usage.merge(&stored)
+			}
+		}
+		value, err := json.Marshal(usage)
+		if err != nil {
+			continue
+		}
+		if _, err := bucket.Put(key, value); err != nil {
+			log.Printf("Failed to flush usage for %s: %v", key, err)
+		}
+	}
+}
+
+// handleUsage reports metered usage per day, workspace and principal, optionally filtered
+// by workspace, principal and an inclusive range of days
+func (s *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	var req UsageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+	for _, day := range []string{req.From, req.To} {
+		if _, err := time.Parse(time.DateOnly, day); day != "" && err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "from and to must be dates such as 2006-01-02"})
+			return
+		}
+	}
+	workspace := req.WorkspaceID
+	if workspace == "" && req.Workspace != "" {
+		workspace = getWorkspacePrefix(req.Workspace)
+	}
+
+	// Make sure recent requests are included in the report
+	s.flushUsage()
+
+	bucket, err := s.getBucket(usageBucket)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	usage := make([]Usage, 0)
+	err = scanBucket(bucket, func(entry nats.KeyValueEntry) {
+		var u Usage
+		if err := json.Unmarshal(entry.Value(), &u); err != nil {
+			return
+		}
+		if (workspace != "" && u.Workspace != workspace) ||
+			(req.Principal != "" && u.Principal != req.Principal) ||
+			(req.From != "" && u.Day < req.From) ||
+			(req.To != "" && u.Day > req.To) {
+			return
+		}
+		usage = append(usage, u)
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].key() < usage[j].key()
+	})
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: usage})
+}
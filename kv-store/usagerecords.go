@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// usageRecordBucket is the system bucket holding a usage record per metering period and
+// workspace, for operators to allocate costs by
+const usageRecordBucket = "system-usage-records"
+
+// usageRecordTime formats the start of a period in record keys, which can't contain colons
+const usageRecordTime = "20060102T150405Z"
+
+// UsageRecord is the consumption of one workspace in one period of KV_USAGE_RECORD_INTERVAL:
+// the requests and bandwidth of the period, and the bytes its buckets stored at its end
+type UsageRecord struct {
+	Period      time.Time `json:"period"`
+	Interval    string    `json:"interval"`
+	Workspace   string    `json:"workspace_prefix"`
+	Requests    int64     `json:"requests"`
+	Rejected    int64     `json:"rate_limited"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	StoredBytes uint64    `json:"stored_bytes"`
+	Buckets     int       `json:"buckets"`
+}
+
+type UsageRecordsRequest struct {
+	Workspace   string `json:"workspace,omitempty"`
+	WorkspaceID string `json:"workspace_prefix,omitempty"`
+	// From and To select the periods starting in an inclusive range, as dates or times
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+	Format string `json:"format,omitempty"`
+}
+
+func (u *UsageRecord) key() string {
+	return u.Period.Format(usageRecordTime) + "." + u.Workspace
+}
+
+// bucketWorkspace returns the workspace a KV bucket or object store belongs to. Every bucket
+// but the system buckets is named after its workspace prefix, alone or followed by a dash.
+func bucketWorkspace(name string) (string, bool) {
+	if strings.HasPrefix(name, "system-") {
+		return "", false
+	}
+	workspace, _, _ := strings.Cut(name, "-")
+	return workspace, workspace != ""
+}
+
+// storedBytes sums the bytes stored by the KV buckets and object stores of each workspace,
+// counting the buckets they are stored in
+func (s *Server) storedBytes() (map[string]*UsageRecord, error) {
+	js, err := s.nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+	stored := map[string]*UsageRecord{}
+	for info := range js.StreamsInfo() {
+		name, ok := strings.CutPrefix(info.Config.Name, "KV_")
+		if !ok {
+			if name, ok = strings.CutPrefix(info.Config.Name, "OBJ_"); !ok {
+				continue
+			}
+		}
+		workspace, ok := bucketWorkspace(name)
+		if !ok {
+			continue
+		}
+		record, ok := stored[workspace]
+		if !ok {
+			record = &UsageRecord{Workspace: workspace}
+			stored[workspace] = record
+		}
+		record.StoredBytes += info.State.Bytes
+		record.Buckets++
+	}
+	return stored, nil
+}
+
+// runUsageRecorder writes the usage records of each period as it ends. Periods are aligned
+// to multiples of the interval, so hourly records cover whole hours.
+func (s *Server) runUsageRecorder() {
+	for {
+		next := time.Now().UTC().Truncate(s.usageRecordInterval).Add(s.usageRecordInterval)
+		time.Sleep(time.Until(next))
+		s.writeUsageRecords(next.Add(-s.usageRecordInterval))
+	}
+}
+
+// writeUsageRecords writes the usage metered since the last records into the records of the
+// period starting at period, along with the bytes each workspace stores now. Workspaces
+// without requests get a record too, as they are still charged for their storage. Records
+// written for a period before are added to, so a restart in the middle of a period doesn't
+// lose the usage metered before it.
+func (s *Server) writeUsageRecords(period time.Time) {
+	s.usage.flushLock.Lock()
+	defer s.usage.flushLock.Unlock()
+
+	s.usage.lock.Lock()
+	metered := s.usage.periods
+	s.usage.periods = map[string]*Usage{}
+	s.usage.lock.Unlock()
+
+	records, err := s.storedBytes()
+	if err != nil {
+		log.Printf("Failed to measure stored bytes for usage records: %v", err)
+		records = map[string]*UsageRecord{}
+	}
+	for workspace, usage := range metered {
+		record, ok := records[workspace]
+		if !ok {
+			record = &UsageRecord{Workspace: workspace}
+			records[workspace] = record
+		}
+		record.Requests = usage.Requests
+		record.Rejected = usage.Rejected
+		record.BytesIn = usage.BytesIn
+		record.BytesOut = usage.BytesOut
+	}
+	if len(records) == 0 {
+		return
+	}
+
+	bucket, err := s.getBucket(usageRecordBucket)
+	if err != nil {
+		log.Printf("Failed to write usage records: %v", err)
+		return
+	}
+	for _, record := range records {
+		record.Period = period
+		record.Interval = s.usageRecordInterval.String()
+		if entry, err := bucket.Get(record.key()); err == nil {
+			var stored UsageRecord
+			if err := json.Unmarshal(entry.Value(), &stored); err == nil {
+				record.Requests += stored.Requests
+				record.Rejected += stored.Rejected
+				record.BytesIn += stored.BytesIn
+				record.BytesOut += stored.BytesOut
+			}
+		}
+		value, err := json.Marshal(record)
+		if err != nil {
+			continue
+		}
+		if _, err := bucket.Put(record.key(), value); err != nil {
+			log.Printf("Failed to write the usage record %s: %v", record.key(), err)
+		}
+	}
+}
+
+// parseUsageTime parses the bounds of a usage export, which are dates or RFC 3339 times. A
+// date as the upper bound includes the whole day.
+func parseUsageTime(value string, end bool) (time.Time, error) {
+	if day, err := time.Parse(time.DateOnly, value); err == nil {
+		if end {
+			return day.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+		}
+		return day, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// writeUsageRecordsCSV writes usage records as CSV with a header row
+func writeUsageRecordsCSV(w io.Writer, records []UsageRecord) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"period", "interval", "workspace_prefix", "requests", "rate_limited", "bytes_in", "bytes_out", "stored_bytes", "buckets"})
+	for _, record := range records {
+		out.Write([]string{
+			record.Period.Format(time.RFC3339),
+			record.Interval,
+			record.Workspace,
+			strconv.FormatInt(record.Requests, 10),
+			strconv.FormatInt(record.Rejected, 10),
+			strconv.FormatInt(record.BytesIn, 10),
+			strconv.FormatInt(record.BytesOut, 10),
+			strconv.FormatUint(record.StoredBytes, 10),
+			strconv.Itoa(record.Buckets),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// handleUsageRecords exports the usage records of every workspace, or of one, as JSON or
+// CSV, optionally limited to the periods starting in a range
+func (s *Server) handleUsageRecords(w http.ResponseWriter, r *http.Request) {
+	var req UsageRecordsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+	if req.Format != "" && req.Format != "json" && req.Format != "csv" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "format must be json or csv"})
+		return
+	}
+	var from, to time.Time
+	for _, bound := range []struct {
+		value string
+		end   bool
+		time  *time.Time
+	}{{req.From, false, &from}, {req.To, true, &to}} {
+		if bound.value == "" {
+			continue
+		}
+		t, err := parseUsageTime(bound.value, bound.end)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "from and to must be dates such as 2006-01-02 or times such as 2006-01-02T15:04:05Z"})
+			return
+		}
+		*bound.time = t
+	}
+	workspace := req.WorkspaceID
+	if workspace == "" && req.Workspace != "" {
+		workspace = getWorkspacePrefix(req.Workspace)
+	}
+
+	bucket, err := s.getBucket(usageRecordBucket)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	records := make([]UsageRecord, 0)
+	err = scanBucket(bucket, func(entry nats.KeyValueEntry) {
+		var record UsageRecord
+		if err := json.Unmarshal(entry.Value(), &record); err != nil {
+			return
+		}
+		if (workspace != "" && record.Workspace != workspace) ||
+			(!from.IsZero() && record.Period.Before(from)) ||
+			(!to.IsZero() && record.Period.After(to)) {
+			return
+		}
+		records = append(records, record)
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	slices.SortFunc(records, func(a, b UsageRecord) int {
+		if c := a.Period.Compare(b.Period); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Workspace, b.Workspace)
+	})
+
+	if req.Format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+		if err := writeUsageRecordsCSV(w, records); err != nil {
+			log.Printf("Failed to write usage records: %v", err)
+		}
+		return
+	}
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: records})
+}
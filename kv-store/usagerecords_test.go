@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucketWorkspace(t *testing.T) {
+	for name, want := range map[string]string{"abc": "abc", "abc-stats": "abc", "abc-tool-search": "abc", "abc-user-0123456789abcdef": "abc"} {
+		if workspace, ok := bucketWorkspace(name); !ok || workspace != want {
+			t.Errorf("bucketWorkspace(%q) = %q, %v, want %q", name, workspace, ok, want)
+		}
+	}
+	for _, name := range []string{"system-usage", "system-usage-records", "-x"} {
+		if _, ok := bucketWorkspace(name); ok {
+			t.Errorf("bucketWorkspace(%q) should not belong to a workspace", name)
+		}
+	}
+}
+
+func TestUsageMeterPeriods(t *testing.T) {
+	m := newUsageMeter(true)
+	m.record("abc", "token:t1", 10, 100, false)
+	m.record("abc", "token:t2", 5, 50, false)
+	m.record("abc", "anonymous", 1, 0, true)
+	m.record("def", "anonymous", 1, 2, false)
+	if usage := m.periods["abc"]; usage == nil || usage.Requests != 2 || usage.Rejected != 1 || usage.BytesIn != 16 || usage.BytesOut != 150 {
+		t.Errorf("unexpected period usage %+v", usage)
+	}
+	// Per principal usage is kept apart from the period totals
+	if len(m.pending) != 4 || m.pending[(&Usage{Day: time.Now().UTC().Format(time.DateOnly), Workspace: "abc", Principal: "token:t1"}).key()].Requests != 1 {
+		t.Errorf("unexpected pending usage %v", m.pending)
+	}
+	m = newUsageMeter(false)
+	m.record("abc", "anonymous", 1, 1, false)
+	if m.periods != nil {
+		t.Error("usage periods must not be kept without usage records")
+	}
+}
+
+func TestParseUsageTime(t *testing.T) {
+	from, _ := parseUsageTime("2024-03-01", false)
+	to, _ := parseUsageTime("2024-03-01", true)
+	if !from.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)) || !to.Equal(time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC).Add(-time.Nanosecond)) {
+		t.Errorf("unexpected bounds %v and %v", from, to)
+	}
+	if at, err := parseUsageTime("2024-03-01T12:00:00Z", true); err != nil || at.Hour() != 12 {
+		t.Errorf("parseUsageTime = %v, %v", at, err)
+	}
+	if _, err := parseUsageTime("yesterday", false); err == nil {
+		t.Error("expected an error for an invalid time")
+	}
+}
+
+func TestWriteUsageRecordsCSV(t *testing.T) {
+	var out bytes.Buffer
+	records := []UsageRecord{{Period: time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC), Interval: "1h0m0s", Workspace: "abc", Requests: 3, BytesIn: 10, BytesOut: 20, StoredBytes: 4096, Buckets: 2}}
+	if err := writeUsageRecordsCSV(&out, records); err != nil {
+		t.Fatal(err)
+	}
+	want := "period,interval,workspace_prefix,requests,rate_limited,bytes_in,bytes_out,stored_bytes,buckets\n2024-03-01T10:00:00Z,1h0m0s,abc,3,0,10,20,4096,2\n"
+	if out.String() != want {
+		t.Errorf("unexpected CSV:\n%s", out.String())
+	}
+	if key := records[0].key(); key != "20240301T100000Z.abc" {
+		t.Errorf("unexpected key %s", key)
+	}
+}
+
+func TestHandleUsageRecordsValidation(t *testing.T) {
+	s := newTestServer()
+	for _, body := range []string{`{"format":"xml"}`, `{"from":"last week"}`, `{"to":"2024-13-01"}`, `not json`} {
+		w := httptest.NewRecorder()
+		s.handleUsageRecords(w, httptest.NewRequest("POST", "/api/admin/usage/records", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", body, w.Code)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// maxWatchSubscriptions limits the prefixes a single watch connection subscribes to
+const maxWatchSubscriptions = 50
+
+// watchKeepAlive is how often an idle watch connection is sent a comment, so proxies don't
+// close it
+const watchKeepAlive = 30 * time.Second
+
+// WatchSubscription selects the keys of the workspace with a prefix. Its ID is returned with
+// every event matching it, so a client can route events without matching keys itself.
+type WatchSubscription struct {
+	ID     string `json:"id"`
+	Prefix string `json:"prefix"`
+}
+
+// WatchRequest subscribes to a single prefix, or to several with subscriptions
+type WatchRequest struct {
+	Prefix        string              `json:"prefix,omitempty"`
+	Subscriptions []WatchSubscription `json:"subscriptions,omitempty"`
+	// LastEventID resumes a watch after the event with this ID, a revision, like the
+	// Last-Event-ID header an EventSource sends when it reconnects
+	LastEventID flexibleInt `json:"last_event_id,omitempty"`
+}
+
+// WatchEvent is a change to a key, sent as a server-sent event
+type WatchEvent struct {
+	Subscriptions []string  `json:"subscriptions,omitempty"`
+	Key           string    `json:"key"`
+	Operation     string    `json:"operation"`
+	Revision      uint64    `json:"revision"`
+	Value         string    `json:"value,omitempty"`
+	Time          time.Time `json:"time"`
+}
+
+// watchOperation names the operation of a watched entry like the change feed does
+func watchOperation(op nats.KeyValueOp) string {
+	switch op {
+	case nats.KeyValueDelete:
+		return "delete"
+	case nats.KeyValuePurge:
+		return "purge"
+	default:
+		return "put"
+	}
+}
+
+// subscriptions validates the subscriptions of a request. A request with only a prefix has
+// a single subscription without an ID.
+func (req WatchRequest) subscriptions() ([]WatchSubscription, error) {
+	if len(req.Subscriptions) == 0 {
+		return []WatchSubscription{{Prefix: req.Prefix}}, nil
+	}
+	if req.Prefix != "" {
+		return nil, fmt.Errorf("prefix and subscriptions can't be combined")
+	}
+	if len(req.Subscriptions) > maxWatchSubscriptions {
+		return nil, fmt.Errorf("at most %d subscriptions are allowed", maxWatchSubscriptions)
+	}
+	seen := map[string]bool{}
+	for _, sub := range req.Subscriptions {
+		if sub.ID == "" {
+			return nil, fmt.Errorf("every subscription needs an id")
+		}
+		if seen[sub.ID] {
+			return nil, fmt.Errorf("duplicate subscription id %s", sub.ID)
+		}
+		seen[sub.ID] = true
+	}
+	return req.Subscriptions, nil
+}
+
+// matchSubscriptions returns the IDs of the subscriptions whose prefix matches a key, and
+// whether any did
+func matchSubscriptions(subs []WatchSubscription, key string) ([]string, bool) {
+	var ids []string
+	matched := false
+	for _, sub := range subs {
+		if strings.HasPrefix(key, sub.Prefix) {
+			matched = true
+			if sub.ID != "" {
+				ids = append(ids, sub.ID)
+			}
+		}
+	}
+	return ids, matched
+}
+
+// resumeRevision returns the revision a watch resumes after, from the Last-Event-ID header
+// or else the request, or 0 for a new watch
+func resumeRevision(r *http.Request, req WatchRequest) (uint64, error) {
+	if header := r.Header.Get("Last-Event-ID"); header != "" {
+		revision, err := strconv.ParseUint(header, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid Last-Event-ID %q, must be the id of an event", header)
+		}
+		return revision, nil
+	}
+	if req.LastEventID < 0 {
+		return 0, fmt.Errorf("last_event_id must be the id of an event")
+	}
+	return uint64(req.LastEventID), nil
+}
+
+// handleWatch streams the changes to keys of the workspace as server-sent events until the
+// client disconnects. One connection can subscribe to many prefixes; the bucket is watched
+// once and each change is sent once, naming every subscription it matches. Events carry
+// their revision as ID, so a client reconnecting with the last one gets the changes it
+// missed. Revisions trimmed from the history of a key in the meantime are skipped, its
+// latest revision is still sent.
+func (s *Server) handleWatch(w http.ResponseWriter, r *http.Request) {
+	var req WatchRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+	subs, err := req.subscriptions()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	after, err := resumeRevision(r, req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	bucket, err := s.getBucket(s.getDataPrefix(r, false))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	// A resumed watch reads the kept history to find the changes made after its last event
+	start := nats.UpdatesOnly()
+	if after > 0 {
+		start = nats.IncludeHistory()
+	}
+	watcher, err := bucket.WatchAll(start)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	defer watcher.Stop()
+
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := controller.Flush(); err != nil {
+		return
+	}
+
+	canRead := s.readFilter(r)
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.stopping:
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case entry, ok := <-watcher.Updates():
+			if !ok {
+				return
+			}
+			if entry == nil || entry.Revision() <= after {
+				continue
+			}
+			ids, matched := matchSubscriptions(subs, entry.Key())
+			if !matched || !canRead(entry.Key()) {
+				continue
+			}
+			event := WatchEvent{
+				Subscriptions: ids,
+				Key:           entry.Key(),
+				Operation:     watchOperation(entry.Operation()),
+				Revision:      entry.Revision(),
+				Time:          entry.Created().UTC(),
+			}
+			if entry.Operation() == nats.KeyValuePut {
+				event.Value = string(entry.Value())
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Revision, event.Operation, data); err != nil {
+				return
+			}
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
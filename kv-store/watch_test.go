@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWatchSubscriptions(t *testing.T) {
+	subs, err := WatchRequest{Prefix: "config/"}.subscriptions()
+	if err != nil || len(subs) != 1 || subs[0].Prefix != "config/" || subs[0].ID != "" {
+		t.Fatalf("a prefix should be a single subscription, got %+v, %v", subs, err)
+	}
+
+	for name, req := range map[string]WatchRequest{
+		"missing id":   {Subscriptions: []WatchSubscription{{Prefix: "a/"}}},
+		"duplicate id": {Subscriptions: []WatchSubscription{{ID: "a", Prefix: "a/"}, {ID: "a", Prefix: "b/"}}},
+		"combined":     {Prefix: "a/", Subscriptions: []WatchSubscription{{ID: "a", Prefix: "a/"}}},
+	} {
+		if _, err := req.subscriptions(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestMatchSubscriptions(t *testing.T) {
+	subs := []WatchSubscription{{ID: "config", Prefix: "config/"}, {ID: "all", Prefix: ""}, {ID: "db", Prefix: "config/db/"}}
+	if ids, ok := matchSubscriptions(subs, "config/db/host"); !ok || strings.Join(ids, ",") != "config,all,db" {
+		t.Errorf("got %v, %v", ids, ok)
+	}
+	if ids, ok := matchSubscriptions(subs[:1], "cache/x"); ok || ids != nil {
+		t.Errorf("got %v, %v", ids, ok)
+	}
+	if ids, ok := matchSubscriptions([]WatchSubscription{{Prefix: "cache/"}}, "cache/x"); !ok || ids != nil {
+		t.Errorf("subscriptions without an id should match without naming it, got %v, %v", ids, ok)
+	}
+}
+
+func TestWatchResume(t *testing.T) {
+	t.Setenv("KV_HISTORY", "5")
+	s := newStoreServer(t)
+	for _, req := range []KVRequest{{Key: "a", Value: "1"}, {Key: "a", Value: "2"}, {Key: "b", Value: "1"}} {
+		if status, response := call(t, s, "ws1", "/api/v1/put", req); status != http.StatusOK {
+			t.Fatalf("put %s = %d, %+v", req.Key, status, response)
+		}
+	}
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	// An EventSource reconnecting after the first event gets the changes made since
+	r, err := http.NewRequest(http.MethodGet, server.URL+"/api/v1/watch", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("X-GPTScript-Env", "GPTSCRIPT_WORKSPACE_ID=ws1")
+	r.Header.Set("Last-Event-ID", "1")
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("watch = %d", resp.StatusCode)
+	}
+
+	events := bufio.NewScanner(resp.Body)
+	nextID := func() string {
+		t.Helper()
+		for events.Scan() {
+			if id, ok := strings.CutPrefix(events.Text(), "id: "); ok {
+				return id
+			}
+		}
+		t.Fatalf("watch ended: %v", events.Err())
+		return ""
+	}
+	for _, want := range []string{"2", "3"} {
+		if id := nextID(); id != want {
+			t.Errorf("event id = %s, want %s", id, want)
+		}
+	}
+	// Changes made after resuming follow
+	if status, response := call(t, s, "ws1", "/api/v1/put", KVRequest{Key: "c", Value: "1"}); status != http.StatusOK {
+		t.Fatalf("put c = %d, %+v", status, response)
+	}
+	if id := nextID(); id != "4" {
+		t.Errorf("event id = %s, want 4", id)
+	}
+}
+
+func TestResumeRevision(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/watch", nil)
+	if revision, err := resumeRevision(r, WatchRequest{LastEventID: 7}); err != nil || revision != 7 {
+		t.Errorf("resumeRevision = %d, %v, want 7", revision, err)
+	}
+	// The header an EventSource sends takes precedence
+	r.Header.Set("Last-Event-ID", "9")
+	if revision, err := resumeRevision(r, WatchRequest{LastEventID: 7}); err != nil || revision != 9 {
+		t.Errorf("resumeRevision = %d, %v, want 9", revision, err)
+	}
+	r.Header.Set("Last-Event-ID", "latest")
+	if _, err := resumeRevision(r, WatchRequest{}); err == nil {
+		t.Error("expected an error for an invalid Last-Event-ID")
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// globalWebhookID identifies KV_WEBHOOK_URL in dead letters and target state
+const globalWebhookID = "global"
+
+// webhookDispatcher delivers events with retries. Each target has a failure budget: after
+// that many deliveries in a row fail, the target is suspended for a while and its events
+// go straight to the dead letters, so a dead receiver doesn't tie up deliveries.
+type webhookDispatcher struct {
+	url         string
+	secret      string
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	budget      int
+	suspend     time.Duration
+	deadLetter  time.Duration
+
+	lock    sync.Mutex
+	targets map[string]*webhookTargetState
+	// pending counts the deliveries being sent or waiting to be retried
+	pending atomic.Int64
+}
+
+// webhookTargetState tracks the recent deliveries to a target
+type webhookTargetState struct {
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	SuspendedUntil      *time.Time `json:"suspended_until,omitempty"`
+}
+
+// newWebhookDispatcher configures delivery from KV_WEBHOOK_URL (signed with
+// KV_WEBHOOK_SECRET when set), KV_WEBHOOK_MAX_ATTEMPTS,
+// KV_WEBHOOK_RETRY_BACKOFF, KV_WEBHOOK_MAX_BACKOFF, KV_WEBHOOK_FAILURE_BUDGET,
+// KV_WEBHOOK_SUSPEND and KV_WEBHOOK_DEAD_LETTER_TTL
+func newWebhookDispatcher() (*webhookDispatcher, error) {
+	d := &webhookDispatcher{
+		url:     getEnvOrDefault("KV_WEBHOOK_URL", ""),
+		secret:  getEnvOrDefault("KV_WEBHOOK_SECRET", ""),
+		targets: map[string]*webhookTargetState{},
+	}
+	if d.url != "" {
+		if err := validateWebhookURL(d.url); err != nil {
+			return nil, fmt.Errorf("invalid KV_WEBHOOK_URL: %v", err)
+		}
+	}
+
+	var err error
+	if d.maxAttempts, err = strconv.Atoi(getEnvOrDefault("KV_WEBHOOK_MAX_ATTEMPTS", "6")); err != nil || d.maxAttempts < 1 {
+		return nil, fmt.Errorf("invalid KV_WEBHOOK_MAX_ATTEMPTS: must be a positive number")
+	}
+	if d.budget, err = strconv.Atoi(getEnvOrDefault("KV_WEBHOOK_FAILURE_BUDGET", "10")); err != nil || d.budget < 1 {
+		return nil, fmt.Errorf("invalid KV_WEBHOOK_FAILURE_BUDGET: must be a positive number")
+	}
+	for _, setting := range []struct {
+		name   string
+		value  string
+		target *time.Duration
+	}{
+		{"KV_WEBHOOK_RETRY_BACKOFF", "1s", &d.backoff},
+		{"KV_WEBHOOK_MAX_BACKOFF", "5m", &d.maxBackoff},
+		{"KV_WEBHOOK_SUSPEND", "10m", &d.suspend},
+		{"KV_WEBHOOK_DEAD_LETTER_TTL", "168h", &d.deadLetter},
+	} {
+		duration, err := time.ParseDuration(getEnvOrDefault(setting.name, setting.value))
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid %s: must be a positive duration", setting.name)
+		}
+		*setting.target = duration
+	}
+	return d, nil
+}
+
+// retryDelay returns how long to wait before the next attempt: the backoff doubles with
+// each attempt up to the maximum, with jitter so retries of many events spread out
+func (d *webhookDispatcher) retryDelay(attempt int) time.Duration {
+	delay := d.backoff
+	for i := 1; i < attempt && delay < d.maxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, d.maxBackoff)
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// suspended reports whether a target used up its failure budget and is still suspended
+func (d *webhookDispatcher) suspended(id string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	state, ok := d.targets[id]
+	return ok && state.SuspendedUntil != nil && time.Now().Before(*state.SuspendedUntil)
+}
+
+// record updates the state of a target with the outcome of a delivery
+func (d *webhookDispatcher) record(id string, err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err == nil {
+		delete(d.targets, id)
+		return
+	}
+	state, ok := d.targets[id]
+	if !ok {
+		state = &webhookTargetState{}
+		d.targets[id] = state
+	}
+	state.ConsecutiveFailures++
+	state.LastError = err.Error()
+	if state.ConsecutiveFailures >= d.budget {
+		until := time.Now().Add(d.suspend).UTC()
+		state.SuspendedUntil = &until
+	}
+}
+
+// state returns a copy of the state of a target, nil when its last delivery succeeded
+func (d *webhookDispatcher) state(id string) *webhookTargetState {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if state, ok := d.targets[id]; ok {
+		copied := *state
+		return &copied
+	}
+	return nil
+}
+
+// failing counts the targets whose last delivery failed and those of them that are suspended
+func (d *webhookDispatcher) failing() (int, int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	suspended := 0
+	for _, state := range d.targets {
+		if state.SuspendedUntil != nil && time.Now().Before(*state.SuspendedUntil) {
+			suspended++
+		}
+	}
+	return len(d.targets), suspended
+}
+
+// retryable reports whether a failed delivery may succeed when sent again. Requests that
+// were rejected as invalid are not retried.
+func retryable(status int) bool {
+	return status == 0 || status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+}
+
+// deliver sends an event to a target, retrying with backoff. Events that can't be
+// delivered are recorded as dead letters of the workspace.
+func (s *Server) deliver(webhook Webhook, event KeyEvent, data []byte) {
+	d := s.webhooks
+	d.pending.Add(1)
+	defer d.pending.Add(-1)
+	if d.suspended(webhook.ID) {
+		s.recordDeadLetter(webhook, event, 0, fmt.Errorf("target is suspended after %d failed deliveries", d.budget))
+		return
+	}
+
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		var status int
+		if status, err = postWebhook(webhook, event, data); err == nil {
+			d.record(webhook.ID, nil)
+			return
+		}
+		if attempt >= d.maxAttempts || !retryable(status) {
+			break
+		}
+		time.Sleep(d.retryDelay(attempt))
+	}
+	d.record(webhook.ID, err)
+	s.recordDeadLetter(webhook, event, attempt, err)
+}
+
+// DeadLetter is an event that could not be delivered to a webhook
+type DeadLetter struct {
+	ID        string    `json:"id"`
+	WebhookID string    `json:"webhook_id"`
+	URL       string    `json:"url"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error"`
+	Failed    time.Time `json:"failed"`
+	Event     KeyEvent  `json:"event"`
+}
+
+type DeadLetterRequest struct {
+	ID        string `json:"id,omitempty"`
+	WebhookID string `json:"webhook_id,omitempty"`
+}
+
+// getDeadLetterBucket gets the bucket holding the dead letters of a workspace. Dead letters
+// expire after KV_WEBHOOK_DEAD_LETTER_TTL.
+func (s *Server) getDeadLetterBucket(workspace string) (nats.KeyValue, error) {
+	return s.getBucket(workspace + "-deadletters")
+}
+
+func (s *Server) recordDeadLetter(webhook Webhook, event KeyEvent, attempts int, err error) {
+	log.Printf("Failed to deliver %s event %s to %s after %d attempts: %v", event.Type, event.ID, webhook.URL, attempts, err)
+	deadLetter := DeadLetter{
+		ID:        uuid.New().String(),
+		WebhookID: webhook.ID,
+		URL:       webhook.URL,
+		Attempts:  attempts,
+		Error:     err.Error(),
+		Failed:    time.Now().UTC(),
+		Event:     event,
+	}
+	value, err := json.Marshal(deadLetter)
+	if err != nil {
+		return
+	}
+	bucket, err := s.getDeadLetterBucket(event.Workspace)
+	if err == nil {
+		_, err = bucket.Put(deadLetter.ID, value)
+	}
+	if err != nil {
+		log.Printf("Failed to record dead letter of event %s: %v", event.ID, err)
+	}
+}
+
+func (s *Server) handleDeadLetterList(w http.ResponseWriter, r *http.Request) {
+	var req DeadLetterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+
+	bucket, err := s.getDeadLetterBucket(getRequestPrefix(r))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	deadLetters := make([]DeadLetter, 0)
+	err = scanBucket(bucket, func(entry nats.KeyValueEntry) {
+		var deadLetter DeadLetter
+		if json.Unmarshal(entry.Value(), &deadLetter) != nil {
+			return
+		}
+		if req.WebhookID == "" || deadLetter.WebhookID == req.WebhookID {
+			deadLetters = append(deadLetters, deadLetter)
+		}
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: deadLetters})
+}
+
+func (s *Server) handleDeadLetterDelete(w http.ResponseWriter, r *http.Request) {
+	var req DeadLetterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+	if req.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "id is required"})
+		return
+	}
+
+	bucket, err := s.getDeadLetterBucket(getRequestPrefix(r))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if _, err := bucket.Get(req.ID); errors.Is(err, nats.ErrKeyNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "dead letter not found"})
+		return
+	}
+	if err := bucket.Purge(req.ID); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true})
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+)
+
+// Webhook event types
+const (
+	webhookEventExpired = "keys.expired"
+	// webhookEventChanged carries changes from the change feed. It is only sent when a
+	// replay is requested, so webhooks don't subscribe to it.
+	webhookEventChanged = "keys.changed"
+)
+
+// webhookEvents are the event types a webhook can subscribe to
+var webhookEvents = []string{webhookEventExpired}
+
+// maxWebhooks limits the webhooks a workspace can register
+const maxWebhooks = 20
+
+// minWebhookSecretLength is the shortest signing secret a webhook can be given
+const minWebhookSecretLength = 16
+
+// maxEventKeys limits the keys named by a single event, larger batches are split
+const maxEventKeys = 1000
+
+// webhookClient delivers webhooks
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Webhook is a URL that receives the events of a workspace
+type Webhook struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Events  []string  `json:"events"`
+	Created time.Time `json:"created"`
+	// Secret signs the deliveries, it is only returned when the webhook is created
+	Secret string `json:"secret,omitempty"`
+	// State reports recent delivery failures, it is not stored
+	State *webhookTargetState `json:"state,omitempty"`
+}
+
+// KeyEvent reports something that happened to keys of a workspace without a request, such
+// as keys expiring. It is delivered to webhooks and published to the events subject.
+// Replayed events also carry the changes themselves.
+type KeyEvent struct {
+	ID        string        `json:"id"`
+	Type      string        `json:"type"`
+	Operation string        `json:"operation"`
+	Time      time.Time     `json:"time"`
+	Workspace string        `json:"workspace"`
+	Tool      string        `json:"tool,omitempty"`
+	Reason    string        `json:"reason,omitempty"`
+	Keys      []string      `json:"keys"`
+	Changes   []ChangeEvent `json:"changes,omitempty"`
+}
+
+type WebhookRequest struct {
+	ID     string     `json:"id,omitempty"`
+	URL    string     `json:"url,omitempty"`
+	Events stringList `json:"events,omitempty"`
+	Secret string     `json:"secret,omitempty"`
+}
+
+// getWebhookBucket gets the bucket holding the webhooks of a workspace
+func (s *Server) getWebhookBucket(prefix string) (nats.KeyValue, error) {
+	return s.getBucket(prefix + "-webhooks")
+}
+
+// splitDataPrefix returns the workspace prefix and the tool of a data bucket
+func splitDataPrefix(prefix string) (string, string) {
+	workspace, _, _ := strings.Cut(prefix, "-")
+	_, tool, _ := strings.Cut(prefix, "-tool-")
+	return workspace, tool
+}
+
+// validateWebhookURL only accepts absolute http and https URLs
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	return nil
+}
+
+// getWebhooks returns the webhooks registered in a workspace
+func (s *Server) getWebhooks(workspace string) ([]Webhook, error) {
+	bucket, err := s.getWebhookBucket(workspace)
+	if err != nil {
+		return nil, err
+	}
+	webhooks := make([]Webhook, 0)
+	err = scanBucket(bucket, func(entry nats.KeyValueEntry) {
+		var webhook Webhook
+		if err := json.Unmarshal(entry.Value(), &webhook); err != nil {
+			log.Printf("Skipping invalid webhook %s in %s: %v", entry.Key(), workspace, err)
+			return
+		}
+		webhook.State = s.webhooks.state(webhook.ID)
+		webhooks = append(webhooks, webhook)
+	})
+	return webhooks, err
+}
+
+// notifyKeys publishes an event naming keys of a data bucket to the events subject and
+// delivers it to the webhooks subscribed to it. Delivery happens in the background.
+func (s *Server) notifyKeys(prefix, eventType, operation, reason string, keys []string) {
+	workspace, tool := splitDataPrefix(prefix)
+	for batch := range slices.Chunk(keys, maxEventKeys) {
+		event := KeyEvent{
+			ID:        uuid.New().String(),
+			Type:      eventType,
+			Operation: operation,
+			Time:      time.Now().UTC(),
+			Workspace: workspace,
+			Tool:      tool,
+			Reason:    reason,
+			Keys:      batch,
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		if s.eventsSubject != "" && s.nc != nil {
+			if err := s.nc.Publish(s.eventsSubject+"."+workspace, data); err != nil {
+				log.Printf("Failed to publish %s event: %v", eventType, err)
+			}
+		}
+		go s.deliverEvent(event, data)
+	}
+}
+
+// deliverEvent sends an event to KV_WEBHOOK_URL and each of the workspace's subscribed
+// webhooks, which are retried independently
+func (s *Server) deliverEvent(event KeyEvent, data []byte) {
+	if s.webhooks.url != "" {
+		go s.deliver(Webhook{ID: globalWebhookID, URL: s.webhooks.url, Secret: s.webhooks.secret}, event, data)
+	}
+	webhooks, err := s.getWebhooks(event.Workspace)
+	if err != nil {
+		log.Printf("Failed to load webhooks of %s: %v", event.Workspace, err)
+	}
+	for _, webhook := range webhooks {
+		if slices.Contains(webhook.Events, event.Type) {
+			go s.deliver(webhook, event, data)
+		}
+	}
+}
+
+// signWebhook returns the X-KV-Signature of a delivery, t=<unix time>,v1=<signature>. The
+// signature is the hex HMAC-SHA256 of "<unix time>.<body>" with the webhook's secret, so
+// receivers can authenticate the payload and reject old deliveries being replayed.
+func signWebhook(secret string, timestamp time.Time, data []byte) string {
+	t := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(data)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// newWebhookSecret generates the signing secret of a webhook
+func newWebhookSecret() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(secret), nil
+}
+
+// postWebhook sends an event, signed when the webhook has a secret, treating any non-2xx
+// response as a failure. It returns the response status, which is 0 when no response was
+// received.
+func postWebhook(webhook Webhook, event KeyEvent, data []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-KV-Event", event.Type)
+	req.Header.Set("X-KV-Event-ID", event.ID)
+	if webhook.Secret != "" {
+		req.Header.Set("X-KV-Signature", signWebhook(webhook.Secret, time.Now(), data))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("%s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+func (s *Server) handleWebhookCreate(w http.ResponseWriter, r *http.Request) {
+	var req WebhookRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("invalid request body: %v", err)})
+		return
+	}
+
+	if err := validateWebhookURL(req.URL); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if req.Secret != "" && len(req.Secret) < minWebhookSecretLength {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("secret must be at least %d characters", minWebhookSecretLength)})
+		return
+	}
+	if len(req.Events) == 0 {
+		req.Events = webhookEvents
+	}
+	for _, event := range req.Events {
+		if !slices.Contains(webhookEvents, event) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("unknown event %s, must be one of %s", event, strings.Join(webhookEvents, ", "))})
+			return
+		}
+	}
+
+	workspace := getRequestPrefix(r)
+	webhooks, err := s.getWebhooks(workspace)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if len(webhooks) >= maxWebhooks {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: fmt.Sprintf("a workspace can have at most %d webhooks", maxWebhooks)})
+		return
+	}
+
+	webhook := Webhook{
+		ID:      uuid.New().String(),
+		URL:     req.URL,
+		Events:  req.Events,
+		Created: time.Now().UTC(),
+		Secret:  req.Secret,
+	}
+	if webhook.Secret == "" {
+		if webhook.Secret, err = newWebhookSecret(); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+			return
+		}
+	}
+	value, err := json.Marshal(webhook)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	bucket, err := s.getWebhookBucket(workspace)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if _, err := bucket.Put(webhook.ID, value); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: webhook})
+}
+
+func (s *Server) handleWebhookList(w http.ResponseWriter, r *http.Request) {
+	webhooks, err := s.getWebhooks(getRequestPrefix(r))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+	json.NewEncoder(w).Encode(KVResponse{Success: true, Data: webhooks})
+}
+
+func (s *Server) handleWebhookDelete(w http.ResponseWriter, r *http.Request) {
+	var req WebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "invalid request body"})
+		return
+	}
+	if req.ID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "id is required"})
+		return
+	}
+
+	bucket, err := s.getWebhookBucket(getRequestPrefix(r))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+	if _, err := bucket.Get(req.ID); errors.Is(err, nats.ErrKeyNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: "webhook not found"})
+		return
+	}
+	if err := bucket.Purge(req.ID); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(KVResponse{Success: false, Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(KVResponse{Success: true})
+}
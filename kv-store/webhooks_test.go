@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateWebhookURL(t *testing.T) {
+	tests := map[string]bool{
+		"https://hooks.example.com/kv": true,
+		"http://127.0.0.1:8080":        true,
+		"ftp://example.com":            false,
+		"/relative":                    false,
+		"https://":                     false,
+	}
+	for raw, valid := range tests {
+		if err := validateWebhookURL(raw); (err == nil) != valid {
+			t.Errorf("validateWebhookURL(%q) = %v, want valid %v", raw, err, valid)
+		}
+	}
+}
+
+func TestSplitDataPrefix(t *testing.T) {
+	if workspace, tool := splitDataPrefix("abc123-tool-writer"); workspace != "abc123" || tool != "writer" {
+		t.Errorf("got %s, %s", workspace, tool)
+	}
+	if workspace, tool := splitDataPrefix("abc123"); workspace != "abc123" || tool != "" {
+		t.Errorf("got %s, %s", workspace, tool)
+	}
+}
+
+func TestPostWebhook(t *testing.T) {
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		body = string(data)
+		if r.Header.Get("X-KV-Event") != webhookEventExpired || r.Header.Get("X-KV-Event-ID") != "evt-1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	event := KeyEvent{ID: "evt-1", Type: webhookEventExpired}
+	if _, err := postWebhook(Webhook{URL: server.URL + "/ok"}, event, []byte(`{"keys":["a"]}`)); err != nil || body != `{"keys":["a"]}` {
+		t.Errorf("delivery failed: %v, body %q", err, body)
+	}
+	if status, err := postWebhook(Webhook{URL: server.URL + "/fail"}, event, []byte(`{}`)); err == nil || status != http.StatusInternalServerError {
+		t.Errorf("a 500 response should fail the delivery, got %d, %v", status, err)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	d := &webhookDispatcher{maxAttempts: 5, backoff: time.Millisecond, maxBackoff: 4 * time.Millisecond, budget: 2, suspend: time.Minute, targets: map[string]*webhookTargetState{}}
+	s := &Server{webhooks: d}
+	d.record("hook", errors.New("earlier failure"))
+
+	s.deliver(Webhook{ID: "hook", URL: server.URL}, KeyEvent{ID: "evt-1", Type: webhookEventExpired}, []byte(`{}`))
+	if attempts != 3 {
+		t.Errorf("delivered in %d attempts, want 3", attempts)
+	}
+	if state := d.state("hook"); state != nil {
+		t.Errorf("a successful delivery should reset the target, got %+v", state)
+	}
+}
+
+func TestWebhookFailureBudget(t *testing.T) {
+	d := &webhookDispatcher{backoff: time.Second, maxBackoff: 8 * time.Second, budget: 3, suspend: time.Minute, targets: map[string]*webhookTargetState{}}
+	for i := 0; i < 2; i++ {
+		d.record("hook", errors.New("503 Service Unavailable"))
+	}
+	if d.suspended("hook") {
+		t.Fatal("the target should not be suspended before using up its budget")
+	}
+	d.record("hook", errors.New("503 Service Unavailable"))
+	if !d.suspended("hook") || d.state("hook").ConsecutiveFailures != 3 {
+		t.Fatalf("the target should be suspended, got %+v", d.state("hook"))
+	}
+	if d.suspended("other") {
+		t.Error("other targets should not be suspended")
+	}
+
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: 8 * time.Second} {
+		if delay := d.retryDelay(attempt); delay < want/2 || delay > want {
+			t.Errorf("retryDelay(%d) = %s, want between %s and %s", attempt, delay, want/2, want)
+		}
+	}
+	if retryable(http.StatusBadRequest) || !retryable(http.StatusTooManyRequests) || !retryable(0) {
+		t.Error("only missing responses, 408, 429 and 5xx should be retried")
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	timestamp := time.Unix(1700000000, 0)
+	want := "t=1700000000,v1=da5337573c77ee1486512d65c291b60350158c6d440c5b6f76b88a4a4e79e527"
+	if got := signWebhook("whsec_test", timestamp, []byte(`{"keys":["a"]}`)); got != want {
+		t.Errorf("signWebhook() = %s, want %s", got, want)
+	}
+
+	var signature string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signature = r.Header.Get("X-KV-Signature")
+	}))
+	defer server.Close()
+	if _, err := postWebhook(Webhook{URL: server.URL, Secret: "whsec_test"}, KeyEvent{}, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	t0, v1, ok := strings.Cut(strings.TrimPrefix(signature, "t="), ",v1=")
+	if !ok || v1 != hmacHex("whsec_test", t0+".{}") {
+		t.Errorf("unexpected signature %q", signature)
+	}
+	if _, err := postWebhook(Webhook{URL: server.URL}, KeyEvent{}, []byte(`{}`)); err != nil || signature != "" {
+		t.Errorf("webhooks without a secret should not be signed, got %q", signature)
+	}
+}
+
+func hmacHex(secret, message string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestChangedKeys(t *testing.T) {
+	changes := []ChangeEvent{{Key: "b"}, {Key: "a"}, {Key: "b"}, {Key: "c"}}
+	if keys := changedKeys(changes); strings.Join(keys, ",") != "b,a,c" {
+		t.Errorf("changedKeys() = %v, want [b a c]", keys)
+	}
+}
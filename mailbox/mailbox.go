@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+	"toolkit"
+)
+
+const (
+	maxRecipients    = 50
+	maxBodySize      = 512 * 1024
+	maxMessageIDSize = 128
+	maxTitleLength   = 256
+)
+
+// Inbox names are subject tokens and part of consumer names
+var inboxPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Message is a message in an inbox. The messages of a workspace are kept in a work queue
+// stream, on a subject per inbox, and each inbox has a durable consumer its receivers share.
+// A message is removed once acknowledged, or when it expires.
+type Message struct {
+	ID      string     `json:"id"`
+	From    string     `json:"from,omitempty"`
+	To      string     `json:"to"`
+	Subject string     `json:"subject,omitempty"`
+	Body    string     `json:"body"`
+	Sent    time.Time  `json:"sent"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+type SendRequest struct {
+	To      toolkit.StringList `json:"to"`
+	From    string             `json:"from,omitempty"`
+	Subject string             `json:"subject,omitempty"`
+	Body    payload            `json:"body"`
+	// TTL is how long the message can wait in an inbox before it expires
+	TTL toolkit.Duration `json:"ttl,omitempty"`
+	// ID makes sending idempotent: a message with the ID of one sent shortly before is
+	// dropped
+	ID string `json:"id,omitempty"`
+}
+
+type SendResult struct {
+	ID string   `json:"id"`
+	To []string `json:"to"`
+	// Duplicates are the inboxes that already had a message with the ID
+	Duplicates []string `json:"duplicates,omitempty"`
+}
+
+type InboxRequest struct {
+	Inbox string `json:"inbox"`
+}
+
+type Inbox struct {
+	Name string `json:"name"`
+	// Waiting is the number of messages not received yet, Unacked of those received but
+	// not acknowledged
+	Waiting uint64 `json:"waiting"`
+	Unacked int    `json:"unacked"`
+}
+
+func streamName(prefix string) string {
+	return "mailbox-" + prefix
+}
+
+func inboxSubject(prefix, inbox string) string {
+	return "mailbox." + prefix + "." + inbox
+}
+
+func consumerName(inbox string) string {
+	return "inbox-" + inbox
+}
+
+func validateInbox(inbox string) error {
+	if !inboxPattern.MatchString(inbox) {
+		return fmt.Errorf("invalid inbox %q, inboxes are 1 to 64 letters, digits, - and _", inbox)
+	}
+	return nil
+}
+
+// getStream creates the stream of a workspace, or updates its limits when they were
+// configured differently
+func (s *Server) getStream(prefix string) error {
+	if _, ok := s.streams.Load(prefix); ok {
+		return nil
+	}
+	config := &nats.StreamConfig{
+		Name:      streamName(prefix),
+		Subjects:  []string{inboxSubject(prefix, "*")},
+		Storage:   nats.FileStorage,
+		Retention: nats.WorkQueuePolicy,
+		MaxAge:    s.retention,
+		MaxBytes:  s.maxBytes,
+		Discard:   nats.DiscardNew,
+	}
+	info, err := s.js.StreamInfo(config.Name)
+	switch {
+	case errors.Is(err, nats.ErrStreamNotFound):
+		_, err = s.js.AddStream(config)
+	case err == nil && (info.Config.MaxAge != config.MaxAge || info.Config.MaxBytes != config.MaxBytes):
+		updated := info.Config
+		updated.MaxAge = config.MaxAge
+		updated.MaxBytes = config.MaxBytes
+		_, err = s.js.UpdateStream(&updated)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create the mailbox stream: %v", err)
+	}
+	s.streams.Store(prefix, true)
+	return nil
+}
+
+// getInbox creates the consumer of an inbox, so it exists from the first message sent to it
+func (s *Server) getInbox(prefix, inbox string) error {
+	if err := s.getStream(prefix); err != nil {
+		return err
+	}
+	key := prefix + "/" + inbox
+	if _, ok := s.consumers.Load(key); ok {
+		return nil
+	}
+	config := &nats.ConsumerConfig{
+		Durable:       consumerName(inbox),
+		FilterSubject: inboxSubject(prefix, inbox),
+		AckPolicy:     nats.AckExplicitPolicy,
+		AckWait:       s.ackWait,
+		DeliverPolicy: nats.DeliverAllPolicy,
+	}
+	info, err := s.js.ConsumerInfo(streamName(prefix), config.Durable)
+	switch {
+	case errors.Is(err, nats.ErrConsumerNotFound):
+		_, err = s.js.AddConsumer(streamName(prefix), config)
+	case err == nil && info.Config.AckWait != config.AckWait:
+		updated := info.Config
+		updated.AckWait = config.AckWait
+		_, err = s.js.UpdateConsumer(streamName(prefix), &updated)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create inbox %s: %v", inbox, err)
+	}
+	s.consumers.Store(key, true)
+	return nil
+}
+
+// handleSend sends a message to one or more inboxes, each getting its own copy
+func (s *Server) handleSend(w http.ResponseWriter, r *http.Request) {
+	var req SendRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if err := req.validate(s.retention); err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	prefix := getPrefixFromEnv(r.Header)
+	if req.ID == "" {
+		req.ID = nuid.Next()
+	}
+	message := Message{ID: req.ID, From: req.From, Subject: req.Subject, Body: string(req.Body), Sent: time.Now().UTC()}
+	if req.TTL > 0 {
+		expires := message.Sent.Add(time.Duration(req.TTL))
+		message.Expires = &expires
+	}
+
+	result := SendResult{ID: message.ID, To: []string{}}
+	for _, inbox := range req.To {
+		if err := s.getInbox(prefix, inbox); err != nil {
+			toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		message.To = inbox
+		msg := nats.NewMsg(inboxSubject(prefix, inbox))
+		msg.Data, _ = json.Marshal(message)
+		// The broker drops a message with the ID of one it stored shortly before
+		msg.Header.Set(nats.MsgIdHdr, message.ID+"."+inbox)
+		ack, err := s.js.PublishMsg(msg)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if strings.Contains(err.Error(), "maximum") {
+				status = http.StatusInsufficientStorage
+			}
+			toolkit.WriteError(w, status, fmt.Sprintf("failed to send to %s after sending to %v: %v", inbox, result.To, err))
+			return
+		}
+		if ack.Duplicate {
+			result.Duplicates = append(result.Duplicates, inbox)
+		} else {
+			result.To = append(result.To, inbox)
+		}
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: result})
+}
+
+func (req SendRequest) validate(retention time.Duration) error {
+	if len(req.To) == 0 || len(req.To) > maxRecipients {
+		return fmt.Errorf("between 1 and %d inboxes are required", maxRecipients)
+	}
+	seen := map[string]bool{}
+	for _, inbox := range req.To {
+		if err := validateInbox(inbox); err != nil {
+			return err
+		}
+		if seen[inbox] {
+			return fmt.Errorf("inbox %s is given twice", inbox)
+		}
+		seen[inbox] = true
+	}
+	switch {
+	case req.From != "" && validateInbox(req.From) != nil:
+		return fmt.Errorf("from must name an inbox to reply to")
+	case len(req.Subject) > maxTitleLength:
+		return fmt.Errorf("subject can be at most %d characters", maxTitleLength)
+	case len(req.Body) > maxBodySize:
+		return fmt.Errorf("body can be at most %d bytes", maxBodySize)
+	case len(req.ID) > maxMessageIDSize:
+		return fmt.Errorf("id can be at most %d characters", maxMessageIDSize)
+	case req.TTL < 0:
+		return fmt.Errorf("ttl can't be negative")
+	case retention > 0 && time.Duration(req.TTL) > retention:
+		return fmt.Errorf("ttl can be at most %s, the longest messages are kept", retention)
+	}
+	return nil
+}
+
+// handleListInboxes lists the inboxes of the workspace with their number of messages
+func (s *Server) handleListInboxes(w http.ResponseWriter, r *http.Request) {
+	prefix := getPrefixFromEnv(r.Header)
+	if err := s.getStream(prefix); err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	inboxes := []Inbox{}
+	for info := range s.js.Consumers(streamName(prefix)) {
+		name, ok := strings.CutPrefix(info.Name, "inbox-")
+		if !ok {
+			continue
+		}
+		inboxes = append(inboxes, Inbox{Name: name, Waiting: info.NumPending, Unacked: info.NumAckPending})
+	}
+	slices.SortFunc(inboxes, func(a, b Inbox) int { return strings.Compare(a.Name, b.Name) })
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: inboxes})
+}
+
+// handleDeleteInbox deletes an inbox with its messages
+func (s *Server) handleDeleteInbox(w http.ResponseWriter, r *http.Request) {
+	var req InboxRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if err := validateInbox(req.Inbox); err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	prefix := getPrefixFromEnv(r.Header)
+	if err := s.getStream(prefix); err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	err := s.js.DeleteConsumer(streamName(prefix), consumerName(req.Inbox))
+	if errors.Is(err, nats.ErrConsumerNotFound) {
+		toolkit.WriteError(w, http.StatusNotFound, fmt.Sprintf("inbox %s does not exist", req.Inbox))
+		return
+	}
+	s.consumers.Delete(prefix + "/" + req.Inbox)
+	if err == nil {
+		err = s.js.PurgeStream(streamName(prefix), &nats.StreamPurgeRequest{Subject: inboxSubject(prefix, req.Inbox)})
+	}
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to delete inbox %s: %v", req.Inbox, err))
+		return
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: map[string]string{"deleted": req.Inbox}})
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"toolkit"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, *Server) {
+	t.Helper()
+	ns, err := server.NewServer(&server.Options{DontListen: true, NoSigs: true, JetStream: true, StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(4 * time.Second) {
+		t.Fatal("failed to start the NATS server")
+	}
+	nc, err := nats.Connect("", nats.InProcessServer(ns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := httptest.NewServer(s)
+	t.Cleanup(func() {
+		httpServer.Close()
+		nc.Close()
+		ns.Shutdown()
+	})
+	return httpServer, s
+}
+
+// call posts a request as a workspace and decodes the data of the response into result
+func call(t *testing.T, url, workspace, path string, body interface{}, result interface{}) (int, toolkit.Response) {
+	t.Helper()
+	data, _ := json.Marshal(body)
+	req, _ := http.NewRequest(http.MethodPost, url+path, bytes.NewReader(data))
+	req.Header.Set("X-GPTScript-Env", "GPTSCRIPT_WORKSPACE_ID="+workspace)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var response toolkit.Response
+	json.NewDecoder(resp.Body).Decode(&response)
+	if result != nil {
+		data, _ := json.Marshal(response.Data)
+		json.Unmarshal(data, result)
+	}
+	return resp.StatusCode, response
+}
+
+func TestValidateReceipt(t *testing.T) {
+	stream := streamName("abc")
+	if err := validateReceipt("abc", "$JS.ACK."+stream+".inbox-planner.1.5.3.1700000000000000000.0"); err != nil {
+		t.Errorf("validateReceipt failed: %v", err)
+	}
+	for _, receipt := range []string{
+		"",
+		"$JS.ACK." + stream + ".inbox-planner.1.5.3",
+		"$JS.ACK.mailbox-other.inbox-planner.1.5.3.1700000000000000000.0",
+		"$JS.ACK." + stream + ".other.1.5.3.1700000000000000000.0",
+		"orders.created",
+	} {
+		if err := validateReceipt("abc", receipt); err == nil {
+			t.Errorf("validateReceipt(%q) succeeded, want an error", receipt)
+		}
+	}
+}
+
+func TestValidateSend(t *testing.T) {
+	valid := SendRequest{To: toolkit.StringList{"planner", "research_1"}, Body: payload("hi"), TTL: toolkit.Duration(time.Hour)}
+	if err := valid.validate(24 * time.Hour); err != nil {
+		t.Errorf("validate failed: %v", err)
+	}
+	for name, req := range map[string]SendRequest{
+		"no inboxes":      {Body: payload("hi")},
+		"invalid inbox":   {To: toolkit.StringList{"a.b"}},
+		"duplicate inbox": {To: toolkit.StringList{"a", "a"}},
+		"invalid from":    {To: toolkit.StringList{"a"}, From: "b c"},
+		"long subject":    {To: toolkit.StringList{"a"}, Subject: strings.Repeat("s", maxTitleLength+1)},
+		"ttl too long":    {To: toolkit.StringList{"a"}, TTL: toolkit.Duration(48 * time.Hour)},
+		"negative ttl":    {To: toolkit.StringList{"a"}, TTL: toolkit.Duration(-time.Second)},
+	} {
+		if err := req.validate(24 * time.Hour); err == nil {
+			t.Errorf("validate with %s succeeded, want an error", name)
+		}
+	}
+}
+
+func TestParams(t *testing.T) {
+	var req struct {
+		To   toolkit.StringList `json:"to"`
+		Max  toolkit.Int        `json:"max"`
+		Ack  toolkit.Bool       `json:"ack"`
+		Body payload            `json:"body"`
+		Wait toolkit.Duration   `json:"wait"`
+	}
+	data := `{"to": "a, b", "max": "5", "ack": "true", "body": {"task": 1}, "wait": "30s"}`
+	if err := json.Unmarshal([]byte(data), &req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.To) != 2 || req.To[1] != "b" || req.Max != 5 || !bool(req.Ack) || string(req.Body) != `{"task":1}` || time.Duration(req.Wait) != 30*time.Second {
+		t.Errorf("unexpected params %+v", req)
+	}
+}
+
+func TestSendReceiveAck(t *testing.T) {
+	srv, _ := newTestServer(t)
+	var sent SendResult
+	status, resp := call(t, srv.URL, "ws1", "/api/v1/send", map[string]interface{}{"to": []string{"planner", "critic"}, "from": "lead", "subject": "task", "body": "plan the trip", "id": "m1"}, &sent)
+	if status != http.StatusOK || len(sent.To) != 2 || sent.ID != "m1" {
+		t.Fatalf("send failed: %d %+v", status, resp)
+	}
+	call(t, srv.URL, "ws1", "/api/v1/send", map[string]interface{}{"to": "planner", "body": "again", "id": "m1"}, &sent)
+	if len(sent.Duplicates) != 1 || len(sent.To) != 0 {
+		t.Errorf("resending an ID wasn't a duplicate: %+v", sent)
+	}
+
+	var received []ReceivedMessage
+	call(t, srv.URL, "ws1", "/api/v1/receive", map[string]interface{}{"inbox": "planner", "max": 10}, &received)
+	if len(received) != 1 || received[0].Body != "plan the trip" || received[0].From != "lead" || received[0].To != "planner" || received[0].Receipt == "" {
+		t.Fatalf("unexpected messages %+v", received)
+	}
+	// A received message is hidden until it is acknowledged or released
+	call(t, srv.URL, "ws1", "/api/v1/receive", map[string]interface{}{"inbox": "planner"}, &received)
+	if len(received) != 0 {
+		t.Errorf("received a message twice: %+v", received)
+	}
+	if status, _ := call(t, srv.URL, "ws2", "/api/v1/receive", map[string]interface{}{"inbox": "critic"}, &received); status != http.StatusOK || len(received) != 0 {
+		t.Errorf("another workspace received %+v", received)
+	}
+
+	call(t, srv.URL, "ws1", "/api/v1/receive", map[string]interface{}{"inbox": "critic"}, &received)
+	if len(received) != 1 {
+		t.Fatalf("unexpected messages %+v", received)
+	}
+	if status, resp := call(t, srv.URL, "ws1", "/api/v1/ack", map[string]interface{}{"receipts": []string{received[0].Receipt}, "release": true}, nil); status != http.StatusOK {
+		t.Fatalf("release failed: %d %+v", status, resp)
+	}
+	call(t, srv.URL, "ws1", "/api/v1/receive", map[string]interface{}{"inbox": "critic"}, &received)
+	if len(received) != 1 || received[0].Deliveries != 2 {
+		t.Fatalf("a released message wasn't received again: %+v", received)
+	}
+	if status, resp := call(t, srv.URL, "ws2", "/api/v1/ack", map[string]interface{}{"receipts": []string{received[0].Receipt}}, nil); status != http.StatusBadRequest {
+		t.Errorf("acknowledging a receipt of another workspace returned %d %+v", status, resp)
+	}
+	if status, resp := call(t, srv.URL, "ws1", "/api/v1/ack", map[string]interface{}{"receipts": []string{received[0].Receipt}}, nil); status != http.StatusOK {
+		t.Fatalf("ack failed: %d %+v", status, resp)
+	}
+
+	var inboxes []Inbox
+	call(t, srv.URL, "ws1", "/api/v1/inboxes/list", map[string]string{}, &inboxes)
+	if len(inboxes) != 2 || inboxes[0].Name != "critic" || inboxes[0].Waiting != 0 || inboxes[0].Unacked != 0 || inboxes[1].Unacked != 1 {
+		t.Errorf("unexpected inboxes %+v", inboxes)
+	}
+	if status, _ := call(t, srv.URL, "ws1", "/api/v1/inboxes/delete", map[string]string{"inbox": "planner"}, nil); status != http.StatusOK {
+		t.Errorf("delete failed: %d", status)
+	}
+	if status, _ := call(t, srv.URL, "ws1", "/api/v1/inboxes/delete", map[string]string{"inbox": "planner"}, nil); status != http.StatusNotFound {
+		t.Errorf("deleting a deleted inbox returned %d, want 404", status)
+	}
+}
+
+func TestReceiveWaitAndExpiry(t *testing.T) {
+	srv, _ := newTestServer(t)
+	call(t, srv.URL, "ws1", "/api/v1/send", map[string]interface{}{"to": "worker", "body": "stale", "ttl": "1ms"}, nil)
+	time.Sleep(10 * time.Millisecond)
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		call(t, srv.URL, "ws1", "/api/v1/send", map[string]interface{}{"to": "worker", "body": "fresh"}, nil)
+	}()
+	start := time.Now()
+	var received []ReceivedMessage
+	call(t, srv.URL, "ws1", "/api/v1/receive", map[string]interface{}{"inbox": "worker", "wait": "5s", "ack": true}, &received)
+	if len(received) != 1 || received[0].Body != "fresh" || received[0].Receipt != "" {
+		t.Fatalf("unexpected messages %+v", received)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("receive returned after %s, not when the message arrived", elapsed)
+	}
+
+	var inboxes []Inbox
+	call(t, srv.URL, "ws1", "/api/v1/inboxes/list", map[string]string{}, &inboxes)
+	if len(inboxes) != 1 || inboxes[0].Waiting != 0 || inboxes[0].Unacked != 0 {
+		t.Errorf("messages were left in the inbox: %+v", inboxes)
+	}
+}
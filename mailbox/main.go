@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"toolkit"
+)
+
+type Server struct {
+	nc *nats.Conn
+	js nats.JetStreamContext
+	// retention is the longest a message is kept unreceived, zero for as long as maxBytes
+	// allows
+	retention time.Duration
+	// maxBytes caps the messages of a workspace. Sends fail rather than drop mail once full.
+	maxBytes int64
+	// ackWait is how long a received message stays hidden from other receivers before it
+	// is delivered again, unless it is acknowledged
+	ackWait time.Duration
+	// streams and consumers hold the workspaces and inboxes known to be configured
+	streams   sync.Map
+	consumers sync.Map
+}
+
+// getPrefixFromEnv generates a SHA1 prefix from the workspace of a request, which names the
+// stream holding its mailboxes
+func getPrefixFromEnv(headers http.Header) string {
+	workspaceID := toolkit.GPTScriptEnv(headers, "GPTSCRIPT_WORKSPACE_ID")
+	if workspaceID == "" {
+		return "default"
+	}
+	hasher := sha1.New()
+	hasher.Write([]byte(workspaceID))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func NewServer(nc *nats.Conn) (*Server, error) {
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+	retention, err := time.ParseDuration(getEnvOrDefault("MAILBOX_RETENTION", "720h"))
+	if err != nil || retention < 0 {
+		return nil, fmt.Errorf("invalid MAILBOX_RETENTION %q, expected a duration such as 720h", os.Getenv("MAILBOX_RETENTION"))
+	}
+	maxBytes, err := strconv.ParseInt(getEnvOrDefault("MAILBOX_MAX_BYTES", strconv.Itoa(256<<20)), 10, 64)
+	if err != nil || maxBytes < 1<<20 {
+		return nil, fmt.Errorf("invalid MAILBOX_MAX_BYTES %q, expected at least 1048576", os.Getenv("MAILBOX_MAX_BYTES"))
+	}
+	ackWait, err := time.ParseDuration(getEnvOrDefault("MAILBOX_ACK_WAIT", "10m"))
+	if err != nil || ackWait < time.Second {
+		return nil, fmt.Errorf("invalid MAILBOX_ACK_WAIT %q, expected a duration of at least 1s", os.Getenv("MAILBOX_ACK_WAIT"))
+	}
+	return &Server{
+		nc:        nc,
+		js:        js,
+		retention: retention,
+		maxBytes:  maxBytes,
+		ackWait:   ackWait,
+	}, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rw := toolkit.NewResponseWriter(w)
+	w = rw
+	log.Printf("Request: %s %s", r.Method, r.URL.Path)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Handle health check endpoint
+	if r.URL.Path == "/api/ready" && r.Method == http.MethodGet {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// All other endpoints should be POST
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		log.Printf("Response: %d - Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/v1/send":
+		s.handleSend(w, r)
+	case "/api/v1/receive":
+		s.handleReceive(w, r)
+	case "/api/v1/ack":
+		s.handleAck(w, r)
+	case "/api/v1/inboxes/list":
+		s.handleListInboxes(w, r)
+	case "/api/v1/inboxes/delete":
+		s.handleDeleteInbox(w, r)
+	default:
+		http.NotFound(w, r)
+		log.Printf("Response: 404 - Not Found")
+		return
+	}
+
+	log.Printf("Response Status: %d", rw.Status)
+}
+
+func main() {
+	port := getEnvOrDefault("PORT", "8080")
+	storageDir := flag.String("s", getEnvOrDefault("NATS_STORAGE", "./data"), "Directory for storing data (env: NATS_STORAGE)")
+	flag.Parse()
+
+	// Ensure storage directory exists
+	if err := os.MkdirAll(*storageDir, 0755); err != nil {
+		log.Fatalf("Failed to create storage directory: %v", err)
+	}
+
+	// The embedded NATS server only serves this process, so it doesn't listen on a port
+	ns, err := server.NewServer(&server.Options{
+		JetStream:  true,
+		StoreDir:   filepath.Clean(*storageDir),
+		DontListen: true,
+		NoSigs:     true,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create server: %v", err)
+	}
+	ns.ConfigureLogger()
+	go ns.Start()
+	if !ns.ReadyForConnections(4 * time.Second) {
+		log.Fatal("Failed to start server")
+	}
+
+	nc, err := nats.Connect("", nats.InProcessServer(ns))
+	if err != nil {
+		log.Fatalf("Failed to connect to NATS: %v", err)
+	}
+	defer nc.Close()
+
+	httpServer, err := NewServer(nc)
+	if err != nil {
+		log.Fatalf("Failed to create HTTP server: %v", err)
+	}
+
+	go func() {
+		log.Printf("Starting HTTP server on port %s", port)
+		if err := http.ListenAndServe(":"+port, httpServer); err != nil {
+			log.Fatalf("HTTP server error: %v", err)
+		}
+	}()
+	log.Printf("Storage directory: %s", *storageDir)
+
+	// Handle graceful shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	<-sigChan
+	log.Print("Shutting down servers...")
+	ns.Shutdown()
+	ns.WaitForShutdown()
+}
+
+func getEnvOrDefault(key, defaultValue string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return defaultValue
+}
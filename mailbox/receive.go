@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"toolkit"
+)
+
+const (
+	maxReceive = 100
+	maxWait    = 5 * time.Minute
+	// pollWait bounds a receive that doesn't block, as the broker is asked for messages
+	// rather than handing them over
+	pollWait = 250 * time.Millisecond
+	// ackTimeout is how long to wait for the broker to confirm an acknowledgement
+	ackTimeout = 5 * time.Second
+)
+
+type ReceiveRequest struct {
+	Inbox string      `json:"inbox"`
+	Max   toolkit.Int `json:"max,omitempty"`
+	// Wait is how long to block for a message when the inbox is empty
+	Wait toolkit.Duration `json:"wait,omitempty"`
+	// Ack acknowledges messages as they are received, so they are never delivered again
+	Ack toolkit.Bool `json:"ack,omitempty"`
+}
+
+// ReceivedMessage is a message with the receipt that acknowledges or releases it
+type ReceivedMessage struct {
+	Message
+	Receipt string `json:"receipt,omitempty"`
+	// Deliveries counts the times the message was received, more than one when an earlier
+	// receiver didn't acknowledge it in time
+	Deliveries uint64 `json:"deliveries"`
+}
+
+type AckRequest struct {
+	Receipts toolkit.StringList `json:"receipts"`
+	// Release makes the messages available to receive again instead of removing them,
+	// after an optional delay
+	Release toolkit.Bool     `json:"release,omitempty"`
+	Delay   toolkit.Duration `json:"delay,omitempty"`
+}
+
+// validateReceipt checks that a receipt is the acknowledgement subject of a message of an
+// inbox of the workspace: $JS.ACK.<stream>.<consumer>.<deliveries>.<stream seq>.<consumer
+// seq>.<time>.<pending>
+func validateReceipt(prefix, receipt string) error {
+	tokens := strings.Split(receipt, ".")
+	if len(tokens) != 9 || tokens[0] != "$JS" || tokens[1] != "ACK" || tokens[2] != streamName(prefix) || !strings.HasPrefix(tokens[3], "inbox-") {
+		return fmt.Errorf("invalid receipt %q", receipt)
+	}
+	return nil
+}
+
+// fetch receives up to max messages of an inbox, blocking up to wait for the first one
+func fetch(ctx context.Context, sub *nats.Subscription, max int, wait time.Duration) ([]*nats.Msg, error) {
+	deadline := time.Now().Add(wait)
+	pollCtx, cancel := context.WithTimeout(ctx, pollWait)
+	defer cancel()
+	// A fetch of more than one message returns those available without waiting for more
+	msgs, err := sub.Fetch(max, nats.Context(pollCtx))
+	if len(msgs) > 0 || time.Until(deadline) <= 0 || (err != nil && !errors.Is(err, nats.ErrTimeout) && !errors.Is(err, context.DeadlineExceeded)) {
+		return msgs, ignoreTimeout(err)
+	}
+
+	// A fetch of one message returns as soon as it arrives
+	waitCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	msgs, err = sub.Fetch(1, nats.Context(waitCtx))
+	if len(msgs) == 0 || max == 1 {
+		return msgs, ignoreTimeout(err)
+	}
+	pollCtx, cancel = context.WithTimeout(ctx, pollWait)
+	defer cancel()
+	more, err := sub.Fetch(max-1, nats.Context(pollCtx))
+	return append(msgs, more...), ignoreTimeout(err)
+}
+
+func ignoreTimeout(err error) error {
+	if errors.Is(err, nats.ErrTimeout) || errors.Is(err, context.DeadlineExceeded) {
+		return nil
+	}
+	return err
+}
+
+// handleReceive receives messages of an inbox, oldest first. A message is hidden from other
+// receivers until it is acknowledged, which removes it, or until the ack wait passes and it
+// is delivered again. Expired messages are removed instead of received.
+func (s *Server) handleReceive(w http.ResponseWriter, r *http.Request) {
+	var req ReceiveRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if req.Max == 0 {
+		req.Max = 1
+	}
+	var err error
+	switch {
+	case validateInbox(req.Inbox) != nil:
+		err = validateInbox(req.Inbox)
+	case req.Max < 1 || req.Max > maxReceive:
+		err = fmt.Errorf("max must be between 1 and %d", maxReceive)
+	case req.Wait < 0 || time.Duration(req.Wait) > maxWait:
+		err = fmt.Errorf("wait can be at most %s", maxWait)
+	}
+	if err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	prefix := getPrefixFromEnv(r.Header)
+	if err := s.getInbox(prefix, req.Inbox); err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sub, err := s.js.PullSubscribe(inboxSubject(prefix, req.Inbox), consumerName(req.Inbox), nats.Bind(streamName(prefix), consumerName(req.Inbox)))
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to read inbox %s: %v", req.Inbox, err))
+		return
+	}
+	defer sub.Unsubscribe()
+
+	deadline := time.Now().Add(time.Duration(req.Wait))
+	messages := []ReceivedMessage{}
+	for len(messages) == 0 {
+		msgs, err := fetch(r.Context(), sub, int(req.Max), time.Until(deadline))
+		if err != nil {
+			toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to read inbox %s: %v", req.Inbox, err))
+			return
+		}
+		if len(msgs) == 0 {
+			break
+		}
+		now := time.Now()
+		for _, msg := range msgs {
+			var message Message
+			meta, err := msg.Metadata()
+			if err == nil {
+				err = json.Unmarshal(msg.Data, &message)
+			}
+			// Messages that can't be read would be delivered forever
+			if err != nil || (message.Expires != nil && now.After(*message.Expires)) {
+				msg.AckSync()
+				continue
+			}
+			received := ReceivedMessage{Message: message, Deliveries: meta.NumDelivered}
+			if req.Ack {
+				if err := msg.AckSync(); err != nil {
+					toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to acknowledge message %s: %v", message.ID, err))
+					return
+				}
+			} else {
+				received.Receipt = msg.Reply
+			}
+			messages = append(messages, received)
+		}
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: messages})
+}
+
+// handleAck acknowledges received messages by their receipts, removing them from their
+// inbox, or releases them to be received again
+func (s *Server) handleAck(w http.ResponseWriter, r *http.Request) {
+	var req AckRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if len(req.Receipts) == 0 || len(req.Receipts) > maxReceive {
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("between 1 and %d receipts are required", maxReceive))
+		return
+	}
+	if req.Delay < 0 || (req.Delay > 0 && !req.Release) {
+		toolkit.WriteError(w, http.StatusBadRequest, "delay must be positive and is only used to release messages")
+		return
+	}
+	prefix := getPrefixFromEnv(r.Header)
+	for _, receipt := range req.Receipts {
+		if err := validateReceipt(prefix, receipt); err != nil {
+			toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	ack := []byte("+ACK")
+	if req.Release {
+		ack = []byte("-NAK")
+		if req.Delay > 0 {
+			ack = fmt.Appendf(ack, ` {"delay": %d}`, time.Duration(req.Delay).Nanoseconds())
+		}
+	}
+	for i, receipt := range req.Receipts {
+		if _, err := s.nc.Request(receipt, ack, ackTimeout); err != nil {
+			toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to acknowledge receipt %d after %d succeeded: %v", i, i, err))
+			return
+		}
+	}
+	action := "acknowledged"
+	if req.Release {
+		action = "released"
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: map[string]int{action: len(req.Receipts)}})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"toolkit"
+)
+
+type Server struct {
+	nc *nats.Conn
+	js nats.JetStreamContext
+	// retention is how long samples are kept, zero for as long as maxBytes allows
+	retention time.Duration
+	// maxBytes caps the samples of a workspace, dropping the oldest first
+	maxBytes int64
+	// remoteWriteURL and remoteWriteToken are the default Prometheus remote-write endpoint
+	// exports go to, and the bearer token sent to it
+	remoteWriteURL   string
+	remoteWriteToken string
+	// streams holds the workspaces whose sample stream is known to be configured
+	streams sync.Map
+}
+
+// getPrefixFromEnv generates a SHA1 prefix from the workspace of a request, which names the
+// bucket and stream holding its metrics
+func getPrefixFromEnv(headers http.Header) string {
+	workspaceID := toolkit.GPTScriptEnv(headers, "GPTSCRIPT_WORKSPACE_ID")
+	if workspaceID == "" {
+		return "default"
+	}
+	hasher := sha1.New()
+	hasher.Write([]byte(workspaceID))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func NewServer(nc *nats.Conn) (*Server, error) {
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create JetStream context: %v", err)
+	}
+	retention, err := parseDuration(getEnvOrDefault("METRICS_RETENTION", "30d"))
+	if err != nil || retention < 0 {
+		return nil, fmt.Errorf("invalid METRICS_RETENTION %q, expected a duration such as 30d", os.Getenv("METRICS_RETENTION"))
+	}
+	maxBytes, err := strconv.ParseInt(getEnvOrDefault("METRICS_MAX_BYTES", strconv.Itoa(256<<20)), 10, 64)
+	if err != nil || maxBytes < 1<<20 {
+		return nil, fmt.Errorf("invalid METRICS_MAX_BYTES %q, expected at least 1048576", os.Getenv("METRICS_MAX_BYTES"))
+	}
+	return &Server{
+		nc:               nc,
+		js:               js,
+		retention:        retention,
+		maxBytes:         maxBytes,
+		remoteWriteURL:   os.Getenv("METRICS_REMOTE_WRITE_URL"),
+		remoteWriteToken: os.Getenv("METRICS_REMOTE_WRITE_TOKEN"),
+	}, nil
+}
+
+// getBucket gets or creates the bucket of a workspace, which holds the definitions of its
+// metrics
+func (s *Server) getBucket(prefix string) (nats.KeyValue, error) {
+	kv, err := s.js.CreateKeyValue(&nats.KeyValueConfig{
+		Bucket: "metrics-" + prefix,
+	})
+	if err != nil {
+		// If it already exists, try to get it
+		kv, err = s.js.KeyValue("metrics-" + prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create/get KV store: %v", err)
+		}
+	}
+	return kv, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rw := toolkit.NewResponseWriter(w)
+	w = rw
+	log.Printf("Request: %s %s", r.Method, r.URL.Path)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Handle health check endpoint
+	if r.URL.Path == "/api/ready" && r.Method == http.MethodGet {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// All other endpoints should be POST
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		log.Printf("Response: %d - Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/v1/counter":
+		s.handleRecordOne(w, r, typeCounter)
+	case "/api/v1/gauge":
+		s.handleRecordOne(w, r, typeGauge)
+	case "/api/v1/timing":
+		s.handleRecordOne(w, r, typeTiming)
+	case "/api/v1/record":
+		s.handleRecord(w, r)
+	case "/api/v1/list":
+		s.handleList(w, r)
+	case "/api/v1/query":
+		s.handleQuery(w, r)
+	case "/api/v1/delete":
+		s.handleDelete(w, r)
+	case "/api/v1/export":
+		s.handleExport(w, r)
+	default:
+		http.NotFound(w, r)
+		log.Printf("Response: 404 - Not Found")
+		return
+	}
+
+	log.Printf("Response Status: %d", rw.Status)
+}
+
+func main() {
+	port := getEnvOrDefault("PORT", "8080")
+	storageDir := flag.String("s", getEnvOrDefault("NATS_STORAGE", "./data"), "Directory for storing data (env: NATS_STORAGE)")
+	flag.Parse()
+
+	// Ensure storage directory exists
+	if err := os.MkdirAll(*storageDir, 0755); err != nil {
+		log.Fatalf("Failed to create storage directory: %v", err)
+	}
+
+	// The embedded NATS server only serves this process, so it doesn't listen on a port
+	ns, err := server.NewServer(&server.Options{
+		JetStream:  true,
+		StoreDir:   filepath.Clean(*storageDir),
+		DontListen: true,
+		NoSigs:     true,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create server: %v", err)
+	}
+	ns.ConfigureLogger()
+	go ns.Start()
+	if !ns.ReadyForConnections(4 * time.Second) {
+		log.Fatal("Failed to start server")
+	}
+
+	nc, err := nats.Connect("", nats.InProcessServer(ns))
+	if err != nil {
+		log.Fatalf("Failed to connect to NATS: %v", err)
+	}
+	defer nc.Close()
+
+	httpServer, err := NewServer(nc)
+	if err != nil {
+		log.Fatalf("Failed to create HTTP server: %v", err)
+	}
+
+	go func() {
+		log.Printf("Starting HTTP server on port %s", port)
+		if err := http.ListenAndServe(":"+port, httpServer); err != nil {
+			log.Fatalf("HTTP server error: %v", err)
+		}
+	}()
+	log.Printf("Storage directory: %s", *storageDir)
+
+	// Handle graceful shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	<-sigChan
+	log.Print("Shutting down servers...")
+	ns.Shutdown()
+	ns.WaitForShutdown()
+}
+
+func getEnvOrDefault(key, defaultValue string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return defaultValue
+}
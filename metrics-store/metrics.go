@@ -0,0 +1,424 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"toolkit"
+)
+
+// Types of metrics. Counters add up increments, gauges hold the latest value and timings
+// are durations in milliseconds, summarized by percentiles.
+const (
+	typeCounter = "counter"
+	typeGauge   = "gauge"
+	typeTiming  = "timing"
+)
+
+const (
+	maxRecord           = 1000
+	maxLabels           = 10
+	maxLabelValueLength = 256
+	// maxReadSamples bounds the samples a query or export reads into memory
+	maxReadSamples = 1000000
+)
+
+var (
+	// Names and labels follow the Prometheus data model, so they export as they are. Names
+	// are also valid subject tokens.
+	namePattern  = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]{0,127}$`)
+	labelPattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]{0,63}$`)
+)
+
+// Metric is the definition of a metric, stored in the bucket of the workspace under its
+// name. Its samples are messages in the stream of the workspace, on a subject ending with
+// the name, and the time of a sample is that of its message.
+type Metric struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Created time.Time `json:"created"`
+}
+
+type Sample struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type,omitempty"`
+	Value  *flexibleFloat    `json:"value"`
+	Labels toolkit.StringMap `json:"labels,omitempty"`
+}
+
+type RecordOneRequest struct {
+	Name   string            `json:"name"`
+	Value  *flexibleFloat    `json:"value,omitempty"`
+	Labels toolkit.StringMap `json:"labels,omitempty"`
+}
+
+type RecordRequest struct {
+	Samples sampleList `json:"samples"`
+}
+
+type MetricRequest struct {
+	Name string `json:"name"`
+}
+
+type MetricInfo struct {
+	Metric
+	// Samples is the number of samples kept
+	Samples uint64 `json:"samples"`
+}
+
+// storedSample is the body of a sample message
+type storedSample struct {
+	Value  float64           `json:"value"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// point is a sample read back with its time
+type point struct {
+	Time   time.Time
+	Value  float64
+	Labels map[string]string
+}
+
+func streamName(prefix string) string {
+	return "metrics-" + prefix
+}
+
+func sampleSubject(prefix, name string) string {
+	return "metrics." + prefix + "." + name
+}
+
+func validType(metricType string) bool {
+	return metricType == typeCounter || metricType == typeGauge || metricType == typeTiming
+}
+
+// getStream creates the sample stream of a workspace, or updates its limits when they were
+// configured differently
+func (s *Server) getStream(prefix string) error {
+	if _, ok := s.streams.Load(prefix); ok {
+		return nil
+	}
+	config := &nats.StreamConfig{
+		Name:     streamName(prefix),
+		Subjects: []string{sampleSubject(prefix, ">")},
+		Storage:  nats.FileStorage,
+		MaxAge:   s.retention,
+		MaxBytes: s.maxBytes,
+		Discard:  nats.DiscardOld,
+	}
+	info, err := s.js.StreamInfo(config.Name)
+	switch {
+	case errors.Is(err, nats.ErrStreamNotFound):
+		_, err = s.js.AddStream(config)
+	case err == nil && (info.Config.MaxAge != config.MaxAge || info.Config.MaxBytes != config.MaxBytes):
+		updated := info.Config
+		updated.MaxAge = config.MaxAge
+		updated.MaxBytes = config.MaxBytes
+		_, err = s.js.UpdateStream(&updated)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create the metrics stream: %v", err)
+	}
+	s.streams.Store(prefix, true)
+	return nil
+}
+
+// getMetric returns the definition of a metric, or nil when it doesn't exist
+func getMetric(bucket nats.KeyValue, name string) (*Metric, error) {
+	entry, err := bucket.Get(name)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metric %s: %v", name, err)
+	}
+	var metric Metric
+	if err := json.Unmarshal(entry.Value(), &metric); err != nil {
+		return nil, fmt.Errorf("failed to read metric %s: %v", name, err)
+	}
+	return &metric, nil
+}
+
+// defineMetric returns the definition of a metric, creating it with a type the first time
+// it is recorded. The type of a metric can't change.
+func defineMetric(bucket nats.KeyValue, name, metricType string) (*Metric, int, error) {
+	metric, err := getMetric(bucket, name)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	if metric == nil {
+		if metricType == "" {
+			return nil, http.StatusBadRequest, fmt.Errorf("metric %s doesn't exist yet, give its type", name)
+		}
+		metric = &Metric{Name: name, Type: metricType, Created: time.Now().UTC()}
+		data, _ := json.Marshal(metric)
+		if _, err := bucket.Create(name, data); err != nil {
+			// Another request may have defined it first
+			if metric, _ = getMetric(bucket, name); metric == nil {
+				return nil, http.StatusInternalServerError, fmt.Errorf("failed to define metric %s: %v", name, err)
+			}
+		}
+	}
+	if metricType != "" && metric.Type != metricType {
+		return nil, http.StatusConflict, fmt.Errorf("metric %s is a %s, not a %s", name, metric.Type, metricType)
+	}
+	return metric, http.StatusOK, nil
+}
+
+func validateSample(sample Sample) error {
+	if !namePattern.MatchString(sample.Name) {
+		return fmt.Errorf("name must start with a letter, _ or : followed by letters, digits, _ or :, up to 128 characters")
+	}
+	if sample.Type != "" && !validType(sample.Type) {
+		return fmt.Errorf("type must be counter, gauge or timing")
+	}
+	if sample.Value == nil {
+		return fmt.Errorf("value is required")
+	}
+	value := float64(*sample.Value)
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("value must be a finite number")
+	}
+	if value < 0 && (sample.Type == typeCounter || sample.Type == typeTiming) {
+		return fmt.Errorf("the value of a %s can't be negative", sample.Type)
+	}
+	if len(sample.Labels) > maxLabels {
+		return fmt.Errorf("at most %d labels are allowed", maxLabels)
+	}
+	for label, value := range sample.Labels {
+		if !labelPattern.MatchString(label) || strings.HasPrefix(label, "__") {
+			return fmt.Errorf("invalid label %q, labels are letters, digits and _ and can't start with __", label)
+		}
+		if len(value) > maxLabelValueLength {
+			return fmt.Errorf("the value of label %s can be at most %d characters", label, maxLabelValueLength)
+		}
+	}
+	return nil
+}
+
+// record stores samples, returning the HTTP status of the failure when one can't be.
+// Samples are validated first, so either all are recorded or, barring a storage failure,
+// none are.
+func (s *Server) record(prefix string, samples []Sample) (int, error) {
+	bucket, err := s.getBucket(prefix)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if err := s.getStream(prefix); err != nil {
+		return http.StatusInternalServerError, err
+	}
+	for i, sample := range samples {
+		if err := validateSample(sample); err != nil {
+			return http.StatusBadRequest, fmt.Errorf("sample %d: %v", i, err)
+		}
+	}
+	for i := range samples {
+		metric, status, err := defineMetric(bucket, samples[i].Name, samples[i].Type)
+		if err != nil {
+			return status, fmt.Errorf("sample %d: %v", i, err)
+		}
+		samples[i].Type = metric.Type
+		// Checked again now that the type of an existing metric is known
+		if err := validateSample(samples[i]); err != nil {
+			return http.StatusBadRequest, fmt.Errorf("sample %d: %v", i, err)
+		}
+	}
+	for _, sample := range samples {
+		data, _ := json.Marshal(storedSample{Value: float64(*sample.Value), Labels: sample.Labels})
+		if _, err := s.js.Publish(sampleSubject(prefix, sample.Name), data); err != nil {
+			return http.StatusInternalServerError, fmt.Errorf("failed to record %s: %v", sample.Name, err)
+		}
+	}
+	return http.StatusOK, nil
+}
+
+// handleRecordOne records a sample of a metric of a type: an increment of a counter,
+// defaulting to 1, the value of a gauge or a duration of a timing
+func (s *Server) handleRecordOne(w http.ResponseWriter, r *http.Request, metricType string) {
+	var req RecordOneRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if req.Value == nil && metricType == typeCounter {
+		one := flexibleFloat(1)
+		req.Value = &one
+	}
+	sample := Sample{Name: req.Name, Type: metricType, Value: req.Value, Labels: req.Labels}
+	if status, err := s.record(getPrefixFromEnv(r.Header), []Sample{sample}); err != nil {
+		toolkit.WriteError(w, status, strings.TrimPrefix(err.Error(), "sample 0: "))
+		return
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: map[string]int{"recorded": 1}})
+}
+
+// handleRecord records a batch of samples of any metrics
+func (s *Server) handleRecord(w http.ResponseWriter, r *http.Request) {
+	var req RecordRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if len(req.Samples) == 0 || len(req.Samples) > maxRecord {
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("between 1 and %d samples are required", maxRecord))
+		return
+	}
+	if status, err := s.record(getPrefixFromEnv(r.Header), req.Samples); err != nil {
+		toolkit.WriteError(w, status, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: map[string]int{"recorded": len(req.Samples)}})
+}
+
+// listMetrics returns the definitions of the metrics of a workspace, sorted by name
+func listMetrics(bucket nats.KeyValue) ([]Metric, error) {
+	keys, err := bucket.Keys()
+	if err != nil && !errors.Is(err, nats.ErrNoKeysFound) {
+		return nil, fmt.Errorf("failed to list metrics: %v", err)
+	}
+	metrics := make([]Metric, 0, len(keys))
+	for _, key := range keys {
+		metric, err := getMetric(bucket, key)
+		if err != nil {
+			return nil, err
+		}
+		if metric != nil {
+			metrics = append(metrics, *metric)
+		}
+	}
+	slices.SortFunc(metrics, func(a, b Metric) int { return cmp.Compare(a.Name, b.Name) })
+	return metrics, nil
+}
+
+// handleList returns the metrics of the workspace with the number of samples kept of each
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	prefix, bucket, ok := s.loadWorkspace(w, r)
+	if !ok {
+		return
+	}
+	metrics, err := listMetrics(bucket)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	info, err := s.js.StreamInfo(streamName(prefix), &nats.StreamInfoRequest{SubjectsFilter: sampleSubject(prefix, ">")})
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to count samples: %v", err))
+		return
+	}
+	result := make([]MetricInfo, 0, len(metrics))
+	for _, metric := range metrics {
+		result = append(result, MetricInfo{Metric: metric, Samples: info.State.Subjects[sampleSubject(prefix, metric.Name)]})
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: result})
+}
+
+// handleDelete deletes a metric with all its samples
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	var req MetricRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	prefix, bucket, ok := s.loadWorkspace(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := findMetric(w, bucket, req.Name); !ok {
+		return
+	}
+	// The samples go first, so a failure leaves the metric to delete again
+	if err := s.js.PurgeStream(streamName(prefix), &nats.StreamPurgeRequest{Subject: sampleSubject(prefix, req.Name)}); err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to delete the samples of %s: %v", req.Name, err))
+		return
+	}
+	if err := bucket.Purge(req.Name); err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to delete metric %s: %v", req.Name, err))
+		return
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: map[string]string{"deleted": req.Name}})
+}
+
+// readSamples returns the samples of a metric recorded from start to end, in the order they
+// were recorded. A zero start reads from the first sample kept.
+func (s *Server) readSamples(prefix, name string, start, end time.Time) ([]point, error) {
+	deliver := nats.DeliverAll()
+	if !start.IsZero() {
+		deliver = nats.StartTime(start)
+	}
+	sub, err := s.js.PullSubscribe(sampleSubject(prefix, name), "", nats.BindStream(streamName(prefix)), deliver, nats.AckNone())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the samples of %s: %v", name, err)
+	}
+	defer sub.Unsubscribe()
+	consumer, err := sub.ConsumerInfo()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the samples of %s: %v", name, err)
+	}
+
+	var points []point
+	// Samples recorded while reading are left out, as the pending count is taken first
+	for pending := consumer.NumPending; pending > 0; {
+		msgs, err := sub.Fetch(int(min(pending, 1000)), nats.MaxWait(5*time.Second))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the samples of %s: %v", name, err)
+		}
+		for _, msg := range msgs {
+			pending--
+			meta, err := msg.Metadata()
+			if err != nil {
+				continue
+			}
+			if meta.Timestamp.After(end) {
+				return points, nil
+			}
+			var sample storedSample
+			if err := json.Unmarshal(msg.Data, &sample); err != nil {
+				continue
+			}
+			if len(points) == maxReadSamples {
+				return nil, fmt.Errorf("more than %d samples of %s, narrow the time window", maxReadSamples, name)
+			}
+			points = append(points, point{Time: meta.Timestamp.UTC(), Value: sample.Value, Labels: sample.Labels})
+		}
+	}
+	return points, nil
+}
+
+// loadWorkspace returns the prefix and bucket of the workspace of a request, writing an
+// error response when they can't be loaded
+func (s *Server) loadWorkspace(w http.ResponseWriter, r *http.Request) (string, nats.KeyValue, bool) {
+	prefix := getPrefixFromEnv(r.Header)
+	bucket, err := s.getBucket(prefix)
+	if err == nil {
+		err = s.getStream(prefix)
+	}
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return "", nil, false
+	}
+	return prefix, bucket, true
+}
+
+// findMetric returns the definition of a metric, writing a 404 response when it doesn't
+// exist
+func findMetric(w http.ResponseWriter, bucket nats.KeyValue, name string) (*Metric, bool) {
+	var metric *Metric
+	if namePattern.MatchString(name) {
+		var err error
+		if metric, err = getMetric(bucket, name); err != nil {
+			toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+			return nil, false
+		}
+	}
+	if metric == nil {
+		toolkit.WriteError(w, http.StatusNotFound, fmt.Sprintf("metric %s does not exist", name))
+		return nil, false
+	}
+	return metric, true
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"toolkit"
+)
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"now", now},
+		{"1h", now.Add(-time.Hour)},
+		{"-90m", now.Add(-90 * time.Minute)},
+		{"7d", now.Add(-7 * 24 * time.Hour)},
+		{"2w", now.Add(-14 * 24 * time.Hour)},
+		{"2024-03-01", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"2024-03-01T10:00:00+02:00", time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := parseTime(tt.value, now)
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("parseTime(%q) = %v, %v, want %v", tt.value, got, err, tt.want)
+		}
+	}
+	for _, value := range []string{"yesterday", "0", "03/01/2024", ""} {
+		if got, err := parseTime(value, now); err == nil {
+			t.Errorf("parseTime(%q) = %v, want an error", value, got)
+		}
+	}
+	if _, _, err := parseWindow("1h", "2h", now); err == nil {
+		t.Error("expected an error for a window ending before it starts")
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	counter := aggregate(typeCounter, []float64{1, 2, 3}, time.Minute)
+	if counter.Count != 3 || counter.Sum != 6 || counter.Min != 1 || counter.Max != 3 || counter.Avg != 2 || *counter.Rate != 0.1 {
+		t.Errorf("unexpected counter aggregate %+v", counter)
+	}
+	if counter.Last != nil || counter.P50 != nil {
+		t.Errorf("a counter aggregate has gauge or timing fields %+v", counter)
+	}
+
+	gauge := aggregate(typeGauge, []float64{5, 2, 4}, time.Minute)
+	if gauge.Last == nil || *gauge.Last != 4 || gauge.Rate != nil {
+		t.Errorf("unexpected gauge aggregate %+v", gauge)
+	}
+
+	var durations []float64
+	for i := 100; i >= 1; i-- {
+		durations = append(durations, float64(i))
+	}
+	timing := aggregate(typeTiming, durations, time.Minute)
+	if *timing.P50 != 50 || *timing.P90 != 90 || *timing.P99 != 99 || timing.Max != 100 {
+		t.Errorf("unexpected timing percentiles %v %v %v", *timing.P50, *timing.P90, *timing.P99)
+	}
+	if durations[0] != 100 {
+		t.Error("aggregate sorted the values in place")
+	}
+
+	empty := aggregate(typeCounter, nil, time.Minute)
+	if empty.Count != 0 || empty.Rate == nil || *empty.Rate != 0 {
+		t.Errorf("unexpected empty aggregate %+v", empty)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	start := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	points := []point{
+		{Time: start.Add(-time.Minute), Value: 100, Labels: map[string]string{"tool": "search"}},
+		{Time: start.Add(10 * time.Minute), Value: 1, Labels: map[string]string{"tool": "search", "status": "ok"}},
+		{Time: start.Add(20 * time.Minute), Value: 2, Labels: map[string]string{"tool": "fetch", "status": "ok"}},
+		{Time: start.Add(70 * time.Minute), Value: 3, Labels: map[string]string{"tool": "search", "status": "error"}},
+	}
+	metric := Metric{Name: "calls_total", Type: typeCounter}
+	end := start.Add(2 * time.Hour)
+
+	series := query(metric, points, nil, nil, start, end, 0)
+	if len(series) != 1 || series[0].Aggregate.Sum != 6 || len(series[0].Labels) != 0 || series[0].Buckets != nil {
+		t.Errorf("unexpected ungrouped series %+v", series)
+	}
+
+	series = query(metric, points, nil, []string{"tool"}, start, end, time.Hour)
+	if len(series) != 2 {
+		t.Fatalf("expected 2 series, got %+v", series)
+	}
+	if series[0].Labels["tool"] != "fetch" || series[1].Labels["tool"] != "search" || series[1].Aggregate.Sum != 4 {
+		t.Errorf("unexpected grouped series %+v", series)
+	}
+	if len(series[1].Buckets) != 2 || series[1].Buckets[0].Sum != 1 || series[1].Buckets[1].Sum != 3 || !series[1].Buckets[1].Start.Equal(start.Add(time.Hour)) {
+		t.Errorf("unexpected buckets %+v", series[1].Buckets)
+	}
+
+	series = query(metric, points, map[string]string{"status": "ok"}, []string{"status"}, start, end, 0)
+	if len(series) != 1 || series[0].Aggregate.Count != 2 {
+		t.Errorf("unexpected filtered series %+v", series)
+	}
+}
+
+func TestValidateSample(t *testing.T) {
+	value := func(v float64) *flexibleFloat {
+		f := flexibleFloat(v)
+		return &f
+	}
+	valid := []Sample{
+		{Name: "steps_total", Type: typeCounter, Value: value(1)},
+		{Name: "queue:size", Type: typeGauge, Value: value(-3), Labels: toolkit.StringMap{"queue": "main"}},
+		{Name: "calls_total", Value: value(2)},
+	}
+	for _, sample := range valid {
+		if err := validateSample(sample); err != nil {
+			t.Errorf("validateSample(%+v) = %v", sample, err)
+		}
+	}
+	invalid := []Sample{
+		{Name: "steps.total", Type: typeCounter, Value: value(1)},
+		{Name: "1steps", Type: typeCounter, Value: value(1)},
+		{Name: "steps", Type: "histogram", Value: value(1)},
+		{Name: "steps", Type: typeCounter},
+		{Name: "steps", Type: typeCounter, Value: value(-1)},
+		{Name: "latency", Type: typeTiming, Value: value(-1)},
+		{Name: "steps", Type: typeCounter, Value: value(1), Labels: toolkit.StringMap{"__name__": "x"}},
+		{Name: "steps", Type: typeCounter, Value: value(1), Labels: toolkit.StringMap{"tool-name": "x"}},
+	}
+	for _, sample := range invalid {
+		if err := validateSample(sample); err == nil {
+			t.Errorf("validateSample(%+v) succeeded, want an error", sample)
+		}
+	}
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	series := []*promSeries{{
+		labels:  []promLabel{{name: "__name__", value: "up"}},
+		samples: []promSample{{value: 1, timestamp: 1000}},
+	}}
+	want := "0a1e" + "0a0e" + "0a085f5f6e616d655f5f" + "12027570" + "120c" + "09000000000000f03f" + "10e807"
+	if got := hex.EncodeToString(encodeWriteRequest(series)); got != want {
+		t.Errorf("encodeWriteRequest = %s, want %s", got, want)
+	}
+}
+
+func TestAddMetric(t *testing.T) {
+	start := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	points := []point{
+		{Time: start.Add(-time.Hour), Value: 5},
+		{Time: start.Add(time.Minute), Value: 2},
+		{Time: start.Add(time.Minute), Value: 1},
+		{Time: start.Add(2 * time.Minute), Value: 4, Labels: map[string]string{"tool": "x"}},
+	}
+	builder := newSeriesBuilder(map[string]string{"job": "agent", "tool": "ignored"})
+	builder.addMetric(Metric{Name: "steps_total", Type: typeCounter}, points, start)
+	series := builder.sorted()
+	if len(series) != 2 {
+		t.Fatalf("expected 2 series, got %d", len(series))
+	}
+	// The two samples of the same millisecond collapse into the running total after both
+	if got := series[0].samples; len(got) != 1 || got[0].value != 8 || got[0].timestamp != start.Add(time.Minute).UnixMilli() {
+		t.Errorf("unexpected counter samples %+v", got)
+	}
+	if want := []promLabel{{"__name__", "steps_total"}, {"job", "agent"}, {"tool", "x"}}; !reflect.DeepEqual(series[1].labels, want) {
+		t.Errorf("labels = %v, want %v", series[1].labels, want)
+	}
+
+	builder = newSeriesBuilder(nil)
+	builder.addMetric(Metric{Name: "call_ms", Type: typeTiming}, points[:2], start)
+	series = builder.sorted()
+	if len(series) != 2 || series[0].labels[0].value != "call_ms_count" || series[0].samples[0].value != 2 || series[1].samples[0].value != 7 {
+		t.Errorf("unexpected timing series %+v %+v", series[0], series[1])
+	}
+}
+
+func TestBatchSeries(t *testing.T) {
+	long := &promSeries{key: "a", samples: make([]promSample, maxSamplesPerWrite+10)}
+	short := &promSeries{key: "b", samples: make([]promSample, 20)}
+	batches := batchSeries([]*promSeries{long, short})
+	if len(batches) != 2 || len(batches[0]) != 1 || len(batches[0][0].samples) != maxSamplesPerWrite {
+		t.Fatalf("unexpected first batch of %d batches", len(batches))
+	}
+	if len(batches[1]) != 2 || len(batches[1][0].samples) != 10 || len(batches[1][1].samples) != 20 {
+		t.Errorf("unexpected second batch %+v", batches[1])
+	}
+}
+
+func TestRemoteWrite(t *testing.T) {
+	series := []*promSeries{{
+		labels:  []promLabel{{name: "__name__", value: "up"}},
+		samples: []promSample{{value: 1, timestamp: 1000}},
+	}}
+	var body []byte
+	var header http.Header
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		compressed, _ := io.ReadAll(r.Body)
+		body, _ = snappy.Decode(nil, compressed)
+		if r.Header.Get("Authorization") == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		}
+	}))
+	defer receiver.Close()
+
+	err := remoteWrite(receiver.Client(), receiver.URL, map[string]string{"Authorization": "Bearer x"}, series)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, encodeWriteRequest(series)) {
+		t.Error("the receiver got a different write request")
+	}
+	if header.Get("Content-Encoding") != "snappy" || header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+		t.Errorf("unexpected headers %v", header)
+	}
+	if err := remoteWrite(receiver.Client(), receiver.URL, nil, series); err == nil {
+		t.Error("expected an error when the endpoint rejects the request")
+	}
+}
+
+func TestParams(t *testing.T) {
+	var req struct {
+		Samples sampleList        `json:"samples"`
+		Labels  toolkit.StringMap `json:"labels"`
+		Value   *flexibleFloat
+	}
+	data := `{
+		"samples": "[{\"name\": \"steps_total\", \"value\": \"2\", \"labels\": {\"attempt\": 2, \"ok\": true}}]",
+		"labels": "{\"tool\": \"search\"}",
+		"value": "1.5"
+	}`
+	if err := json.Unmarshal([]byte(data), &req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.Samples) != 1 || *req.Samples[0].Value != 2 || !reflect.DeepEqual(req.Samples[0].Labels, toolkit.StringMap{"attempt": "2", "ok": "true"}) {
+		t.Errorf("unexpected samples %+v", req.Samples)
+	}
+	if req.Labels["tool"] != "search" || *req.Value != 1.5 {
+		t.Errorf("unexpected params %+v", req)
+	}
+	if err := json.Unmarshal([]byte(`{"labels": {"nested": {"a": 1}}}`), &req); err == nil {
+		t.Error("expected an error for a nested label value")
+	}
+}
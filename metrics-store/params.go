@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// flexibleFloat is a number that can also be given as a string
+type flexibleFloat float64
+
+func (f *flexibleFloat) UnmarshalJSON(data []byte) error {
+	var value float64
+	if err := json.Unmarshal(data, &value); err == nil {
+		*f = flexibleFloat(value)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("expected a number")
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+	if err != nil {
+		return fmt.Errorf("expected a number, got %q", str)
+	}
+	*f = flexibleFloat(value)
+	return nil
+}
+
+// sampleList is a list of samples that can also be given as a string holding a JSON array
+type sampleList []Sample
+
+func (l *sampleList) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		data = []byte(str)
+	}
+	var samples []Sample
+	if err := json.Unmarshal(data, &samples); err != nil {
+		return fmt.Errorf("expected a list of samples: %v", err)
+	}
+	*l = samples
+	return nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"toolkit"
+)
+
+const (
+	defaultWindow = 24 * time.Hour
+	maxBuckets    = 1000
+)
+
+type QueryRequest struct {
+	Name string `json:"name"`
+	// Labels are label values samples must have
+	Labels toolkit.StringMap `json:"labels,omitempty"`
+	// Start and end are times, or durations before now such as 1h or 7d
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+	// Step splits the window into buckets of a duration, each aggregated on its own
+	Step    string             `json:"step,omitempty"`
+	GroupBy toolkit.StringList `json:"group_by,omitempty"`
+}
+
+// Aggregate summarizes the values of samples. The fields specific to a type of metric are
+// only set for it.
+type Aggregate struct {
+	Count int     `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Avg   float64 `json:"avg"`
+	// Rate is the sum per second over the window, for counters
+	Rate *float64 `json:"rate,omitempty"`
+	// Last is the latest value, for gauges
+	Last *float64 `json:"last,omitempty"`
+	// P50, P90 and P99 are percentiles of the values, for timings
+	P50 *float64 `json:"p50,omitempty"`
+	P90 *float64 `json:"p90,omitempty"`
+	P99 *float64 `json:"p99,omitempty"`
+}
+
+type Bucket struct {
+	Start time.Time `json:"start"`
+	Aggregate
+}
+
+// Series holds the aggregates of the samples with the same values of the group_by labels
+type Series struct {
+	Labels    map[string]string `json:"labels"`
+	Aggregate Aggregate         `json:"aggregate"`
+	Buckets   []Bucket          `json:"buckets,omitempty"`
+}
+
+type QueryResult struct {
+	Name   string    `json:"name"`
+	Type   string    `json:"type"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Series []Series  `json:"series"`
+}
+
+var longDuration = regexp.MustCompile(`^(\d+(?:\.\d+)?)([dw])$`)
+
+// parseDuration parses a Go duration, or a number of days or weeks such as 7d or 2w
+func parseDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "0" {
+		return 0, nil
+	}
+	if match := longDuration.FindStringSubmatch(value); match != nil {
+		n, _ := strconv.ParseFloat(match[1], 64)
+		unit := 24 * time.Hour
+		if match[2] == "w" {
+			unit *= 7
+		}
+		return time.Duration(n * float64(unit)), nil
+	}
+	return time.ParseDuration(value)
+}
+
+// parseTime parses an RFC 3339 time, a date, now, or a duration before now
+func parseTime(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "now" {
+		return now, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	if d, err := parseDuration(strings.TrimPrefix(value, "-")); err == nil && d > 0 {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected an RFC 3339 time, a date or a duration before now such as 1h or 7d", value)
+}
+
+// parseWindow returns the start and end of a time window, defaulting to the last day
+func parseWindow(start, end string, now time.Time) (time.Time, time.Time, error) {
+	from, to := now.Add(-defaultWindow), now
+	var err error
+	if start != "" {
+		if from, err = parseTime(start, now); err != nil {
+			return from, to, err
+		}
+	}
+	if end != "" {
+		if to, err = parseTime(end, now); err != nil {
+			return from, to, err
+		}
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("start must be before end")
+	}
+	return from, to, nil
+}
+
+// percentile returns the nearest rank percentile of sorted values
+func percentile(sorted []float64, p float64) *float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	value := sorted[max(rank-1, 0)]
+	return &value
+}
+
+// aggregate summarizes the values of samples over a window, in the order they were recorded
+func aggregate(metricType string, values []float64, window time.Duration) Aggregate {
+	var result Aggregate
+	if metricType == typeCounter {
+		rate := 0.0
+		result.Rate = &rate
+	}
+	if len(values) == 0 {
+		return result
+	}
+	result.Count = len(values)
+	result.Min, result.Max = values[0], values[0]
+	for _, value := range values {
+		result.Sum += value
+		result.Min = min(result.Min, value)
+		result.Max = max(result.Max, value)
+	}
+	result.Avg = result.Sum / float64(len(values))
+	switch metricType {
+	case typeCounter:
+		*result.Rate = result.Sum / window.Seconds()
+	case typeGauge:
+		last := values[len(values)-1]
+		result.Last = &last
+	case typeTiming:
+		sorted := slices.Clone(values)
+		slices.Sort(sorted)
+		result.P50, result.P90, result.P99 = percentile(sorted, 50), percentile(sorted, 90), percentile(sorted, 99)
+	}
+	return result
+}
+
+// matchesLabels reports whether labels have every value of the filter
+func matchesLabels(labels, filter map[string]string) bool {
+	for label, value := range filter {
+		if labels[label] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// groupKey identifies the series of a sample by the values of the group_by labels it has
+func groupKey(labels map[string]string, groupBy []string) (string, map[string]string) {
+	group := map[string]string{}
+	var key strings.Builder
+	for _, label := range groupBy {
+		if value, ok := labels[label]; ok {
+			group[label] = value
+			fmt.Fprintf(&key, "%s=%q,", label, value)
+		}
+	}
+	return key.String(), group
+}
+
+// query aggregates points by series and, with a step, by bucket
+func query(metric Metric, points []point, filter map[string]string, groupBy []string, start, end time.Time, step time.Duration) []Series {
+	type group struct {
+		labels  map[string]string
+		values  []float64
+		buckets [][]float64
+	}
+	buckets := 0
+	if step > 0 {
+		buckets = int((end.Sub(start) + step - 1) / step)
+	}
+	groups := map[string]*group{}
+	for _, p := range points {
+		if p.Time.Before(start) || p.Time.After(end) || !matchesLabels(p.Labels, filter) {
+			continue
+		}
+		key, labels := groupKey(p.Labels, groupBy)
+		g, ok := groups[key]
+		if !ok {
+			g = &group{labels: labels, buckets: make([][]float64, buckets)}
+			groups[key] = g
+		}
+		g.values = append(g.values, p.Value)
+		if buckets > 0 {
+			i := min(int(p.Time.Sub(start)/step), buckets-1)
+			g.buckets[i] = append(g.buckets[i], p.Value)
+		}
+	}
+
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, cmp.Compare[string])
+	series := make([]Series, 0, len(keys))
+	for _, key := range keys {
+		g := groups[key]
+		s := Series{Labels: g.labels, Aggregate: aggregate(metric.Type, g.values, end.Sub(start))}
+		for i, values := range g.buckets {
+			bucketStart := start.Add(time.Duration(i) * step)
+			window := min(step, end.Sub(bucketStart))
+			s.Buckets = append(s.Buckets, Bucket{Start: bucketStart, Aggregate: aggregate(metric.Type, values, window)})
+		}
+		series = append(series, s)
+	}
+	return series
+}
+
+// handleQuery aggregates the samples of a metric over a time window, optionally grouped by
+// labels and split into buckets of a step
+func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
+	var req QueryRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	now := time.Now().UTC()
+	start, end, err := parseWindow(req.Start, req.End, now)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	var step time.Duration
+	if req.Step != "" {
+		if step, err = parseDuration(req.Step); err != nil || step <= 0 {
+			toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid step %q, expected a duration such as 5m or 1h", req.Step))
+			return
+		}
+		if end.Sub(start)/step >= maxBuckets {
+			toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("the step splits the window into more than %d buckets, use a longer one", maxBuckets))
+			return
+		}
+	}
+
+	prefix, bucket, ok := s.loadWorkspace(w, r)
+	if !ok {
+		return
+	}
+	metric, ok := findMetric(w, bucket, req.Name)
+	if !ok {
+		return
+	}
+	points, err := s.readSamples(prefix, metric.Name, start, end)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	result := QueryResult{
+		Name:   metric.Name,
+		Type:   metric.Type,
+		Start:  start,
+		End:    end,
+		Series: query(*metric, points, req.Labels, req.GroupBy, start, end, step),
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: result})
+}
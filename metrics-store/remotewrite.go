@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+	"toolkit"
+)
+
+// Exports use the Prometheus remote-write protocol: a snappy compressed protobuf
+// WriteRequest. It only takes a few fields, so it is encoded by hand:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+const (
+	maxSamplesPerWrite = 5000
+	remoteWriteTimeout = 30 * time.Second
+)
+
+type ExportRequest struct {
+	// URL is the remote-write endpoint, defaulting to METRICS_REMOTE_WRITE_URL
+	URL   string             `json:"url,omitempty"`
+	Names toolkit.StringList `json:"names,omitempty"`
+	Start string             `json:"start,omitempty"`
+	End   string             `json:"end,omitempty"`
+	// Labels are added to every series, such as a job label, unless a sample has them
+	Labels  toolkit.StringMap `json:"labels,omitempty"`
+	Headers toolkit.StringMap `json:"headers,omitempty"`
+}
+
+type ExportResult struct {
+	Series   int `json:"series"`
+	Samples  int `json:"samples"`
+	Requests int `json:"requests"`
+}
+
+type promLabel struct {
+	name, value string
+}
+
+type promSample struct {
+	value     float64
+	timestamp int64
+}
+
+type promSeries struct {
+	key     string
+	labels  []promLabel
+	samples []promSample
+}
+
+// seriesBuilder collects samples into series by metric name and labels
+type seriesBuilder struct {
+	extra  map[string]string
+	series map[string]*promSeries
+}
+
+func newSeriesBuilder(extra map[string]string) *seriesBuilder {
+	return &seriesBuilder{extra: extra, series: map[string]*promSeries{}}
+}
+
+func (b *seriesBuilder) add(name string, labels map[string]string, t time.Time, value float64) {
+	all := []promLabel{{name: "__name__", value: name}}
+	for label, value := range labels {
+		all = append(all, promLabel{name: label, value: value})
+	}
+	for label, value := range b.extra {
+		if _, ok := labels[label]; !ok {
+			all = append(all, promLabel{name: label, value: value})
+		}
+	}
+	// Receivers expect the labels of a series sorted by name
+	slices.SortFunc(all, func(a, b promLabel) int { return cmp.Compare(a.name, b.name) })
+	var key strings.Builder
+	for _, label := range all {
+		fmt.Fprintf(&key, "%s=%q,", label.name, label.value)
+	}
+	series, ok := b.series[key.String()]
+	if !ok {
+		series = &promSeries{key: key.String(), labels: all}
+		b.series[series.key] = series
+	}
+	timestamp := t.UnixMilli()
+	// The samples of a series need distinct timestamps, so the last of a millisecond wins
+	if n := len(series.samples); n > 0 && series.samples[n-1].timestamp == timestamp {
+		series.samples[n-1].value = value
+		return
+	}
+	series.samples = append(series.samples, promSample{value: value, timestamp: timestamp})
+}
+
+// sorted returns the series ordered by their labels
+func (b *seriesBuilder) sorted() []*promSeries {
+	series := make([]*promSeries, 0, len(b.series))
+	for _, s := range b.series {
+		series = append(series, s)
+	}
+	slices.SortFunc(series, func(a, b *promSeries) int { return cmp.Compare(a.key, b.key) })
+	return series
+}
+
+// addMetric adds the samples of a metric recorded from start. Counters export as their
+// running total and timings as the running count and sum of their durations, as Prometheus
+// expects, so their points must be read from the first sample kept.
+func (b *seriesBuilder) addMetric(metric Metric, points []point, start time.Time) {
+	type totals struct {
+		count int
+		sum   float64
+	}
+	running := map[string]*totals{}
+	for _, p := range points {
+		if metric.Type == typeGauge {
+			if !p.Time.Before(start) {
+				b.add(metric.Name, p.Labels, p.Time, p.Value)
+			}
+			continue
+		}
+		key, _ := groupKey(p.Labels, sortedLabels(p.Labels))
+		t, ok := running[key]
+		if !ok {
+			t = &totals{}
+			running[key] = t
+		}
+		t.count++
+		t.sum += p.Value
+		if p.Time.Before(start) {
+			continue
+		}
+		if metric.Type == typeCounter {
+			b.add(metric.Name, p.Labels, p.Time, t.sum)
+		} else {
+			b.add(metric.Name+"_count", p.Labels, p.Time, float64(t.count))
+			b.add(metric.Name+"_sum", p.Labels, p.Time, t.sum)
+		}
+	}
+}
+
+func sortedLabels(labels map[string]string) []string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func appendTag(b []byte, field, wireType int) []byte {
+	return binary.AppendUvarint(b, uint64(field<<3|wireType))
+}
+
+func appendBytes(b []byte, field int, data []byte) []byte {
+	b = appendTag(b, field, 2)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// encodeWriteRequest encodes a WriteRequest of series
+func encodeWriteRequest(series []*promSeries) []byte {
+	var request, ts, message []byte
+	for _, s := range series {
+		ts = ts[:0]
+		for _, label := range s.labels {
+			message = appendBytes(message[:0], 1, []byte(label.name))
+			message = appendBytes(message, 2, []byte(label.value))
+			ts = appendBytes(ts, 1, message)
+		}
+		for _, sample := range s.samples {
+			message = appendTag(message[:0], 1, 1)
+			message = binary.LittleEndian.AppendUint64(message, math.Float64bits(sample.value))
+			message = appendTag(message, 2, 0)
+			message = binary.AppendUvarint(message, uint64(sample.timestamp))
+			ts = appendBytes(ts, 2, message)
+		}
+		request = appendBytes(request, 1, ts)
+	}
+	return request
+}
+
+// batchSeries splits series into write requests of at most maxSamplesPerWrite samples,
+// splitting the samples of long series across requests
+func batchSeries(series []*promSeries) [][]*promSeries {
+	var batches [][]*promSeries
+	var batch []*promSeries
+	size := 0
+	for _, s := range series {
+		for samples := s.samples; len(samples) > 0; {
+			if size == maxSamplesPerWrite {
+				batches = append(batches, batch)
+				batch, size = nil, 0
+			}
+			n := min(len(samples), maxSamplesPerWrite-size)
+			batch = append(batch, &promSeries{key: s.key, labels: s.labels, samples: samples[:n]})
+			samples = samples[n:]
+			size += n
+		}
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// remoteWrite sends a write request to a remote-write endpoint
+func remoteWrite(client *http.Client, endpoint string, headers map[string]string, series []*promSeries) error {
+	body := snappy.Encode(nil, encodeWriteRequest(series))
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "metrics-store")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("the endpoint responded %s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	return nil
+}
+
+// handleExport sends the samples of metrics recorded in a time window to a Prometheus
+// remote-write endpoint
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request) {
+	var req ExportRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	endpoint, headers := req.URL, map[string]string(req.Headers)
+	if endpoint == "" {
+		endpoint = s.remoteWriteURL
+		// The configured token only goes to the configured endpoint
+		if s.remoteWriteToken != "" {
+			headers = map[string]string{"Authorization": "Bearer " + s.remoteWriteToken}
+			for name, value := range req.Headers {
+				headers[name] = value
+			}
+		}
+	}
+	if endpoint == "" {
+		toolkit.WriteError(w, http.StatusBadRequest, "url is required as METRICS_REMOTE_WRITE_URL is not set")
+		return
+	}
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid url %q, expected an http or https URL", endpoint))
+		return
+	}
+	for label := range req.Labels {
+		if !labelPattern.MatchString(label) || strings.HasPrefix(label, "__") {
+			toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid label %q, labels are letters, digits and _ and can't start with __", label))
+			return
+		}
+	}
+	start, end, err := parseWindow(req.Start, req.End, time.Now().UTC())
+	if err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	prefix, bucket, ok := s.loadWorkspace(w, r)
+	if !ok {
+		return
+	}
+	var metrics []Metric
+	if len(req.Names) == 0 {
+		if metrics, err = listMetrics(bucket); err != nil {
+			toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	for _, name := range req.Names {
+		metric, ok := findMetric(w, bucket, name)
+		if !ok {
+			return
+		}
+		metrics = append(metrics, *metric)
+	}
+
+	builder := newSeriesBuilder(req.Labels)
+	for _, metric := range metrics {
+		readFrom := start
+		if metric.Type != typeGauge {
+			readFrom = time.Time{}
+		}
+		points, err := s.readSamples(prefix, metric.Name, readFrom, end)
+		if err != nil {
+			toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		builder.addMetric(metric, points, start)
+	}
+
+	series := builder.sorted()
+	result := ExportResult{Series: len(series)}
+	client := &http.Client{Timeout: remoteWriteTimeout}
+	for _, batch := range batchSeries(series) {
+		if err := remoteWrite(client, endpoint, headers, batch); err != nil {
+			toolkit.WriteError(w, http.StatusBadGateway, fmt.Sprintf("failed to export after %d of the samples were sent: %v", result.Samples, err))
+			return
+		}
+		result.Requests++
+		for _, s := range batch {
+			result.Samples += len(s.samples)
+		}
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: result})
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Driver names of the two connections opened to each database. Writes go through the
+// structured table API; the SQL agents send is only ever run on a read-only connection.
+const (
+	writeDriver = "sqlite3_scratch"
+	readDriver  = "sqlite3_scratch_ro"
+)
+
+// sqliteRecursive is SQLITE_RECURSIVE, which go-sqlite3 doesn't export
+const sqliteRecursive = 33
+
+// readOnlyPragmas can be run by queries, they only describe the schema
+var readOnlyPragmas = map[string]bool{
+	"table_info":       true,
+	"table_xinfo":      true,
+	"table_list":       true,
+	"index_list":       true,
+	"index_info":       true,
+	"index_xinfo":      true,
+	"foreign_key_list": true,
+}
+
+func init() {
+	sql.Register(writeDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			pages := maxDatabaseSize / 4096
+			_, err := conn.Exec("PRAGMA page_size = 4096; PRAGMA max_page_count = "+strconv.FormatInt(pages, 10), nil)
+			return err
+		},
+	})
+	sql.Register(readDriver, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			conn.RegisterAuthorizer(authorizeQuery)
+			return nil
+		},
+	})
+}
+
+// authorizeQuery only lets queries read. The connection is already opened read-only, but
+// that doesn't stop ATTACH from opening the database of another workspace.
+func authorizeQuery(action int, arg1, arg2, _ string) int {
+	switch action {
+	case sqlite3.SQLITE_SELECT, sqlite3.SQLITE_READ, sqlite3.SQLITE_FUNCTION, sqliteRecursive:
+		return sqlite3.SQLITE_OK
+	case sqlite3.SQLITE_PRAGMA:
+		if readOnlyPragmas[strings.ToLower(arg1)] {
+			return sqlite3.SQLITE_OK
+		}
+	}
+	return sqlite3.SQLITE_DENY
+}
+
+// maxDatabaseSize bounds the file of each workspace, set from SQL_MAX_DB_SIZE at startup
+var maxDatabaseSize int64 = 1 << 30
+
+// workspaceDB holds the connections to the database of a workspace
+type workspaceDB struct {
+	write *sql.DB
+	read  *sql.DB
+}
+
+func (db *workspaceDB) Close() error {
+	db.read.Close()
+	return db.write.Close()
+}
+
+// databaseCache opens the database of each workspace on its first request and keeps it open
+type databaseCache struct {
+	dir       string
+	lock      sync.Mutex
+	databases map[string]*workspaceDB
+}
+
+func newDatabaseCache(dir string) *databaseCache {
+	return &databaseCache{dir: dir, databases: map[string]*workspaceDB{}}
+}
+
+func (c *databaseCache) get(prefix string) (*workspaceDB, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if db, ok := c.databases[prefix]; ok {
+		return db, nil
+	}
+	db, err := openDatabase(filepath.Join(c.dir, prefix+".db"))
+	if err != nil {
+		return nil, err
+	}
+	c.databases[prefix] = db
+	return db, nil
+}
+
+func (c *databaseCache) closeAll() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for prefix, db := range c.databases {
+		db.Close()
+		delete(c.databases, prefix)
+	}
+}
+
+// openDatabase opens, creating it if needed, the database file at path. The write
+// connection is opened first so the file exists in WAL mode before readers open it.
+func openDatabase(path string) (*workspaceDB, error) {
+	file := "file:" + (&url.URL{Path: path}).EscapedPath()
+	write, err := sql.Open(writeDriver, file+"?_journal_mode=WAL&_busy_timeout=5000&_foreign_keys=on")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	// SQLite allows one writer at a time, more connections would only wait on each other
+	write.SetMaxOpenConns(1)
+	if err := write.Ping(); err != nil {
+		write.Close()
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+
+	read, err := sql.Open(readDriver, file+"?mode=ro&_query_only=true&_busy_timeout=5000")
+	if err != nil {
+		write.Close()
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	read.SetMaxOpenConns(4)
+	if err := read.Ping(); err != nil {
+		read.Close()
+		write.Close()
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	return &workspaceDB{write: write, read: read}, nil
+}
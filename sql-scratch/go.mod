@@ -0,0 +1,10 @@
+module sql-scratch
+
+go 1.23.5
+
+require (
+	github.com/mattn/go-sqlite3 v1.14.33
+	toolkit v0.0.0
+)
+
+replace toolkit => ../toolkit
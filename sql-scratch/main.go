@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"toolkit"
+)
+
+type Server struct {
+	databases    *databaseCache
+	maxRows      int
+	queryTimeout time.Duration
+}
+
+// getPrefixFromEnv generates a SHA1 prefix from the workspace of a request, which names the
+// file of its database
+func getPrefixFromEnv(headers http.Header) string {
+	workspaceID := toolkit.GPTScriptEnv(headers, "GPTSCRIPT_WORKSPACE_ID")
+	if workspaceID == "" {
+		return "default"
+	}
+	hasher := sha1.New()
+	hasher.Write([]byte(workspaceID))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// NewServer reads SQL_MAX_ROWS, the most rows a query returns, and SQL_QUERY_TIMEOUT
+func NewServer(dir string) (*Server, error) {
+	maxRows, err := strconv.Atoi(getEnvOrDefault("SQL_MAX_ROWS", "1000"))
+	if err != nil || maxRows < 1 {
+		return nil, fmt.Errorf("invalid SQL_MAX_ROWS: must be a positive integer")
+	}
+	queryTimeout, err := time.ParseDuration(getEnvOrDefault("SQL_QUERY_TIMEOUT", "10s"))
+	if err != nil || queryTimeout <= 0 {
+		return nil, fmt.Errorf("invalid SQL_QUERY_TIMEOUT: must be a positive duration")
+	}
+	return &Server{
+		databases:    newDatabaseCache(dir),
+		maxRows:      maxRows,
+		queryTimeout: queryTimeout,
+	}, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rw := toolkit.NewResponseWriter(w)
+	w = rw
+	log.Printf("Request: %s %s", r.Method, r.URL.Path)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Handle health check endpoint
+	if r.URL.Path == "/api/ready" && r.Method == http.MethodGet {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// All other endpoints should be POST
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		log.Printf("Response: %d - Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/v1/tables/create":
+		s.handleCreateTable(w, r)
+	case "/api/v1/tables/list":
+		s.handleListTables(w, r)
+	case "/api/v1/tables/drop":
+		s.handleDropTable(w, r)
+	case "/api/v1/insert":
+		s.handleInsert(w, r)
+	case "/api/v1/query":
+		s.handleQuery(w, r)
+	default:
+		http.NotFound(w, r)
+		log.Printf("Response: 404 - Not Found")
+		return
+	}
+
+	log.Printf("Response Status: %d", rw.Status)
+}
+
+func main() {
+	port := getEnvOrDefault("PORT", "8080")
+	storageDir := flag.String("s", getEnvOrDefault("SQL_STORAGE", "./data"), "Directory for storing the databases (env: SQL_STORAGE)")
+	flag.Parse()
+
+	if size := getEnvOrDefault("SQL_MAX_DB_SIZE", ""); size != "" {
+		value, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || value < 1<<20 {
+			log.Fatalf("Invalid SQL_MAX_DB_SIZE: must be at least 1048576 bytes")
+		}
+		maxDatabaseSize = value
+	}
+
+	// Ensure storage directory exists
+	if err := os.MkdirAll(*storageDir, 0755); err != nil {
+		log.Fatalf("Failed to create storage directory: %v", err)
+	}
+
+	httpServer, err := NewServer(*storageDir)
+	if err != nil {
+		log.Fatalf("Failed to create HTTP server: %v", err)
+	}
+
+	go func() {
+		log.Printf("Starting HTTP server on port %s", port)
+		if err := http.ListenAndServe(":"+port, httpServer); err != nil {
+			log.Fatalf("HTTP server error: %v", err)
+		}
+	}()
+	log.Printf("Storage directory: %s", *storageDir)
+
+	// Handle graceful shutdown
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	<-sigChan
+	log.Print("Shutting down server...")
+	httpServer.databases.closeAll()
+}
+
+func getEnvOrDefault(key, defaultValue string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return defaultValue
+}
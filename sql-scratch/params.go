@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// columnList is a list of columns that can also be given as a string holding a JSON array
+type columnList []Column
+
+func (l *columnList) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		data = []byte(str)
+	}
+	var columns []Column
+	if err := json.Unmarshal(data, &columns); err != nil {
+		return fmt.Errorf("expected a list of columns: %v", err)
+	}
+	*l = columns
+	return nil
+}
+
+// rowList is a list of rows, each an object of column values, that can also be given as a
+// string holding a JSON array. Numbers are kept as json.Number so integers stay exact.
+type rowList []map[string]interface{}
+
+func (l *rowList) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		data = []byte(str)
+	}
+	var rows []map[string]interface{}
+	if err := decodeNumbers(data, &rows); err != nil {
+		return fmt.Errorf("expected a list of row objects: %v", err)
+	}
+	*l = rows
+	return nil
+}
+
+// valueList is a list of values that can also be given as a string holding a JSON array
+type valueList []interface{}
+
+func (l *valueList) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		if strings.TrimSpace(str) == "" {
+			*l = nil
+			return nil
+		}
+		data = []byte(str)
+	}
+	var values []interface{}
+	if err := decodeNumbers(data, &values); err != nil {
+		return fmt.Errorf("expected a list of values: %v", err)
+	}
+	*l = values
+	return nil
+}
+
+func decodeNumbers(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
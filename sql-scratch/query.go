@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"toolkit"
+)
+
+type QueryRequest struct {
+	SQL    string      `json:"sql"`
+	Params valueList   `json:"params,omitempty"`
+	Limit  toolkit.Int `json:"limit,omitempty"`
+}
+
+type QueryResult struct {
+	Columns []string        `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+	// Truncated is set when the query returned more rows than the limit
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// sqlValue converts a JSON value to one SQLite can store. Objects and arrays are stored
+// as their JSON text, which SQLite's JSON functions can read.
+func sqlValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, string, bool:
+		return v, nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, nil
+		}
+		return v.Float64()
+	case float64:
+		return v, nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+// jsonValue converts a value read from SQLite to one JSON can hold. Blobs that aren't
+// text are returned base64 encoded.
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		if utf8.Valid(v) {
+			return string(v)
+		}
+		return base64.StdEncoding.EncodeToString(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	}
+	return value
+}
+
+// runQuery runs a read-only query, returning at most limit rows
+func runQuery(ctx context.Context, db *sql.DB, query string, params []interface{}, limit int) (*QueryResult, error) {
+	rows, err := db.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	result := &QueryResult{Columns: columns, Rows: [][]interface{}{}}
+	for rows.Next() {
+		if len(result.Rows) == limit {
+			result.Truncated = true
+			break
+		}
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, err
+		}
+		for i, value := range values {
+			values[i] = jsonValue(value)
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// handleQuery runs SQL from an agent on the read-only connection of its workspace, where
+// anything but reading is refused
+func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
+	var req QueryRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = toolkit.Int(s.maxRows)
+	}
+	switch {
+	case strings.TrimSpace(req.SQL) == "":
+		toolkit.WriteError(w, http.StatusBadRequest, "sql is required")
+		return
+	case req.Limit < 1 || int(req.Limit) > s.maxRows:
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", s.maxRows))
+		return
+	}
+	params := make([]interface{}, len(req.Params))
+	for i, param := range req.Params {
+		value, err := sqlValue(param)
+		if err != nil {
+			toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("param %d: %v", i, err))
+			return
+		}
+		params[i] = value
+	}
+
+	db, err := s.databases.get(getPrefixFromEnv(r.Header))
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), s.queryTimeout)
+	defer cancel()
+	result, err := runQuery(ctx, db.read, req.SQL, params, int(req.Limit))
+	if err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			toolkit.WriteError(w, http.StatusRequestTimeout, fmt.Sprintf("the query took longer than %s", s.queryTimeout))
+			return
+		}
+		if strings.Contains(err.Error(), "not authorized") {
+			toolkit.WriteError(w, http.StatusForbidden, "only read-only queries are allowed, use the table tools to change data")
+			return
+		}
+		toolkit.WriteError(w, sqlStatus(err), err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: result})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"toolkit"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	s, err := NewServer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.databases.closeAll)
+	return s
+}
+
+func call(t *testing.T, s *Server, workspace, path, body string) (int, toolkit.Response) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("X-GPTScript-Env", "GPTSCRIPT_WORKSPACE_ID="+workspace)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	var resp toolkit.Response
+	decoder := json.NewDecoder(rec.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&resp); err != nil {
+		t.Fatalf("%s returned %q", path, rec.Body.String())
+	}
+	return rec.Code, resp
+}
+
+func TestCreateTableStatement(t *testing.T) {
+	statement, err := createTableStatement(CreateTableRequest{
+		Name:    "orders",
+		Columns: columnList{{Name: "id", Type: "integer", PrimaryKey: true}, {Name: "item", NotNull: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `CREATE TABLE "orders" ("id" INTEGER, "item" TEXT NOT NULL, PRIMARY KEY ("id"))`; statement != want {
+		t.Errorf("statement = %s, want %s", statement, want)
+	}
+
+	for _, req := range []CreateTableRequest{
+		{Name: `x"; DROP TABLE y; --`, Columns: columnList{{Name: "a"}}},
+		{Name: "sqlite_x", Columns: columnList{{Name: "a"}}},
+		{Name: "t"},
+		{Name: "t", Columns: columnList{{Name: "a b"}}},
+		{Name: "t", Columns: columnList{{Name: "a"}, {Name: "A"}}},
+		{Name: "t", Columns: columnList{{Name: "a", Type: "VARCHAR(10) DEFAULT 1"}}},
+	} {
+		if _, err := createTableStatement(req); err == nil {
+			t.Errorf("invalid request %+v accepted", req)
+		}
+	}
+}
+
+func TestInsertAndQuery(t *testing.T) {
+	s := newTestServer(t)
+	if code, resp := call(t, s, "ws1", "/api/v1/tables/create", `{"name": "sales", "columns": "[{\"name\": \"region\"}, {\"name\": \"amount\", \"type\": \"INTEGER\"}, {\"name\": \"tags\"}]"}`); code != http.StatusOK {
+		t.Fatalf("create returned %d: %s", code, resp.Error)
+	}
+	code, resp := call(t, s, "ws1", "/api/v1/insert", `{"table": "sales", "rows": [
+		{"region": "east", "amount": 9007199254740993},
+		{"region": "east", "amount": 5, "tags": ["a", "b"]},
+		{"region": "west", "amount": 7}]}`)
+	if code != http.StatusOK {
+		t.Fatalf("insert returned %d: %s", code, resp.Error)
+	}
+
+	code, resp = call(t, s, "ws1", "/api/v1/query", `{"sql": "SELECT region, count(*) AS n FROM sales WHERE amount > ? GROUP BY region ORDER BY region", "params": "[1]"}`)
+	if code != http.StatusOK {
+		t.Fatalf("query returned %d: %s", code, resp.Error)
+	}
+	data, _ := json.Marshal(resp.Data)
+	if want := `{"columns":["region","n"],"rows":[["east",2],["west",1]]}`; string(data) != want {
+		t.Errorf("query returned %s, want %s", data, want)
+	}
+
+	_, resp = call(t, s, "ws1", "/api/v1/query", `{"sql": "SELECT amount, json_extract(tags, '$[1]') FROM sales ORDER BY rowid", "limit": "2"}`)
+	data, _ = json.Marshal(resp.Data)
+	if want := `{"columns":["amount","json_extract(tags, '$[1]')"],"rows":[[9007199254740993,null],[5,"b"]],"truncated":true}`; string(data) != want {
+		t.Errorf("query returned %s, want %s", data, want)
+	}
+
+	// A failed row rolls back the whole insert
+	code, _ = call(t, s, "ws1", "/api/v1/insert", `{"table": "sales", "rows": [{"region": "north"}, {"missing": 1}]}`)
+	if code != http.StatusBadRequest {
+		t.Errorf("insert of an unknown column returned %d", code)
+	}
+	_, resp = call(t, s, "ws1", "/api/v1/tables/list", `{}`)
+	data, _ = json.Marshal(resp.Data)
+	if !strings.Contains(string(data), `"rows":3`) {
+		t.Errorf("tables = %s, want 3 rows", data)
+	}
+
+	// Workspaces have their own databases
+	code, _ = call(t, s, "ws2", "/api/v1/query", `{"sql": "SELECT * FROM sales"}`)
+	if code != http.StatusBadRequest {
+		t.Errorf("query of another workspace's table returned %d", code)
+	}
+}
+
+func TestQueriesAreReadOnly(t *testing.T) {
+	s := newTestServer(t)
+	call(t, s, "ws1", "/api/v1/tables/create", `{"name": "t", "columns": [{"name": "a"}]}`)
+
+	for _, statement := range []string{
+		"INSERT INTO t VALUES (1)",
+		"DELETE FROM t",
+		"DROP TABLE t",
+		"CREATE TABLE u (a)",
+		"ATTACH DATABASE 'other.db' AS other",
+		"PRAGMA journal_mode = DELETE",
+		"SELECT 1; DELETE FROM t",
+	} {
+		body, _ := json.Marshal(map[string]string{"sql": statement})
+		if code, resp := call(t, s, "ws1", "/api/v1/query", string(body)); code != http.StatusForbidden {
+			t.Errorf("%s returned %d: %v", statement, code, resp.Error)
+		}
+	}
+
+	code, resp := call(t, s, "ws1", "/api/v1/query", `{"sql": "WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 3) SELECT sum(i) FROM n"}`)
+	if code != http.StatusOK {
+		t.Errorf("recursive query returned %d: %s", code, resp.Error)
+	}
+	if code, resp := call(t, s, "ws1", "/api/v1/query", `{"sql": "PRAGMA table_info(t)"}`); code != http.StatusOK {
+		t.Errorf("table_info returned %d: %s", code, resp.Error)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+	"toolkit"
+)
+
+const (
+	maxColumns    = 100
+	maxInsertRows = 10000
+)
+
+// Names of tables and columns are checked against identifier, so they can be quoted into
+// statements as they are
+var identifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,63}$`)
+
+// columnTypes are the SQLite type affinities columns can be declared with
+var columnTypes = []string{"TEXT", "INTEGER", "REAL", "NUMERIC", "BLOB"}
+
+type Column struct {
+	Name       string       `json:"name"`
+	Type       string       `json:"type"`
+	PrimaryKey toolkit.Bool `json:"primary_key,omitempty"`
+	NotNull    toolkit.Bool `json:"not_null,omitempty"`
+}
+
+type Table struct {
+	Name    string   `json:"name"`
+	Columns []Column `json:"columns"`
+	Rows    int64    `json:"rows"`
+}
+
+type CreateTableRequest struct {
+	Name        string       `json:"name"`
+	Columns     columnList   `json:"columns"`
+	IfNotExists toolkit.Bool `json:"if_not_exists,omitempty"`
+}
+
+type TableRequest struct {
+	Name string `json:"name"`
+}
+
+type InsertRequest struct {
+	Table string  `json:"table"`
+	Rows  rowList `json:"rows"`
+}
+
+func quote(name string) string {
+	return `"` + name + `"`
+}
+
+// createTableStatement builds the CREATE TABLE statement of a request
+func createTableStatement(req CreateTableRequest) (string, error) {
+	if !identifier.MatchString(req.Name) || strings.HasPrefix(strings.ToLower(req.Name), "sqlite_") {
+		return "", fmt.Errorf("table name must be a letter or _ followed by up to 63 letters, digits or _, and not start with sqlite_")
+	}
+	if len(req.Columns) == 0 || len(req.Columns) > maxColumns {
+		return "", fmt.Errorf("a table must have between 1 and %d columns", maxColumns)
+	}
+
+	var definitions, primaryKey []string
+	seen := map[string]bool{}
+	for _, column := range req.Columns {
+		if !identifier.MatchString(column.Name) {
+			return "", fmt.Errorf("invalid column name %q, it must be a letter or _ followed by up to 63 letters, digits or _", column.Name)
+		}
+		if seen[strings.ToLower(column.Name)] {
+			return "", fmt.Errorf("column %s is given twice", column.Name)
+		}
+		seen[strings.ToLower(column.Name)] = true
+
+		columnType := strings.ToUpper(strings.TrimSpace(column.Type))
+		if columnType == "" {
+			columnType = "TEXT"
+		}
+		if !slices.Contains(columnTypes, columnType) {
+			return "", fmt.Errorf("invalid type %q of column %s, must be one of %s", column.Type, column.Name, strings.Join(columnTypes, ", "))
+		}
+		definition := quote(column.Name) + " " + columnType
+		if column.NotNull {
+			definition += " NOT NULL"
+		}
+		definitions = append(definitions, definition)
+		if column.PrimaryKey {
+			primaryKey = append(primaryKey, quote(column.Name))
+		}
+	}
+	if len(primaryKey) > 0 {
+		definitions = append(definitions, "PRIMARY KEY ("+strings.Join(primaryKey, ", ")+")")
+	}
+
+	statement := "CREATE TABLE "
+	if req.IfNotExists {
+		statement += "IF NOT EXISTS "
+	}
+	return statement + quote(req.Name) + " (" + strings.Join(definitions, ", ") + ")", nil
+}
+
+// sqlStatus returns the HTTP status of a failed statement: mistakes in the request are
+// client errors, failures of the database server errors
+func sqlStatus(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusRequestTimeout
+	}
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return http.StatusInternalServerError
+	}
+	switch sqliteErr.Code {
+	case sqlite3.ErrError, sqlite3.ErrRange, sqlite3.ErrMismatch, sqlite3.ErrTooBig:
+		return http.StatusBadRequest
+	case sqlite3.ErrAuth, sqlite3.ErrReadonly:
+		return http.StatusForbidden
+	case sqlite3.ErrConstraint:
+		return http.StatusConflict
+	case sqlite3.ErrInterrupt:
+		return http.StatusRequestTimeout
+	case sqlite3.ErrFull:
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+func (s *Server) handleCreateTable(w http.ResponseWriter, r *http.Request) {
+	var req CreateTableRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	statement, err := createTableStatement(req)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	db, err := s.databases.get(getPrefixFromEnv(r.Header))
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if _, err := db.write.ExecContext(r.Context(), statement); err != nil {
+		toolkit.WriteError(w, sqlStatus(err), err.Error())
+		return
+	}
+	table, err := describeTable(r.Context(), db.read, req.Name)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: table})
+}
+
+func (s *Server) handleListTables(w http.ResponseWriter, r *http.Request) {
+	db, err := s.databases.get(getPrefixFromEnv(r.Header))
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	rows, err := db.read.QueryContext(r.Context(), `SELECT name FROM sqlite_schema WHERE type = 'table' AND name NOT LIKE 'sqlite\_%' ESCAPE '\' ORDER BY name`)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+
+	tables := make([]*Table, 0, len(names))
+	for _, name := range names {
+		table, err := describeTable(r.Context(), db.read, name)
+		if err != nil {
+			toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		tables = append(tables, table)
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: tables})
+}
+
+// describeTable returns the columns and number of rows of a table
+func describeTable(ctx context.Context, db *sql.DB, name string) (*Table, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name, type, pk, \"notnull\" FROM pragma_table_info(?)", name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe table %s: %v", name, err)
+	}
+	defer rows.Close()
+	table := &Table{Name: name, Columns: []Column{}}
+	for rows.Next() {
+		var column Column
+		var primaryKey, notNull int
+		if err := rows.Scan(&column.Name, &column.Type, &primaryKey, &notNull); err != nil {
+			return nil, fmt.Errorf("failed to describe table %s: %v", name, err)
+		}
+		column.PrimaryKey = primaryKey > 0
+		column.NotNull = notNull != 0
+		table.Columns = append(table.Columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to describe table %s: %v", name, err)
+	}
+	if err := db.QueryRowContext(ctx, "SELECT count(*) FROM "+quote(name)).Scan(&table.Rows); err != nil {
+		return nil, fmt.Errorf("failed to count the rows of %s: %v", name, err)
+	}
+	return table, nil
+}
+
+func (s *Server) handleDropTable(w http.ResponseWriter, r *http.Request) {
+	var req TableRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if !identifier.MatchString(req.Name) {
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid table name %q", req.Name))
+		return
+	}
+	db, err := s.databases.get(getPrefixFromEnv(r.Header))
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if _, err := db.write.ExecContext(r.Context(), "DROP TABLE "+quote(req.Name)); err != nil {
+		if strings.Contains(err.Error(), "no such table") {
+			toolkit.WriteError(w, http.StatusNotFound, fmt.Sprintf("table %s does not exist", req.Name))
+			return
+		}
+		toolkit.WriteError(w, sqlStatus(err), err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true})
+}
+
+// handleInsert inserts rows in one transaction, so either all of them are added or none.
+// Each row is an object of column values; columns it leaves out get their default.
+func (s *Server) handleInsert(w http.ResponseWriter, r *http.Request) {
+	var req InsertRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	switch {
+	case !identifier.MatchString(req.Table):
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid table name %q", req.Table))
+		return
+	case len(req.Rows) == 0:
+		toolkit.WriteError(w, http.StatusBadRequest, "rows is required")
+		return
+	case len(req.Rows) > maxInsertRows:
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("at most %d rows can be inserted at once", maxInsertRows))
+		return
+	}
+	for i, row := range req.Rows {
+		if len(row) == 0 {
+			toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("row %d has no columns", i))
+			return
+		}
+		for column := range row {
+			if !identifier.MatchString(column) {
+				toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid column name %q in row %d", column, i))
+				return
+			}
+		}
+	}
+
+	db, err := s.databases.get(getPrefixFromEnv(r.Header))
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	tx, err := db.write.BeginTx(r.Context(), nil)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	// Rows with the same columns share a statement
+	statements := map[string]*sql.Stmt{}
+	for i, row := range req.Rows {
+		columns := make([]string, 0, len(row))
+		for column := range row {
+			columns = append(columns, column)
+		}
+		slices.Sort(columns)
+		key := strings.Join(columns, ",")
+
+		statement, ok := statements[key]
+		if !ok {
+			quoted := make([]string, len(columns))
+			for j, column := range columns {
+				quoted[j] = quote(column)
+			}
+			placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+			statement, err = tx.PrepareContext(r.Context(), "INSERT INTO "+quote(req.Table)+" ("+strings.Join(quoted, ", ")+") VALUES ("+placeholders+")")
+			if err != nil {
+				toolkit.WriteError(w, sqlStatus(err), err.Error())
+				return
+			}
+			defer statement.Close()
+			statements[key] = statement
+		}
+
+		values := make([]interface{}, len(columns))
+		for j, column := range columns {
+			if values[j], err = sqlValue(row[column]); err != nil {
+				toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("row %d, column %s: %v", i, column, err))
+				return
+			}
+		}
+		if _, err := statement.ExecContext(r.Context(), values...); err != nil {
+			toolkit.WriteError(w, sqlStatus(err), fmt.Sprintf("row %d: %v", i, err))
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		toolkit.WriteError(w, sqlStatus(err), err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: map[string]int{"inserted": len(req.Rows)}})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"toolkit"
+)
+
+const (
+	maxCSVSize = 10 << 20
+	maxCSVRows = 50000
+)
+
+// Import modes: append adds the rows of the file, replace deletes the rows of the table first
+const (
+	modeAppend  = "append"
+	modeReplace = "replace"
+)
+
+type ImportCSVRequest struct {
+	Table  string       `json:"table"`
+	CSV    string       `json:"csv"`
+	Create toolkit.Bool `json:"create,omitempty"`
+	Mode   string       `json:"mode,omitempty"`
+}
+
+type ImportResult struct {
+	Table    string   `json:"table"`
+	Created  bool     `json:"created,omitempty"`
+	Columns  []Column `json:"columns,omitempty"`
+	Imported int      `json:"imported"`
+	Replaced int      `json:"replaced,omitempty"`
+}
+
+type ExportCSVRequest struct {
+	Table   string             `json:"table"`
+	Filter  conditionList      `json:"filter,omitempty"`
+	Sort    toolkit.StringList `json:"sort,omitempty"`
+	Columns toolkit.StringList `json:"columns,omitempty"`
+}
+
+// parseCSV reads the header and records of a CSV file. An id column is left out, rows get
+// new IDs when imported.
+func parseCSV(data string) ([]string, [][]string, error) {
+	reader := csv.NewReader(strings.NewReader(strings.TrimPrefix(data, "\ufeff")))
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CSV: %v", err)
+	}
+	if len(records) == 0 {
+		return nil, nil, fmt.Errorf("the CSV has no header")
+	}
+	if len(records)-1 > maxCSVRows {
+		return nil, nil, fmt.Errorf("at most %d rows can be imported at once", maxCSVRows)
+	}
+
+	idIndex := -1
+	header := make([]string, 0, len(records[0]))
+	for i, name := range records[0] {
+		name = strings.TrimSpace(name)
+		if strings.EqualFold(name, idColumn) {
+			idIndex = i
+			continue
+		}
+		header = append(header, name)
+	}
+	rows := make([][]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		if idIndex >= 0 {
+			record = append(record[:idIndex:idIndex], record[idIndex+1:]...)
+		}
+		rows = append(rows, record)
+	}
+	return header, rows, nil
+}
+
+// inferColumns makes the columns of a table for a CSV file, typed by the values in them
+func inferColumns(header []string, rows [][]string) []Column {
+	columns := make([]Column, len(header))
+	for i, name := range header {
+		values := make([]string, len(rows))
+		for j, row := range rows {
+			values[j] = row[i]
+		}
+		columns[i] = Column{Name: name, Type: inferType(values)}
+	}
+	return columns
+}
+
+// handleImportCSV adds the rows of a CSV file to a table, creating the table when asked to.
+// The columns of the file must be columns of the table; none of the rows are added if one
+// is invalid.
+func (s *Server) handleImportCSV(w http.ResponseWriter, r *http.Request) {
+	var req ImportCSVRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if req.Mode == "" {
+		req.Mode = modeAppend
+	}
+	switch {
+	case !tableName.MatchString(req.Table):
+		toolkit.WriteError(w, http.StatusBadRequest, "table must be 1 to 64 letters, digits, - or _")
+		return
+	case req.Mode != modeAppend && req.Mode != modeReplace:
+		toolkit.WriteError(w, http.StatusBadRequest, "mode must be append or replace")
+		return
+	case len(req.CSV) > maxCSVSize:
+		toolkit.WriteError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("the CSV can be at most %d bytes", maxCSVSize))
+		return
+	}
+	header, records, err := parseCSV(req.CSV)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	bucket, err := s.getBucket(getPrefixFromEnv(r.Header))
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	result := ImportResult{Table: req.Table}
+	cached, err := s.cache.get(bucket, req.Table)
+	if errors.Is(err, nats.ErrKeyNotFound) && bool(req.Create) {
+		columns := inferColumns(header, records)
+		if err := validateColumns(columns); err != nil {
+			toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if _, err := createTable(bucket, req.Table, columns); err != nil && !errors.Is(err, nats.ErrKeyExists) {
+			toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		result.Created, result.Columns = true, columns
+		cached, err = s.cache.get(bucket, req.Table)
+	}
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		toolkit.WriteError(w, http.StatusNotFound, fmt.Sprintf("table %s does not exist, set create to create it from the CSV", req.Table))
+		return
+	}
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	cached.lock.Lock()
+	defer cached.lock.Unlock()
+	rows := make([]map[string]interface{}, len(records))
+	for i, record := range records {
+		rows[i] = make(map[string]interface{}, len(header))
+		for j, name := range header {
+			rows[i][name] = record[j]
+		}
+		// Rows are checked before replace deletes anything
+		if _, err := validateValues(cached.table, rows[i], false); err != nil {
+			toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("line %d: %v", i+2, err))
+			return
+		}
+	}
+
+	if req.Mode == modeReplace {
+		for id := range cached.rows {
+			if err := cached.deleteRow(bucket, id); err != nil {
+				toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			result.Replaced++
+		}
+	}
+	if len(rows) > 0 {
+		ids, err := cached.insertRows(bucket, rows)
+		result.Imported = len(ids)
+		if err != nil {
+			toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("imported %d rows, then failed: %v", len(ids), err))
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: result})
+}
+
+// handleExportCSV returns the rows of a table matching a filter as a CSV file, with their ID
+// in the first column
+func (s *Server) handleExportCSV(w http.ResponseWriter, r *http.Request) {
+	var req ExportCSVRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	_, cached, ok := s.loadTable(w, r, req.Table)
+	if !ok {
+		return
+	}
+	cached.lock.RLock()
+	defer cached.lock.RUnlock()
+	conditions, err := prepareConditions(cached.table, req.Filter)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	keys, err := parseSort(cached.table, req.Sort)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	columns := []string(req.Columns)
+	if len(columns) == 0 {
+		for _, column := range cached.table.Columns {
+			columns = append(columns, column.Name)
+		}
+	}
+	for _, name := range columns {
+		if _, ok := cached.table.column(name); !ok {
+			toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("table %s has no column %q", cached.table.Name, name))
+			return
+		}
+	}
+
+	rows := cached.selectRows(conditions, keys)
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write(append([]string{idColumn}, columns...))
+	for _, row := range rows {
+		record := make([]string, 0, len(columns)+1)
+		record = append(record, strconv.FormatInt(row.ID, 10))
+		for _, name := range columns {
+			record = append(record, formatValue(row.Values[name]))
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: map[string]interface{}{"csv": buf.String(), "rows": len(rows)}})
+}
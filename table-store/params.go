@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// columnList is a list of columns that can also be given as a string holding a JSON array
+type columnList []Column
+
+func (l *columnList) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		data = []byte(str)
+	}
+	var columns []Column
+	if err := json.Unmarshal(data, &columns); err != nil {
+		return fmt.Errorf("expected a list of columns: %v", err)
+	}
+	*l = columns
+	return nil
+}
+
+// rowValues is an object of column values that can also be given as a string holding a
+// JSON object. Numbers are kept as json.Number so integers stay exact.
+type rowValues map[string]interface{}
+
+func (v *rowValues) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		data = []byte(str)
+	}
+	var values map[string]interface{}
+	if err := decodeNumbers(data, &values); err != nil {
+		return fmt.Errorf("expected an object of column values: %v", err)
+	}
+	*v = values
+	return nil
+}
+
+// rowList is a list of rows, each an object of column values, that can also be given as a
+// string holding a JSON array
+type rowList []map[string]interface{}
+
+func (l *rowList) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		data = []byte(str)
+	}
+	var rows []map[string]interface{}
+	if err := decodeNumbers(data, &rows); err != nil {
+		return fmt.Errorf("expected a list of row objects: %v", err)
+	}
+	*l = rows
+	return nil
+}
+
+// idList is a list of row IDs that can also be given as a string holding a JSON array or
+// comma separated IDs
+type idList []int64
+
+func (l *idList) UnmarshalJSON(data []byte) error {
+	var ids []int64
+	if err := json.Unmarshal(data, &ids); err == nil {
+		*l = ids
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("expected a list of IDs")
+	}
+	str = strings.TrimSpace(str)
+	if strings.HasPrefix(str, "[") {
+		if err := json.Unmarshal([]byte(str), &ids); err != nil {
+			return fmt.Errorf("expected a list of IDs")
+		}
+		*l = ids
+		return nil
+	}
+	*l = nil
+	for _, item := range strings.Split(str, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(item, 10, 64)
+		if err != nil {
+			return fmt.Errorf("expected a list of IDs, got %q", item)
+		}
+		*l = append(*l, id)
+	}
+	return nil
+}
+
+// conditionList is a list of filter conditions. It can also be given as an object of
+// column values to match, or as a string holding either.
+type conditionList []Condition
+
+func (l *conditionList) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		if strings.TrimSpace(str) == "" {
+			*l = nil
+			return nil
+		}
+		data = []byte(str)
+	}
+	var conditions []Condition
+	if err := decodeNumbers(data, &conditions); err == nil {
+		*l = conditions
+		return nil
+	}
+	var values map[string]interface{}
+	if err := decodeNumbers(data, &values); err != nil {
+		return fmt.Errorf("expected a list of conditions or an object of column values")
+	}
+	*l = make([]Condition, 0, len(values))
+	for column, value := range values {
+		*l = append(*l, Condition{Column: column, Op: "eq", Value: value})
+	}
+	return nil
+}
+
+func decodeNumbers(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
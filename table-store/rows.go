@@ -0,0 +1,503 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"toolkit"
+)
+
+const (
+	maxInsertRows = 1000
+	maxQueryRows  = 1000
+)
+
+// Filter operators, with the symbols they can also be written as
+var operators = map[string]string{
+	"eq": "eq", "=": "eq", "==": "eq",
+	"ne": "ne", "!=": "ne", "<>": "ne",
+	"lt": "lt", "<": "lt",
+	"lte": "lte", "<=": "lte",
+	"gt": "gt", ">": "gt",
+	"gte": "gte", ">=": "gte",
+	"contains":    "contains",
+	"starts_with": "starts_with",
+	"in":          "in",
+	"is_null":     "is_null",
+	"not_null":    "not_null",
+}
+
+type Condition struct {
+	Column string      `json:"column"`
+	Op     string      `json:"op,omitempty"`
+	Value  interface{} `json:"value,omitempty"`
+}
+
+type InsertRowsRequest struct {
+	Table string  `json:"table"`
+	Rows  rowList `json:"rows"`
+}
+
+type UpdateRowsRequest struct {
+	Table  string        `json:"table"`
+	IDs    idList        `json:"ids,omitempty"`
+	Filter conditionList `json:"filter,omitempty"`
+	Values rowValues     `json:"values"`
+}
+
+type DeleteRowsRequest struct {
+	Table  string        `json:"table"`
+	IDs    idList        `json:"ids,omitempty"`
+	Filter conditionList `json:"filter,omitempty"`
+}
+
+type QueryRowsRequest struct {
+	Table   string             `json:"table"`
+	Filter  conditionList      `json:"filter,omitempty"`
+	Sort    toolkit.StringList `json:"sort,omitempty"`
+	Columns toolkit.StringList `json:"columns,omitempty"`
+	Limit   toolkit.Int        `json:"limit,omitempty"`
+	Offset  toolkit.Int        `json:"offset,omitempty"`
+}
+
+type QueryResult struct {
+	Rows []Row `json:"rows"`
+	// Total is the number of rows matching the filter, of which Rows is a page
+	Total int `json:"total"`
+}
+
+// condition is a filter condition checked against a table, with its value coerced to the
+// type of its column
+type condition struct {
+	column string
+	op     string
+	value  interface{}
+	values []interface{}
+}
+
+type sortKey struct {
+	column     string
+	descending bool
+}
+
+// columnType returns the type of a column of a table, including the ID of rows
+func columnType(table *Table, name string) (string, bool) {
+	if name == idColumn {
+		return typeInteger, true
+	}
+	column, ok := table.column(name)
+	return column.Type, ok
+}
+
+func prepareConditions(table *Table, conditions []Condition) ([]condition, error) {
+	prepared := make([]condition, 0, len(conditions))
+	for _, c := range conditions {
+		columnType, ok := columnType(table, c.Column)
+		if !ok {
+			return nil, fmt.Errorf("table %s has no column %q", table.Name, c.Column)
+		}
+		if c.Op == "" {
+			c.Op = "eq"
+		}
+		op, ok := operators[strings.ToLower(c.Op)]
+		if !ok {
+			return nil, fmt.Errorf("invalid operator %q, must be eq, ne, lt, lte, gt, gte, contains, starts_with, in, is_null or not_null", c.Op)
+		}
+		if op == "eq" && c.Value == nil {
+			op = "is_null"
+		}
+		if op == "ne" && c.Value == nil {
+			op = "not_null"
+		}
+		prepared = append(prepared, condition{column: c.Column, op: op})
+		current := &prepared[len(prepared)-1]
+
+		switch op {
+		case "is_null", "not_null":
+		case "contains", "starts_with":
+			str, ok := c.Value.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s needs a string value", op)
+			}
+			current.value = strings.ToLower(str)
+		case "in":
+			values, ok := c.Value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("in needs a list of values")
+			}
+			for _, value := range values {
+				coerced, err := coerce(columnType, value)
+				if err != nil {
+					return nil, fmt.Errorf("column %s: %v", c.Column, err)
+				}
+				current.values = append(current.values, coerced)
+			}
+		default:
+			coerced, err := coerce(columnType, c.Value)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %v", c.Column, err)
+			}
+			current.value = coerced
+		}
+	}
+	return prepared, nil
+}
+
+// value returns the value of a column of a row, including its ID
+func (r *Row) value(column string) interface{} {
+	if column == idColumn {
+		return r.ID
+	}
+	return r.Values[column]
+}
+
+// matches reports whether a row meets all the conditions. Comparisons with null are false
+// except for is_null and ne.
+func (r *Row) matches(conditions []condition) bool {
+	for _, c := range conditions {
+		value := r.value(c.column)
+		var ok bool
+		switch c.op {
+		case "is_null":
+			ok = value == nil
+		case "not_null":
+			ok = value != nil
+		case "eq":
+			ok = value != nil && compareValues(value, c.value) == 0
+		case "ne":
+			ok = value == nil || compareValues(value, c.value) != 0
+		case "lt":
+			ok = value != nil && compareValues(value, c.value) < 0
+		case "lte":
+			ok = value != nil && compareValues(value, c.value) <= 0
+		case "gt":
+			ok = value != nil && compareValues(value, c.value) > 0
+		case "gte":
+			ok = value != nil && compareValues(value, c.value) >= 0
+		case "contains":
+			ok = value != nil && strings.Contains(strings.ToLower(formatValue(value)), c.value.(string))
+		case "starts_with":
+			ok = value != nil && strings.HasPrefix(strings.ToLower(formatValue(value)), c.value.(string))
+		case "in":
+			ok = value != nil && slices.ContainsFunc(c.values, func(v interface{}) bool { return compareValues(value, v) == 0 })
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSort reads sort keys written as column, -column or "column desc"
+func parseSort(table *Table, sort []string) ([]sortKey, error) {
+	keys := make([]sortKey, 0, len(sort))
+	for _, item := range sort {
+		key := sortKey{column: strings.TrimSpace(item)}
+		if name, ok := strings.CutPrefix(key.column, "-"); ok {
+			key.column, key.descending = name, true
+		} else if i := strings.LastIndex(key.column, " "); i > 0 {
+			switch strings.ToLower(key.column[i+1:]) {
+			case "desc":
+				key.column, key.descending = strings.TrimSpace(key.column[:i]), true
+			case "asc":
+				key.column = strings.TrimSpace(key.column[:i])
+			}
+		}
+		if _, ok := columnType(table, key.column); !ok {
+			return nil, fmt.Errorf("table %s has no column %q to sort by", table.Name, key.column)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// selectRows returns the rows of a table matching conditions, sorted. The caller holds a
+// lock of the table.
+func (cached *cachedTable) selectRows(conditions []condition, keys []sortKey) []*Row {
+	var rows []*Row
+	for _, row := range cached.rows {
+		if row.matches(conditions) {
+			rows = append(rows, row)
+		}
+	}
+	slices.SortFunc(rows, func(a, b *Row) int {
+		for _, key := range keys {
+			order := compareValues(a.value(key.column), b.value(key.column))
+			if key.descending {
+				order = -order
+			}
+			if order != 0 {
+				return order
+			}
+		}
+		// Rows that sort the same stay in the order they were added
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return rows
+}
+
+// validateValues coerces the values of a row to the types of their columns. Inserted rows
+// must have a value for every required column; updates only change the columns given.
+func validateValues(table *Table, values map[string]interface{}, update bool) (map[string]interface{}, error) {
+	coerced := make(map[string]interface{}, len(values))
+	for name, value := range values {
+		column, ok := table.column(name)
+		if !ok {
+			if name == idColumn {
+				return nil, fmt.Errorf("the %s of rows is given when they are inserted and can't be set", idColumn)
+			}
+			return nil, fmt.Errorf("table %s has no column %q", table.Name, name)
+		}
+		v, err := coerce(column.Type, value)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %v", name, err)
+		}
+		if v == nil && column.Required {
+			return nil, fmt.Errorf("column %s is required", name)
+		}
+		coerced[name] = v
+	}
+	if !update {
+		for _, column := range table.Columns {
+			if _, ok := coerced[column.Name]; !ok && bool(column.Required) {
+				return nil, fmt.Errorf("column %s is required", column.Name)
+			}
+		}
+	}
+	return coerced, nil
+}
+
+// newRow makes a row of coerced values, leaving out the null ones
+func newRow(id int64, values map[string]interface{}) *Row {
+	row := &Row{ID: id, Values: make(map[string]interface{}, len(values))}
+	for name, value := range values {
+		if value != nil {
+			row.Values[name] = value
+		}
+	}
+	return row
+}
+
+// insertRows validates rows and adds them with new IDs, adding none if any is invalid.
+// The caller holds the lock of the table.
+func (cached *cachedTable) insertRows(bucket nats.KeyValue, rows []map[string]interface{}) ([]int64, error) {
+	coerced := make([]map[string]interface{}, len(rows))
+	for i, values := range rows {
+		var err error
+		if coerced[i], err = validateValues(cached.table, values, false); err != nil {
+			return nil, &rowError{row: i, err: err}
+		}
+	}
+
+	// The IDs are reserved before the rows are written, so they are never given out twice
+	table := *cached.table
+	first := table.NextID
+	table.NextID += int64(len(rows))
+	if err := cached.saveTable(bucket, &table); err != nil {
+		return nil, err
+	}
+	ids := make([]int64, len(rows))
+	for i, values := range coerced {
+		ids[i] = first + int64(i)
+		if err := cached.putRow(bucket, newRow(ids[i], values)); err != nil {
+			return ids[:i], err
+		}
+	}
+	return ids, nil
+}
+
+// rowError is an invalid row of a request
+type rowError struct {
+	row int
+	err error
+}
+
+func (e *rowError) Error() string {
+	return fmt.Sprintf("row %d: %v", e.row, e.err)
+}
+
+func (s *Server) handleInsertRows(w http.ResponseWriter, r *http.Request) {
+	var req InsertRowsRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if len(req.Rows) == 0 || len(req.Rows) > maxInsertRows {
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("between 1 and %d rows are required", maxInsertRows))
+		return
+	}
+	bucket, cached, ok := s.loadTable(w, r, req.Table)
+	if !ok {
+		return
+	}
+	cached.lock.Lock()
+	defer cached.lock.Unlock()
+	ids, err := cached.insertRows(bucket, req.Rows)
+	if err != nil {
+		var invalid *rowError
+		if errors.As(err, &invalid) {
+			toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: map[string]interface{}{"inserted": len(ids), "ids": ids}})
+}
+
+// targetRows returns the rows an update or delete applies to: those with the IDs given and
+// matching the filter. One of them is required, so a forgotten filter doesn't change every
+// row. The caller holds a lock of the table.
+func (cached *cachedTable) targetRows(ids []int64, filter []Condition) ([]*Row, error) {
+	if len(ids) == 0 && len(filter) == 0 {
+		return nil, fmt.Errorf("ids or filter is required")
+	}
+	conditions, err := prepareConditions(cached.table, filter)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 {
+		values := make([]interface{}, len(ids))
+		for i, id := range ids {
+			values[i] = id
+		}
+		conditions = append(conditions, condition{column: idColumn, op: "in", values: values})
+	}
+	return cached.selectRows(conditions, nil), nil
+}
+
+func (s *Server) handleUpdateRows(w http.ResponseWriter, r *http.Request) {
+	var req UpdateRowsRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if len(req.Values) == 0 {
+		toolkit.WriteError(w, http.StatusBadRequest, "values are required")
+		return
+	}
+	bucket, cached, ok := s.loadTable(w, r, req.Table)
+	if !ok {
+		return
+	}
+	cached.lock.Lock()
+	defer cached.lock.Unlock()
+	values, err := validateValues(cached.table, req.Values, true)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rows, err := cached.targetRows(req.IDs, req.Filter)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, row := range rows {
+		updated := make(map[string]interface{}, len(row.Values)+len(values))
+		for name, value := range row.Values {
+			updated[name] = value
+		}
+		for name, value := range values {
+			updated[name] = value
+		}
+		if err := cached.putRow(bucket, newRow(row.ID, updated)); err != nil {
+			toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: map[string]int{"updated": len(rows)}})
+}
+
+func (s *Server) handleDeleteRows(w http.ResponseWriter, r *http.Request) {
+	var req DeleteRowsRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	bucket, cached, ok := s.loadTable(w, r, req.Table)
+	if !ok {
+		return
+	}
+	cached.lock.Lock()
+	defer cached.lock.Unlock()
+	rows, err := cached.targetRows(req.IDs, req.Filter)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	for _, row := range rows {
+		if err := cached.deleteRow(bucket, row.ID); err != nil {
+			toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: map[string]int{"deleted": len(rows)}})
+}
+
+// selectColumns keeps the values of the columns asked for, checking they exist
+func selectColumns(table *Table, rows []*Row, columns []string) ([]Row, error) {
+	for _, name := range columns {
+		if _, ok := columnType(table, name); !ok {
+			return nil, fmt.Errorf("table %s has no column %q", table.Name, name)
+		}
+	}
+	selected := make([]Row, len(rows))
+	for i, row := range rows {
+		selected[i] = *row
+		if len(columns) == 0 {
+			continue
+		}
+		selected[i].Values = map[string]interface{}{}
+		for _, name := range columns {
+			if value, ok := row.Values[name]; ok {
+				selected[i].Values[name] = value
+			}
+		}
+	}
+	return selected, nil
+}
+
+func (s *Server) handleQueryRows(w http.ResponseWriter, r *http.Request) {
+	var req QueryRowsRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = 100
+	}
+	if req.Limit < 1 || req.Limit > maxQueryRows {
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxQueryRows))
+		return
+	}
+	if req.Offset < 0 {
+		toolkit.WriteError(w, http.StatusBadRequest, "offset must not be negative")
+		return
+	}
+	_, cached, ok := s.loadTable(w, r, req.Table)
+	if !ok {
+		return
+	}
+	cached.lock.RLock()
+	defer cached.lock.RUnlock()
+	conditions, err := prepareConditions(cached.table, req.Filter)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	keys, err := parseSort(cached.table, req.Sort)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	rows := cached.selectRows(conditions, keys)
+	result := QueryResult{Total: len(rows)}
+	page := rows[min(int(req.Offset), len(rows)):min(int(req.Offset+req.Limit), len(rows))]
+	if result.Rows, err = selectColumns(cached.table, page, req.Columns); err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: result})
+}
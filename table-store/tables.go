@@ -0,0 +1,440 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/nats-io/nats.go"
+	"toolkit"
+)
+
+const (
+	maxColumns          = 100
+	maxColumnNameLength = 64
+)
+
+// Tables are stored as table.<name>, their rows as row.<name>.<id>
+var tableName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// idColumn is the ID every row gets, it can't be used as the name of a column
+const idColumn = "id"
+
+type Column struct {
+	Name     string       `json:"name"`
+	Type     string       `json:"type"`
+	Required toolkit.Bool `json:"required,omitempty"`
+}
+
+type Table struct {
+	Name    string    `json:"name"`
+	Columns []Column  `json:"columns"`
+	Created time.Time `json:"created"`
+	// NextID is the ID of the next row inserted, IDs are never reused
+	NextID int64 `json:"next_id"`
+	Rows   int   `json:"rows,omitempty"`
+}
+
+func (t *Table) column(name string) (Column, bool) {
+	for _, column := range t.Columns {
+		if column.Name == name {
+			return column, true
+		}
+	}
+	return Column{}, false
+}
+
+// Row is written as one JSON object of its ID and values
+type Row struct {
+	ID     int64
+	Values map[string]interface{}
+}
+
+func (r Row) MarshalJSON() ([]byte, error) {
+	object := make(map[string]interface{}, len(r.Values)+1)
+	for name, value := range r.Values {
+		object[name] = value
+	}
+	object[idColumn] = r.ID
+	return json.Marshal(object)
+}
+
+type TableRequest struct {
+	Name    string     `json:"name"`
+	Columns columnList `json:"columns,omitempty"`
+}
+
+type AlterTableRequest struct {
+	Name        string             `json:"name"`
+	AddColumns  columnList         `json:"add_columns,omitempty"`
+	DropColumns toolkit.StringList `json:"drop_columns,omitempty"`
+}
+
+func tableKey(name string) string {
+	return "table." + name
+}
+
+func rowKey(table string, id int64) string {
+	return "row." + table + "." + strconv.FormatInt(id, 10)
+}
+
+// validateColumn checks the name and type of a column, defaulting its type to string
+func validateColumn(column *Column) error {
+	name := strings.TrimSpace(column.Name)
+	if name == "" || len(name) > maxColumnNameLength || name != column.Name {
+		return fmt.Errorf("column name %q must be 1 to %d characters, without spaces around it", column.Name, maxColumnNameLength)
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return fmt.Errorf("column name %q must not hold control characters", column.Name)
+	}
+	if strings.EqualFold(name, idColumn) {
+		return fmt.Errorf("%s is the ID of every row, it can't be a column", idColumn)
+	}
+	column.Type = strings.ToLower(strings.TrimSpace(column.Type))
+	if column.Type == "" {
+		column.Type = typeString
+	}
+	if !slices.Contains(columnTypes, column.Type) {
+		return fmt.Errorf("invalid type %q of column %s, must be one of %s", column.Type, column.Name, strings.Join(columnTypes, ", "))
+	}
+	return nil
+}
+
+func validateColumns(columns []Column) error {
+	if len(columns) > maxColumns {
+		return fmt.Errorf("a table can have at most %d columns", maxColumns)
+	}
+	seen := map[string]bool{}
+	for i := range columns {
+		if err := validateColumn(&columns[i]); err != nil {
+			return err
+		}
+		if seen[columns[i].Name] {
+			return fmt.Errorf("column %s is given twice", columns[i].Name)
+		}
+		seen[columns[i].Name] = true
+	}
+	return nil
+}
+
+// tableCache holds the schema and rows of the tables used, so queries don't read the
+// whole table from the bucket each time. Writes go through the cache.
+type tableCache struct {
+	lock   sync.Mutex
+	tables map[string]*cachedTable
+}
+
+type cachedTable struct {
+	lock sync.RWMutex
+	// table is the schema as last written, revision its revision in the bucket
+	table    *Table
+	revision uint64
+	rows     map[int64]*Row
+}
+
+func newTableCache() *tableCache {
+	return &tableCache{tables: map[string]*cachedTable{}}
+}
+
+// get returns a cached table, reading it from the bucket the first time. It returns
+// nats.ErrKeyNotFound when the table doesn't exist.
+func (c *tableCache) get(bucket nats.KeyValue, name string) (*cachedTable, error) {
+	id := bucket.Bucket() + "/" + name
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if cached, ok := c.tables[id]; ok {
+		return cached, nil
+	}
+
+	entry, err := bucket.Get(tableKey(name))
+	if err != nil {
+		return nil, err
+	}
+	cached := &cachedTable{table: &Table{}, revision: entry.Revision(), rows: map[int64]*Row{}}
+	if err := json.Unmarshal(entry.Value(), cached.table); err != nil {
+		return nil, fmt.Errorf("failed to read table %s: %v", name, err)
+	}
+
+	watcher, err := bucket.Watch("row."+name+".*", nats.IgnoreDeletes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the rows of %s: %v", name, err)
+	}
+	defer watcher.Stop()
+	// The watcher sends the current values, then nil once it is up to date
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		row, err := decodeRow(cached.table, entry.Value())
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row %s: %v", entry.Key(), err)
+		}
+		cached.rows[row.ID] = row
+	}
+	c.tables[id] = cached
+	return cached, nil
+}
+
+func (c *tableCache) drop(bucket nats.KeyValue, name string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.tables, bucket.Bucket()+"/"+name)
+}
+
+// decodeRow reads a stored row, restoring the types JSON loses such as integers
+func decodeRow(table *Table, data []byte) (*Row, error) {
+	var object map[string]interface{}
+	if err := decodeNumbers(data, &object); err != nil {
+		return nil, err
+	}
+	id, ok := object[idColumn].(json.Number)
+	if !ok {
+		return nil, fmt.Errorf("the row has no ID")
+	}
+	row := &Row{Values: map[string]interface{}{}}
+	var err error
+	if row.ID, err = id.Int64(); err != nil {
+		return nil, fmt.Errorf("invalid ID %s", id)
+	}
+	for _, column := range table.Columns {
+		if value, err := coerce(column.Type, object[column.Name]); err == nil && value != nil {
+			row.Values[column.Name] = value
+		}
+	}
+	return row, nil
+}
+
+// saveTable writes the schema of a cached table, failing if it was changed since it was
+// read. The caller holds the lock of the table.
+func (cached *cachedTable) saveTable(bucket nats.KeyValue, table *Table) error {
+	data, _ := json.Marshal(table)
+	revision, err := bucket.Update(tableKey(table.Name), data, cached.revision)
+	if err != nil {
+		return fmt.Errorf("failed to save table %s: %v", table.Name, err)
+	}
+	cached.table, cached.revision = table, revision
+	return nil
+}
+
+// putRow writes a row to the bucket and the cache. The caller holds the lock of the table.
+func (cached *cachedTable) putRow(bucket nats.KeyValue, row *Row) error {
+	data, _ := json.Marshal(row)
+	if _, err := bucket.Put(rowKey(cached.table.Name, row.ID), data); err != nil {
+		return fmt.Errorf("failed to write row %d: %v", row.ID, err)
+	}
+	cached.rows[row.ID] = row
+	return nil
+}
+
+// deleteRow removes a row from the bucket and the cache. The caller holds the lock of the
+// table.
+func (cached *cachedTable) deleteRow(bucket nats.KeyValue, id int64) error {
+	if err := bucket.Purge(rowKey(cached.table.Name, id)); err != nil {
+		return fmt.Errorf("failed to delete row %d: %v", id, err)
+	}
+	delete(cached.rows, id)
+	return nil
+}
+
+// loadTable reads a table from the cache, writing a 404 response when it doesn't exist
+func (s *Server) loadTable(w http.ResponseWriter, r *http.Request, name string) (nats.KeyValue, *cachedTable, bool) {
+	if !tableName.MatchString(name) {
+		toolkit.WriteError(w, http.StatusBadRequest, "table must be 1 to 64 letters, digits, - or _")
+		return nil, nil, false
+	}
+	bucket, err := s.getBucket(getPrefixFromEnv(r.Header))
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return nil, nil, false
+	}
+	cached, err := s.cache.get(bucket, name)
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		toolkit.WriteError(w, http.StatusNotFound, fmt.Sprintf("table %s does not exist", name))
+		return nil, nil, false
+	}
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return nil, nil, false
+	}
+	return bucket, cached, true
+}
+
+// createTable stores the schema of a new table
+func createTable(bucket nats.KeyValue, name string, columns []Column) (*Table, error) {
+	table := &Table{Name: name, Columns: columns, Created: time.Now().UTC(), NextID: 1}
+	data, _ := json.Marshal(table)
+	if _, err := bucket.Create(tableKey(name), data); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+func (s *Server) handleCreateTable(w http.ResponseWriter, r *http.Request) {
+	var req TableRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if !tableName.MatchString(req.Name) {
+		toolkit.WriteError(w, http.StatusBadRequest, "name must be 1 to 64 letters, digits, - or _")
+		return
+	}
+	if len(req.Columns) == 0 {
+		toolkit.WriteError(w, http.StatusBadRequest, "columns are required")
+		return
+	}
+	if err := validateColumns(req.Columns); err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	bucket, err := s.getBucket(getPrefixFromEnv(r.Header))
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	table, err := createTable(bucket, req.Name, req.Columns)
+	if errors.Is(err, nats.ErrKeyExists) {
+		toolkit.WriteError(w, http.StatusConflict, fmt.Sprintf("table %s already exists", req.Name))
+		return
+	}
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: table})
+}
+
+func (s *Server) handleListTables(w http.ResponseWriter, r *http.Request) {
+	bucket, err := s.getBucket(getPrefixFromEnv(r.Header))
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	watcher, err := bucket.Watch("table.*", nats.IgnoreDeletes())
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer watcher.Stop()
+
+	tables := make([]Table, 0)
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		var table Table
+		if err := json.Unmarshal(entry.Value(), &table); err != nil {
+			continue
+		}
+		if cached, err := s.cache.get(bucket, table.Name); err == nil {
+			cached.lock.RLock()
+			table.Rows = len(cached.rows)
+			cached.lock.RUnlock()
+		}
+		tables = append(tables, table)
+	}
+	slices.SortFunc(tables, func(a, b Table) int { return strings.Compare(a.Name, b.Name) })
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: tables})
+}
+
+// handleAlterTable adds and drops columns. Dropped columns are removed from every row, so a
+// column added later with the same name starts out empty.
+func (s *Server) handleAlterTable(w http.ResponseWriter, r *http.Request) {
+	var req AlterTableRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if len(req.AddColumns) == 0 && len(req.DropColumns) == 0 {
+		toolkit.WriteError(w, http.StatusBadRequest, "add_columns or drop_columns is required")
+		return
+	}
+	bucket, cached, ok := s.loadTable(w, r, req.Name)
+	if !ok {
+		return
+	}
+	cached.lock.Lock()
+	defer cached.lock.Unlock()
+
+	table := *cached.table
+	table.Columns = slices.DeleteFunc(slices.Clone(table.Columns), func(column Column) bool {
+		return slices.Contains(req.DropColumns, column.Name)
+	})
+	for _, name := range req.DropColumns {
+		if _, ok := cached.table.column(name); !ok {
+			toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("table %s has no column %s", table.Name, name))
+			return
+		}
+	}
+	for _, column := range req.AddColumns {
+		if column.Required && len(cached.rows) > 0 {
+			toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("column %s can't be required, the rows of the table have no value for it", column.Name))
+			return
+		}
+		table.Columns = append(table.Columns, column)
+	}
+	if err := validateColumns(table.Columns); err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// The schema is saved first, so rows are read without the dropped columns even if
+	// rewriting them fails part way
+	if err := cached.saveTable(bucket, &table); err != nil {
+		s.cache.drop(bucket, table.Name)
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(req.DropColumns) > 0 {
+		for _, row := range cached.rows {
+			values := map[string]interface{}{}
+			for name, value := range row.Values {
+				if !slices.Contains(req.DropColumns, name) {
+					values[name] = value
+				}
+			}
+			if len(values) == len(row.Values) {
+				continue
+			}
+			if err := cached.putRow(bucket, &Row{ID: row.ID, Values: values}); err != nil {
+				toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: table})
+}
+
+// handleDeleteTable removes a table with all its rows
+func (s *Server) handleDeleteTable(w http.ResponseWriter, r *http.Request) {
+	var req TableRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	bucket, cached, ok := s.loadTable(w, r, req.Name)
+	if !ok {
+		return
+	}
+	// The table is removed first, so it is gone even if some rows are left behind
+	if err := bucket.Purge(tableKey(req.Name)); err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	cached.lock.Lock()
+	defer cached.lock.Unlock()
+	s.cache.drop(bucket, req.Name)
+	for id := range cached.rows {
+		if err := bucket.Purge(rowKey(req.Name, id)); err != nil {
+			toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to delete row %d: %v", id, err))
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCoerce(t *testing.T) {
+	tests := []struct {
+		columnType string
+		value      interface{}
+		want       interface{}
+	}{
+		{typeString, json.Number("42"), "42"},
+		{typeString, "", ""},
+		{typeInteger, "42", int64(42)},
+		{typeInteger, json.Number("9007199254740993"), int64(9007199254740993)},
+		{typeInteger, json.Number("5.0"), int64(5)},
+		{typeInteger, " ", nil},
+		{typeNumber, "2.5", 2.5},
+		{typeBoolean, "Yes", true},
+		{typeBoolean, json.Number("0"), false},
+		{typeDate, "2024-03-01", "2024-03-01"},
+		{typeDate, "2024-03-01T10:00:00+02:00", "2024-03-01T08:00:00Z"},
+	}
+	for _, tt := range tests {
+		got, err := coerce(tt.columnType, tt.value)
+		if err != nil || got != tt.want {
+			t.Errorf("coerce(%s, %#v) = %#v, %v, want %#v", tt.columnType, tt.value, got, err, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		columnType string
+		value      interface{}
+	}{
+		{typeInteger, "2.5"},
+		{typeInteger, true},
+		{typeNumber, "NaN"},
+		{typeBoolean, "maybe"},
+		{typeDate, "03/01/2024"},
+		{typeString, map[string]interface{}{}},
+	} {
+		if got, err := coerce(tt.columnType, tt.value); err == nil {
+			t.Errorf("coerce(%s, %#v) = %#v, want an error", tt.columnType, tt.value, got)
+		}
+	}
+}
+
+func TestInferType(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   string
+	}{
+		{[]string{"1", "", "30"}, typeInteger},
+		{[]string{"1", "2.5"}, typeNumber},
+		{[]string{"true", "no"}, typeBoolean},
+		{[]string{"2024-01-01", "2024-02-01T10:00:00Z"}, typeDate},
+		{[]string{"1", "x"}, typeString},
+		{[]string{"", ""}, typeString},
+	}
+	for _, tt := range tests {
+		if got := inferType(tt.values); got != tt.want {
+			t.Errorf("inferType(%q) = %s, want %s", tt.values, got, tt.want)
+		}
+	}
+}
+
+func testTable() *cachedTable {
+	table := &Table{Name: "people", Columns: []Column{
+		{Name: "name", Type: typeString, Required: true},
+		{Name: "age", Type: typeInteger},
+		{Name: "joined", Type: typeDate},
+	}}
+	cached := &cachedTable{table: table, rows: map[int64]*Row{}}
+	for i, values := range []map[string]interface{}{
+		{"name": "Ada", "age": int64(36), "joined": "2020-01-01"},
+		{"name": "Grace", "age": int64(45)},
+		{"name": "alan", "age": int64(41), "joined": "2021-06-01"},
+		{"name": "Linus"},
+	} {
+		cached.rows[int64(i+1)] = newRow(int64(i+1), values)
+	}
+	return cached
+}
+
+func names(rows []*Row) []string {
+	var names []string
+	for _, row := range rows {
+		names = append(names, row.Values["name"].(string))
+	}
+	return names
+}
+
+func TestSelectRows(t *testing.T) {
+	cached := testTable()
+	tests := []struct {
+		filter string
+		sort   []string
+		want   []string
+	}{
+		{`[{"column": "age", "op": ">", "value": "40"}]`, []string{"-age"}, []string{"Grace", "alan"}},
+		{`{"joined": null}`, nil, []string{"Grace", "Linus"}},
+		{`[{"column": "name", "op": "starts_with", "value": "A"}]`, []string{"name desc"}, []string{"alan", "Ada"}},
+		{`[{"column": "age", "op": "ne", "value": 36}]`, []string{"age"}, []string{"Linus", "alan", "Grace"}},
+		{`[{"column": "id", "op": "in", "value": [1, 4]}]`, nil, []string{"Ada", "Linus"}},
+		{`"[{\"column\": \"joined\", \"op\": \"gte\", \"value\": \"2021-01-01\"}]"`, nil, []string{"alan"}},
+	}
+	for _, tt := range tests {
+		var filter conditionList
+		if err := json.Unmarshal([]byte(tt.filter), &filter); err != nil {
+			t.Fatalf("%s: %v", tt.filter, err)
+		}
+		conditions, err := prepareConditions(cached.table, filter)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.filter, err)
+		}
+		keys, err := parseSort(cached.table, tt.sort)
+		if err != nil {
+			t.Fatalf("%v: %v", tt.sort, err)
+		}
+		got := names(cached.selectRows(conditions, keys))
+		if len(got) != len(tt.want) {
+			t.Errorf("%s sorted by %v = %q, want %q", tt.filter, tt.sort, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s sorted by %v = %q, want %q", tt.filter, tt.sort, got, tt.want)
+				break
+			}
+		}
+	}
+
+	if _, err := prepareConditions(cached.table, []Condition{{Column: "height", Value: 1}}); err == nil {
+		t.Errorf("unknown column accepted")
+	}
+	if _, err := prepareConditions(cached.table, []Condition{{Column: "age", Op: "like", Value: 1}}); err == nil {
+		t.Errorf("unknown operator accepted")
+	}
+	if _, err := parseSort(cached.table, []string{"height"}); err == nil {
+		t.Errorf("unknown sort column accepted")
+	}
+}
+
+func TestValidateValues(t *testing.T) {
+	table := testTable().table
+	if _, err := validateValues(table, map[string]interface{}{"age": "3"}, false); err == nil {
+		t.Errorf("row without a required column accepted")
+	}
+	if _, err := validateValues(table, map[string]interface{}{"age": "3"}, true); err != nil {
+		t.Errorf("update without the required column rejected: %v", err)
+	}
+	if _, err := validateValues(table, map[string]interface{}{"name": nil}, true); err == nil {
+		t.Errorf("update clearing a required column accepted")
+	}
+	if _, err := validateValues(table, map[string]interface{}{"name": "x", "id": 3}, false); err == nil {
+		t.Errorf("row setting its id accepted")
+	}
+	values, err := validateValues(table, map[string]interface{}{"name": "x", "age": json.Number("7")}, false)
+	if err != nil || values["age"] != int64(7) {
+		t.Errorf("values = %v, %v", values, err)
+	}
+}
+
+func TestParseCSV(t *testing.T) {
+	header, rows, err := parseCSV("\ufeffid,name, age\n1,Ada,36\n2,\"Hopper, Grace\",\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header) != 2 || header[0] != "name" || header[1] != "age" {
+		t.Errorf("header = %q, want the id column left out", header)
+	}
+	if len(rows) != 2 || rows[1][0] != "Hopper, Grace" || rows[1][1] != "" {
+		t.Errorf("rows = %q", rows)
+	}
+	columns := inferColumns(header, rows)
+	if columns[0].Type != typeString || columns[1].Type != typeInteger {
+		t.Errorf("columns = %+v", columns)
+	}
+
+	if _, _, err := parseCSV("a,b\n1\n"); err == nil {
+		t.Errorf("rows with missing fields accepted")
+	}
+}
+
+func TestRowJSON(t *testing.T) {
+	table := testTable().table
+	data, _ := json.Marshal(newRow(12, map[string]interface{}{"name": "Ada", "age": int64(36), "joined": nil}))
+	if string(data) != `{"age":36,"id":12,"name":"Ada"}` {
+		t.Errorf("row = %s", data)
+	}
+	row, err := decodeRow(table, data)
+	if err != nil || row.ID != 12 || row.Values["age"] != int64(36) {
+		t.Errorf("decoded row = %+v, %v", row, err)
+	}
+}
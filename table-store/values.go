@@ -0,0 +1,226 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Column types. Values are coerced to the type of their column when written, so strings
+// such as "42" or "yes" from CSV files and tool parameters are stored as what they mean.
+const (
+	typeString  = "string"
+	typeInteger = "integer"
+	typeNumber  = "number"
+	typeBoolean = "boolean"
+	typeDate    = "date"
+)
+
+var columnTypes = []string{typeString, typeInteger, typeNumber, typeBoolean, typeDate}
+
+// Dates are stored as text in one of these layouts, which sort in time order
+const (
+	dateLayout     = "2006-01-02"
+	dateTimeLayout = time.RFC3339
+)
+
+// coerce converts a value to the type of a column. Empty strings are null in columns that
+// aren't strings, as that is how CSV files leave out values.
+func coerce(columnType string, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	if str, ok := value.(string); ok && columnType != typeString {
+		if value = strings.TrimSpace(str); value == "" {
+			return nil, nil
+		}
+	}
+
+	switch columnType {
+	case typeString:
+		switch v := value.(type) {
+		case string:
+			return v, nil
+		case json.Number:
+			return v.String(), nil
+		case float64:
+			return strconv.FormatFloat(v, 'f', -1, 64), nil
+		case int64:
+			return strconv.FormatInt(v, 10), nil
+		case bool:
+			return strconv.FormatBool(v), nil
+		}
+	case typeInteger:
+		switch v := value.(type) {
+		case int64:
+			return v, nil
+		case json.Number:
+			return parseInteger(v.String())
+		case string:
+			return parseInteger(v)
+		case float64:
+			if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+				return int64(v), nil
+			}
+			return nil, fmt.Errorf("%v is not an integer", v)
+		}
+	case typeNumber:
+		var f float64
+		var err error
+		switch v := value.(type) {
+		case float64:
+			f = v
+		case int64:
+			f = float64(v)
+		case json.Number:
+			f, err = v.Float64()
+		case string:
+			f, err = strconv.ParseFloat(v, 64)
+		default:
+			return nil, fmt.Errorf("%v can't be stored in a %s column", value, columnType)
+		}
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("%v is not a number", value)
+		}
+		return f, nil
+	case typeBoolean:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			switch strings.ToLower(v) {
+			case "true", "yes", "y", "1":
+				return true, nil
+			case "false", "no", "n", "0":
+				return false, nil
+			}
+			return nil, fmt.Errorf("%q is not a boolean", v)
+		case json.Number:
+			switch v.String() {
+			case "1":
+				return true, nil
+			case "0":
+				return false, nil
+			}
+		}
+	case typeDate:
+		if v, ok := value.(string); ok {
+			return parseDate(v)
+		}
+	}
+	return nil, fmt.Errorf("%v can't be stored in a %s column", value, columnType)
+}
+
+// parseInteger also accepts whole numbers written with a fraction, such as 5.0
+func parseInteger(str string) (int64, error) {
+	if i, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(str, 64); err == nil && f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+		return int64(f), nil
+	}
+	return 0, fmt.Errorf("%q is not an integer", str)
+}
+
+// parseDate accepts a date or a date and time, returning the date as is and the time in UTC
+func parseDate(str string) (string, error) {
+	if t, err := time.Parse(dateLayout, str); err == nil {
+		return t.Format(dateLayout), nil
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02 15:04"} {
+		if t, err := time.Parse(layout, str); err == nil {
+			return t.UTC().Format(dateTimeLayout), nil
+		}
+	}
+	return "", fmt.Errorf("%q is not a date, use YYYY-MM-DD or an RFC 3339 date and time", str)
+}
+
+// compareValues orders two values of the same column, with nulls first
+func compareValues(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return -1
+	case b == nil:
+		return 1
+	}
+	switch a := a.(type) {
+	case string:
+		if b, ok := b.(string); ok {
+			return strings.Compare(a, b)
+		}
+	case int64:
+		switch b := b.(type) {
+		case int64:
+			return cmp.Compare(a, b)
+		case float64:
+			return cmp.Compare(float64(a), b)
+		}
+	case float64:
+		switch b := b.(type) {
+		case float64:
+			return cmp.Compare(a, b)
+		case int64:
+			return cmp.Compare(a, float64(b))
+		}
+	case bool:
+		if b, ok := b.(bool); ok {
+			switch {
+			case a == b:
+				return 0
+			case !a:
+				return -1
+			}
+			return 1
+		}
+	}
+	return strings.Compare(formatValue(a), formatValue(b))
+}
+
+// formatValue returns the text of a value, as written to CSV files
+func formatValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return fmt.Sprint(value)
+}
+
+// inferType returns the narrowest column type all the values of a CSV column fit,
+// ignoring empty values
+func inferType(values []string) string {
+	candidates := []string{typeInteger, typeNumber, typeBoolean, typeDate}
+	seen := false
+	for _, value := range values {
+		if strings.TrimSpace(value) == "" {
+			continue
+		}
+		seen = true
+		fits := candidates[:0]
+		for _, candidate := range candidates {
+			if _, err := coerce(candidate, value); err == nil {
+				fits = append(fits, candidate)
+			}
+		}
+		if candidates = fits; len(candidates) == 0 {
+			return typeString
+		}
+	}
+	if !seen {
+		return typeString
+	}
+	return candidates[0]
+}
@@ -0,0 +1,66 @@
+package toolkit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Response is the body of every response of the tools
+type Response struct {
+	Success bool        `json:"success"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// GPTScriptEnv extracts environment values from the X-GPTScript-Env header
+func GPTScriptEnv(headers http.Header, envKey string) string {
+	for _, env := range headers[http.CanonicalHeaderKey("X-Gptscript-Env")] {
+		for _, pair := range strings.Split(env, ",") {
+			key, value, ok := strings.Cut(pair, "=")
+			if ok && strings.TrimSpace(key) == envKey {
+				return strings.TrimSpace(value)
+			}
+		}
+	}
+	return ""
+}
+
+// WriteError writes a failed response
+func WriteError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Response{Success: false, Error: message})
+}
+
+// DecodeRequest decodes a request body, writing a 400 response when it is invalid
+func DecodeRequest(w http.ResponseWriter, r *http.Request, req interface{}) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(req); err != nil {
+		WriteError(w, http.StatusBadRequest, fmt.Sprintf("invalid request body: %v", err))
+		return false
+	}
+	return true
+}
+
+// ResponseWriter is a wrapper for http.ResponseWriter that captures the status code
+type ResponseWriter struct {
+	http.ResponseWriter
+	Status int
+}
+
+// NewResponseWriter wraps a response writer, whose status is 200 until one is written
+func NewResponseWriter(w http.ResponseWriter) *ResponseWriter {
+	return &ResponseWriter{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (rw *ResponseWriter) WriteHeader(code int) {
+	rw.Status = code
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap lets http.ResponseController reach the wrapped writer, e.g. to flush streams
+func (rw *ResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
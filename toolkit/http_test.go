@@ -0,0 +1,38 @@
+package toolkit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGPTScriptEnv(t *testing.T) {
+	headers := http.Header{}
+	headers.Add("X-GPTScript-Env", "OTHER=1, GPTSCRIPT_WORKSPACE_ID = ws1")
+	if got := GPTScriptEnv(headers, "GPTSCRIPT_WORKSPACE_ID"); got != "ws1" {
+		t.Errorf("GPTScriptEnv = %q, want ws1", got)
+	}
+	if got := GPTScriptEnv(headers, "MISSING"); got != "" {
+		t.Errorf("GPTScriptEnv of a missing key = %q", got)
+	}
+}
+
+func TestDecodeRequest(t *testing.T) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	w := NewResponseWriter(httptest.NewRecorder())
+	if !DecodeRequest(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"name": "a"}`)), &req) || req.Name != "a" || w.Status != http.StatusOK {
+		t.Errorf("valid request: %+v, status %d", req, w.Status)
+	}
+
+	recorder := httptest.NewRecorder()
+	w = NewResponseWriter(recorder)
+	if DecodeRequest(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"other": 1}`)), &req) {
+		t.Error("unknown fields should be rejected")
+	}
+	if w.Status != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), `"success":false`) {
+		t.Errorf("invalid request: status %d, body %s", w.Status, recorder.Body)
+	}
+}
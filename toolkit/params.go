@@ -0,0 +1,171 @@
+// Package toolkit holds the request handling shared by the HTTP tools. GPTScript passes
+// tool parameters as plain strings, so request fields that are not strings accept both
+// their JSON type and a string form.
+package toolkit
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StringList is a list of strings that can also be given as a comma separated string
+type StringList []string
+
+func (l *StringList) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err == nil {
+		*l = list
+		return nil
+	}
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("expected a list or a comma separated string")
+	}
+	*l = nil
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// Int is an integer that can also be given as a string
+type Int int64
+
+func (i *Int) UnmarshalJSON(data []byte) error {
+	var value int64
+	if err := json.Unmarshal(data, &value); err == nil {
+		*i = Int(value)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("expected an integer")
+	}
+	if str = strings.TrimSpace(str); str == "" {
+		*i = 0
+		return nil
+	}
+	value, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return fmt.Errorf("expected an integer, got %q", str)
+	}
+	*i = Int(value)
+	return nil
+}
+
+// Bool is a boolean that can also be given as a string such as "true" or "false"
+type Bool bool
+
+func (b *Bool) UnmarshalJSON(data []byte) error {
+	var value bool
+	if err := json.Unmarshal(data, &value); err == nil {
+		*b = Bool(value)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("expected a boolean")
+	}
+	if str = strings.TrimSpace(str); str == "" {
+		*b = false
+		return nil
+	}
+	value, err := strconv.ParseBool(str)
+	if err != nil {
+		return fmt.Errorf("expected a boolean, got %q", str)
+	}
+	*b = Bool(value)
+	return nil
+}
+
+// Duration is a duration given as a string such as 30s or 2m, or as a number of seconds
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var seconds float64
+	if err := json.Unmarshal(data, &seconds); err == nil {
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("expected a duration")
+	}
+	if str = strings.TrimSpace(str); str == "" {
+		*d = 0
+		return nil
+	}
+	if seconds, err := strconv.ParseFloat(str, 64); err == nil {
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+	value, err := time.ParseDuration(str)
+	if err != nil {
+		return fmt.Errorf("expected a duration such as 30s, got %q", str)
+	}
+	*d = Duration(value)
+	return nil
+}
+
+// JSONObject is a JSON object that can also be given as a string holding a JSON object
+type JSONObject map[string]interface{}
+
+func (o *JSONObject) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		if strings.TrimSpace(str) == "" {
+			*o = nil
+			return nil
+		}
+		data = []byte(str)
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return fmt.Errorf("expected a JSON object")
+	}
+	*o = object
+	return nil
+}
+
+// StringMap is an object of string values that can also be given as a string holding a
+// JSON object. Numbers and booleans are taken as their text, so {"attempt": 2} works.
+type StringMap map[string]string
+
+func (m *StringMap) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		if strings.TrimSpace(str) == "" {
+			*m = nil
+			return nil
+		}
+		data = []byte(str)
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		return fmt.Errorf("expected a JSON object")
+	}
+	*m = make(StringMap, len(object))
+	for name, raw := range object {
+		var value interface{}
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		if err := decoder.Decode(&value); err != nil {
+			return fmt.Errorf("expected a JSON object")
+		}
+		switch value := value.(type) {
+		case string:
+			(*m)[name] = value
+		case json.Number, bool:
+			(*m)[name] = fmt.Sprint(value)
+		default:
+			return fmt.Errorf("the value of %s must be a string, number or boolean", name)
+		}
+	}
+	return nil
+}
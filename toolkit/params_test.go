@@ -0,0 +1,47 @@
+package toolkit
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParams(t *testing.T) {
+	var req struct {
+		IDs     StringList `json:"ids"`
+		Depth   Int        `json:"depth"`
+		Merge   Bool       `json:"merge"`
+		Timeout Duration   `json:"timeout"`
+		Seconds Duration   `json:"seconds"`
+		Props   JSONObject `json:"props"`
+		Labels  StringMap  `json:"labels"`
+	}
+	data := `{"ids": "a, b", "depth": "2", "merge": "true", "timeout": "1m", "seconds": 2.5, "props": "{\"x\": 1}", "labels": {"attempt": 2, "ok": true}}`
+	if err := json.Unmarshal([]byte(data), &req); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]string(req.IDs), []string{"a", "b"}) || req.Depth != 2 || !bool(req.Merge) || req.Props["x"] != 1.0 {
+		t.Errorf("unexpected params %+v", req)
+	}
+	if time.Duration(req.Timeout) != time.Minute || time.Duration(req.Seconds) != 2500*time.Millisecond {
+		t.Errorf("unexpected durations %v and %v", req.Timeout, req.Seconds)
+	}
+	if want := (StringMap{"attempt": "2", "ok": "true"}); !reflect.DeepEqual(req.Labels, want) {
+		t.Errorf("labels = %v, want %v", req.Labels, want)
+	}
+
+	// The JSON types are accepted as they are, and empty strings are zero values
+	if err := json.Unmarshal([]byte(`{"ids": ["a,b"], "depth": 3, "merge": "", "props": ""}`), &req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.IDs) != 1 || req.Depth != 3 || bool(req.Merge) || req.Props != nil {
+		t.Errorf("unexpected params %+v", req)
+	}
+
+	for _, invalid := range []string{`{"depth": "two"}`, `{"merge": "maybe"}`, `{"timeout": "soon"}`, `{"props": "[1]"}`, `{"labels": {"a": [1]}}`} {
+		if err := json.Unmarshal([]byte(invalid), &req); err == nil {
+			t.Errorf("%s should be rejected", invalid)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// vector is a list of numbers that can also be given as a string holding a JSON array or
+// comma separated numbers
+type vector []float32
+
+func (v *vector) UnmarshalJSON(data []byte) error {
+	var values []float32
+	if err := json.Unmarshal(data, &values); err == nil {
+		*v = values
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return fmt.Errorf("expected a list of numbers")
+	}
+	str = strings.TrimSpace(str)
+	if strings.HasPrefix(str, "[") {
+		if err := json.Unmarshal([]byte(str), &values); err != nil {
+			return fmt.Errorf("expected a list of numbers")
+		}
+		*v = values
+		return nil
+	}
+	*v = nil
+	for _, item := range strings.Split(str, ",") {
+		value, err := strconv.ParseFloat(strings.TrimSpace(item), 32)
+		if err != nil {
+			return fmt.Errorf("expected a list of numbers, got %q", item)
+		}
+		*v = append(*v, float32(value))
+	}
+	return nil
+}
+
+// pointList is a list of points that can also be given as a string holding a JSON array
+type pointList []Point
+
+func (l *pointList) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		data = []byte(str)
+	}
+	var points []Point
+	if err := json.Unmarshal(data, &points); err != nil {
+		return fmt.Errorf("expected a list of points: %v", err)
+	}
+	*l = points
+	return nil
+}
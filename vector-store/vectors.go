@@ -0,0 +1,586 @@
+package main
+
+import (
+	"container/list"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"toolkit"
+)
+
+// Distance metrics. Cosine and dot rank the highest scores first, l2 the smallest distances.
+const (
+	metricCosine = "cosine"
+	metricDot    = "dot"
+	metricL2     = "l2"
+)
+
+const (
+	maxDimension     = 8192
+	maxUpsertPoints  = 1000
+	maxSearchResults = 1000
+	maxIDLength      = 256
+)
+
+// Collections are stored as collection.<name>, their points as point.<name>.<id>, with the
+// ID base64 encoded so any string can be one
+var collectionName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+type Collection struct {
+	Name      string    `json:"name"`
+	Dimension int       `json:"dimension"`
+	Metric    string    `json:"metric"`
+	Created   time.Time `json:"created"`
+	Points    int       `json:"points,omitempty"`
+}
+
+type Point struct {
+	ID      string             `json:"id"`
+	Vector  vector             `json:"vector,omitempty"`
+	Payload toolkit.JSONObject `json:"payload,omitempty"`
+}
+
+type CollectionRequest struct {
+	Name      string      `json:"name"`
+	Dimension toolkit.Int `json:"dimension,omitempty"`
+	Metric    string      `json:"metric,omitempty"`
+}
+
+type UpsertRequest struct {
+	Collection string    `json:"collection"`
+	Points     pointList `json:"points"`
+}
+
+type PointsRequest struct {
+	Collection  string             `json:"collection"`
+	IDs         toolkit.StringList `json:"ids"`
+	WithVectors toolkit.Bool       `json:"with_vectors,omitempty"`
+}
+
+type SearchRequest struct {
+	Collection  string             `json:"collection"`
+	Vector      vector             `json:"vector"`
+	K           toolkit.Int        `json:"k,omitempty"`
+	Filter      toolkit.JSONObject `json:"filter,omitempty"`
+	WithVectors toolkit.Bool       `json:"with_vectors,omitempty"`
+}
+
+type SearchResult struct {
+	Point
+	Score float64 `json:"score"`
+}
+
+func collectionKey(name string) string {
+	return "collection." + name
+}
+
+func pointKey(collection, id string) string {
+	return "point." + collection + "." + base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+// collectionCache holds the points of the collections searched, so searches don't read the
+// whole collection from the bucket each time. Writes go through the cache. It keeps up to
+// maxPoints points, evicting the least recently used collections first, though the
+// collection used last stays cached whatever its size.
+type collectionCache struct {
+	lock        sync.Mutex
+	maxPoints   int
+	points      int
+	order       *list.List
+	collections map[string]*list.Element
+}
+
+type cachedCollection struct {
+	id     string
+	lock   sync.RWMutex
+	points map[string]*Point
+	// evicted is set, with the lock held, once the collection is no longer cached, so
+	// handlers that got it before then read it again instead of writing to a stale copy
+	evicted bool
+	// size is the points counted towards the limit of the cache, guarded by its lock
+	size int
+}
+
+// newCollectionCache reads VECTOR_CACHE_MAX_POINTS, the points kept in memory
+func newCollectionCache() (*collectionCache, error) {
+	maxPoints, err := strconv.Atoi(getEnvOrDefault("VECTOR_CACHE_MAX_POINTS", "100000"))
+	if err != nil || maxPoints < 1 {
+		return nil, fmt.Errorf("invalid VECTOR_CACHE_MAX_POINTS: must be a positive number of points")
+	}
+	return &collectionCache{maxPoints: maxPoints, order: list.New(), collections: map[string]*list.Element{}}, nil
+}
+
+// read returns the cached points of a collection locked for reading
+func (c *collectionCache) read(bucket nats.KeyValue, collection string) (*cachedCollection, error) {
+	for {
+		cached, err := c.get(bucket, collection)
+		if err != nil {
+			return nil, err
+		}
+		cached.lock.RLock()
+		if !cached.evicted {
+			return cached, nil
+		}
+		cached.lock.RUnlock()
+	}
+}
+
+// write returns the cached points of a collection locked for writing. Writers call resize
+// once they changed the points.
+func (c *collectionCache) write(bucket nats.KeyValue, collection string) (*cachedCollection, error) {
+	for {
+		cached, err := c.get(bucket, collection)
+		if err != nil {
+			return nil, err
+		}
+		cached.lock.Lock()
+		if !cached.evicted {
+			return cached, nil
+		}
+		cached.lock.Unlock()
+	}
+}
+
+// get returns the cached points of a collection, reading them from the bucket the first time
+func (c *collectionCache) get(bucket nats.KeyValue, collection string) (*cachedCollection, error) {
+	id := bucket.Bucket() + "/" + collection
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if element, ok := c.collections[id]; ok {
+		c.order.MoveToFront(element)
+		return element.Value.(*cachedCollection), nil
+	}
+
+	cached := &cachedCollection{id: id, points: map[string]*Point{}}
+	watcher, err := bucket.Watch("point."+collection+".*", nats.IgnoreDeletes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the collection: %v", err)
+	}
+	defer watcher.Stop()
+	// The watcher sends the current values, then nil once it is up to date
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		var point Point
+		if err := json.Unmarshal(entry.Value(), &point); err != nil {
+			return nil, fmt.Errorf("failed to read point %s: %v", entry.Key(), err)
+		}
+		cached.points[point.ID] = &point
+	}
+	cached.size = len(cached.points)
+	c.collections[id] = c.order.PushFront(cached)
+	c.points += cached.size
+	c.evict()
+	return cached, nil
+}
+
+// resize counts the points of a collection after a write, with its write lock held
+func (c *collectionCache) resize(cached *cachedCollection) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if cached.evicted {
+		return
+	}
+	c.points += len(cached.points) - cached.size
+	cached.size = len(cached.points)
+	c.evict()
+}
+
+// evict drops the least recently used collections until the cache is within its limit, with
+// the cache locked. Collections in use are skipped, so no handler holds one while it's
+// evicted.
+func (c *collectionCache) evict() {
+	for element := c.order.Back(); element != nil && element != c.order.Front() && c.points > c.maxPoints; {
+		prev := element.Prev()
+		cached := element.Value.(*cachedCollection)
+		if cached.lock.TryLock() {
+			c.remove(cached)
+			cached.lock.Unlock()
+		}
+		element = prev
+	}
+}
+
+// remove drops a collection, with the cache and the collection locked
+func (c *collectionCache) remove(cached *cachedCollection) {
+	if element, ok := c.collections[cached.id]; ok && element.Value == cached {
+		c.order.Remove(element)
+		delete(c.collections, cached.id)
+		c.points -= cached.size
+	}
+	cached.evicted = true
+}
+
+// drop removes a deleted collection from the cache, with its write lock held
+func (c *collectionCache) drop(cached *cachedCollection) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.remove(cached)
+}
+
+// loadCollection reads the configuration of a collection, writing a 404 response when it
+// doesn't exist
+func (s *Server) loadCollection(w http.ResponseWriter, r *http.Request, name string) (nats.KeyValue, *Collection, bool) {
+	if !collectionName.MatchString(name) {
+		toolkit.WriteError(w, http.StatusBadRequest, "collection must be 1 to 64 letters, digits, - or _")
+		return nil, nil, false
+	}
+	bucket, err := s.getBucket(getPrefixFromEnv(r.Header))
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return nil, nil, false
+	}
+	entry, err := bucket.Get(collectionKey(name))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		toolkit.WriteError(w, http.StatusNotFound, fmt.Sprintf("collection %s does not exist", name))
+		return nil, nil, false
+	}
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return nil, nil, false
+	}
+	var collection Collection
+	if err := json.Unmarshal(entry.Value(), &collection); err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to read collection %s: %v", name, err))
+		return nil, nil, false
+	}
+	return bucket, &collection, true
+}
+
+func (s *Server) handleCreateCollection(w http.ResponseWriter, r *http.Request) {
+	var req CollectionRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if req.Metric == "" {
+		req.Metric = metricCosine
+	}
+	switch {
+	case !collectionName.MatchString(req.Name):
+		toolkit.WriteError(w, http.StatusBadRequest, "name must be 1 to 64 letters, digits, - or _")
+		return
+	case req.Dimension < 1 || req.Dimension > maxDimension:
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("dimension must be between 1 and %d", maxDimension))
+		return
+	case req.Metric != metricCosine && req.Metric != metricDot && req.Metric != metricL2:
+		toolkit.WriteError(w, http.StatusBadRequest, "metric must be cosine, dot or l2")
+		return
+	}
+
+	bucket, err := s.getBucket(getPrefixFromEnv(r.Header))
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	collection := Collection{Name: req.Name, Dimension: int(req.Dimension), Metric: req.Metric, Created: time.Now().UTC()}
+	data, _ := json.Marshal(collection)
+	if _, err := bucket.Create(collectionKey(req.Name), data); err != nil {
+		if errors.Is(err, nats.ErrKeyExists) {
+			toolkit.WriteError(w, http.StatusConflict, fmt.Sprintf("collection %s already exists", req.Name))
+			return
+		}
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: collection})
+}
+
+func (s *Server) handleListCollections(w http.ResponseWriter, r *http.Request) {
+	bucket, err := s.getBucket(getPrefixFromEnv(r.Header))
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	watcher, err := bucket.Watch("collection.*", nats.IgnoreDeletes())
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer watcher.Stop()
+
+	collections := make([]Collection, 0)
+	for entry := range watcher.Updates() {
+		if entry == nil {
+			break
+		}
+		var collection Collection
+		if err := json.Unmarshal(entry.Value(), &collection); err != nil {
+			continue
+		}
+		if cached, err := s.cache.read(bucket, collection.Name); err == nil {
+			collection.Points = len(cached.points)
+			cached.lock.RUnlock()
+		}
+		collections = append(collections, collection)
+	}
+	slices.SortFunc(collections, func(a, b Collection) int { return strings.Compare(a.Name, b.Name) })
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: collections})
+}
+
+// handleDeleteCollection removes a collection with all its points
+func (s *Server) handleDeleteCollection(w http.ResponseWriter, r *http.Request) {
+	var req CollectionRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	bucket, _, ok := s.loadCollection(w, r, req.Name)
+	if !ok {
+		return
+	}
+	cached, err := s.cache.write(bucket, req.Name)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer cached.lock.Unlock()
+	// The collection is removed first, so it is gone even if some points are left behind
+	if err := bucket.Purge(collectionKey(req.Name)); err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	s.cache.drop(cached)
+	for id := range cached.points {
+		if err := bucket.Purge(pointKey(req.Name, id)); err != nil {
+			toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to delete point %s: %v", id, err))
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true})
+}
+
+func (s *Server) handleUpsert(w http.ResponseWriter, r *http.Request) {
+	var req UpsertRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if len(req.Points) == 0 || len(req.Points) > maxUpsertPoints {
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("between 1 and %d points are required", maxUpsertPoints))
+		return
+	}
+	bucket, collection, ok := s.loadCollection(w, r, req.Collection)
+	if !ok {
+		return
+	}
+	for i, point := range req.Points {
+		if err := validatePoint(point, collection.Dimension); err != nil {
+			toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("point %d: %v", i, err))
+			return
+		}
+	}
+
+	cached, err := s.cache.write(bucket, collection.Name)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer cached.lock.Unlock()
+	defer s.cache.resize(cached)
+	for _, point := range req.Points {
+		data, _ := json.Marshal(point)
+		if _, err := bucket.Put(pointKey(collection.Name, point.ID), data); err != nil {
+			toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to write point %s: %v", point.ID, err))
+			return
+		}
+		cached.points[point.ID] = &point
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: map[string]int{"upserted": len(req.Points)}})
+}
+
+func validatePoint(point Point, dimension int) error {
+	if point.ID == "" || len(point.ID) > maxIDLength {
+		return fmt.Errorf("id must be 1 to %d characters", maxIDLength)
+	}
+	if len(point.Vector) != dimension {
+		return fmt.Errorf("vector has %d dimensions, the collection has %d", len(point.Vector), dimension)
+	}
+	for _, x := range point.Vector {
+		if math.IsNaN(float64(x)) || math.IsInf(float64(x), 0) {
+			return fmt.Errorf("vector must only hold finite numbers")
+		}
+	}
+	return nil
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	var req PointsRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	bucket, collection, ok := s.loadCollection(w, r, req.Collection)
+	if !ok {
+		return
+	}
+	cached, err := s.cache.read(bucket, collection.Name)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer cached.lock.RUnlock()
+	points := make([]Point, 0, len(req.IDs))
+	for _, id := range req.IDs {
+		if point, ok := cached.points[id]; ok {
+			points = append(points, withoutVector(*point, bool(req.WithVectors)))
+		}
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: points})
+}
+
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	var req PointsRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if len(req.IDs) == 0 {
+		toolkit.WriteError(w, http.StatusBadRequest, "ids are required")
+		return
+	}
+	bucket, collection, ok := s.loadCollection(w, r, req.Collection)
+	if !ok {
+		return
+	}
+	cached, err := s.cache.write(bucket, collection.Name)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer cached.lock.Unlock()
+	defer s.cache.resize(cached)
+	deleted := 0
+	for _, id := range req.IDs {
+		if _, ok := cached.points[id]; !ok {
+			continue
+		}
+		if err := bucket.Purge(pointKey(collection.Name, id)); err != nil {
+			toolkit.WriteError(w, http.StatusInternalServerError, fmt.Sprintf("failed to delete point %s: %v", id, err))
+			return
+		}
+		delete(cached.points, id)
+		deleted++
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: map[string]int{"deleted": deleted}})
+}
+
+// handleSearch returns the k points nearest to a vector, among those whose payload holds
+// every field of the filter with the same value
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	var req SearchRequest
+	if !toolkit.DecodeRequest(w, r, &req) {
+		return
+	}
+	if req.K == 0 {
+		req.K = 10
+	}
+	if req.K < 0 || req.K > maxSearchResults {
+		toolkit.WriteError(w, http.StatusBadRequest, fmt.Sprintf("k must be between 1 and %d", maxSearchResults))
+		return
+	}
+	bucket, collection, ok := s.loadCollection(w, r, req.Collection)
+	if !ok {
+		return
+	}
+	if err := validatePoint(Point{ID: "query", Vector: req.Vector}, collection.Dimension); err != nil {
+		toolkit.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	cached, err := s.cache.read(bucket, collection.Name)
+	if err != nil {
+		toolkit.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	results := search(cached.points, req.Vector, collection.Metric, int(req.K), req.Filter)
+	cached.lock.RUnlock()
+	for i := range results {
+		results[i].Point = withoutVector(results[i].Point, bool(req.WithVectors))
+	}
+	json.NewEncoder(w).Encode(toolkit.Response{Success: true, Data: results})
+}
+
+// search scores every point matching the filter and keeps the k best
+func search(points map[string]*Point, query []float32, metric string, k int, filter map[string]interface{}) []SearchResult {
+	results := make([]SearchResult, 0, min(k, len(points)))
+	for _, point := range points {
+		if !matchesFilter(point.Payload, filter) {
+			continue
+		}
+		results = append(results, SearchResult{Point: *point, Score: score(metric, query, point.Vector)})
+	}
+	slices.SortFunc(results, func(a, b SearchResult) int {
+		if a.Score == b.Score {
+			return strings.Compare(a.ID, b.ID)
+		}
+		if (a.Score > b.Score) == (metric == metricL2) {
+			return 1
+		}
+		return -1
+	})
+	if len(results) > k {
+		results = results[:k]
+	}
+	return results
+}
+
+// score is the similarity of two vectors for cosine and dot, and their distance for l2
+func score(metric string, a, b []float32) float64 {
+	var dot, normA, normB, dist float64
+	for i := range a {
+		x, y := float64(a[i]), float64(b[i])
+		dot += x * y
+		normA += x * x
+		normB += y * y
+		dist += (x - y) * (x - y)
+	}
+	switch metric {
+	case metricDot:
+		return dot
+	case metricL2:
+		return math.Sqrt(dist)
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// matchesFilter reports whether a payload holds every field of the filter. Values are
+// compared as decoded from JSON, so 1 matches 1.0.
+func matchesFilter(payload, filter map[string]interface{}) bool {
+	for field, want := range filter {
+		got, ok := payload[field]
+		if !ok || !reflect.DeepEqual(normalizeJSON(got), normalizeJSON(want)) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeJSON round trips a value through JSON, so values written by Go and decoded from
+// requests compare equal
+func normalizeJSON(value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return value
+	}
+	var normalized interface{}
+	json.Unmarshal(data, &normalized)
+	return normalized
+}
+
+func withoutVector(point Point, withVector bool) Point {
+	if !withVector {
+		point.Vector = nil
+	}
+	return point
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"toolkit"
+)
+
+func TestScore(t *testing.T) {
+	a, b := []float32{1, 0}, []float32{0, 2}
+	tests := []struct {
+		metric string
+		a, b   []float32
+		want   float64
+	}{
+		{metric: metricCosine, a: a, b: a, want: 1},
+		{metric: metricCosine, a: a, b: b, want: 0},
+		{metric: metricCosine, a: a, b: []float32{0, 0}, want: 0},
+		{metric: metricDot, a: []float32{1, 2}, b: []float32{3, 4}, want: 11},
+		{metric: metricL2, a: []float32{0, 0}, b: []float32{3, 4}, want: 5},
+	}
+	for _, tt := range tests {
+		if got := score(tt.metric, tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("score(%s, %v, %v) = %v, want %v", tt.metric, tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	points := map[string]*Point{
+		"near":  {ID: "near", Vector: vector{1, 0.1}, Payload: toolkit.JSONObject{"kind": "a"}},
+		"far":   {ID: "far", Vector: vector{-1, 0}, Payload: toolkit.JSONObject{"kind": "a"}},
+		"other": {ID: "other", Vector: vector{1, 0}, Payload: toolkit.JSONObject{"kind": "b", "page": 1}},
+	}
+	query := []float32{1, 0}
+
+	results := search(points, query, metricCosine, 2, nil)
+	if len(results) != 2 || results[0].ID != "other" || results[1].ID != "near" {
+		t.Errorf("cosine results = %+v, want other then near", results)
+	}
+	results = search(points, query, metricL2, 3, nil)
+	if len(results) != 3 || results[0].ID != "other" || results[2].ID != "far" {
+		t.Errorf("l2 results = %+v, want the smallest distances first", results)
+	}
+	results = search(points, query, metricCosine, 10, map[string]interface{}{"kind": "a"})
+	if len(results) != 2 || results[0].ID != "near" {
+		t.Errorf("filtered results = %+v, want near and far", results)
+	}
+
+	var filter toolkit.JSONObject
+	if err := json.Unmarshal([]byte(`"{\"page\": 1.0}"`), &filter); err != nil {
+		t.Fatal(err)
+	}
+	if results = search(points, query, metricCosine, 10, filter); len(results) != 1 || results[0].ID != "other" {
+		t.Errorf("numbers must match whatever their form, got %+v", results)
+	}
+}
+
+func TestVectorParam(t *testing.T) {
+	for _, input := range []string{`[1, 2.5]`, `"[1, 2.5]"`, `"1, 2.5"`} {
+		var v vector
+		if err := json.Unmarshal([]byte(input), &v); err != nil || len(v) != 2 || v[1] != 2.5 {
+			t.Errorf("%s decoded to %v, %v", input, v, err)
+		}
+	}
+	var v vector
+	if err := json.Unmarshal([]byte(`"1, x"`), &v); err == nil {
+		t.Errorf("non-numbers must be rejected")
+	}
+}
+
+func TestValidatePoint(t *testing.T) {
+	if err := validatePoint(Point{ID: "a", Vector: vector{1, 2}}, 2); err != nil {
+		t.Errorf("valid point rejected: %v", err)
+	}
+	if err := validatePoint(Point{ID: "a", Vector: vector{1}}, 2); err == nil {
+		t.Errorf("wrong dimension accepted")
+	}
+	if err := validatePoint(Point{Vector: vector{1, 2}}, 2); err == nil {
+		t.Errorf("missing id accepted")
+	}
+	if err := validatePoint(Point{ID: "a", Vector: vector{float32(math.NaN()), 2}}, 2); err == nil {
+		t.Errorf("NaN accepted")
+	}
+}
+
+func TestCollectionCache(t *testing.T) {
+	t.Setenv("VECTOR_CACHE_MAX_POINTS", "3")
+	ns, err := server.NewServer(&server.Options{DontListen: true, NoSigs: true, NoLog: true, JetStream: true, StoreDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	defer ns.Shutdown()
+	if !ns.ReadyForConnections(4 * time.Second) {
+		t.Fatal("failed to start the NATS server")
+	}
+	nc, err := nats.Connect("", nats.InProcessServer(ns))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	s, err := NewServer(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := s.getBucket("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{pointKey("a", "1"), pointKey("a", "2"), pointKey("b", "1"), pointKey("b", "2")} {
+		if _, err := bucket.Put(key, []byte(`{"id":"`+key+`","vector":[1]}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cached := func(collection string) bool {
+		_, ok := s.cache.collections[bucket.Bucket()+"/"+collection]
+		return ok
+	}
+
+	a, err := s.cache.read(bucket, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.lock.RUnlock()
+	b, err := s.cache.read(bucket, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a is evicted to make room for b
+	if cached("a") || !cached("b") || s.cache.points != 2 || !a.evicted {
+		t.Errorf("after reading b: a cached %v, b cached %v, %d points", cached("a"), cached("b"), s.cache.points)
+	}
+
+	// b is in use, so it stays cached past the limit until it's released
+	if a, err = s.cache.read(bucket, "a"); err != nil {
+		t.Fatal(err)
+	}
+	a.lock.RUnlock()
+	if !cached("a") || !cached("b") || s.cache.points != 4 {
+		t.Errorf("with b in use: a cached %v, b cached %v, %d points", cached("a"), cached("b"), s.cache.points)
+	}
+	b.lock.RUnlock()
+
+	// Writes count the points they add, evicting what no longer fits
+	if a, err = s.cache.write(bucket, "a"); err != nil {
+		t.Fatal(err)
+	}
+	a.points["3"] = &Point{ID: "3", Vector: vector{1}}
+	s.cache.resize(a)
+	a.lock.Unlock()
+	if cached("b") || s.cache.points != 3 {
+		t.Errorf("after writing a: b cached %v, %d points", cached("b"), s.cache.points)
+	}
+}